@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// ErrAccountIDCollision is returned by CreateAccount when every ID it
+// generated was taken.
+var ErrAccountIDCollision = errors.New("account id collision")
+
+// maxAccountIDAttempts is how many IDs CreateAccount generates before giving
+// up with ErrAccountIDCollision.
+const maxAccountIDAttempts = 10
+
+// AccountIDGenerator generates the IDs of the accounts CreateAccount opens,
+// so they follow the conventions of the system vaultflow is embedded in. It
+// is called concurrently. An ID it generates may be taken already, in which
+// case it is asked for another.
+type AccountIDGenerator interface {
+	NewAccountID(ctx context.Context) (string, error)
+}
+
+// AccountIDFunc adapts a function to an AccountIDGenerator, e.g. one asking
+// an external system for the IDs.
+type AccountIDFunc func(ctx context.Context) (string, error)
+
+func (f AccountIDFunc) NewAccountID(ctx context.Context) (string, error) {
+	return f(ctx)
+}
+
+// ULIDAccountIDs generates ULIDs made at the time of clock, WallClock if
+// nil, which sort by the time the accounts were created.
+func ULIDAccountIDs(clock Clock) AccountIDGenerator {
+	if clock == nil {
+		clock = WallClock
+	}
+	ids := &ulids{}
+	return AccountIDFunc(func(context.Context) (string, error) {
+		return ids.next(clock.Now()), nil
+	})
+}
+
+// UUIDAccountIDs generates random version 4 UUIDs.
+func UUIDAccountIDs() AccountIDGenerator {
+	return AccountIDFunc(func(context.Context) (string, error) {
+		var b [16]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return "", err
+		}
+		b[6] = b[6]&0x0f | 0x40 // version 4
+		b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+		h := hex.EncodeToString(b[:])
+		return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+	})
+}
+
+// SequentialAccountIDs generates prefix followed by next, next+1 and so on.
+// The IDs taken already are skipped, up to maxAccountIDAttempts at a time,
+// so next should be past the accounts opened by earlier runs.
+func SequentialAccountIDs(prefix string, next int) AccountIDGenerator {
+	var n atomic.Int64
+	n.Store(int64(next) - 1)
+	return AccountIDFunc(func(context.Context) (string, error) {
+		return prefix + strconv.FormatInt(n.Add(1), 10), nil
+	})
+}
+
+// UseAccountIDs makes CreateAccount generate account IDs with g rather than
+// ULIDs. It must be called before operations start.
+func (sm *StateMachine) UseAccountIDs(g AccountIDGenerator) {
+	sm.accountIDs = g
+}
+
+// CreateAccount opens an account with an initial balance, like OpenAccount,
+// under an ID generated by the generator set with UseAccountIDs, and
+// returns the ID. If the ID is taken by an account or an alias another one
+// is generated, up to maxAccountIDAttempts times.
+func (sm *StateMachine) CreateAccount(ctx context.Context, balance int) (string, error) {
+	generator := sm.accountIDs
+	if generator == nil {
+		generator = AccountIDFunc(func(context.Context) (string, error) {
+			return sm.ids.next(sm.now()), nil
+		})
+	}
+
+	var taken []string
+	for range maxAccountIDAttempts {
+		accountId, err := generator.NewAccountID(ctx)
+		if err != nil {
+			return "", fmt.Errorf("generate account id: %w", err)
+		}
+		err = sm.OpenAccountContext(ctx, accountId, balance)
+		if !errors.Is(err, ErrAccountExists) && !errors.Is(err, ErrAliasTaken) {
+			if err != nil {
+				return "", err
+			}
+			return accountId, nil
+		}
+		taken = append(taken, accountId)
+	}
+	return "", fmt.Errorf("%w: %q were all taken", ErrAccountIDCollision, taken)
+}
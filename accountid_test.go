@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestStateMachineCreateAccount(t *testing.T) {
+	quiet(t)
+
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		generator AccountIDGenerator
+		pattern   string
+	}{
+		{"Default", nil, `^[0-9A-HJKMNP-TV-Z]{26}$`},
+		{"ULID", ULIDAccountIDs(NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))), `^01KDVDNA00[0-9A-HJKMNP-TV-Z]{16}$`},
+		{"UUID", UUIDAccountIDs(), `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+		{"Sequential skips taken IDs", SequentialAccountIDs("acc", 1), `^acc3$`},
+		{"External", AccountIDFunc(func(context.Context) (string, error) { return "ext-42", nil }), `^ext-42$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"acc1": 0}}
+			_ = sm.SetAlias("acc2", "acc1")
+			sm.UseAccountIDs(tt.generator)
+
+			id, err := sm.CreateAccount(ctx, 100)
+			if err != nil {
+				t.Fatalf("CreateAccount() error = %v", err)
+			}
+			if !regexp.MustCompile(tt.pattern).MatchString(id) {
+				t.Errorf("CreateAccount() = %q; want it to match %s", id, tt.pattern)
+			}
+			if balance, err := sm.Balance(id); err != nil || balance != 100 {
+				t.Errorf("Balance(%s) = %d, %v; want 100", id, balance, err)
+			}
+		})
+	}
+
+	t.Run("Collision", func(t *testing.T) {
+		sm := &StateMachine{accounts: map[string]int{"acc1": 0}}
+		sm.UseAccountIDs(AccountIDFunc(func(context.Context) (string, error) { return "acc1", nil }))
+		if _, err := sm.CreateAccount(ctx, 0); !errors.Is(err, ErrAccountIDCollision) {
+			t.Errorf("CreateAccount() error = %v; want %v", err, ErrAccountIDCollision)
+		}
+		if sm.Version() != 0 {
+			t.Errorf("Version() = %d; want 0, the collisions saved no state", sm.Version())
+		}
+	})
+
+	t.Run("Generator fails", func(t *testing.T) {
+		unavailable := errors.New("id service unavailable")
+		sm := &StateMachine{accounts: map[string]int{}}
+		sm.UseAccountIDs(AccountIDFunc(func(context.Context) (string, error) { return "", unavailable }))
+		if _, err := sm.CreateAccount(ctx, 0); !errors.Is(err, unavailable) {
+			t.Errorf("CreateAccount() error = %v; want %v", err, unavailable)
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrAccountExists = errors.New("account already exists")
+	// ErrInvalidCursor is returned for page cursors ListAccounts did not
+	// issue.
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// OpenAccount creates an account with an initial balance. Like any other
+// operation it is journaled and can be rolled back, which closes the account
+// again.
+func (sm *StateMachine) OpenAccount(accountId string, balance int) error {
+	return sm.OpenAccountContext(context.Background(), accountId, balance)
+}
+
+// OpenAccountContext is like OpenAccount but gives up without applying
+// anything if ctx is done before the operation starts.
+func (sm *StateMachine) OpenAccountContext(ctx context.Context, accountId string, balance int) error {
+	_, err := sm.ApplyContext(ctx, Operation{Type: OpOpen, To: accountId, Amount: balance})
+	return err
+}
+
+func (sm *StateMachine) applyOpen(op Operation) error {
+	accountId, balance := op.To, op.Amount
+	fmt.Printf("\n\nOpening account %s with %d\n", accountId, balance)
+
+	if _, ok := sm.accounts[accountId]; ok {
+		return fmt.Errorf("%w (%s)", ErrAccountExists, accountId)
+	}
+	if _, ok := sm.aliases.owner(accountId); ok {
+		return fmt.Errorf("%w (%s): an account cannot be opened under an alias", ErrAliasTaken, accountId)
+	}
+
+	sm.saveState(accountId)
+	sm.accounts[accountId] = balance
+	sm.setStatus(accountId, op.Status)
+
+	// Unlike other operations the accounts are not printed afterwards, as
+	// imports open thousands of them.
+	return nil
+}
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// AccountOrder is the order ListAccounts returns accounts in.
+type AccountOrder string
+
+const (
+	OrderByID          AccountOrder = "id"
+	OrderByIDDesc      AccountOrder = "-id"
+	OrderByBalance     AccountOrder = "balance"  // ties ordered by id
+	OrderByBalanceDesc AccountOrder = "-balance" // ties ordered by id
+)
+
+// compare orders a before b.
+func (o AccountOrder) compare(a, b Account) int {
+	switch o {
+	case OrderByIDDesc:
+		return strings.Compare(b.ID, a.ID)
+	case OrderByBalance:
+		return cmp.Or(cmp.Compare(a.Balance, b.Balance), strings.Compare(a.ID, b.ID))
+	case OrderByBalanceDesc:
+		return cmp.Or(cmp.Compare(b.Balance, a.Balance), strings.Compare(a.ID, b.ID))
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+func (o AccountOrder) valid() bool {
+	switch o {
+	case "", OrderByID, OrderByIDDesc, OrderByBalance, OrderByBalanceDesc:
+		return true
+	}
+	return false
+}
+
+// ListOptions select and order the accounts ListAccounts returns.
+type ListOptions struct {
+	Limit  int    // accounts per page, defaultPageSize if 0, at most maxPageSize
+	Cursor string // NextCursor of the previous page, empty for the first page
+
+	MinBalance *int     // nil means no lower bound
+	MaxBalance *int     // nil means no upper bound
+	Tags       []string // accounts must have every tag
+
+	Order AccountOrder // OrderByID if empty
+}
+
+// AccountPage is a page of accounts. NextCursor is empty on the last page.
+type AccountPage struct {
+	Accounts   []Account `json:"accounts"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+}
+
+// ListAccounts returns a page of the accounts matching opts. Pages are read
+// from the current state, so an account changing between pages may be
+// skipped or listed twice when ordering by balance.
+//
+// Each page filters every account but only sorts the matching ones after
+// the cursor, so paging through millions of accounts never copies the whole
+// state.
+func (sm *StateMachine) ListAccounts(opts ListOptions) (AccountPage, error) {
+	if opts.Limit < 0 {
+		return AccountPage{}, fmt.Errorf("%w: negative limit", errBadRequest)
+	}
+	if !opts.Order.valid() {
+		return AccountPage{}, fmt.Errorf("%w: unknown order %q", errBadRequest, opts.Order)
+	}
+	limit := opts.Limit
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	var after *Account
+	if opts.Cursor != "" {
+		cursor, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return AccountPage{}, err
+		}
+		after = &cursor
+	}
+
+	sm.mu.Lock()
+	var matches []Account
+	for id, balance := range sm.accounts {
+		if isBucketKey(id) {
+			continue
+		}
+		account := Account{ID: id, Balance: balance}
+		if after != nil && opts.Order.compare(account, *after) <= 0 {
+			continue
+		}
+		if opts.MinBalance != nil && balance < *opts.MinBalance || opts.MaxBalance != nil && balance > *opts.MaxBalance {
+			continue
+		}
+		if !hasTags(sm.tags[id], opts.Tags) {
+			continue
+		}
+		account.Tags = slices.Clone(sm.tags[id])
+		matches = append(matches, account)
+	}
+	sm.mu.Unlock()
+
+	slices.SortFunc(matches, opts.Order.compare)
+
+	page := AccountPage{Accounts: matches[:min(limit, len(matches))]}
+	if page.Accounts == nil {
+		page.Accounts = []Account{}
+	}
+	if len(matches) > limit {
+		page.NextCursor = encodeCursor(page.Accounts[limit-1])
+	}
+	return page, nil
+}
+
+func hasTags(tags, required []string) bool {
+	for _, tag := range required {
+		if !slices.Contains(tags, tag) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeCursor returns a cursor pointing after account. It holds the balance
+// as well as the id, so pages ordered by balance can resume after it.
+func encodeCursor(account Account) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(account.Balance) + ":" + account.ID))
+}
+
+func decodeCursor(cursor string) (Account, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return Account{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	balance, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return Account{}, ErrInvalidCursor
+	}
+	b, err := strconv.Atoi(balance)
+	if err != nil {
+		return Account{}, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return Account{ID: id, Balance: b}, nil
+}
+
+// SetAccountTags replaces the tags of an account, used to filter
+// ListAccounts. Tags are metadata: they are not versioned and rollbacks do not
+// touch them.
+func (sm *StateMachine) SetAccountTags(accountId string, tags ...string) error {
+	if sm.readOnly {
+		return ErrReadOnly
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.accounts[accountId]; !ok {
+		return fmt.Errorf("%w (%s)", ErrInvalidAccount, accountId)
+	}
+
+	if len(tags) == 0 {
+		delete(sm.tags, accountId)
+		return nil
+	}
+	if sm.tags == nil {
+		sm.tags = map[string][]string{}
+	}
+	sm.tags[accountId] = slices.Compact(slices.Sorted(slices.Values(tags)))
+	return nil
+}
+
+// AccountTags returns the tags of an account, sorted.
+func (sm *StateMachine) AccountTags(accountId string) []string {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return slices.Clone(sm.tags[accountId])
+}
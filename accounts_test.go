@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func newListStateMachine() *StateMachine {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 300, "acc2": 100, "acc3": 200, "acc4": 100, "acc5": 0},
+	}
+	_ = sm.SetAccountTags("acc1", "retail", "vip")
+	_ = sm.SetAccountTags("acc3", "retail")
+	_ = sm.SetAccountTags("acc4", "vip", "retail", "vip")
+	return sm
+}
+
+func accountIds(accounts []Account) []string {
+	ids := make([]string, len(accounts))
+	for i, account := range accounts {
+		ids[i] = account.ID
+	}
+	return ids
+}
+
+func TestListAccounts(t *testing.T) {
+	sm := newListStateMachine()
+	one, twoHundred := 1, 200
+
+	tests := []struct {
+		name        string
+		opts        ListOptions
+		expected    []string
+		expectedErr error
+	}{
+		{name: "All", opts: ListOptions{}, expected: []string{"acc1", "acc2", "acc3", "acc4", "acc5"}},
+		{name: "By id descending", opts: ListOptions{Order: OrderByIDDesc}, expected: []string{"acc5", "acc4", "acc3", "acc2", "acc1"}},
+		{name: "By balance", opts: ListOptions{Order: OrderByBalance}, expected: []string{"acc5", "acc2", "acc4", "acc3", "acc1"}},
+		{name: "By balance descending", opts: ListOptions{Order: OrderByBalanceDesc}, expected: []string{"acc1", "acc3", "acc2", "acc4", "acc5"}},
+		{name: "Balance range", opts: ListOptions{MinBalance: &one, MaxBalance: &twoHundred}, expected: []string{"acc2", "acc3", "acc4"}},
+		{name: "One tag", opts: ListOptions{Tags: []string{"retail"}}, expected: []string{"acc1", "acc3", "acc4"}},
+		{name: "Every tag", opts: ListOptions{Tags: []string{"retail", "vip"}}, expected: []string{"acc1", "acc4"}},
+		{name: "Limit", opts: ListOptions{Limit: 2}, expected: []string{"acc1", "acc2"}},
+		{name: "Unknown order", opts: ListOptions{Order: "name"}, expectedErr: errBadRequest},
+		{name: "Negative limit", opts: ListOptions{Limit: -1}, expectedErr: errBadRequest},
+		{name: "Invalid cursor", opts: ListOptions{Cursor: "!!"}, expectedErr: ErrInvalidCursor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := sm.ListAccounts(tt.opts)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("ListAccounts = %v; want %v", err, tt.expectedErr)
+			}
+			if ids := accountIds(page.Accounts); err == nil && !slices.Equal(ids, tt.expected) {
+				t.Errorf("ListAccounts = %v; want %v", ids, tt.expected)
+			}
+		})
+	}
+
+	if page, _ := sm.ListAccounts(ListOptions{Tags: []string{"vip"}}); !slices.Equal(page.Accounts[0].Tags, []string{"retail", "vip"}) {
+		t.Errorf("Tags of acc1 = %v; want [retail vip]", page.Accounts[0].Tags)
+	}
+}
+
+func TestListAccountsPages(t *testing.T) {
+	sm := &StateMachine{accounts: map[string]int{}}
+	for i := range 250 {
+		sm.accounts[fmt.Sprintf("acc%03d", i)] = i % 7
+	}
+
+	for _, order := range []AccountOrder{OrderByID, OrderByIDDesc, OrderByBalance, OrderByBalanceDesc} {
+		t.Run(string(order), func(t *testing.T) {
+			var listed []Account
+			opts := ListOptions{Limit: 40, Order: order}
+			for pages := 1; ; pages++ {
+				page, err := sm.ListAccounts(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				listed = append(listed, page.Accounts...)
+				if page.NextCursor == "" {
+					if pages != 7 {
+						t.Errorf("Listed %d pages; want 7", pages)
+					}
+					break
+				}
+				opts.Cursor = page.NextCursor
+			}
+
+			if len(listed) != 250 || !slices.IsSortedFunc(listed, order.compare) {
+				t.Errorf("Listed %d accounts, sorted %v; want 250, sorted", len(listed), slices.IsSortedFunc(listed, order.compare))
+			}
+		})
+	}
+}
+
+func TestServerListAccounts(t *testing.T) {
+	srv, _ := newTestServer(map[string]int{"acc1": 300, "acc2": 100, "acc3": 200})
+
+	tests := []struct {
+		name           string
+		method, path   string
+		body           string
+		expectedStatus int
+		expected       string
+	}{
+		{name: "Tag", method: "PUT", path: "/accounts/acc2/tags", body: `{"tags": ["vip"]}`, expectedStatus: http.StatusOK, expected: `{"id":"acc2","tags":["vip"]}`},
+		{name: "Tag unknown account", method: "PUT", path: "/accounts/nope/tags", body: `{"tags": ["vip"]}`, expectedStatus: http.StatusNotFound},
+		{name: "First page", method: "GET", path: "/accounts?limit=2&order=-balance", expectedStatus: http.StatusOK,
+			expected: `{"accounts":[{"id":"acc1","balance":300},{"id":"acc3","balance":200}],"next_cursor":"` + encodeCursor(Account{ID: "acc3", Balance: 200}) + `"}`},
+		{name: "Next page", method: "GET", path: "/accounts?limit=2&order=-balance&cursor=" + encodeCursor(Account{ID: "acc3", Balance: 200}), expectedStatus: http.StatusOK,
+			expected: `{"accounts":[{"id":"acc2","balance":100,"tags":["vip"]}]}`},
+		{name: "Filtered", method: "GET", path: "/accounts?min_balance=150&tag=vip", expectedStatus: http.StatusOK, expected: `{"accounts":[]}`},
+		{name: "Invalid bound", method: "GET", path: "/accounts?max_balance=lots", expectedStatus: http.StatusBadRequest},
+		{name: "Invalid cursor", method: "GET", path: "/accounts?cursor=x", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); tt.expected != "" && got != tt.expected {
+				t.Errorf("Response = %s; want %s", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+)
+
+// ErrActorStopped is returned by commands sent to an Actor after Stop.
+var ErrActorStopped = errors.New("actor is stopped")
+
+// actorQueueSize is the number of commands an Actor queues before senders
+// wait.
+const actorQueueSize = 64
+
+// Actor is a StateTransitions in which a single goroutine owns the state
+// and consumes commands from a channel, rather than callers taking turns
+// under a mutex. Commands are applied one at a time in the order they are
+// received, so no lock is ever taken and ordering is deterministic for a
+// single sender.
+//
+// Operations are applied as a StateMachine applies them, with the same
+// history and rollbacks, but without hooks, rate limits, approvals or any
+// of the StateMachine's other services. Actor exists to compare both
+// concurrency models, see BenchmarkStateTransitions.
+type Actor struct {
+	commands chan func(state *StateMachine)
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// NewActor starts an actor owning the given accounts. It runs until Stop.
+func NewActor(accounts map[string]int) *Actor {
+	a := &Actor{
+		commands: make(chan func(state *StateMachine), actorQueueSize),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	state := &StateMachine{accounts: maps.Clone(accounts)}
+	if state.accounts == nil {
+		state.accounts = map[string]int{}
+	}
+	go a.run(state)
+	return a
+}
+
+// run is the goroutine owning state: nothing else ever touches it.
+func (a *Actor) run(state *StateMachine) {
+	defer close(a.stopped)
+	for {
+		select {
+		case command := <-a.commands:
+			command(state)
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the actor. Commands queued but not yet applied fail with
+// ErrActorStopped.
+func (a *Actor) Stop() {
+	a.stopOnce.Do(func() { close(a.stop) })
+	<-a.stopped
+}
+
+// do sends command to the actor and waits for it to be applied.
+func (a *Actor) do(command func(state *StateMachine)) error {
+	done := make(chan struct{})
+	select {
+	case a.commands <- func(state *StateMachine) {
+		command(state)
+		close(done)
+	}:
+	case <-a.stopped:
+		return ErrActorStopped
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-a.stopped:
+		select {
+		case <-done: // applied just before stopping
+			return nil
+		default:
+			return ErrActorStopped
+		}
+	}
+}
+
+// apply applies op in the actor's goroutine, as execute would.
+func (a *Actor) apply(op Operation) error {
+	var err error
+	if stopErr := a.do(func(state *StateMachine) {
+		op.Time = state.now()
+		op.ID = state.newOperationID(op.Time)
+		if err = state.apply(op); err == nil {
+			state.record(op)
+		}
+	}); stopErr != nil {
+		return stopErr
+	}
+	return err
+}
+
+func (a *Actor) Deposit(accountId string, amount int) error {
+	return a.apply(Operation{Type: OpDeposit, To: accountId, Amount: amount})
+}
+
+func (a *Actor) Withdraw(accountId string, amount int) error {
+	return a.apply(Operation{Type: OpWithdraw, From: accountId, Amount: amount})
+}
+
+func (a *Actor) Transfer(fromAccountId, toAccountId string, amount int) error {
+	return a.apply(Operation{Type: OpTransfer, From: fromAccountId, To: toAccountId, Amount: amount})
+}
+
+func (a *Actor) Rollback() error {
+	return a.apply(Operation{Type: OpRollback})
+}
+
+// Balance returns the balance of an account once the commands sent before
+// have been applied.
+func (a *Actor) Balance(accountId string) (int, error) {
+	var balance int
+	var ok bool
+	if err := a.do(func(state *StateMachine) {
+		balance, ok = state.accounts[accountId]
+	}); err != nil {
+		return 0, err
+	}
+	if !ok || isBucketKey(accountId) {
+		return 0, fmt.Errorf("%w (%s)", ErrInvalidAccount, accountId)
+	}
+	return balance, nil
+}
+
+// Balances returns a copy of every balance once the commands sent before
+// have been applied.
+func (a *Actor) Balances() (map[string]int, error) {
+	var balances map[string]int
+	err := a.do(func(state *StateMachine) {
+		balances = maps.Clone(state.accounts)
+		maps.DeleteFunc(balances, func(id string, _ int) bool { return isBucketKey(id) })
+	})
+	return balances, err
+}
+
+// Version returns the number of states saved and not rolled back.
+func (a *Actor) Version() (int, error) {
+	var version int
+	err := a.do(func(state *StateMachine) { version = state.version })
+	return version, err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+var _ StateTransitions = (*Actor)(nil)
+
+// TestActorMatchesStateMachine applies the same operations to an actor and
+// a state machine, which must agree on every outcome.
+func TestActorMatchesStateMachine(t *testing.T) {
+	quiet(t)
+
+	accounts := map[string]int{"acc1": 100, "acc2": 50}
+	actor := NewActor(accounts)
+	defer actor.Stop()
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 50}}
+
+	tests := []struct {
+		name        string
+		fn          func(st StateTransitions) error
+		expectedErr error
+	}{
+		{"Deposit", func(st StateTransitions) error { return st.Deposit("acc1", 25) }, nil},
+		{"Withdraw", func(st StateTransitions) error { return st.Withdraw("acc2", 20) }, nil},
+		{"Transfer", func(st StateTransitions) error { return st.Transfer("acc1", "acc2", 75) }, nil},
+		{"Insufficient balance", func(st StateTransitions) error { return st.Withdraw("acc2", 1000) }, ErrInsufficientBalance},
+		{"Unknown account", func(st StateTransitions) error { return st.Deposit("acc3", 10) }, ErrInvalidAccount},
+		{"Rollback", func(st StateTransitions) error { return st.Rollback() }, nil},
+		{"Rollback again", func(st StateTransitions) error { return st.Rollback() }, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actorErr, smErr := tt.fn(actor), tt.fn(sm)
+			if !errors.Is(actorErr, tt.expectedErr) || !errors.Is(smErr, tt.expectedErr) {
+				t.Fatalf("Error = %v (actor), %v (state machine); want %v", actorErr, smErr, tt.expectedErr)
+			}
+			balances, err := actor.Balances()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(balances, sm.Balances()) {
+				t.Errorf("Balances() = %v (actor), %v (state machine)", balances, sm.Balances())
+			}
+			if version, _ := actor.Version(); version != sm.Version() {
+				t.Errorf("Version() = %d (actor), %d (state machine)", version, sm.Version())
+			}
+		})
+	}
+
+	if accounts["acc1"] != 100 {
+		t.Errorf("NewActor() changed the caller's accounts: %v", accounts)
+	}
+}
+
+func TestActorConcurrent(t *testing.T) {
+	quiet(t)
+
+	accounts := map[string]int{}
+	for i := range 10 {
+		accounts["acc"+strconv.Itoa(i)] = 1000
+	}
+	actor := NewActor(accounts)
+	defer actor.Stop()
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				_ = actor.Transfer("acc"+strconv.Itoa((w+i)%10), "acc"+strconv.Itoa((w+i+3)%10), 7)
+			}
+		}()
+	}
+	wg.Wait()
+
+	balances, err := actor.Balances()
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, balance := range balances {
+		total += balance
+	}
+	if total != 10000 {
+		t.Errorf("Total balance = %d; want 10000", total)
+	}
+}
+
+func TestActorStop(t *testing.T) {
+	quiet(t)
+
+	actor := NewActor(map[string]int{"acc1": 100})
+	actor.Stop()
+	actor.Stop()
+
+	if err := actor.Deposit("acc1", 10); !errors.Is(err, ErrActorStopped) {
+		t.Errorf("Deposit() after Stop() error = %v; want ErrActorStopped", err)
+	}
+	if _, err := actor.Balance("acc1"); !errors.Is(err, ErrActorStopped) {
+		t.Errorf("Balance() after Stop() error = %v; want ErrActorStopped", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var ErrInvalidBounds = errors.New("invalid balance bounds")
+
+// AccountBalance is the balance of an account.
+type AccountBalance struct {
+	ID      string `json:"id"`
+	Balance int    `json:"balance"`
+}
+
+// BalanceRange counts the accounts with a balance of at least Min and below
+// Max. The first range of a distribution has no Min and the last no Max.
+type BalanceRange struct {
+	Min   *int `json:"min,omitempty"`
+	Max   *int `json:"max,omitempty"`
+	Count int  `json:"count"`
+}
+
+// balanceIndex keeps the accounts ordered by balance, and their total, as
+// operations are applied, for the aggregate queries. It is built from the
+// accounts when first queried and dropped when they are replaced wholesale,
+// by a rollback or a restore, to be built again on the next query. It is
+// guarded by sm.mu.
+type balanceIndex struct {
+	built    bool
+	balances map[string]int // the balance each account is indexed with
+	ordered  []AccountBalance
+	total    int
+}
+
+// compareBalances orders balances ascending, and equal balances by
+// descending ID, so the highest come last in ID order.
+func compareBalances(a, b AccountBalance) int {
+	return cmp.Or(cmp.Compare(a.Balance, b.Balance), cmp.Compare(b.ID, a.ID))
+}
+
+func (x *balanceIndex) build(accounts map[string]int) {
+	*x = balanceIndex{built: true, balances: make(map[string]int, len(accounts))}
+	for id, balance := range accounts {
+		if isBucketKey(id) {
+			continue
+		}
+		x.balances[id] = balance
+		x.ordered = append(x.ordered, AccountBalance{id, balance})
+		x.total += balance
+	}
+	slices.SortFunc(x.ordered, compareBalances)
+}
+
+// invalidate drops the index after the accounts were replaced.
+func (x *balanceIndex) invalidate() {
+	*x = balanceIndex{}
+}
+
+// update reindexes the given accounts with their balance in accounts.
+func (x *balanceIndex) update(accounts map[string]int, ids ...string) {
+	if !x.built {
+		return
+	}
+	for _, id := range ids {
+		if old, ok := x.balances[id]; ok {
+			i, _ := slices.BinarySearchFunc(x.ordered, AccountBalance{id, old}, compareBalances)
+			x.ordered = slices.Delete(x.ordered, i, i+1)
+			x.total -= old
+			delete(x.balances, id)
+		}
+		if balance, ok := accounts[id]; ok {
+			i, _ := slices.BinarySearchFunc(x.ordered, AccountBalance{id, balance}, compareBalances)
+			x.ordered = slices.Insert(x.ordered, i, AccountBalance{id, balance})
+			x.total += balance
+			x.balances[id] = balance
+		}
+	}
+}
+
+// index returns the balance index, building it if needed. sm.mu must be
+// held.
+func (sm *StateMachine) index() *balanceIndex {
+	if !sm.balanceIndex.built {
+		sm.balanceIndex.build(sm.accounts)
+	}
+	return &sm.balanceIndex
+}
+
+// TopAccountsByBalance returns the n accounts with the highest balances,
+// highest first, equal balances in ID order.
+func (sm *StateMachine) TopAccountsByBalance(n int) []AccountBalance {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	ordered := sm.index().ordered
+	top := make([]AccountBalance, 0, min(max(n, 0), len(ordered)))
+	for i := len(ordered) - 1; i >= 0 && len(top) < n; i-- {
+		top = append(top, ordered[i])
+	}
+	return top
+}
+
+// TotalBalance returns the sum of the balances of every account.
+func (sm *StateMachine) TotalBalance() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return sm.index().total
+}
+
+// BalanceDistribution counts the accounts in each of the ranges bounded by
+// bounds, which must be ascending: below bounds[0], from each bound to the
+// next, and from the last bound up.
+func (sm *StateMachine) BalanceDistribution(bounds []int) ([]BalanceRange, error) {
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i] <= bounds[i-1] {
+			return nil, fmt.Errorf("%w: %v is not ascending", ErrInvalidBounds, bounds)
+		}
+	}
+	bounds = slices.Clone(bounds) // the ranges point into it
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	ordered := sm.index().ordered
+	// below returns the number of accounts with a balance below bound.
+	below := func(bound int) int {
+		i, _ := slices.BinarySearchFunc(ordered, bound, func(e AccountBalance, bound int) int {
+			if e.Balance < bound {
+				return -1
+			}
+			return 1
+		})
+		return i
+	}
+
+	ranges := make([]BalanceRange, len(bounds)+1)
+	counted := 0
+	for i, bound := range bounds {
+		n := below(bound)
+		ranges[i].Max = &bounds[i]
+		ranges[i+1].Min = &bounds[i]
+		ranges[i].Count = n - counted
+		counted = n
+	}
+	ranges[len(bounds)].Count = len(ordered) - counted
+	return ranges, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestAggregateBalances(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 500, "acc3": 0, "acc4": 500}}
+	bound := func(v int) *int { return &v }
+
+	tests := []struct {
+		name                 string
+		change               func() error
+		expectedTop          []AccountBalance
+		expectedTotal        int
+		expectedDistribution []BalanceRange
+	}{
+		{
+			"Initial balances",
+			func() error { return nil },
+			[]AccountBalance{{"acc2", 500}, {"acc4", 500}},
+			1100,
+			[]BalanceRange{{nil, bound(1), 1}, {bound(1), bound(500), 1}, {bound(500), nil, 2}},
+		},
+		{
+			"Transfer",
+			func() error { return sm.Transfer("acc2", "acc3", 450) },
+			[]AccountBalance{{"acc4", 500}, {"acc3", 450}},
+			1100,
+			[]BalanceRange{{nil, bound(1), 0}, {bound(1), bound(500), 3}, {bound(500), nil, 1}},
+		},
+		{
+			"Deposit",
+			func() error { return sm.Deposit("acc1", 900) },
+			[]AccountBalance{{"acc1", 1000}, {"acc4", 500}},
+			2000,
+			[]BalanceRange{{nil, bound(1), 0}, {bound(1), bound(500), 2}, {bound(500), nil, 2}},
+		},
+		{
+			"Rollback",
+			func() error { return sm.Rollback() },
+			[]AccountBalance{{"acc4", 500}, {"acc3", 450}},
+			1100,
+			[]BalanceRange{{nil, bound(1), 0}, {bound(1), bound(500), 3}, {bound(500), nil, 1}},
+		},
+		{
+			"Open",
+			func() error { return sm.OpenAccount("acc5", 700) },
+			[]AccountBalance{{"acc5", 700}, {"acc4", 500}},
+			1800,
+			[]BalanceRange{{nil, bound(1), 0}, {bound(1), bound(500), 3}, {bound(500), nil, 2}},
+		},
+		{
+			"Bucket",
+			func() error { return sm.Move("acc5", "", "reserved", 300) },
+			[]AccountBalance{{"acc5", 700}, {"acc4", 500}},
+			1800,
+			[]BalanceRange{{nil, bound(1), 0}, {bound(1), bound(500), 3}, {bound(500), nil, 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.change(); err != nil {
+				t.Fatal(err)
+			}
+			if top := sm.TopAccountsByBalance(2); !reflect.DeepEqual(top, tt.expectedTop) {
+				t.Errorf("TopAccountsByBalance() = %v; want %v", top, tt.expectedTop)
+			}
+			if total := sm.TotalBalance(); total != tt.expectedTotal {
+				t.Errorf("TotalBalance() = %d; want %d", total, tt.expectedTotal)
+			}
+			distribution, err := sm.BalanceDistribution([]int{1, 500})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(distribution, tt.expectedDistribution) {
+				t.Errorf("BalanceDistribution() = %v; want %v", distribution, tt.expectedDistribution)
+			}
+		})
+	}
+
+	if _, err := sm.BalanceDistribution([]int{500, 1}); !errors.Is(err, ErrInvalidBounds) {
+		t.Errorf("BalanceDistribution() with descending bounds error = %v; want ErrInvalidBounds", err)
+	}
+	if top := sm.TopAccountsByBalance(0); len(top) != 0 {
+		t.Errorf("TopAccountsByBalance(0) = %v; want none", top)
+	}
+}
+
+// TestBalanceIndexConsistent checks the index against a scan of the
+// balances after random operations, transactions, rollbacks and a restore.
+func TestBalanceIndexConsistent(t *testing.T) {
+	quiet(t)
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	sm := &StateMachine{accounts: map[string]int{}}
+	for i := range 50 {
+		sm.accounts[fmt.Sprintf("acc%d", i)] = rng.IntN(1000)
+	}
+	account := func() string { return fmt.Sprintf("acc%d", rng.IntN(50)) }
+
+	check := func(step int) {
+		t.Helper()
+		var scanned []AccountBalance
+		total := 0
+		for id, balance := range sm.Balances() {
+			scanned = append(scanned, AccountBalance{id, balance})
+			total += balance
+		}
+		slices.SortFunc(scanned, func(a, b AccountBalance) int {
+			return cmp.Or(cmp.Compare(b.Balance, a.Balance), cmp.Compare(a.ID, b.ID))
+		})
+		if top := sm.TopAccountsByBalance(10); !reflect.DeepEqual(top, scanned[:10]) {
+			t.Fatalf("Step %d: TopAccountsByBalance() = %v; want %v", step, top, scanned[:10])
+		}
+		if got := sm.TotalBalance(); got != total {
+			t.Fatalf("Step %d: TotalBalance() = %d; want %d", step, got, total)
+		}
+	}
+
+	for step := range 500 {
+		switch rng.IntN(6) {
+		case 0:
+			_ = sm.Deposit(account(), rng.IntN(500))
+		case 1:
+			_ = sm.Withdraw(account(), rng.IntN(500))
+		case 2:
+			_ = sm.Transfer(account(), account(), rng.IntN(500))
+		case 3:
+			_ = sm.Tx(func(tx *Tx) error {
+				_ = tx.Transfer(account(), account(), rng.IntN(500))
+				return tx.Deposit(account(), rng.IntN(500))
+			})
+		case 4:
+			_ = sm.Rollback()
+		case 5:
+			var buf bytes.Buffer
+			if err := sm.WriteSnapshot(&buf, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := sm.ReadSnapshot(&buf, nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		check(step)
+	}
+}
+
+func TestServerAggregateBalances(t *testing.T) {
+	quiet(t)
+
+	srv, _ := newTestServer(map[string]int{"acc1": 100, "acc2": 300, "acc3": 200})
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Top", "/balances/top?n=2", http.StatusOK, `[{"id":"acc2","balance":300},{"id":"acc3","balance":200}]`},
+		{"Total", "/balances/total", http.StatusOK, `{"total":600}`},
+		{"Distribution", "/balances/distribution?bound=150&bound=250", http.StatusOK, `[{"max":150,"count":1},{"min":150,"max":250,"count":1},{"min":250,"count":1}]`},
+		{"Bad bound", "/balances/distribution?bound=x", http.StatusBadRequest, ""},
+		{"Descending bounds", "/balances/distribution?bound=2&bound=1", http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("GET %s = %d; want %d (%s)", tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if tt.expectedBody == "" {
+				return
+			}
+			var got, expected any
+			_ = json.Unmarshal(rec.Body.Bytes(), &got)
+			_ = json.Unmarshal([]byte(tt.expectedBody), &expected)
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("GET %s = %s; want %s", tt.path, rec.Body, tt.expectedBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var (
+	ErrInvalidAlert  = errors.New("invalid alert")
+	ErrAlertNotFound = errors.New("alert not found")
+)
+
+type AlertKind string
+
+const (
+	AlertBalanceBelow    AlertKind = "balance_below"    // the account's balance drops below Threshold
+	AlertBalanceAbove    AlertKind = "balance_above"    // the account's balance rises above Threshold
+	AlertWithdrawalAbove AlertKind = "withdrawal_above" // a withdrawal or transfer debits more than Threshold
+)
+
+// Alert asks to be notified when a balance crosses a threshold or a single
+// debit exceeds one. Balance alerts need an Account; for withdrawal alerts
+// an empty Account means any account.
+//
+// A triggered alert is reported in the Event of the operation that
+// triggered it, so it reaches subscribers and, through the outbox, webhooks.
+// Balance alerts trigger when the balance crosses the threshold, not on
+// every operation while it stays beyond it.
+type Alert struct {
+	ID        string    `json:"id"`
+	Kind      AlertKind `json:"kind"`
+	Account   string    `json:"account,omitempty"`
+	Threshold int       `json:"threshold"`
+}
+
+// validate checks the alert has the fields its kind needs.
+func (a Alert) validate() error {
+	switch a.Kind {
+	case AlertBalanceBelow, AlertBalanceAbove:
+		if a.Account == "" {
+			return fmt.Errorf("%w: %s needs an account", ErrInvalidAlert, a.Kind)
+		}
+	case AlertWithdrawalAbove:
+	default:
+		return fmt.Errorf("%w: unknown kind %q", ErrInvalidAlert, a.Kind)
+	}
+	return nil
+}
+
+// breached reports whether a balance alert's condition holds for accounts.
+func (a Alert) breached(accounts map[string]int) bool {
+	balance, ok := accounts[a.Account]
+	switch {
+	case !ok:
+		return false
+	case a.Kind == AlertBalanceBelow:
+		return balance < a.Threshold
+	case a.Kind == AlertBalanceAbove:
+		return balance > a.Threshold
+	}
+	return false
+}
+
+// alerts holds the registered alerts in the order they were added, and which
+// balance alerts are breached, so they trigger only when crossing over.
+type alerts struct {
+	defined  []Alert
+	breaches map[string]bool // by alert ID
+}
+
+// triggered returns the alerts op triggers, given the accounts it left and
+// the accounts it may have changed, and updates which are breached. sm.mu
+// must be held.
+func (al *alerts) triggered(op Operation, accounts map[string]int, changed []string) []Alert {
+	var fired []Alert
+	for _, a := range al.defined {
+		switch a.Kind {
+		case AlertWithdrawalAbove:
+			debit := op.Type == OpWithdraw || op.Type == OpTransfer
+			if debit && op.Amount > a.Threshold && (a.Account == "" || a.Account == op.From) {
+				fired = append(fired, a)
+			}
+		default:
+			if !slices.Contains(changed, a.Account) {
+				continue
+			}
+			breached := a.breached(accounts)
+			if breached && !al.breaches[a.ID] {
+				fired = append(fired, a)
+			}
+			al.breaches[a.ID] = breached
+		}
+	}
+	return fired
+}
+
+// restore replaces the alerts with defined, as breached as accounts say.
+func (al *alerts) restore(defined []Alert, accounts map[string]int) {
+	*al = alerts{defined: slices.Clone(defined), breaches: map[string]bool{}}
+	for _, a := range defined {
+		al.breaches[a.ID] = a.breached(accounts)
+	}
+}
+
+// AddAlert registers an alert and returns it with its assigned ID. A balance
+// alert already breached when added triggers only once the balance has
+// recovered and crosses the threshold again.
+func (sm *StateMachine) AddAlert(alert Alert) (Alert, error) {
+	if err := alert.validate(); err != nil {
+		return alert, err
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.readOnly {
+		return alert, ErrReadOnly
+	}
+	alert.ID = sm.ids.next(sm.now())
+	if sm.alerts.breaches == nil {
+		sm.alerts.breaches = map[string]bool{}
+	}
+	sm.alerts.defined = append(sm.alerts.defined, alert)
+	sm.alerts.breaches[alert.ID] = alert.breached(sm.accounts)
+	return alert, nil
+}
+
+// Alerts returns the registered alerts, in the order they were added.
+func (sm *StateMachine) Alerts() []Alert {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return slices.Clone(sm.alerts.defined)
+}
+
+// RemoveAlert unregisters the alert with the given ID.
+func (sm *StateMachine) RemoveAlert(id string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if sm.readOnly {
+		return ErrReadOnly
+	}
+	i := slices.IndexFunc(sm.alerts.defined, func(a Alert) bool { return a.ID == id })
+	if i < 0 {
+		return fmt.Errorf("%w (%s)", ErrAlertNotFound, id)
+	}
+	sm.alerts.defined = slices.Delete(sm.alerts.defined, i, i+1)
+	delete(sm.alerts.breaches, id)
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestAlerts(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 10_000, "acc2": 500}}
+	below, _ := sm.AddAlert(Alert{Kind: AlertBalanceBelow, Account: "acc2", Threshold: 100})
+	above, _ := sm.AddAlert(Alert{Kind: AlertBalanceAbove, Account: "acc2", Threshold: 1000})
+	large, _ := sm.AddAlert(Alert{Kind: AlertWithdrawalAbove, Threshold: 5000})
+	largeAcc2, _ := sm.AddAlert(Alert{Kind: AlertWithdrawalAbove, Account: "acc2", Threshold: 300})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := sm.Subscribe(ctx)
+
+	tests := []struct {
+		name     string
+		apply    func() error
+		expected []Alert
+	}{
+		{"Quiet", func() error { return sm.Withdraw("acc2", 100) }, nil},
+		{"Drops below", func() error { return sm.Withdraw("acc2", 350) }, []Alert{below, largeAcc2}},
+		{"Stays below", func() error { return sm.Withdraw("acc2", 10) }, nil},
+		{"Recovers", func() error { return sm.Deposit("acc2", 100) }, nil},
+		{"Drops below again", func() error { return sm.Withdraw("acc2", 100) }, []Alert{below}},
+		{"Large transfer", func() error { return sm.Transfer("acc1", "acc2", 6000) }, []Alert{above, large}},
+		{"Large deposit", func() error { return sm.Deposit("acc1", 6000) }, nil},
+		{"Rollback", sm.Rollback, nil},
+		{"Rollback below", sm.Rollback, []Alert{below}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.apply(); err != nil {
+				t.Fatal(err)
+			}
+			if event := <-events; !slices.Equal(event.Alerts, tt.expected) {
+				t.Errorf("Event alerts = %+v; want %+v", event.Alerts, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAddAlert(t *testing.T) {
+	sm := &StateMachine{accounts: map[string]int{"acc1": 0}}
+
+	tests := []struct {
+		name        string
+		alert       Alert
+		expectedErr error
+	}{
+		{"Balance", Alert{Kind: AlertBalanceBelow, Account: "acc1", Threshold: 10}, nil},
+		{"Any account", Alert{Kind: AlertWithdrawalAbove, Threshold: 10}, nil},
+		{"No account", Alert{Kind: AlertBalanceAbove, Threshold: 10}, ErrInvalidAlert},
+		{"Unknown kind", Alert{Kind: "balance_equals", Account: "acc1"}, ErrInvalidAlert},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alert, err := sm.AddAlert(tt.alert)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("AddAlert() error = %v; want %v", err, tt.expectedErr)
+			}
+			if err == nil && alert.ID == "" {
+				t.Errorf("AddAlert() = %+v; want an ID", alert)
+			}
+		})
+	}
+
+	alerts := sm.Alerts()
+	if len(alerts) != 2 {
+		t.Fatalf("Alerts() = %+v; want the 2 valid alerts", alerts)
+	}
+	if err := sm.RemoveAlert(alerts[0].ID); err != nil {
+		t.Fatalf("RemoveAlert() error = %v", err)
+	}
+	if err := sm.RemoveAlert(alerts[0].ID); !errors.Is(err, ErrAlertNotFound) {
+		t.Errorf("RemoveAlert() of a removed alert error = %v; want ErrAlertNotFound", err)
+	}
+	if remaining := sm.Alerts(); !slices.Equal(remaining, alerts[1:]) {
+		t.Errorf("Alerts() = %+v; want %+v", remaining, alerts[1:])
+	}
+}
+
+func TestAlertsSnapshot(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 50}}
+	alert, _ := sm.AddAlert(Alert{Kind: AlertBalanceBelow, Account: "acc1", Threshold: 100})
+	var buf bytes.Buffer
+	if err := sm.WriteSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &StateMachine{}
+	if err := restored.ReadSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if alerts := restored.Alerts(); !slices.Equal(alerts, []Alert{alert}) {
+		t.Fatalf("Alerts() = %+v; want %+v", alerts, []Alert{alert})
+	}
+
+	// The balance was already below the threshold, so it must recover first.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := restored.Subscribe(ctx)
+	for _, amount := range []int{-10, 100, -100} {
+		if amount < 0 {
+			_ = restored.Withdraw("acc1", -amount)
+		} else {
+			_ = restored.Deposit("acc1", amount)
+		}
+		if event := <-events; (len(event.Alerts) > 0) != (amount == -100) {
+			t.Errorf("After %d alerts = %+v", amount, event.Alerts)
+		}
+	}
+}
+
+func TestServerAlerts(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := sm.Subscribe(ctx)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/alerts", `{"kind": "balance_below", "account": "acc1", "threshold": 100}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /alerts = %d; want 201 (%s)", rec.Code, rec.Body)
+	}
+	var alert Alert
+	if err := json.Unmarshal(rec.Body.Bytes(), &alert); err != nil {
+		t.Fatal(err)
+	}
+	if rec := do(http.MethodPost, "/alerts", `{"kind": "balance_below", "threshold": 100}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /alerts without an account = %d; want 400", rec.Code)
+	}
+
+	rec = do(http.MethodGet, "/alerts", "")
+	var alerts []Alert
+	if err := json.Unmarshal(rec.Body.Bytes(), &alerts); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(alerts, []Alert{alert}) {
+		t.Errorf("GET /alerts = %+v; want %+v", alerts, []Alert{alert})
+	}
+
+	if rec := do(http.MethodPost, "/accounts/acc1/withdraw", `{"amount": 950}`); rec.Code != http.StatusOK {
+		t.Fatalf("POST withdraw = %d; want 200 (%s)", rec.Code, rec.Body)
+	}
+	if event := <-events; !slices.Equal(event.Alerts, []Alert{alert}) {
+		t.Errorf("Event alerts = %+v; want %+v", event.Alerts, []Alert{alert})
+	}
+
+	if rec := do(http.MethodDelete, "/alerts/"+alert.ID, ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d; want 204 (%s)", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodDelete, "/alerts/"+alert.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Second DELETE = %d; want 404", rec.Code)
+	}
+}
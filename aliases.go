@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+)
+
+var (
+	ErrInvalidAlias = errors.New("invalid alias")
+	ErrAliasTaken   = errors.New("alias already in use")
+	ErrUnknownAlias = errors.New("unknown alias")
+)
+
+const maxAliasLength = 128
+
+// aliases maps external identifiers to account IDs. It has its own lock so
+// resolving an alias never waits for an operation being applied; when both
+// are needed, sm.mu is taken first.
+type aliases struct {
+	mu     sync.RWMutex
+	owners map[string]string // account of each alias
+}
+
+func (a *aliases) owner(alias string) (string, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	accountId, ok := a.owners[alias]
+	return accountId, ok
+}
+
+func (a *aliases) all() map[string]string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return maps.Clone(a.owners)
+}
+
+func (a *aliases) restore(owners map[string]string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.owners = owners
+}
+
+// SetAlias maps an external identifier, such as an IBAN or a customer ID, to
+// an account, so the account can be addressed by it. An alias belongs to at
+// most one account and cannot be an account's ID; an account may have any
+// number of aliases. Like tags, aliases are metadata: they are not versioned
+// and rollbacks do not touch them.
+func (sm *StateMachine) SetAlias(alias, accountId string) error {
+	if sm.readOnly {
+		return ErrReadOnly
+	}
+	if alias == "" || len(alias) > maxAliasLength {
+		return fmt.Errorf("%w (%q): want 1 to %d characters", ErrInvalidAlias, alias, maxAliasLength)
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.accounts[accountId]; !ok {
+		return fmt.Errorf("%w (%s)", ErrInvalidAccount, accountId)
+	}
+	_, isAccount := sm.accounts[alias]
+	_, isArchived := sm.archived[alias]
+	if isAccount || isArchived || isBucketKey(alias) {
+		return fmt.Errorf("%w (%s): it is an account ID", ErrAliasTaken, alias)
+	}
+
+	sm.aliases.mu.Lock()
+	defer sm.aliases.mu.Unlock()
+
+	if owner, ok := sm.aliases.owners[alias]; ok && owner != accountId {
+		return fmt.Errorf("%w (%s) by %s", ErrAliasTaken, alias, owner)
+	}
+	if sm.aliases.owners == nil {
+		sm.aliases.owners = map[string]string{}
+	}
+	sm.aliases.owners[alias] = accountId
+	return nil
+}
+
+// RemoveAlias removes an alias of accountId.
+func (sm *StateMachine) RemoveAlias(alias, accountId string) error {
+	if sm.readOnly {
+		return ErrReadOnly
+	}
+	sm.aliases.mu.Lock()
+	defer sm.aliases.mu.Unlock()
+
+	if owner, ok := sm.aliases.owners[alias]; !ok || owner != accountId {
+		return fmt.Errorf("%w (%s) of %s", ErrUnknownAlias, alias, accountId)
+	}
+	delete(sm.aliases.owners, alias)
+	return nil
+}
+
+// Aliases returns the aliases of an account, sorted.
+func (sm *StateMachine) Aliases(accountId string) []string {
+	sm.aliases.mu.RLock()
+	defer sm.aliases.mu.RUnlock()
+
+	var list []string
+	for alias, owner := range sm.aliases.owners {
+		if owner == accountId {
+			list = append(list, alias)
+		}
+	}
+	slices.Sort(list)
+	return list
+}
+
+// ResolveAccount returns the ID of the account idOrAlias is an alias of, or
+// idOrAlias itself if it is not an alias.
+func (sm *StateMachine) ResolveAccount(idOrAlias string) string {
+	if accountId, ok := sm.aliases.owner(idOrAlias); ok {
+		return accountId
+	}
+	return idOrAlias
+}
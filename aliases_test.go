@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetAlias(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 50}}
+
+	tests := []struct {
+		name     string
+		alias    string
+		account  string
+		expected error
+	}{
+		{"Alias", "DE89370400440532013000", "acc1", nil},
+		{"Second alias", "customer-42", "acc1", nil},
+		{"Same alias again", "customer-42", "acc1", nil},
+		{"Taken by another account", "customer-42", "acc2", ErrAliasTaken},
+		{"Account ID", "acc2", "acc1", ErrAliasTaken},
+		{"Empty", "", "acc1", ErrInvalidAlias},
+		{"Too long", strings.Repeat("x", maxAliasLength+1), "acc1", ErrInvalidAlias},
+		{"Unknown account", "customer-43", "acc3", ErrInvalidAccount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := sm.SetAlias(tt.alias, tt.account); !errors.Is(err, tt.expected) {
+				t.Errorf("SetAlias(%q, %q) error = %v; want %v", tt.alias, tt.account, err, tt.expected)
+			}
+		})
+	}
+
+	if aliases := sm.Aliases("acc1"); !reflect.DeepEqual(aliases, []string{"DE89370400440532013000", "customer-42"}) {
+		t.Errorf("Aliases() = %v; want both aliases", aliases)
+	}
+	for idOrAlias, expected := range map[string]string{"customer-42": "acc1", "acc2": "acc2", "unknown": "unknown"} {
+		if got := sm.ResolveAccount(idOrAlias); got != expected {
+			t.Errorf("ResolveAccount(%q) = %q; want %q", idOrAlias, got, expected)
+		}
+	}
+
+	if err := sm.RemoveAlias("customer-42", "acc2"); !errors.Is(err, ErrUnknownAlias) {
+		t.Errorf("RemoveAlias() of another account's alias error = %v; want ErrUnknownAlias", err)
+	}
+	if err := sm.RemoveAlias("customer-42", "acc1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.SetAlias("customer-42", "acc2"); err != nil {
+		t.Errorf("SetAlias() of a removed alias error = %v", err)
+	}
+
+	if err := sm.OpenAccount("customer-42", 0); !errors.Is(err, ErrAliasTaken) {
+		t.Errorf("OpenAccount() under an alias error = %v; want ErrAliasTaken", err)
+	}
+}
+
+func TestAliasBackup(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	if err := sm.SetAlias("customer-42", "acc1"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := sm.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &StateMachine{}
+	if err := restored.Restore(&buf, LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.ResolveAccount("customer-42"); got != "acc1" {
+		t.Errorf("ResolveAccount() after Restore = %q; want acc1", got)
+	}
+}
+
+func TestServerAliases(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 100, "acc2": 0})
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Set", http.MethodPut, "/accounts/acc1/aliases/customer-42", "", http.StatusOK, `{"id":"acc1","aliases":["customer-42"]}`},
+		{"Taken", http.MethodPut, "/accounts/acc2/aliases/customer-42", "", http.StatusConflict, ""},
+		{"Balance by alias", http.MethodGet, "/accounts/customer-42", "", http.StatusOK, `{"id":"acc1","balance":100}`},
+		{"Deposit by alias", http.MethodPost, "/accounts/customer-42/deposit", `{"amount":10}`, http.StatusOK, ""},
+		{"Transfer by alias", http.MethodPost, "/transfers", `{"from":"customer-42","to":"acc2","amount":30}`, http.StatusOK, ""},
+		{"List", http.MethodGet, "/accounts/acc1/aliases", "", http.StatusOK, `{"id":"acc1","aliases":["customer-42"]}`},
+		{"Remove", http.MethodDelete, "/accounts/acc1/aliases/customer-42", "", http.StatusOK, `{"id":"acc1","aliases":[]}`},
+		{"Remove again", http.MethodDelete, "/accounts/acc1/aliases/customer-42", "", http.StatusNotFound, ""},
+		{"Unknown alias", http.MethodGet, "/accounts/customer-42", "", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if tt.expectedBody == "" {
+				return
+			}
+			var got, expected any
+			_ = json.Unmarshal(rec.Body.Bytes(), &got)
+			_ = json.Unmarshal([]byte(tt.expectedBody), &expected)
+			if !reflect.DeepEqual(got, expected) {
+				t.Errorf("%s %s = %s; want %s", tt.method, tt.path, rec.Body, tt.expectedBody)
+			}
+		})
+	}
+
+	if balances := sm.Balances(); balances["acc1"] != 80 || balances["acc2"] != 30 {
+		t.Errorf("Balances() = %v; want acc1 80 and acc2 30", balances)
+	}
+}
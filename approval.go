@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrApprovalRequired = errors.New("transfer requires approval")
+	ErrUnknownApproval  = errors.New("unknown approval")
+	ErrApprovalDecided  = errors.New("approval already decided")
+	ErrSelfApproval     = errors.New("transfer cannot be approved by its requester")
+)
+
+type ApprovalStatus string
+
+const (
+	ApprovalPending  ApprovalStatus = "pending"
+	ApprovalApproved ApprovalStatus = "approved" // approved and applied
+	ApprovalFailed   ApprovalStatus = "failed"   // approved, but the transfer failed
+	ApprovalRejected ApprovalStatus = "rejected"
+	ApprovalExpired  ApprovalStatus = "expired"
+)
+
+// PendingTransfer is a transfer waiting for, or having received, a decision.
+type PendingTransfer struct {
+	ID          string
+	From        string
+	To          string
+	Amount      int
+	RequestedBy string
+	RequestedAt time.Time
+	ExpiresAt   time.Time
+
+	Status    ApprovalStatus
+	DecidedBy string
+	DecidedAt time.Time
+	Reason    string // rejection reason or transfer error
+}
+
+// ApprovalRequiredError is returned by a transfer that was parked for
+// approval instead of being applied.
+type ApprovalRequiredError struct {
+	ID string
+}
+
+func (e *ApprovalRequiredError) Error() string {
+	return fmt.Sprintf("%s: pending as %s", ErrApprovalRequired, e.ID)
+}
+
+func (e *ApprovalRequiredError) Is(target error) bool {
+	return target == ErrApprovalRequired
+}
+
+type approvals struct {
+	threshold atomic.Int64 // see Reconfigure
+
+	mu        sync.Mutex
+	ttl       time.Duration
+	now       func() time.Time
+	nextID    int
+	transfers map[string]*PendingTransfer
+	order     []string // ids in request order
+}
+
+type actorKey struct{}
+
+// WithActor records who is performing the operations run with ctx, so a
+// transfer cannot be approved by the actor who requested it.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func ActorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+type approvedKey struct{}
+
+// RequireApproval parks transfers above threshold until a second actor
+// approves them with Approve. Pending transfers expire after ttl.
+func (sm *StateMachine) RequireApproval(threshold int, ttl time.Duration) {
+	a := &approvals{
+		ttl:       ttl,
+		now:       sm.now,
+		transfers: map[string]*PendingTransfer{},
+	}
+	a.threshold.Store(int64(threshold))
+	sm.approvals.Store(a)
+}
+
+// above reports whether transfers of amount need approval.
+func (a *approvals) above(amount int) bool {
+	return int64(amount) > a.threshold.Load()
+}
+
+// parkTransfer records a transfer above the approval threshold and returns
+// the *ApprovalRequiredError to hand back to the caller, or nil when the
+// transfer may be applied right away.
+func (sm *StateMachine) parkTransfer(ctx context.Context, from, to string, amount int) error {
+	a := sm.approvals.Load()
+	if a == nil || !a.above(amount) || ctx.Value(approvedKey{}) != nil {
+		return nil
+	}
+	if _, ok := sm.multisig.signerSet(Operation{Type: OpTransfer, From: from}); ok {
+		return nil // its signatures stand in for the approval
+	}
+
+	// Reject transfers that could never be applied before asking anyone.
+	if _, err := sm.SimulateContext(ctx, func(scratch *StateMachine) error {
+		return scratch.TransferContext(ctx, from, to, amount)
+	}); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.nextID++
+	now := a.now()
+	pending := &PendingTransfer{
+		ID:          fmt.Sprintf("approval-%d", a.nextID),
+		From:        from,
+		To:          to,
+		Amount:      amount,
+		RequestedBy: ActorFrom(ctx),
+		RequestedAt: now,
+		ExpiresAt:   now.Add(a.ttl),
+		Status:      ApprovalPending,
+	}
+	a.transfers[pending.ID] = pending
+	a.order = append(a.order, pending.ID)
+
+	fmt.Printf("\n\nTransfer of %d from account %s to account %s pending approval as %s\n", amount, from, to, pending.ID)
+
+	return &ApprovalRequiredError{ID: pending.ID}
+}
+
+// decide moves a pending transfer out of the pending state, expiring it
+// first if its time is up.
+func (a *approvals) decide(ctx context.Context, id string, status ApprovalStatus, reason string) (PendingTransfer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pending, ok := a.transfers[id]
+	if !ok {
+		return PendingTransfer{}, fmt.Errorf("%w (%s)", ErrUnknownApproval, id)
+	}
+
+	now := a.now()
+	a.expire(pending, now)
+	if pending.Status != ApprovalPending {
+		return *pending, fmt.Errorf("%w: %s is %s", ErrApprovalDecided, id, pending.Status)
+	}
+
+	actor := ActorFrom(ctx)
+	if status == ApprovalApproved && actor == pending.RequestedBy {
+		return *pending, fmt.Errorf("%w (%s)", ErrSelfApproval, actor)
+	}
+
+	pending.Status = status
+	pending.DecidedBy = actor
+	pending.DecidedAt = now
+	pending.Reason = reason
+	return *pending, nil
+}
+
+// restore replaces the parked transfers, numbering later ones after them.
+func (a *approvals) restore(transfers []PendingTransfer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.transfers, a.order, a.nextID = map[string]*PendingTransfer{}, nil, 0
+	for _, pending := range transfers {
+		a.transfers[pending.ID] = &pending
+		a.order = append(a.order, pending.ID)
+		var n int
+		if _, err := fmt.Sscanf(pending.ID, "approval-%d", &n); err == nil {
+			a.nextID = max(a.nextID, n)
+		}
+	}
+}
+
+func (a *approvals) expire(pending *PendingTransfer, now time.Time) {
+	if pending.Status == ApprovalPending && !now.Before(pending.ExpiresAt) {
+		pending.Status = ApprovalExpired
+		pending.DecidedAt = pending.ExpiresAt
+	}
+}
+
+func (sm *StateMachine) registeredApprovals() (*approvals, error) {
+	a := sm.approvals.Load()
+	if a == nil {
+		return nil, fmt.Errorf("%w: approvals are not enabled", ErrUnknownApproval)
+	}
+	return a, nil
+}
+
+// Approve applies a pending transfer on behalf of the actor in ctx, who must
+// not be the one who requested it.
+func (sm *StateMachine) Approve(ctx context.Context, id string) (PendingTransfer, error) {
+	a, err := sm.registeredApprovals()
+	if err != nil {
+		return PendingTransfer{}, err
+	}
+
+	pending, err := a.decide(ctx, id, ApprovalApproved, "")
+	if err != nil {
+		return pending, err
+	}
+
+	fmt.Printf("\n\nTransfer %s approved by %q\n", id, pending.DecidedBy)
+
+	err = sm.TransferContext(context.WithValue(ctx, approvedKey{}, id), pending.From, pending.To, pending.Amount)
+	if err != nil {
+		a.mu.Lock()
+		a.transfers[id].Status = ApprovalFailed
+		a.transfers[id].Reason = err.Error()
+		pending = *a.transfers[id]
+		a.mu.Unlock()
+		return pending, err
+	}
+	return pending, nil
+}
+
+// Reject discards a pending transfer without moving funds.
+func (sm *StateMachine) Reject(ctx context.Context, id, reason string) (PendingTransfer, error) {
+	a, err := sm.registeredApprovals()
+	if err != nil {
+		return PendingTransfer{}, err
+	}
+
+	pending, err := a.decide(ctx, id, ApprovalRejected, reason)
+	if err == nil {
+		fmt.Printf("\n\nTransfer %s rejected by %q: %s\n", id, pending.DecidedBy, reason)
+	}
+	return pending, err
+}
+
+// Approval returns a transfer parked for approval, whatever its status.
+func (sm *StateMachine) Approval(id string) (PendingTransfer, error) {
+	a, err := sm.registeredApprovals()
+	if err != nil {
+		return PendingTransfer{}, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pending, ok := a.transfers[id]
+	if !ok {
+		return PendingTransfer{}, fmt.Errorf("%w (%s)", ErrUnknownApproval, id)
+	}
+	a.expire(pending, a.now())
+	return *pending, nil
+}
+
+// Approvals returns every transfer parked for approval, oldest first.
+func (sm *StateMachine) Approvals() []PendingTransfer {
+	a, err := sm.registeredApprovals()
+	if err != nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	list := make([]PendingTransfer, 0, len(a.order))
+	for _, id := range a.order {
+		pending := a.transfers[id]
+		a.expire(pending, now)
+		list = append(list, *pending)
+	}
+	return list
+}
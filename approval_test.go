@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateMachineApprovals(t *testing.T) {
+	now := time.Unix(0, 0)
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 10000, "acc2": 500},
+	}
+	sm.RequireApproval(1000, time.Hour)
+	sm.approvals.Load().now = func() time.Time { return now }
+
+	alice := WithActor(context.Background(), "alice")
+	bob := WithActor(context.Background(), "bob")
+
+	if err := sm.TransferContext(alice, "acc1", "acc2", 1000); err != nil {
+		t.Fatalf("Transfer at threshold failed: %v", err)
+	}
+
+	park := func(amount int) string {
+		t.Helper()
+		var approvalErr *ApprovalRequiredError
+		if err := sm.TransferContext(alice, "acc1", "acc2", amount); !errors.As(err, &approvalErr) {
+			t.Fatalf("Transfer above threshold = %v; want *ApprovalRequiredError", err)
+		}
+		return approvalErr.ID
+	}
+
+	approved := park(2000)
+	rejected := park(3000)
+	expired := park(4000)
+
+	if err := sm.TransferContext(alice, "acc1", "acc2", 50000); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Unfundable transfer = %v; want %v", err, ErrInsufficientBalance)
+	}
+
+	if _, err := sm.Approve(alice, approved); !errors.Is(err, ErrSelfApproval) {
+		t.Errorf("Self approval = %v; want %v", err, ErrSelfApproval)
+	}
+	if p, err := sm.Approve(bob, approved); err != nil || p.Status != ApprovalApproved || p.DecidedBy != "bob" {
+		t.Errorf("Approve = %+v, %v; want approved by bob", p, err)
+	}
+	if _, err := sm.Approve(bob, approved); !errors.Is(err, ErrApprovalDecided) {
+		t.Errorf("Second approval = %v; want %v", err, ErrApprovalDecided)
+	}
+
+	if p, err := sm.Reject(bob, rejected, "suspicious"); err != nil || p.Status != ApprovalRejected {
+		t.Errorf("Reject = %+v, %v; want rejected", p, err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := sm.Approve(bob, expired); !errors.Is(err, ErrApprovalDecided) {
+		t.Errorf("Approve after expiry = %v; want %v", err, ErrApprovalDecided)
+	}
+
+	var statuses []ApprovalStatus
+	for _, p := range sm.Approvals() {
+		statuses = append(statuses, p.Status)
+	}
+	expectedStatuses := []ApprovalStatus{ApprovalApproved, ApprovalRejected, ApprovalExpired}
+	if len(statuses) != len(expectedStatuses) {
+		t.Fatalf("Approvals statuses = %v; want %v", statuses, expectedStatuses)
+	}
+	for i, status := range expectedStatuses {
+		if statuses[i] != status {
+			t.Errorf("Approvals[%d] = %s; want %s", i, statuses[i], status)
+		}
+	}
+
+	// Only the transfer at the threshold and the approved one moved funds.
+	expectedAccounts := map[string]int{"acc1": 7000, "acc2": 3500}
+	for acc, expectedBalance := range expectedAccounts {
+		if sm.accounts[acc] != expectedBalance {
+			t.Errorf("Account %s balance = %d; want %d", acc, sm.accounts[acc], expectedBalance)
+		}
+	}
+	if sm.history.len() != 2 {
+		t.Errorf("History length = %d; want 2", sm.history.len())
+	}
+}
+
+func TestServerApprovals(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 10000, "acc2": 0})
+	sm.RequireApproval(100, time.Hour)
+
+	auth := NewAuthenticator(nil)
+	_ = auth.AddAPIKey("alice-key", Principal{Subject: "alice", Role: RoleAdmin})
+	_ = auth.AddAPIKey("bob-key", Principal{Subject: "bob", Role: RoleAdmin})
+	_ = auth.AddAPIKey("carol-key", Principal{Subject: "carol", Role: RoleOperator, Accounts: []string{"acc1"}})
+	srv.UseAuth(auth)
+
+	do := func(apiKey, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(APIKeyHeader, apiKey)
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do("alice-key", "POST", "/transfers", `{"from": "acc1", "to": "acc2", "amount": 500}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("Transfer above threshold = %d; want %d", rec.Code, http.StatusAccepted)
+	}
+	var parked struct {
+		ApprovalID string `json:"approval_id"`
+	}
+	_ = json.NewDecoder(rec.Body).Decode(&parked)
+
+	if rec := do("carol-key", "POST", "/approvals/"+parked.ApprovalID+"/approve", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Approve by operator = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := do("alice-key", "POST", "/approvals/"+parked.ApprovalID+"/approve", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Approve by requester = %d; want %d", rec.Code, http.StatusForbidden)
+	}
+	if rec := do("bob-key", "POST", "/approvals/"+parked.ApprovalID+"/approve", ""); rec.Code != http.StatusOK {
+		t.Errorf("Approve by second admin = %d; want %d (%s)", rec.Code, http.StatusOK, rec.Body)
+	}
+	if rec := do("bob-key", "GET", "/approvals/nope", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Unknown approval = %d; want %d", rec.Code, http.StatusNotFound)
+	}
+
+	if sm.accounts["acc2"] != 500 {
+		t.Errorf("Account acc2 balance = %d; want 500", sm.accounts["acc2"])
+	}
+}
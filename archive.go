@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ErrNoArchive is returned when bootstrapping from an archive holding no
+// backup.
+var ErrNoArchive = errors.New("no archived backup")
+
+// archiveTimeFormat names archived backups so they sort by time.
+const archiveTimeFormat = "20060102T150405.000000000Z"
+
+// archiveAAD binds sealed archived backups to their purpose, see snapshotAAD.
+var archiveAAD = []byte("vaultflow-archive")
+
+// ObjectStore is an object storage bucket archives are kept in, such as an
+// S3Store.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the keys starting with prefix, in lexical order.
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// ArchiveOptions configure where backups are archived and for how long.
+type ArchiveOptions struct {
+	Prefix string // prepended to the key of every backup, e.g. "prod/"
+
+	// Keep bounds the number of backups kept and MaxAge their age, 0
+	// meaning unbounded. The newest backup is always kept.
+	Keep   int
+	MaxAge time.Duration
+
+	// Compression compresses the backups; they restore whatever it is.
+	Compression Compression
+
+	// WAL, if set, has its sealed segments archived too, compressed the
+	// same, see WAL.ArchiveSegments.
+	WAL *WAL
+
+	// Encryptor, if set, seals the backups once compressed. The segments
+	// of WAL are archived as written, sealed by its own encryptor.
+	Encryptor *Encryptor
+}
+
+// Archive uploads a backup of the state machine to store, see Backup, and
+// then deletes the archived backups opts no longer retains. It returns the
+// key of the new backup.
+func (sm *StateMachine) Archive(ctx context.Context, store ObjectStore, opts ArchiveOptions) (string, error) {
+	var buf bytes.Buffer
+	if err := sm.Backup(&buf); err != nil {
+		return "", err
+	}
+
+	data, err := Compress(opts.Compression, buf.Bytes())
+	if err != nil {
+		return "", err
+	}
+	if opts.Encryptor != nil {
+		if data, err = opts.Encryptor.Seal(data, archiveAAD); err != nil {
+			return "", fmt.Errorf("seal backup: %w", err)
+		}
+	}
+
+	key := fmt.Sprintf("%sbackup-%s.json", opts.Prefix, sm.now().UTC().Format(archiveTimeFormat))
+	if err := store.Put(ctx, key, data); err != nil {
+		return "", fmt.Errorf("archive %s: %w", key, err)
+	}
+	if opts.WAL != nil {
+		if _, err := opts.WAL.ArchiveSegments(ctx, store, opts.Prefix, opts.Compression); err != nil {
+			return key, err
+		}
+	}
+	return key, sm.applyRetention(ctx, store, opts)
+}
+
+// applyRetention deletes the backups beyond opts.Keep or older than
+// opts.MaxAge, except the newest.
+func (sm *StateMachine) applyRetention(ctx context.Context, store ObjectStore, opts ArchiveOptions) error {
+	keys, err := archivedBackups(ctx, store, opts.Prefix)
+	if err != nil {
+		return err
+	}
+
+	now := sm.now()
+	for i, key := range keys[:max(len(keys)-1, 0)] {
+		expired := opts.Keep > 0 && len(keys)-i > opts.Keep
+		if opts.MaxAge > 0 {
+			archived, err := time.Parse(archiveTimeFormat, strings.TrimSuffix(strings.TrimPrefix(key, opts.Prefix+"backup-"), ".json"))
+			expired = expired || err == nil && now.Sub(archived) > opts.MaxAge
+		}
+		if expired {
+			if err := store.Delete(ctx, key); err != nil {
+				return fmt.Errorf("delete archived %s: %w", key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// archivedBackups returns the keys of the backups under prefix, oldest
+// first.
+func archivedBackups(ctx context.Context, store ObjectStore, prefix string) ([]string, error) {
+	keys, err := store.List(ctx, prefix+"backup-")
+	if err != nil {
+		return nil, err
+	}
+	keys = slices.DeleteFunc(keys, func(key string) bool { return !strings.HasSuffix(key, ".json") })
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// RunArchival archives a backup every interval until ctx is done.
+func (sm *StateMachine) RunArchival(ctx context.Context, store ObjectStore, interval time.Duration, opts ArchiveOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if key, err := sm.Archive(ctx, store, opts); err != nil {
+				fmt.Println("Archive Error:", err)
+			} else {
+				fmt.Println("Archived", key)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RestoreArchive bootstraps the state machine from the newest backup
+// archived under prefix, see Restore, opening it with enc if it is sealed.
+// It fails with ErrNoArchive if there is none.
+func (sm *StateMachine) RestoreArchive(ctx context.Context, store ObjectStore, prefix string, enc *Encryptor) (string, error) {
+	keys, err := archivedBackups(ctx, store, prefix)
+	if err != nil {
+		return "", err
+	}
+	if len(keys) == 0 {
+		return "", fmt.Errorf("%w under %q", ErrNoArchive, prefix)
+	}
+
+	key := keys[len(keys)-1]
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("get archived %s: %w", key, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("get archived %s: %w", key, err)
+	}
+
+	if IsSealed(data) {
+		if enc == nil {
+			return "", fmt.Errorf("archived %s is encrypted but no encryptor was given", key)
+		}
+		if data, err = enc.Open(data, archiveAAD); err != nil {
+			return "", fmt.Errorf("open archived %s: %w", key, err)
+		}
+	}
+	return key, sm.Restore(bytes.NewReader(data), LatestVersion)
+}
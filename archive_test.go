@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is an ObjectStore in memory.
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (m *memStore) Put(ctx context.Context, key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.objects == nil {
+		m.objects = map[string][]byte{}
+	}
+	m.objects[key] = data
+	return nil
+}
+
+func (m *memStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.objects[key]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memStore) List(ctx context.Context, prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+func (m *memStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func TestArchiveRetention(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name         string
+		opts         ArchiveOptions
+		expectedKept int
+	}{
+		{"Unbounded", ArchiveOptions{Prefix: "prod/"}, 5},
+		{"Keep", ArchiveOptions{Prefix: "prod/", Keep: 2}, 2},
+		{"Max age", ArchiveOptions{Prefix: "prod/", MaxAge: 150 * time.Minute}, 3},
+		{"Max age keeps the newest", ArchiveOptions{Prefix: "prod/", MaxAge: time.Second}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+			sm := &StateMachine{accounts: map[string]int{"acc1": 0}}
+			sm.UseClock(clock)
+			store := &memStore{}
+			_ = store.Put(context.Background(), "other/backup-x.json", nil) // another prefix
+
+			var keys []string
+			for range 5 {
+				_ = sm.Deposit("acc1", 1)
+				key, err := sm.Archive(context.Background(), store, tt.opts)
+				if err != nil {
+					t.Fatalf("Archive() error = %v", err)
+				}
+				keys = append(keys, key)
+				clock.Advance(time.Hour)
+			}
+
+			kept, _ := store.List(context.Background(), "prod/")
+			if expected := keys[len(keys)-tt.expectedKept:]; !slices.Equal(kept, expected) {
+				t.Errorf("Kept %v; want %v", kept, expected)
+			}
+			if _, ok := store.objects["other/backup-x.json"]; !ok {
+				t.Errorf("Retention deleted a backup under another prefix")
+			}
+		})
+	}
+}
+
+func TestRestoreArchive(t *testing.T) {
+	quiet(t)
+
+	store := &memStore{}
+	fresh := &StateMachine{}
+	if _, err := fresh.RestoreArchive(context.Background(), store, "", nil); !errors.Is(err, ErrNoArchive) {
+		t.Fatalf("RestoreArchive() of an empty archive error = %v; want ErrNoArchive", err)
+	}
+
+	clock := NewFakeClock(time.Now())
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 50}}
+	sm.UseClock(clock)
+	_ = sm.Transfer("acc1", "acc2", 10)
+	if _, err := sm.Archive(context.Background(), store, ArchiveOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second)
+	_ = sm.Deposit("acc1", 5)
+	latest, err := sm.Archive(context.Background(), store, ArchiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := fresh.RestoreArchive(context.Background(), store, "", nil)
+	if err != nil {
+		t.Fatalf("RestoreArchive() error = %v", err)
+	}
+	if key != latest {
+		t.Errorf("RestoreArchive() restored %s; want the newest backup %s", key, latest)
+	}
+	if balances := fresh.Balances(); !maps.Equal(balances, sm.Balances()) {
+		t.Errorf("Balances() = %v; want %v", balances, sm.Balances())
+	}
+	if fresh.Version() != sm.Version() {
+		t.Errorf("Version() = %d; want %d", fresh.Version(), sm.Version())
+	}
+}
+
+func TestArchiveEncrypted(t *testing.T) {
+	quiet(t)
+
+	keys, _ := NewKeyring("k1", bytes.Repeat([]byte{5}, 32))
+	enc := NewEncryptor(keys)
+	store := &memStore{}
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	_ = sm.Deposit("acc1", 5)
+	key, err := sm.Archive(context.Background(), store, ArchiveOptions{Compression: CompressionGzip, Encryptor: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(store.objects[key]) {
+		t.Fatalf("archived %s is not sealed", key)
+	}
+
+	if _, err := (&StateMachine{}).RestoreArchive(context.Background(), store, "", nil); err == nil {
+		t.Errorf("RestoreArchive() without an encryptor succeeded; want an error")
+	}
+	fresh := &StateMachine{}
+	if _, err := fresh.RestoreArchive(context.Background(), store, "", enc); err != nil {
+		t.Fatalf("RestoreArchive() error = %v", err)
+	}
+	if balances := fresh.Balances(); !maps.Equal(balances, sm.Balances()) {
+		t.Errorf("Balances() = %v; want %v", balances, sm.Balances())
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Olusamimaths/vaultflow/config"
+)
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrForbidden       = errors.New("forbidden")
+)
+
+type Role string
+
+const (
+	RoleReadOnly Role = "read-only" // may read balances
+	RoleOperator Role = "operator"  // may also deposit, and debit the accounts it owns
+	RoleAdmin    Role = "admin"     // may do anything, including rollback
+)
+
+func (r Role) valid() bool {
+	return r == RoleReadOnly || r == RoleOperator || r == RoleAdmin
+}
+
+type Action string
+
+const (
+	ActionRead     Action = "read"
+	ActionDeposit  Action = "deposit"
+	ActionWithdraw Action = "withdraw" // also required on the sender of a transfer
+	ActionRollback Action = "rollback"
+	ActionApprove  Action = "approve" // approve or reject parked transfers
+	ActionManage   Action = "manage"  // e.g. creating tenants
+)
+
+// Principal is an authenticated API caller.
+type Principal struct {
+	Subject  string
+	Role     Role
+	Tenant   string   // namespace the principal belongs to, empty for the root
+	Accounts []string // accounts owned by the principal, within its tenant
+}
+
+// CanAccessTenant reports whether the principal may address tenantId's
+// namespace. Root admins may address every tenant.
+func (p *Principal) CanAccessTenant(tenantId string) bool {
+	return p.Tenant == tenantId || (p.Tenant == "" && p.Role == RoleAdmin)
+}
+
+func (p *Principal) Owns(accountId string) bool {
+	return slices.Contains(p.Accounts, accountId)
+}
+
+// Can reports whether the principal may perform action on accountId.
+func (p *Principal) Can(action Action, accountId string) bool {
+	switch p.Role {
+	case RoleAdmin:
+		return true
+	case RoleOperator:
+		switch action {
+		case ActionRead, ActionDeposit:
+			return true
+		case ActionWithdraw:
+			return p.Owns(accountId)
+		}
+	case RoleReadOnly:
+		return action == ActionRead
+	}
+	return false
+}
+
+const APIKeyHeader = "X-API-Key"
+
+// Authenticator resolves API keys and HS256 signed JWTs to principals.
+type Authenticator struct {
+	mu        sync.RWMutex
+	apiKeys   map[string]Principal
+	jwtSecret []byte // nil disables JWT authentication
+	now       func() time.Time
+}
+
+func NewAuthenticator(jwtSecret []byte) *Authenticator {
+	return &Authenticator{
+		apiKeys:   map[string]Principal{},
+		jwtSecret: jwtSecret,
+		now:       time.Now,
+	}
+}
+
+func (a *Authenticator) AddAPIKey(key string, p Principal) error {
+	if key == "" {
+		return fmt.Errorf("empty api key for %s", p.Subject)
+	}
+	if !p.Role.valid() {
+		return fmt.Errorf("invalid role (%s) for %s", p.Role, p.Subject)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.apiKeys[key] = p
+	return nil
+}
+
+// Authenticate reads the caller's credentials from the X-API-Key header or an
+// "Authorization: Bearer <jwt>" header.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return a.authenticateAPIKey(key)
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return a.authenticateJWT(token)
+	}
+	return nil, fmt.Errorf("%w: missing credentials", ErrUnauthenticated)
+}
+
+func (a *Authenticator) authenticateAPIKey(key string) (*Principal, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for candidate, p := range a.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			return &p, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: unknown api key", ErrUnauthenticated)
+}
+
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	Role      Role     `json:"role"`
+	Tenant    string   `json:"tenant,omitempty"`
+	Accounts  []string `json:"accounts"`
+	ExpiresAt int64    `json:"exp"`
+}
+
+func (a *Authenticator) authenticateJWT(token string) (*Principal, error) {
+	if a.jwtSecret == nil {
+		return nil, fmt.Errorf("%w: jwt authentication disabled", ErrUnauthenticated)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed jwt", ErrUnauthenticated)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: unsupported jwt header", ErrUnauthenticated)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, signJWT(a.jwtSecret, parts[0]+"."+parts[1])) {
+		return nil, fmt.Errorf("%w: invalid jwt signature", ErrUnauthenticated)
+	}
+
+	var claims jwtClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: malformed jwt claims", ErrUnauthenticated)
+	}
+	if claims.ExpiresAt != 0 && a.now().Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("%w: jwt expired", ErrUnauthenticated)
+	}
+	if !claims.Role.valid() {
+		return nil, fmt.Errorf("%w: invalid role (%s)", ErrUnauthenticated, claims.Role)
+	}
+
+	return &Principal{Subject: claims.Subject, Role: claims.Role, Tenant: claims.Tenant, Accounts: claims.Accounts}, nil
+}
+
+// IssueJWT signs an HS256 token for p that expires after ttl, or never when
+// ttl is zero.
+func (a *Authenticator) IssueJWT(p Principal, ttl time.Duration) (string, error) {
+	if a.jwtSecret == nil {
+		return "", fmt.Errorf("jwt authentication disabled")
+	}
+
+	claims := jwtClaims{Subject: p.Subject, Role: p.Role, Tenant: p.Tenant, Accounts: p.Accounts}
+	if ttl > 0 {
+		claims.ExpiresAt = a.now().Add(ttl).Unix()
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signJWT(a.jwtSecret, unsigned)), nil
+}
+
+func signJWT(secret []byte, unsigned string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return mac.Sum(nil)
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// newAuthenticator builds an Authenticator from the auth settings of a config.
+func newAuthenticator(cfg config.AuthConfig) (*Authenticator, error) {
+	var secret []byte
+	if cfg.JWTSecret != "" {
+		secret = []byte(cfg.JWTSecret)
+	}
+
+	auth := NewAuthenticator(secret)
+	for key, apiKey := range cfg.APIKeys {
+		p := Principal{Subject: apiKey.Subject, Role: Role(apiKey.Role), Accounts: apiKey.Accounts}
+		if err := auth.AddAPIKey(key, p); err != nil {
+			return nil, err
+		}
+	}
+	return auth, nil
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the authenticated caller stored in ctx, if any.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*Principal)
+	return p, ok
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerAuthorization(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 1000, "acc2": 500})
+
+	auth := NewAuthenticator([]byte("secret"))
+	_ = auth.AddAPIKey("reader-key", Principal{Subject: "reader", Role: RoleReadOnly})
+	_ = auth.AddAPIKey("owner-key", Principal{Subject: "owner", Role: RoleOperator, Accounts: []string{"acc1"}})
+	_ = auth.AddAPIKey("admin-key", Principal{Subject: "admin", Role: RoleAdmin})
+	srv.UseAuth(auth)
+
+	ownerJWT, err := auth.IssueJWT(Principal{Subject: "owner", Role: RoleOperator, Accounts: []string{"acc1"}}, time.Hour)
+	if err != nil {
+		t.Fatalf("IssueJWT failed: %v", err)
+	}
+	auth.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	expiredJWT, _ := auth.IssueJWT(Principal{Subject: "owner", Role: RoleOperator}, time.Minute)
+	auth.now = time.Now
+	forgedJWT, _ := NewAuthenticator([]byte("other")).IssueJWT(Principal{Subject: "admin", Role: RoleAdmin}, 0)
+
+	tests := []struct {
+		name           string
+		apiKey, jwt    string
+		method, path   string
+		body           string
+		expectedStatus int
+	}{
+		{name: "No credentials", method: "GET", path: "/accounts/acc1", expectedStatus: http.StatusUnauthorized},
+		{name: "Unknown api key", apiKey: "nope", method: "GET", path: "/accounts/acc1", expectedStatus: http.StatusUnauthorized},
+		{name: "Read-only reads", apiKey: "reader-key", method: "GET", path: "/accounts/acc2", expectedStatus: http.StatusOK},
+		{name: "Read-only deposits", apiKey: "reader-key", method: "POST", path: "/accounts/acc1/deposit", body: `{"amount": 1}`, expectedStatus: http.StatusForbidden},
+		{name: "Owner withdraws own", apiKey: "owner-key", method: "POST", path: "/accounts/acc1/withdraw", body: `{"amount": 100}`, expectedStatus: http.StatusOK},
+		{name: "Owner withdraws other", apiKey: "owner-key", method: "POST", path: "/accounts/acc2/withdraw", body: `{"amount": 100}`, expectedStatus: http.StatusForbidden},
+		{name: "Owner transfers from other", jwt: ownerJWT, method: "POST", path: "/transfers", body: `{"from": "acc2", "to": "acc1", "amount": 50}`, expectedStatus: http.StatusForbidden},
+		{name: "Owner transfers own via jwt", jwt: ownerJWT, method: "POST", path: "/transfers", body: `{"from": "acc1", "to": "acc2", "amount": 50}`, expectedStatus: http.StatusOK},
+		{name: "Expired jwt", jwt: expiredJWT, method: "GET", path: "/accounts/acc1", expectedStatus: http.StatusUnauthorized},
+		{name: "Forged jwt", jwt: forgedJWT, method: "POST", path: "/rollback", expectedStatus: http.StatusUnauthorized},
+		{name: "Operator rollback", apiKey: "owner-key", method: "POST", path: "/rollback", expectedStatus: http.StatusForbidden},
+		{name: "Admin rollback", apiKey: "admin-key", method: "POST", path: "/rollback", expectedStatus: http.StatusOK},
+		{name: "Health stays open", method: "GET", path: "/healthz", expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.apiKey != "" {
+				req.Header.Set(APIKeyHeader, tt.apiKey)
+			}
+			if tt.jwt != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.jwt)
+			}
+
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, req)
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+
+	// The admin rolled back the owner's transfer, leaving the withdrawal.
+	expectedAccounts := map[string]int{"acc1": 900, "acc2": 500}
+	for acc, expectedBalance := range expectedAccounts {
+		if sm.accounts[acc] != expectedBalance {
+			t.Errorf("Account %s balance = %d; want %d", acc, sm.accounts[acc], expectedBalance)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded is matched by every *OverloadError.
+var ErrOverloaded = errors.New("server overloaded")
+
+// OverloadError is returned when the operations waiting to be applied exceed
+// the server's maximum depth or latency, see Server.UseBackpressure. It is
+// retryable: the queue is expected to have drained after RetryAfter.
+type OverloadError struct {
+	Depth      int           // operations in flight
+	Latency    time.Duration // their recent average latency
+	RetryAfter time.Duration
+}
+
+func (e *OverloadError) Error() string {
+	return fmt.Sprintf("%s: %d operations in flight, %s latency, retry after %s", ErrOverloaded, e.Depth, e.Latency, e.RetryAfter)
+}
+
+func (e *OverloadError) Is(target error) bool {
+	return target == ErrOverloaded
+}
+
+func (e *OverloadError) Retryable() bool {
+	return true
+}
+
+// backpressureWeight is the weight of the latest operation in the moving
+// average of latencies.
+const backpressureWeight = 0.2
+
+// backpressure sheds operations while too many are in flight, waiting for
+// the state lock, or while they recently took too long to be applied,
+// rather than letting latency grow without bound. A zero maximum disables
+// its limit.
+type backpressure struct {
+	maxDepth   int
+	maxLatency time.Duration
+
+	mu      sync.Mutex
+	depth   int
+	latency time.Duration // moving average of the latency of operations
+}
+
+// admit counts an operation in flight from now, or fails with an
+// *OverloadError. Operations admitted must be finished.
+//
+// The latency limit only sheds operations while others are in flight: once
+// they all finished the queue is empty, whatever their latency was, and the
+// next operation is admitted to measure it again.
+func (b *backpressure) admit() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if (b.maxDepth > 0 && b.depth >= b.maxDepth) || (b.maxLatency > 0 && b.depth > 0 && b.latency > b.maxLatency) {
+		return &OverloadError{Depth: b.depth, Latency: b.latency, RetryAfter: max(time.Second, b.latency)}
+	}
+	b.depth++
+	return nil
+}
+
+// finish counts an admitted operation out after it took latency.
+func (b *backpressure) finish(latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.depth--
+	if b.latency == 0 {
+		b.latency = latency
+	} else {
+		b.latency += time.Duration(backpressureWeight * float64(latency-b.latency))
+	}
+}
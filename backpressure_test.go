@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackpressure(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxDepth    int
+		maxLatency  time.Duration
+		inFlight    int
+		latency     time.Duration
+		expectedErr error
+	}{
+		{"Under depth", 2, 0, 1, 0, nil},
+		{"At depth", 2, 0, 2, 0, ErrOverloaded},
+		{"Under latency", 0, time.Second, 1, 500 * time.Millisecond, nil},
+		{"Over latency", 0, time.Second, 1, 2 * time.Second, ErrOverloaded},
+		{"Over latency with nothing in flight", 0, time.Second, 0, 2 * time.Second, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &backpressure{maxDepth: tt.maxDepth, maxLatency: tt.maxLatency}
+			if tt.latency > 0 {
+				_ = b.admit()
+				b.finish(tt.latency)
+			}
+			for range tt.inFlight {
+				if err := b.admit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := b.admit()
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("admit() error = %v; want %v", err, tt.expectedErr)
+			}
+			var overloadErr *OverloadError
+			if errors.As(err, &overloadErr) && (overloadErr.Depth != tt.inFlight || overloadErr.RetryAfter < time.Second) {
+				t.Errorf("admit() error = %+v; want %d in flight, retrying after a second or more", overloadErr, tt.inFlight)
+			}
+		})
+	}
+}
+
+func TestBackpressureLatencyAverage(t *testing.T) {
+	b := &backpressure{}
+	for _, latency := range []time.Duration{time.Second, 2 * time.Second} {
+		_ = b.admit()
+		b.finish(latency)
+	}
+	if expected := 1200 * time.Millisecond; b.latency != expected {
+		t.Errorf("latency = %s; want %s", b.latency, expected)
+	}
+}
+
+// TestServerBackpressure sheds a second operation while the first waits for
+// the state lock.
+func TestServerBackpressure(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+	srv.UseBackpressure(1, 0)
+	deposit := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/accounts/acc1/deposit", strings.NewReader(`{"amount": 10}`)))
+		return rec
+	}
+
+	sm.mu.Lock()
+	var wg sync.WaitGroup
+	var first *httptest.ResponseRecorder
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		first = deposit()
+	}()
+	for {
+		srv.pressure.mu.Lock()
+		depth := srv.pressure.depth
+		srv.pressure.mu.Unlock()
+		if depth == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := deposit()
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Deposit while one is in flight = %d, Retry-After %q; want 429 with Retry-After", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	read := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(read, httptest.NewRequest(http.MethodGet, "/accounts/acc1", nil))
+	if read.Code != http.StatusOK {
+		t.Errorf("Read while one operation is in flight = %d; want 200", read.Code)
+	}
+
+	sm.mu.Unlock()
+	wg.Wait()
+	if first.Code != http.StatusOK {
+		t.Errorf("Deposit in flight = %d; want 200 (%s)", first.Code, first.Body)
+	}
+	if rec := deposit(); rec.Code != http.StatusOK {
+		t.Errorf("Deposit after the queue drained = %d; want 200 (%s)", rec.Code, rec.Body)
+	}
+}
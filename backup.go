@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Olusamimaths/vaultflow/config"
+)
+
+const backupFormat = 1
+
+// LatestVersion restores a backup to the state it was taken at.
+const LatestVersion = -1
+
+// backupFile is a consistent copy of a StateMachine: its current state and
+// the history and operations leading to it.
+type backupFile struct {
+	Format     int                 `json:"format"`
+	Version    int                 `json:"version"` // of the current state
+	Snapshot   snapshotFile        `json:"snapshot"`
+	History    []backupState       `json:"history"` // oldest first
+	Operations []Operation         `json:"operations"`
+	Tags       map[string][]string `json:"tags,omitempty"`
+	Aliases    map[string]string   `json:"aliases,omitempty"`
+	Tombstones []Tombstone         `json:"tombstones,omitempty"`
+
+	// Approvals and Debits hold the transfers parked for approval and the
+	// debits parked for signatures, whatever their status.
+	Approvals []PendingTransfer `json:"approvals,omitempty"`
+	Debits    []PendingDebit    `json:"debits,omitempty"`
+}
+
+// backupState is a historyEntry, see there.
+type backupState struct {
+	Version  int            `json:"version"`
+	Saved    time.Time      `json:"saved"`
+	Balances map[string]int `json:"balances"`
+	Absent   []string       `json:"absent,omitempty"`
+	Full     bool           `json:"full,omitempty"`
+}
+
+// Backup writes a consistent archive of the state machine to w: the current
+// balances, outbox, processed messages, alerts, escrows, signer sets,
+// standing orders, archived accounts, statuses and dead letters as
+// WriteSnapshot persists them, plus the rollback history, the operations in
+// it, the tombstones of pruned ones, the tags, the aliases and the pending
+// approvals and debits, all taken under one lock. Restore
+// can bring the archive back at any version in that history.
+func (sm *StateMachine) Backup(w io.Writer) error {
+	sm.mu.Lock()
+	data, err := json.Marshal(sm.backup())
+	sm.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// backup returns the current state as Backup archives it, sharing its maps:
+// it must be encoded before sm.mu is released.
+func (sm *StateMachine) backup() backupFile {
+	backup := backupFile{
+		Format:  backupFormat,
+		Version: sm.version,
+		Snapshot: snapshotFile{
+			Version:   snapshotVersion,
+			Accounts:  sm.accounts,
+			Outbox:    sm.outbox.entries,
+			OutboxSeq: sm.outbox.lastSeq,
+			Inbox:     sm.inbox.operations(),
+			Alerts:    sm.alerts.defined,
+			Escrows:   sm.escrows.list(),
+			Signers:   sm.multisig.signerSets(),
+
+			OutboxOffsets:  sm.outbox.offsets,
+			StandingOrders: sm.standingOrders.list(),
+			Archived:       sm.archivedList(),
+			LastActive:     sm.lastActive,
+			Statuses:       sm.statuses,
+			DeadLetters:    sm.deadLetters.entries,
+		},
+		History:    make([]backupState, len(sm.history.entries)),
+		Operations: sm.journal,
+		Tags:       sm.tags,
+		Aliases:    sm.aliases.all(),
+		Tombstones: sm.tombstones,
+		Approvals:  sm.Approvals(),
+		Debits:     sm.PendingDebits(),
+	}
+	for i, entry := range sm.history.entries {
+		backup.History[i] = backupState{
+			Version:  entry.version,
+			Saved:    entry.saved,
+			Balances: entry.balances,
+			Absent:   entry.absent,
+			Full:     entry.full,
+		}
+	}
+	return backup
+}
+
+// readBackup decodes a backup written by Backup, possibly compressed,
+// migrating it from an older format.
+func readBackup(r io.Reader) (backupFile, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return backupFile{}, err
+	}
+	if data, err = Decompress(data); err != nil {
+		return backupFile{}, fmt.Errorf("decompress backup: %w", err)
+	}
+	data, applied, err := migrations.Migrate(KindBackup, data)
+	if err != nil {
+		return backupFile{}, err
+	}
+	logMigrations(applied)
+
+	var backup backupFile
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return backupFile{}, fmt.Errorf("decode backup: %w", err)
+	}
+	return backup, nil
+}
+
+// history returns the rollback history of the backup.
+func (b *backupFile) history() stateHistory {
+	var history stateHistory
+	for _, state := range b.History {
+		history.entries = append(history.entries, historyEntry{
+			version:  state.Version,
+			saved:    state.Saved,
+			balances: state.Balances,
+			absent:   state.Absent,
+			full:     state.Full,
+		})
+		history.sinceSnapshot++
+		if state.Full {
+			history.sinceSnapshot = 0
+		}
+	}
+	return history
+}
+
+// Restore replaces the state machine's state with a backup written by
+// Backup, as it was at upToVersion, or as it was when the backup was taken
+// for LatestVersion. The version must be in the backup's history. States and
+// operations after it are dropped, as if rolled back, which fails with
+// ErrIrreversible if an account was archived, restored or changed status
+// since; the outbox, processed messages, alerts, escrows, signer sets,
+// standing orders, archived accounts, statuses, dead letters and pending
+// approvals and debits are restored as they were when the backup was taken.
+// Pending approvals are only restored if approvals are required.
+func (sm *StateMachine) Restore(r io.Reader, upToVersion int) error {
+	backup, err := readBackup(r)
+	if err != nil {
+		return err
+	}
+	history := backup.history()
+
+	accounts := maps.Clone(backup.Snapshot.Accounts)
+	if accounts == nil {
+		accounts = map[string]int{}
+	}
+	version := backup.Version
+	if upToVersion != LatestVersion && upToVersion != version {
+		if upToVersion > version {
+			return fmt.Errorf("%w (%d is after the backup's version %d)", ErrUnknownVersion, upToVersion, version)
+		}
+		if err := checkIrreversibleAfter(backup.Operations, upToVersion); err != nil {
+			return err
+		}
+		if accounts, err = history.restore(accounts, upToVersion); err != nil {
+			return err
+		}
+		version = upToVersion
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.accounts = accounts
+	sm.balanceIndex.invalidate()
+	sm.version = version
+	sm.storeState()
+	sm.history = history
+	sm.journal = backup.Operations
+	sm.forgetOperationsAfter(version)
+	sm.tags = backup.Tags
+	sm.aliases.restore(backup.Aliases)
+	sm.tombstones = backup.Tombstones
+	sm.outbox.entries, sm.outbox.lastSeq, sm.outbox.offsets = backup.Snapshot.Outbox, backup.Snapshot.OutboxSeq, backup.Snapshot.OutboxOffsets
+	sm.inbox.restore(backup.Snapshot.Inbox)
+	sm.alerts.restore(backup.Snapshot.Alerts, sm.accounts)
+	sm.escrows.restore(backup.Snapshot.Escrows)
+	sm.multisig.restore(backup.Snapshot.Signers)
+	sm.standingOrders.restore(backup.Snapshot.StandingOrders)
+	sm.restoreArchived(backup.Snapshot.Archived, backup.Snapshot.LastActive)
+	sm.statuses = backup.Snapshot.Statuses
+	sm.deadLetters.entries = backup.Snapshot.DeadLetters
+	sm.multisig.restoreDebits(backup.Debits)
+	if a := sm.approvals.Load(); a != nil {
+		a.restore(backup.Approvals)
+	}
+	sm.endEpoch()
+	return nil
+}
+
+// runBackup implements "vaultflow backup": it downloads a backup of a
+// running instance to a file.
+func runBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	addr := flags.String("addr", "http://localhost:8080", "base URL of the instance to back up")
+	apiKey := flags.String("api-key", os.Getenv(config.EnvPrefix+"API_KEY"), "admin API key, sent as X-API-Key")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: vaultflow backup [-addr url] [-api-key key] file")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("want a backup file")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, *addr+"/backup", nil)
+	if err != nil {
+		return err
+	}
+	if *apiKey != "" {
+		req.Header.Set("X-API-Key", *apiKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", *addr, resp.Status)
+	}
+
+	f, err := os.Create(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runRestore implements "vaultflow restore": it restores a backup file,
+// optionally to a past version, into the storage of the configuration, for
+// the next start to serve. The write-ahead log of the state replaced is set
+// aside, so it is not replayed on top of the restored state.
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "path to a YAML, TOML or JSON config file")
+	version := flags.Int("version", LatestVersion, "version to restore, the latest in the backup by default")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: vaultflow restore [-config path] [-version n] file")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("want a backup file")
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+	if !cfg.Storage.WAL {
+		return fmt.Errorf("restoring needs storage.wal, for the restored state to be kept in storage.dir")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	sm := &StateMachine{maxHistory: cfg.Limits.MaxHistory}
+	err = sm.Restore(f, *version)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	walDir := filepath.Join(cfg.Storage.Dir, "wal")
+	if _, err := os.Stat(walDir); err == nil {
+		aside := fmt.Sprintf("%s-replaced-%s", walDir, time.Now().UTC().Format(archiveTimeFormat))
+		if err := os.Rename(walDir, aside); err != nil {
+			return err
+		}
+		fmt.Println("Set the write-ahead log of the replaced state aside in", aside)
+	}
+	enc, err := newEncryptor(cfg)
+	if err != nil {
+		return err
+	}
+	if err := sm.WriteCheckpoint(filepath.Join(cfg.Storage.Dir, checkpointName), enc); err != nil {
+		return err
+	}
+	fmt.Printf("Restored version %d to %s: %v\n", sm.Version(), cfg.Storage.Dir, sm.Balances())
+	return nil
+}
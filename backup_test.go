@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 500}}
+	_ = sm.Deposit("acc1", 100)          // version 1
+	_ = sm.OpenAccount("acc3", 30)       // version 2
+	_ = sm.Transfer("acc1", "acc3", 200) // version 3
+	_ = sm.SetAccountTags("acc1", "vip")
+
+	var buf bytes.Buffer
+	if err := sm.Backup(&buf); err != nil {
+		t.Fatalf("Backup() error = %v", err)
+	}
+	_ = sm.Withdraw("acc2", 100) // after the backup
+
+	tests := []struct {
+		name             string
+		version          int
+		expectedBalances map[string]int
+		expectedOps      int
+		expectedErr      error
+	}{
+		{"Latest", LatestVersion, map[string]int{"acc1": 900, "acc2": 500, "acc3": 230}, 3, nil},
+		{"Backup version", 3, map[string]int{"acc1": 900, "acc2": 500, "acc3": 230}, 3, nil},
+		{"Before the transfer", 2, map[string]int{"acc1": 1100, "acc2": 500, "acc3": 30}, 2, nil},
+		{"Before the account was opened", 1, map[string]int{"acc1": 1100, "acc2": 500}, 1, nil},
+		{"Initial state", 0, map[string]int{"acc1": 1000, "acc2": 500}, 0, nil},
+		{"After the backup", 4, nil, 0, ErrUnknownVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored := &StateMachine{}
+			err := restored.Restore(bytes.NewReader(buf.Bytes()), tt.version)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Restore(%d) error = %v; want %v", tt.version, err, tt.expectedErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if balances := restored.Balances(); !maps.Equal(balances, tt.expectedBalances) {
+				t.Errorf("Balances() = %v; want %v", balances, tt.expectedBalances)
+			}
+			if ops := restored.Operations(); len(ops) != tt.expectedOps {
+				t.Errorf("Operations() = %d operations; want %d", len(ops), tt.expectedOps)
+			}
+			if tt.version != LatestVersion && restored.Version() != tt.version {
+				t.Errorf("Version() = %d; want %d", restored.Version(), tt.version)
+			}
+			if tags := restored.AccountTags("acc1"); len(tags) != 1 {
+				t.Errorf("AccountTags(acc1) = %v; want [vip]", tags)
+			}
+		})
+	}
+
+	// A restored state machine carries on from the restored version, and
+	// can still be rolled back past it.
+	restored := &StateMachine{}
+	if err := restored.Restore(bytes.NewReader(buf.Bytes()), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Rollback(); err != nil {
+		t.Fatalf("Rollback() after Restore error = %v", err)
+	}
+	if _, err := restored.Balance("acc3"); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("Balance(acc3) after rolling back its opening error = %v; want ErrInvalidAccount", err)
+	}
+}
+
+func TestBackupCommand(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+	_ = sm.Deposit("acc1", 1)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	path := filepath.Join(t.TempDir(), "backup.json")
+	if err := runBackup([]string{"-addr", ts.URL, path}); err != nil {
+		t.Fatalf("runBackup() error = %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	restored := &StateMachine{}
+	if err := restored.Restore(f, LatestVersion); err != nil {
+		t.Fatalf("Restore() of the downloaded backup error = %v", err)
+	}
+	if balance, _ := restored.Balance("acc1"); balance != 1001 {
+		t.Errorf("Balance(acc1) = %d; want 1001", balance)
+	}
+
+	if err := runBackup([]string{"-addr", ts.URL + "/missing", path}); err == nil {
+		t.Errorf("runBackup() of a missing instance succeeded; want an error")
+	}
+}
+
+func TestRestoreCommand(t *testing.T) {
+	quiet(t)
+	dir := t.TempDir()
+	cfgPath := filepath.Join(dir, "config.yaml")
+	storage := filepath.Join(dir, "data")
+	if err := os.WriteFile(cfgPath, []byte("storage:\n  dir: "+storage+"\n  wal: true\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000}}
+	_ = sm.Deposit("acc1", 1)
+	_ = sm.Deposit("acc1", 2)
+	path := filepath.Join(dir, "backup.json")
+	var buf bytes.Buffer
+	if err := sm.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log of the state replaced holds a later version.
+	old, w := walMachine(t, filepath.Join(storage, "wal"), WALOptions{})
+	for range 3 {
+		_ = old.Deposit("acc1", 100)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runRestore([]string{"-config", cfgPath, "-version", "1", path}); err != nil {
+		t.Fatalf("runRestore() error = %v", err)
+	}
+
+	// The next start restores the checkpoint and replays the new log.
+	w, err := OpenWAL(filepath.Join(storage, "wal"), WALOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	started := &StateMachine{accounts: map[string]int{}}
+	if restored, err := started.RestoreCheckpoint(filepath.Join(storage, checkpointName), nil); !restored || err != nil {
+		t.Fatalf("RestoreCheckpoint() = %v, %v; want restored", restored, err)
+	}
+	if replayed, err := started.ReplayWAL(w); replayed != 0 || err != nil {
+		t.Errorf("ReplayWAL() = %d, %v; want nothing replayed", replayed, err)
+	}
+	if balance, _ := started.Balance("acc1"); balance != 1001 || started.Version() != 1 {
+		t.Errorf("acc1 = %d at version %d; want 1001 at version 1", balance, started.Version())
+	}
+	if aside, _ := filepath.Glob(filepath.Join(storage, "wal-replaced-*")); len(aside) != 1 {
+		t.Errorf("logs set aside = %v; want the replaced one", aside)
+	}
+
+	noWAL := filepath.Join(dir, "nowal.yaml")
+	if err := os.WriteFile(noWAL, []byte("storage:\n  dir: "+storage+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRestore([]string{"-config", noWAL, path}); err == nil {
+		t.Errorf("runRestore() without storage.wal succeeded; want an error")
+	}
+}
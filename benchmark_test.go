@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newBenchmarkStateMachine(accounts int) *StateMachine {
+	sm := &StateMachine{accounts: map[string]int{}}
+	for i := range accounts {
+		sm.accounts["acc"+strconv.Itoa(i)] = 1 << 40
+	}
+	return sm
+}
+
+func BenchmarkOperations(b *testing.B) {
+	quiet(b)
+
+	operations := []struct {
+		name string
+		fn   func(sm *StateMachine, i int) error
+	}{
+		{"Deposit", func(sm *StateMachine, i int) error { return sm.Deposit("acc"+strconv.Itoa(i%100), 10) }},
+		{"Withdraw", func(sm *StateMachine, i int) error { return sm.Withdraw("acc"+strconv.Itoa(i%100), 10) }},
+		{"Transfer", func(sm *StateMachine, i int) error {
+			return sm.Transfer("acc"+strconv.Itoa(i%100), "acc"+strconv.Itoa((i+1)%100), 10)
+		}},
+	}
+
+	for _, op := range operations {
+		b.Run(op.name, func(b *testing.B) {
+			sm := newBenchmarkStateMachine(100)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := range b.N {
+				if err := op.fn(sm, i); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkContention measures throughput with workers applying operations
+// to the same state machine concurrently.
+func BenchmarkContention(b *testing.B) {
+	quiet(b)
+
+	for _, workers := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			sm := newBenchmarkStateMachine(100)
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+			for w := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := w; i < b.N; i += workers {
+						_ = sm.Transfer("acc"+strconv.Itoa(i%100), "acc"+strconv.Itoa((i+7)%100), 1)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// BenchmarkHistory compares saving full snapshots of every state with saving
+// deltas of the accounts an operation touches, and the cost of rolling back
+// through each.
+func BenchmarkHistory(b *testing.B) {
+	now := time.Now()
+
+	for _, accounts := range []int{10, 1000} {
+		sm := newBenchmarkStateMachine(accounts)
+
+		b.Run(fmt.Sprintf("Snapshot/accounts=%d", accounts), func(b *testing.B) {
+			var h stateHistory
+			b.ReportAllocs()
+			for i := range b.N {
+				h.save(i, now, sm.accounts)
+			}
+		})
+
+		b.Run(fmt.Sprintf("Delta/accounts=%d", accounts), func(b *testing.B) {
+			var h stateHistory
+			b.ReportAllocs()
+			for i := range b.N {
+				h.save(i, now, sm.accounts, "acc0", "acc1")
+			}
+		})
+
+		b.Run(fmt.Sprintf("RollbackTo/accounts=%d", accounts), func(b *testing.B) {
+			var h stateHistory
+			for i := range 10 * snapshotInterval {
+				h.save(i, now, sm.accounts, "acc0", "acc1")
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for range b.N {
+				restored := h // restore truncates entries, which stay shared
+				if _, err := restored.restore(sm.accounts, 5*snapshotInterval+snapshotInterval/2); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkStateTransitions compares the lock-based StateMachine with the
+// single-writer Actor behind the same StateTransitions interface.
+func BenchmarkStateTransitions(b *testing.B) {
+	quiet(b)
+
+	models := []struct {
+		name string
+		new  func() (StateTransitions, func())
+	}{
+		{"Mutex", func() (StateTransitions, func()) { return newBenchmarkStateMachine(100), func() {} }},
+		{"Actor", func() (StateTransitions, func()) {
+			actor := NewActor(newBenchmarkStateMachine(100).accounts)
+			return actor, actor.Stop
+		}},
+	}
+
+	for _, model := range models {
+		for _, workers := range []int{1, 4, 16, 64} {
+			b.Run(fmt.Sprintf("%s/workers=%d", model.name, workers), func(b *testing.B) {
+				st, stop := model.new()
+				defer stop()
+				b.ReportAllocs()
+				b.ResetTimer()
+
+				var wg sync.WaitGroup
+				for w := range workers {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := w; i < b.N; i += workers {
+							_ = st.Transfer("acc"+strconv.Itoa(i%100), "acc"+strconv.Itoa((i+7)%100), 1)
+						}
+					}()
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
+
+// BenchmarkBalanceReads measures reads of balances from the published State,
+// idle and while a writer applies transfers, against reads under the state
+// lock as they were before.
+func BenchmarkBalanceReads(b *testing.B) {
+	quiet(b)
+
+	reads := []struct {
+		name string
+		fn   func(sm *StateMachine, accountId string)
+	}{
+		{"State", func(sm *StateMachine, accountId string) { _, _ = sm.Balance(accountId) }},
+		{"Locked", func(sm *StateMachine, accountId string) {
+			sm.mu.Lock()
+			_ = sm.accounts[accountId]
+			sm.mu.Unlock()
+		}},
+	}
+
+	for _, read := range reads {
+		for _, writing := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/writing=%t", read.name, writing), func(b *testing.B) {
+				sm := newBenchmarkStateMachine(1000)
+				sm.State()
+				stop := make(chan struct{})
+				var wg sync.WaitGroup
+				if writing {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for i := 0; ; i++ {
+							select {
+							case <-stop:
+								return
+							default:
+								_ = sm.Transfer("acc"+strconv.Itoa(i%1000), "acc"+strconv.Itoa((i+7)%1000), 1)
+							}
+						}
+					}()
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for i := 0; pb.Next(); i++ {
+						read.fn(sm, "acc"+strconv.Itoa(i%1000))
+					}
+				})
+				b.StopTimer()
+				close(stop)
+				wg.Wait()
+			})
+		}
+	}
+}
+
+// BenchmarkWALGroupCommit measures concurrent operations flushed to disk
+// before being acknowledged, which share flushes as more run at once.
+func BenchmarkWALGroupCommit(b *testing.B) {
+	quiet(b)
+
+	for _, workers := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			w, err := OpenWAL(b.TempDir(), WALOptions{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer w.Close()
+			sm := newBenchmarkStateMachine(100)
+			sm.UseWAL(w)
+			b.ResetTimer()
+
+			var wg sync.WaitGroup
+			for worker := range workers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := worker; i < b.N; i += workers {
+						_ = sm.Deposit("acc"+strconv.Itoa(i%100), 1)
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+			flush := w.Status().Flush
+			b.ReportMetric(float64(flush.Records)/float64(max(flush.Flushes, 1)), "records/flush")
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned, wrapped in a CircuitOpenError, for calls a
+// circuit breaker fails fast instead of making.
+var ErrCircuitOpen = errors.New("circuit open")
+
+// defaultBreakerThreshold and defaultBreakerCooldown are those of circuit
+// breakers created with zeros.
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+)
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // calls go through
+	BreakerOpen     BreakerState = "open"      // calls fail fast
+	BreakerHalfOpen BreakerState = "half-open" // a probe call goes through
+)
+
+// CircuitOpenError is returned for calls a circuit breaker fails fast.
+type CircuitOpenError struct {
+	Name       string
+	RetryAfter time.Duration // until the breaker lets a probe through
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s: %v, retry after %s", e.Name, ErrCircuitOpen, e.RetryAfter)
+}
+
+func (e *CircuitOpenError) Unwrap() error {
+	return ErrCircuitOpen
+}
+
+// CircuitBreaker guards calls to an external dependency, e.g. a storage
+// backend or a webhook target, so that when it is down callers fail fast
+// instead of each waiting for it to time out. It opens once Threshold
+// calls in a row failed; calls then fail with a CircuitOpenError for
+// Cooldown, after which it is half-open and lets a single probe call
+// through, closing if it succeeds and opening again if it fails.
+//
+// Only errors IsRetryable deems transient count as failures: a request the
+// dependency rejected, e.g. with a 4xx, shows it is up.
+type CircuitBreaker struct {
+	Name      string
+	Threshold int           // defaultBreakerThreshold if 0
+	Cooldown  time.Duration // defaultBreakerCooldown if 0
+
+	now func() time.Time // time.Now if nil
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int // in a row
+	openedAt time.Time
+	probing  bool
+}
+
+// NewCircuitBreaker returns a closed circuit breaker opening after
+// threshold failures in a row for cooldown.
+func NewCircuitBreaker(name string, threshold int, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Name: name, Threshold: threshold, Cooldown: cooldown}
+}
+
+func (b *CircuitBreaker) threshold() int {
+	if b.Threshold > 0 {
+		return b.Threshold
+	}
+	return defaultBreakerThreshold
+}
+
+func (b *CircuitBreaker) cooldown() time.Duration {
+	if b.Cooldown > 0 {
+		return b.Cooldown
+	}
+	return defaultBreakerCooldown
+}
+
+func (b *CircuitBreaker) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+	return time.Now()
+}
+
+// Do calls fn unless the breaker is open, and records its outcome.
+func (b *CircuitBreaker) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn(ctx)
+	b.record(ctx, err)
+	return err
+}
+
+// allow reports whether a call may go through, turning an open breaker
+// half-open once its cooldown is over.
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if wait := b.openedAt.Add(b.cooldown()).Sub(b.clock()); wait > 0 {
+			return &CircuitOpenError{Name: b.Name, RetryAfter: wait}
+		}
+		b.state = BreakerHalfOpen
+		fallthrough
+	case BreakerHalfOpen:
+		if b.probing {
+			return &CircuitOpenError{Name: b.Name}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record records the outcome of a call. A call cut short by its context
+// tells nothing of the dependency.
+func (b *CircuitBreaker) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	probe := b.probing
+	b.probing = false
+	if err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled)) {
+		return
+	}
+	if err == nil || !IsRetryable(err) {
+		if b.state != BreakerClosed && b.state != "" {
+			fmt.Printf("Circuit Breaker: %s closed\n", b.Name)
+		}
+		b.state, b.failures = BreakerClosed, 0
+		return
+	}
+
+	b.failures++
+	if probe || b.failures >= b.threshold() {
+		if b.state != BreakerOpen {
+			fmt.Printf("Circuit Breaker: %s opened after %d failures: %v\n", b.Name, b.failures, err)
+		}
+		b.state, b.openedAt = BreakerOpen, b.clock()
+	}
+}
+
+// BreakerStatus is the state of a circuit breaker, see
+// CircuitBreaker.Status.
+type BreakerStatus struct {
+	Name     string       `json:"name"`
+	State    BreakerState `json:"state"`
+	Failures int          `json:"failures"`            // in a row
+	OpenedAt *time.Time   `json:"opened_at,omitempty"` // unless closed
+	ProbeAt  *time.Time   `json:"probe_at,omitempty"`  // when open
+}
+
+// Status returns the state of the breaker.
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := BreakerStatus{Name: b.Name, State: b.state, Failures: b.failures}
+	if status.State == "" {
+		status.State = BreakerClosed
+	}
+	if status.State != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	if status.State == BreakerOpen {
+		probeAt := b.openedAt.Add(b.cooldown())
+		status.ProbeAt = &probeAt
+	}
+	return status
+}
+
+// BreakerStore is an ObjectStore calling Store through Breaker.
+type BreakerStore struct {
+	Store   ObjectStore
+	Breaker *CircuitBreaker
+}
+
+func (s BreakerStore) Put(ctx context.Context, key string, data []byte) error {
+	return s.Breaker.Do(ctx, func(ctx context.Context) error {
+		return s.Store.Put(ctx, key, data)
+	})
+}
+
+func (s BreakerStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	err := s.Breaker.Do(ctx, func(ctx context.Context) (err error) {
+		r, err = s.Store.Get(ctx, key)
+		return err
+	})
+	return r, err
+}
+
+func (s BreakerStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.Breaker.Do(ctx, func(ctx context.Context) (err error) {
+		keys, err = s.Store.List(ctx, prefix)
+		return err
+	})
+	return keys, err
+}
+
+func (s BreakerStore) Delete(ctx context.Context, key string) error {
+	return s.Breaker.Do(ctx, func(ctx context.Context) error {
+		return s.Store.Delete(ctx, key)
+	})
+}
+
+// BreakerPublisher is a Publisher calling Publisher through Breaker, e.g.
+// a WebhookPublisher, so the outbox relay backs off a target that is down.
+type BreakerPublisher struct {
+	Publisher Publisher
+	Breaker   *CircuitBreaker
+}
+
+func (p BreakerPublisher) Publish(ctx context.Context, entries []OutboxEntry) error {
+	return p.Breaker.Do(ctx, func(ctx context.Context) error {
+		return p.Publisher.Publish(ctx, entries)
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	b := NewCircuitBreaker("archive", 3, time.Minute)
+	b.now = clock.Now
+
+	errUnreachable := errors.New("bucket unreachable")
+	calls := 0
+	call := func(err error) error {
+		return b.Do(context.Background(), func(ctx context.Context) error {
+			calls++
+			return err
+		})
+	}
+
+	// Rejections show the dependency is up.
+	for range 5 {
+		_ = call(Permanent(errors.New("forbidden")))
+	}
+	if state := b.Status().State; state != BreakerClosed {
+		t.Fatalf("state after permanent errors = %s; want closed", state)
+	}
+
+	for range 3 {
+		_ = call(errUnreachable)
+	}
+	status := b.Status()
+	if status.State != BreakerOpen || status.Failures != 3 || status.ProbeAt == nil || !status.ProbeAt.Equal(clock.Now().Add(time.Minute)) {
+		t.Fatalf("Status() after 3 failures = %+v; want open until a minute from now", status)
+	}
+
+	calls = 0
+	var open *CircuitOpenError
+	if err := call(nil); !errors.As(err, &open) || !errors.Is(err, ErrCircuitOpen) || open.RetryAfter != time.Minute || calls != 0 {
+		t.Fatalf("call to an open breaker = %v after %d calls; want a CircuitOpenError without calling", err, calls)
+	}
+
+	// A failed probe opens it again for another cooldown.
+	clock.Advance(time.Minute)
+	if err := call(errUnreachable); !errors.Is(err, errUnreachable) || calls != 1 || b.Status().State != BreakerOpen {
+		t.Fatalf("failed probe = %v, state %s; want the error and open", err, b.Status().State)
+	}
+	clock.Advance(30 * time.Second)
+	if err := call(nil); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("call during the second cooldown = %v; want ErrCircuitOpen", err)
+	}
+
+	// A single probe goes through while half-open.
+	clock.Advance(30 * time.Second)
+	probing := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- b.Do(context.Background(), func(ctx context.Context) error {
+			close(probing)
+			<-release
+			return nil
+		})
+	}()
+	<-probing
+	if err := call(nil); !errors.Is(err, ErrCircuitOpen) || b.Status().State != BreakerHalfOpen {
+		t.Errorf("call during a probe = %v, state %s; want ErrCircuitOpen while half-open", err, b.Status().State)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatalf("probe error = %v", err)
+	}
+	if status := b.Status(); status.State != BreakerClosed || status.Failures != 0 || status.OpenedAt != nil {
+		t.Errorf("Status() after a successful probe = %+v; want closed", status)
+	}
+}
+
+func TestCircuitBreakerCancelled(t *testing.T) {
+	quiet(t)
+
+	b := NewCircuitBreaker("webhook", 1, time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for range 3 {
+		_ = b.Do(ctx, func(ctx context.Context) error { return ctx.Err() })
+	}
+	if state := b.Status().State; state != BreakerClosed {
+		t.Errorf("state after cancelled calls = %s; want closed", state)
+	}
+}
+
+func TestBreakerPublisher(t *testing.T) {
+	quiet(t)
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	pub := BreakerPublisher{Publisher: &WebhookPublisher{URL: ts.URL}, Breaker: NewCircuitBreaker("webhook", 2, time.Hour)}
+	entries := []OutboxEntry{{Seq: 1, Event: Event{Operation: Operation{ID: "txn-1", Type: OpDeposit}}}}
+	for range 5 {
+		_ = pub.Publish(context.Background(), entries)
+	}
+	if requests != 2 {
+		t.Errorf("webhook received %d requests; want 2 before the breaker opened", requests)
+	}
+}
+
+func TestServerBreakers(t *testing.T) {
+	quiet(t)
+
+	srv, _ := newTestServer(map[string]int{"acc1": 100})
+	archive := NewCircuitBreaker("archive", 1, time.Minute)
+	srv.UseBreakers(archive, NewCircuitBreaker("webhook", 0, 0))
+	store := BreakerStore{Store: &failingStore{}, Breaker: archive}
+	_ = store.Put(context.Background(), "backup.json", nil)
+
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/breakers", nil))
+	var breakers []BreakerStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &breakers); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /breakers = %d %s", rec.Code, rec.Body)
+	}
+	if len(breakers) != 2 || breakers[0].State != BreakerOpen || breakers[1].State != BreakerClosed {
+		t.Errorf("GET /breakers = %+v; want archive open and webhook closed", breakers)
+	}
+}
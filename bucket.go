@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrInvalidBucket = errors.New("invalid bucket")
+
+// BucketAvailable is the bucket operations without a bucket credit and
+// debit. Other buckets, e.g. "reserved" or "bonus", hold the part of the
+// balance set aside by operations naming them.
+const BucketAvailable = "available"
+
+// bucketSeparator joins an account ID and a bucket name into the key holding
+// the bucket's balance in sm.accounts, e.g. "acc1#reserved". Keeping the
+// buckets there versions them with the account: they are rolled back,
+// snapshotted and replicated along with it. Account IDs cannot contain it.
+const bucketSeparator = "#"
+
+const maxBucketLength = 64
+
+// validateBucket checks that a bucket name in an operation is well-formed;
+// the empty name stands for BucketAvailable.
+func validateBucket(bucket string) error {
+	if len(bucket) > maxBucketLength || strings.Contains(bucket, bucketSeparator) {
+		return fmt.Errorf("%w: %q must be at most %d bytes, without %q", ErrInvalidBucket, bucket, maxBucketLength, bucketSeparator)
+	}
+	return nil
+}
+
+func bucketName(bucket string) string {
+	if bucket == "" {
+		return BucketAvailable
+	}
+	return bucket
+}
+
+func bucketKey(accountId, bucket string) string {
+	return accountId + bucketSeparator + bucketName(bucket)
+}
+
+// isBucketKey reports whether a key of sm.accounts holds a bucket rather
+// than an account.
+func isBucketKey(id string) bool {
+	return strings.Contains(id, bucketSeparator)
+}
+
+// validateAccountId checks an account ID cannot be taken for the key of a
+// bucket of another account.
+func validateAccountId(id string) error {
+	if isBucketKey(id) {
+		return fmt.Errorf("account %q contains %q", id, bucketSeparator)
+	}
+	return nil
+}
+
+// accountOfKey returns the account a key of sm.accounts belongs to.
+func accountOfKey(key string) string {
+	id, _, _ := strings.Cut(key, bucketSeparator)
+	return id
+}
+
+// bucketKeys returns the keys an operation on the buckets of accountId may
+// change, to save them in history first.
+func bucketKeys(accountId string, buckets ...string) []string {
+	keys := []string{accountId, bucketKey(accountId, BucketAvailable)}
+	for _, bucket := range buckets {
+		if bucketName(bucket) != BucketAvailable {
+			keys = append(keys, bucketKey(accountId, bucket))
+		}
+	}
+	return keys
+}
+
+// An account has no bucket key until an operation names a bucket other than
+// BucketAvailable; until then its whole balance is available. From then on
+// the account's balance is the sum of its buckets. sm.mu must be held by the
+// methods below.
+
+func (sm *StateMachine) hasBuckets(accountId string) bool {
+	_, ok := sm.accounts[bucketKey(accountId, BucketAvailable)]
+	return ok
+}
+
+func (sm *StateMachine) bucketBalance(accountId, bucket string) int {
+	if !sm.hasBuckets(accountId) && bucketName(bucket) == BucketAvailable {
+		return sm.accounts[accountId]
+	}
+	return sm.accounts[bucketKey(accountId, bucket)]
+}
+
+// useBuckets starts keeping the buckets of an account apart, with its whole
+// balance available, if an operation names another bucket than
+// BucketAvailable for the first time.
+func (sm *StateMachine) useBuckets(accountId string, buckets ...string) {
+	if sm.hasBuckets(accountId) {
+		return
+	}
+	for _, bucket := range buckets {
+		if bucketName(bucket) != BucketAvailable {
+			sm.accounts[bucketKey(accountId, BucketAvailable)] = sm.accounts[accountId]
+			return
+		}
+	}
+}
+
+// addToBucket adds amount, which may be negative, to a bucket. The caller
+// changes the account's balance by the same amount, unless it moves amount
+// from another of its buckets.
+func (sm *StateMachine) addToBucket(accountId, bucket string, amount int) {
+	if sm.hasBuckets(accountId) {
+		sm.accounts[bucketKey(accountId, bucket)] += amount
+	}
+}
+
+func (sm *StateMachine) Move(accountId, fromBucket, toBucket string, amount int) error {
+	return sm.MoveContext(context.Background(), accountId, fromBucket, toBucket, amount)
+}
+
+// MoveContext moves amount between two buckets of an account, leaving its
+// balance unchanged. It gives up without applying anything if ctx is done
+// before the operation starts.
+func (sm *StateMachine) MoveContext(ctx context.Context, accountId, fromBucket, toBucket string, amount int) error {
+	_, err := sm.execute(ctx, Operation{Type: OpMove, From: accountId, FromBucket: fromBucket, ToBucket: toBucket, Amount: amount})
+	return err
+}
+
+func (sm *StateMachine) applyMove(op Operation) error {
+	accountId, amount := op.From, op.Amount
+	fmt.Printf("\n\nMoving %d in account %s from %s to %s\n", amount, accountId, bucketName(op.FromBucket), bucketName(op.ToBucket))
+
+	sm.saveState(bucketKeys(accountId, op.FromBucket, op.ToBucket)...)
+
+	if _, ok := sm.accounts[accountId]; !ok {
+		return fmt.Errorf("%w (%s) to move within", ErrInvalidAccount, accountId)
+	}
+
+	currentBalance := sm.bucketBalance(accountId, op.FromBucket)
+	if currentBalance < amount {
+		return fmt.Errorf("%w (%d) in %s to move (%d) from", ErrInsufficientBalance, currentBalance, bucketName(op.FromBucket), amount)
+	}
+
+	sm.useBuckets(accountId, op.FromBucket, op.ToBucket)
+	sm.addToBucket(accountId, op.FromBucket, -amount)
+	sm.addToBucket(accountId, op.ToBucket, amount)
+
+	fmt.Println("After move:", sm.buckets(accountId))
+
+	return nil
+}
+
+// Buckets returns the balance of each bucket of an account. An account no
+// operation has named a bucket of holds everything in BucketAvailable.
+func (sm *StateMachine) Buckets(accountId string) (map[string]int, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.accounts[accountId]; !ok {
+		return nil, fmt.Errorf("%w (%s)", ErrInvalidAccount, accountId)
+	}
+	return sm.buckets(accountId), nil
+}
+
+func (sm *StateMachine) buckets(accountId string) map[string]int {
+	if !sm.hasBuckets(accountId) {
+		return map[string]int{BucketAvailable: sm.accounts[accountId]}
+	}
+	prefix := accountId + bucketSeparator
+	buckets := map[string]int{}
+	for id, balance := range sm.accounts {
+		if bucket, ok := strings.CutPrefix(id, prefix); ok {
+			buckets[bucket] = balance
+		}
+	}
+	return buckets
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+
+	tests := []struct {
+		name            string
+		op              Operation
+		expectedErr     error
+		expectedBalance int
+		expectedBuckets map[string]int
+	}{
+		{
+			"Reserve",
+			Operation{Type: OpMove, From: "acc1", ToBucket: "reserved", Amount: 300},
+			nil, 1000, map[string]int{"available": 700, "reserved": 300},
+		},
+		{
+			"Deposit a bonus",
+			Operation{Type: OpDeposit, To: "acc1", ToBucket: "bonus", Amount: 50},
+			nil, 1050, map[string]int{"available": 700, "reserved": 300, "bonus": 50},
+		},
+		{
+			"Withdraw more than available",
+			Operation{Type: OpWithdraw, From: "acc1", Amount: 800},
+			ErrInsufficientBalance, 1050, map[string]int{"available": 700, "reserved": 300, "bonus": 50},
+		},
+		{
+			"Withdraw from available",
+			Operation{Type: OpWithdraw, From: "acc1", Amount: 200},
+			nil, 850, map[string]int{"available": 500, "reserved": 300, "bonus": 50},
+		},
+		{
+			"Transfer out of reserved",
+			Operation{Type: OpTransfer, From: "acc1", To: "acc2", FromBucket: "reserved", ToBucket: "reserved", Amount: 100},
+			nil, 750, map[string]int{"available": 500, "reserved": 200, "bonus": 50},
+		},
+		{
+			"Rollback",
+			Operation{Type: OpRollback},
+			nil, 850, map[string]int{"available": 500, "reserved": 300, "bonus": 50},
+		},
+		{
+			"Move more than the bucket holds",
+			Operation{Type: OpMove, From: "acc1", FromBucket: "bonus", Amount: 60},
+			ErrInsufficientBalance, 850, map[string]int{"available": 500, "reserved": 300, "bonus": 50},
+		},
+		{
+			"Move to the same bucket",
+			Operation{Type: OpMove, From: "acc1", FromBucket: "available", Amount: 10},
+			ErrInvalidOperation, 850, map[string]int{"available": 500, "reserved": 300, "bonus": 50},
+		},
+		{
+			"Bucket with the separator",
+			Operation{Type: OpDeposit, To: "acc1", ToBucket: "a#b", Amount: 10},
+			ErrInvalidBucket, 850, map[string]int{"available": 500, "reserved": 300, "bonus": 50},
+		},
+		{
+			"Bucket key as an account",
+			Operation{Type: OpWithdraw, From: "acc1#reserved", Amount: 10},
+			ErrInvalidOperation, 850, map[string]int{"available": 500, "reserved": 300, "bonus": 50},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := sm.Apply(tt.op); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Apply() error = %v; want %v", err, tt.expectedErr)
+			}
+			if balance, _ := sm.Balance("acc1"); balance != tt.expectedBalance {
+				t.Errorf("Balance() = %d; want %d", balance, tt.expectedBalance)
+			}
+			if buckets, _ := sm.Buckets("acc1"); !maps.Equal(buckets, tt.expectedBuckets) {
+				t.Errorf("Buckets() = %v; want %v", buckets, tt.expectedBuckets)
+			}
+		})
+	}
+
+	if balances := sm.Balances(); len(balances) != 2 {
+		t.Errorf("Balances() = %v; want the 2 accounts without their buckets", balances)
+	}
+	if buckets, _ := sm.Buckets("acc2"); !maps.Equal(buckets, map[string]int{"available": 0}) {
+		t.Errorf("Buckets() of acc2 = %v; want nothing, the transfer was rolled back", buckets)
+	}
+	if _, err := sm.Balance("acc1#reserved"); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("Balance() of a bucket error = %v; want ErrInvalidAccount", err)
+	}
+}
+
+func TestBucketsUnused(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	if err := sm.Withdraw("acc1", 40); err != nil {
+		t.Fatal(err)
+	}
+	if buckets, _ := sm.Buckets("acc1"); !maps.Equal(buckets, map[string]int{"available": 60}) {
+		t.Errorf("Buckets() = %v; want everything available", buckets)
+	}
+	if _, err := sm.Buckets("nope"); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("Buckets() of an unknown account error = %v; want ErrInvalidAccount", err)
+	}
+}
+
+func TestReverseMove(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	op, err := sm.Apply(Operation{Type: OpMove, From: "acc1", ToBucket: "reserved", Amount: 40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.Reverse(op.ID); err != nil {
+		t.Fatalf("Reverse() error = %v", err)
+	}
+	if buckets, _ := sm.Buckets("acc1"); !maps.Equal(buckets, map[string]int{"available": 100, "reserved": 0}) {
+		t.Errorf("Buckets() = %v; want everything available again", buckets)
+	}
+}
+
+func TestBucketsSnapshot(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	_ = sm.Move("acc1", "", "reserved", 30)
+	var buf bytes.Buffer
+	if err := sm.WriteSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &StateMachine{}
+	if err := restored.ReadSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if buckets, _ := restored.Buckets("acc1"); !maps.Equal(buckets, map[string]int{"available": 70, "reserved": 30}) {
+		t.Errorf("Buckets() = %v; want 30 reserved", buckets)
+	}
+	if err := restored.Withdraw("acc1", 80); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Withdraw() error = %v; want ErrInsufficientBalance", err)
+	}
+}
+
+func TestServerBuckets(t *testing.T) {
+	quiet(t)
+
+	srv, _ := newTestServer(map[string]int{"acc1": 1000})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	tests := []struct {
+		name            string
+		method, path    string
+		body            string
+		expectedStatus  int
+		expectedBuckets map[string]int
+	}{
+		{"Move", http.MethodPost, "/accounts/acc1/moves", `{"to": "reserved", "amount": 400}`, http.StatusOK, map[string]int{"available": 600, "reserved": 400}},
+		{"Move too much", http.MethodPost, "/accounts/acc1/moves", `{"from": "reserved", "to": "bonus", "amount": 500}`, http.StatusConflict, nil},
+		{"Bad bucket", http.MethodPost, "/accounts/acc1/moves", `{"to": "a#b", "amount": 1}`, http.StatusBadRequest, nil},
+		{"Withdraw from a bucket", http.MethodPost, "/accounts/acc1/withdraw", `{"amount": 100, "bucket": "reserved"}`, http.StatusOK, nil},
+		{"Get", http.MethodGet, "/accounts/acc1/buckets", "", http.StatusOK, map[string]int{"available": 600, "reserved": 300}},
+		{"Unknown account", http.MethodGet, "/accounts/nope/buckets", "", http.StatusNotFound, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(tt.method, tt.path, tt.body)
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if tt.expectedBuckets == nil {
+				return
+			}
+			var resp bucketsResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(resp.Buckets, tt.expectedBuckets) {
+				t.Errorf("Buckets = %v; want %v", resp.Buckets, tt.expectedBuckets)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// maxBulkLineLength bounds each operation of a bulk stream.
+const maxBulkLineLength = 64 << 10
+
+// BulkResult is the outcome of an operation of a bulk stream, in the order
+// they were sent. Status is the HTTP status the operation would have been
+// answered with on its own, and Operation the operation applied, with its
+// ID and version, if it succeeded.
+type BulkResult struct {
+	Index      int        `json:"index"`
+	Status     int        `json:"status"`
+	Operation  *Operation `json:"operation,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	ApprovalID string     `json:"approval_id,omitempty"`
+	DebitID    string     `json:"debit_id,omitempty"`
+}
+
+// handleBulk applies a stream of operations, one JSON object per line, and
+// streams back a BulkResult for each as soon as it is applied. Operations
+// are authorized and applied one by one, like their own requests would be:
+// a failed operation does not stop the stream. Results are flushed whenever
+// the client has sent nothing more yet, so they can keep sending while
+// reading them, over HTTP/2 or HTTP/1.1.
+//
+// This stands in for a gRPC client-streaming RPC: the module has no
+// dependencies, so it cannot use grpc-go, and newline-delimited JSON over a
+// full-duplex request amortizes round trips the same way.
+func (s *Server) handleBulk(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	rc := http.NewResponseController(w)
+	_ = rc.EnableFullDuplex() // HTTP/2 always is
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	body := bufio.NewReaderSize(r.Body, maxBulkLineLength)
+	encoder := json.NewEncoder(w)
+	for i := 0; ; {
+		line, err := body.ReadSlice('\n')
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = body.ReadSlice('\n') // skip the rest of the line
+			}
+			_ = encoder.Encode(BulkResult{Index: i, Status: http.StatusBadRequest,
+				Error: fmt.Sprintf("%s: operation longer than %d bytes", errBadRequest, maxBulkLineLength)})
+			i++
+		case len(bytes.TrimSpace(line)) > 0:
+			_ = encoder.Encode(s.bulkOperation(r, sm, i, line))
+			i++
+		}
+		if err != nil {
+			return // io.EOF, or the client went away
+		}
+		if body.Buffered() == 0 && rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+// bulkOperation applies an operation of a bulk stream.
+func (s *Server) bulkOperation(r *http.Request, sm *StateMachine, index int, line []byte) BulkResult {
+	result := BulkResult{Index: index}
+	fail := func(err error) BulkResult {
+		result.Status, result.Error = errorStatus(err), err.Error()
+		var approvalErr *ApprovalRequiredError
+		var signaturesErr *SignaturesRequiredError
+		switch {
+		case errors.As(err, &approvalErr):
+			result.Status, result.ApprovalID = http.StatusAccepted, approvalErr.ID
+		case errors.As(err, &signaturesErr):
+			result.Status, result.DebitID = http.StatusAccepted, signaturesErr.ID
+		}
+		return result
+	}
+
+	var op Operation
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&op); err != nil {
+		return fail(fmt.Errorf("%w: %v", errBadRequest, err))
+	}
+	// The request was charged for the first operation.
+	if index > 0 {
+		if err := s.sm.limiter.AllowClient(clientID(r)); err != nil {
+			return fail(err)
+		}
+	}
+	op.From, op.To = sm.ResolveAccount(op.From), sm.ResolveAccount(op.To)
+	if err := s.authorizeOperation(r, op); err != nil {
+		return fail(err)
+	}
+
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+	op, err := sm.ApplyContext(ctx, op)
+	if err != nil {
+		return fail(err)
+	}
+	result.Status, result.Operation = http.StatusOK, &op
+	return result
+}
+
+// authorizeOperation checks that the caller may apply op, needing the same
+// actions as the route applying it.
+func (s *Server) authorizeOperation(r *http.Request, op Operation) error {
+	switch op.Type {
+	case OpDeposit:
+		return s.authorize(r, ActionDeposit, op.To)
+	case OpWithdraw, OpMove:
+		return s.authorize(r, ActionWithdraw, op.From)
+	case OpTransfer:
+		if err := s.authorize(r, ActionWithdraw, op.From); err != nil {
+			return err
+		}
+		return s.authorize(r, ActionDeposit, op.To)
+	case OpRollback, OpRollbackTo:
+		return s.authorize(r, ActionRollback)
+	}
+	return s.authorize(r, ActionManage, op.accounts()...)
+}
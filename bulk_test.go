@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServerBulk(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 1000, "acc2": 0})
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	body := strings.Join([]string{
+		`{"type": "transfer", "from": "acc1", "to": "acc2", "amount": 300}`,
+		`{"type": "withdraw", "from": "acc2", "amount": 500}`,
+		``,
+		`{"type": "deposit", "to": "acc2", "amount": "ten"}`,
+		`{"type": "open", "to": "acc3", "amount": 5, "message_id": "m1"}`,
+		`{"type": "open", "to": "acc3", "amount": 5, "message_id": "m1"}`,
+		`{"type": "deposit", "to": "missing", "amount": 1}`,
+		`{"type": "withdraw", "from": "acc1", "amount": 100}`,
+	}, "\n")
+	resp, err := http.Post(ts.URL+"/operations/bulk", "application/x-ndjson", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	expected := []int{http.StatusOK, http.StatusConflict, http.StatusBadRequest, http.StatusOK, http.StatusConflict, http.StatusNotFound, http.StatusOK}
+	var results []BulkResult
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var result BulkResult
+		if err := decoder.Decode(&result); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, result)
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("POST /operations/bulk = %+v; want %d results", results, len(expected))
+	}
+	for i, result := range results {
+		if result.Index != i || result.Status != expected[i] {
+			t.Errorf("result %d = %+v; want index %d and status %d", i, result, i, expected[i])
+		}
+		if (result.Operation != nil) != (result.Status == http.StatusOK) || (result.Error == "") != (result.Status == http.StatusOK) {
+			t.Errorf("result %d = %+v; want the operation if applied, the error otherwise", i, result)
+		}
+	}
+	if op := results[0].Operation; op.ID == "" || op.Version != 1 {
+		t.Errorf("applied operation = %+v; want its ID and version", op)
+	}
+
+	for id, want := range map[string]int{"acc1": 600, "acc2": 300, "acc3": 5} {
+		if balance, _ := sm.Balance(id); balance != want {
+			t.Errorf("Balance(%s) = %d; want %d", id, balance, want)
+		}
+	}
+}
+
+func TestServerBulkStreams(t *testing.T) {
+	quiet(t)
+
+	srv, _ := newTestServer(map[string]int{"acc1": 1000})
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	// Each result is read before the next operation is sent.
+	requests, send := io.Pipe()
+	defer send.Close()
+	var resp *http.Response
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		resp, err = http.Post(ts.URL+"/operations/bulk", "application/x-ndjson", requests)
+		errc <- err
+	}()
+
+	fmt.Fprintln(send, `{"type": "deposit", "to": "acc1", "amount": 1}`)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	results := bufio.NewScanner(resp.Body)
+	for i := range 3 {
+		if i > 0 {
+			fmt.Fprintln(send, `{"type": "deposit", "to": "acc1", "amount": 1}`)
+		}
+		if !results.Scan() {
+			t.Fatalf("no result for operation %d: %v", i, results.Err())
+		}
+		var result BulkResult
+		if err := json.Unmarshal(results.Bytes(), &result); err != nil || result.Index != i || result.Operation.Version != i+1 {
+			t.Fatalf("result %d = %s; want operation %d applied", i, results.Bytes(), i)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+)
+
+// changeSourceName is the name of the instance in the change events the API
+// serves.
+const changeSourceName = "vaultflow"
+
+// Change event op codes, as Debezium names them.
+const (
+	ChangeCreate = "c"
+	ChangeUpdate = "u"
+	ChangeDelete = "d"
+)
+
+// ChangeEvent is the change of one account's balance by an operation in the
+// envelope of Debezium, so change data capture pipelines and sinks built for
+// it consume vaultflow's outbox as they would a database table's changes.
+// Before is nil for an account an operation created, After for one it
+// archived. It has the schemaless form, without the schema Debezium's
+// JSON converter may send alongside.
+type ChangeEvent struct {
+	Before      *ChangeRow        `json:"before"`
+	After       *ChangeRow        `json:"after"`
+	Source      ChangeSource      `json:"source"`
+	Op          string            `json:"op"`
+	TsMs        int64             `json:"ts_ms"`
+	Transaction ChangeTransaction `json:"transaction"`
+}
+
+// ChangeRow is the image of an account, the row of the accounts table.
+type ChangeRow struct {
+	ID      string `json:"id"`
+	Balance int    `json:"balance"`
+}
+
+// ChangeSource is the source metadata of a change event: Name is the
+// logical name of the vaultflow instance, used by sinks to route its
+// changes, Seq the outbox entry and StateVersion the version the operation
+// led to.
+type ChangeSource struct {
+	Version       string `json:"version"`
+	Connector     string `json:"connector"`
+	Name          string `json:"name"`
+	TsMs          int64  `json:"ts_ms"`
+	Snapshot      string `json:"snapshot"`
+	DB            string `json:"db"`
+	Table         string `json:"table"`
+	Seq           uint64 `json:"seq"`
+	StateVersion  int    `json:"state_version"`
+	OperationID   string `json:"operation_id,omitempty"`
+	OperationType string `json:"operation_type"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+// ChangeTransaction groups the change events of an operation: ID is its
+// operation ID, and the orders number its events from 1.
+type ChangeTransaction struct {
+	ID                  string `json:"id"`
+	TotalOrder          int    `json:"total_order"`
+	DataCollectionOrder int    `json:"data_collection_order"`
+}
+
+// ChangeEvents returns the change events of an outbox entry, one per
+// account whose balance the operation changed, in the order of its
+// accounts, for the instance named name. Rollbacks change every account
+// rolled back, creating or deleting those opened or archived since. Entries
+// without before images, restored from a snapshot, which leaves them out,
+// have updates with a nil Before.
+func ChangeEvents(entry OutboxEntry, name string) []ChangeEvent {
+	event := entry.Event
+	op := event.Operation
+
+	rollback := op.Type == OpRollback || op.Type == OpRollbackTo
+	ids := slices.Compact(op.accounts())
+	if rollback {
+		ids = slices.Collect(maps.Keys(event.Balances))
+		for id := range event.Before {
+			if _, ok := event.Balances[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		slices.Sort(ids)
+	}
+
+	var events []ChangeEvent
+	for _, id := range ids {
+		before, hadBefore := event.Before[id]
+		after, hasAfter := event.Balances[id]
+		change := ChangeEvent{Op: ChangeUpdate}
+		if hadBefore {
+			change.Before = &ChangeRow{ID: id, Balance: before}
+		}
+		if hasAfter {
+			change.After = &ChangeRow{ID: id, Balance: after}
+		}
+		switch {
+		case rollback && hadBefore && hasAfter && before == after:
+			continue
+		case !hasAfter:
+			change.Op = ChangeDelete
+		case !hadBefore && (op.Type == OpOpen || op.Type == OpUnarchive || rollback && event.Before != nil):
+			change.Op = ChangeCreate
+		}
+		events = append(events, change)
+	}
+
+	ts := op.Time.UnixMilli()
+	for i := range events {
+		events[i].TsMs = ts
+		events[i].Source = ChangeSource{
+			Version:       APIVersion,
+			Connector:     "vaultflow",
+			Name:          name,
+			TsMs:          ts,
+			Snapshot:      "false",
+			DB:            name,
+			Table:         "accounts",
+			Seq:           entry.Seq,
+			StateVersion:  event.Version,
+			OperationID:   op.ID,
+			OperationType: string(op.Type),
+			CorrelationID: op.CorrelationID,
+		}
+		events[i].Transaction = ChangeTransaction{ID: op.ID, TotalOrder: i + 1, DataCollectionOrder: i + 1}
+	}
+	return events
+}
+
+// ChangeEventPublisher adapts a function publishing change events, e.g. to
+// the topic a Debezium sink connector reads, to a Publisher of the outbox,
+// see ChangeEvents.
+func ChangeEventPublisher(name string, publish func(ctx context.Context, events []ChangeEvent) error) Publisher {
+	return PublisherFunc(func(ctx context.Context, entries []OutboxEntry) error {
+		var events []ChangeEvent
+		for _, entry := range entries {
+			events = append(events, ChangeEvents(entry, name)...)
+		}
+		return publish(ctx, events)
+	})
+}
+
+// imagesBefore returns the balances the accounts changed by op had before
+// it: from the newest state in history, or, for a rollback, as kept by
+// keepImages. sm.mu must be held.
+func (sm *StateMachine) imagesBefore(op Operation, changed []string) map[string]int {
+	if op.Type == OpRollback || op.Type == OpRollbackTo {
+		before := sm.outbox.rolledBack
+		sm.outbox.rolledBack = nil
+		return before
+	}
+	n := sm.history.len()
+	if n == 0 || sm.history.entries[n-1].version != sm.version-1 {
+		return nil
+	}
+	saved := sm.history.entries[n-1].balances
+	before := map[string]int{}
+	for _, id := range changed {
+		if balance, ok := saved[id]; ok {
+			before[id] = balance
+		}
+	}
+	return before
+}
+
+// keepImages keeps the balances of accounts before a rollback replaces them,
+// as the before images of its outbox entry. sm.mu must be held.
+func (sm *StateMachine) keepImages() {
+	if !sm.outbox.enabled {
+		return
+	}
+	sm.outbox.rolledBack = maps.Clone(sm.accounts)
+	maps.DeleteFunc(sm.outbox.rolledBack, func(id string, _ int) bool { return isBucketKey(id) })
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// describeChanges returns each change event as "op id before after", with -
+// for a missing image.
+func describeChanges(events []ChangeEvent) []string {
+	image := func(row *ChangeRow) string {
+		if row == nil {
+			return "-"
+		}
+		return fmt.Sprint(row.Balance)
+	}
+	var changes []string
+	for _, e := range events {
+		id := ""
+		if e.After != nil {
+			id = e.After.ID
+		} else if e.Before != nil {
+			id = e.Before.ID
+		}
+		changes = append(changes, fmt.Sprintf("%s %s %s %s", e.Op, id, image(e.Before), image(e.After)))
+	}
+	return changes
+}
+
+func TestChangeEvents(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 0}}
+	sm.EnableOutbox()
+
+	tests := []struct {
+		name string
+		op   func() error
+		want []string
+	}{
+		{"Deposit", func() error { return sm.Deposit("acc1", 10) }, []string{"u acc1 100 110"}},
+		{"Transfer", func() error { return sm.Transfer("acc1", "acc2", 30) }, []string{"u acc1 110 80", "u acc2 0 30"}},
+		{"Transfer to itself", func() error { return sm.Transfer("acc1", "acc1", 5) }, []string{"u acc1 80 80"}},
+		{"Open", func() error { return sm.OpenAccount("acc3", 5) }, []string{"c acc3 - 5"}},
+		{"Rollback of the open", sm.Rollback, []string{"d acc3 5 -"}},
+		{"Deposit again", func() error { return sm.Deposit("acc2", 1) }, []string{"u acc2 30 31"}},
+		{"Rollback of the deposit", sm.Rollback, []string{"u acc2 31 30"}},
+		{"Open again", func() error { return sm.OpenAccount("acc3", 5) }, []string{"c acc3 - 5"}},
+		{"Archive", func() error { return sm.ArchiveAccount("acc3") }, []string{"d acc3 5 -"}},
+		{"Transaction", func() error {
+			return sm.Tx(func(tx *Tx) error {
+				_ = tx.Deposit("acc1", 1)
+				return tx.Deposit("acc2", 2)
+			})
+		}, []string{"u acc1 80 81", "u acc2 30 32"}},
+		{"Rollback to before the transaction", func() error { return sm.RollbackTo(sm.Version() - 1) }, []string{"u acc1 81 80", "u acc2 32 30"}},
+	}
+	for _, tt := range tests {
+		seen := sm.outbox.lastSeq
+		if err := tt.op(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		entries, _ := sm.Events(seen, 0)
+		var changes []string
+		for _, entry := range entries {
+			changes = append(changes, describeChanges(ChangeEvents(entry, "ledger"))...)
+		}
+		if !slices.Equal(changes, tt.want) {
+			t.Errorf("%s: ChangeEvents() = %q; want %q", tt.name, changes, tt.want)
+		}
+	}
+
+	// Source metadata and transaction ordering.
+	entries := sm.OutboxEntries()
+	transfer := entries[1]
+	events := ChangeEvents(transfer, "ledger")
+	source := events[1].Source
+	if source.Name != "ledger" || source.Table != "accounts" || source.Seq != transfer.Seq || source.OperationID != transfer.Event.Operation.ID || source.OperationType != string(OpTransfer) || source.TsMs != transfer.Event.Operation.Time.UnixMilli() {
+		t.Errorf("Source = %+v; want the transfer's", source)
+	}
+	if tx := events[1].Transaction; tx.ID != transfer.Event.Operation.ID || tx.TotalOrder != 2 {
+		t.Errorf("Transaction = %+v; want the second event of the transfer", tx)
+	}
+
+	// Before images are not persisted.
+	restored := OutboxEntry{Seq: transfer.Seq, Event: transfer.Event}
+	restored.Event.Before = nil
+	if changes := describeChanges(ChangeEvents(restored, "ledger")); !slices.Equal(changes, []string{"u acc1 - 80", "u acc2 - 30"}) {
+		t.Errorf("ChangeEvents() without before images = %q", changes)
+	}
+
+	var published []ChangeEvent
+	pub := ChangeEventPublisher("ledger", func(ctx context.Context, events []ChangeEvent) error {
+		published = append(published, events...)
+		return nil
+	})
+	if err := pub.Publish(context.Background(), entries[:2]); err != nil || len(published) != 3 {
+		t.Errorf("Publish() = %v, published %d events; want 3", err, len(published))
+	}
+}
+
+func TestServerChangeEvents(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 100})
+	sm.EnableOutbox()
+	_ = sm.Deposit("acc1", 5)
+	handler := srv.Handler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/outbox?format=debezium", nil))
+	var events []ChangeEvent
+	if err := json.NewDecoder(rec.Body).Decode(&events); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /outbox?format=debezium = %d, %v", rec.Code, err)
+	}
+	if changes := describeChanges(events); !slices.Equal(changes, []string{"u acc1 100 105"}) || events[0].Source.Name != changeSourceName {
+		t.Errorf("GET /outbox?format=debezium = %q from %q", changes, events[0].Source.Name)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/outbox?format=avro", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("GET /outbox?format=avro = %d; want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ErrInjected is returned by the calls a FaultInjector fails.
+var ErrInjected = errors.New("injected fault")
+
+// Faults are the failures a FaultInjector injects. Rates are probabilities
+// between 0 and 1.
+type Faults struct {
+	ErrorRate        float64       // calls failing with ErrInjected
+	PartialWriteRate float64       // writes stopping after part of the data
+	MaxLatency       time.Duration // calls are delayed up to this long
+}
+
+// FaultInjector wraps storage readers and writers and operation hooks to
+// fail or slow them down at random, for testing that the state machine stays
+// consistent when the infrastructure around it fails. Failures follow from
+// the seed, so a failing run can be reproduced.
+type FaultInjector struct {
+	mu     sync.Mutex
+	rng    *rand.Rand
+	faults Faults
+	sleep  func(time.Duration)
+}
+
+func NewFaultInjector(seed uint64, faults Faults) *FaultInjector {
+	return &FaultInjector{
+		rng:    rand.New(rand.NewPCG(seed, seed)),
+		faults: faults,
+		sleep:  time.Sleep,
+	}
+}
+
+// SetFaults changes the failures injected from now on, e.g. to heal the
+// infrastructure halfway through a test.
+func (f *FaultInjector) SetFaults(faults Faults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = faults
+}
+
+// roll reports whether an event with the given rate happens.
+func (f *FaultInjector) roll(rate func(Faults) float64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rng.Float64() < rate(f.faults)
+}
+
+// inject delays the call and decides whether it fails.
+func (f *FaultInjector) inject(call string) error {
+	f.mu.Lock()
+	var latency time.Duration
+	if f.faults.MaxLatency > 0 {
+		latency = time.Duration(f.rng.Int64N(int64(f.faults.MaxLatency)))
+	}
+	fail := f.rng.Float64() < f.faults.ErrorRate
+	f.mu.Unlock()
+
+	if latency > 0 {
+		f.sleep(latency)
+	}
+	if fail {
+		return fmt.Errorf("%w: %s", ErrInjected, call)
+	}
+	return nil
+}
+
+// Writer wraps w, failing writes or cutting them short.
+func (f *FaultInjector) Writer(w io.Writer) io.Writer {
+	return &faultyWriter{f: f, w: w}
+}
+
+type faultyWriter struct {
+	f *FaultInjector
+	w io.Writer
+}
+
+func (fw *faultyWriter) Write(p []byte) (int, error) {
+	if err := fw.f.inject("write"); err != nil {
+		return 0, err
+	}
+	if len(p) > 1 && fw.f.roll(func(faults Faults) float64 { return faults.PartialWriteRate }) {
+		n, err := fw.w.Write(p[:len(p)/2])
+		if err == nil {
+			err = fmt.Errorf("%w: partial write", ErrInjected)
+		}
+		return n, err
+	}
+	return fw.w.Write(p)
+}
+
+// Reader wraps r, failing reads.
+func (f *FaultInjector) Reader(r io.Reader) io.Reader {
+	return &faultyReader{f: f, r: r}
+}
+
+type faultyReader struct {
+	f *FaultInjector
+	r io.Reader
+}
+
+func (fr *faultyReader) Read(p []byte) (int, error) {
+	if err := fr.f.inject("read"); err != nil {
+		return 0, err
+	}
+	return fr.r.Read(p)
+}
+
+// Hooks wraps h so every hook call is delayed, and BeforeOperation fails as
+// a webhook call would, vetoing the operation.
+func (f *FaultInjector) Hooks(h Hooks) Hooks {
+	return Hooks{
+		BeforeOperation: func(ctx context.Context, op Operation) error {
+			if err := f.inject("before operation hook"); err != nil {
+				return err
+			}
+			if h.BeforeOperation != nil {
+				return h.BeforeOperation(ctx, op)
+			}
+			return nil
+		},
+		AfterOperation: func(ctx context.Context, op Operation) {
+			_ = f.inject("after operation hook")
+			if h.AfterOperation != nil {
+				h.AfterOperation(ctx, op)
+			}
+		},
+		OnError: func(ctx context.Context, op Operation, err error) {
+			_ = f.inject("error hook")
+			if h.OnError != nil {
+				h.OnError(ctx, op, err)
+			}
+		},
+	}
+}
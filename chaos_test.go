@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"maps"
+	"math/rand/v2"
+	"testing"
+	"time"
+)
+
+func TestFaultInjectorHooks(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000, "acc2": 500, "acc3": 0},
+	}
+	faults := NewFaultInjector(1, Faults{ErrorRate: 0.3, MaxLatency: time.Millisecond})
+	var slept time.Duration
+	faults.sleep = func(d time.Duration) { slept += d }
+
+	applied := 0
+	sm.RegisterHooks(faults.Hooks(Hooks{
+		AfterOperation: func(ctx context.Context, op Operation) { applied++ },
+	}))
+
+	accountIds := []string{"acc1", "acc2", "acc3"}
+	rng := rand.New(rand.NewPCG(1, 1))
+	total, injected := 1500, 0
+	for range 300 {
+		before := maps.Clone(sm.accounts)
+		from, to := accountIds[rng.IntN(3)], accountIds[rng.IntN(3)]
+		amount := rng.IntN(200)
+
+		var err error
+		switch rng.IntN(3) {
+		case 0:
+			if err = sm.Deposit(to, amount); err == nil {
+				total += amount
+			}
+		case 1:
+			if err = sm.Withdraw(from, amount); err == nil {
+				total -= amount
+			}
+		case 2:
+			err = sm.Transfer(from, to, amount)
+		}
+
+		if errors.Is(err, ErrInjected) {
+			injected++
+			if !maps.Equal(sm.accounts, before) {
+				t.Fatalf("Accounts = %v after a failed hook; want %v", sm.accounts, before)
+			}
+		}
+		if got := sum(sm.accounts); got != total {
+			t.Fatalf("Total balance = %d; want %d", got, total)
+		}
+	}
+
+	if injected == 0 || injected == 300 {
+		t.Errorf("Injected %d failures in 300 operations; want some", injected)
+	}
+	if applied != len(sm.Operations()) {
+		t.Errorf("AfterOperation ran %d times; want once per applied operation (%d)", applied, len(sm.Operations()))
+	}
+	if slept == 0 {
+		t.Errorf("No latency injected")
+	}
+}
+
+func TestFaultInjectorSnapshots(t *testing.T) {
+	keys, _ := NewKeyring("k1", bytes.Repeat([]byte{7}, 32))
+
+	for _, enc := range []*Encryptor{nil, NewEncryptor(keys)} {
+		faults := NewFaultInjector(2, Faults{ErrorRate: 0.2, PartialWriteRate: 0.3})
+		restored := &StateMachine{accounts: map[string]int{"old": 1}}
+		expected := maps.Clone(restored.accounts)
+
+		failedWrites, failedReads := 0, 0
+		for i := range 100 {
+			sm := &StateMachine{accounts: map[string]int{"acc1": i, "acc2": 2 * i}}
+
+			var buf bytes.Buffer
+			writeErr := sm.WriteSnapshot(faults.Writer(&buf), enc)
+			if writeErr != nil {
+				failedWrites++
+				if !errors.Is(writeErr, ErrInjected) {
+					t.Fatalf("WriteSnapshot = %v; want %v", writeErr, ErrInjected)
+				}
+			}
+
+			// A snapshot that was not written in full must never be
+			// half applied.
+			readErr := restored.ReadSnapshot(faults.Reader(bytes.NewReader(buf.Bytes())), enc)
+			switch {
+			case readErr != nil:
+				failedReads++
+			case writeErr != nil:
+				t.Fatalf("ReadSnapshot of a failed write succeeded with %v", restored.accounts)
+			default:
+				expected = maps.Clone(sm.accounts)
+			}
+			if !maps.Equal(restored.accounts, expected) {
+				t.Fatalf("Accounts = %v; want %v", restored.accounts, expected)
+			}
+		}
+
+		if failedWrites == 0 || failedReads == 0 {
+			t.Errorf("Failed %d writes and %d reads; want some of each", failedWrites, failedReads)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Olusamimaths/vaultflow/config"
+)
+
+func TestCheckpointRestart(t *testing.T) {
+	quiet(t)
+	dir := t.TempDir()
+	checkpoint := filepath.Join(dir, checkpointName)
+	ctx := WithActor(context.Background(), "alice")
+
+	sm, w := walMachine(t, filepath.Join(dir, "wal"), WALOptions{})
+	sm.RequireApproval(500, time.Hour)
+	escrow, err := sm.CreateEscrow(ctx, "acc1", "acc2", 300, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.SetAlias("savings", "acc2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.SetAccountTags("acc1", "vip"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.TransferContext(ctx, "acc1", "acc2", 600); !errors.Is(err, ErrApprovalRequired) {
+		t.Fatalf("Transfer error = %v; want ErrApprovalRequired", err)
+	}
+	if err := sm.WriteCheckpoint(checkpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Balances changed after the checkpoint come back from the log.
+	if err := sm.Deposit("acc2", 50); err != nil {
+		t.Fatal(err)
+	}
+	want := sm.Balances()
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = OpenWAL(filepath.Join(dir, "wal"), WALOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	restarted := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+	restarted.RequireApproval(500, time.Hour)
+	if restored, err := restarted.RestoreCheckpoint(checkpoint, nil); !restored || err != nil {
+		t.Fatalf("RestoreCheckpoint = %v, %v; want restored", restored, err)
+	}
+	if _, err := restarted.ReplayWAL(w); err != nil {
+		t.Fatal(err)
+	}
+	restarted.UseWAL(w)
+
+	if got := restarted.Balances(); !maps.Equal(got, want) {
+		t.Errorf("Balances = %v; want %v", got, want)
+	}
+	if got := restarted.ResolveAccount("savings"); got != "acc2" {
+		t.Errorf("savings resolves to %q; want acc2", got)
+	}
+	if got := restarted.AccountTags("acc1"); !slices.Equal(got, []string{"vip"}) {
+		t.Errorf("AccountTags = %v; want [vip]", got)
+	}
+	if approvals := restarted.Approvals(); len(approvals) != 1 || approvals[0].Status != ApprovalPending {
+		t.Errorf("Approvals = %+v; want the pending transfer", approvals)
+	}
+	if _, err := restarted.ReleaseEscrow(ctx, escrow.ID); err != nil {
+		t.Fatalf("ReleaseEscrow: %v", err)
+	}
+	if got, _ := restarted.Balance("acc2"); got != want["acc2"]+300 {
+		t.Errorf("acc2 = %d after the release; want %d", got, want["acc2"]+300)
+	}
+}
+
+func TestRestoreCheckpointMissing(t *testing.T) {
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000}}
+	restored, err := sm.RestoreCheckpoint(filepath.Join(t.TempDir(), checkpointName), nil)
+	if restored || err != nil {
+		t.Fatalf("RestoreCheckpoint = %v, %v; want nothing restored", restored, err)
+	}
+}
+
+func TestCheckpointEncrypted(t *testing.T) {
+	quiet(t)
+	checkpoint := filepath.Join(t.TempDir(), checkpointName)
+	cfg := config.Default()
+	cfg.Storage.Key = "k1"
+	cfg.Keys = map[string]string{"k1": "MDEyMzQ1Njc4OWFiY2RlZg=="}
+	enc, err := newEncryptor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000}}
+	_ = sm.Deposit("acc1", 1)
+	if err := sm.WriteCheckpoint(checkpoint, enc); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(checkpoint); !IsSealed(data) {
+		t.Fatalf("checkpoint is not sealed: %.40q", data)
+	}
+	if _, err := (&StateMachine{}).RestoreCheckpoint(checkpoint, nil); err == nil {
+		t.Errorf("RestoreCheckpoint() without an encryptor succeeded; want an error")
+	}
+
+	// After a rotation, the checkpoint sealed under the previous key opens.
+	cfg.Storage.Key = "k2"
+	cfg.Keys["k2"] = "ZmVkY2JhOTg3NjU0MzIxMA=="
+	if enc, err = newEncryptor(cfg); err != nil {
+		t.Fatal(err)
+	}
+	restored := &StateMachine{}
+	if ok, err := restored.RestoreCheckpoint(checkpoint, enc); !ok || err != nil {
+		t.Fatalf("RestoreCheckpoint() after a rotation = %v, %v; want restored", ok, err)
+	}
+	if balance, _ := restored.Balance("acc1"); balance != 1001 {
+		t.Errorf("acc1 = %d; want 1001", balance)
+	}
+	if err := restored.WriteCheckpoint(checkpoint, enc); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(checkpoint); !IsSealed(data) {
+		t.Fatal("checkpoint is not sealed")
+	} else if id, _ := SealedKeyID(data); id != "k2" {
+		t.Errorf("checkpoint sealed with %s; want k2", id)
+	}
+}
@@ -0,0 +1,559 @@
+// Package client is a Go client of the vaultflow HTTP API, so services need
+// not hand-roll its requests.
+//
+// Requests shed by the server or failing to reach it are retried with
+// exponential backoff, honoring Retry-After. Requests applying an operation
+// carry an idempotency key, generated unless one is given, which stays the
+// same across retries: a retried deposit whose first attempt was applied is
+// answered as the first attempt, not applied twice.
+//
+// Errors answered by the server unwrap to the sentinel errors below, which
+// mirror vaultflow's, so callers can check them with errors.Is.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The errors of vaultflow, as answered by its API.
+var (
+	ErrInvalidAccount      = errors.New("invalid account")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrNothingToRollback   = errors.New("nothing to rollback")
+	ErrAccountExists       = errors.New("account already exists")
+	ErrAccountArchived     = errors.New("account is archived")
+	ErrInvalidOperation    = errors.New("invalid operation")
+	ErrOperationNotFound   = errors.New("operation not found")
+	ErrDuplicateMessage    = errors.New("duplicate message")
+	ErrApprovalRequired    = errors.New("transfer requires approval")
+	ErrSignaturesRequired  = errors.New("debit requires signatures")
+	ErrStatusForbids       = errors.New("operation not allowed in account status")
+	ErrRateLimited         = errors.New("rate limited")
+	ErrOverloaded          = errors.New("server overloaded")
+	ErrUnauthenticated     = errors.New("unauthenticated")
+	ErrForbidden           = errors.New("forbidden")
+	ErrReadOnly            = errors.New("read-only replica")
+	ErrReplicaStale        = errors.New("replica is stale")
+	ErrClosed              = errors.New("state machine is closed")
+	ErrVersionConflict     = errors.New("state changed since the version expected")
+	ErrStaleEpoch          = errors.New("stale epoch")
+	ErrQuotaExceeded       = errors.New("quota exceeded")
+	ErrMemoryLimit         = errors.New("memory limit reached")
+	ErrDeadlock            = errors.New("deadlock")
+	ErrEventsPruned        = errors.New("events no longer in the outbox")
+)
+
+// sentinels are the errors an APIError may unwrap to, recognized by the
+// start of its message.
+var sentinels = []error{
+	ErrInvalidAccount, ErrInsufficientBalance, ErrNothingToRollback, ErrAccountExists, ErrAccountArchived,
+	ErrInvalidOperation, ErrOperationNotFound, ErrDuplicateMessage, ErrApprovalRequired, ErrSignaturesRequired,
+	ErrStatusForbids, ErrRateLimited, ErrOverloaded, ErrUnauthenticated, ErrForbidden, ErrReadOnly,
+	ErrReplicaStale, ErrClosed, ErrVersionConflict, ErrStaleEpoch,
+	ErrQuotaExceeded, ErrMemoryLimit, ErrDeadlock, ErrEventsPruned,
+}
+
+// APIError is an error answered by the server.
+type APIError struct {
+	StatusCode    int
+	Message       string
+	CorrelationID string        // of the request, to find it in the server's logs
+	RetryAfter    time.Duration // when the server asked to wait before retrying
+
+	err error // the sentinel the message starts with, if any
+}
+
+// newAPIError returns the error answered with status, header and message.
+func newAPIError(status int, header http.Header, message string) *APIError {
+	e := &APIError{StatusCode: status, Message: message, CorrelationID: header.Get("X-Correlation-ID")}
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	for _, sentinel := range sentinels {
+		if strings.HasPrefix(e.Message, sentinel.Error()) {
+			e.err = sentinel
+			break
+		}
+	}
+	return e
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("vaultflow: %s (%d)", e.Message, e.StatusCode)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.err
+}
+
+// Retryable reports whether the request was turned away before being
+// applied and may be sent again.
+func (e *APIError) Retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+// ApprovalRequiredError is returned for a transfer parked for approval
+// instead of applied; ID is the approval to follow it by.
+type ApprovalRequiredError struct {
+	ID string
+}
+
+func (e *ApprovalRequiredError) Error() string {
+	return fmt.Sprintf("%s: pending as %s", ErrApprovalRequired, e.ID)
+}
+
+func (e *ApprovalRequiredError) Is(target error) bool {
+	return target == ErrApprovalRequired
+}
+
+// SignaturesRequiredError is returned for a debit parked for signatures
+// instead of applied; ID is the debit to follow it by.
+type SignaturesRequiredError struct {
+	ID string
+}
+
+func (e *SignaturesRequiredError) Error() string {
+	return fmt.Sprintf("%s: pending as %s", ErrSignaturesRequired, e.ID)
+}
+
+func (e *SignaturesRequiredError) Is(target error) bool {
+	return target == ErrSignaturesRequired
+}
+
+// Operation is an operation of the API, as vaultflow encodes it.
+type Operation struct {
+	ID            string            `json:"id,omitempty"`
+	Type          string            `json:"type"`
+	From          string            `json:"from,omitempty"`
+	To            string            `json:"to,omitempty"`
+	Amount        int               `json:"amount,omitempty"`
+	Version       int               `json:"version,omitempty"`
+	Time          time.Time         `json:"time"`
+	Reverses      string            `json:"reverses,omitempty"`
+	MessageID     string            `json:"message_id,omitempty"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+	FromBucket    string            `json:"from_bucket,omitempty"`
+	ToBucket      string            `json:"to_bucket,omitempty"`
+	Status        string            `json:"status,omitempty"`
+	Memo          string            `json:"memo,omitempty"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	Category      string            `json:"category,omitempty"`
+}
+
+// AmountRequest is a deposit to or a withdrawal from an account.
+type AmountRequest struct {
+	Amount   int               `json:"amount"`
+	Bucket   string            `json:"bucket,omitempty"`
+	Memo     string            `json:"memo,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Category string            `json:"category,omitempty"`
+
+	// IdempotencyKey identifies the request across retries, including
+	// those of the caller; one is generated if empty.
+	IdempotencyKey string `json:"-"`
+}
+
+// TransferRequest is a transfer between two accounts.
+type TransferRequest struct {
+	From       string            `json:"from"`
+	To         string            `json:"to"`
+	Amount     int               `json:"amount"`
+	FromBucket string            `json:"from_bucket,omitempty"`
+	ToBucket   string            `json:"to_bucket,omitempty"`
+	Memo       string            `json:"memo,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+	Category   string            `json:"category,omitempty"`
+
+	// IdempotencyKey identifies the request across retries, including
+	// those of the caller; one is generated if empty.
+	IdempotencyKey string `json:"-"`
+}
+
+// Receipt is the outcome of an applied operation.
+type Receipt struct {
+	OperationID    string
+	Balance        int    // of the account, after a deposit or a withdrawal
+	IdempotencyKey string // the request was sent with
+	Replayed       bool   // the operation was applied by an earlier request with the key
+}
+
+// OperationFilter selects operations, see Client.Operations. Zero fields
+// select any.
+type OperationFilter struct {
+	Account string
+	Type    string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// BulkResult is the outcome of an operation sent with Client.Bulk.
+type BulkResult struct {
+	Index      int        `json:"index"`
+	Status     int        `json:"status"`
+	Operation  *Operation `json:"operation,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	ApprovalID string     `json:"approval_id,omitempty"`
+	DebitID    string     `json:"debit_id,omitempty"`
+}
+
+// Err returns the error of the operation, nil if it was applied.
+func (r BulkResult) Err() error {
+	switch {
+	case r.ApprovalID != "":
+		return &ApprovalRequiredError{ID: r.ApprovalID}
+	case r.DebitID != "":
+		return &SignaturesRequiredError{ID: r.DebitID}
+	case r.Error != "":
+		return newAPIError(r.Status, http.Header{}, r.Error)
+	}
+	return nil
+}
+
+// Client calls the vaultflow API. Its fields must not be changed once it
+// is in use; it is safe for concurrent use.
+type Client struct {
+	BaseURL    string // of the server, e.g. https://vaultflow.internal:8080
+	Tenant     string // addresses the namespace of the tenant if set
+	APIKey     string // sent as X-API-Key if set
+	Token      string // sent as a bearer token if set
+	HTTPClient *http.Client
+
+	MaxRetries int // after the first attempt
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// New returns a client of the server at baseURL retrying 3 times, backing
+// off from 100ms up to 5s.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+		MaxRetries: 3,
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: 5 * time.Second,
+	}
+}
+
+// Balance returns the balance of an account.
+func (c *Client) Balance(ctx context.Context, accountId string) (int, error) {
+	var resp struct {
+		Balance int `json:"balance"`
+	}
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/accounts/" + url.PathEscape(accountId)}, &resp)
+	return resp.Balance, err
+}
+
+// Deposit deposits to an account.
+func (c *Client) Deposit(ctx context.Context, accountId string, req AmountRequest) (Receipt, error) {
+	return c.amount(ctx, "/accounts/"+url.PathEscape(accountId)+"/deposit", req)
+}
+
+// Withdraw withdraws from an account.
+func (c *Client) Withdraw(ctx context.Context, accountId string, req AmountRequest) (Receipt, error) {
+	return c.amount(ctx, "/accounts/"+url.PathEscape(accountId)+"/withdraw", req)
+}
+
+func (c *Client) amount(ctx context.Context, path string, req AmountRequest) (Receipt, error) {
+	receipt := Receipt{IdempotencyKey: req.IdempotencyKey}
+	if receipt.IdempotencyKey == "" {
+		receipt.IdempotencyKey = newIdempotencyKey()
+	}
+	var resp struct {
+		Balance     int    `json:"balance"`
+		OperationID string `json:"operation_id"`
+	}
+	header, err := c.do(ctx, request{method: http.MethodPost, path: path, body: req, key: receipt.IdempotencyKey}, &resp)
+	receipt.OperationID, receipt.Balance, receipt.Replayed = resp.OperationID, resp.Balance, replayed(header)
+	return receipt, err
+}
+
+// Transfer transfers between two accounts.
+func (c *Client) Transfer(ctx context.Context, req TransferRequest) (Receipt, error) {
+	receipt := Receipt{IdempotencyKey: req.IdempotencyKey}
+	if receipt.IdempotencyKey == "" {
+		receipt.IdempotencyKey = newIdempotencyKey()
+	}
+	var resp struct {
+		OperationID string `json:"operation_id"`
+	}
+	header, err := c.do(ctx, request{method: http.MethodPost, path: "/transfers", body: req, key: receipt.IdempotencyKey}, &resp)
+	receipt.OperationID, receipt.Replayed = resp.OperationID, replayed(header)
+	return receipt, err
+}
+
+// Rollback rolls back the latest state change. It is not retried once
+// sent, as a second rollback would roll back another change.
+func (c *Client) Rollback(ctx context.Context) error {
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/rollback"}, nil)
+	return err
+}
+
+// RollbackIfVersion rolls back the change that produced version only if it
+// is still the latest change, failing with ErrVersionConflict otherwise. It
+// is retried, as it never rolls back twice: a retry of a rollback that was
+// applied fails with ErrVersionConflict instead.
+func (c *Client) RollbackIfVersion(ctx context.Context, version int) error {
+	query := url.Values{"if_version": {strconv.Itoa(version)}}
+	_, err := c.do(ctx, request{method: http.MethodPost, path: "/rollback", query: query, idempotent: true}, nil)
+	return err
+}
+
+// Operations returns the operations in history selected by filter.
+func (c *Client) Operations(ctx context.Context, filter OperationFilter) ([]Operation, error) {
+	query := url.Values{}
+	if filter.Account != "" {
+		query.Set("account", filter.Account)
+	}
+	if filter.Type != "" {
+		query.Set("type", filter.Type)
+	}
+	if !filter.Since.IsZero() {
+		query.Set("since", filter.Since.Format(time.RFC3339Nano))
+	}
+	if !filter.Until.IsZero() {
+		query.Set("until", filter.Until.Format(time.RFC3339Nano))
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+	var ops []Operation
+	_, err := c.do(ctx, request{method: http.MethodGet, path: "/operations", query: query}, &ops)
+	return ops, err
+}
+
+// Bulk applies operations in one streamed request, returning the result of
+// each in order. Operations without a MessageID are given one, so a retried
+// stream does not apply them twice: those applied by an earlier attempt
+// fail with ErrDuplicateMessage.
+func (c *Client) Bulk(ctx context.Context, ops []Operation) ([]BulkResult, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, op := range ops {
+		if op.MessageID == "" {
+			op.MessageID = newIdempotencyKey()
+		}
+		if err := encoder.Encode(op); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := c.send(ctx, request{method: http.MethodPost, path: "/operations/bulk", body: body.Bytes(), contentType: "application/x-ndjson", idempotent: true})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	results := make([]BulkResult, 0, len(ops))
+	lines := bufio.NewScanner(resp.Body)
+	for lines.Scan() {
+		var result BulkResult
+		if err := json.Unmarshal(lines.Bytes(), &result); err != nil {
+			return results, fmt.Errorf("vaultflow: bulk result %d: %w", len(results), err)
+		}
+		results = append(results, result)
+	}
+	if err := lines.Err(); err != nil {
+		return results, err
+	}
+	if len(results) != len(ops) {
+		return results, fmt.Errorf("vaultflow: %d bulk results for %d operations", len(results), len(ops))
+	}
+	return results, nil
+}
+
+// request is a request to the API.
+type request struct {
+	method      string
+	path        string // within the namespace, e.g. /transfers
+	query       url.Values
+	body        any // encoded as JSON unless already []byte
+	contentType string
+	key         string // idempotency key
+	idempotent  bool   // safe to send again even if it may have been applied
+}
+
+func (r request) retryable() bool {
+	return r.method == http.MethodGet || r.key != "" || r.idempotent
+}
+
+// do sends req and decodes the JSON answer into out, if not nil.
+func (c *Client) do(ctx context.Context, req request, out any) (http.Header, error) {
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.Header, err
+	}
+	if resp.StatusCode == http.StatusAccepted {
+		var pending struct {
+			ApprovalID string `json:"approval_id"`
+			DebitID    string `json:"debit_id"`
+		}
+		if err := json.Unmarshal(body, &pending); err != nil {
+			return resp.Header, err
+		}
+		if pending.ApprovalID != "" {
+			return resp.Header, &ApprovalRequiredError{ID: pending.ApprovalID}
+		}
+		return resp.Header, &SignaturesRequiredError{ID: pending.DebitID}
+	}
+	if out != nil {
+		if err := json.Unmarshal(body, out); err != nil {
+			return resp.Header, fmt.Errorf("vaultflow: decoding %s %s: %w", req.method, req.path, err)
+		}
+	}
+	return resp.Header, nil
+}
+
+// send sends req, retrying it while the server turns it away or, if it is
+// safe to, cannot be reached. It returns the successful response, whose
+// body must be closed, or the error of the last attempt.
+func (c *Client) send(ctx context.Context, req request) (*http.Response, error) {
+	var body []byte
+	switch v := req.body.(type) {
+	case nil:
+	case []byte:
+		body = v
+	default:
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		resp, err := c.attempt(ctx, req, body)
+		if err == nil {
+			return resp, nil
+		}
+
+		var apiErr *APIError
+		retryable := req.retryable()
+		if errors.As(err, &apiErr) {
+			retryable = apiErr.Retryable()
+		}
+		if !retryable || attempt >= c.MaxRetries || ctx.Err() != nil {
+			return nil, err
+		}
+
+		wait := c.backoff(attempt)
+		if apiErr != nil && apiErr.RetryAfter > wait {
+			wait = apiErr.RetryAfter
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt sends req once, returning an *APIError if it is not answered
+// with a success.
+func (c *Client) attempt(ctx context.Context, req request, body []byte) (*http.Response, error) {
+	u := c.BaseURL + "/v1"
+	if c.Tenant != "" {
+		u += "/tenants/" + url.PathEscape(c.Tenant)
+	}
+	u += req.path
+	if len(req.query) > 0 {
+		u += "?" + req.query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		contentType := req.contentType
+		if contentType == "" {
+			contentType = "application/json"
+		}
+		httpReq.Header.Set("Content-Type", contentType)
+	}
+	if req.key != "" {
+		httpReq.Header.Set("Idempotency-Key", req.key)
+	}
+	if c.APIKey != "" {
+		httpReq.Header.Set("X-API-Key", c.APIKey)
+	}
+	if c.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var answer struct {
+		Error string `json:"error"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&answer)
+	return nil, newAPIError(resp.StatusCode, resp.Header, answer.Error)
+}
+
+// backoff returns how long to wait before retrying after the attempt-th
+// retry: exponentially longer, up to MaxBackoff, with jitter so clients
+// turned away together do not come back together.
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.MinBackoff
+	for range attempt {
+		if wait >= c.MaxBackoff/2 {
+			wait = c.MaxBackoff
+			break
+		}
+		wait *= 2
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return wait/2 + mathrand.N(wait/2+1)
+}
+
+func replayed(header http.Header) bool {
+	return header.Get("Idempotent-Replayed") == "true"
+}
+
+// newIdempotencyKey returns a random idempotency key.
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
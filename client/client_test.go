@@ -0,0 +1,239 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client of handler, backing off for a millisecond.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	c := New(ts.URL)
+	c.MinBackoff, c.MaxBackoff = time.Millisecond, time.Millisecond
+	return c
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        any
+		expectedErr error
+	}{
+		{"Insufficient balance", http.StatusConflict, map[string]string{"error": "insufficient balance: acc1 has 5"}, ErrInsufficientBalance},
+		{"Unknown account", http.StatusNotFound, map[string]string{"error": "invalid account: acc9"}, ErrInvalidAccount},
+		{"Forbidden", http.StatusForbidden, map[string]string{"error": "forbidden: ci may not withdraw account acc1"}, ErrForbidden},
+		{"Approval", http.StatusAccepted, map[string]string{"status": "pending", "approval_id": "a1"}, ErrApprovalRequired},
+		{"Signatures", http.StatusAccepted, map[string]string{"status": "pending", "debit_id": "d1"}, ErrSignaturesRequired},
+		{"Unrecognized", http.StatusTeapot, "not json", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Correlation-ID", "c1")
+				writeJSON(w, tt.status, tt.body)
+			})
+			_, err := c.Withdraw(context.Background(), "acc1", AmountRequest{Amount: 10})
+			if err == nil {
+				t.Fatalf("Withdraw() succeeded; want an error")
+			}
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Errorf("Withdraw() error = %v; want %v", err, tt.expectedErr)
+			}
+
+			var apiErr *APIError
+			if tt.status != http.StatusAccepted {
+				if !errors.As(err, &apiErr) || apiErr.StatusCode != tt.status || apiErr.CorrelationID != "c1" {
+					t.Errorf("Withdraw() error = %#v; want an APIError of status %d and its correlation ID", err, tt.status)
+				}
+			}
+		})
+	}
+
+	var approvalErr *ApprovalRequiredError
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusAccepted, map[string]string{"approval_id": "a1"})
+	})
+	if _, err := c.Transfer(context.Background(), TransferRequest{From: "acc1", To: "acc2", Amount: 1}); !errors.As(err, &approvalErr) || approvalErr.ID != "a1" {
+		t.Errorf("Transfer() error = %v; want the approval a1", err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	var mu sync.Mutex
+	var keys []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		switch len(keys) {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "rate limited: client limit exceeded"})
+		case 2:
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "replica is stale"})
+		default:
+			w.Header().Set("Idempotent-Replayed", "true")
+			writeJSON(w, http.StatusOK, map[string]any{"id": "acc1", "balance": 110, "operation_id": "op1"})
+		}
+	})
+
+	receipt, err := c.Deposit(context.Background(), "acc1", AmountRequest{Amount: 10})
+	if err != nil {
+		t.Fatalf("Deposit() error = %v", err)
+	}
+	if receipt.OperationID != "op1" || receipt.Balance != 110 || !receipt.Replayed {
+		t.Errorf("Deposit() = %+v; want op1 replayed, leaving 110", receipt)
+	}
+	if len(keys) != 3 || keys[0] == "" || keys[1] != keys[0] || keys[2] != keys[0] || receipt.IdempotencyKey != keys[0] {
+		t.Errorf("Idempotency-Key of the attempts = %q; want 3 attempts with the key %q", keys, receipt.IdempotencyKey)
+	}
+
+	// Retries are bounded.
+	attempts := 0
+	c = newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "server overloaded"})
+	})
+	c.MaxRetries = 2
+	if _, err := c.Balance(context.Background(), "acc1"); !errors.Is(err, ErrOverloaded) || attempts != 3 {
+		t.Errorf("Balance() error = %v after %d attempts; want ErrOverloaded after 3", err, attempts)
+	}
+}
+
+// failingTransport fails the first requests, as an unreachable server would.
+type failingTransport struct {
+	failures int
+	attempts int
+}
+
+func (f *failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	f.attempts++
+	if f.attempts <= f.failures {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestClientRetriesUnreachable(t *testing.T) {
+	tests := []struct {
+		name             string
+		call             func(c *Client) error
+		expectedAttempts int
+	}{
+		{"Read", func(c *Client) error {
+			_, err := c.Balance(context.Background(), "acc1")
+			return err
+		}, 2},
+		{"Operation with an idempotency key", func(c *Client) error {
+			_, err := c.Transfer(context.Background(), TransferRequest{From: "acc1", To: "acc2", Amount: 1})
+			return err
+		}, 2},
+		{"Rollback", func(c *Client) error {
+			return c.Rollback(context.Background())
+		}, 1},
+		{"Rollback if version", func(c *Client) error {
+			return c.RollbackIfVersion(context.Background(), 3)
+		}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, http.StatusOK, map[string]any{})
+			})
+			transport := &failingTransport{failures: 1}
+			c.HTTPClient = &http.Client{Transport: transport}
+
+			err := tt.call(c)
+			if transport.attempts != tt.expectedAttempts {
+				t.Errorf("%d attempts; want %d", transport.attempts, tt.expectedAttempts)
+			}
+			if (err == nil) != (tt.expectedAttempts > 1) {
+				t.Errorf("error = %v; want the request to succeed only if retried", err)
+			}
+		})
+	}
+}
+
+func TestClientRequests(t *testing.T) {
+	var got *http.Request
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		writeJSON(w, http.StatusOK, []Operation{{ID: "op1", Type: "deposit", To: "acc1", Amount: 5}})
+	})
+	c.Tenant, c.APIKey, c.Token = "acme", "key", "token"
+
+	ops, err := c.Operations(context.Background(), OperationFilter{Account: "acc1", Limit: 10})
+	if err != nil {
+		t.Fatalf("Operations() error = %v", err)
+	}
+	if len(ops) != 1 || ops[0].ID != "op1" {
+		t.Errorf("Operations() = %+v; want op1", ops)
+	}
+	if got.URL.Path != "/v1/tenants/acme/operations" || got.URL.RawQuery != "account=acc1&limit=10" {
+		t.Errorf("request to %s; want /v1/tenants/acme/operations?account=acc1&limit=10", got.URL)
+	}
+	if got.Header.Get("X-API-Key") != "key" || got.Header.Get("Authorization") != "Bearer token" {
+		t.Errorf("request headers = %v; want the API key and token", got.Header)
+	}
+}
+
+func TestClientBulk(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		lines := bufio.NewScanner(r.Body)
+		for i := 0; lines.Scan(); i++ {
+			var op Operation
+			_ = json.Unmarshal(lines.Bytes(), &op)
+			if op.MessageID == "" {
+				_ = encoder.Encode(BulkResult{Index: i, Status: http.StatusBadRequest, Error: "invalid operation: no message ID"})
+				continue
+			}
+			if op.Amount > 100 {
+				_ = encoder.Encode(BulkResult{Index: i, Status: http.StatusConflict, Error: "insufficient balance: " + op.From})
+				continue
+			}
+			op.ID = fmt.Sprint("op", i)
+			_ = encoder.Encode(BulkResult{Index: i, Status: http.StatusOK, Operation: &op})
+		}
+	})
+
+	results, err := c.Bulk(context.Background(), []Operation{
+		{Type: "withdraw", From: "acc1", Amount: 10},
+		{Type: "withdraw", From: "acc1", Amount: 1000},
+		{Type: "deposit", To: "acc1", Amount: 1, MessageID: "m1"},
+	})
+	if err != nil {
+		t.Fatalf("Bulk() error = %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Bulk() = %+v; want 3 results", results)
+	}
+	if results[0].Err() != nil || results[0].Operation.ID != "op0" || results[0].Operation.MessageID == "" {
+		t.Errorf("result 0 = %+v; want applied with a generated message ID", results[0])
+	}
+	if err := results[1].Err(); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("result 1 error = %v; want ErrInsufficientBalance", err)
+	}
+	if results[2].Operation == nil || results[2].Operation.MessageID != "m1" {
+		t.Errorf("result 2 = %+v; want its message ID kept", results[2])
+	}
+}
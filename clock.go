@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time. Operation timestamps, history, approvals and
+// rate limits read the time through a Clock, so tests can control it with a
+// FakeClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// WallClock is the Clock telling the system time, used when none is set.
+var WallClock Clock = wallClock{}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock is a Clock that only moves when told to.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// UseClock makes sm and its rate limiter read the time from clock, as do the
+// tenants created after it. It must be called before operations start.
+func (sm *StateMachine) UseClock(clock Clock) {
+	sm.clock = clock
+	if sm.limiter != nil {
+		sm.limiter.UseClock(clock)
+	}
+}
+
+func (sm *StateMachine) now() time.Time {
+	if sm.clock == nil {
+		return time.Now()
+	}
+	return sm.clock.Now()
+}
+
+// UseClock makes the limiter refill its buckets by clock. It must be called
+// before the limiter is used.
+func (rl *RateLimiter) UseClock(clock Clock) {
+	rl.now = clock.Now
+}
+
+// UseClock makes the engine age activity by clock. It must be called before
+// the engine's hooks are registered.
+func (e *RuleEngine) UseClock(clock Clock) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.activity.now = clock.Now
+}
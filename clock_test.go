@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	if now := clock.Now(); !now.Equal(start) {
+		t.Errorf("Now = %v; want %v", now, start)
+	}
+	clock.Advance(90 * time.Minute)
+	if now := clock.Now(); !now.Equal(start.Add(90 * time.Minute)) {
+		t.Errorf("Now after Advance = %v; want %v", now, start.Add(90*time.Minute))
+	}
+	clock.Set(start)
+	if now := clock.Now(); !now.Equal(start) {
+		t.Errorf("Now after Set = %v; want %v", now, start)
+	}
+}
+
+func TestStateMachineUseClock(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 10000, "acc2": 0},
+		limiter:  NewRateLimiter(RateLimit{Rate: 1, Burst: 1}, RateLimit{}, RateLimit{}),
+	}
+	sm.UseClock(clock)
+	sm.RequireApproval(1000, time.Hour)
+
+	if err := sm.Deposit("acc1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if op := sm.Operations()[0]; !op.Time.Equal(start) {
+		t.Errorf("Operation time = %v; want %v", op.Time, start)
+	}
+
+	// The rate limiter only refills as the clock moves.
+	if err := sm.Deposit("acc1", 1); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Deposit without refill = %v; want %v", err, ErrRateLimited)
+	}
+	clock.Advance(time.Second)
+
+	var approvalErr *ApprovalRequiredError
+	if err := sm.Transfer("acc1", "acc2", 5000); !errors.As(err, &approvalErr) {
+		t.Fatalf("Large transfer = %v; want *ApprovalRequiredError", err)
+	}
+	p, err := sm.Approval(approvalErr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.ExpiresAt.Equal(start.Add(time.Second + time.Hour)) {
+		t.Errorf("ExpiresAt = %v; want an hour after the clock", p.ExpiresAt)
+	}
+
+	clock.Advance(time.Hour)
+	if p, err := sm.Approval(approvalErr.ID); err != nil || p.Status != ApprovalExpired {
+		t.Errorf("Approval after an hour = %+v, %v; want expired", p, err)
+	}
+}
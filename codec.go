@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// Codec serializes snapshots and published events, so they can match the
+// format of an existing data pipeline. See UseCodec and
+// WebhookPublisher.Codec.
+type Codec interface {
+	ContentType() string
+	Encode(v any) ([]byte, error)
+	Decode(data []byte, v any) error
+}
+
+var (
+	// JSONCodec encodes as encoding/json does, the default.
+	JSONCodec Codec = jsonCodec{}
+	// MsgpackCodec encodes as MessagePack. Field names and values are those
+	// of the JSON encoding, e.g. times are RFC 3339 strings, so a record
+	// decodes the same from either.
+	MsgpackCodec Codec = msgpackCodec{}
+	// ProtobufCodec encodes as protocol buffers: the JSON value as the
+	// well-known google.protobuf.Value message, so pipelines decode records
+	// with the Value type of any protobuf library, without a schema of
+	// vaultflow's own. Numbers are doubles, exact up to 2^53.
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+var (
+	// ErrInvalidMsgpack is returned for data MsgpackCodec cannot decode.
+	ErrInvalidMsgpack = errors.New("invalid msgpack")
+	// ErrInvalidProtobuf is returned for data ProtobufCodec cannot decode.
+	ErrInvalidProtobuf = errors.New("invalid protobuf")
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string             { return "application/json" }
+func (jsonCodec) Encode(v any) ([]byte, error)    { return json.Marshal(v) }
+func (jsonCodec) Decode(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+// UseCodec makes WriteSnapshot encode with c rather than JSON. ReadSnapshot
+// reads snapshots encoded with c and, so existing files still load, JSON
+// ones. It must be called before snapshots are written.
+func (sm *StateMachine) UseCodec(c Codec) {
+	sm.codec = c
+}
+
+// snapshotCodec returns the codec snapshots are written with.
+func (sm *StateMachine) snapshotCodec() Codec {
+	if sm.codec == nil {
+		return JSONCodec
+	}
+	return sm.codec
+}
+
+// isJSONObject reports whether data looks like a JSON object rather than
+// another codec's encoding.
+func isJSONObject(data []byte) bool {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	return len(data) > 0 && data[0] == '{'
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+// Encode encodes the JSON value of v, map keys sorted so equal values encode
+// the same.
+func (msgpackCodec) Encode(v any) ([]byte, error) {
+	value, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return appendMsgpack(nil, value), nil
+}
+
+// Decode decodes data into the value it was encoded from.
+func (msgpackCodec) Decode(data []byte, v any) error {
+	d := msgpackDecoder{data: data}
+	value, err := d.value(0)
+	if err != nil {
+		return err
+	}
+	if d.pos != len(data) {
+		return fmt.Errorf("%w: %d bytes after the value", ErrInvalidMsgpack, len(data)-d.pos)
+	}
+	data, err = json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// jsonValue returns the JSON value of v, numbers decoded with UseNumber.
+func jsonValue(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// appendMsgpack appends the encoding of a value decoded from JSON with
+// UseNumber.
+func appendMsgpack(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, n)
+		}
+		f, _ := v.Float64()
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+	case string:
+		switch n := len(v); {
+		case n < 32:
+			b = append(b, 0xa0|byte(n))
+		case n <= math.MaxUint8:
+			b = append(b, 0xd9, byte(n))
+		case n <= math.MaxUint16:
+			b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+		default:
+			b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+		}
+		return append(b, v...)
+	case []any:
+		b = appendMsgpackLength(b, len(v), 0x90, 0xdc)
+		for _, item := range v {
+			b = appendMsgpack(b, item)
+		}
+		return b
+	case map[string]any:
+		b = appendMsgpackLength(b, len(v), 0x80, 0xde)
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			b = appendMsgpack(b, key)
+			b = appendMsgpack(b, v[key])
+		}
+		return b
+	}
+	panic(fmt.Sprintf("msgpack: unexpected %T", v))
+}
+
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= 0x7f:
+		return append(b, byte(n))
+	case n >= -32 && n < 0:
+		return append(b, byte(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+}
+
+// appendMsgpackLength appends the header of an array or a map of n items:
+// fix, the 4-bit form, up to 15 items, else the 16 or 32-bit form from
+// long.
+func appendMsgpackLength(b []byte, n int, fix, long byte) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, long), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, long+1), uint32(n))
+}
+
+// maxMsgpackDepth bounds the nesting of decoded values.
+const maxMsgpackDepth = 100
+
+// msgpackDecoder decodes MessagePack into the values encoding/json decodes
+// into any: maps with string keys, slices, strings, numbers, bools and nil.
+// Binary data decodes as a string of its bytes and extensions are refused.
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.pos {
+		return nil, fmt.Errorf("%w: truncated at byte %d", ErrInvalidMsgpack, d.pos)
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (d *msgpackDecoder) value(depth int) (any, error) {
+	if depth > maxMsgpackDepth {
+		return nil, fmt.Errorf("%w: nested deeper than %d", ErrInvalidMsgpack, maxMsgpackDepth)
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return json.Number(strconv.Itoa(int(c))), nil
+	case c >= 0xe0:
+		return json.Number(strconv.Itoa(int(int8(c)))), nil
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.arrayOf(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c := b[0]; c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb: // bin and str 8, 16, 32
+		size := 1 << (c - 0xc4)
+		if c >= 0xd9 {
+			size = 1 << (c - 0xd9)
+		}
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(min(n, math.MaxInt32)))
+	case 0xca:
+		n, err := d.uint(4)
+		return json.Number(strconv.FormatFloat(float64(math.Float32frombits(uint32(n))), 'g', -1, 32)), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return json.Number(strconv.FormatFloat(math.Float64frombits(n), 'g', -1, 64)), err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		n, err := d.uint(1 << (c - 0xcc))
+		return json.Number(strconv.FormatUint(n, 10)), err
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8, 16, 32, 64
+		size := 1 << (c - 0xd0)
+		n, err := d.uint(size)
+		shift := 64 - 8*size
+		return json.Number(strconv.FormatInt(int64(n<<shift)>>shift, 10)), err
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(int(min(n, math.MaxInt32)), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(int(min(n, math.MaxInt32)), depth)
+	}
+	return nil, fmt.Errorf("%w: unsupported type byte 0x%02x at byte %d", ErrInvalidMsgpack, b[0], d.pos-1)
+}
+
+func (d *msgpackDecoder) str(n int) (any, error) {
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) arrayOf(n, depth int) (any, error) {
+	if n > len(d.data)-d.pos {
+		return nil, fmt.Errorf("%w: truncated array of %d items", ErrInvalidMsgpack, n)
+	}
+	items := make([]any, n)
+	for i := range items {
+		item, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = item
+	}
+	return items, nil
+}
+
+func (d *msgpackDecoder) mapOf(n, depth int) (any, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, fmt.Errorf("%w: truncated map of %d entries", ErrInvalidMsgpack, n)
+	}
+	m := make(map[string]any, n)
+	for range n {
+		key, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: map key %v is not a string", ErrInvalidMsgpack, key)
+		}
+		if m[s], err = d.value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string { return "application/x-protobuf" }
+
+// Encode encodes the JSON value of v as a google.protobuf.Value, map keys
+// sorted so equal values encode the same.
+func (protobufCodec) Encode(v any) ([]byte, error) {
+	value, err := jsonValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return protoValue(value), nil
+}
+
+// Decode decodes a google.protobuf.Value into the value it was encoded from.
+func (protobufCodec) Decode(data []byte, v any) error {
+	value, err := decodeProtoValue(data, 0)
+	if err != nil {
+		return err
+	}
+	if data, err = json.Marshal(value); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// The fields of google.protobuf.Value, and of the Struct and ListValue
+// messages it nests, e.g. {"a": 1} is Value{struct_value: Struct{fields:
+// [{key: "a", value: Value{number_value: 1}}]}}.
+const (
+	protoNullValue   = 1 // NullValue enum, varint
+	protoNumberValue = 2 // double, fixed64
+	protoStringValue = 3
+	protoBoolValue   = 4 // varint
+	protoStructValue = 5 // Struct{repeated FieldsEntry fields = 1}, FieldsEntry{key = 1, value = 2}
+	protoListValue   = 6 // ListValue{repeated Value values = 1}
+
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoValue returns the google.protobuf.Value of a value decoded from JSON
+// with UseNumber.
+func protoValue(v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return []byte{protoNullValue << 3, 0}
+	case bool:
+		if v {
+			return []byte{protoBoolValue << 3, 1}
+		}
+		return []byte{protoBoolValue << 3, 0}
+	case json.Number:
+		f, _ := v.Float64()
+		return binary.LittleEndian.AppendUint64([]byte{protoNumberValue<<3 | protoFixed64}, math.Float64bits(f))
+	case string:
+		return appendProtoBytes(nil, protoStringValue, []byte(v))
+	case []any:
+		var list []byte
+		for _, item := range v {
+			list = appendProtoBytes(list, 1, protoValue(item))
+		}
+		return appendProtoBytes(nil, protoListValue, list)
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		var fields []byte
+		for _, key := range keys {
+			entry := appendProtoBytes(nil, 1, []byte(key))
+			entry = appendProtoBytes(entry, 2, protoValue(v[key]))
+			fields = appendProtoBytes(fields, 1, entry)
+		}
+		return appendProtoBytes(nil, protoStructValue, fields)
+	}
+	panic(fmt.Sprintf("protobuf: unexpected %T", v))
+}
+
+// appendProtoBytes appends a length-delimited field.
+func appendProtoBytes(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// protoFields calls fn with each field of a message: its number, wire type
+// and value, n for varints and fixed-size values, data for length-delimited
+// ones.
+func protoFields(data []byte, fn func(field int, wire byte, n uint64, data []byte) error) error {
+	for pos := 0; pos < len(data); {
+		tag, size := binary.Uvarint(data[pos:])
+		if size <= 0 || tag>>3 == 0 || tag>>3 > math.MaxInt32 {
+			return fmt.Errorf("%w: bad tag at byte %d", ErrInvalidProtobuf, pos)
+		}
+		pos += size
+
+		var n uint64
+		var value []byte
+		switch wire := byte(tag & 7); wire {
+		case protoVarint:
+			if n, size = binary.Uvarint(data[pos:]); size <= 0 {
+				return fmt.Errorf("%w: bad varint at byte %d", ErrInvalidProtobuf, pos)
+			}
+			pos += size
+		case protoFixed64, protoFixed32:
+			width := 8
+			if wire == protoFixed32 {
+				width = 4
+			}
+			if len(data)-pos < width {
+				return fmt.Errorf("%w: truncated at byte %d", ErrInvalidProtobuf, pos)
+			}
+			for i := width - 1; i >= 0; i-- {
+				n = n<<8 | uint64(data[pos+i])
+			}
+			pos += width
+		case protoBytes:
+			length, size := binary.Uvarint(data[pos:])
+			if size <= 0 || length > uint64(len(data)-pos-size) {
+				return fmt.Errorf("%w: truncated at byte %d", ErrInvalidProtobuf, pos)
+			}
+			pos += size
+			value, pos = data[pos:pos+int(length)], pos+int(length)
+		default:
+			return fmt.Errorf("%w: unsupported wire type %d at byte %d", ErrInvalidProtobuf, wire, pos)
+		}
+		if err := fn(int(tag>>3), byte(tag&7), n, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxProtobufDepth bounds the nesting of decoded values.
+const maxProtobufDepth = 100
+
+// decodeProtoValue decodes a google.protobuf.Value into the values
+// encoding/json decodes into any. Of several kinds set, the last wins, and
+// unknown fields are skipped, as protobuf libraries do.
+func decodeProtoValue(data []byte, depth int) (any, error) {
+	if depth > maxProtobufDepth {
+		return nil, fmt.Errorf("%w: nested deeper than %d", ErrInvalidProtobuf, maxProtobufDepth)
+	}
+	var value any
+	err := protoFields(data, func(field int, wire byte, n uint64, data []byte) error {
+		var err error
+		switch {
+		case field == protoNullValue && wire == protoVarint:
+			value = nil
+		case field == protoNumberValue && wire == protoFixed64:
+			f := math.Float64frombits(n)
+			if math.IsNaN(f) || math.IsInf(f, 0) {
+				return fmt.Errorf("%w: %g has no JSON value", ErrInvalidProtobuf, f)
+			}
+			value = json.Number(strconv.FormatFloat(f, 'f', -1, 64))
+		case field == protoStringValue && wire == protoBytes:
+			value = string(data)
+		case field == protoBoolValue && wire == protoVarint:
+			value = n != 0
+		case field == protoStructValue && wire == protoBytes:
+			value, err = decodeProtoStruct(data, depth)
+		case field == protoListValue && wire == protoBytes:
+			value, err = decodeProtoList(data, depth)
+		}
+		return err
+	})
+	return value, err
+}
+
+func decodeProtoStruct(data []byte, depth int) (any, error) {
+	m := map[string]any{}
+	err := protoFields(data, func(field int, wire byte, _ uint64, entry []byte) error {
+		if field != 1 || wire != protoBytes {
+			return nil
+		}
+		var key string
+		var value any
+		err := protoFields(entry, func(field int, wire byte, _ uint64, data []byte) error {
+			var err error
+			switch {
+			case field == 1 && wire == protoBytes:
+				key = string(data)
+			case field == 2 && wire == protoBytes:
+				value, err = decodeProtoValue(data, depth+1)
+			}
+			return err
+		})
+		m[key] = value
+		return err
+	})
+	return m, err
+}
+
+func decodeProtoList(data []byte, depth int) (any, error) {
+	items := []any{}
+	err := protoFields(data, func(field int, wire byte, _ uint64, data []byte) error {
+		if field != 1 || wire != protoBytes {
+			return nil
+		}
+		item, err := decodeProtoValue(data, depth+1)
+		items = append(items, item)
+		return err
+	})
+	return items, err
+}
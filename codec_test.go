@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMsgpackCodec(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		want []byte
+	}{
+		{"Map", map[string]any{"b": []any{true, nil, "x"}, "a": 1}, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x93, 0xc3, 0xc0, 0xa1, 'x'}},
+		{"Negative fixint", -5, []byte{0xfb}},
+		{"Int32", -70000, []byte{0xd2, 0xff, 0xfe, 0xee, 0x90}},
+		{"Int64", int64(math.MaxInt64), []byte{0xd3, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"Float", 1.5, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"Str8", string(bytes.Repeat([]byte{'a'}, 40)), append([]byte{0xd9, 40}, bytes.Repeat([]byte{'a'}, 40)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MsgpackCodec.Encode(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Encode(%v) = % x; want % x", tt.v, got, tt.want)
+			}
+		})
+	}
+
+	// Values round-trip as they do through JSON.
+	event := Event{Operation: Operation{ID: "op-1", Type: OpTransfer, From: "acc1", To: "acc2", Amount: 70000,
+		Time: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Metadata: map[string]string{"memo": "rent"}}, Version: 3}
+	for _, codec := range []Codec{JSONCodec, MsgpackCodec} {
+		data, err := codec.Encode(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Event
+		if err := codec.Decode(data, &got); err != nil {
+			t.Fatalf("%s: Decode() error = %v", codec.ContentType(), err)
+		}
+		if !reflect.DeepEqual(got, event) {
+			t.Errorf("%s: decoded %+v; want %+v", codec.ContentType(), got, event)
+		}
+	}
+
+	invalid := map[string][]byte{
+		"Truncated":       {0x92, 0x01},
+		"Non-string key":  {0x81, 0x01, 0x02},
+		"Extension":       {0xd4, 0x01, 0x02},
+		"Trailing bytes":  {0x01, 0x02},
+		"Huge array":      {0xdd, 0xff, 0xff, 0xff, 0xff},
+		"Truncated float": {0xcb, 0x3f},
+	}
+	for name, data := range invalid {
+		var v any
+		if err := MsgpackCodec.Decode(data, &v); !errors.Is(err, ErrInvalidMsgpack) {
+			t.Errorf("%s: Decode(% x) = %v; want %v", name, data, err, ErrInvalidMsgpack)
+		}
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	tests := []struct {
+		name string
+		v    any
+		want []byte
+	}{
+		{"Null", nil, []byte{0x08, 0x00}},
+		{"Bool", true, []byte{0x20, 0x01}},
+		{"Number", 1.5, []byte{0x11, 0, 0, 0, 0, 0, 0, 0xf8, 0x3f}},
+		{"String", "ab", []byte{0x1a, 0x02, 'a', 'b'}},
+		{"List", []any{false}, []byte{0x32, 0x04, 0x0a, 0x02, 0x20, 0x00}},
+		{"Struct", map[string]any{"b": "x", "a": nil}, []byte{
+			0x2a, 0x13,
+			0x0a, 0x07, 0x0a, 0x01, 'a', 0x12, 0x02, 0x08, 0x00,
+			0x0a, 0x08, 0x0a, 0x01, 'b', 0x12, 0x03, 0x1a, 0x01, 'x',
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ProtobufCodec.Encode(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Encode(%v) = % x; want % x", tt.v, got, tt.want)
+			}
+		})
+	}
+
+	event := Event{Operation: Operation{ID: "op-1", Type: OpTransfer, From: "acc1", To: "acc2", Amount: 70000,
+		Time: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), Metadata: map[string]string{"memo": "rent"}}, Version: 3,
+		Buckets: map[string]int{"acc1#reserved": -20}}
+	data, err := ProtobufCodec.Encode(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Event
+	if err := ProtobufCodec.Decode(data, &got); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, event) {
+		t.Errorf("decoded %+v; want %+v", got, event)
+	}
+
+	// Unknown fields are skipped, as by protobuf libraries.
+	var v any
+	if err := ProtobufCodec.Decode([]byte{0x38, 0x05, 0x1a, 0x01, 'x', 0x45, 1, 2, 3, 4}, &v); err != nil || v != "x" {
+		t.Errorf("Decode() with unknown fields = %v, %v; want x", v, err)
+	}
+
+	invalid := map[string][]byte{
+		"Truncated":       {0x1a, 0x05, 'a'},
+		"Bad tag":         {0x00},
+		"Group":           {0x0b},
+		"Truncated float": {0x11, 0x00},
+		"NaN":             {0x11, 0, 0, 0, 0, 0, 0, 0xf8, 0x7f},
+	}
+	nested := []byte{0x08, 0x00}
+	for range maxProtobufDepth + 1 {
+		nested = appendProtoBytes(nil, protoListValue, appendProtoBytes(nil, 1, nested))
+	}
+	invalid["Too deep"] = nested
+	for name, data := range invalid {
+		var v any
+		if err := ProtobufCodec.Decode(data, &v); !errors.Is(err, ErrInvalidProtobuf) {
+			t.Errorf("%s: Decode(% x) = %v; want %v", name, data, err, ErrInvalidProtobuf)
+		}
+	}
+
+	quiet(t)
+	sm, _ := goldenMachine(t)
+	sm.UseCodec(ProtobufCodec)
+	var snapshot bytes.Buffer
+	if err := sm.WriteSnapshot(&snapshot, nil); err != nil {
+		t.Fatal(err)
+	}
+	restored := &StateMachine{}
+	restored.UseCodec(ProtobufCodec)
+	if err := restored.ReadSnapshot(&snapshot, nil); err != nil {
+		t.Fatalf("ReadSnapshot() error = %v", err)
+	}
+	if got, want := restored.Balances(), sm.Balances(); !maps.Equal(got, want) {
+		t.Errorf("Balances() = %v; want %v", got, want)
+	}
+}
+
+func TestSnapshotCodec(t *testing.T) {
+	quiet(t)
+
+	sm, _ := goldenMachine(t)
+	var plain bytes.Buffer
+	if err := sm.WriteSnapshot(&plain, nil); err != nil {
+		t.Fatal(err)
+	}
+	sm.UseCodec(MsgpackCodec)
+	var packed bytes.Buffer
+	if err := sm.WriteSnapshot(&packed, nil); err != nil {
+		t.Fatal(err)
+	}
+	if packed.Len() >= plain.Len() || isJSONObject(packed.Bytes()) {
+		t.Errorf("msgpack snapshot of %d bytes; want a binary one smaller than the %d of JSON", packed.Len(), plain.Len())
+	}
+
+	tests := []struct {
+		name  string
+		codec Codec
+		data  []byte
+	}{
+		{"Msgpack", MsgpackCodec, packed.Bytes()},
+		{"JSON read with msgpack", MsgpackCodec, plain.Bytes()},
+		{"JSON", nil, plain.Bytes()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			restored := &StateMachine{}
+			restored.UseCodec(tt.codec)
+			if err := restored.ReadSnapshot(bytes.NewReader(tt.data), nil); err != nil {
+				t.Fatalf("ReadSnapshot() error = %v", err)
+			}
+			if got, want := restored.Balances(), sm.Balances(); !maps.Equal(got, want) {
+				t.Errorf("Balances() = %v; want %v", got, want)
+			}
+			var again bytes.Buffer
+			if err := restored.WriteSnapshot(&again, nil); err != nil {
+				t.Fatal(err)
+			}
+			if want := map[bool][]byte{true: packed.Bytes(), false: plain.Bytes()}[tt.codec != nil]; !bytes.Equal(again.Bytes(), want) {
+				t.Errorf("snapshot written again differs")
+			}
+		})
+	}
+}
+
+func TestWebhookPublisherCodec(t *testing.T) {
+	var contentType string
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer ts.Close()
+
+	pub := &WebhookPublisher{URL: ts.URL, Codec: MsgpackCodec}
+	entries := []OutboxEntry{{Seq: 1, Event: Event{Operation: Operation{ID: "op-1", Type: OpDeposit}}}}
+	if err := pub.Publish(context.Background(), entries); err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Entries []OutboxEntry `json:"entries"`
+	}
+	if err := MsgpackCodec.Decode(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "application/msgpack" || len(got.Entries) != 1 || got.Entries[0].Event.Operation.ID != "op-1" {
+		t.Errorf("webhook received %s %+v; want the entry as msgpack", contentType, got)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCompositeFailed     = errors.New("composite operation failed")
+	ErrUnknownCompensation = errors.New("unknown compensation")
+	ErrCompensationSettled = errors.New("compensation already settled")
+)
+
+// maxCompensationAttempts is how many times a compensation is attempted
+// before it is left to an admin.
+const maxCompensationAttempts = 5
+
+// compensationInterval is how often the server retries pending
+// compensations.
+const compensationInterval = 10 * time.Second
+
+// Step is a step of a composite operation, see RunComposite: either an
+// Operation applied to the state machine, compensated by reversing it, or
+// an Action outside of it, e.g. calling a webhook, compensated by calling
+// Compensate, if not nil.
+type Step struct {
+	Name       string
+	Operation  *Operation
+	Action     func(ctx context.Context) error
+	Compensate func(ctx context.Context) error
+}
+
+type CompensationStatus string
+
+const (
+	CompensationPending    CompensationStatus = "pending"    // to be attempted by the compensator
+	CompensationDone       CompensationStatus = "done"       // the step was undone
+	CompensationUnresolved CompensationStatus = "unresolved" // given up on, waiting for an admin
+	CompensationResolved   CompensationStatus = "resolved"   // settled by an admin
+)
+
+// Compensation is an entry of the compensation log: a completed step of a
+// composite operation to undo because a later step failed.
+type Compensation struct {
+	ID         string             `json:"id"`
+	Composite  string             `json:"composite"` // ID of the composite operation
+	Name       string             `json:"name"`      // of the composite operation
+	Step       string             `json:"step"`
+	Operation  string             `json:"operation,omitempty"` // applied by the step, reversed to undo it
+	Reversal   string             `json:"reversal,omitempty"`  // the operation reversing it, once done
+	Cause      string             `json:"cause"`               // error of the step that failed
+	Status     CompensationStatus `json:"status"`
+	Attempts   int                `json:"attempts"`
+	Error      string             `json:"error,omitempty"` // of the latest attempt
+	CreatedAt  time.Time          `json:"created_at"`
+	UpdatedAt  time.Time          `json:"updated_at"`
+	Note       string             `json:"note,omitempty"` // left by the admin resolving it
+	ResolvedBy string             `json:"resolved_by,omitempty"`
+
+	compensate func(ctx context.Context) error // of an action
+	running    bool                            // being attempted
+}
+
+// compensations is the compensation log, oldest first. Its lock is never
+// held while taking the state lock.
+type compensations struct {
+	mu    sync.Mutex
+	byID  map[string]*Compensation
+	order []string
+}
+
+func (cs *compensations) add(c Compensation) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.byID == nil {
+		cs.byID = map[string]*Compensation{}
+	}
+	cs.byID[c.ID] = &c
+	cs.order = append(cs.order, c.ID)
+}
+
+func (cs *compensations) list() []Compensation {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	list := make([]Compensation, len(cs.order))
+	for i, id := range cs.order {
+		list[i] = *cs.byID[id]
+	}
+	return list
+}
+
+func (cs *compensations) get(id string) (Compensation, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c, ok := cs.byID[id]
+	if !ok {
+		return Compensation{}, fmt.Errorf("%w (%s)", ErrUnknownCompensation, id)
+	}
+	return *c, nil
+}
+
+// RunComposite applies the steps of a composite operation in order, e.g. a
+// transfer, its fee and the webhook announcing it, and returns the
+// operations applied. The operations carry the composite's ID as their
+// "composite" metadata.
+//
+// If a step fails, the steps completed before it are logged as compensations
+// and undone, latest first: their operations are reversed and their actions
+// compensated. Compensations that fail are retried by RunCompensator and,
+// after maxCompensationAttempts, left unresolved for an admin, see
+// Compensations. The error wraps ErrCompositeFailed and that of the step.
+func (sm *StateMachine) RunComposite(ctx context.Context, name string, steps ...Step) ([]Operation, error) {
+	composite := sm.newOperationID(sm.now())
+
+	var applied []Operation
+	var completed []Compensation
+	for _, step := range steps {
+		var err error
+		c := Compensation{Composite: composite, Name: name, Step: step.Name, compensate: step.Compensate}
+		if step.Operation != nil {
+			op := *step.Operation
+			op.Metadata = maps.Clone(op.Metadata)
+			if op.Metadata == nil {
+				op.Metadata = map[string]string{}
+			}
+			op.Metadata["composite"] = composite
+			if op, err = sm.ApplyContext(ctx, op); err == nil {
+				applied = append(applied, op)
+				c.Operation = op.ID
+			}
+		} else if step.Action != nil {
+			err = step.Action(ctx)
+		}
+
+		if err != nil {
+			sm.logCompensations(ctx, completed, err)
+			return applied, fmt.Errorf("%w: %s step %s: %w", ErrCompositeFailed, name, step.Name, err)
+		}
+		if c.Operation != "" || c.compensate != nil {
+			completed = append(completed, c)
+		}
+	}
+	return applied, nil
+}
+
+// logCompensations logs the compensations of the completed steps, latest
+// first, and attempts each.
+func (sm *StateMachine) logCompensations(ctx context.Context, completed []Compensation, cause error) {
+	now := sm.now()
+	for i := len(completed) - 1; i >= 0; i-- {
+		c := completed[i]
+		c.ID, c.Cause, c.Status = sm.newOperationID(now), cause.Error(), CompensationPending
+		c.CreatedAt, c.UpdatedAt = now, now
+		sm.compensations.add(c)
+		sm.attemptCompensation(ctx, c.ID)
+	}
+}
+
+// attemptCompensation attempts a pending compensation unless it is already
+// being attempted.
+func (sm *StateMachine) attemptCompensation(ctx context.Context, id string) {
+	cs := &sm.compensations
+	cs.mu.Lock()
+	c, ok := cs.byID[id]
+	if !ok || c.Status != CompensationPending || c.running {
+		cs.mu.Unlock()
+		return
+	}
+	c.running = true
+	operation, compensate := c.Operation, c.compensate
+	cs.mu.Unlock()
+
+	var reversal string
+	var err error
+	if operation != "" {
+		var op Operation
+		if op, err = sm.ReverseContext(ctx, operation); err == nil {
+			reversal = op.ID
+		} else if errors.Is(err, ErrAlreadyReversed) {
+			err = nil
+		}
+	} else {
+		err = compensate(ctx)
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c.running = false
+	c.Attempts++
+	c.UpdatedAt = sm.now()
+	switch {
+	case err == nil:
+		c.Status, c.Reversal, c.Error = CompensationDone, reversal, ""
+	case ctx.Err() != nil:
+		c.Attempts-- // not the compensation's fault
+	default:
+		c.Error = err.Error()
+		// Operations out of history or no longer reversible never will be.
+		permanent := errors.Is(err, ErrOperationNotFound) || errors.Is(err, ErrIrreversible)
+		if permanent || c.Attempts >= maxCompensationAttempts {
+			c.Status = CompensationUnresolved
+			fmt.Printf("Compensation Error: %s step %s of %s left unresolved: %v\n", c.Name, c.Step, c.Composite, err)
+		}
+	}
+}
+
+// Compensations returns the compensation log, oldest first. Those
+// unresolved wait for an admin to retry or resolve them.
+func (sm *StateMachine) Compensations() []Compensation {
+	return sm.compensations.list()
+}
+
+// Compensation returns an entry of the compensation log.
+func (sm *StateMachine) Compensation(id string) (Compensation, error) {
+	return sm.compensations.get(id)
+}
+
+// RunCompensations attempts every pending compensation once and returns how
+// many are still pending.
+func (sm *StateMachine) RunCompensations(ctx context.Context) int {
+	pending := 0
+	for _, c := range sm.compensations.list() {
+		if c.Status != CompensationPending {
+			continue
+		}
+		sm.attemptCompensation(ctx, c.ID)
+		if c, _ := sm.compensations.get(c.ID); c.Status == CompensationPending {
+			pending++
+		}
+	}
+	return pending
+}
+
+// RunCompensator calls RunCompensations every interval until ctx is done.
+func (sm *StateMachine) RunCompensator(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sm.RunCompensations(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RetryCompensation attempts an unresolved compensation again, with
+// maxCompensationAttempts more attempts, and returns it. It fails with
+// ErrCompensationSettled if it is done or resolved.
+func (sm *StateMachine) RetryCompensation(ctx context.Context, id string) (Compensation, error) {
+	cs := &sm.compensations
+	cs.mu.Lock()
+	c, ok := cs.byID[id]
+	switch {
+	case !ok:
+		cs.mu.Unlock()
+		return Compensation{}, fmt.Errorf("%w (%s)", ErrUnknownCompensation, id)
+	case c.Status == CompensationDone || c.Status == CompensationResolved:
+		cs.mu.Unlock()
+		return Compensation{}, fmt.Errorf("%w (%s) is %s", ErrCompensationSettled, id, c.Status)
+	}
+	c.Status, c.Attempts = CompensationPending, 0
+	cs.mu.Unlock()
+
+	sm.attemptCompensation(ctx, id)
+	return sm.compensations.get(id)
+}
+
+// ResolveCompensation records that the actor of ctx, an admin, settled a
+// compensation by other means, e.g. by hand, with a note saying how, and
+// returns it. It fails with ErrCompensationSettled if it is done or
+// resolved.
+func (sm *StateMachine) ResolveCompensation(ctx context.Context, id, note string) (Compensation, error) {
+	cs := &sm.compensations
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c, ok := cs.byID[id]
+	switch {
+	case !ok:
+		return Compensation{}, fmt.Errorf("%w (%s)", ErrUnknownCompensation, id)
+	case c.Status == CompensationDone || c.Status == CompensationResolved:
+		return Compensation{}, fmt.Errorf("%w (%s) is %s", ErrCompensationSettled, id, c.Status)
+	}
+	c.Status, c.Note, c.ResolvedBy, c.UpdatedAt = CompensationResolved, note, ActorFrom(ctx), sm.now()
+	return *c, nil
+}
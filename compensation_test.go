@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunComposite(t *testing.T) {
+	quiet(t)
+
+	errWebhook := errors.New("webhook unreachable")
+	tests := []struct {
+		name             string
+		webhookErr       error
+		expected         map[string]int
+		expectedStatuses []CompensationStatus
+	}{
+		{"Completed", nil, map[string]int{"acc1": 890, "acc2": 100, "fees": 10}, nil},
+		{"Webhook fails", errWebhook, map[string]int{"acc1": 1000, "acc2": 0, "fees": 0}, []CompensationStatus{CompensationDone, CompensationDone}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0, "fees": 0}}
+			applied, err := sm.RunComposite(context.Background(), "payment",
+				Step{Name: "transfer", Operation: &Operation{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 100}},
+				Step{Name: "fee", Operation: &Operation{Type: OpTransfer, From: "acc1", To: "fees", Amount: 10}},
+				Step{Name: "webhook", Action: func(ctx context.Context) error { return tt.webhookErr }},
+			)
+			if tt.webhookErr == nil && err != nil {
+				t.Fatalf("RunComposite() error = %v", err)
+			}
+			if tt.webhookErr != nil && (!errors.Is(err, ErrCompositeFailed) || !errors.Is(err, tt.webhookErr)) {
+				t.Fatalf("RunComposite() error = %v; want ErrCompositeFailed and the webhook's", err)
+			}
+			if len(applied) != 2 || applied[0].Metadata["composite"] == "" || applied[0].Metadata["composite"] != applied[1].Metadata["composite"] {
+				t.Errorf("RunComposite() = %+v; want 2 operations of the same composite", applied)
+			}
+
+			for id, want := range tt.expected {
+				if balance, _ := sm.Balance(id); balance != want {
+					t.Errorf("Balance(%s) = %d; want %d", id, balance, want)
+				}
+			}
+			compensations := sm.Compensations()
+			if len(compensations) != len(tt.expectedStatuses) {
+				t.Fatalf("Compensations() = %+v; want %d", compensations, len(tt.expectedStatuses))
+			}
+			// Latest step first.
+			for i, c := range compensations {
+				want := applied[len(applied)-1-i]
+				if c.Status != tt.expectedStatuses[i] || c.Operation != want.ID || c.Reversal == "" || c.Cause != errWebhook.Error() {
+					t.Errorf("compensation %d = %+v; want %s reversing %s", i, c, tt.expectedStatuses[i], want.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestCompensator(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	failures := maxCompensationAttempts
+	_, err := sm.RunComposite(context.Background(), "booking",
+		Step{Name: "reserve", Action: func(ctx context.Context) error { return nil }, Compensate: func(ctx context.Context) error {
+			if failures > 0 {
+				failures--
+				return errors.New("release failed")
+			}
+			return nil
+		}},
+		Step{Name: "charge", Operation: &Operation{Type: OpWithdraw, From: "acc1", Amount: 500}},
+	)
+	if !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("RunComposite() error = %v; want ErrInsufficientBalance", err)
+	}
+
+	// Attempted once right away, then by the compensator until given up on.
+	for i := 1; i < maxCompensationAttempts; i++ {
+		if c := sm.Compensations()[0]; c.Status != CompensationPending || c.Attempts != i {
+			t.Fatalf("compensation = %+v; want pending after %d attempts", c, i)
+		}
+		sm.RunCompensations(context.Background())
+	}
+	c := sm.Compensations()[0]
+	if c.Status != CompensationUnresolved || c.Error != "release failed" {
+		t.Fatalf("compensation = %+v; want unresolved", c)
+	}
+	if pending := sm.RunCompensations(context.Background()); pending != 0 || sm.Compensations()[0].Attempts != maxCompensationAttempts {
+		t.Errorf("RunCompensations() attempted an unresolved compensation")
+	}
+
+	retried, err := sm.RetryCompensation(context.Background(), c.ID)
+	if err != nil || retried.Status != CompensationDone {
+		t.Errorf("RetryCompensation() = %+v, %v; want done", retried, err)
+	}
+	if _, err := sm.ResolveCompensation(context.Background(), c.ID, "released by hand"); !errors.Is(err, ErrCompensationSettled) {
+		t.Errorf("ResolveCompensation() of a done compensation error = %v; want ErrCompensationSettled", err)
+	}
+	if _, err := sm.RetryCompensation(context.Background(), "missing"); !errors.Is(err, ErrUnknownCompensation) {
+		t.Errorf("RetryCompensation(missing) error = %v; want ErrUnknownCompensation", err)
+	}
+}
+
+func TestServerCompensations(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 100})
+	_, _ = sm.RunComposite(context.Background(), "booking",
+		Step{Name: "reserve", Action: func(ctx context.Context) error { return nil }, Compensate: func(ctx context.Context) error {
+			return errors.New("release failed")
+		}},
+		Step{Name: "charge", Operation: &Operation{Type: OpWithdraw, From: "acc1", Amount: 500}},
+	)
+	for range maxCompensationAttempts {
+		sm.RunCompensations(context.Background())
+	}
+	id := sm.Compensations()[0].ID
+
+	tests := []struct {
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expected       CompensationStatus
+	}{
+		{http.MethodGet, "/compensations/" + id, "", http.StatusOK, CompensationUnresolved},
+		{http.MethodPost, "/compensations/" + id + "/resolve", `{"note": "released by hand"}`, http.StatusOK, CompensationResolved},
+		{http.MethodPost, "/compensations/" + id + "/resolve", `{}`, http.StatusConflict, ""},
+		{http.MethodPost, "/compensations/missing/retry", "", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+			var c Compensation
+			_ = json.Unmarshal(rec.Body.Bytes(), &c)
+			if tt.expected != "" && c.Status != tt.expected {
+				t.Errorf("%s %s = %+v; want %s", tt.method, tt.path, c, tt.expected)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/compensations?status=unresolved", nil))
+	if strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("GET /compensations?status=unresolved = %s; want none left", rec.Body)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalidCompression is returned for an unknown compression, or data
+// whose header names one.
+var ErrInvalidCompression = errors.New("invalid compression")
+
+// Compression is the algorithm persisted snapshots, archived backups and
+// archived WAL segments are compressed with, see UseCompression,
+// ArchiveOptions and WAL.ArchiveSegments. zstd is not among them: it has no
+// implementation in the standard library, and gzip stands in for it where
+// ratio matters. Live WAL segments are not compressed, as they are appended
+// and synced record by record; they are once sealed and archived.
+type Compression string
+
+const (
+	CompressionNone Compression = ""
+	// CompressionGzip compresses the most, for archives kept long.
+	CompressionGzip Compression = "gzip"
+	// CompressionSnappy compresses less but several times faster, for
+	// snapshots written often.
+	CompressionSnappy Compression = "snappy"
+)
+
+// compressedMagic starts compressed data. The byte after it records the
+// compression, so data reads back whatever the current setting.
+var compressedMagic = []byte("VFZ\x01")
+
+// compressionIDs are the bytes recording each compression, which must
+// never change.
+var compressionIDs = map[Compression]byte{CompressionGzip: 1, CompressionSnappy: 2}
+
+// maxDecompressedSize bounds what Decompress inflates, so a corrupt or
+// crafted header cannot exhaust memory.
+const maxDecompressedSize = 1 << 30
+
+// ParseCompression parses the name of a compression, empty for none.
+func ParseCompression(name string) (Compression, error) {
+	c := Compression(name)
+	if _, ok := compressionIDs[c]; !ok && c != CompressionNone {
+		return "", fmt.Errorf("%w: %q, want gzip or snappy", ErrInvalidCompression, name)
+	}
+	return c, nil
+}
+
+// IsCompressed reports whether data looks like the output of Compress.
+func IsCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, compressedMagic) && len(data) > len(compressedMagic)
+}
+
+// Compress compresses data with c behind a header recording it. With
+// CompressionNone data is returned as is.
+func Compress(c Compression, data []byte) ([]byte, error) {
+	if c == CompressionNone {
+		return data, nil
+	}
+	id, ok := compressionIDs[c]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidCompression, c)
+	}
+
+	out := append(bytes.Clone(compressedMagic), id)
+	switch c {
+	case CompressionGzip:
+		buf := bytes.NewBuffer(out)
+		zw := gzip.NewWriter(buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return append(out, snappyEncode(data)...), nil
+	}
+}
+
+// Decompress returns the data compressed by Compress, with whichever
+// compression its header records. Data without the header is returned as
+// is, so files written before compression was enabled still read.
+func Decompress(data []byte) ([]byte, error) {
+	if !IsCompressed(data) {
+		return data, nil
+	}
+	id, body := data[len(compressedMagic)], data[len(compressedMagic)+1:]
+	switch id {
+	case compressionIDs[CompressionGzip]:
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCompression, err)
+		}
+		out, err := io.ReadAll(io.LimitReader(zr, maxDecompressedSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCompression, err)
+		}
+		if len(out) > maxDecompressedSize {
+			return nil, fmt.Errorf("%w: more than %d bytes decompressed", ErrInvalidCompression, maxDecompressedSize)
+		}
+		return out, nil
+	case compressionIDs[CompressionSnappy]:
+		out, err := snappyDecode(body, maxDecompressedSize)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidCompression, err)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("%w: unknown compression %d in header", ErrInvalidCompression, id)
+}
+
+// UseCompression makes WriteSnapshot compress snapshots with c, before
+// they are sealed. ReadSnapshot reads them compressed or not, with any
+// compression. It must be called before snapshots are written.
+func (sm *StateMachine) UseCompression(c Compression) {
+	sm.compression = c
+}
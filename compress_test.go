@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"maps"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := make([]byte, 200_000)
+	for i := range random {
+		random[i] = byte(rng.IntN(256))
+	}
+	// JSON-like data, with repeats within and beyond the reach of copies.
+	var ledger bytes.Buffer
+	for i := range 20_000 {
+		ledger.WriteString(`{"account":"acc` + string(rune('a'+i%7)) + `","amount":`)
+		ledger.WriteByte(byte('0' + rng.IntN(10)))
+		ledger.WriteString("},")
+	}
+	ledger.Write(random[:100_000])
+	ledger.Write(random[:100_000])
+
+	inputs := map[string][]byte{
+		"Empty":      {},
+		"Short":      []byte("abc"),
+		"Overlap":    bytes.Repeat([]byte("a"), 1000),
+		"Random":     random,
+		"Repetitive": ledger.Bytes(),
+	}
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+		for name, data := range inputs {
+			compressed, err := Compress(c, data)
+			if err != nil {
+				t.Fatalf("%s: Compress(%s) error = %v", c, name, err)
+			}
+			if IsCompressed(compressed) != (c != CompressionNone) {
+				t.Errorf("%s: IsCompressed(%s) = %v", c, name, !IsCompressed(compressed))
+			}
+			if c != CompressionNone && name == "Repetitive" && len(compressed) > len(data)/2 {
+				t.Errorf("%s: %s compressed to %d of %d bytes", c, name, len(compressed), len(data))
+			}
+			got, err := Decompress(compressed)
+			if err != nil {
+				t.Fatalf("%s: Decompress(%s) error = %v", c, name, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s: %s does not round-trip", c, name)
+			}
+		}
+	}
+
+	if _, err := ParseCompression("zstd"); !errors.Is(err, ErrInvalidCompression) {
+		t.Errorf("ParseCompression(zstd) = %v; want %v", err, ErrInvalidCompression)
+	}
+
+	snappy, _ := Compress(CompressionSnappy, ledger.Bytes())
+	gzipped, _ := Compress(CompressionGzip, ledger.Bytes())
+	corrupt := map[string][]byte{
+		"Unknown compression": append(bytes.Clone(compressedMagic), 9, 0),
+		"Truncated snappy":    snappy[:len(snappy)/2],
+		"Truncated gzip":      gzipped[:len(gzipped)/2],
+		"Snappy copy before the start": append(bytes.Clone(compressedMagic), 2,
+			10, 0x01<<2|2, 5, 0), // 10 bytes, copy 2 from 5 back
+		"Snappy too large": append(bytes.Clone(compressedMagic), 2, 0xff, 0xff, 0xff, 0xff, 0x0f),
+	}
+	for name, data := range corrupt {
+		if _, err := Decompress(data); !errors.Is(err, ErrInvalidCompression) {
+			t.Errorf("Decompress(%s) = %v; want %v", name, err, ErrInvalidCompression)
+		}
+	}
+}
+
+// TestSnappyFormat decodes a block as the reference implementation encodes
+// it, so the format stays readable by other Snappy decoders.
+func TestSnappyFormat(t *testing.T) {
+	// A literal, then copies of it in both offset forms.
+	block := []byte{
+		12,                         // 12 bytes
+		3 << 2, 'a', 'b', 'c', 'd', // literal "abcd"
+		(4-4)<<2 | 0<<5 | 1, 4, // copy 4 from 4 back, 1-byte offset
+		(4-1)<<2 | 2, 8, 0, // copy 4 from 8 back, 2-byte offset
+	}
+	got, err := snappyDecode(block, 100)
+	if err != nil || string(got) != "abcdabcdabcd" {
+		t.Errorf("snappyDecode() = %q, %v; want abcdabcdabcd", got, err)
+	}
+}
+
+func TestCompressedSnapshotAndArchive(t *testing.T) {
+	quiet(t)
+
+	sm, _ := goldenMachine(t)
+	keys, _ := NewKeyring("k1", bytes.Repeat([]byte{1}, 32))
+	enc := NewEncryptor(keys)
+
+	for _, c := range []Compression{CompressionGzip, CompressionSnappy} {
+		sm.UseCompression(c)
+		var b bytes.Buffer
+		if err := sm.WriteSnapshot(&b, enc); err != nil {
+			t.Fatal(err)
+		}
+		restored := &StateMachine{} // reads any compression
+		if err := restored.ReadSnapshot(&b, enc); err != nil {
+			t.Fatalf("%s: ReadSnapshot() error = %v", c, err)
+		}
+		if got, want := restored.Balances(), sm.Balances(); !maps.Equal(got, want) {
+			t.Errorf("%s: Balances() = %v; want %v", c, got, want)
+		}
+
+		store := &memStore{}
+		if _, err := sm.Archive(context.Background(), store, ArchiveOptions{Compression: c}); err != nil {
+			t.Fatal(err)
+		}
+		restored = &StateMachine{}
+		if _, err := restored.RestoreArchive(context.Background(), store, "", nil); err != nil {
+			t.Fatalf("%s: RestoreArchive() error = %v", c, err)
+		}
+		if got, want := restored.Balances(), sm.Balances(); !maps.Equal(got, want) || restored.Version() != sm.Version() {
+			t.Errorf("%s: restored %v at %d; want %v at %d", c, got, restored.Version(), want, sm.Version())
+		}
+	}
+}
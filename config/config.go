@@ -0,0 +1,901 @@
+// Package config loads vaultflow settings from YAML, TOML or JSON files and
+// from environment variables.
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is prepended to every environment variable read by Load.
+const EnvPrefix = "VAULTFLOW_"
+
+type Config struct {
+	Server      ServerConfig
+	Storage     StorageConfig
+	Replication ReplicationConfig
+	Archive     ArchiveConfig
+	Limits      LimitsConfig
+	Retry       RetryConfig
+	Breaker     BreakerConfig
+	Auth        AuthConfig
+	Sweeps      map[string]Sweep     // keyed by name
+	Signers     map[string]SignerSet // keyed by account
+	Features    map[string]bool      // feature flags, keyed by name
+	Plugins     map[string]string    // path of each plugin, keyed by name
+	Scripts     map[string]string    // source of each script, keyed by name
+	Keys        map[string]string    // base64 AES-128/192/256 encryption key, keyed by id
+	Accounts    map[string]int       // initial balance of each account
+}
+
+type ServerConfig struct {
+	Addr             string
+	ShutdownTimeout  time.Duration
+	OperationTimeout time.Duration // 0 means operations wait as long as the request
+
+	// Operations are shed with 429 Too Many Requests while MaxQueueDepth
+	// of them are in flight, or while they recently took longer than
+	// MaxQueueLatency. Zero disables a limit.
+	MaxQueueDepth   int
+	MaxQueueLatency time.Duration
+
+	// TLS is enabled when both TLSCert and TLSKey are set. ClientCA enables
+	// client certificate verification, mandatory when RequireClientCert is set.
+	TLSCert           string
+	TLSKey            string
+	ClientCA          string
+	RequireClientCert bool
+}
+
+func (s ServerConfig) TLSEnabled() bool {
+	return s.TLSCert != "" && s.TLSKey != ""
+}
+
+// StorageConfig keeps data in Dir. With WAL set, the events of operations
+// are recorded in a write-ahead log under Dir/wal, replayed at startup and
+// rotated to a new segment once one holds SegmentSize bytes or is older
+// than SegmentAge, if set. Sync is when records are flushed to disk:
+// always, in batches every SyncInterval, or async, leaving it to the
+// operating system. With always, a flush waits GroupWindow for concurrent
+// operations to share it. With WAL set, a checkpoint of the state the log
+// does not record is also written to Dir every CheckpointInterval, if set,
+// and on shutdown, and restored before the log is replayed. With Key set,
+// the log, the checkpoints and the archived backups are sealed with the
+// key of Keys of that id; the other keys still open those sealed before a
+// rotation. With Outbox, the events of operations are kept for consumers
+// polling them.
+type StorageConfig struct {
+	Dir          string
+	Outbox       bool
+	WAL          bool
+	SegmentSize  int64
+	SegmentAge   time.Duration
+	Sync         string
+	SyncInterval time.Duration
+	GroupWindow  time.Duration
+
+	CheckpointInterval time.Duration
+	Key                string
+}
+
+// ReplicationConfig makes this instance a read-only replica of the leader
+// at Leader, a base URL, when set. APIKey authenticates the replica to the
+// leader, and reads fail once the leader has not been heard from for
+// MaxStaleness.
+type ReplicationConfig struct {
+	Leader       string
+	APIKey       string
+	MaxStaleness time.Duration
+}
+
+// ArchiveConfig uploads a backup to an S3-compatible bucket every
+// Interval, when Bucket is set, or writes it to the local directory Dir,
+// keeping at most Keep backups no older than MaxAge (0 meaning unbounded).
+// Operations older than HistoryRetention, if set, are exported there too
+// and pruned from history. With ExportInterval set, the accounts and new
+// operations are dumped there that often for analytics warehouses, as
+// ExportFormat files, csv or parquet. With Plugin, the name of a plugin
+// providing storage, they are kept there instead.
+type ArchiveConfig struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Dir       string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	Interval  time.Duration
+	Keep      int
+	MaxAge    time.Duration
+
+	HistoryRetention time.Duration
+	Compression      string // of the backups, gzip or snappy, none if empty
+
+	ExportInterval time.Duration
+	ExportFormat   string
+
+	Plugin string
+}
+
+func (a ArchiveConfig) Enabled() bool {
+	return a.Bucket != "" || a.Dir != "" || a.Plugin != ""
+}
+
+// RetryConfig is the retry policy of storage writes, webhook deliveries
+// and event publishing: up to MaxAttempts attempts, waiting Backoff after
+// the first failure and twice as long after each next one, up to
+// MaxBackoff, with Jitter, from 0 to 1, the fraction of each wait
+// randomized.
+type RetryConfig struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	Jitter      float64
+}
+
+// BreakerConfig configures the circuit breakers of external dependencies,
+// e.g. the archive: each opens after Threshold failures in a row, failing
+// calls fast for Cooldown before letting a probe through.
+type BreakerConfig struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// AuthConfig enables API authentication when a JWT secret or at least one
+// API key is set.
+type AuthConfig struct {
+	JWTSecret string
+	APIKeys   map[string]APIKey // keyed by the key itself
+}
+
+// APIKey is configured as "subject:role" or "subject:role:acc1,acc2".
+type APIKey struct {
+	Subject  string
+	Role     string
+	Accounts []string
+}
+
+func (a AuthConfig) Enabled() bool {
+	return a.JWTSecret != "" || len(a.APIKeys) > 0
+}
+
+// Sweep moves everything above Target from one account to another every day
+// at At, the time since midnight UTC. It is configured as
+// "from:to:target@15:04".
+type Sweep struct {
+	From   string
+	To     string
+	Target int
+	At     time.Duration
+}
+
+// SignerSet makes withdrawals and transfers out of an account wait for
+// Required of its Signers. It is configured as "2:alice,bob,carol".
+type SignerSet struct {
+	Required int
+	Signers  []string
+}
+
+type LimitsConfig struct {
+	Workers    int // number of operations applied concurrently by the dispatcher
+	QueueSize  int // operations queued before submitters are pushed back
+	MaxHistory int // max number of snapshots kept for rollback, 0 means unbounded
+
+	// Every CompactInterval, history older than the newest CompactKeep
+	// states is compacted down to its full snapshots. A zero interval
+	// disables compaction.
+	CompactInterval time.Duration
+	CompactKeep     int
+
+	// Once the state machine holds more than MemoryLimit bytes, history is
+	// compacted, then operations are refused. Zero disables the limit.
+	MemoryLimit int64
+
+	// Accounts touched at HotRate operations per second or more, or whose
+	// operations wait HotLockWait or more for the state lock, are hot. With
+	// HotQueue, operations on a hot account queue for it. Zero thresholds
+	// disable detection.
+	HotRate     float64
+	HotLockWait time.Duration
+	HotQueue    bool
+
+	// Accounts locked by external coordinators are released LockTimeout
+	// after being locked, 30 seconds if zero.
+	LockTimeout time.Duration
+
+	// Accounts no operation touched for DormantAfter are archived. Zero
+	// disables archival.
+	DormantAfter time.Duration
+
+	// Transfers above ApprovalThreshold wait up to ApprovalTTL for a second
+	// actor's approval. A zero threshold disables approvals.
+	ApprovalThreshold int
+	ApprovalTTL       time.Duration
+
+	// Policies is a YAML or JSON file of policies constraining operations,
+	// reloaded whenever it changes.
+	Policies string
+
+	// Token bucket rate limits in operations per second, 0 disables a limit.
+	GlobalRate   float64
+	GlobalBurst  int
+	AccountRate  float64
+	AccountBurst int
+	ClientRate   float64
+	ClientBurst  int
+}
+
+// Default returns the configuration used when no file or environment
+// overrides are given.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Addr:            ":8080",
+			ShutdownTimeout: 10 * time.Second,
+		},
+		Storage: StorageConfig{
+			Dir:                "data",
+			CheckpointInterval: time.Minute,
+		},
+		Replication: ReplicationConfig{
+			MaxStaleness: 5 * time.Second,
+		},
+		Archive: ArchiveConfig{
+			Endpoint: "https://s3.amazonaws.com",
+			Region:   "us-east-1",
+			Interval: time.Hour,
+		},
+		Limits: LimitsConfig{
+			Workers:     4,
+			QueueSize:   64,
+			ApprovalTTL: 24 * time.Hour,
+			CompactKeep: 1000,
+		},
+		Retry: RetryConfig{
+			MaxAttempts: 5,
+			Backoff:     100 * time.Millisecond,
+			MaxBackoff:  10 * time.Second,
+			Jitter:      0.2,
+		},
+		Breaker: BreakerConfig{
+			Threshold: 5,
+			Cooldown:  30 * time.Second,
+		},
+		Accounts: map[string]int{
+			"acc1": 1000,
+			"acc2": 500,
+			"acc3": 300,
+		},
+	}
+}
+
+// Load builds a Config from the defaults, the file at path (if path is not
+// empty) and finally the environment, in that order of precedence.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		values, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := cfg.apply(values); err != nil {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.apply(readEnv(os.Environ())); err != nil {
+		return nil, fmt.Errorf("config env: %w", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// Validate reports the first invalid setting found in cfg.
+func (cfg *Config) Validate() error {
+	if cfg.Server.ShutdownTimeout < 0 {
+		return fmt.Errorf("invalid server.shutdown_timeout (%s)", cfg.Server.ShutdownTimeout)
+	}
+	if cfg.Server.OperationTimeout < 0 {
+		return fmt.Errorf("invalid server.operation_timeout (%s)", cfg.Server.OperationTimeout)
+	}
+	if cfg.Server.MaxQueueDepth < 0 || cfg.Server.MaxQueueLatency < 0 {
+		return fmt.Errorf("invalid server.max_queue_depth (%d) or server.max_queue_latency (%s)", cfg.Server.MaxQueueDepth, cfg.Server.MaxQueueLatency)
+	}
+	if (cfg.Server.TLSCert == "") != (cfg.Server.TLSKey == "") {
+		return fmt.Errorf("server.tls_cert and server.tls_key must be set together")
+	}
+	if (cfg.Server.ClientCA != "" || cfg.Server.RequireClientCert) && !cfg.Server.TLSEnabled() {
+		return fmt.Errorf("client certificate verification requires server.tls_cert and server.tls_key")
+	}
+	if cfg.Server.RequireClientCert && cfg.Server.ClientCA == "" {
+		return fmt.Errorf("server.require_client_cert requires server.client_ca")
+	}
+	if cfg.Replication.MaxStaleness <= 0 {
+		return fmt.Errorf("invalid replication.max_staleness (%s), must be positive", cfg.Replication.MaxStaleness)
+	}
+	if cfg.Storage.SegmentSize < 0 || cfg.Storage.SegmentAge < 0 {
+		return fmt.Errorf("invalid storage.segment_size (%d) or storage.segment_age (%s)", cfg.Storage.SegmentSize, cfg.Storage.SegmentAge)
+	}
+	if s := cfg.Storage.Sync; s != "" && s != "always" && s != "batch" && s != "async" {
+		return fmt.Errorf("invalid storage.sync (%s), want always, batch or async", s)
+	}
+	if cfg.Storage.SyncInterval < 0 || cfg.Storage.GroupWindow < 0 {
+		return fmt.Errorf("invalid storage.sync_interval (%s) or storage.group_window (%s)", cfg.Storage.SyncInterval, cfg.Storage.GroupWindow)
+	}
+	if cfg.Storage.CheckpointInterval < 0 {
+		return fmt.Errorf("invalid storage.checkpoint_interval (%s)", cfg.Storage.CheckpointInterval)
+	}
+	if _, ok := cfg.Keys[cfg.Storage.Key]; !ok && (cfg.Storage.Key != "" || len(cfg.Keys) > 0) {
+		return fmt.Errorf("invalid storage.key (%s), must name one of keys", cfg.Storage.Key)
+	}
+	for id, key := range cfg.Keys {
+		if data, err := base64.StdEncoding.DecodeString(key); err != nil || len(data) != 16 && len(data) != 24 && len(data) != 32 {
+			return fmt.Errorf("invalid key %s, want 16, 24 or 32 bytes in base64", id)
+		}
+	}
+	if cfg.Archive.Enabled() && cfg.Archive.Interval <= 0 {
+		return fmt.Errorf("invalid archive.interval (%s), must be positive", cfg.Archive.Interval)
+	}
+	if cfg.Archive.Keep < 0 || cfg.Archive.MaxAge < 0 {
+		return fmt.Errorf("invalid archive.keep (%d) or archive.max_age (%s)", cfg.Archive.Keep, cfg.Archive.MaxAge)
+	}
+	if cfg.Archive.Bucket != "" && cfg.Archive.Dir != "" {
+		return fmt.Errorf("archive.bucket (%s) and archive.dir (%s) are exclusive", cfg.Archive.Bucket, cfg.Archive.Dir)
+	}
+	if name := cfg.Archive.Plugin; name != "" && (cfg.Archive.Bucket != "" || cfg.Archive.Dir != "" || cfg.Plugins[name] == "") {
+		return fmt.Errorf("invalid archive.plugin (%s), must name a plugin and exclude archive.bucket and archive.dir", name)
+	}
+	if cfg.Archive.HistoryRetention < 0 || cfg.Archive.HistoryRetention > 0 && !cfg.Archive.Enabled() {
+		return fmt.Errorf("invalid archive.history_retention (%s), needs archive.bucket or archive.dir", cfg.Archive.HistoryRetention)
+	}
+	if c := cfg.Archive.Compression; c != "" && c != "gzip" && c != "snappy" {
+		return fmt.Errorf("invalid archive.compression (%s), want gzip or snappy", c)
+	}
+	if cfg.Archive.ExportInterval < 0 || cfg.Archive.ExportInterval > 0 && !cfg.Archive.Enabled() {
+		return fmt.Errorf("invalid archive.export_interval (%s), needs archive.bucket or archive.dir", cfg.Archive.ExportInterval)
+	}
+	if f := cfg.Archive.ExportFormat; f != "" && f != "csv" && f != "parquet" {
+		return fmt.Errorf("invalid archive.export_format (%s), want csv or parquet", f)
+	}
+	if cfg.Limits.Workers <= 0 {
+		return fmt.Errorf("invalid limits.workers (%d), must be positive", cfg.Limits.Workers)
+	}
+	if cfg.Limits.QueueSize < 0 {
+		return fmt.Errorf("invalid limits.queue_size (%d)", cfg.Limits.QueueSize)
+	}
+	if cfg.Limits.ApprovalThreshold < 0 || cfg.Limits.ApprovalTTL <= 0 {
+		return fmt.Errorf("invalid limits.approval_threshold (%d) or limits.approval_ttl (%s)", cfg.Limits.ApprovalThreshold, cfg.Limits.ApprovalTTL)
+	}
+	if cfg.Limits.MaxHistory < 0 {
+		return fmt.Errorf("invalid limits.max_history (%d)", cfg.Limits.MaxHistory)
+	}
+	if cfg.Limits.CompactInterval < 0 || cfg.Limits.CompactKeep < 0 {
+		return fmt.Errorf("invalid limits.compact_interval (%s) or limits.compact_keep (%d)", cfg.Limits.CompactInterval, cfg.Limits.CompactKeep)
+	}
+	if cfg.Limits.MemoryLimit < 0 {
+		return fmt.Errorf("invalid limits.memory_limit (%d)", cfg.Limits.MemoryLimit)
+	}
+	if cfg.Limits.HotRate < 0 || cfg.Limits.HotLockWait < 0 {
+		return fmt.Errorf("invalid limits.hot_rate (%g) or limits.hot_lock_wait (%s)", cfg.Limits.HotRate, cfg.Limits.HotLockWait)
+	}
+	if cfg.Limits.LockTimeout < 0 {
+		return fmt.Errorf("invalid limits.lock_timeout (%s)", cfg.Limits.LockTimeout)
+	}
+	if cfg.Limits.DormantAfter < 0 {
+		return fmt.Errorf("invalid limits.dormant_after (%s)", cfg.Limits.DormantAfter)
+	}
+	for _, limit := range []struct {
+		name  string
+		rate  float64
+		burst int
+	}{
+		{"global", cfg.Limits.GlobalRate, cfg.Limits.GlobalBurst},
+		{"account", cfg.Limits.AccountRate, cfg.Limits.AccountBurst},
+		{"client", cfg.Limits.ClientRate, cfg.Limits.ClientBurst},
+	} {
+		if limit.rate < 0 || limit.burst < 0 {
+			return fmt.Errorf("invalid limits.%s_rate (%g) or limits.%s_burst (%d)", limit.name, limit.rate, limit.name, limit.burst)
+		}
+	}
+	if cfg.Retry.MaxAttempts < 1 || cfg.Retry.Backoff < 0 || cfg.Retry.MaxBackoff < 0 {
+		return fmt.Errorf("invalid retry.max_attempts (%d), retry.backoff (%s) or retry.max_backoff (%s)", cfg.Retry.MaxAttempts, cfg.Retry.Backoff, cfg.Retry.MaxBackoff)
+	}
+	if cfg.Retry.Jitter < 0 || cfg.Retry.Jitter > 1 {
+		return fmt.Errorf("invalid retry.jitter (%g), must be from 0 to 1", cfg.Retry.Jitter)
+	}
+	if cfg.Breaker.Threshold < 1 || cfg.Breaker.Cooldown <= 0 {
+		return fmt.Errorf("invalid breaker.threshold (%d) or breaker.cooldown (%s), must be positive", cfg.Breaker.Threshold, cfg.Breaker.Cooldown)
+	}
+	for _, key := range cfg.Auth.APIKeys {
+		switch key.Role {
+		case "read-only", "operator", "admin":
+		default:
+			return fmt.Errorf("invalid role (%s) for api key of %s", key.Role, key.Subject)
+		}
+	}
+	for name, sweep := range cfg.Sweeps {
+		if sweep.From == "" || sweep.To == "" || sweep.From == sweep.To {
+			return fmt.Errorf("invalid accounts (%s to %s) for sweep %s", sweep.From, sweep.To, name)
+		}
+		if sweep.Target < 0 {
+			return fmt.Errorf("invalid target (%d) for sweep %s", sweep.Target, name)
+		}
+	}
+	for id, set := range cfg.Signers {
+		if set.Required < 1 || set.Required > len(set.Signers) {
+			return fmt.Errorf("invalid signers (%d of %d required) for account %s", set.Required, len(set.Signers), id)
+		}
+	}
+	for name, source := range cfg.Scripts {
+		if strings.TrimSpace(source) == "" {
+			return fmt.Errorf("empty script %s", name)
+		}
+	}
+	if len(cfg.Accounts) == 0 {
+		return fmt.Errorf("no accounts configured")
+	}
+	for id, balance := range cfg.Accounts {
+		if id == "" {
+			return fmt.Errorf("empty account id")
+		}
+		if strings.Contains(id, "#") {
+			return fmt.Errorf("invalid account id (%s), must not contain #, which separates buckets", id)
+		}
+		if balance < 0 {
+			return fmt.Errorf("invalid initial balance (%d) for account %s", balance, id)
+		}
+	}
+	return nil
+}
+
+// AccountIDs returns the configured account ids in sorted order.
+func (cfg *Config) AccountIDs() []string {
+	ids := make([]string, 0, len(cfg.Accounts))
+	for id := range cfg.Accounts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// apply copies the flattened "section.key" values onto cfg. An "accounts"
+// entry replaces the default accounts entirely rather than merging with them.
+func (cfg *Config) apply(values map[string]string) error {
+	var accounts map[string]int
+
+	for key, value := range values {
+		var err error
+		switch key {
+		case "server.addr":
+			cfg.Server.Addr = value
+		case "server.shutdown_timeout":
+			cfg.Server.ShutdownTimeout, err = time.ParseDuration(value)
+		case "server.operation_timeout":
+			cfg.Server.OperationTimeout, err = time.ParseDuration(value)
+		case "server.max_queue_depth":
+			cfg.Server.MaxQueueDepth, err = strconv.Atoi(value)
+		case "server.max_queue_latency":
+			cfg.Server.MaxQueueLatency, err = time.ParseDuration(value)
+		case "server.tls_cert":
+			cfg.Server.TLSCert = value
+		case "server.tls_key":
+			cfg.Server.TLSKey = value
+		case "server.client_ca":
+			cfg.Server.ClientCA = value
+		case "server.require_client_cert":
+			cfg.Server.RequireClientCert, err = strconv.ParseBool(value)
+		case "storage.dir":
+			cfg.Storage.Dir = value
+		case "storage.outbox":
+			cfg.Storage.Outbox, err = strconv.ParseBool(value)
+		case "storage.wal":
+			cfg.Storage.WAL, err = strconv.ParseBool(value)
+		case "storage.segment_size":
+			cfg.Storage.SegmentSize, err = strconv.ParseInt(value, 10, 64)
+		case "storage.segment_age":
+			cfg.Storage.SegmentAge, err = time.ParseDuration(value)
+		case "storage.sync":
+			cfg.Storage.Sync = value
+		case "storage.sync_interval":
+			cfg.Storage.SyncInterval, err = time.ParseDuration(value)
+		case "storage.group_window":
+			cfg.Storage.GroupWindow, err = time.ParseDuration(value)
+		case "storage.checkpoint_interval":
+			cfg.Storage.CheckpointInterval, err = time.ParseDuration(value)
+		case "storage.key":
+			cfg.Storage.Key = value
+		case "replication.leader":
+			cfg.Replication.Leader = value
+		case "replication.api_key":
+			cfg.Replication.APIKey = value
+		case "replication.max_staleness":
+			cfg.Replication.MaxStaleness, err = time.ParseDuration(value)
+		case "archive.endpoint":
+			cfg.Archive.Endpoint = value
+		case "archive.region":
+			cfg.Archive.Region = value
+		case "archive.bucket":
+			cfg.Archive.Bucket = value
+		case "archive.dir":
+			cfg.Archive.Dir = value
+		case "archive.prefix":
+			cfg.Archive.Prefix = value
+		case "archive.access_key":
+			cfg.Archive.AccessKey = value
+		case "archive.secret_key":
+			cfg.Archive.SecretKey = value
+		case "archive.interval":
+			cfg.Archive.Interval, err = time.ParseDuration(value)
+		case "archive.keep":
+			cfg.Archive.Keep, err = strconv.Atoi(value)
+		case "archive.max_age":
+			cfg.Archive.MaxAge, err = time.ParseDuration(value)
+		case "archive.history_retention":
+			cfg.Archive.HistoryRetention, err = time.ParseDuration(value)
+		case "archive.compression":
+			cfg.Archive.Compression = value
+		case "archive.export_interval":
+			cfg.Archive.ExportInterval, err = time.ParseDuration(value)
+		case "archive.export_format":
+			cfg.Archive.ExportFormat = value
+		case "archive.plugin":
+			cfg.Archive.Plugin = value
+		case "limits.workers":
+			cfg.Limits.Workers, err = strconv.Atoi(value)
+		case "limits.queue_size":
+			cfg.Limits.QueueSize, err = strconv.Atoi(value)
+		case "limits.max_history":
+			cfg.Limits.MaxHistory, err = strconv.Atoi(value)
+		case "limits.compact_interval":
+			cfg.Limits.CompactInterval, err = time.ParseDuration(value)
+		case "limits.compact_keep":
+			cfg.Limits.CompactKeep, err = strconv.Atoi(value)
+		case "limits.memory_limit":
+			cfg.Limits.MemoryLimit, err = strconv.ParseInt(value, 10, 64)
+		case "limits.hot_rate":
+			cfg.Limits.HotRate, err = strconv.ParseFloat(value, 64)
+		case "limits.hot_lock_wait":
+			cfg.Limits.HotLockWait, err = time.ParseDuration(value)
+		case "limits.hot_queue":
+			cfg.Limits.HotQueue, err = strconv.ParseBool(value)
+		case "limits.policies":
+			cfg.Limits.Policies = value
+		case "limits.lock_timeout":
+			cfg.Limits.LockTimeout, err = time.ParseDuration(value)
+		case "limits.dormant_after":
+			cfg.Limits.DormantAfter, err = time.ParseDuration(value)
+		case "retry.max_attempts":
+			cfg.Retry.MaxAttempts, err = strconv.Atoi(value)
+		case "retry.backoff":
+			cfg.Retry.Backoff, err = time.ParseDuration(value)
+		case "retry.max_backoff":
+			cfg.Retry.MaxBackoff, err = time.ParseDuration(value)
+		case "retry.jitter":
+			cfg.Retry.Jitter, err = strconv.ParseFloat(value, 64)
+		case "breaker.threshold":
+			cfg.Breaker.Threshold, err = strconv.Atoi(value)
+		case "breaker.cooldown":
+			cfg.Breaker.Cooldown, err = time.ParseDuration(value)
+		case "auth.jwt_secret":
+			cfg.Auth.JWTSecret = value
+		case "limits.approval_threshold":
+			cfg.Limits.ApprovalThreshold, err = strconv.Atoi(value)
+		case "limits.approval_ttl":
+			cfg.Limits.ApprovalTTL, err = time.ParseDuration(value)
+		case "limits.global_rate":
+			cfg.Limits.GlobalRate, err = strconv.ParseFloat(value, 64)
+		case "limits.global_burst":
+			cfg.Limits.GlobalBurst, err = strconv.Atoi(value)
+		case "limits.account_rate":
+			cfg.Limits.AccountRate, err = strconv.ParseFloat(value, 64)
+		case "limits.account_burst":
+			cfg.Limits.AccountBurst, err = strconv.Atoi(value)
+		case "limits.client_rate":
+			cfg.Limits.ClientRate, err = strconv.ParseFloat(value, 64)
+		case "limits.client_burst":
+			cfg.Limits.ClientBurst, err = strconv.Atoi(value)
+		default:
+			if apiKey, ok := strings.CutPrefix(key, "api_keys."); ok {
+				err = cfg.addAPIKey(apiKey, value)
+				break
+			}
+			if sweep, ok := strings.CutPrefix(key, "sweeps."); ok {
+				err = cfg.addSweep(sweep, value)
+				break
+			}
+			if account, ok := strings.CutPrefix(key, "signers."); ok {
+				err = cfg.addSigners(account, value)
+				break
+			}
+			if flag, ok := strings.CutPrefix(key, "features."); ok {
+				var enabled bool
+				if enabled, err = strconv.ParseBool(value); err == nil {
+					if cfg.Features == nil {
+						cfg.Features = make(map[string]bool)
+					}
+					cfg.Features[flag] = enabled
+				}
+				break
+			}
+
+			if name, ok := strings.CutPrefix(key, "plugins."); ok {
+				if cfg.Plugins == nil {
+					cfg.Plugins = make(map[string]string)
+				}
+				cfg.Plugins[name] = value
+				break
+			}
+			if name, ok := strings.CutPrefix(key, "scripts."); ok {
+				if cfg.Scripts == nil {
+					cfg.Scripts = make(map[string]string)
+				}
+				cfg.Scripts[name] = value
+				break
+			}
+			if id, ok := strings.CutPrefix(key, "keys."); ok {
+				if cfg.Keys == nil {
+					cfg.Keys = make(map[string]string)
+				}
+				cfg.Keys[id] = value
+				break
+			}
+
+			id, ok := strings.CutPrefix(key, "accounts.")
+			if !ok {
+				return fmt.Errorf("unknown setting %q", key)
+			}
+			if accounts == nil {
+				accounts = make(map[string]int)
+			}
+			accounts[id], err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value %q for %s: %w", value, key, err)
+		}
+	}
+
+	if accounts != nil {
+		cfg.Accounts = accounts
+	}
+	return nil
+}
+
+func (cfg *Config) addAPIKey(key, value string) error {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) < 2 || parts[0] == "" {
+		return fmt.Errorf("want \"subject:role[:accounts]\"")
+	}
+
+	apiKey := APIKey{Subject: parts[0], Role: parts[1]}
+	if len(parts) == 3 && parts[2] != "" {
+		apiKey.Accounts = strings.Split(parts[2], ",")
+	}
+
+	if cfg.Auth.APIKeys == nil {
+		cfg.Auth.APIKeys = make(map[string]APIKey)
+	}
+	cfg.Auth.APIKeys[key] = apiKey
+	return nil
+}
+
+func (cfg *Config) addSweep(name, value string) error {
+	accounts, at, ok := strings.Cut(value, "@")
+	parts := strings.Split(accounts, ":")
+	if !ok || len(parts) != 3 {
+		return fmt.Errorf("want \"from:to:target@15:04\"")
+	}
+
+	sweep := Sweep{From: parts[0], To: parts[1]}
+	var err error
+	if sweep.Target, err = strconv.Atoi(parts[2]); err != nil {
+		return err
+	}
+	clock, err := time.Parse("15:04", at)
+	if err != nil {
+		return err
+	}
+	sweep.At = time.Duration(clock.Hour())*time.Hour + time.Duration(clock.Minute())*time.Minute
+
+	if cfg.Sweeps == nil {
+		cfg.Sweeps = make(map[string]Sweep)
+	}
+	cfg.Sweeps[name] = sweep
+	return nil
+}
+
+func (cfg *Config) addSigners(account, value string) error {
+	required, signers, ok := strings.Cut(value, ":")
+	if !ok || signers == "" {
+		return fmt.Errorf("want \"required:signer,signer\"")
+	}
+
+	set := SignerSet{Signers: strings.Split(signers, ",")}
+	var err error
+	if set.Required, err = strconv.Atoi(required); err != nil {
+		return err
+	}
+
+	if cfg.Signers == nil {
+		cfg.Signers = make(map[string]SignerSet)
+	}
+	cfg.Signers[account] = set
+	return nil
+}
+
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read config: %w", err)
+	}
+
+	var values map[string]string
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		values, err = parseYAML(data)
+	case ".toml":
+		values, err = parseTOML(data)
+	case ".json":
+		values, err = parseJSON(data)
+	default:
+		return nil, fmt.Errorf("unsupported config format %q", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// readEnv maps VAULTFLOW_SECTION_KEY variables onto "section.key". Keys
+// written in upper case are lowercased, while mixed-case keys, e.g. the name
+// in VAULTFLOW_SCRIPTS_nightlySweep, are kept as they are. Accounts are given
+// as a single list: VAULTFLOW_ACCOUNTS="acc1=1000,acc2=500".
+func readEnv(environ []string) map[string]string {
+	values := make(map[string]string)
+	for _, kv := range environ {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		name, ok = strings.CutPrefix(name, EnvPrefix)
+		if !ok || name == "CONFIG" {
+			continue
+		}
+
+		if name == "ACCOUNTS" {
+			for _, entry := range strings.Split(value, ",") {
+				id, balance, _ := strings.Cut(strings.TrimSpace(entry), "=")
+				if id != "" {
+					values["accounts."+id] = balance
+				}
+			}
+			continue
+		}
+
+		section, key, ok := strings.Cut(name, "_")
+		if !ok {
+			continue
+		}
+		if key == strings.ToUpper(key) {
+			key = strings.ToLower(key)
+		}
+		values[strings.ToLower(section)+"."+key] = value
+	}
+	return values
+}
+
+// parseYAML understands the two-level subset of YAML used by vaultflow
+// config files: top-level sections holding scalar "key: value" pairs.
+func parseYAML(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	section := ""
+
+	for n, line := range strings.Split(string(data), "\n") {
+		line = stripComment(line)
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		indented := line[0] == ' ' || line[0] == '\t'
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", n+1)
+		}
+		key, value = strings.TrimSpace(key), unquote(strings.TrimSpace(value))
+
+		switch {
+		case !indented && value == "":
+			section = key
+		case indented && section != "":
+			values[section+"."+key] = value
+		default:
+			return nil, fmt.Errorf("line %d: setting %q outside of a section", n+1, key)
+		}
+	}
+	return values, nil
+}
+
+// parseTOML understands "[section]" tables holding scalar "key = value" pairs.
+func parseTOML(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	section := ""
+
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key = value\"", n+1)
+		}
+		if section == "" {
+			return nil, fmt.Errorf("line %d: setting %q outside of a table", n+1, strings.TrimSpace(key))
+		}
+		values[section+"."+unquote(strings.TrimSpace(key))] = unquote(strings.TrimSpace(value))
+	}
+	return values, nil
+}
+
+func parseJSON(data []byte) (map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var sections map[string]map[string]any
+	if err := decoder.Decode(&sections); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for section, settings := range sections {
+		for key, value := range settings {
+			values[section+"."+key] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// stripComment cuts a line at the first '#' outside of a quoted value, so
+// that password: "a#b" keeps its '#'. Quotes only open a value, not within
+// one, as in memo: don't.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t:=", line[i-1]) >= 0):
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,275 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadFormats(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{
+			name: "YAML",
+			file: "vaultflow.yaml",
+			content: `
+server:
+  addr: ":9090"  # listen address
+  shutdown_timeout: 5s
+limits:
+  workers: 8
+  policies: /etc/vaultflow/policies.yaml
+api_keys:
+  k1: alice:operator:alice,bob
+sweeps:
+  nightly: alice:bob:80@17:30
+signers:
+  alice: 2:alice,bob,carol
+features:
+  state_reads: false
+plugins:
+  audit: ./plugins/audit
+scripts:
+  cap: when op.amount > 500 then reject('too large')
+accounts:
+  alice: 100
+  bob: 50
+`,
+		},
+		{
+			name: "TOML",
+			file: "vaultflow.toml",
+			content: `
+[server]
+addr = ":9090"
+shutdown_timeout = "5s"
+
+[limits]
+workers = 8
+policies = "/etc/vaultflow/policies.yaml"
+
+[api_keys]
+k1 = "alice:operator:alice,bob"
+
+[sweeps]
+nightly = "alice:bob:80@17:30"
+
+[signers]
+alice = "2:alice,bob,carol"
+
+[features]
+state_reads = false
+
+[plugins]
+audit = "./plugins/audit"
+
+[scripts]
+cap = "when op.amount > 500 then reject('too large')"
+
+[accounts]
+alice = 100
+bob = 50
+`,
+		},
+		{
+			name: "JSON",
+			file: "vaultflow.json",
+			content: `{
+  "server": {"addr": ":9090", "shutdown_timeout": "5s"},
+  "limits": {"workers": 8, "policies": "/etc/vaultflow/policies.yaml"},
+  "api_keys": {"k1": "alice:operator:alice,bob"},
+  "sweeps": {"nightly": "alice:bob:80@17:30"},
+  "signers": {"alice": "2:alice,bob,carol"},
+  "features": {"state_reads": false},
+  "plugins": {"audit": "./plugins/audit"},
+  "scripts": {"cap": "when op.amount > 500 then reject('too large')"},
+  "accounts": {"alice": 100, "bob": 50}
+}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := Load(path)
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+
+			if cfg.Server.Addr != ":9090" {
+				t.Errorf("Server.Addr = %q; want %q", cfg.Server.Addr, ":9090")
+			}
+			if cfg.Server.ShutdownTimeout != 5*time.Second {
+				t.Errorf("Server.ShutdownTimeout = %s; want 5s", cfg.Server.ShutdownTimeout)
+			}
+			if cfg.Limits.Workers != 8 {
+				t.Errorf("Limits.Workers = %d; want 8", cfg.Limits.Workers)
+			}
+			if cfg.Limits.Policies != "/etc/vaultflow/policies.yaml" {
+				t.Errorf("Limits.Policies = %q; want /etc/vaultflow/policies.yaml", cfg.Limits.Policies)
+			}
+			if cfg.Storage.Dir != Default().Storage.Dir {
+				t.Errorf("Storage.Dir = %q; want default %q", cfg.Storage.Dir, Default().Storage.Dir)
+			}
+			if len(cfg.Accounts) != 2 || cfg.Accounts["alice"] != 100 || cfg.Accounts["bob"] != 50 {
+				t.Errorf("Accounts = %v; want map[alice:100 bob:50]", cfg.Accounts)
+			}
+			if key := cfg.Auth.APIKeys["k1"]; key.Subject != "alice" || key.Role != "operator" || len(key.Accounts) != 2 {
+				t.Errorf("APIKeys[k1] = %+v; want alice operator owning 2 accounts", key)
+			}
+			if expected := (Sweep{From: "alice", To: "bob", Target: 80, At: 17*time.Hour + 30*time.Minute}); cfg.Sweeps["nightly"] != expected {
+				t.Errorf("Sweeps[nightly] = %+v; want %+v", cfg.Sweeps["nightly"], expected)
+			}
+			if set := cfg.Signers["alice"]; set.Required != 2 || len(set.Signers) != 3 {
+				t.Errorf("Signers[alice] = %+v; want 2 of 3 signers", set)
+			}
+			if enabled, ok := cfg.Features["state_reads"]; !ok || enabled {
+				t.Errorf("Features = %v; want state_reads off", cfg.Features)
+			}
+			if cfg.Plugins["audit"] != "./plugins/audit" {
+				t.Errorf("Plugins = %v; want map[audit:./plugins/audit]", cfg.Plugins)
+			}
+			if cfg.Scripts["cap"] != "when op.amount > 500 then reject('too large')" {
+				t.Errorf("Scripts = %v; want the cap script", cfg.Scripts)
+			}
+		})
+	}
+}
+
+func TestLoadEnvOverridesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vaultflow.yaml")
+	if err := os.WriteFile(path, []byte("limits:\n  workers: 8\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("VAULTFLOW_LIMITS_WORKERS", "2")
+	t.Setenv("VAULTFLOW_LIMITS_MAX_HISTORY", "10")
+	t.Setenv("VAULTFLOW_LIMITS_CLIENT_RATE", "2.5")
+	t.Setenv("VAULTFLOW_ACCOUNTS", "acc1=10, acc2=20")
+	t.Setenv("VAULTFLOW_REPLICATION_LEADER", "http://leader:8080")
+	t.Setenv("VAULTFLOW_REPLICATION_MAX_STALENESS", "2s")
+	t.Setenv("VAULTFLOW_RETRY_MAX_ATTEMPTS", "3")
+	t.Setenv("VAULTFLOW_RETRY_BACKOFF", "1s")
+	t.Setenv("VAULTFLOW_SCRIPTS_nightlySweep", "when true then reject('x')")
+	t.Setenv("VAULTFLOW_STORAGE_KEY", "k1")
+	t.Setenv("VAULTFLOW_KEYS_k1", "MDEyMzQ1Njc4OWFiY2RlZg==")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	if cfg.Limits.Workers != 2 {
+		t.Errorf("Limits.Workers = %d; want 2", cfg.Limits.Workers)
+	}
+	if cfg.Limits.MaxHistory != 10 {
+		t.Errorf("Limits.MaxHistory = %d; want 10", cfg.Limits.MaxHistory)
+	}
+	if cfg.Limits.ClientRate != 2.5 {
+		t.Errorf("Limits.ClientRate = %g; want 2.5", cfg.Limits.ClientRate)
+	}
+	if cfg.Replication.Leader != "http://leader:8080" || cfg.Replication.MaxStaleness != 2*time.Second {
+		t.Errorf("Replication = %+v; want leader http://leader:8080 and max staleness 2s", cfg.Replication)
+	}
+	if cfg.Retry.MaxAttempts != 3 || cfg.Retry.Backoff != time.Second || cfg.Retry.MaxBackoff != Default().Retry.MaxBackoff {
+		t.Errorf("Retry = %+v; want 3 attempts with a 1s backoff", cfg.Retry)
+	}
+	if len(cfg.Accounts) != 2 || cfg.Accounts["acc1"] != 10 || cfg.Accounts["acc2"] != 20 {
+		t.Errorf("Accounts = %v; want map[acc1:10 acc2:20]", cfg.Accounts)
+	}
+	if _, ok := cfg.Scripts["nightlySweep"]; !ok {
+		t.Errorf("Scripts = %v; want nightlySweep with its case kept", cfg.Scripts)
+	}
+	if cfg.Storage.Key != "k1" || cfg.Keys["k1"] != "MDEyMzQ1Njc4OWFiY2RlZg==" {
+		t.Errorf("Storage.Key = %q with keys %v; want k1 with its key", cfg.Storage.Key, cfg.Keys)
+	}
+}
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`  workers: 8 # comment`, `  workers: 8 `},
+		{`# comment`, ``},
+		{`  password: "a#b"`, `  password: "a#b"`},
+		{`  password: 'a#b' # comment`, `  password: 'a#b' `},
+		{`secret = "a#b"`, `secret = "a#b"`},
+		{`  memo: don't # comment`, `  memo: don't `},
+	}
+	for _, tt := range tests {
+		if got := stripComment(tt.line); got != tt.want {
+			t.Errorf("stripComment(%q) = %q; want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+	}{
+		{name: "Zero workers", file: "c.yaml", content: "limits:\n  workers: 0\n"},
+		{name: "Negative balance", file: "c.toml", content: "[accounts]\nacc1 = -5\n"},
+		{name: "Account id with a bucket separator", file: "c.json", content: `{"accounts": {"acc1#reserved": 5}}`},
+		{name: "Unknown setting", file: "c.yaml", content: "server:\n  port: 80\n"},
+		{name: "Unknown storage key", file: "c.yaml", content: "storage:\n  key: k2\nkeys:\n  k1: MDEyMzQ1Njc4OWFiY2RlZg==\n"},
+		{name: "Keys without a storage key", file: "c.yaml", content: "keys:\n  k1: MDEyMzQ1Njc4OWFiY2RlZg==\n"},
+		{name: "Short key", file: "c.yaml", content: "storage:\n  key: k1\nkeys:\n  k1: c2hvcnQ=\n"},
+		{name: "Invalid role", file: "c.yaml", content: "api_keys:\n  k1: alice:root\n"},
+		{name: "TLS key without cert", file: "c.yaml", content: "server:\n  tls_key: key.pem\n"},
+		{name: "Client CA without TLS", file: "c.yaml", content: "server:\n  client_ca: ca.pem\n"},
+		{name: "Negative rate", file: "c.yaml", content: "limits:\n  account_rate: -1\n"},
+		{name: "Negative compaction keep", file: "c.yaml", content: "limits:\n  compact_keep: -1\n"},
+		{name: "Negative memory limit", file: "c.yaml", content: "limits:\n  memory_limit: -1\n"},
+		{name: "Negative hot rate", file: "c.yaml", content: "limits:\n  hot_rate: -1\n"},
+		{name: "Negative lock timeout", file: "c.yaml", content: "limits:\n  lock_timeout: -1s\n"},
+		{name: "Negative dormancy", file: "c.yaml", content: "limits:\n  dormant_after: -1h\n"},
+		{name: "Negative queue depth", file: "c.yaml", content: "server:\n  max_queue_depth: -1\n"},
+		{name: "Negative archive keep", file: "c.yaml", content: "archive:\n  keep: -1\n"},
+		{name: "Bucket and dir", file: "c.yaml", content: "archive:\n  bucket: b\n  dir: /tmp/a\n"},
+		{name: "Retention without archive", file: "c.yaml", content: "archive:\n  history_retention: 720h\n"},
+		{name: "Unknown compression", file: "c.yaml", content: "archive:\n  compression: zstd\n"},
+		{name: "Exports without archive", file: "c.yaml", content: "archive:\n  export_interval: 24h\n"},
+		{name: "Unknown export format", file: "c.yaml", content: "archive:\n  export_format: avro\n"},
+		{name: "Negative segment size", file: "c.yaml", content: "storage:\n  segment_size: -1\n"},
+		{name: "Unknown sync policy", file: "c.yaml", content: "storage:\n  sync: never\n"},
+		{name: "Negative group window", file: "c.yaml", content: "storage:\n  group_window: -1ms\n"},
+		{name: "Zero retry attempts", file: "c.yaml", content: "retry:\n  max_attempts: 0\n"},
+		{name: "Jitter above 1", file: "c.yaml", content: "retry:\n  jitter: 1.5\n"},
+		{name: "Zero breaker cooldown", file: "c.yaml", content: "breaker:\n  cooldown: 0s\n"},
+		{name: "Zero max staleness", file: "c.yaml", content: "replication:\n  max_staleness: 0s\n"},
+		{name: "Sweep without time", file: "c.yaml", content: "sweeps:\n  s: acc1:acc2:10\n"},
+		{name: "Sweep to itself", file: "c.yaml", content: "sweeps:\n  s: acc1:acc1:10@17:00\n"},
+		{name: "Sweep at a bad time", file: "c.yaml", content: "sweeps:\n  s: acc1:acc2:10@25:00\n"},
+		{name: "Signers without count", file: "c.yaml", content: "signers:\n  acc1: alice,bob\n"},
+		{name: "Too many signatures required", file: "c.yaml", content: "signers:\n  acc1: 3:alice,bob\n"},
+		{name: "Archive to an unknown plugin", file: "c.yaml", content: "archive:\n  plugin: s3\n"},
+		{name: "Archive to a plugin and a directory", file: "c.yaml", content: "plugins:\n  s3: ./s3\narchive:\n  plugin: s3\n  dir: /tmp\n"},
+		{name: "Empty script", file: "c.json", content: `{"scripts": {"cap": " "}}`},
+		{name: "Bad duration", file: "c.json", content: `{"server": {"shutdown_timeout": "soon"}}`},
+		{name: "Unsupported format", file: "c.ini", content: "workers=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := Load(path); err == nil {
+				t.Errorf("Load(%s) succeeded; want error", tt.file)
+			}
+		})
+	}
+}
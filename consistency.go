@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrInvalidConsistency is returned for a consistency level that cannot be
+// parsed.
+var ErrInvalidConsistency = errors.New("invalid consistency")
+
+// ConsistencyHeader requests the consistency of a read, as parsed by
+// ParseConsistency. Without it, replicas serve reads until they are stale,
+// see Replica.Check.
+const ConsistencyHeader = "X-Consistency"
+
+// ServedVersionHeader reports the version of the state a read was served
+// from, by the leader or a replica.
+const ServedVersionHeader = "X-Served-Version"
+
+// ConsistencyLevel is how up to date a read must be.
+type ConsistencyLevel string
+
+const (
+	// LevelLinearizable reads see every operation the leader applied
+	// before the read, so replicas route them to the leader.
+	LevelLinearizable ConsistencyLevel = "linearizable"
+	// LevelBoundedStaleness reads may miss the operations of at most the
+	// last MaxStaleness.
+	LevelBoundedStaleness ConsistencyLevel = "bounded"
+	// LevelEventual reads may be served by any synced replica, however
+	// long ago it last heard from the leader.
+	LevelEventual ConsistencyLevel = "eventual"
+)
+
+// Consistency is the consistency requested for a read.
+type Consistency struct {
+	Level        ConsistencyLevel
+	MaxStaleness time.Duration // for LevelBoundedStaleness
+}
+
+var (
+	// Linearizable reads are served by the leader.
+	Linearizable = Consistency{Level: LevelLinearizable}
+	// Eventual reads are served by any synced replica.
+	Eventual = Consistency{Level: LevelEventual}
+)
+
+// BoundedStaleness reads are served by replicas that heard from the leader
+// at most d ago, and by the leader otherwise.
+func BoundedStaleness(d time.Duration) Consistency {
+	return Consistency{Level: LevelBoundedStaleness, MaxStaleness: d}
+}
+
+// ParseConsistency parses "linearizable", "eventual" or "bounded:<d>", d
+// being a duration such as 5s. The empty string is the zero Consistency,
+// which requests none.
+func ParseConsistency(s string) (Consistency, error) {
+	level, staleness, bounded := strings.Cut(s, ":")
+	switch ConsistencyLevel(level) {
+	case "":
+		if !bounded {
+			return Consistency{}, nil
+		}
+	case LevelLinearizable, LevelEventual:
+		if !bounded {
+			return Consistency{Level: ConsistencyLevel(level)}, nil
+		}
+	case LevelBoundedStaleness:
+		d, err := time.ParseDuration(staleness)
+		if err == nil && d >= 0 {
+			return BoundedStaleness(d), nil
+		}
+	}
+	return Consistency{}, fmt.Errorf("%w %q, want linearizable, eventual or bounded:<duration>", ErrInvalidConsistency, s)
+}
+
+func (c Consistency) String() string {
+	if c.Level == LevelBoundedStaleness {
+		return fmt.Sprintf("%s:%s", c.Level, c.MaxStaleness)
+	}
+	return string(c.Level)
+}
+
+// Serves reports whether the replica may serve a read at consistency c
+// itself, rather than route it to its leader.
+func (r *Replica) Serves(c Consistency) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.synced {
+		return false
+	}
+	switch c.Level {
+	case LevelEventual:
+		return true
+	case LevelBoundedStaleness:
+		return r.sm.now().Sub(r.lastContact) <= c.MaxStaleness
+	}
+	return false
+}
+
+// forward routes a read to the leader and relays its response, with the
+// version the leader served. The caller's credentials are forwarded as they
+// are, never the replica's own.
+func (r *Replica) forward(w http.ResponseWriter, req *http.Request) {
+	leader, err := url.Parse(r.Leader)
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: leader %s: %v", ErrReplicaStale, r.Leader, err))
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(leader)
+			pr.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			writeError(w, fmt.Errorf("%w: leader %s unreachable: %v", ErrReplicaStale, r.Leader, err))
+		},
+	}
+	if r.Client != nil {
+		proxy.Transport = r.Client.Transport
+	}
+	proxy.ServeHTTP(w, req)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseConsistency(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    Consistency
+		expectedErr error
+	}{
+		{"", Consistency{}, nil},
+		{"linearizable", Linearizable, nil},
+		{"eventual", Eventual, nil},
+		{"bounded:5s", BoundedStaleness(5 * time.Second), nil},
+		{"bounded:0s", BoundedStaleness(0), nil},
+		{"bounded", Consistency{}, ErrInvalidConsistency},
+		{"bounded:-1s", Consistency{}, ErrInvalidConsistency},
+		{"eventual:5s", Consistency{}, ErrInvalidConsistency},
+		{"strong", Consistency{}, ErrInvalidConsistency},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c, err := ParseConsistency(tt.value)
+			if !errors.Is(err, tt.expectedErr) || c != tt.expected {
+				t.Errorf("ParseConsistency(%q) = %v, %v; want %v, %v", tt.value, c, err, tt.expected, tt.expectedErr)
+			}
+		})
+	}
+}
+
+// TestServerConsistency reads from a replica that stopped following its
+// leader one operation ago, so the served version tells which served it.
+func TestServerConsistency(t *testing.T) {
+	quiet(t)
+
+	leaderSrv, leader := newTestServer(map[string]int{"acc1": 1000})
+	clock := NewFakeClock(time.Now())
+	replica, stop := startReplica(t, leaderSrv, clock, time.Minute)
+	waitReplicated(t, replica, 0)
+	stop()
+	if err := leader.Deposit("acc1", 10); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(replica.StateMachine(), "")
+	srv.UseReplica(replica)
+
+	tests := []struct {
+		name            string
+		staleness       time.Duration
+		consistency     string
+		expectedStatus  int
+		expectedVersion string
+	}{
+		{"Default", 30 * time.Second, "", http.StatusOK, "0"},
+		{"Linearizable", 30 * time.Second, "linearizable", http.StatusOK, "1"},
+		{"Eventual", 30 * time.Second, "eventual", http.StatusOK, "0"},
+		{"Bounded within staleness", 30 * time.Second, "bounded:1m", http.StatusOK, "0"},
+		{"Bounded beyond staleness", 30 * time.Second, "bounded:10s", http.StatusOK, "1"},
+		{"Invalid", 30 * time.Second, "bounded:soon", http.StatusBadRequest, ""},
+		{"Default when stale", 2 * time.Minute, "", http.StatusServiceUnavailable, ""},
+		{"Eventual when stale", 2 * time.Minute, "eventual", http.StatusOK, "0"},
+	}
+
+	start := clock.Now()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.Set(start.Add(tt.staleness))
+			req := httptest.NewRequest(http.MethodGet, "/accounts/acc1", nil)
+			if tt.consistency != "" {
+				req.Header.Set(ConsistencyHeader, tt.consistency)
+			}
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, req)
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("GET /accounts/acc1 = %d; want %d (%s)", rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if version := rec.Header().Get(ServedVersionHeader); version != tt.expectedVersion {
+				t.Errorf("%s = %q; want %q", ServedVersionHeader, version, tt.expectedVersion)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import "context"
+
+// CorrelationIDHeader carries the correlation ID of an API request. The
+// server generates one when it is absent and echoes it in the response.
+const CorrelationIDHeader = "X-Correlation-ID"
+
+// maxCorrelationIDLength bounds caller-supplied correlation IDs.
+const maxCorrelationIDLength = 128
+
+type correlationIDKey struct{}
+
+// WithCorrelationID records the ID tying the operations run with ctx to the
+// request, message or job that caused them. Operations applied with ctx
+// carry it in their CorrelationID, and so into history, hooks and rule
+// findings, events, the outbox and webhooks, and replicas.
+func WithCorrelationID(ctx context.Context, correlationId string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, correlationId)
+}
+
+func CorrelationIDFrom(ctx context.Context) string {
+	correlationId, _ := ctx.Value(correlationIDKey{}).(string)
+	return correlationId
+}
+
+// correlate sets the correlation ID of op from ctx, unless op has one.
+func correlate(ctx context.Context, op Operation) Operation {
+	if op.CorrelationID == "" {
+		op.CorrelationID = CorrelationIDFrom(ctx)
+	}
+	return op
+}
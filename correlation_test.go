@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCorrelationID(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 500}}
+	var mu sync.Mutex
+	var hooked []string
+	sm.RegisterHooks(Hooks{
+		BeforeOperation: func(ctx context.Context, op Operation) error {
+			mu.Lock()
+			defer mu.Unlock()
+			hooked = append(hooked, op.CorrelationID)
+			return nil
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := sm.Subscribe(ctx)
+
+	corrCtx := WithCorrelationID(context.Background(), "req-1")
+	_ = sm.DepositContext(corrCtx, "acc1", 100)
+	_, _ = sm.ApplyContext(corrCtx, Operation{Type: OpWithdraw, From: "acc1", Amount: 1, CorrelationID: "job-7"})
+	_ = sm.TxContext(WithCorrelationID(context.Background(), "req-2"), func(tx *Tx) error {
+		return tx.Transfer("acc1", "acc2", 10)
+	})
+	_ = sm.Deposit("acc2", 1)
+
+	expected := []string{"req-1", "job-7", "req-2", ""}
+	for i, op := range sm.Operations() {
+		if op.CorrelationID != expected[i] {
+			t.Errorf("Operation %d (%s) correlation ID = %q; want %q", i, op.Type, op.CorrelationID, expected[i])
+		}
+		if event := <-events; event.Operation.CorrelationID != expected[i] {
+			t.Errorf("Event %d correlation ID = %q; want %q", i, event.Operation.CorrelationID, expected[i])
+		}
+		if hooked[i] != expected[i] {
+			t.Errorf("Hooked operation %d correlation ID = %q; want %q", i, hooked[i], expected[i])
+		}
+	}
+}
+
+func TestServerCorrelationID(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name           string
+		header         string
+		expectedStatus int
+		expectedHeader string // "" means a generated ID
+	}{
+		{"Supplied", "trace-abc", http.StatusOK, "trace-abc"},
+		{"Generated", "", http.StatusOK, ""},
+		{"Too long", strings.Repeat("x", maxCorrelationIDLength+1), http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, sm := newTestServer(map[string]int{"acc1": 1000})
+			req := httptest.NewRequest(http.MethodPost, "/accounts/acc1/deposit", strings.NewReader(`{"amount": 10}`))
+			if tt.header != "" {
+				req.Header.Set(CorrelationIDHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, req)
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("POST = %d; want %d (%s)", rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			echoed := rec.Header().Get(CorrelationIDHeader)
+			if tt.expectedHeader != "" && echoed != tt.expectedHeader || echoed == "" {
+				t.Errorf("%s = %q; want %q", CorrelationIDHeader, echoed, tt.expectedHeader)
+			}
+			if ops := sm.Operations(); len(ops) != 1 || ops[0].CorrelationID != echoed {
+				t.Errorf("Operations() = %+v; want one with correlation ID %q", ops, echoed)
+			}
+		})
+	}
+}
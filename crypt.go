@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/Olusamimaths/vaultflow/config"
+)
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+// KeyProvider supplies data encryption keys, e.g. backed by a KMS. Keys are
+// identified so data sealed under a rotated-out key can still be opened.
+type KeyProvider interface {
+	// CurrentKey returns the key new data is sealed with.
+	CurrentKey() (keyId string, key []byte, err error)
+	// Key returns a key by id, including keys that have been rotated out.
+	Key(keyId string) ([]byte, error)
+}
+
+// Keyring is an in-memory KeyProvider holding AES-128/192/256 keys.
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+func NewKeyring(keyId string, key []byte) (*Keyring, error) {
+	k := &Keyring{keys: map[string][]byte{}}
+	if err := k.Rotate(keyId, key); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate makes key the current key. Previous keys are kept for decryption.
+func (k *Keyring) Rotate(keyId string, key []byte) error {
+	if _, err := aes.NewCipher(key); err != nil {
+		return fmt.Errorf("invalid key %s: %w", keyId, err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[keyId]; ok {
+		return fmt.Errorf("key %s already exists", keyId)
+	}
+	k.keys[keyId] = bytes.Clone(key)
+	k.current = keyId
+	return nil
+}
+
+func (k *Keyring) CurrentKey() (string, []byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *Keyring) Key(keyId string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w (%s)", ErrUnknownKey, keyId)
+	}
+	return key, nil
+}
+
+// newEncryptor returns an encryptor sealing with the key of cfg named by
+// storage.key and opening with any of its keys, or nil if none is set.
+func newEncryptor(cfg *config.Config) (*Encryptor, error) {
+	if cfg.Storage.Key == "" {
+		return nil, nil
+	}
+	// The current key is added last, as Rotate makes it the current one.
+	ids := slices.DeleteFunc(slices.Sorted(maps.Keys(cfg.Keys)), func(id string) bool { return id == cfg.Storage.Key })
+	var keyring *Keyring
+	for _, id := range append(ids, cfg.Storage.Key) {
+		key, err := base64.StdEncoding.DecodeString(cfg.Keys[id])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+		if keyring == nil {
+			keyring, err = NewKeyring(id, key)
+		} else {
+			err = keyring.Rotate(id, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return NewEncryptor(keyring), nil
+}
+
+// sealedMagic prefixes every sealed blob, followed by the key id length, the
+// key id, the GCM nonce and the ciphertext.
+var sealedMagic = []byte("VFE1")
+
+// Encryptor seals persisted data with AES-GCM.
+type Encryptor struct {
+	keys KeyProvider
+}
+
+func NewEncryptor(keys KeyProvider) *Encryptor {
+	return &Encryptor{keys: keys}
+}
+
+// Seal encrypts plaintext under the current key. additionalData, such as a
+// file name or record offset, is authenticated but not stored.
+func (e *Encryptor) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	keyId, key, err := e.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	if len(keyId) > 255 {
+		return nil, fmt.Errorf("key id %q too long", keyId)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(bytes.Clone(sealedMagic), byte(len(keyId)))
+	header = append(header, keyId...)
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append(header, nonce...)
+	return aead.Seal(out, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts data sealed by Seal with any key known to the provider.
+func (e *Encryptor) Open(sealed, additionalData []byte) ([]byte, error) {
+	keyId, rest, err := parseSealed(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := e.keys.Key(keyId)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed data truncated")
+	}
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt with key %s: %w", keyId, err)
+	}
+	return plaintext, nil
+}
+
+// Reseal re-encrypts sealed data under the current key, so data written
+// before a rotation can be migrated and the old key retired.
+func (e *Encryptor) Reseal(sealed, additionalData []byte) ([]byte, error) {
+	plaintext, err := e.Open(sealed, additionalData)
+	if err != nil {
+		return nil, err
+	}
+	return e.Seal(plaintext, additionalData)
+}
+
+// SealedKeyID returns the id of the key a blob was sealed with.
+func SealedKeyID(sealed []byte) (string, error) {
+	keyId, _, err := parseSealed(sealed)
+	return keyId, err
+}
+
+// IsSealed reports whether data looks like the output of Seal.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealedMagic)
+}
+
+func parseSealed(sealed []byte) (keyId string, rest []byte, err error) {
+	if !IsSealed(sealed) || len(sealed) < len(sealedMagic)+1 {
+		return "", nil, fmt.Errorf("data is not sealed")
+	}
+	rest = sealed[len(sealedMagic):]
+
+	n := int(rest[0])
+	if len(rest) < 1+n {
+		return "", nil, fmt.Errorf("sealed data truncated")
+	}
+	return string(rest[1 : 1+n]), rest[1+n:], nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
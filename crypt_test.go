@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncryptorKeyRotation(t *testing.T) {
+	keys, err := NewKeyring("k1", bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+	enc := NewEncryptor(keys)
+	aad := []byte("segment-1")
+
+	sealedV1, err := enc.Seal([]byte("balances"), aad)
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if bytes.Contains(sealedV1, []byte("balances")) {
+		t.Errorf("Sealed data contains the plaintext")
+	}
+
+	if err := keys.Rotate("k2", bytes.Repeat([]byte{2}, 32)); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+
+	plaintext, err := enc.Open(sealedV1, aad)
+	if err != nil || string(plaintext) != "balances" {
+		t.Fatalf("Open after rotation = %q, %v; want %q", plaintext, err, "balances")
+	}
+
+	sealedV2, err := enc.Reseal(sealedV1, aad)
+	if err != nil {
+		t.Fatalf("Reseal failed: %v", err)
+	}
+	if keyId, _ := SealedKeyID(sealedV2); keyId != "k2" {
+		t.Errorf("Resealed key id = %q; want %q", keyId, "k2")
+	}
+
+	if _, err := enc.Open(sealedV2, []byte("segment-2")); err == nil {
+		t.Errorf("Open with wrong additional data succeeded")
+	}
+
+	tampered := bytes.Clone(sealedV2)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := enc.Open(tampered, aad); err == nil {
+		t.Errorf("Open of tampered data succeeded")
+	}
+
+	other, _ := NewKeyring("k3", bytes.Repeat([]byte{3}, 16))
+	if _, err := NewEncryptor(other).Open(sealedV2, aad); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Open with unknown key = %v; want %v", err, ErrUnknownKey)
+	}
+}
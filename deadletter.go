@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrUnknownDeadLetter = errors.New("unknown dead letter")
+
+// operationRetryPolicy is how SubmitOperation retries an operation failing
+// with a retryable error, e.g. rate limited.
+var operationRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	Backoff:     100 * time.Millisecond,
+	Jitter:      0.2,
+	Retryable:   retryable,
+}
+
+// DeadLetter is an operation submitted with SubmitOperation that could not
+// be applied, kept until it is requeued or discarded.
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	Operation Operation `json:"operation"`
+	Priority  Priority  `json:"priority,omitempty"`
+	Error     string    `json:"error"` // of the last attempt
+	Attempts  int       `json:"attempts"`
+	FailedAt  time.Time `json:"failed_at"`
+	Requeues  int       `json:"requeues,omitempty"` // times it was requeued before failing again
+}
+
+// deadLetters is the dead-letter queue, oldest first, guarded by the state
+// lock so snapshots hold it as it was with the balances.
+type deadLetters struct {
+	entries []DeadLetter
+}
+
+func (q *deadLetters) index(id string) int {
+	for i, dl := range q.entries {
+		if dl.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// SubmitOperation queues op on d at priority p without blocking and returns
+// its future. An operation failing with a retryable error is attempted
+// again with operationRetryPolicy; one that still fails, or that cannot
+// be queued, is put in the dead-letter queue instead of being dropped, see
+// DeadLetters.
+func (sm *StateMachine) SubmitOperation(d *Dispatcher, p Priority, op Operation) *Future {
+	return sm.submitOperation(d, p, op, 0)
+}
+
+func (sm *StateMachine) submitOperation(d *Dispatcher, p Priority, op Operation, requeues int) *Future {
+	attempts := 0
+	return d.SubmitAsyncPriority(p, func() error {
+		return operationRetryPolicy.Do(context.Background(), func(ctx context.Context) error {
+			attempts++
+			_, err := sm.ApplyContext(ctx, op)
+			return err
+		})
+	}, func(f *Future) {
+		if err := f.Err(); err != nil {
+			sm.deadLetter(op, p, err, attempts, requeues)
+		}
+	})
+}
+
+// deadLetter puts a failed operation in the dead-letter queue.
+func (sm *StateMachine) deadLetter(op Operation, p Priority, err error, attempts, requeues int) {
+	now := sm.now()
+	dl := DeadLetter{
+		ID:        sm.newOperationID(now),
+		Operation: op,
+		Priority:  p,
+		Error:     err.Error(),
+		Attempts:  attempts,
+		FailedAt:  now,
+		Requeues:  requeues,
+	}
+
+	sm.mu.Lock()
+	sm.deadLetters.entries = append(sm.deadLetters.entries, dl)
+	sm.mu.Unlock()
+
+	fmt.Printf("Dead Letter: %s %s after %d attempts: %v\n", dl.ID, op.Type, attempts, err)
+}
+
+// DeadLetters returns the dead-letter queue, oldest first.
+func (sm *StateMachine) DeadLetters() []DeadLetter {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return append([]DeadLetter(nil), sm.deadLetters.entries...)
+}
+
+// DeadLetter returns an entry of the dead-letter queue.
+func (sm *StateMachine) DeadLetter(id string) (DeadLetter, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	i := sm.deadLetters.index(id)
+	if i < 0 {
+		return DeadLetter{}, fmt.Errorf("%w (%s)", ErrUnknownDeadLetter, id)
+	}
+	return sm.deadLetters.entries[i], nil
+}
+
+// DiscardDeadLetter removes an entry from the dead-letter queue without
+// applying its operation and returns it.
+func (sm *StateMachine) DiscardDeadLetter(id string) (DeadLetter, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	i := sm.deadLetters.index(id)
+	if i < 0 {
+		return DeadLetter{}, fmt.Errorf("%w (%s)", ErrUnknownDeadLetter, id)
+	}
+	dl := sm.deadLetters.entries[i]
+	sm.deadLetters.entries = append(sm.deadLetters.entries[:i], sm.deadLetters.entries[i+1:]...)
+	return dl, nil
+}
+
+// RequeueDeadLetter removes an entry from the dead-letter queue and submits
+// its operation to d again, at its priority, e.g. once the balance it
+// lacked was deposited. If it fails again it is put back in the queue as a
+// new entry.
+func (sm *StateMachine) RequeueDeadLetter(ctx context.Context, d *Dispatcher, id string) (*Future, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dl, err := sm.DiscardDeadLetter(id)
+	if err != nil {
+		return nil, err
+	}
+	return sm.submitOperation(d, dl.Priority, dl.Operation, dl.Requeues+1), nil
+}
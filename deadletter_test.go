@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSubmitOperation(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name             string
+		op               Operation
+		overloaded       int // attempts failing with a retryable error
+		closed           bool
+		expectedAttempts int // of the dead letter, -1 if none
+		expectedErr      error
+	}{
+		{"Applied", Operation{Type: OpWithdraw, From: "acc1", Amount: 10}, 0, false, -1, nil},
+		{"Applied on retry", Operation{Type: OpWithdraw, From: "acc1", Amount: 10}, 1, false, -1, nil},
+		{"Not retryable", Operation{Type: OpWithdraw, From: "acc1", Amount: 500}, 0, false, 1, ErrInsufficientBalance},
+		{"Retries exhausted", Operation{Type: OpWithdraw, From: "acc1", Amount: 10}, operationRetryPolicy.MaxAttempts, false, operationRetryPolicy.MaxAttempts, ErrVetoed},
+		{"Not queued", Operation{Type: OpWithdraw, From: "acc1", Amount: 10}, 0, true, 0, ErrDispatcherClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+			overloaded := tt.overloaded
+			sm.RegisterHooks(Hooks{BeforeOperation: func(ctx context.Context, op Operation) error {
+				if overloaded > 0 {
+					overloaded--
+					return &OverloadError{RetryAfter: time.Millisecond}
+				}
+				return nil
+			}})
+
+			d := NewDispatcher(1, 1)
+			if tt.closed {
+				_ = d.Close(context.Background())
+			}
+			future := sm.SubmitOperation(d, PriorityHigh, tt.op)
+			if err := future.Wait(); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Wait() error = %v; want %v", err, tt.expectedErr)
+			}
+			_ = d.Close(context.Background()) // waits for the callbacks
+
+			letters := sm.DeadLetters()
+			if tt.expectedAttempts < 0 {
+				if len(letters) != 0 {
+					t.Errorf("DeadLetters() = %+v; want none", letters)
+				}
+				return
+			}
+			if len(letters) != 1 {
+				t.Fatalf("DeadLetters() = %+v; want 1", letters)
+			}
+			dl := letters[0]
+			if dl.Attempts != tt.expectedAttempts || dl.Priority != PriorityHigh || dl.Operation.Amount != tt.op.Amount || dl.Error == "" {
+				t.Errorf("dead letter = %+v; want %d attempts at %s priority", dl, tt.expectedAttempts, PriorityHigh)
+			}
+		})
+	}
+}
+
+func TestRequeueDeadLetter(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	d := NewDispatcher(1, 4)
+	defer d.Close(context.Background())
+
+	_ = sm.SubmitOperation(d, PriorityNormal, Operation{Type: OpWithdraw, From: "acc1", Amount: 150}).Wait()
+	_ = sm.SubmitOperation(d, PriorityNormal, Operation{Type: OpWithdraw, From: "acc1", Amount: 500}).Wait()
+	deadline := time.Now().Add(time.Second)
+	for len(sm.DeadLetters()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond) // wait for the callbacks
+	}
+	letters := sm.DeadLetters()
+	if len(letters) != 2 {
+		t.Fatalf("DeadLetters() = %+v; want 2", letters)
+	}
+
+	// Requeued once the balance it lacked was deposited.
+	if err := sm.Deposit("acc1", 100); err != nil {
+		t.Fatal(err)
+	}
+	future, err := sm.RequeueDeadLetter(context.Background(), d, letters[0].ID)
+	if err != nil {
+		t.Fatalf("RequeueDeadLetter() error = %v", err)
+	}
+	if err := future.Wait(); err != nil {
+		t.Fatalf("requeued operation error = %v", err)
+	}
+	if balance, _ := sm.Balance("acc1"); balance != 50 {
+		t.Errorf("Balance(acc1) = %d; want 50", balance)
+	}
+
+	discarded, err := sm.DiscardDeadLetter(letters[1].ID)
+	if err != nil || discarded.Operation.Amount != 500 {
+		t.Errorf("DiscardDeadLetter() = %+v, %v; want the 500 withdrawal", discarded, err)
+	}
+	if letters := sm.DeadLetters(); len(letters) != 0 {
+		t.Errorf("DeadLetters() = %+v; want none left", letters)
+	}
+	if _, err := sm.RequeueDeadLetter(context.Background(), d, letters[0].ID); !errors.Is(err, ErrUnknownDeadLetter) {
+		t.Errorf("second RequeueDeadLetter() error = %v; want ErrUnknownDeadLetter", err)
+	}
+}
+
+func TestDeadLettersSnapshot(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	sm.deadLetter(Operation{Type: OpWithdraw, From: "acc1", Amount: 500}, PriorityLow, ErrInsufficientBalance, 1, 2)
+
+	var buf bytes.Buffer
+	if err := sm.WriteSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	restored := &StateMachine{}
+	if err := restored.ReadSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	letters := restored.DeadLetters()
+	if len(letters) != 1 || letters[0].ID != sm.DeadLetters()[0].ID || letters[0].Priority != PriorityLow || letters[0].Requeues != 2 {
+		t.Errorf("restored DeadLetters() = %+v; want %+v", letters, sm.DeadLetters())
+	}
+}
+
+func TestServerDeadLetters(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 100})
+	sm.deadLetter(Operation{Type: OpWithdraw, From: "acc1", Amount: 50}, PriorityNormal, ErrInsufficientBalance, 1, 0)
+	sm.deadLetter(Operation{Type: OpWithdraw, From: "acc1", Amount: 500}, PriorityNormal, ErrInsufficientBalance, 1, 0)
+	letters := sm.DeadLetters()
+
+	do := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	if rec := do(http.MethodPost, "/dead-letters/"+letters[0].ID+"/requeue"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST requeue without a dispatcher = %d; want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	d := NewDispatcher(1, 1)
+	srv.UseDispatcher(d)
+
+	tests := []struct {
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{http.MethodGet, "/dead-letters/" + letters[0].ID, http.StatusOK},
+		{http.MethodPost, "/dead-letters/" + letters[0].ID + "/requeue", http.StatusAccepted},
+		{http.MethodPost, "/dead-letters/" + letters[0].ID + "/requeue", http.StatusNotFound},
+		{http.MethodDelete, "/dead-letters/" + letters[1].ID, http.StatusOK},
+		{http.MethodGet, "/dead-letters/missing", http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if rec := do(tt.method, tt.path); rec.Code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+
+	_ = d.Close(context.Background())
+	if balance, _ := sm.Balance("acc1"); balance != 50 {
+		t.Errorf("Balance(acc1) = %d; want 50 after the requeue", balance)
+	}
+	var remaining []DeadLetter
+	_ = json.Unmarshal(do(http.MethodGet, "/dead-letters").Body.Bytes(), &remaining)
+	if len(remaining) != 0 {
+		t.Errorf("GET /dead-letters = %+v; want none", remaining)
+	}
+}
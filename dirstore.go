@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// DirStore is an ObjectStore in a local directory, keys being paths relative
+// to it.
+type DirStore struct {
+	Dir string
+}
+
+func (d *DirStore) path(key string) string {
+	return filepath.Join(d.Dir, filepath.FromSlash(key))
+}
+
+// Put writes the object to a temporary file first and renames it into
+// place, so a reader never sees a partial object.
+func (d *DirStore) Put(ctx context.Context, key string, data []byte) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (d *DirStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(d.path(key))
+}
+
+func (d *DirStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(d.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *DirStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(d.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == d.Dir {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.Dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	slices.Sort(keys)
+	return keys, err
+}
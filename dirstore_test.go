@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDirStore(t *testing.T) {
+	ctx := context.Background()
+	store := &DirStore{Dir: filepath.Join(t.TempDir(), "archive")}
+
+	if keys, err := store.List(ctx, ""); err != nil || len(keys) != 0 {
+		t.Fatalf("List() of a missing directory = %v, %v; want none", keys, err)
+	}
+	for _, key := range []string{"prod/backup-2.json", "prod/history/acc1/1.json", "prod/backup-1.json", "dev/backup-1.json"} {
+		if err := store.Put(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("Put(%s) error = %v", key, err)
+		}
+	}
+
+	keys, err := store.List(ctx, "prod/backup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"prod/backup-1.json", "prod/backup-2.json"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("List() = %v; want %v", keys, expected)
+	}
+
+	r, err := store.Get(ctx, "prod/history/acc1/1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "prod/history/acc1/1.json" {
+		t.Errorf("Get() = %q; want the object put", data)
+	}
+
+	if err := store.Delete(ctx, "prod/backup-1.json"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, "prod/backup-1.json"); err != nil {
+		t.Errorf("Delete() of a missing key error = %v", err)
+	}
+	if keys, _ := store.List(ctx, "prod/backup-"); !reflect.DeepEqual(keys, []string{"prod/backup-2.json"}) {
+		t.Errorf("List() after Delete() = %v", keys)
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+var (
+	ErrQueueFull        = errors.New("operation queue is full")
+	ErrDispatcherClosed = errors.New("dispatcher is closed")
+	ErrUnknownOperation = errors.New("unknown operation")
+	ErrInvalidPriority  = errors.New("invalid priority")
+)
+
+// Priority is the class of an operation submitted to a Dispatcher. Workers
+// always take the operations of a higher class first, so background bulk
+// work queued at PriorityLow never delays interactive operations at
+// PriorityHigh, but may wait as long as higher ones keep coming.
+type Priority string
+
+const (
+	PriorityHigh   Priority = "high"   // e.g. customer-facing withdrawals
+	PriorityNormal Priority = "normal" // the default
+	PriorityLow    Priority = "low"    // e.g. settlement and other bulk jobs
+)
+
+// priorities lists the classes from the highest.
+var priorities = [...]Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// queue returns the index of p's queue, the empty Priority being
+// PriorityNormal.
+func (p Priority) queue() (int, error) {
+	if p == "" {
+		p = PriorityNormal
+	}
+	i := slices.Index(priorities[:], p)
+	if i < 0 {
+		return 0, fmt.Errorf("%w %q, want high, normal or low", ErrInvalidPriority, p)
+	}
+	return i, nil
+}
+
+type FutureStatus string
+
+const (
+	StatusQueued    FutureStatus = "queued"
+	StatusRunning   FutureStatus = "running"
+	StatusSucceeded FutureStatus = "succeeded"
+	StatusFailed    FutureStatus = "failed"
+)
+
+// Future is the pending result of an operation submitted to a Dispatcher.
+type Future struct {
+	id   string
+	done chan struct{}
+
+	mu        sync.Mutex
+	status    FutureStatus
+	err       error
+	callbacks []func(*Future)
+}
+
+func newFuture(id string) *Future {
+	return &Future{id: id, done: make(chan struct{}), status: StatusQueued}
+}
+
+func (f *Future) setRunning() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = StatusRunning
+}
+
+func (f *Future) complete(err error) {
+	f.mu.Lock()
+	f.err = err
+	f.status = StatusSucceeded
+	if err != nil {
+		f.status = StatusFailed
+	}
+	callbacks := f.callbacks
+	f.callbacks = nil
+	close(f.done)
+	f.mu.Unlock()
+
+	for _, callback := range callbacks {
+		callback(f)
+	}
+}
+
+// ID identifies the operation for Dispatcher.Status.
+func (f *Future) ID() string {
+	return f.id
+}
+
+func (f *Future) Status() FutureStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// Err returns the operation's error, nil until it has completed.
+func (f *Future) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// OnComplete registers a callback run once the operation completes, on the
+// worker goroutine that applied it. Callbacks registered after completion run
+// immediately.
+func (f *Future) OnComplete(callback func(*Future)) {
+	f.mu.Lock()
+	select {
+	case <-f.done:
+		f.mu.Unlock()
+		callback(f)
+	default:
+		f.callbacks = append(f.callbacks, callback)
+		f.mu.Unlock()
+	}
+}
+
+// Done is closed once the operation has been applied or has failed.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the operation completes and returns its error.
+func (f *Future) Wait() error {
+	<-f.done
+	return f.Err()
+}
+
+type job struct {
+	fn     func() error
+	future *Future
+}
+
+// maxTrackedFutures bounds how many completed futures Status can look up;
+// the oldest completed ones are forgotten first.
+const maxTrackedFutures = 10000
+
+// Dispatcher applies queued operations with bounded concurrency, highest
+// Priority first. When the queue of a priority is full Submit blocks and
+// TrySubmit fails, pushing back on callers instead of spawning unbounded
+// goroutines. Each priority has its own queue, so bulk work filling its
+// queue never rejects operations of another priority.
+type Dispatcher struct {
+	queues  [len(priorities)]chan job
+	workers sync.WaitGroup
+
+	mu     sync.RWMutex // held for reading while enqueueing, for writing to close
+	closed bool
+
+	trackMu   sync.Mutex
+	nextID    uint64
+	futures   map[string]*Future
+	completed []string // ids of completed futures, oldest first
+}
+
+// NewDispatcher starts workers applying operations, with room for
+// queueSize of them in the queue of each priority.
+func NewDispatcher(workers, queueSize int) *Dispatcher {
+	d := &Dispatcher{futures: map[string]*Future{}}
+	for i := range d.queues {
+		d.queues[i] = make(chan job, queueSize)
+	}
+
+	d.workers.Add(workers)
+	for range workers {
+		go func() {
+			defer d.workers.Done()
+			for {
+				j, ok := d.next()
+				if !ok {
+					return
+				}
+				j.future.setRunning()
+				j.future.complete(j.fn())
+			}
+		}()
+	}
+	return d
+}
+
+// next waits for the queued operation of the highest priority. It fails
+// once the dispatcher is closed and every queue is drained.
+func (d *Dispatcher) next() (job, bool) {
+	for {
+		closed := 0
+		for _, queue := range d.queues {
+			select {
+			case j, ok := <-queue:
+				if ok {
+					return j, true
+				}
+				closed++
+			default:
+			}
+		}
+		if closed == len(d.queues) {
+			return job{}, false
+		}
+
+		// Nothing queued: take whatever comes first. Queues are closed
+		// together, so once one is the others are drained above.
+		select {
+		case j, ok := <-d.queues[0]:
+			if ok {
+				return j, true
+			}
+		case j, ok := <-d.queues[1]:
+			if ok {
+				return j, true
+			}
+		case j, ok := <-d.queues[2]:
+			if ok {
+				return j, true
+			}
+		}
+	}
+}
+
+// Submit queues fn at PriorityNormal, see SubmitPriority.
+func (d *Dispatcher) Submit(ctx context.Context, fn func() error) (*Future, error) {
+	return d.SubmitPriority(ctx, PriorityNormal, fn)
+}
+
+// SubmitPriority queues fn at priority p, waiting for room in its queue
+// until ctx is done.
+func (d *Dispatcher) SubmitPriority(ctx context.Context, p Priority, fn func() error) (*Future, error) {
+	i, err := p.queue()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return nil, ErrDispatcherClosed
+	}
+
+	j := d.newJob(fn)
+	select {
+	case d.queues[i] <- j:
+		return j.future, nil
+	case <-ctx.Done():
+		d.forget(j.future.id)
+		return nil, ctx.Err()
+	}
+}
+
+// TrySubmit queues fn at PriorityNormal, see TrySubmitPriority.
+func (d *Dispatcher) TrySubmit(fn func() error) (*Future, error) {
+	return d.TrySubmitPriority(PriorityNormal, fn)
+}
+
+// TrySubmitPriority queues fn at priority p, failing with ErrQueueFull
+// instead of waiting.
+func (d *Dispatcher) TrySubmitPriority(p Priority, fn func() error) (*Future, error) {
+	i, err := p.queue()
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.closed {
+		return nil, ErrDispatcherClosed
+	}
+
+	j := d.newJob(fn)
+	select {
+	case d.queues[i] <- j:
+		return j.future, nil
+	default:
+		d.forget(j.future.id)
+		return nil, ErrQueueFull
+	}
+}
+
+// SubmitAsync queues fn at PriorityNormal, see SubmitAsyncPriority.
+func (d *Dispatcher) SubmitAsync(fn func() error, callbacks ...func(*Future)) *Future {
+	return d.SubmitAsyncPriority(PriorityNormal, fn, callbacks...)
+}
+
+// SubmitAsyncPriority queues fn at priority p without blocking and returns
+// its future right away. When fn cannot be queued the future is already
+// failed with ErrQueueFull, ErrDispatcherClosed or ErrInvalidPriority.
+// Callbacks are registered with OnComplete before fn can run, so none of
+// them is missed.
+func (d *Dispatcher) SubmitAsyncPriority(p Priority, fn func() error, callbacks ...func(*Future)) *Future {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	j := d.newJob(fn)
+	for _, callback := range callbacks {
+		j.future.OnComplete(callback)
+	}
+
+	i, err := p.queue()
+	if err != nil {
+		j.future.complete(err)
+		return j.future
+	}
+	if d.closed {
+		j.future.complete(ErrDispatcherClosed)
+		return j.future
+	}
+
+	select {
+	case d.queues[i] <- j:
+	default:
+		j.future.complete(ErrQueueFull)
+	}
+	return j.future
+}
+
+// Status looks up an operation submitted to the dispatcher by its future's
+// ID.
+func (d *Dispatcher) Status(id string) (FutureStatus, error) {
+	d.trackMu.Lock()
+	future, ok := d.futures[id]
+	d.trackMu.Unlock()
+
+	if !ok {
+		return "", fmt.Errorf("%w (%s)", ErrUnknownOperation, id)
+	}
+	return future.Status(), nil
+}
+
+// Future returns the future of an operation submitted to the dispatcher.
+func (d *Dispatcher) Future(id string) (*Future, error) {
+	d.trackMu.Lock()
+	defer d.trackMu.Unlock()
+
+	future, ok := d.futures[id]
+	if !ok {
+		return nil, fmt.Errorf("%w (%s)", ErrUnknownOperation, id)
+	}
+	return future, nil
+}
+
+func (d *Dispatcher) newJob(fn func() error) job {
+	d.trackMu.Lock()
+	defer d.trackMu.Unlock()
+
+	d.nextID++
+	future := newFuture(fmt.Sprintf("op-%d", d.nextID))
+	d.futures[future.id] = future
+	future.OnComplete(d.track)
+
+	return job{fn: fn, future: future}
+}
+
+// track records a completed future, forgetting the oldest completed ones
+// beyond maxTrackedFutures.
+func (d *Dispatcher) track(f *Future) {
+	d.trackMu.Lock()
+	defer d.trackMu.Unlock()
+
+	d.completed = append(d.completed, f.id)
+	for len(d.completed) > maxTrackedFutures {
+		delete(d.futures, d.completed[0])
+		d.completed = d.completed[1:]
+	}
+}
+
+func (d *Dispatcher) forget(id string) {
+	d.trackMu.Lock()
+	defer d.trackMu.Unlock()
+	delete(d.futures, id)
+}
+
+// QueueDepth returns the number of operations waiting for a worker, of
+// every priority.
+func (d *Dispatcher) QueueDepth() int {
+	depth := 0
+	for _, queue := range d.queues {
+		depth += len(queue)
+	}
+	return depth
+}
+
+// Close stops accepting operations and waits for queued ones to be applied,
+// or for ctx to be done.
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, queue := range d.queues {
+			close(queue)
+		}
+	}
+	d.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatcher(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000, "acc2": 500},
+	}
+
+	d := NewDispatcher(4, 8)
+	var futures []*Future
+	for range 100 {
+		future, err := d.Submit(context.Background(), func() error { return sm.Transfer("acc1", "acc2", 5) })
+		if err != nil {
+			t.Fatalf("Submit failed: %v", err)
+		}
+		futures = append(futures, future)
+	}
+
+	withdrawal, _ := d.Submit(context.Background(), func() error { return sm.Withdraw("acc2", 100000) })
+	if err := withdrawal.Wait(); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Future error = %v; want %v", err, ErrInsufficientBalance)
+	}
+
+	for _, future := range futures {
+		if err := future.Wait(); err != nil {
+			t.Errorf("Transfer failed: %v", err)
+		}
+	}
+
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if _, err := d.Submit(context.Background(), func() error { return nil }); !errors.Is(err, ErrDispatcherClosed) {
+		t.Errorf("Submit after Close = %v; want %v", err, ErrDispatcherClosed)
+	}
+
+	expectedAccounts := map[string]int{"acc1": 500, "acc2": 1000}
+	for acc, expectedBalance := range expectedAccounts {
+		if sm.accounts[acc] != expectedBalance {
+			t.Errorf("Account %s balance = %d; want %d", acc, sm.accounts[acc], expectedBalance)
+		}
+	}
+}
+
+func TestDispatcherBackpressure(t *testing.T) {
+	d := NewDispatcher(1, 1)
+	release := make(chan struct{})
+	var running atomic.Int32
+
+	block := func() error {
+		running.Add(1)
+		<-release
+		return nil
+	}
+
+	if _, err := d.Submit(context.Background(), block); err != nil {
+		t.Fatalf("Submit failed: %v", err)
+	}
+	for running.Load() == 0 {
+		time.Sleep(time.Millisecond) // wait for the worker to pick up the first job
+	}
+	if _, err := d.TrySubmit(block); err != nil {
+		t.Fatalf("TrySubmit into empty queue failed: %v", err)
+	}
+
+	if _, err := d.TrySubmit(block); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("TrySubmit into full queue = %v; want %v", err, ErrQueueFull)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := d.Submit(ctx, block); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Submit into full queue = %v; want %v", err, context.DeadlineExceeded)
+	}
+	if depth := d.QueueDepth(); depth != 1 {
+		t.Errorf("QueueDepth = %d; want 1", depth)
+	}
+
+	close(release)
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if n := running.Load(); n != 2 {
+		t.Errorf("Ran %d operations; want 2", n)
+	}
+}
+
+func TestDispatcherSubmitAsync(t *testing.T) {
+	d := NewDispatcher(1, 1)
+	release := make(chan struct{})
+
+	var notified atomic.Int32
+	onComplete := func(f *Future) { notified.Add(1) }
+
+	blocked := d.SubmitAsync(func() error { <-release; return nil }, onComplete)
+	for blocked.Status() != StatusRunning {
+		time.Sleep(time.Millisecond)
+	}
+
+	queued := d.SubmitAsync(func() error { return ErrInsufficientBalance }, onComplete)
+	rejected := d.SubmitAsync(func() error { return nil }, onComplete)
+
+	if status, err := d.Status(queued.ID()); err != nil || status != StatusQueued {
+		t.Errorf("Status(%s) = %s, %v; want %s", queued.ID(), status, err, StatusQueued)
+	}
+	if status, _ := d.Status(rejected.ID()); status != StatusFailed || !errors.Is(rejected.Err(), ErrQueueFull) {
+		t.Errorf("Status(%s) = %s, %v; want %s with %v", rejected.ID(), status, rejected.Err(), StatusFailed, ErrQueueFull)
+	}
+
+	close(release)
+	if err := queued.Wait(); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Wait = %v; want %v", err, ErrInsufficientBalance)
+	}
+	if status, _ := d.Status(blocked.ID()); status != StatusSucceeded {
+		t.Errorf("Status(%s) = %s; want %s", blocked.ID(), status, StatusSucceeded)
+	}
+	if status, _ := d.Status(queued.ID()); status != StatusFailed {
+		t.Errorf("Status(%s) = %s; want %s", queued.ID(), status, StatusFailed)
+	}
+
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if n := notified.Load(); n != 3 {
+		t.Errorf("Callbacks ran %d times; want 3", n)
+	}
+
+	late := d.SubmitAsync(func() error { return nil })
+	if !errors.Is(late.Wait(), ErrDispatcherClosed) {
+		t.Errorf("SubmitAsync after Close = %v; want %v", late.Err(), ErrDispatcherClosed)
+	}
+	if _, err := d.Status("op-unknown"); !errors.Is(err, ErrUnknownOperation) {
+		t.Errorf("Status of unknown id = %v; want %v", err, ErrUnknownOperation)
+	}
+}
+
+func TestDispatcherPriority(t *testing.T) {
+	d := NewDispatcher(1, 4)
+	release := make(chan struct{})
+	blocked := d.SubmitAsync(func() error { <-release; return nil })
+	for blocked.Status() != StatusRunning {
+		time.Sleep(time.Millisecond)
+	}
+
+	var mu sync.Mutex
+	var order []Priority
+	run := func(p Priority) func() error {
+		return func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			order = append(order, p)
+			return nil
+		}
+	}
+	for _, p := range []Priority{PriorityLow, PriorityLow, PriorityNormal, "", PriorityHigh, PriorityLow, PriorityHigh} {
+		if _, err := d.TrySubmitPriority(p, run(cmp.Or(p, PriorityNormal))); err != nil {
+			t.Fatalf("TrySubmitPriority(%q) error = %v", p, err)
+		}
+	}
+	if _, err := d.TrySubmitPriority(PriorityLow, run(PriorityLow)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.TrySubmitPriority(PriorityLow, run(PriorityLow)); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("TrySubmitPriority(low) into its full queue error = %v; want ErrQueueFull", err)
+	}
+	if _, err := d.TrySubmitPriority(PriorityHigh, run(PriorityHigh)); err != nil {
+		t.Errorf("TrySubmitPriority(high) with the low queue full error = %v", err)
+	}
+	if _, err := d.TrySubmitPriority("urgent", run(PriorityHigh)); !errors.Is(err, ErrInvalidPriority) {
+		t.Errorf("TrySubmitPriority(urgent) error = %v; want ErrInvalidPriority", err)
+	}
+	if future := d.SubmitAsyncPriority("urgent", run(PriorityHigh)); !errors.Is(future.Err(), ErrInvalidPriority) {
+		t.Errorf("SubmitAsyncPriority(urgent) error = %v; want ErrInvalidPriority", future.Err())
+	}
+	if depth := d.QueueDepth(); depth != 9 {
+		t.Errorf("QueueDepth = %d; want 9", depth)
+	}
+
+	close(release)
+	if err := d.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	expected := []Priority{PriorityHigh, PriorityHigh, PriorityHigh, PriorityNormal, PriorityNormal, PriorityLow, PriorityLow, PriorityLow, PriorityLow}
+	if !slices.Equal(order, expected) {
+		t.Errorf("Operations ran in order %v; want %v", order, expected)
+	}
+}
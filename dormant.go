@@ -0,0 +1,269 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+var (
+	ErrAccountArchived = errors.New("account is archived")
+	ErrNotArchived     = errors.New("account is not archived")
+)
+
+// dormancyCheckInterval is how often the server archives the accounts that
+// became dormant.
+const dormancyCheckInterval = time.Hour
+
+// ArchivedAccount is an account set aside by ArchiveAccount, with the
+// balances it had.
+type ArchivedAccount struct {
+	ID         string         `json:"id"`
+	Balance    int            `json:"balance"`
+	Buckets    map[string]int `json:"buckets,omitempty"` // if it had any
+	LastActive time.Time      `json:"last_active"`
+	ArchivedAt time.Time      `json:"archived_at"`
+}
+
+func (a ArchivedAccount) clone() ArchivedAccount {
+	a.Buckets = maps.Clone(a.Buckets)
+	return a
+}
+
+// ArchiveAccount archives an account: it is removed from the balances, so
+// it is left out of listings and every query, and operations on it fail
+// with ErrAccountArchived until it is restored with UnarchiveAccount. The
+// archival is an operation of its own, journaled like any other.
+//
+// Rollbacks cannot undo an archival or a restore: they fail with
+// ErrIrreversible rather than go back past one.
+func (sm *StateMachine) ArchiveAccount(accountId string) error {
+	return sm.ArchiveAccountContext(context.Background(), accountId)
+}
+
+// ArchiveAccountContext is like ArchiveAccount but gives up without
+// archiving if ctx is done before the operation starts.
+func (sm *StateMachine) ArchiveAccountContext(ctx context.Context, accountId string) error {
+	_, err := sm.execute(ctx, Operation{Type: OpArchive, From: accountId})
+	return err
+}
+
+// UnarchiveAccount restores an archived account with the balances it was
+// archived with.
+func (sm *StateMachine) UnarchiveAccount(accountId string) error {
+	return sm.UnarchiveAccountContext(context.Background(), accountId)
+}
+
+// UnarchiveAccountContext is like UnarchiveAccount but gives up without
+// restoring if ctx is done before the operation starts.
+func (sm *StateMachine) UnarchiveAccountContext(ctx context.Context, accountId string) error {
+	_, err := sm.execute(ctx, Operation{Type: OpUnarchive, To: accountId})
+	return err
+}
+
+func (sm *StateMachine) applyArchive(op Operation) error {
+	accountId := op.From
+	fmt.Printf("\n\nArchiving account %s\n", accountId)
+
+	balance, ok := sm.accounts[accountId]
+	if !ok {
+		return fmt.Errorf("%w (%s) to archive", ErrInvalidAccount, accountId)
+	}
+	archived := ArchivedAccount{
+		ID:         accountId,
+		Balance:    balance,
+		LastActive: sm.lastActive[accountId],
+		ArchivedAt: op.Time,
+	}
+	keys := []string{accountId}
+	if sm.hasBuckets(accountId) {
+		archived.Buckets = sm.buckets(accountId)
+		for bucket := range archived.Buckets {
+			keys = append(keys, bucketKey(accountId, bucket))
+		}
+	}
+
+	sm.saveState(keys...)
+	for _, key := range keys {
+		delete(sm.accounts, key)
+	}
+	if sm.archived == nil {
+		sm.archived = map[string]ArchivedAccount{}
+	}
+	sm.archived[accountId] = archived
+	sm.onRevert(func() error {
+		delete(sm.archived, accountId)
+		return nil
+	})
+	delete(sm.lastActive, accountId)
+	return nil
+}
+
+func (sm *StateMachine) applyUnarchive(op Operation) error {
+	accountId := op.To
+	fmt.Printf("\n\nRestoring archived account %s\n", accountId)
+
+	archived, ok := sm.archived[accountId]
+	if !ok {
+		if _, active := sm.accounts[accountId]; active {
+			return fmt.Errorf("%w (%s)", ErrNotArchived, accountId)
+		}
+		return fmt.Errorf("%w (%s) to restore", ErrInvalidAccount, accountId)
+	}
+	keys := []string{accountId}
+	for bucket := range archived.Buckets {
+		keys = append(keys, bucketKey(accountId, bucket))
+	}
+
+	sm.saveState(keys...)
+	sm.accounts[accountId] = archived.Balance
+	for bucket, balance := range archived.Buckets {
+		sm.accounts[bucketKey(accountId, bucket)] = balance
+	}
+	delete(sm.archived, accountId)
+	sm.onRevert(func() error {
+		sm.archived[accountId] = archived
+		return nil
+	})
+	return nil
+}
+
+// checkArchived fails with ErrAccountArchived if op touches an archived
+// account, unless it restores it. sm.mu must be held.
+func (sm *StateMachine) checkArchived(op Operation) error {
+	if op.Type == OpUnarchive {
+		return nil
+	}
+	for _, id := range op.accounts() {
+		if _, ok := sm.archived[id]; ok {
+			return fmt.Errorf("%w (%s)", ErrAccountArchived, id)
+		}
+	}
+	return nil
+}
+
+// checkIrreversibleAfter fails with ErrIrreversible if an archival, a
+// restore or a status change in journal produced a version after version,
+// which going back to it would undo.
+func checkIrreversibleAfter(journal []Operation, version int) error {
+	for i := len(journal) - 1; i >= 0 && journal[i].Version > version; i-- {
+		if op := journal[i]; op.Type == OpArchive || op.Type == OpUnarchive || op.Type == OpSetStatus {
+			return fmt.Errorf("%w: rolling back to version %d would undo %s %s (%s)", ErrIrreversible, version, op.Type, op.accounts()[0], op.ID)
+		}
+	}
+	return nil
+}
+
+// markActive records when the accounts of an applied operation were last
+// active. sm.mu must be held.
+func (sm *StateMachine) markActive(op Operation) {
+	if op.Type == OpArchive || op.Type == OpRollback || op.Type == OpRollbackTo {
+		return
+	}
+	if sm.lastActive == nil {
+		sm.lastActive = map[string]time.Time{}
+	}
+	for _, id := range op.accounts() {
+		sm.lastActive[id] = op.Time
+	}
+}
+
+// ArchivedAccounts returns every archived account, in ID order.
+func (sm *StateMachine) ArchivedAccounts() []ArchivedAccount {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return sm.archivedList()
+}
+
+// archivedList returns every archived account, in ID order. sm.mu must be
+// held.
+func (sm *StateMachine) archivedList() []ArchivedAccount {
+	list := make([]ArchivedAccount, 0, len(sm.archived))
+	for _, a := range sm.archived {
+		list = append(list, a.clone())
+	}
+	slices.SortFunc(list, func(a, b ArchivedAccount) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+// restoreArchived replaces the archived accounts and activity times. sm.mu
+// must be held.
+func (sm *StateMachine) restoreArchived(list []ArchivedAccount, lastActive map[string]time.Time) {
+	sm.archived = make(map[string]ArchivedAccount, len(list))
+	for _, a := range list {
+		sm.archived[a.ID] = a
+	}
+	sm.lastActive = lastActive
+}
+
+// ArchiveDormant archives the accounts no operation touched for at least
+// dormantAfter and returns how many it archived. It carries on past
+// accounts that fail to be archived and returns the first error. An account
+// no operation touched yet counts as active when ArchiveDormant first sees
+// it. Escrow accounts are never archived.
+func (sm *StateMachine) ArchiveDormant(ctx context.Context, dormantAfter time.Duration) (int, error) {
+	now := sm.now()
+
+	sm.mu.Lock()
+	var dormant []string
+	for id := range sm.accounts {
+		if isBucketKey(id) || strings.HasPrefix(id, escrowAccountPrefix) {
+			continue
+		}
+		last, ok := sm.lastActive[id]
+		if !ok {
+			if sm.lastActive == nil {
+				sm.lastActive = map[string]time.Time{}
+			}
+			sm.lastActive[id] = now
+			continue
+		}
+		if now.Sub(last) >= dormantAfter {
+			dormant = append(dormant, id)
+		}
+	}
+	sm.mu.Unlock()
+
+	slices.Sort(dormant)
+	archived := 0
+	var firstErr error
+	for _, id := range dormant {
+		if err := sm.ArchiveAccountContext(ctx, id); err != nil {
+			if ctx.Err() != nil || errors.Is(err, ErrClosed) {
+				return archived, err
+			}
+			firstErr = cmp.Or(firstErr, err)
+			continue
+		}
+		archived++
+	}
+	return archived, firstErr
+}
+
+// RunDormancyArchival calls ArchiveDormant every interval until ctx is
+// done.
+func (sm *StateMachine) RunDormancyArchival(ctx context.Context, interval, dormantAfter time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			archived, err := sm.ArchiveDormant(ctx, dormantAfter)
+			if err != nil && ctx.Err() == nil {
+				fmt.Println("Dormancy Archival Error:", err)
+			}
+			if archived > 0 {
+				fmt.Printf("\n\nArchived %d dormant accounts\n", archived)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
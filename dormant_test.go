@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestArchiveAccount(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 50}}
+	if err := sm.Move("acc1", "", "reserved", 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.ArchiveAccount("acc1"); err != nil {
+		t.Fatalf("ArchiveAccount() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		apply    func() error
+		expected error
+	}{
+		{"Deposit", func() error { return sm.Deposit("acc1", 10) }, ErrAccountArchived},
+		{"Transfer to", func() error { return sm.Transfer("acc2", "acc1", 10) }, ErrAccountArchived},
+		{"Reopen", func() error { return sm.OpenAccount("acc1", 0) }, ErrAccountArchived},
+		{"Balance", func() error { _, err := sm.Balance("acc1"); return err }, ErrAccountArchived},
+		{"Archive twice", func() error { return sm.ArchiveAccount("acc1") }, ErrAccountArchived},
+		{"Archive unknown", func() error { return sm.ArchiveAccount("acc3") }, ErrInvalidAccount},
+		{"Restore active", func() error { return sm.UnarchiveAccount("acc2") }, ErrNotArchived},
+		{"Restore unknown", func() error { return sm.UnarchiveAccount("acc3") }, ErrInvalidAccount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.apply(); !errors.Is(err, tt.expected) {
+				t.Errorf("Error = %v; want %v", err, tt.expected)
+			}
+		})
+	}
+
+	if balances := sm.Balances(); !reflect.DeepEqual(balances, map[string]int{"acc2": 50}) {
+		t.Errorf("Balances() = %v; want only acc2", balances)
+	}
+	if page, _ := sm.ListAccounts(ListOptions{}); len(page.Accounts) != 1 {
+		t.Errorf("ListAccounts() = %+v; want only acc2", page.Accounts)
+	}
+	if total := sm.TotalBalance(); total != 50 {
+		t.Errorf("TotalBalance() = %d; want 50", total)
+	}
+	archived := sm.ArchivedAccounts()
+	if len(archived) != 1 || archived[0].Balance != 100 || archived[0].Buckets["reserved"] != 30 {
+		t.Errorf("ArchivedAccounts() = %+v; want acc1 with 100 and 30 reserved", archived)
+	}
+	if err := sm.Rollback(); !errors.Is(err, ErrIrreversible) {
+		t.Errorf("Rollback() across an archival error = %v; want ErrIrreversible", err)
+	}
+
+	if err := sm.UnarchiveAccount("acc1"); err != nil {
+		t.Fatalf("UnarchiveAccount() error = %v", err)
+	}
+	if balance, _ := sm.Balance("acc1"); balance != 100 {
+		t.Errorf("Balance() after restore = %d; want 100", balance)
+	}
+	if buckets, _ := sm.Buckets("acc1"); buckets["reserved"] != 30 {
+		t.Errorf("Buckets() after restore = %v; want 30 reserved", buckets)
+	}
+	if len(sm.ArchivedAccounts()) != 0 {
+		t.Errorf("ArchivedAccounts() after restore = %+v; want none", sm.ArchivedAccounts())
+	}
+}
+
+func TestArchiveDormant(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 50, "acc3": 0}}
+	sm.UseClock(clock)
+
+	tests := []struct {
+		name     string
+		advance  time.Duration
+		deposit  string
+		expected int
+		active   []string
+	}{
+		{"First seen", 0, "", 0, []string{"acc1", "acc2", "acc3"}},
+		{"Touched", 20 * time.Hour, "acc1", 0, []string{"acc1", "acc2", "acc3"}},
+		{"Dormant", 4 * time.Hour, "", 2, []string{"acc1"}},
+		{"Kept active", 23 * time.Hour, "acc1", 0, []string{"acc1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.Advance(tt.advance)
+			if tt.deposit != "" {
+				if err := sm.Deposit(tt.deposit, 1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			archived, err := sm.ArchiveDormant(context.Background(), 24*time.Hour)
+			if err != nil || archived != tt.expected {
+				t.Fatalf("ArchiveDormant() = %d, %v; want %d", archived, err, tt.expected)
+			}
+			var active []string
+			for id := range sm.Balances() {
+				active = append(active, id)
+			}
+			if len(active) != len(tt.active) {
+				t.Errorf("Active accounts = %v; want %v", active, tt.active)
+			}
+		})
+	}
+}
+
+func TestArchiveSnapshot(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 50}}
+	sm.UseClock(NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)))
+	if err := sm.ArchiveAccount("acc1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot, backup bytes.Buffer
+	if err := sm.WriteSnapshot(&snapshot, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &StateMachine{}
+	if err := restored.ReadSnapshot(&snapshot, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.ArchivedAccounts(), sm.ArchivedAccounts()) {
+		t.Errorf("ArchivedAccounts() after ReadSnapshot = %+v; want %+v", restored.ArchivedAccounts(), sm.ArchivedAccounts())
+	}
+	if err := restored.UnarchiveAccount("acc1"); err != nil {
+		t.Errorf("UnarchiveAccount() after ReadSnapshot error = %v", err)
+	}
+
+	if err := (&StateMachine{}).Restore(bytes.NewReader(backup.Bytes()), 0); !errors.Is(err, ErrIrreversible) {
+		t.Errorf("Restore() before the archival error = %v; want ErrIrreversible", err)
+	}
+	restored = &StateMachine{}
+	if err := restored.Restore(bytes.NewReader(backup.Bytes()), LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.ArchivedAccounts()) != 1 {
+		t.Errorf("ArchivedAccounts() after Restore = %+v; want acc1", restored.ArchivedAccounts())
+	}
+}
+
+func TestServerArchive(t *testing.T) {
+	quiet(t)
+
+	srv, _ := newTestServer(map[string]int{"acc1": 100})
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{"Archive", http.MethodPost, "/accounts/acc1/archive", http.StatusOK},
+		{"Balance", http.MethodGet, "/accounts/acc1", http.StatusConflict},
+		{"Deposit", http.MethodPost, "/accounts/acc1/deposit", http.StatusConflict},
+		{"List", http.MethodGet, "/archived-accounts", http.StatusOK},
+		{"Archive unknown", http.MethodPost, "/accounts/acc2/archive", http.StatusNotFound},
+		{"Unarchive", http.MethodPost, "/accounts/acc1/unarchive", http.StatusOK},
+		{"Unarchive active", http.MethodPost, "/accounts/acc1/unarchive", http.StatusConflict},
+		{"Balance after restore", http.MethodGet, "/accounts/acc1", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body *bytes.Reader
+			if tt.method == http.MethodPost {
+				body = bytes.NewReader([]byte(`{"amount":10}`))
+			} else {
+				body = bytes.NewReader(nil)
+			}
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, body))
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+}
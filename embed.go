@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrTxDone is returned when committing or rolling back an EmbeddedTx that
+// already was.
+var ErrTxDone = errors.New("transaction already committed or rolled back")
+
+// TxCoordinator joins the transactions of a state machine embedded in a host
+// application to the host's own transactions, so the ledger writes and the
+// host's writes are committed together or not at all.
+type TxCoordinator interface {
+	// Write records the operations, with their IDs and versions, within
+	// the host transaction, e.g. as rows of a ledger table.
+	Write(ctx context.Context, ops []Operation) error
+	// Commit commits the host transaction. The operations are applied to
+	// the state machine only if it succeeds.
+	Commit() error
+	// Rollback aborts the host transaction.
+	Rollback() error
+}
+
+// LedgerInsert is the statement SQLCoordinator inserts an operation with by
+// default, given its ID, version and JSON encoding.
+const LedgerInsert = "INSERT INTO vaultflow_ledger (id, version, operation) VALUES (?, ?, ?)"
+
+// SQLCoordinator is the TxCoordinator of a database/sql transaction. It
+// writes each operation with Insert, or LedgerInsert if empty, which must
+// use the placeholders of the driver, e.g. $1 for PostgreSQL.
+type SQLCoordinator struct {
+	Tx     *sql.Tx
+	Insert string
+}
+
+func (c SQLCoordinator) Write(ctx context.Context, ops []Operation) error {
+	insert := c.Insert
+	if insert == "" {
+		insert = LedgerInsert
+	}
+	for _, op := range ops {
+		data, err := json.Marshal(op)
+		if err != nil {
+			return err
+		}
+		if _, err := c.Tx.ExecContext(ctx, insert, op.ID, op.Version, string(data)); err != nil {
+			return fmt.Errorf("writing operation %s: %w", op.ID, err)
+		}
+	}
+	return nil
+}
+
+func (c SQLCoordinator) Commit() error {
+	return c.Tx.Commit()
+}
+
+func (c SQLCoordinator) Rollback() error {
+	return c.Tx.Rollback()
+}
+
+// EmbeddedTx is a transaction of the state machine joined to a host
+// transaction by a TxCoordinator, see StateMachine.Embed. Operations are
+// performed like with a Tx, whose methods it has, and committed or rolled
+// back with the host transaction by the methods of EmbeddedTx, which the
+// host calls instead of those of its transaction. It is not safe for
+// concurrent use.
+type EmbeddedTx struct {
+	*Tx
+	coord TxCoordinator
+	done  bool
+}
+
+// Embed starts a transaction joined to the host transaction of coord. The
+// state machine is not locked until the transaction commits, so other
+// operations carry on meanwhile; they are validated again on commit.
+func (sm *StateMachine) Embed(ctx context.Context, coord TxCoordinator) (*EmbeddedTx, error) {
+	if sm.readOnly {
+		return nil, ErrReadOnly
+	}
+	tx, err := sm.newTx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &EmbeddedTx{Tx: tx, coord: coord}, nil
+}
+
+// ApplyInTx performs ops in a transaction joined to tx, e.g.
+//
+//	tx, _ := db.BeginTx(ctx, nil)
+//	_, _ = tx.ExecContext(ctx, "UPDATE invoices SET paid = true WHERE id = ?", invoiceId)
+//	etx, err := sm.ApplyInTx(ctx, tx, Operation{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 100})
+//	if err != nil {
+//		_ = tx.Rollback()
+//		return err
+//	}
+//	return etx.Commit() // commits tx, then applies the transfer
+//
+// The operations are written to tx with SQLCoordinator when the returned
+// transaction commits. If one of them fails nothing is written and tx is
+// left to the caller.
+func (sm *StateMachine) ApplyInTx(ctx context.Context, tx *sql.Tx, ops ...Operation) (*EmbeddedTx, error) {
+	etx, err := sm.Embed(ctx, SQLCoordinator{Tx: tx})
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		if err := etx.Apply(op); err != nil {
+			return nil, err
+		}
+	}
+	return etx, nil
+}
+
+// Commit validates the operations against the current balances, writes them
+// to the host transaction and commits it, then applies them as a single
+// state change. If any step fails the host transaction is rolled back and
+// nothing is applied. Other operations wait while the host transaction
+// commits.
+func (etx *EmbeddedTx) Commit() error {
+	if etx.done {
+		return ErrTxDone
+	}
+	etx.done = true
+
+	sm := etx.sm
+	if err := sm.lifecycle.begin(); err != nil {
+		_ = etx.coord.Rollback()
+		return err
+	}
+	defer sm.lifecycle.end()
+	return sm.commit(etx.ctx, etx.hooks, etx.ops, etx.coord)
+}
+
+// Rollback rolls back the host transaction, applying nothing.
+func (etx *EmbeddedTx) Rollback() error {
+	if etx.done {
+		return ErrTxDone
+	}
+	etx.done = true
+	return etx.coord.Rollback()
+}
+
+// Operations returns the operations performed, with their IDs and versions
+// once committed.
+func (etx *EmbeddedTx) Operations() []Operation {
+	return etx.ops
+}
+
+// commitHost writes ops, as the next state change will record them, to the
+// host transaction of coord and commits it. sm.mu must be held.
+func (sm *StateMachine) commitHost(ctx context.Context, coord TxCoordinator, ops []Operation) error {
+	for i := range ops {
+		ops[i].Version = sm.version + 1
+	}
+	if err := coord.Write(ctx, ops); err != nil {
+		_ = coord.Rollback()
+		return err
+	}
+	return coord.Commit()
+}
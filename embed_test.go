@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+)
+
+// ledgerDB is a database/sql driver keeping the rows inserted by committed
+// transactions, whose commits can be made to fail.
+type ledgerDB struct {
+	mu         sync.Mutex
+	rows       [][]driver.Value
+	failCommit bool
+}
+
+var testLedger = &ledgerDB{}
+
+var errCommitFailed = errors.New("commit failed")
+
+func init() {
+	sql.Register("vaultflow-ledger", testLedger)
+}
+
+func (db *ledgerDB) Open(name string) (driver.Conn, error) {
+	return &ledgerConn{db: db}, nil
+}
+
+type ledgerConn struct {
+	db      *ledgerDB
+	pending [][]driver.Value
+}
+
+func (c *ledgerConn) Prepare(query string) (driver.Stmt, error) {
+	return ledgerStmt{c}, nil
+}
+
+func (c *ledgerConn) Close() error {
+	return nil
+}
+
+func (c *ledgerConn) Begin() (driver.Tx, error) {
+	c.pending = nil
+	return c, nil
+}
+
+func (c *ledgerConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	if c.db.failCommit {
+		return errCommitFailed
+	}
+	c.db.rows = append(c.db.rows, c.pending...)
+	return nil
+}
+
+func (c *ledgerConn) Rollback() error {
+	c.pending = nil
+	return nil
+}
+
+type ledgerStmt struct {
+	conn *ledgerConn
+}
+
+func (s ledgerStmt) Close() error  { return nil }
+func (s ledgerStmt) NumInput() int { return -1 }
+
+func (s ledgerStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.pending = append(s.conn.pending, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (s ledgerStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, io.EOF
+}
+
+// committedRows returns the rows committed since the last call.
+func (db *ledgerDB) committedRows() [][]driver.Value {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	rows := db.rows
+	db.rows = nil
+	return rows
+}
+
+func TestApplyInTx(t *testing.T) {
+	quiet(t)
+
+	db, err := sql.Open("vaultflow-ledger", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		name        string
+		ops         []Operation
+		concurrent  func(sm *StateMachine)
+		failCommit  bool
+		expectedErr error
+		expected    map[string]int
+	}{
+		{"Committed", []Operation{
+			{Type: OpWithdraw, From: "acc1", Amount: 30},
+			{Type: OpDeposit, To: "acc2", Amount: 30},
+		}, nil, false, nil, map[string]int{"acc1": 70, "acc2": 30}},
+		{"Invalidated by a concurrent operation", []Operation{
+			{Type: OpWithdraw, From: "acc1", Amount: 80},
+		}, func(sm *StateMachine) { _ = sm.Withdraw("acc1", 50) }, false, ErrInsufficientBalance, map[string]int{"acc1": 50, "acc2": 0}},
+		{"Host commit fails", []Operation{
+			{Type: OpDeposit, To: "acc2", Amount: 10},
+		}, nil, true, errCommitFailed, map[string]int{"acc1": 100, "acc2": 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 0}}
+			testLedger.failCommit = tt.failCommit
+			defer func() { testLedger.failCommit = false }()
+
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			etx, err := sm.ApplyInTx(ctx, tx, tt.ops...)
+			if err != nil {
+				t.Fatalf("ApplyInTx() error = %v", err)
+			}
+			if tt.concurrent != nil {
+				tt.concurrent(sm)
+			}
+
+			err = etx.Commit()
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Commit() error = %v; want %v", err, tt.expectedErr)
+			}
+			if err := etx.Commit(); !errors.Is(err, ErrTxDone) {
+				t.Errorf("second Commit() error = %v; want ErrTxDone", err)
+			}
+			for id, want := range tt.expected {
+				if balance, _ := sm.Balance(id); balance != want {
+					t.Errorf("Balance(%s) = %d; want %d", id, balance, want)
+				}
+			}
+
+			rows := testLedger.committedRows()
+			if tt.expectedErr != nil {
+				if len(rows) != 0 {
+					t.Errorf("committed rows = %v; want none", rows)
+				}
+				return
+			}
+			if len(rows) != len(tt.ops) {
+				t.Fatalf("committed rows = %v; want %d", rows, len(tt.ops))
+			}
+			for i, op := range etx.Operations() {
+				var written Operation
+				_ = json.Unmarshal([]byte(rows[i][2].(string)), &written)
+				if rows[i][0] != op.ID || rows[i][1] != int64(sm.Version()) || written.ID != op.ID || written.Version != op.Version {
+					t.Errorf("row %d = %v; want operation %s of version %d", i, rows[i], op.ID, sm.Version())
+				}
+			}
+		})
+	}
+}
+
+func TestEmbeddedTxRollback(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	coord := &recordingCoordinator{}
+	etx, err := sm.Embed(context.Background(), coord)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := etx.Deposit("acc1", 10); err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := etx.Balance("acc1"); balance != 110 {
+		t.Errorf("etx.Balance(acc1) = %d; want 110", balance)
+	}
+	if err := etx.Rollback(); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+
+	if !coord.rolledBack || coord.committed || coord.written != nil {
+		t.Errorf("coordinator = %+v; want only rolled back", coord)
+	}
+	if balance, _ := sm.Balance("acc1"); balance != 100 || sm.Version() != 0 {
+		t.Errorf("Balance(acc1) = %d at version %d; want 100 at 0", balance, sm.Version())
+	}
+
+	// A failed write rolls back the host transaction.
+	coord = &recordingCoordinator{failWrite: true}
+	etx, _ = sm.Embed(context.Background(), coord)
+	_ = etx.Deposit("acc1", 10)
+	if err := etx.Commit(); err == nil || !coord.rolledBack || coord.committed {
+		t.Errorf("Commit() error = %v, coordinator = %+v; want an error and a rollback", err, coord)
+	}
+}
+
+type recordingCoordinator struct {
+	failWrite  bool
+	written    []Operation
+	committed  bool
+	rolledBack bool
+}
+
+func (c *recordingCoordinator) Write(ctx context.Context, ops []Operation) error {
+	if c.failWrite {
+		return errors.New("write failed")
+	}
+	c.written = ops
+	return nil
+}
+
+func (c *recordingCoordinator) Commit() error {
+	c.committed = true
+	return nil
+}
+
+func (c *recordingCoordinator) Rollback() error {
+	c.rolledBack = true
+	return nil
+}
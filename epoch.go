@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrStaleEpoch is matched by a StaleEpochError.
+var ErrStaleEpoch = errors.New("stale epoch")
+
+// EpochHeader carries the epoch of the state. The API answers it on every
+// response, and a request sending it is only applied in that epoch; a stale
+// one is answered 412 with the current epoch.
+const EpochHeader = "X-Epoch"
+
+// StaleEpochError is returned for an operation made for an epoch that
+// ended: the state was rolled back or restored since, so the operation may
+// no longer make sense, e.g. a retry of a transfer that was rolled back.
+type StaleEpochError struct {
+	Epoch   string // the operation was made for
+	Current string
+}
+
+func (e *StaleEpochError) Error() string {
+	return fmt.Sprintf("%s: operation for epoch %s, the state is at epoch %s", ErrStaleEpoch, e.Epoch, e.Current)
+}
+
+func (e *StaleEpochError) Is(target error) bool {
+	return target == ErrStaleEpoch
+}
+
+type epochKey struct{}
+
+// WithEpoch fences the operations run with ctx, including transactions, to
+// the given epoch, see Epoch. An empty epoch applies them in any epoch.
+func WithEpoch(ctx context.Context, epoch string) context.Context {
+	return context.WithValue(ctx, epochKey{}, epoch)
+}
+
+func EpochFrom(ctx context.Context) string {
+	epoch, _ := ctx.Value(epochKey{}).(string)
+	return epoch
+}
+
+// fence sets the epoch of op from ctx, unless op has one.
+func fence(ctx context.Context, op Operation) Operation {
+	if op.Epoch == "" {
+		op.Epoch = EpochFrom(ctx)
+	}
+	return op
+}
+
+// Epoch returns the epoch of the state: a token, unique to the state machine,
+// that changes whenever the state is rolled back or restored. A client that
+// read the state in an epoch can make its changes, and retry them, with
+// that Epoch set, or with WithEpoch, so they are rejected with a
+// StaleEpochError rather than applied to a state that moved back under
+// them. An epoch starts when first read.
+func (sm *StateMachine) Epoch() string {
+	if epoch := sm.epoch.Load(); epoch != nil {
+		return *epoch
+	}
+	epoch := sm.ids.next(sm.now())
+	if !sm.epoch.CompareAndSwap(nil, &epoch) {
+		return *sm.epoch.Load()
+	}
+	return epoch
+}
+
+// endEpoch ends the current epoch, after a rollback or a restore. sm.mu
+// must be held.
+func (sm *StateMachine) endEpoch() {
+	sm.epoch.Store(nil)
+}
+
+// checkEpoch fails with a StaleEpochError unless epoch is empty or the
+// current one. sm.mu must be held, so the epoch cannot end in between.
+func (sm *StateMachine) checkEpoch(epoch string) error {
+	if epoch == "" {
+		return nil
+	}
+	if current := sm.Epoch(); epoch != current {
+		return &StaleEpochError{Epoch: epoch, Current: current}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStateMachineEpoch(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+	epoch := sm.Epoch()
+	if epoch == "" {
+		t.Fatal("Epoch() is empty")
+	}
+	_ = sm.Deposit("acc1", 100)
+	_ = sm.Withdraw("acc2", 10) // rejected
+	if got := sm.Epoch(); got != epoch {
+		t.Fatalf("Epoch() = %s after operations; want %s", got, epoch)
+	}
+
+	ctx := WithEpoch(context.Background(), epoch)
+	if _, err := sm.execute(ctx, Operation{Type: OpDeposit, To: "acc1", Amount: 10}); err != nil {
+		t.Fatalf("deposit in the current epoch: %v", err)
+	}
+
+	if err := sm.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	rolledBack := sm.Epoch()
+	if rolledBack == epoch {
+		t.Fatal("Epoch() unchanged by a rollback")
+	}
+
+	version := sm.Version()
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"Operation", func() error {
+			_, err := sm.execute(context.Background(), Operation{Type: OpDeposit, To: "acc1", Amount: 10, Epoch: epoch})
+			return err
+		}},
+		{"Context", func() error {
+			_, err := sm.execute(ctx, Operation{Type: OpDeposit, To: "acc1", Amount: 10})
+			return err
+		}},
+		{"Tx", func() error {
+			return sm.TxContext(ctx, func(tx *Tx) error { return tx.Transfer("acc1", "acc2", 10) })
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.run()
+			var staleErr *StaleEpochError
+			if !errors.As(err, &staleErr) || !errors.Is(err, ErrStaleEpoch) {
+				t.Fatalf("error = %v; want a StaleEpochError", err)
+			}
+			if staleErr.Epoch != epoch || staleErr.Current != rolledBack {
+				t.Errorf("StaleEpochError = %+v; want epoch %s, current %s", staleErr, epoch, rolledBack)
+			}
+			if sm.Version() != version {
+				t.Errorf("Version() = %d; want %d, nothing applied", sm.Version(), version)
+			}
+		})
+	}
+
+	var b bytes.Buffer
+	if err := sm.Backup(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Restore(&b, LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	if got := sm.Epoch(); got == rolledBack {
+		t.Error("Epoch() unchanged by a restore")
+	}
+}
+
+func TestServerEpoch(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+	deposit := func(epoch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/accounts/acc1/deposit", strings.NewReader(`{"amount": 100}`))
+		if epoch != "" {
+			req.Header.Set(EpochHeader, epoch)
+		}
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := deposit("")
+	epoch := rec.Header().Get(EpochHeader)
+	if rec.Code != http.StatusOK || epoch != sm.Epoch() {
+		t.Fatalf("deposit = %d with epoch %q; want 200 with %q", rec.Code, epoch, sm.Epoch())
+	}
+	if rec := deposit(epoch); rec.Code != http.StatusOK {
+		t.Fatalf("deposit in the current epoch = %d (%s)", rec.Code, rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/rollback", nil))
+	current := rec.Header().Get(EpochHeader)
+	if rec.Code != http.StatusOK || current == epoch || current != sm.Epoch() {
+		t.Fatalf("rollback = %d with epoch %q; want 200 with a new epoch %q", rec.Code, current, sm.Epoch())
+	}
+
+	rec = deposit(epoch)
+	if rec.Code != http.StatusPreconditionFailed || rec.Header().Get(EpochHeader) != current {
+		t.Errorf("retried deposit = %d with epoch %q; want 412 with %q", rec.Code, rec.Header().Get(EpochHeader), current)
+	}
+	if balance, _ := sm.Balance("acc1"); balance != 1100 {
+		t.Errorf("Balance() = %d; want 1100, the retry not applied", balance)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownEscrow = errors.New("unknown escrow")
+	ErrEscrowSettled = errors.New("escrow already settled")
+	// ErrEscrowAccount is returned for operations touching the account of an
+	// escrow other than through CreateEscrow, ReleaseEscrow and RefundEscrow.
+	ErrEscrowAccount = errors.New("escrow accounts only move through their escrow")
+)
+
+// escrowAccountPrefix starts the IDs of the accounts holding escrowed funds.
+const escrowAccountPrefix = "escrow:"
+
+// escrowExpiryInterval is how often the server refunds expired escrows.
+const escrowExpiryInterval = time.Second
+
+type EscrowStatus string
+
+const (
+	EscrowHeld     EscrowStatus = "held"
+	EscrowReleased EscrowStatus = "released" // paid to To
+	EscrowRefunded EscrowStatus = "refunded" // paid back to From
+)
+
+// Escrow is an amount taken from From and held until it is released to To
+// or refunded to From. An escrow with an ExpiresAt is refunded once it
+// expires, see RunEscrowExpiry.
+//
+// The funds are held in an account of their own, "escrow:<id>", so they
+// stay in the balances, snapshots and history like any other funds, and
+// every movement is journaled with the escrow's ID as its "escrow" metadata.
+type Escrow struct {
+	ID        string       `json:"id"`
+	From      string       `json:"from"`
+	To        string       `json:"to"`
+	Amount    int          `json:"amount"`
+	CreatedAt time.Time    `json:"created_at"`
+	ExpiresAt time.Time    `json:"expires_at"` // zero if it never expires
+	Status    EscrowStatus `json:"status"`
+	SettledAt time.Time    `json:"settled_at"` // zero while held
+}
+
+// Account returns the ID of the account holding the escrowed funds.
+func (e Escrow) Account() string {
+	return escrowAccountPrefix + e.ID
+}
+
+// escrows holds every escrow, in the order they were created. Its lock is
+// never held while taking the state lock, but may be taken with it held.
+type escrows struct {
+	mu    sync.Mutex
+	byID  map[string]*Escrow
+	order []string
+}
+
+func (es *escrows) add(e Escrow) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.byID == nil {
+		es.byID = map[string]*Escrow{}
+	}
+	es.byID[e.ID] = &e
+	es.order = append(es.order, e.ID)
+}
+
+// list returns every escrow, oldest first.
+func (es *escrows) list() []Escrow {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	list := make([]Escrow, 0, len(es.order))
+	for _, id := range es.order {
+		list = append(list, *es.byID[id])
+	}
+	return list
+}
+
+// restore replaces the escrows with list.
+func (es *escrows) restore(list []Escrow) {
+	es.mu.Lock()
+	es.byID, es.order = nil, nil
+	es.mu.Unlock()
+	for _, e := range list {
+		es.add(e)
+	}
+}
+
+type escrowKey struct{}
+
+// checkEscrowAccounts fails with ErrEscrowAccount if op touches an escrow
+// account and ctx does not come from the escrow functions.
+func checkEscrowAccounts(ctx context.Context, op Operation) error {
+	if ctx.Value(escrowKey{}) != nil {
+		return nil
+	}
+	for _, id := range op.accounts() {
+		if strings.HasPrefix(id, escrowAccountPrefix) {
+			return fmt.Errorf("%w (%s)", ErrEscrowAccount, id)
+		}
+	}
+	return nil
+}
+
+// CreateEscrow takes amount from one account and holds it until it is
+// released to another or refunded. A zero expiresAt means the escrow never
+// expires. Funding an escrow is a transfer, so like in a transaction it
+// fails with ErrApprovalRequired above the approval threshold.
+func (sm *StateMachine) CreateEscrow(ctx context.Context, from, to string, amount int, expiresAt time.Time) (Escrow, error) {
+	if from == "" || to == "" || from == to || amount <= 0 {
+		return Escrow{}, fmt.Errorf("%w: an escrow needs a payer, another payee and a positive amount", ErrInvalidOperation)
+	}
+	if err := checkEscrowAccounts(context.Background(), Operation{From: from, To: to}); err != nil {
+		return Escrow{}, err
+	}
+	if _, err := sm.Balance(to); err != nil {
+		return Escrow{}, err
+	}
+
+	now := sm.now()
+	e := Escrow{
+		ID:        sm.ids.next(now),
+		From:      from,
+		To:        to,
+		Amount:    amount,
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+		Status:    EscrowHeld,
+	}
+	ctx = context.WithValue(ctx, escrowKey{}, e.ID)
+	err := sm.TxContext(ctx, func(tx *Tx) error {
+		if err := tx.Open(e.Account(), 0); err != nil {
+			return err
+		}
+		return tx.Apply(e.operation(from, e.Account(), "held"))
+	})
+	if err != nil {
+		return Escrow{}, err
+	}
+	sm.escrows.add(e)
+
+	fmt.Printf("\n\nHolding %d from account %s for account %s in escrow %s\n", amount, from, to, e.ID)
+	return e, nil
+}
+
+// operation returns the transfer moving the escrowed amount.
+func (e Escrow) operation(from, to, event string) Operation {
+	return Operation{
+		Type:     OpTransfer,
+		From:     from,
+		To:       to,
+		Amount:   e.Amount,
+		Memo:     fmt.Sprintf("escrow %s %s", e.ID, event),
+		Metadata: map[string]string{"escrow": e.ID},
+	}
+}
+
+// ReleaseEscrow pays a held escrow to its payee.
+func (sm *StateMachine) ReleaseEscrow(ctx context.Context, id string) (Escrow, error) {
+	return sm.settleEscrow(ctx, id, EscrowReleased)
+}
+
+// RefundEscrow pays a held escrow back to its payer.
+func (sm *StateMachine) RefundEscrow(ctx context.Context, id string) (Escrow, error) {
+	return sm.settleEscrow(ctx, id, EscrowRefunded)
+}
+
+// settleEscrow moves a held escrow's funds out as status says. An expired
+// escrow can only be refunded. If the funds cannot be moved, e.g. because
+// the operation holding them was rolled back, the escrow stays held.
+func (sm *StateMachine) settleEscrow(ctx context.Context, id string, status EscrowStatus) (Escrow, error) {
+	now := sm.now()
+
+	sm.escrows.mu.Lock()
+	e, ok := sm.escrows.byID[id]
+	if !ok {
+		sm.escrows.mu.Unlock()
+		return Escrow{}, fmt.Errorf("%w (%s)", ErrUnknownEscrow, id)
+	}
+	if e.Status != EscrowHeld {
+		defer sm.escrows.mu.Unlock()
+		return *e, fmt.Errorf("%w: %s is %s", ErrEscrowSettled, id, e.Status)
+	}
+	if status == EscrowReleased && !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt) {
+		defer sm.escrows.mu.Unlock()
+		return *e, fmt.Errorf("%w: %s expired at %s and can only be refunded", ErrEscrowSettled, id, e.ExpiresAt.Format(time.RFC3339))
+	}
+	// Settle it now, so it cannot be settled twice meanwhile.
+	e.Status, e.SettledAt = status, now
+	settled := *e
+	sm.escrows.mu.Unlock()
+
+	op := settled.operation(settled.Account(), settled.To, "released")
+	if status == EscrowRefunded {
+		op = settled.operation(settled.Account(), settled.From, "refunded")
+	}
+	ctx = context.WithValue(context.WithValue(ctx, escrowKey{}, id), approvedKey{}, id)
+	if _, err := sm.ApplyContext(ctx, op); err != nil {
+		sm.escrows.mu.Lock()
+		defer sm.escrows.mu.Unlock()
+		e.Status, e.SettledAt = EscrowHeld, time.Time{} // it may be tried again
+		return *e, err
+	}
+
+	fmt.Printf("\n\nEscrow %s %s\n", id, status)
+	return settled, nil
+}
+
+// Escrow returns the escrow with the given ID, whatever its status.
+func (sm *StateMachine) Escrow(id string) (Escrow, error) {
+	sm.escrows.mu.Lock()
+	defer sm.escrows.mu.Unlock()
+
+	e, ok := sm.escrows.byID[id]
+	if !ok {
+		return Escrow{}, fmt.Errorf("%w (%s)", ErrUnknownEscrow, id)
+	}
+	return *e, nil
+}
+
+// Escrows returns every escrow, oldest first.
+func (sm *StateMachine) Escrows() []Escrow {
+	return sm.escrows.list()
+}
+
+// RefundExpiredEscrows refunds the held escrows that have expired and
+// returns how many were refunded.
+func (sm *StateMachine) RefundExpiredEscrows(ctx context.Context) int {
+	now := sm.now()
+	refunded := 0
+	for _, e := range sm.escrows.list() {
+		if e.Status != EscrowHeld || e.ExpiresAt.IsZero() || now.Before(e.ExpiresAt) {
+			continue
+		}
+		if _, err := sm.RefundEscrow(ctx, e.ID); err != nil {
+			fmt.Println("Escrow Error:", err)
+			continue
+		}
+		refunded++
+	}
+	return refunded
+}
+
+// RunEscrowExpiry calls RefundExpiredEscrows every interval until ctx is
+// done.
+func (sm *StateMachine) RunEscrowExpiry(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sm.RefundExpiredEscrows(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEscrow(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name             string
+		settle           func(sm *StateMachine, id string) (Escrow, error)
+		expectedStatus   EscrowStatus
+		expectedBalances map[string]int
+	}{
+		{
+			"Release",
+			func(sm *StateMachine, id string) (Escrow, error) { return sm.ReleaseEscrow(context.Background(), id) },
+			EscrowReleased,
+			map[string]int{"buyer": 700, "seller": 300},
+		},
+		{
+			"Refund",
+			func(sm *StateMachine, id string) (Escrow, error) { return sm.RefundEscrow(context.Background(), id) },
+			EscrowRefunded,
+			map[string]int{"buyer": 1000, "seller": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"buyer": 1000, "seller": 0}}
+			e, err := sm.CreateEscrow(context.Background(), "buyer", "seller", 300, time.Time{})
+			if err != nil {
+				t.Fatalf("CreateEscrow() error = %v", err)
+			}
+			if balances := sm.Balances(); balances["buyer"] != 700 || balances[e.Account()] != 300 {
+				t.Fatalf("Balances() = %v; want 300 held in %s", balances, e.Account())
+			}
+
+			// The held funds cannot be moved but through the escrow.
+			if err := sm.Transfer(e.Account(), "buyer", 300); !errors.Is(err, ErrEscrowAccount) {
+				t.Errorf("Transfer() from the escrow account error = %v; want ErrEscrowAccount", err)
+			}
+			if err := sm.Tx(func(tx *Tx) error { return tx.Withdraw(e.Account(), 1) }); !errors.Is(err, ErrEscrowAccount) {
+				t.Errorf("Tx withdrawing from the escrow account error = %v; want ErrEscrowAccount", err)
+			}
+
+			settled, err := tt.settle(sm, e.ID)
+			if err != nil {
+				t.Fatalf("Settling error = %v", err)
+			}
+			if settled.Status != tt.expectedStatus || settled.SettledAt.IsZero() {
+				t.Errorf("Settled escrow = %+v; want %s", settled, tt.expectedStatus)
+			}
+			balances := sm.Balances()
+			if balances[e.Account()] != 0 {
+				t.Errorf("Escrow account holds %d after settling; want 0", balances[e.Account()])
+			}
+			delete(balances, e.Account())
+			if !maps.Equal(balances, tt.expectedBalances) {
+				t.Errorf("Balances() = %v; want %v", balances, tt.expectedBalances)
+			}
+
+			for _, again := range tests {
+				if _, err := again.settle(sm, e.ID); !errors.Is(err, ErrEscrowSettled) {
+					t.Errorf("Settling a settled escrow error = %v; want ErrEscrowSettled", err)
+				}
+			}
+			if ops := sm.OperationsWithMetadata(map[string]string{"escrow": e.ID}); len(ops) != 2 {
+				t.Errorf("Escrow operations = %+v; want the hold and the settlement", ops)
+			}
+		})
+	}
+}
+
+func TestCreateEscrowInvalid(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name        string
+		from, to    string
+		amount      int
+		expectedErr error
+	}{
+		{"Unknown payee", "buyer", "nobody", 10, ErrInvalidAccount},
+		{"Unknown payer", "nobody", "seller", 10, ErrInvalidAccount},
+		{"Insufficient balance", "buyer", "seller", 2000, ErrInsufficientBalance},
+		{"Zero amount", "buyer", "seller", 0, ErrInvalidOperation},
+		{"Same account", "buyer", "buyer", 10, ErrInvalidOperation},
+		{"From another escrow", "escrow:x", "seller", 10, ErrEscrowAccount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"buyer": 1000, "seller": 0}}
+			if _, err := sm.CreateEscrow(context.Background(), tt.from, tt.to, tt.amount, time.Time{}); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("CreateEscrow() error = %v; want %v", err, tt.expectedErr)
+			}
+			if escrows := sm.Escrows(); len(escrows) != 0 {
+				t.Errorf("Escrows() = %+v; want none", escrows)
+			}
+			if balances := sm.Balances(); len(balances) != 2 {
+				t.Errorf("Balances() = %v; want no escrow account", balances)
+			}
+		})
+	}
+}
+
+func TestEscrowExpiry(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"buyer": 1000, "seller": 0}}
+	sm.UseClock(clock)
+	expiring, _ := sm.CreateEscrow(context.Background(), "buyer", "seller", 100, clock.Now().Add(time.Hour))
+	lasting, _ := sm.CreateEscrow(context.Background(), "buyer", "seller", 200, time.Time{})
+
+	if refunded := sm.RefundExpiredEscrows(context.Background()); refunded != 0 {
+		t.Errorf("RefundExpiredEscrows() before expiry = %d; want 0", refunded)
+	}
+	clock.Advance(time.Hour)
+	if _, err := sm.ReleaseEscrow(context.Background(), expiring.ID); !errors.Is(err, ErrEscrowSettled) {
+		t.Errorf("ReleaseEscrow() of an expired escrow error = %v; want ErrEscrowSettled", err)
+	}
+	if refunded := sm.RefundExpiredEscrows(context.Background()); refunded != 1 {
+		t.Errorf("RefundExpiredEscrows() = %d; want 1", refunded)
+	}
+
+	if e, _ := sm.Escrow(expiring.ID); e.Status != EscrowRefunded {
+		t.Errorf("Expired escrow status = %s; want refunded", e.Status)
+	}
+	if e, _ := sm.Escrow(lasting.ID); e.Status != EscrowHeld {
+		t.Errorf("Escrow without expiry status = %s; want held", e.Status)
+	}
+	if balance, _ := sm.Balance("buyer"); balance != 800 {
+		t.Errorf("Buyer balance = %d; want 800", balance)
+	}
+}
+
+func TestEscrowRolledBack(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"buyer": 1000, "seller": 0}}
+	e, _ := sm.CreateEscrow(context.Background(), "buyer", "seller", 100, time.Time{})
+	if err := sm.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sm.ReleaseEscrow(context.Background(), e.ID); err == nil {
+		t.Fatalf("ReleaseEscrow() of a rolled back escrow succeeded")
+	}
+	if e, _ := sm.Escrow(e.ID); e.Status != EscrowHeld {
+		t.Errorf("Escrow status = %s after a failed release; want held", e.Status)
+	}
+}
+
+func TestEscrowSnapshot(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"buyer": 1000, "seller": 0}}
+	e, _ := sm.CreateEscrow(context.Background(), "buyer", "seller", 100, time.Time{})
+	var buf bytes.Buffer
+	if err := sm.WriteSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &StateMachine{}
+	if err := restored.ReadSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if escrows := restored.Escrows(); len(escrows) != 1 || !escrows[0].CreatedAt.Equal(e.CreatedAt) || escrows[0].ID != e.ID {
+		t.Fatalf("Escrows() = %+v; want %+v", escrows, e)
+	}
+	if _, err := restored.ReleaseEscrow(context.Background(), e.ID); err != nil {
+		t.Fatalf("ReleaseEscrow() after restoring error = %v", err)
+	}
+	if balance, _ := restored.Balance("seller"); balance != 100 {
+		t.Errorf("Seller balance = %d; want 100", balance)
+	}
+}
+
+func TestServerEscrow(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"buyer": 1000, "seller": 0})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/escrows", `{"from": "buyer", "to": "seller", "amount": 250}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /escrows = %d; want 201 (%s)", rec.Code, rec.Body)
+	}
+	var created escrowResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Status != EscrowHeld || created.ExpiresAt != nil || !strings.HasPrefix(created.Account, escrowAccountPrefix) {
+		t.Errorf("POST /escrows = %+v; want a held escrow without expiry", created)
+	}
+
+	tests := []struct {
+		name           string
+		method, path   string
+		expectedStatus int
+	}{
+		{"Get", http.MethodGet, "/escrows/" + created.ID, http.StatusOK},
+		{"Unknown", http.MethodGet, "/escrows/nope", http.StatusNotFound},
+		{"Withdraw from the escrow account", http.MethodPost, "/accounts/" + created.Account + "/withdraw", http.StatusForbidden},
+		{"Release", http.MethodPost, "/escrows/" + created.ID + "/release", http.StatusOK},
+		{"Refund after release", http.MethodPost, "/escrows/" + created.ID + "/refund", http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.method, tt.path, `{"amount": 1}`); rec.Code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+
+	if balance, _ := sm.Balance("seller"); balance != 250 {
+		t.Errorf("Seller balance = %d; want 250", balance)
+	}
+}
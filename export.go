@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidExportFormat is returned for an unknown export format.
+var ErrInvalidExportFormat = errors.New("invalid export format")
+
+// ExportFormat is the file format of warehouse exports, see Export.
+type ExportFormat string
+
+const (
+	ExportCSV     ExportFormat = "csv"
+	ExportParquet ExportFormat = "parquet"
+)
+
+// exportDateFormat names the date partitions of exports.
+const exportDateFormat = "2006-01-02"
+
+// ParseExportFormat parses the name of an export format, CSV if empty.
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch f := ExportFormat(name); f {
+	case "", ExportCSV:
+		return ExportCSV, nil
+	case ExportParquet:
+		return f, nil
+	}
+	return "", fmt.Errorf("%w: %q, want csv or parquet", ErrInvalidExportFormat, name)
+}
+
+// ExportOptions configure where and how exports are written.
+type ExportOptions struct {
+	Prefix string       // prepended to the key of every file, e.g. "prod/"
+	Format ExportFormat // CSV if empty
+
+	// Compression compresses Parquet pages with gzip or snappy, and CSV
+	// files with gzip; snappy has no standard framing for CSV, which is
+	// left uncompressed with it.
+	Compression Compression
+}
+
+type columnKind int
+
+const (
+	columnString columnKind = iota
+	columnInt
+	columnTime
+)
+
+type exportColumn struct {
+	name string
+	kind columnKind
+}
+
+// exportTable is a table of an export. Its rows hold a string, an int or a
+// time.Time per column, as its kind says.
+type exportTable struct {
+	columns []exportColumn
+	rows    [][]any
+}
+
+var (
+	accountColumns = []exportColumn{
+		{"id", columnString},
+		{"balance", columnInt},
+		{"status", columnString},
+		{"version", columnInt},
+		{"exported_at", columnTime},
+	}
+	operationColumns = []exportColumn{
+		{"id", columnString},
+		{"type", columnString},
+		{"from", columnString},
+		{"to", columnString},
+		{"amount", columnInt},
+		{"version", columnInt},
+		{"time", columnTime},
+		{"correlation_id", columnString},
+		{"memo", columnString},
+		{"category", columnString},
+	}
+)
+
+// Export writes a dump of the accounts and of the operations applied since
+// the previous export to store, for ingestion into an analytics warehouse.
+// Files are partitioned by date, in the directories warehouses read as a
+// date column: the accounts under accounts/date=<day of the export>/, with
+// their balance and status, archived accounts included with status
+// archived, and the operations under operations/date=<day applied>/. It
+// returns the keys of the files written.
+//
+// Which operations were exported is kept in memory, so the first export
+// after a restart dumps every operation in the journal again; warehouses
+// should deduplicate them by id. Operations rolled back after they were
+// exported stay in the export.
+func (sm *StateMachine) Export(ctx context.Context, store ObjectStore, opts ExportOptions) ([]string, error) {
+	format, err := ParseExportFormat(string(opts.Format))
+	if err != nil {
+		return nil, err
+	}
+
+	sm.mu.Lock()
+	now := sm.now().UTC()
+	accounts := exportTable{columns: accountColumns}
+	for id, balance := range sm.accounts {
+		if !isBucketKey(id) {
+			accounts.rows = append(accounts.rows, []any{id, balance, string(sm.status(id)), sm.version, now})
+		}
+	}
+	for id, archived := range sm.archived {
+		accounts.rows = append(accounts.rows, []any{id, archived.Balance, "archived", sm.version, now})
+	}
+	var ops []Operation
+	for _, op := range sm.journal {
+		if op.ID > sm.exported {
+			ops = append(ops, op)
+		}
+	}
+	sm.mu.Unlock()
+	slices.SortFunc(accounts.rows, func(a, b []any) int { return cmp.Compare(a[0].(string), b[0].(string)) })
+
+	stamp := now.Format(archiveTimeFormat)
+	var keys []string
+	put := func(table, day string, t exportTable) error {
+		data, err := encodeExport(t, format, opts.Compression)
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%sexport/%s/date=%s/%s-%s.%s", opts.Prefix, table, day, table, stamp, format)
+		if format == ExportCSV && opts.Compression == CompressionGzip {
+			key += ".gz"
+		}
+		if err := store.Put(ctx, key, data); err != nil {
+			return fmt.Errorf("export %s: %w", key, err)
+		}
+		keys = append(keys, key)
+		return nil
+	}
+
+	if err := put("accounts", now.Format(exportDateFormat), accounts); err != nil {
+		return keys, err
+	}
+	for len(ops) > 0 {
+		day := ops[0].Time.UTC().Format(exportDateFormat)
+		n := 1
+		for n < len(ops) && ops[n].Time.UTC().Format(exportDateFormat) == day {
+			n++
+		}
+		t := exportTable{columns: operationColumns}
+		for _, op := range ops[:n] {
+			t.rows = append(t.rows, []any{op.ID, string(op.Type), op.From, op.To, op.Amount, op.Version, op.Time, op.CorrelationID, op.Memo, op.Category})
+		}
+		if err := put("operations", day, t); err != nil {
+			return keys, err
+		}
+
+		sm.mu.Lock()
+		sm.exported = max(sm.exported, ops[n-1].ID)
+		sm.mu.Unlock()
+		ops = ops[n:]
+	}
+	return keys, nil
+}
+
+// encodeExport encodes table as a file of format.
+func encodeExport(table exportTable, format ExportFormat, c Compression) ([]byte, error) {
+	if format == ExportParquet {
+		return writeParquet(table, c)
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	record := make([]string, len(table.columns))
+	for i, column := range table.columns {
+		record[i] = column.name
+	}
+	_ = w.Write(record)
+	for _, row := range table.rows {
+		for i, value := range row {
+			switch v := value.(type) {
+			case string:
+				record[i] = v
+			case int:
+				record[i] = strconv.Itoa(v)
+			case time.Time:
+				record[i] = v.UTC().Format(time.RFC3339Nano)
+			}
+		}
+		_ = w.Write(record)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+	if c != CompressionGzip {
+		return buf.Bytes(), nil
+	}
+
+	var out bytes.Buffer
+	zw := gzip.NewWriter(&out)
+	if _, err := zw.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// RunExports exports the accounts and operations every interval until ctx
+// is done, see Export.
+func (sm *StateMachine) RunExports(ctx context.Context, store ObjectStore, interval time.Duration, opts ExportOptions) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if keys, err := sm.Export(ctx, store, opts); err != nil {
+				fmt.Println("Export Error:", err)
+			} else {
+				fmt.Println("Exported", keys)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
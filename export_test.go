@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readCSV returns the records of an exported CSV file, gunzipped if need be.
+func readCSV(t *testing.T, key string, data []byte) [][]string {
+	t.Helper()
+	if strings.HasSuffix(key, ".gz") {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	return records
+}
+
+// exportedKeys returns keys without their time stamp, e.g.
+// "export/accounts/date=2026-01-02/accounts.csv".
+func exportedKeys(keys []string) []string {
+	var trimmed []string
+	for _, key := range keys {
+		stamp := strings.LastIndex(key, "-")
+		ext := stamp + strings.Index(key[stamp:], "Z.") + 1
+		trimmed = append(trimmed, key[:stamp]+key[ext:])
+	}
+	return trimmed
+}
+
+func TestExport(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 0, "acc3": 5}}
+	sm.UseClock(clock)
+	_ = sm.Deposit("acc1", 10)
+	clock.Advance(2 * time.Hour)
+	_ = sm.Transfer("acc1", "acc2", 30)
+	_ = sm.SetAccountStatus("acc2", StatusRestricted, "review")
+	_ = sm.ArchiveAccount("acc3")
+
+	if _, err := sm.Export(context.Background(), &failingStore{}, ExportOptions{}); err == nil {
+		t.Fatal("Export() to a failing store succeeded")
+	}
+
+	store := &memStore{}
+	keys, err := sm.Export(context.Background(), store, ExportOptions{Prefix: "prod/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"prod/export/accounts/date=2026-01-02/accounts.csv",
+		"prod/export/operations/date=2026-01-01/operations.csv",
+		"prod/export/operations/date=2026-01-02/operations.csv",
+	}
+	if got := exportedKeys(keys); !slices.Equal(got, want) {
+		t.Fatalf("Export() = %v; want %v", got, want)
+	}
+
+	accounts := readCSV(t, keys[0], store.objects[keys[0]])
+	wantAccounts := [][]string{
+		{"id", "balance", "status", "version", "exported_at"},
+		{"acc1", "80", "active", "4", "2026-01-02T01:00:00Z"},
+		{"acc2", "30", "restricted", "4", "2026-01-02T01:00:00Z"},
+		{"acc3", "5", "archived", "4", "2026-01-02T01:00:00Z"},
+	}
+	if !slices.EqualFunc(accounts, wantAccounts, slices.Equal) {
+		t.Errorf("Exported accounts = %q; want %q", accounts, wantAccounts)
+	}
+	first := readCSV(t, keys[1], store.objects[keys[1]])
+	if len(first) != 2 || first[1][1] != string(OpDeposit) || first[1][3] != "acc1" || first[1][4] != "10" {
+		t.Errorf("Operations of 2026-01-01 = %q; want the deposit", first)
+	}
+	if second := readCSV(t, keys[2], store.objects[keys[2]]); len(second) != 4 {
+		t.Errorf("Operations of 2026-01-02 = %q; want the transfer, status change and archival", second)
+	}
+
+	// Only operations applied since are exported again, here gzipped.
+	_ = sm.Deposit("acc1", 1)
+	keys, err = sm.Export(context.Background(), store, ExportOptions{Compression: CompressionGzip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !strings.HasSuffix(keys[1], ".csv.gz") {
+		t.Fatalf("Export() = %v; want the accounts and one file of operations, gzipped", keys)
+	}
+	if ops := readCSV(t, keys[1], store.objects[keys[1]]); len(ops) != 2 || ops[1][4] != "1" {
+		t.Errorf("Exported operations = %q; want the new deposit only", ops)
+	}
+
+	if _, err := sm.Export(context.Background(), store, ExportOptions{Format: "avro"}); !errors.Is(err, ErrInvalidExportFormat) {
+		t.Errorf("Export() error = %v; want %v", err, ErrInvalidExportFormat)
+	}
+	keys, _ = sm.Export(context.Background(), store, ExportOptions{Format: ExportParquet})
+	if len(keys) != 1 || !strings.HasSuffix(keys[0], ".parquet") || !bytes.HasPrefix(store.objects[keys[0]], parquetMagic) {
+		t.Errorf("Export() as Parquet = %v; want the accounts only", keys)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrUnknownFlag is returned for a feature flag that is not in knownFlags.
+var ErrUnknownFlag = errors.New("unknown feature flag")
+
+// Flag names a feature flag, gating an experimental behavior so operators can
+// roll it out gradually: enable it in the config of a few instances, or at
+// runtime with SetFlag, and turn it off again without a release.
+type Flag string
+
+const (
+	// FlagStateReads serves balance reads from the published State, never
+	// waiting for the state lock. Disabled, they read under the lock.
+	FlagStateReads Flag = "state_reads"
+)
+
+// FlagInfo describes a feature flag.
+type FlagInfo struct {
+	Default     bool   `json:"default"`
+	Description string `json:"description"`
+}
+
+// knownFlags lists every feature flag. A new subsystem registers its flag
+// here, disabled by default until it is rolled out.
+var knownFlags = map[Flag]FlagInfo{
+	FlagStateReads: {Default: true, Description: "serve balance reads from published state snapshots, without the state lock"},
+}
+
+// FlagState is a feature flag as it currently is.
+type FlagState struct {
+	FlagInfo
+	Name    Flag `json:"name"`
+	Enabled bool `json:"enabled"`
+}
+
+// flags holds the feature flags set to something else than their default.
+// Reads are lock-free, as flags are checked on hot paths.
+type flags struct {
+	mu  sync.Mutex // serializes changes
+	set atomic.Pointer[map[Flag]bool]
+}
+
+// Enabled reports whether a feature flag is on, its default unless set.
+// Unknown flags are off.
+func (sm *StateMachine) Enabled(flag Flag) bool {
+	if set := sm.flags.set.Load(); set != nil {
+		if enabled, ok := (*set)[flag]; ok {
+			return enabled
+		}
+	}
+	return knownFlags[flag].Default
+}
+
+// SetFlag turns a feature flag on or off, taking effect right away, on
+// behalf of the actor in ctx.
+func (sm *StateMachine) SetFlag(ctx context.Context, flag Flag, enabled bool) error {
+	if _, ok := knownFlags[flag]; !ok {
+		return fmt.Errorf("%w (%s)", ErrUnknownFlag, flag)
+	}
+
+	sm.flags.mu.Lock()
+	defer sm.flags.mu.Unlock()
+
+	set := map[Flag]bool{}
+	if current := sm.flags.set.Load(); current != nil {
+		set = maps.Clone(*current)
+	}
+	set[flag] = enabled
+	sm.flags.set.Store(&set)
+
+	fmt.Printf("\n\nFeature flag %s set to %t by %q\n", flag, enabled, ActorFrom(ctx))
+	return nil
+}
+
+// Flags returns every known feature flag as it currently is.
+func (sm *StateMachine) Flags() []FlagState {
+	states := make([]FlagState, 0, len(knownFlags))
+	for name, info := range knownFlags {
+		states = append(states, FlagState{FlagInfo: info, Name: name, Enabled: sm.Enabled(name)})
+	}
+	slices.SortFunc(states, func(a, b FlagState) int { return cmp.Compare(a.Name, b.Name) })
+	return states
+}
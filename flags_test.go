@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFlags(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	ctx := context.Background()
+
+	if !sm.Enabled(FlagStateReads) {
+		t.Errorf("Enabled(%s) = false; want its default, true", FlagStateReads)
+	}
+	if sm.Enabled("sharding") {
+		t.Error("Enabled() of an unknown flag = true")
+	}
+	if err := sm.SetFlag(ctx, "sharding", true); !errors.Is(err, ErrUnknownFlag) {
+		t.Errorf("SetFlag() of an unknown flag error = %v; want ErrUnknownFlag", err)
+	}
+
+	if err := sm.SetFlag(ctx, FlagStateReads, false); err != nil {
+		t.Fatal(err)
+	}
+	if sm.Enabled(FlagStateReads) {
+		t.Errorf("Enabled(%s) after turning it off = true", FlagStateReads)
+	}
+	flags := sm.Flags()
+	i := slices.IndexFunc(flags, func(f FlagState) bool { return f.Name == FlagStateReads })
+	if len(flags) != len(knownFlags) || i < 0 || flags[i].Enabled || !flags[i].Default {
+		t.Errorf("Flags() = %+v; want every flag, %s off but on by default", flags, FlagStateReads)
+	}
+}
+
+// TestFlagStateReads checks that reads agree with the flag on or off.
+func TestFlagStateReads(t *testing.T) {
+	quiet(t)
+
+	for _, enabled := range []bool{true, false} {
+		sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 0}}
+		if err := sm.SetFlag(context.Background(), FlagStateReads, enabled); err != nil {
+			t.Fatal(err)
+		}
+		if err := sm.Deposit("acc1", 10); err != nil {
+			t.Fatal(err)
+		}
+		if err := sm.ArchiveAccount("acc2"); err != nil {
+			t.Fatal(err)
+		}
+
+		if balance, err := sm.Balance("acc1"); err != nil || balance != 110 {
+			t.Errorf("Balance() with %s %t = %d, %v; want 110", FlagStateReads, enabled, balance, err)
+		}
+		if _, err := sm.Balance("acc2"); !errors.Is(err, ErrAccountArchived) {
+			t.Errorf("Balance() of an archived account with %s %t error = %v; want ErrAccountArchived", FlagStateReads, enabled, err)
+		}
+		if balances := sm.Balances(); len(balances) != 1 || balances["acc1"] != 110 {
+			t.Errorf("Balances() with %s %t = %v; want acc1 at 110", FlagStateReads, enabled, balances)
+		}
+	}
+}
+
+func TestServerFlags(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 100})
+
+	tests := []struct {
+		name           string
+		path, body     string
+		expectedStatus int
+	}{
+		{"Turn off", "/flags/state_reads", `{"enabled": false}`, http.StatusOK},
+		{"Unknown flag", "/flags/sharding", `{"enabled": true}`, http.StatusNotFound},
+		{"Bad body", "/flags/state_reads", `{"on": true}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("PUT %s = %d; want %d (%s)", tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+
+	if sm.Enabled(FlagStateReads) {
+		t.Errorf("Enabled(%s) after PUT /flags = true", FlagStateReads)
+	}
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/flags", nil))
+	var flags []FlagState
+	if err := json.Unmarshal(rec.Body.Bytes(), &flags); err != nil || !slices.Contains(flags, FlagState{FlagInfo: knownFlags[FlagStateReads], Name: FlagStateReads}) {
+		t.Errorf("GET /flags = %s; want state_reads off", rec.Body)
+	}
+}
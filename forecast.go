@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Bounds of how far ahead Forecast projects balances, in days for the API.
+const (
+	maxForecastHorizon  = 366 * 24 * time.Hour
+	defaultForecastDays = 30
+)
+
+// Forecast is the projected balance of an account at the end of each day,
+// in UTC, from At, when it was made, on.
+type Forecast struct {
+	Account string        `json:"account"`
+	At      time.Time     `json:"at"`
+	Balance int           `json:"balance"` // at At
+	Days    []ForecastDay `json:"days"`
+}
+
+// ForecastDay is the projection of a day. Shortfall is the sum of the
+// payments due that day the balance would not cover, which would fail, and
+// are not counted in Outflows nor Balance.
+type ForecastDay struct {
+	Date      string `json:"date"` // YYYY-MM-DD
+	Balance   int    `json:"balance"`
+	Inflows   int    `json:"inflows"`
+	Outflows  int    `json:"outflows"`
+	Shortfall int    `json:"shortfall,omitempty"`
+}
+
+// Shortfalls returns the days some payment would fail on.
+func (f Forecast) Shortfalls() []ForecastDay {
+	var days []ForecastDay
+	for _, day := range f.Days {
+		if day.Shortfall > 0 {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// forecastFlow is a scheduled movement of funds in or out of an account.
+type forecastFlow struct {
+	at     time.Time
+	amount int // negative for payments out
+}
+
+// Forecast projects the balance of an account over horizon, at most a
+// year, from the payments of its standing orders, both ways, and the
+// refunds of the held escrows it funded once they expire, so clients can
+// warn of upcoming shortfalls. Flows of the same time are applied inflows
+// first. Payments into the account are assumed to succeed; payments out
+// that the projected balance would not cover are counted as shortfalls and
+// left out, as they would fail, without the retries they may get. Escrows
+// held for the account are left out, as when they are released is not
+// known.
+func (sm *StateMachine) Forecast(accountId string, horizon time.Duration) (Forecast, error) {
+	if horizon <= 0 || horizon > maxForecastHorizon {
+		return Forecast{}, fmt.Errorf("%w: forecast horizon %s must be positive and at most %s", ErrInvalidOperation, horizon, maxForecastHorizon)
+	}
+	balance, err := sm.Balance(accountId)
+	if err != nil {
+		return Forecast{}, err
+	}
+	now := sm.now().UTC()
+	end := now.Add(horizon)
+
+	var flows []forecastFlow
+	for _, o := range sm.StandingOrders() {
+		amount := 0
+		switch {
+		case o.Cancelled, o.Every <= 0:
+		case o.From == accountId:
+			amount = -o.Amount
+		case o.To == accountId:
+			amount = o.Amount
+		}
+		if amount == 0 {
+			continue
+		}
+		// The next payment, or its retry, then one every Every.
+		at := o.Next
+		if !o.RetryAt.IsZero() {
+			at = o.RetryAt
+		}
+		for n := 1; !at.After(end); n++ {
+			flows = append(flows, forecastFlow{at: latest(at, now), amount: amount})
+			at = o.Next.Add(time.Duration(n) * o.Every)
+		}
+	}
+	for _, e := range sm.Escrows() {
+		if e.Status == EscrowHeld && e.From == accountId && !e.ExpiresAt.IsZero() && !e.ExpiresAt.After(end) {
+			flows = append(flows, forecastFlow{at: latest(e.ExpiresAt, now), amount: e.Amount})
+		}
+	}
+	slices.SortStableFunc(flows, func(a, b forecastFlow) int {
+		return cmp.Or(a.at.Compare(b.at), cmp.Compare(b.amount, a.amount))
+	})
+
+	f := Forecast{Account: accountId, At: now, Balance: balance}
+	for day := now.Truncate(24 * time.Hour); !day.After(end); day = day.AddDate(0, 0, 1) {
+		projected := ForecastDay{Date: day.Format(exportDateFormat)}
+		next := day.AddDate(0, 0, 1)
+		for len(flows) > 0 && flows[0].at.Before(next) {
+			switch amount := flows[0].amount; {
+			case amount > 0:
+				projected.Inflows += amount
+				balance += amount
+			case balance+amount < 0:
+				projected.Shortfall -= amount
+			default:
+				projected.Outflows -= amount
+				balance += amount
+			}
+			flows = flows[1:]
+		}
+		projected.Balance = balance
+		f.Days = append(f.Days, projected)
+	}
+	return f, nil
+}
+
+// latest returns the latest of a and b.
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestForecast(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 0, "acc3": 50}}
+	sm.UseClock(clock)
+	day := 24 * time.Hour
+	if _, err := sm.CreateStandingOrder("acc1", "acc2", 40, day, time.Date(2026, 1, 2, 9, 0, 0, 0, time.UTC), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.CreateStandingOrder("acc3", "acc1", 10, 2*day, time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC), 0); err != nil {
+		t.Fatal(err)
+	}
+	cancelled, _ := sm.CreateStandingOrder("acc2", "acc1", 1000, day, time.Time{}, 0)
+	_, _ = sm.CancelStandingOrder(cancelled.ID)
+	if _, err := sm.CreateEscrow(context.Background(), "acc1", "acc2", 20, time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		account string
+		want    []ForecastDay
+	}{
+		{"acc1", []ForecastDay{
+			{Date: "2026-01-01", Balance: 90, Inflows: 10},
+			{Date: "2026-01-02", Balance: 50, Outflows: 40},
+			{Date: "2026-01-03", Balance: 40, Inflows: 30, Outflows: 40},
+			{Date: "2026-01-04", Balance: 0, Outflows: 40},
+			{Date: "2026-01-05", Balance: 0, Shortfall: 40},
+		}},
+		{"acc3", []ForecastDay{
+			{Date: "2026-01-01", Balance: 40, Outflows: 10},
+			{Date: "2026-01-02", Balance: 40},
+			{Date: "2026-01-03", Balance: 30, Outflows: 10},
+			{Date: "2026-01-04", Balance: 30},
+			{Date: "2026-01-05", Balance: 30},
+		}},
+	}
+	for _, tt := range tests {
+		f, err := sm.Forecast(tt.account, 4*day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(f.Days, tt.want) {
+			t.Errorf("Forecast(%s) = %+v; want %+v", tt.account, f.Days, tt.want)
+		}
+	}
+
+	f, _ := sm.Forecast("acc1", 4*day)
+	if shortfalls := f.Shortfalls(); len(shortfalls) != 1 || shortfalls[0].Date != "2026-01-05" || f.Balance != 80 {
+		t.Errorf("Shortfalls() = %+v from %d; want 2026-01-05 from 80", shortfalls, f.Balance)
+	}
+	if _, err := sm.Forecast("acc1", 0); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Forecast() over no horizon error = %v; want %v", err, ErrInvalidOperation)
+	}
+	if _, err := sm.Forecast("nope", day); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("Forecast() of an unknown account error = %v; want %v", err, ErrInvalidAccount)
+	}
+}
+
+func TestServerForecast(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 100, "acc2": 0})
+	_, _ = sm.CreateStandingOrder("acc1", "acc2", 30, 24*time.Hour, sm.now().Add(time.Hour), 0)
+	handler := srv.Handler()
+
+	tests := []struct {
+		query string
+		code  int
+		days  int
+	}{
+		{"", http.StatusOK, 31},
+		{"?days=7", http.StatusOK, 8},
+		{"?days=1000", http.StatusBadRequest, 0},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/accounts/acc1/forecast"+tt.query, nil))
+		var f Forecast
+		_ = json.NewDecoder(rec.Body).Decode(&f)
+		if rec.Code != tt.code || len(f.Days) != tt.days {
+			t.Errorf("GET forecast%s = %d with %d days; want %d with %d", tt.query, rec.Code, len(f.Days), tt.code, tt.days)
+		}
+	}
+}
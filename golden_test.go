@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata/golden instead of comparing with them")
+
+// goldenDir holds the persisted forms of goldenMachine. Snapshots and
+// backups are named after their format version: a change of format adds a
+// file, and the files of earlier versions stay to check they still restore.
+const goldenDir = "testdata/golden"
+
+// goldenMachine returns a state machine whose persisted forms cover each
+// kind of record, with its time and IDs fixed so they serialize the same on
+// every run, and the events it published.
+func goldenMachine(t *testing.T) (*StateMachine, []Event) {
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 500}}
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	sm.UseClock(clock)
+	sm.UseRandom(rand.NewChaCha8([32]byte{}))
+	sm.EnableOutbox()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := sm.Subscribe(ctx)
+
+	step := func(err error) {
+		t.Helper()
+		clock.Advance(time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := sm.AddAlert(Alert{Kind: AlertWithdrawalAbove, Threshold: 100})
+	step(err)
+	step(sm.Deposit("acc1", 100))
+	_ = sm.Withdraw("acc2", 10000) // rejected, leaving a state in history
+	step(sm.Transfer("acc1", "acc2", 200))
+	step(sm.Deposit("acc2", 1))
+	step(sm.Rollback())
+	step(sm.OpenAccount("acc3", 30))
+	step(sm.Move("acc1", BucketAvailable, "reserved", 50))
+	step(sm.SetAccountTags("acc3", "savings"))
+	step(sm.SetAlias("main", "acc1"))
+	step(sm.SetAccountStatus("acc2", StatusRestricted, "audit"))
+	_, err = sm.CreateEscrow(context.Background(), "acc1", "acc3", 25, clock.Now().Add(24*time.Hour))
+	step(err)
+	_, err = sm.CreateStandingOrder("acc3", "acc1", 5, time.Hour, clock.Now().Add(time.Hour), time.Minute)
+	step(err)
+	step(sm.ArchiveAccount("acc3"))
+
+	var published []Event
+	for len(events) > 0 {
+		published = append(published, <-events)
+	}
+	return sm, published
+}
+
+// checkGolden compares got with the golden file of that name, or rewrites
+// the file with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join(goldenDir, name)
+	if *update {
+		if err := os.MkdirAll(goldenDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v; run go test -run TestGolden -update to write it", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s changed:\n%s\nwant:\n%s\nA change of format must bump its version and register a migration, see migrations; then rewrite the golden files with go test -run TestGolden -update.", name, got, want)
+	}
+}
+
+// indented returns the JSON written by write, indented for readable diffs.
+func indented(t *testing.T, write func(*bytes.Buffer) error) []byte {
+	t.Helper()
+	var data, out bytes.Buffer
+	if err := write(&data); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Indent(&out, data.Bytes(), "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	out.WriteByte('\n')
+	return out.Bytes()
+}
+
+func TestGoldenFormats(t *testing.T) {
+	quiet(t)
+
+	sm, events := goldenMachine(t)
+	tests := []struct {
+		name  string
+		write func(*bytes.Buffer) error
+	}{
+		{fmt.Sprintf("snapshot-v%d.json", snapshotVersion), func(b *bytes.Buffer) error { return sm.WriteSnapshot(b, nil) }},
+		{fmt.Sprintf("backup-v%d.json", backupFormat), func(b *bytes.Buffer) error { return sm.Backup(b) }},
+		{"state.json", func(b *bytes.Buffer) error {
+			return json.NewEncoder(b).Encode(map[string]any{"version": sm.State().Version(), "hash": sm.State().Hash()})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkGolden(t, tt.name, indented(t, tt.write))
+		})
+	}
+
+	t.Run("events.jsonl", func(t *testing.T) {
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		for _, event := range events {
+			if err := enc.Encode(event); err != nil {
+				t.Fatal(err)
+			}
+		}
+		checkGolden(t, "events.jsonl", b.Bytes())
+	})
+}
+
+// TestGoldenCompatibility checks that the golden files of every format
+// version still restore, and that those of the current one round-trip.
+func TestGoldenCompatibility(t *testing.T) {
+	quiet(t)
+
+	sm, _ := goldenMachine(t)
+	want := sm.Balances()
+
+	snapshots, _ := filepath.Glob(filepath.Join(goldenDir, "snapshot-v*.json"))
+	backups, _ := filepath.Glob(filepath.Join(goldenDir, "backup-v*.json"))
+	if len(snapshots) == 0 || len(backups) == 0 {
+		t.Fatalf("no golden snapshots or backups in %s", goldenDir)
+	}
+
+	for _, path := range snapshots {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored := &StateMachine{}
+			if err := restored.ReadSnapshot(bytes.NewReader(data), nil); err != nil {
+				t.Fatalf("ReadSnapshot() error = %v", err)
+			}
+			if got := restored.Balances(); !maps.Equal(got, want) {
+				t.Errorf("Balances() = %v; want %v", got, want)
+			}
+			if filepath.Base(path) == fmt.Sprintf("snapshot-v%d.json", snapshotVersion) {
+				again := indented(t, func(b *bytes.Buffer) error { return restored.WriteSnapshot(b, nil) })
+				if !bytes.Equal(again, data) {
+					t.Errorf("snapshot written again differs:\n%s", again)
+				}
+			}
+		})
+	}
+
+	for _, path := range backups {
+		t.Run(filepath.Base(path), func(t *testing.T) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			restored := &StateMachine{}
+			if err := restored.Restore(bytes.NewReader(data), LatestVersion); err != nil {
+				t.Fatalf("Restore() error = %v", err)
+			}
+			if got := restored.Balances(); !maps.Equal(got, want) || restored.Version() != sm.Version() {
+				t.Errorf("Balances() = %v at version %d; want %v at %d", got, restored.Version(), want, sm.Version())
+			}
+			if filepath.Base(path) == fmt.Sprintf("backup-v%d.json", backupFormat) {
+				again := indented(t, func(b *bytes.Buffer) error { return restored.Backup(b) })
+				if !bytes.Equal(again, data) {
+					t.Errorf("backup written again differs:\n%s", again)
+				}
+			}
+		})
+	}
+
+	t.Run("events.jsonl", func(t *testing.T) {
+		f, err := os.Open(filepath.Join(goldenDir, "events.jsonl"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		lines := bufio.NewScanner(f)
+		for lines.Scan() {
+			var event Event
+			if err := json.Unmarshal(lines.Bytes(), &event); err != nil {
+				t.Fatalf("decode %s: %v", lines.Text(), err)
+			}
+			again, _ := json.Marshal(event)
+			if !bytes.Equal(again, lines.Bytes()) {
+				t.Errorf("event encoded again = %s; want %s", again, lines.Bytes())
+			}
+		}
+	})
+}
@@ -0,0 +1,878 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The GraphQL endpoint supports the subset of the language clients need to
+// query and mutate the state machine: a single query or mutation with
+// nested selections, aliases, arguments and variables. Fragments, directives
+// and introspection are not supported.
+//
+//	type Query {
+//	  version: Int
+//	  account(id: String!): Account
+//	  accounts(first: Int, after: String, minBalance: Int, maxBalance: Int, tags: [String], order: String): AccountPage
+//	  operation(id: String!): Operation
+//	  operations(account: String, type: String, first: Int, after: String): OperationPage
+//	}
+//
+//	type Mutation {
+//	  deposit(account: String!, amount: Int!, memo: String): Operation
+//	  withdraw(account: String!, amount: Int!, memo: String): Operation
+//	  transfer(from: String!, to: String!, amount: Int!, memo: String): Operation
+//	  reverse(id: String!): Operation
+//	  rollback: Int
+//	}
+//
+//	type Account { id: String, balance: Int, tags: [String], balanceAt(version: Int, at: String): Int }
+//	type AccountPage { nodes: [Account], endCursor: String, hasNextPage: Boolean }
+//	type Operation { id: String, type: String, from: String, to: String, amount: Int, version: Int, time: String, reverses: String, correlationId: String, memo: String, metadata(key: String!): String }
+//	type OperationPage { nodes: [Operation], endCursor: String, hasNextPage: Boolean }
+
+// errGraphQL marks malformed GraphQL documents and arguments.
+var errGraphQL = errors.New("graphql")
+
+type graphQLRequest struct {
+	Query         string          `json:"query"`
+	OperationName string          `json:"operationName,omitempty"`
+	Variables     json.RawMessage `json:"variables,omitempty"`
+	Extensions    json.RawMessage `json:"extensions,omitempty"`
+}
+
+type graphQLError struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+type graphQLResponse struct {
+	Data   *gqlResult     `json:"data,omitempty"`
+	Errors []graphQLError `json:"errors,omitempty"`
+}
+
+func (s *Server) handleGraphQL(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	var req graphQLRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	variables := map[string]any{}
+	if len(req.Variables) > 0 && !bytes.Equal(req.Variables, []byte("null")) {
+		decoder := json.NewDecoder(bytes.NewReader(req.Variables))
+		decoder.UseNumber()
+		if err := decoder.Decode(&variables); err != nil {
+			writeError(w, fmt.Errorf("%w: invalid variables: %v", errBadRequest, err))
+			return
+		}
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, graphQLResponse{Errors: []graphQLError{{Message: err.Error()}}})
+		return
+	}
+	for name, value := range doc.defaults {
+		if _, ok := variables[name]; !ok {
+			variables[name] = value
+		}
+	}
+
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+
+	root := s.graphQLQuery(r, sm)
+	if doc.mutation {
+		root = s.graphQLMutation(ctx, r, sm)
+	}
+
+	exec := &gqlExecutor{variables: variables}
+	data := exec.selectFields(root, doc.selections, nil)
+	writeJSON(w, http.StatusOK, graphQLResponse{Data: data, Errors: exec.errors})
+}
+
+func (s *Server) graphQLQuery(r *http.Request, sm *StateMachine) gqlObject {
+	return gqlObject{typename: "Query", fields: map[string]gqlResolver{
+		"version": func(args gqlArgs) (any, error) {
+			return sm.Version(), nil
+		},
+		"account": func(args gqlArgs) (any, error) {
+			id, err := args.requiredString("id")
+			if err != nil {
+				return nil, err
+			}
+			if err := s.authorize(r, ActionRead, id); err != nil {
+				return nil, err
+			}
+			balance, err := sm.Balance(id)
+			if err != nil {
+				return nil, err
+			}
+			return gqlAccount(sm, Account{ID: id, Balance: balance, Tags: sm.AccountTags(id)}), nil
+		},
+		"accounts": func(args gqlArgs) (any, error) {
+			if err := s.authorize(r, ActionRead); err != nil {
+				return nil, err
+			}
+			first, err := args.pageSize()
+			if err != nil {
+				return nil, err
+			}
+			opts := ListOptions{Limit: first}
+			if opts.Cursor, err = args.string("after"); err != nil {
+				return nil, err
+			}
+			if opts.Tags, err = args.strings("tags"); err != nil {
+				return nil, err
+			}
+			order, err := args.string("order")
+			if err != nil {
+				return nil, err
+			}
+			opts.Order = AccountOrder(order)
+			if opts.MinBalance, err = args.optionalInt("minBalance"); err != nil {
+				return nil, err
+			}
+			if opts.MaxBalance, err = args.optionalInt("maxBalance"); err != nil {
+				return nil, err
+			}
+
+			page, err := sm.ListAccounts(opts)
+			if err != nil {
+				return nil, err
+			}
+			nodes := make([]gqlObject, len(page.Accounts))
+			for i, account := range page.Accounts {
+				nodes[i] = gqlAccount(sm, account)
+			}
+			return gqlPage("AccountPage", nodes, page.NextCursor), nil
+		},
+		"operation": func(args gqlArgs) (any, error) {
+			id, err := args.requiredString("id")
+			if err != nil {
+				return nil, err
+			}
+			if err := s.authorize(r, ActionRead); err != nil {
+				return nil, err
+			}
+			op, err := sm.Operation(id)
+			if err != nil {
+				return nil, err
+			}
+			return gqlOperation(op), nil
+		},
+		"operations": func(args gqlArgs) (any, error) {
+			if err := s.authorize(r, ActionRead); err != nil {
+				return nil, err
+			}
+			first, err := args.pageSize()
+			if err != nil {
+				return nil, err
+			}
+			accountId, err := args.string("account")
+			if err != nil {
+				return nil, err
+			}
+			opType, err := args.string("type")
+			if err != nil {
+				return nil, err
+			}
+			after, err := args.string("after")
+			if err != nil {
+				return nil, err
+			}
+
+			ops := sm.Operations()
+			if after != "" {
+				i := slices.IndexFunc(ops, func(op Operation) bool { return op.ID == after })
+				if i < 0 {
+					return nil, fmt.Errorf("%w (%s)", ErrOperationNotFound, after)
+				}
+				ops = ops[i+1:]
+			}
+			ops = slices.DeleteFunc(ops, func(op Operation) bool {
+				return (accountId != "" && !slices.Contains(op.accounts(), accountId)) || (opType != "" && string(op.Type) != opType)
+			})
+
+			page := ops[:min(first, len(ops))]
+			nodes := make([]gqlObject, len(page))
+			for i, op := range page {
+				nodes[i] = gqlOperation(op)
+			}
+			var endCursor string
+			if len(ops) > first {
+				endCursor = page[len(page)-1].ID
+			}
+			return gqlPage("OperationPage", nodes, endCursor), nil
+		},
+	}}
+}
+
+func (s *Server) graphQLMutation(ctx context.Context, r *http.Request, sm *StateMachine) gqlObject {
+	// apply performs op, with the memo in args, with the permissions the
+	// REST routes require.
+	apply := func(args gqlArgs, op Operation) (any, error) {
+		if err := checkAmount(op.Amount); err != nil {
+			return nil, err
+		}
+		memo, err := args.string("memo")
+		if err != nil {
+			return nil, err
+		}
+		op.Memo = memo
+		if op.From != "" {
+			if err := s.authorize(r, ActionWithdraw, op.From); err != nil {
+				return nil, err
+			}
+		}
+		if op.To != "" {
+			if err := s.authorize(r, ActionDeposit, op.To); err != nil {
+				return nil, err
+			}
+		}
+		applied, err := sm.ApplyContext(ctx, op)
+		if err != nil {
+			return nil, err
+		}
+		return gqlOperation(applied), nil
+	}
+
+	return gqlObject{typename: "Mutation", fields: map[string]gqlResolver{
+		"deposit": func(args gqlArgs) (any, error) {
+			accountId, amount, err := args.accountAmount()
+			if err != nil {
+				return nil, err
+			}
+			return apply(args, Operation{Type: OpDeposit, To: accountId, Amount: amount})
+		},
+		"withdraw": func(args gqlArgs) (any, error) {
+			accountId, amount, err := args.accountAmount()
+			if err != nil {
+				return nil, err
+			}
+			return apply(args, Operation{Type: OpWithdraw, From: accountId, Amount: amount})
+		},
+		"transfer": func(args gqlArgs) (any, error) {
+			from, err := args.requiredString("from")
+			if err != nil {
+				return nil, err
+			}
+			to, err := args.requiredString("to")
+			if err != nil {
+				return nil, err
+			}
+			amount, err := args.requiredInt("amount")
+			if err != nil {
+				return nil, err
+			}
+			return apply(args, Operation{Type: OpTransfer, From: from, To: to, Amount: amount})
+		},
+		"reverse": func(args gqlArgs) (any, error) {
+			id, err := args.requiredString("id")
+			if err != nil {
+				return nil, err
+			}
+			if err := s.authorize(r, ActionRollback); err != nil {
+				return nil, err
+			}
+			op, err := sm.ReverseContext(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			return gqlOperation(op), nil
+		},
+		"rollback": func(args gqlArgs) (any, error) {
+			if err := s.authorize(r, ActionRollback); err != nil {
+				return nil, err
+			}
+			if err := sm.RollbackContext(ctx); err != nil {
+				return nil, err
+			}
+			return sm.Version(), nil
+		},
+	}}
+}
+
+func gqlAccount(sm *StateMachine, account Account) gqlObject {
+	id := account.ID
+	return gqlObject{typename: "Account", fields: map[string]gqlResolver{
+		"id":      gqlValue(id),
+		"balance": gqlValue(account.Balance),
+		"tags":    gqlValue(append([]string{}, account.Tags...)),
+		"balanceAt": func(args gqlArgs) (any, error) {
+			version, hasVersion, err := args.int("version")
+			if err != nil {
+				return nil, err
+			}
+			if hasVersion {
+				return sm.BalanceAt(id, version)
+			}
+			at, err := args.requiredString("at")
+			if err != nil {
+				return nil, fmt.Errorf("%w: balanceAt needs a version or time", errGraphQL)
+			}
+			t, err := time.Parse(time.RFC3339Nano, at)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid time: %v", errGraphQL, err)
+			}
+			return sm.BalanceAtTime(id, t)
+		},
+	}}
+}
+
+func gqlOperation(op Operation) gqlObject {
+	return gqlObject{typename: "Operation", fields: map[string]gqlResolver{
+		"id":       gqlValue(op.ID),
+		"type":     gqlValue(string(op.Type)),
+		"from":     gqlValue(op.From),
+		"to":       gqlValue(op.To),
+		"amount":   gqlValue(op.Amount),
+		"version":  gqlValue(op.Version),
+		"time":     gqlValue(op.Time.Format(time.RFC3339Nano)),
+		"reverses": gqlValue(op.Reverses),
+
+		"correlationId": gqlValue(op.CorrelationID),
+		"memo":          gqlValue(op.Memo),
+		"metadata": func(args gqlArgs) (any, error) {
+			key, err := args.requiredString("key")
+			if err != nil {
+				return nil, err
+			}
+			if value, ok := op.Metadata[key]; ok {
+				return value, nil
+			}
+			return nil, nil
+		},
+	}}
+}
+
+// gqlPage returns a page of nodes. endCursor, empty on the last page, is
+// passed as after to get the next page.
+func gqlPage(typename string, nodes []gqlObject, endCursor string) gqlObject {
+	var cursor any
+	if endCursor != "" {
+		cursor = endCursor
+	}
+	return gqlObject{typename: typename, fields: map[string]gqlResolver{
+		"nodes":       gqlValue(nodes),
+		"endCursor":   gqlValue(cursor),
+		"hasNextPage": gqlValue(endCursor != ""),
+	}}
+}
+
+// gqlResolver returns the value of a field: a scalar, a gqlObject or a
+// []gqlObject.
+type gqlResolver func(args gqlArgs) (any, error)
+
+type gqlObject struct {
+	typename string
+	fields   map[string]gqlResolver
+}
+
+func gqlValue(v any) gqlResolver {
+	return func(gqlArgs) (any, error) { return v, nil }
+}
+
+// gqlArgs are the arguments of a field, with variables substituted.
+type gqlArgs map[string]any
+
+func (a gqlArgs) string(name string) (string, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("%w: argument %s must be a String", errGraphQL, name)
+}
+
+func (a gqlArgs) strings(name string) ([]string, error) {
+	var values []any
+	switch v := a[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil // a single value is coerced to a list
+	case []any:
+		values = v
+	default:
+		return nil, fmt.Errorf("%w: argument %s must be a [String]", errGraphQL, name)
+	}
+
+	strs := make([]string, len(values))
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: argument %s must be a [String]", errGraphQL, name)
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+func (a gqlArgs) requiredString(name string) (string, error) {
+	v, err := a.string(name)
+	if err == nil && v == "" {
+		err = fmt.Errorf("%w: argument %s is required", errGraphQL, name)
+	}
+	return v, err
+}
+
+func (a gqlArgs) int(name string) (int, bool, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return 0, false, nil
+	case int:
+		return v, true, nil
+	case json.Number:
+		if i, err := strconv.Atoi(v.String()); err == nil {
+			return i, true, nil
+		}
+	}
+	return 0, false, fmt.Errorf("%w: argument %s must be an Int", errGraphQL, name)
+}
+
+// optionalInt returns nil if the argument is not given.
+func (a gqlArgs) optionalInt(name string) (*int, error) {
+	v, ok, err := a.int(name)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (a gqlArgs) requiredInt(name string) (int, error) {
+	v, ok, err := a.int(name)
+	if err == nil && !ok {
+		err = fmt.Errorf("%w: argument %s is required", errGraphQL, name)
+	}
+	return v, err
+}
+
+func (a gqlArgs) accountAmount() (string, int, error) {
+	accountId, err := a.requiredString("account")
+	if err != nil {
+		return "", 0, err
+	}
+	amount, err := a.requiredInt("amount")
+	return accountId, amount, err
+}
+
+// pageSize returns the first argument, bounded by maxPageSize.
+func (a gqlArgs) pageSize() (int, error) {
+	first, ok, err := a.int("first")
+	switch {
+	case err != nil:
+		return 0, err
+	case !ok:
+		return defaultPageSize, nil
+	case first < 0:
+		return 0, fmt.Errorf("%w: first must not be negative", errGraphQL)
+	}
+	return min(first, maxPageSize), nil
+}
+
+// gqlResult is a selection's result, keeping the fields in selection order.
+type gqlResult struct {
+	keys   []string
+	values map[string]any
+}
+
+func (r *gqlResult) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range r.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(r.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// gqlExecutor resolves selections, collecting field errors as it goes. A
+// field that fails is null in the result.
+type gqlExecutor struct {
+	variables map[string]any
+	errors    []graphQLError
+}
+
+func (e *gqlExecutor) fail(path []any, err error) {
+	e.errors = append(e.errors, graphQLError{Message: err.Error(), Path: slices.Clone(path)})
+}
+
+func (e *gqlExecutor) selectFields(obj gqlObject, selections []gqlField, path []any) *gqlResult {
+	result := &gqlResult{values: map[string]any{}}
+	for _, field := range selections {
+		key := field.alias
+		if key == "" {
+			key = field.name
+		}
+		if _, ok := result.values[key]; !ok {
+			result.keys = append(result.keys, key)
+		}
+		result.values[key] = e.resolve(obj, field, append(path, key))
+	}
+	return result
+}
+
+func (e *gqlExecutor) resolve(obj gqlObject, field gqlField, path []any) any {
+	if field.name == "__typename" {
+		return obj.typename
+	}
+	resolver, ok := obj.fields[field.name]
+	if !ok {
+		e.fail(path, fmt.Errorf("%w: unknown field %s on %s", errGraphQL, field.name, obj.typename))
+		return nil
+	}
+
+	args := gqlArgs{}
+	for name, value := range field.args {
+		if v, ok := value.(gqlVariable); ok {
+			value = e.variables[string(v)]
+		}
+		args[name] = value
+	}
+
+	value, err := resolver(args)
+	if err != nil {
+		e.fail(path, err)
+		return nil
+	}
+
+	switch v := value.(type) {
+	case gqlObject:
+		if len(field.selections) == 0 {
+			e.fail(path, fmt.Errorf("%w: field %s of type %s needs a selection", errGraphQL, field.name, v.typename))
+			return nil
+		}
+		return e.selectFields(v, field.selections, path)
+	case []gqlObject:
+		results := make([]*gqlResult, len(v))
+		for i, item := range v {
+			if len(field.selections) == 0 {
+				e.fail(path, fmt.Errorf("%w: field %s of type [%s] needs a selection", errGraphQL, field.name, item.typename))
+				return nil
+			}
+			results[i] = e.selectFields(item, field.selections, append(path, i))
+		}
+		return results
+	}
+	if len(field.selections) > 0 {
+		e.fail(path, fmt.Errorf("%w: scalar field %s has a selection", errGraphQL, field.name))
+		return nil
+	}
+	return value
+}
+
+// gqlDocument is a parsed GraphQL operation.
+type gqlDocument struct {
+	mutation   bool
+	selections []gqlField
+	defaults   map[string]any // default values of variables
+}
+
+type gqlField struct {
+	alias, name string
+	args        map[string]any // literal values or gqlVariable
+	selections  []gqlField
+}
+
+// gqlVariable is a $variable argument, substituted when the field resolves.
+type gqlVariable string
+
+type gqlParser struct {
+	src string
+	pos int
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	p := &gqlParser{src: src}
+	doc := &gqlDocument{defaults: map[string]any{}}
+
+	if !p.peek("{") {
+		switch keyword := p.name(); keyword {
+		case "query":
+		case "mutation":
+			doc.mutation = true
+		case "subscription":
+			return nil, fmt.Errorf("%w: subscriptions are not supported, use /events", errGraphQL)
+		default:
+			return nil, p.errorf("expected query or mutation, got %q", keyword)
+		}
+		if !p.peek("{") && !p.peek("(") {
+			p.name() // operation name
+		}
+		if p.accept("(") {
+			for !p.accept(")") {
+				if err := p.variableDefinition(doc.defaults); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	selections, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	doc.selections = selections
+
+	if p.skip(); p.pos < len(p.src) {
+		return nil, p.errorf("only a single operation is supported")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s at offset %d", errGraphQL, fmt.Sprintf(format, args...), p.pos)
+}
+
+// skip skips whitespace, commas and comments, which are insignificant.
+func (p *gqlParser) skip() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *gqlParser) peek(punct string) bool {
+	p.skip()
+	return strings.HasPrefix(p.src[p.pos:], punct)
+}
+
+func (p *gqlParser) accept(punct string) bool {
+	if p.peek(punct) {
+		p.pos += len(punct)
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(punct string) error {
+	if !p.accept(punct) {
+		return p.errorf("expected %q", punct)
+	}
+	return nil
+}
+
+// name returns the next name, or "" if there is none.
+func (p *gqlParser) name() string {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || p.pos > start && '0' <= c && c <= '9' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *gqlParser) requiredName() (string, error) {
+	name := p.name()
+	if name == "" {
+		return "", p.errorf("expected a name")
+	}
+	return name, nil
+}
+
+// variableDefinition parses $name: Type = default, recording the default.
+func (p *gqlParser) variableDefinition(defaults map[string]any) error {
+	if err := p.expect("$"); err != nil {
+		return err
+	}
+	name, err := p.requiredName()
+	if err != nil {
+		return err
+	}
+	if err := p.expect(":"); err != nil {
+		return err
+	}
+	if err := p.variableType(); err != nil {
+		return err
+	}
+	if p.accept("=") {
+		value, err := p.value()
+		if err != nil {
+			return err
+		}
+		defaults[name] = value
+	}
+	return nil
+}
+
+func (p *gqlParser) variableType() error {
+	if p.accept("[") {
+		if err := p.variableType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.requiredName(); err != nil {
+		return err
+	}
+	p.accept("!")
+	return nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	var fields []gqlField
+	for !p.accept("}") {
+		if p.peek("...") {
+			return nil, p.errorf("fragments are not supported")
+		}
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	if len(fields) == 0 {
+		return nil, p.errorf("empty selection")
+	}
+	return fields, nil
+}
+
+func (p *gqlParser) field() (gqlField, error) {
+	var field gqlField
+	name, err := p.requiredName()
+	if err != nil {
+		return field, err
+	}
+	field.name = name
+
+	if p.accept(":") {
+		field.alias = name
+		if field.name, err = p.requiredName(); err != nil {
+			return field, err
+		}
+	}
+
+	if p.accept("(") {
+		field.args = map[string]any{}
+		for !p.accept(")") {
+			name, err := p.requiredName()
+			if err != nil {
+				return field, err
+			}
+			if err := p.expect(":"); err != nil {
+				return field, err
+			}
+			if field.args[name], err = p.value(); err != nil {
+				return field, err
+			}
+		}
+	}
+
+	if p.peek("@") {
+		return field, p.errorf("directives are not supported")
+	}
+	if p.peek("{") {
+		if field.selections, err = p.selectionSet(); err != nil {
+			return field, err
+		}
+	}
+	return field, nil
+}
+
+// value parses a variable, string, Int, Boolean, null, enum or list value.
+// Enum values are returned as strings, lists as []any.
+func (p *gqlParser) value() (any, error) {
+	p.skip()
+	if p.accept("$") {
+		name, err := p.requiredName()
+		return gqlVariable(name), err
+	}
+	if p.accept("[") {
+		list := []any{}
+		for !p.accept("]") {
+			value, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := value.(gqlVariable); ok {
+				return nil, p.errorf("variables in lists are not supported")
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	}
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("expected a value")
+	}
+
+	switch c := p.src[p.pos]; {
+	case c == '"':
+		end := p.pos + 1
+		for end < len(p.src) && p.src[end] != '"' {
+			if p.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.src) {
+			return nil, p.errorf("unterminated string")
+		}
+		s, err := strconv.Unquote(p.src[p.pos : end+1])
+		if err != nil {
+			return nil, p.errorf("invalid string: %v", err)
+		}
+		p.pos = end + 1
+		return s, nil
+	case c == '-' || '0' <= c && c <= '9':
+		end := p.pos + 1
+		for end < len(p.src) && '0' <= p.src[end] && p.src[end] <= '9' {
+			end++
+		}
+		i, err := strconv.Atoi(p.src[p.pos:end])
+		if err != nil || end < len(p.src) && strings.ContainsRune(".eE", rune(p.src[end])) {
+			return nil, p.errorf("only Int numbers are supported")
+		}
+		p.pos = end
+		return i, nil
+	}
+
+	switch name := p.name(); name {
+	case "":
+		return nil, p.errorf("expected a value")
+	case "true", "false":
+		return name == "true", nil
+	case "null":
+		return nil, nil
+	default:
+		return name, nil
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseGraphQL(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		expectedErr bool
+	}{
+		{name: "Shorthand query", query: `{ account(id: "acc1") { id balance } }`},
+		{name: "Named query with variables", query: `query Get($id: String!, $first: Int = 10) { account(id: $id) { balance } }`},
+		{name: "Mutation", query: `mutation { deposit(account: "acc1", amount: 10) { id } }`},
+		{name: "Aliases and comments", query: "{\n  # both accounts\n  a: account(id: \"acc1\") { balance }\n  b: account(id: \"acc2\") { balance }\n}"},
+		{name: "Enum argument", query: `{ operations(type: deposit) { nodes { id } } }`},
+		{name: "List argument", query: `{ accounts(tags: ["vip", "retail"]) { nodes { id } } }`},
+		{name: "Unterminated", query: `{ account(id: "acc1") { id }`, expectedErr: true},
+		{name: "Fragment", query: `{ account(id: "acc1") { ...fields } }`, expectedErr: true},
+		{name: "Directive", query: `{ version @skip(if: true) }`, expectedErr: true},
+		{name: "Subscription", query: `subscription { events }`, expectedErr: true},
+		{name: "Float", query: `{ account(id: 1.5) { id } }`, expectedErr: true},
+		{name: "Two operations", query: `{ version } { version }`, expectedErr: true},
+		{name: "Empty selection", query: `{ }`, expectedErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseGraphQL(tt.query)
+			if (err != nil) != tt.expectedErr {
+				t.Errorf("parseGraphQL(%q) = %v; want error %v", tt.query, err, tt.expectedErr)
+			}
+			if err != nil && !errors.Is(err, errGraphQL) {
+				t.Errorf("parseGraphQL(%q) = %v; want %v", tt.query, err, errGraphQL)
+			}
+		})
+	}
+}
+
+func TestServerGraphQL(t *testing.T) {
+	quiet(t)
+
+	srv, _ := newTestServer(map[string]int{"acc1": 1000, "acc2": 500, "acc3": 0})
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expected       string
+	}{
+		{
+			name:           "Deposit",
+			body:           `{"query": "mutation { deposit(account: \"acc1\", amount: 200) { type to amount version } }"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"data":{"deposit":{"type":"deposit","to":"acc1","amount":200,"version":1}}}`,
+		},
+		{
+			name:           "Transfer with variables",
+			body:           `{"query": "mutation Move($amount: Int!) { transfer(from: \"acc1\", to: \"acc3\", amount: $amount) { from amount } }", "variables": {"amount": 300}}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"data":{"transfer":{"from":"acc1","amount":300}}}`,
+		},
+		{
+			name:           "Failed mutation",
+			body:           `{"query": "mutation { withdraw(account: \"acc2\", amount: 5000) { id } }"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"data":{"withdraw":null},"errors":[{"message":"insufficient balance (500)","path":["withdraw"]}]}`,
+		},
+		{
+			name:           "Account with aliases",
+			body:           `{"query": "{ a: account(id: \"acc1\") { balance old: balanceAt(version: 0) } b: account(id: \"nope\") { balance } }"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"data":{"a":{"balance":900,"old":1000},"b":null},"errors":[{"message":"invalid account (nope)","path":["b"]}]}`,
+		},
+		{
+			name:           "Accounts page",
+			body:           `{"query": "{ accounts(first: 2, minBalance: 1) { nodes { id balance } endCursor hasNextPage } }"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"data":{"accounts":{"nodes":[{"id":"acc1","balance":900},{"id":"acc2","balance":500}],"endCursor":"` + encodeCursor(Account{ID: "acc2", Balance: 500}) + `","hasNextPage":true}}}`,
+		},
+		{
+			name:           "Next accounts page",
+			body:           `{"query": "query Next($after: String) { accounts(first: 2, minBalance: 1, after: $after) { nodes { id tags } hasNextPage } }", "variables": {"after": "` + encodeCursor(Account{ID: "acc2", Balance: 500}) + `"}}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"data":{"accounts":{"nodes":[{"id":"acc3","tags":[]}],"hasNextPage":false}}}`,
+		},
+		{
+			name:           "Operations of an account",
+			body:           `{"query": "{ version operations(account: \"acc3\") { nodes { __typename type from } } }"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"data":{"version":3,"operations":{"nodes":[{"__typename":"Operation","type":"transfer","from":"acc1"}]}}}`,
+		},
+		{
+			name:           "Unknown field",
+			body:           `{"query": "{ account(id: \"acc1\") { owner } }"}`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"data":{"account":{"owner":null}},"errors":[{"message":"graphql: unknown field owner on Account","path":["account","owner"]}]}`,
+		},
+		{
+			name:           "Syntax error",
+			body:           `{"query": "{ account(id: \"acc1\") "}`,
+			expectedStatus: http.StatusBadRequest,
+			expected:       `{"errors":[{"message":"graphql: expected a name at offset 22"}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest("POST", "/graphql", strings.NewReader(tt.body)))
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("POST /graphql = %d; want %d (%s)", rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.expected {
+				t.Errorf("Response = %s; want %s", got, tt.expected)
+			}
+			if !json.Valid(rec.Body.Bytes()) {
+				t.Errorf("Response is not valid JSON")
+			}
+		})
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+)
+
+var ErrUnknownVersion = errors.New("version not in history")
+
+// snapshotInterval is how many states apart full snapshots are kept in
+// history. The states in between are stored as deltas.
+const snapshotInterval = 64
+
+// stateHistory holds the past states of a StateMachine, oldest first. Most
+// states are deltas holding only the balances an operation touched; every
+// snapshotInterval-th state is a full snapshot, so rolling back to any
+// version needs at most snapshotInterval deltas. The zero value is empty.
+type stateHistory struct {
+	entries       []historyEntry
+	sinceSnapshot int // states saved since the newest full snapshot
+}
+
+// historyEntry holds the balances at version, which lasted until saved. A
+// delta only holds the balances that differ at the entry after it, or at the
+// current state for the newest entry, and the accounts that did not exist
+// yet.
+type historyEntry struct {
+	version  int
+	saved    time.Time
+	balances map[string]int
+	absent   []string // accounts of a delta that did not exist at version
+	full     bool
+}
+
+func (h *stateHistory) len() int {
+	return len(h.entries)
+}
+
+// save records accounts as the state at version, left at now. ids are the
+// accounts about to change; none means any account may change, and a full
+// snapshot is saved.
+func (h *stateHistory) save(version int, now time.Time, accounts map[string]int, ids ...string) {
+	entry := historyEntry{version: version, saved: now}
+	if len(ids) == 0 || h.sinceSnapshot+1 >= snapshotInterval {
+		entry.balances, entry.full = maps.Clone(accounts), true
+		h.sinceSnapshot = 0
+	} else {
+		entry.balances = make(map[string]int, len(ids))
+		for _, id := range ids {
+			if balance, ok := accounts[id]; ok {
+				entry.balances[id] = balance
+			} else {
+				entry.absent = append(entry.absent, id)
+			}
+		}
+		h.sinceSnapshot++
+	}
+	h.entries = append(h.entries, entry)
+}
+
+// trim forgets the oldest states beyond max, 0 meaning no bound.
+func (h *stateHistory) trim(max int) {
+	if max > 0 && len(h.entries) > max {
+		h.entries = h.entries[len(h.entries)-max:] // forget the oldest states
+	}
+}
+
+// restore removes the states after version from history and returns the
+// accounts as they were at version, given the current accounts. The
+// accounts map is updated in place unless a full snapshot is used.
+func (h *stateHistory) restore(accounts map[string]int, version int) (map[string]int, error) {
+	i := len(h.entries) - 1
+	for i >= 0 && h.entries[i].version > version {
+		i--
+	}
+	if i < 0 || h.entries[i].version != version {
+		return nil, fmt.Errorf("%w (%d)", ErrUnknownVersion, version)
+	}
+
+	// Start from the oldest full snapshot not older than version, if any,
+	// rather than undoing every delta since.
+	start := len(h.entries)
+	for j := i; j < len(h.entries); j++ {
+		if h.entries[j].full {
+			start = j
+			break
+		}
+	}
+	if start < len(h.entries) {
+		accounts = maps.Clone(h.entries[start].balances)
+	}
+	for j := start - 1; j >= i; j-- {
+		maps.Copy(accounts, h.entries[j].balances)
+		for _, id := range h.entries[j].absent {
+			delete(accounts, id)
+		}
+	}
+
+	h.forget(version)
+	return accounts, nil
+}
+
+// forget removes the states at and after version from history.
+func (h *stateHistory) forget(version int) {
+	i := len(h.entries)
+	for i > 0 && h.entries[i-1].version >= version {
+		i--
+	}
+	h.entries = h.entries[:i]
+	h.sinceSnapshot = 0
+	for j := i - 1; j >= 0 && !h.entries[j].full; j-- {
+		h.sinceSnapshot++
+	}
+}
+
+// compact drops the deltas older than the newest keep states that are
+// followed by a full snapshot, merging them into that snapshot. The versions
+// they held can then no longer be rolled back to individually. It returns
+// the number of states dropped.
+func (h *stateHistory) compact(keep int) int {
+	end := len(h.entries) - keep
+	for end > 0 && !h.entries[end-1].full {
+		end-- // only deltas followed by a full snapshot can be dropped
+	}
+	if end <= 0 {
+		return 0
+	}
+
+	kept := h.entries[:0]
+	for j, entry := range h.entries {
+		if j >= end || entry.full {
+			kept = append(kept, entry)
+		}
+	}
+	dropped := len(h.entries) - len(kept)
+	clear(h.entries[len(kept):])
+	h.entries = kept
+	return dropped
+}
+
+// CompactHistory drops the deltas between full snapshots older than the
+// newest keep states, bounding the memory history uses. Rollback and
+// RollbackTo still reach every full snapshot, but skip the dropped versions
+// between them. It returns the number of states dropped.
+func (sm *StateMachine) CompactHistory(keep int) int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return sm.history.compact(keep)
+}
+
+// RunCompaction calls CompactHistory every interval until ctx is done.
+func (sm *StateMachine) RunCompaction(ctx context.Context, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if dropped := sm.CompactHistory(keep); dropped > 0 {
+				fmt.Printf("\n\nCompacted %d states from history\n", dropped)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Version returns the version of the current state: the number of states
+// saved to history and not rolled back.
+func (sm *StateMachine) Version() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return sm.version
+}
+
+// HistoryDepth returns the number of states in history, which is how many
+// times Rollback can succeed.
+func (sm *StateMachine) HistoryDepth() int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return sm.history.len()
+}
+
+// HistoryEntry is a past state of a StateMachine: the balances at Version,
+// which lasted until Saved, when Operations moved the state on to the next
+// version: one operation, or those of a transaction. Operations is empty
+// once they are no longer journaled.
+type HistoryEntry struct {
+	Version    int
+	Saved      time.Time
+	Balances   map[string]int
+	Operations []Operation
+}
+
+// HistoryIter returns an iterator over the states in history from
+// fromVersion on, oldest first. The current state, see Balances, is not
+// included. Entries are rebuilt from the deltas in history a few at a time,
+// up to the next full snapshot, rather than all at once, so iterating over a
+// long history needs memory for only a few states. The state machine is not
+// locked while the caller handles an entry; states saved or rolled back in
+// the meantime are seen by the rest of the iteration.
+func (sm *StateMachine) HistoryIter(fromVersion int) iter.Seq[HistoryEntry] {
+	return func(yield func(HistoryEntry) bool) {
+		next := fromVersion
+		for {
+			entries := sm.historyFrom(next)
+			if len(entries) == 0 {
+				return
+			}
+			for _, entry := range entries {
+				if !yield(entry) {
+					return
+				}
+			}
+			next = entries[len(entries)-1].Version + 1
+		}
+	}
+}
+
+// historyFrom rebuilds the states in history from version on up to the
+// first full snapshot, or to the newest state if there is none.
+func (sm *StateMachine) historyFrom(version int) []HistoryEntry {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	h := sm.history.entries
+	i := sort.Search(len(h), func(i int) bool {
+		return h[i].version >= version
+	})
+	if i == len(h) {
+		return nil
+	}
+
+	// Walk back from the full snapshot, or the current state, undoing deltas.
+	end := i
+	for end < len(h) && !h[end].full {
+		end++
+	}
+	balances := sm.accounts
+	if end < len(h) {
+		balances = h[end].balances
+		end++
+	}
+	entries := make([]HistoryEntry, end-i)
+	for j := end - 1; j >= i; j-- {
+		if !h[j].full {
+			balances = maps.Clone(balances)
+			maps.Copy(balances, h[j].balances)
+			for _, id := range h[j].absent {
+				delete(balances, id)
+			}
+		}
+		entries[j-i] = HistoryEntry{
+			Version:    h[j].version,
+			Saved:      h[j].saved,
+			Balances:   maps.Clone(balances),
+			Operations: sm.journaledOperations(h[j].version + 1),
+		}
+	}
+	return entries
+}
+
+// RollbackTo returns the state to the given version, undoing every operation
+// applied since. The version must still be in history.
+func (sm *StateMachine) RollbackTo(version int) error {
+	return sm.RollbackToContext(context.Background(), version)
+}
+
+// RollbackToContext is like RollbackTo but gives up without rolling back if
+// ctx is done before the rollback starts.
+func (sm *StateMachine) RollbackToContext(ctx context.Context, version int) error {
+	_, err := sm.execute(ctx, Operation{Type: OpRollbackTo, Version: version})
+	return err
+}
+
+func (sm *StateMachine) applyRollbackTo(op Operation) error {
+	if err := sm.checkIfVersion(op); err != nil {
+		return err
+	}
+	if op.Version == sm.version {
+		return nil
+	}
+	if op.Version > sm.version {
+		return fmt.Errorf("%w (%d is after the current version %d)", ErrUnknownVersion, op.Version, sm.version)
+	}
+	if err := checkIrreversibleAfter(sm.journal, op.Version); err != nil {
+		return err
+	}
+
+	sm.onRevertRollback()
+	sm.keepImages()
+	accounts, err := sm.history.restore(sm.accounts, op.Version)
+	if err != nil {
+		return err
+	}
+	sm.accounts = accounts
+	sm.version = op.Version
+	sm.forgetOperationsAfter(sm.version)
+	sm.endEpoch()
+
+	fmt.Printf("After Rollback to version %d: %v\n", sm.version, sm.accounts)
+
+	return nil
+}
+
+// BalanceAt returns the balance an account had at the given version, which
+// must still be in history. The current state is not touched.
+func (sm *StateMachine) BalanceAt(accountId string, version int) (int, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return sm.balanceAt(accountId, version)
+}
+
+// BalanceAtTime returns the balance an account had at t. The state at t must
+// still be in history, or be the current one. States undone by a rollback
+// are not in history, so t is resolved as if they never happened.
+func (sm *StateMachine) BalanceAtTime(accountId string, t time.Time) (int, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	version, err := sm.history.versionAt(t, sm.version)
+	if err != nil {
+		return 0, err
+	}
+	return sm.balanceAt(accountId, version)
+}
+
+// balanceAt reads the balance at version from the first entry not older
+// than version holding it: a full snapshot, or a delta of an operation that
+// touched the account. sm.mu must be held.
+func (sm *StateMachine) balanceAt(accountId string, version int) (int, error) {
+	if version != sm.version {
+		i := sort.Search(len(sm.history.entries), func(i int) bool {
+			return sm.history.entries[i].version >= version
+		})
+		if i == len(sm.history.entries) || sm.history.entries[i].version != version {
+			return 0, fmt.Errorf("%w (%d)", ErrUnknownVersion, version)
+		}
+
+		for _, entry := range sm.history.entries[i:] {
+			if balance, ok := entry.balances[accountId]; ok {
+				return balance, nil
+			}
+			if entry.full || slices.Contains(entry.absent, accountId) {
+				return 0, fmt.Errorf("%w (%s) at version %d", ErrInvalidAccount, accountId, version)
+			}
+		}
+	}
+
+	balance, ok := sm.accounts[accountId]
+	if !ok {
+		return 0, fmt.Errorf("%w (%s) at version %d", ErrInvalidAccount, accountId, version)
+	}
+	return balance, nil
+}
+
+// versionAt returns the version of the state at t, given the current
+// version.
+func (h *stateHistory) versionAt(t time.Time, current int) (int, error) {
+	// The state at t is the one left by the first save after t.
+	i := sort.Search(len(h.entries), func(i int) bool {
+		return h.entries[i].saved.After(t)
+	})
+
+	version := current
+	if i < len(h.entries) {
+		version = h.entries[i].version
+	}
+
+	// Unless history goes back to the start, the state at t is only known
+	// when it began with the save before.
+	switch {
+	case i == 0 && version == 0:
+	case i > 0 && h.entries[i-1].version+1 == version:
+	case i == 0 && len(h.entries) == 0:
+	default:
+		return 0, fmt.Errorf("%w (no state at %s)", ErrUnknownVersion, t.Format(time.RFC3339Nano))
+	}
+	return version, nil
+}
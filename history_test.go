@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateMachineRollbackTo(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 0, "acc2": 0, "acc3": 0},
+	}
+
+	// Record the balances at every version over a few snapshot intervals.
+	states := []map[string]int{maps.Clone(sm.accounts)}
+	for i := range 3 * snapshotInterval {
+		switch i % 3 {
+		case 0:
+			_ = sm.Deposit("acc1", 10)
+		case 1:
+			_ = sm.Transfer("acc1", "acc2", 5)
+		case 2:
+			_ = sm.Withdraw("acc3", 1) // fails, but is still saved
+		}
+		states = append(states, maps.Clone(sm.accounts))
+	}
+	if sm.Version() != len(states)-1 {
+		t.Fatalf("Version = %d; want %d", sm.Version(), len(states)-1)
+	}
+
+	full := 0
+	for _, entry := range sm.history.entries {
+		if entry.full {
+			full++
+		} else if len(entry.balances) > 2 {
+			t.Errorf("Delta at version %d holds %v; want only the touched accounts", entry.version, entry.balances)
+		}
+	}
+	if full != 3 {
+		t.Errorf("Full snapshots = %d; want 3", full)
+	}
+
+	tests := []struct {
+		name        string
+		version     int
+		expectedErr error
+	}{
+		{name: "Same version", version: 3 * snapshotInterval},
+		{name: "Within the last interval", version: 3*snapshotInterval - 5},
+		{name: "Across a snapshot", version: 2*snapshotInterval - 1},
+		{name: "Future version", version: 3 * snapshotInterval, expectedErr: ErrUnknownVersion},
+		{name: "Exactly a snapshot", version: snapshotInterval - 1},
+		{name: "Start", version: 0},
+		{name: "Negative", version: -1, expectedErr: ErrUnknownVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := sm.RollbackTo(tt.version); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("RollbackTo(%d) = %v; want %v", tt.version, err, tt.expectedErr)
+			}
+			if tt.expectedErr != nil {
+				return
+			}
+			if !maps.Equal(sm.accounts, states[tt.version]) {
+				t.Errorf("Accounts = %v; want %v", sm.accounts, states[tt.version])
+			}
+			if sm.Version() != tt.version {
+				t.Errorf("Version = %d; want %d", sm.Version(), tt.version)
+			}
+		})
+	}
+}
+
+func TestStateMachineCompactHistory(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 0},
+	}
+
+	for range 3 * snapshotInterval {
+		_ = sm.Deposit("acc1", 1)
+	}
+
+	if dropped := sm.CompactHistory(10); dropped != 2*snapshotInterval-2 {
+		t.Errorf("CompactHistory dropped %d; want %d", dropped, 2*snapshotInterval-2)
+	}
+	if dropped := sm.CompactHistory(10); dropped != 0 {
+		t.Errorf("Second CompactHistory dropped %d; want 0", dropped)
+	}
+
+	// Recent versions and the full snapshots are still reachable.
+	if err := sm.RollbackTo(3*snapshotInterval - 10); err != nil {
+		t.Fatal(err)
+	}
+	if sm.accounts["acc1"] != 3*snapshotInterval-10 {
+		t.Errorf("Balance = %d; want %d", sm.accounts["acc1"], 3*snapshotInterval-10)
+	}
+	if err := sm.RollbackTo(snapshotInterval); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("RollbackTo compacted version = %v; want %v", err, ErrUnknownVersion)
+	}
+
+	if err := sm.RollbackTo(2*snapshotInterval - 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if version := snapshotInterval - 1; sm.Version() != version || sm.accounts["acc1"] != version {
+		t.Errorf("Rollback to version %d, balance %d; want %d", sm.Version(), sm.accounts["acc1"], version)
+	}
+	if err := sm.Rollback(); !errors.Is(err, ErrNothingToRollback) {
+		t.Errorf("Rollback past compacted history = %v; want %v", err, ErrNothingToRollback)
+	}
+}
+
+func TestStateMachineHistoryIter(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 0, "acc2": 0},
+	}
+
+	// Record the balances at every version across a few full snapshots,
+	// opening an account and transferring in a transaction along the way.
+	states := []map[string]int{maps.Clone(sm.accounts)}
+	for i := range 2*snapshotInterval + 10 {
+		switch {
+		case i == 70:
+			_ = sm.OpenAccount("acc3", 5)
+		case i%10 == 9:
+			_ = sm.Tx(func(tx *Tx) error {
+				_ = tx.Transfer("acc1", "acc2", 1)
+				return tx.Transfer("acc1", "acc2", 2)
+			})
+		default:
+			_ = sm.Deposit("acc1", 10)
+		}
+		states = append(states, maps.Clone(sm.accounts))
+	}
+
+	tests := []struct {
+		name        string
+		fromVersion int
+	}{
+		{"Start", 0},
+		{"Before a snapshot", snapshotInterval - 3},
+		{"Before the account opened", 65},
+		{"Newest", len(states) - 2},
+		{"Current", len(states) - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			version := tt.fromVersion
+			for entry := range sm.HistoryIter(tt.fromVersion) {
+				if entry.Version != version {
+					t.Fatalf("Entry version = %d; want %d", entry.Version, version)
+				}
+				if !maps.Equal(entry.Balances, states[version]) {
+					t.Errorf("Balances at %d = %v; want %v", version, entry.Balances, states[version])
+				}
+				if expected := 1 + version%10/9; len(entry.Operations) != expected || entry.Operations[0].Version != version+1 {
+					t.Errorf("Operations after %d = %+v; want %d producing version %d", version, entry.Operations, expected, version+1)
+				}
+				version++
+			}
+			if version != len(states)-1 {
+				t.Errorf("Iterated up to version %d; want %d", version, len(states)-1)
+			}
+		})
+	}
+
+	// Iteration stops with the loop.
+	n := 0
+	for range sm.HistoryIter(0) {
+		if n++; n == 3 {
+			break
+		}
+	}
+	if n != 3 {
+		t.Errorf("Iterated %d entries; want 3", n)
+	}
+
+	// Entries are copies.
+	for entry := range sm.HistoryIter(len(states) - 2) {
+		entry.Balances["acc1"] = -1
+	}
+	if balance, _ := sm.BalanceAt("acc1", len(states)-2); balance != states[len(states)-2]["acc1"] {
+		t.Errorf("BalanceAt = %d after changing an entry; want %d", balance, states[len(states)-2]["acc1"])
+	}
+}
+
+func TestStateMachineBalanceAt(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 100, "acc2": 0},
+	}
+
+	expected := []map[string]int{maps.Clone(sm.accounts)}
+	for i := range snapshotInterval + 10 {
+		if i%2 == 0 {
+			_ = sm.Transfer("acc1", "acc2", 1)
+		} else {
+			_ = sm.Deposit("acc2", 3)
+		}
+		expected = append(expected, maps.Clone(sm.accounts))
+	}
+
+	for version, accounts := range expected {
+		for acc, expectedBalance := range accounts {
+			if balance, err := sm.BalanceAt(acc, version); err != nil || balance != expectedBalance {
+				t.Errorf("BalanceAt(%s, %d) = %d, %v; want %d", acc, version, balance, err, expectedBalance)
+			}
+		}
+	}
+
+	tests := []struct {
+		name        string
+		account     string
+		version     int
+		expectedErr error
+	}{
+		{name: "Future version", account: "acc1", version: len(expected), expectedErr: ErrUnknownVersion},
+		{name: "Unknown account", account: "nope", version: 3, expectedErr: ErrInvalidAccount},
+		{name: "Unknown account now", account: "nope", version: len(expected) - 1, expectedErr: ErrInvalidAccount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := sm.BalanceAt(tt.account, tt.version); !errors.Is(err, tt.expectedErr) {
+				t.Errorf("BalanceAt(%s, %d) = %v; want %v", tt.account, tt.version, err, tt.expectedErr)
+			}
+		})
+	}
+
+	if sm.Version() != len(expected)-1 || !maps.Equal(sm.accounts, expected[len(expected)-1]) {
+		t.Errorf("BalanceAt changed the state to %v at version %d", sm.accounts, sm.Version())
+	}
+}
+
+func TestStateMachineBalanceAtTime(t *testing.T) {
+	sm := &StateMachine{
+		accounts:   map[string]int{"acc1": 100},
+		maxHistory: 3,
+	}
+
+	start := time.Unix(0, 0)
+	clock := NewFakeClock(start)
+	sm.UseClock(clock)
+	for range 5 {
+		_ = sm.Deposit("acc1", 10)
+		clock.Advance(time.Hour)
+	}
+	// History now holds the states at versions 2, 3 and 4, left at 2h, 3h
+	// and 4h; version 5 is current.
+
+	tests := []struct {
+		name            string
+		at              time.Duration
+		expectedBalance int
+		expectedErr     error
+	}{
+		{name: "Before history", at: 90 * time.Minute, expectedErr: ErrUnknownVersion},
+		{name: "At a save", at: 2 * time.Hour, expectedBalance: 130},
+		{name: "Between saves", at: 3*time.Hour + time.Minute, expectedBalance: 140},
+		{name: "After the last save", at: 5 * time.Hour, expectedBalance: 150},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			balance, err := sm.BalanceAtTime("acc1", start.Add(tt.at))
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("BalanceAtTime = %v; want %v", err, tt.expectedErr)
+			}
+			if err == nil && balance != tt.expectedBalance {
+				t.Errorf("BalanceAtTime = %d; want %d", balance, tt.expectedBalance)
+			}
+		})
+	}
+}
+
+func TestServerBalanceAt(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+
+	if err := sm.Deposit("acc1", 200); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{name: "Version", query: "?version=0", expectedStatus: http.StatusOK, expectedBody: `"balance":1000`},
+		{name: "Time", query: "?at=" + time.Now().Add(time.Hour).Format(time.RFC3339), expectedStatus: http.StatusOK, expectedBody: `"balance":1200`},
+		{name: "Unknown version", query: "?version=7", expectedStatus: http.StatusNotFound},
+		{name: "Malformed version", query: "?version=latest", expectedStatus: http.StatusBadRequest},
+		{name: "Malformed time", query: "?at=yesterday", expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/accounts/acc1"+tt.query, nil))
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("GET %s = %d; want %d (%s)", tt.query, rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.expectedBody) {
+				t.Errorf("GET %s = %s; want %s", tt.query, rec.Body, tt.expectedBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrVetoed is matched by errors of operations rejected by a BeforeOperation
+// hook.
+var ErrVetoed = errors.New("operation vetoed")
+
+// Hooks lets integrators observe and veto operations, e.g. for fraud checks,
+// enrichment or custom logging. Any of the functions may be nil.
+//
+// Hooks run outside the state lock, so they may call read methods such as
+// Balance, but they must not assume balances are unchanged by the time the
+// operation is applied.
+type Hooks struct {
+	// BeforeOperation runs once an operation is admitted and before it is
+	// applied. Returning an error vetoes the operation.
+	BeforeOperation func(ctx context.Context, op Operation) error
+	// AfterOperation runs once an operation has been applied.
+	AfterOperation func(ctx context.Context, op Operation)
+	// OnError runs when an operation fails, including when it is vetoed.
+	OnError func(ctx context.Context, op Operation, err error)
+	// Classify runs before BeforeOperation for operations without a
+	// Category and returns the category to file them under, or "" to leave
+	// it to the next hook. The first category returned is kept.
+	Classify func(ctx context.Context, op Operation) string
+	// OnStandingOrder runs after each attempt at a payment of a standing
+	// order, whether it was paid, will be retried or failed.
+	OnStandingOrder func(ctx context.Context, run StandingOrderRun)
+}
+
+// RegisterHooks adds hooks run for every later operation, in registration
+// order. Tenants have their own hooks.
+func (sm *StateMachine) RegisterHooks(h Hooks) {
+	sm.hooksMu.Lock()
+	defer sm.hooksMu.Unlock()
+	sm.hooks = append(sm.hooks, h)
+}
+
+func (sm *StateMachine) registeredHooks() []Hooks {
+	sm.hooksMu.RLock()
+	defer sm.hooksMu.RUnlock()
+	return sm.hooks
+}
+
+// classify sets the category of op from the Classify hooks if it has none.
+func (sm *StateMachine) classify(ctx context.Context, hooks []Hooks, op Operation) Operation {
+	for _, h := range hooks {
+		if op.Category != "" {
+			break
+		}
+		if h.Classify != nil {
+			op.Category = h.Classify(ctx, op)
+		}
+	}
+	return op
+}
+
+func (sm *StateMachine) runBeforeHooks(ctx context.Context, hooks []Hooks, op Operation) error {
+	for _, h := range hooks {
+		if h.BeforeOperation == nil {
+			continue
+		}
+		if err := h.BeforeOperation(ctx, op); err != nil {
+			return fmt.Errorf("%w: %w", ErrVetoed, err)
+		}
+	}
+	return nil
+}
+
+func (sm *StateMachine) runAfterHooks(ctx context.Context, hooks []Hooks, op Operation, err error) {
+	for _, h := range hooks {
+		if err != nil && h.OnError != nil {
+			h.OnError(ctx, op, err)
+		}
+		if err == nil && h.AfterOperation != nil {
+			h.AfterOperation(ctx, op)
+		}
+	}
+}
+
+func (sm *StateMachine) runStandingOrderHooks(ctx context.Context, run StandingOrderRun) {
+	for _, h := range sm.registeredHooks() {
+		if h.OnStandingOrder != nil {
+			h.OnStandingOrder(ctx, run)
+		}
+	}
+}
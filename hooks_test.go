@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateMachineHooks(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000, "acc2": 500},
+	}
+
+	errTooLarge := errors.New("amount above fraud threshold")
+	var applied []Operation
+	var failed []error
+
+	sm.RegisterHooks(Hooks{
+		BeforeOperation: func(ctx context.Context, op Operation) error {
+			if op.Amount > 400 {
+				return errTooLarge
+			}
+			// Hooks run outside the state lock and may read balances.
+			_, err := sm.Balance("acc1")
+			return err
+		},
+	})
+	sm.RegisterHooks(Hooks{
+		AfterOperation: func(ctx context.Context, op Operation) { applied = append(applied, op) },
+		OnError:        func(ctx context.Context, op Operation, err error) { failed = append(failed, err) },
+	})
+
+	if err := sm.Transfer("acc1", "acc2", 100); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+
+	err := sm.Withdraw("acc1", 500)
+	if !errors.Is(err, ErrVetoed) || !errors.Is(err, errTooLarge) {
+		t.Errorf("Vetoed withdraw = %v; want %v wrapping %v", err, ErrVetoed, errTooLarge)
+	}
+
+	if err := sm.Withdraw("acc2", 300); err != nil {
+		t.Fatalf("Withdraw failed: %v", err)
+	}
+	if err := sm.Deposit("nope", 1); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("Deposit to invalid account = %v; want %v", err, ErrInvalidAccount)
+	}
+
+	expectedApplied := []Operation{
+		{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 100},
+		{Type: OpWithdraw, From: "acc2", Amount: 300},
+	}
+	if len(applied) != len(expectedApplied) {
+		t.Fatalf("AfterOperation ran for %v; want %v", applied, expectedApplied)
+	}
+	for i, op := range expectedApplied {
+		if applied[i].ID == "" {
+			t.Errorf("AfterOperation[%d] has no ID", i)
+		}
+		got := applied[i]
+		got.ID, got.Version, got.Time = "", 0, time.Time{}
+		if !reflect.DeepEqual(got, op) {
+			t.Errorf("AfterOperation[%d] = %+v; want %+v", i, got, op)
+		}
+	}
+
+	if len(failed) != 2 || !errors.Is(failed[0], ErrVetoed) || !errors.Is(failed[1], ErrInvalidAccount) {
+		t.Errorf("OnError ran with %v; want the veto and the invalid account", failed)
+	}
+
+	expectedAccounts := map[string]int{"acc1": 900, "acc2": 300}
+	for acc, expectedBalance := range expectedAccounts {
+		if sm.accounts[acc] != expectedBalance {
+			t.Errorf("Account %s balance = %d; want %d", acc, sm.accounts[acc], expectedBalance)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultHotWindow is the window of detection of hot accounts when none is
+// set.
+const defaultHotWindow = time.Minute
+
+// HotAccountOptions configure the detection of hot accounts, see
+// DetectHotAccounts: an account is hot once operations touch it at MinRate
+// per second or more, or wait MinLockWait or more on average for the state
+// lock, over the last Window, a minute if 0. A zero threshold is not
+// checked. With Queue, operations on a hot account queue for it, one at a
+// time, before contending for the state lock, so they no longer crowd out
+// operations on other accounts.
+type HotAccountOptions struct {
+	MinRate     float64
+	MinLockWait time.Duration
+	Window      time.Duration
+	Queue       bool
+}
+
+// HotAccount reports the contention on a hot account over the last window
+// of detection.
+type HotAccount struct {
+	ID       string        `json:"id"`
+	Rate     float64       `json:"rate"`      // operations per second
+	LockWait time.Duration `json:"lock_wait"` // mean wait for the state lock
+	Queued   int           `json:"queued"`    // operations in its queue, with HotAccountOptions.Queue
+}
+
+// contention counts the operations on an account in a window, and how long
+// they waited for the state lock in all.
+type contention struct {
+	ops  int
+	wait time.Duration
+}
+
+// hotAccounts tracks the contention on each account over two windows, the
+// current one and the one before, weighing the latter by how much of it
+// still falls in the last window, as a sliding window would.
+type hotAccounts struct {
+	enabled bool
+	opts    HotAccountOptions
+
+	mu       sync.Mutex
+	start    time.Time // of the current window
+	current  map[string]contention
+	previous map[string]contention
+	queues   map[string]*hotQueue
+}
+
+// hotQueue lets one operation at a time through to the state lock.
+type hotQueue struct {
+	turn    chan struct{} // holds a token while an operation has its turn
+	waiting int           // operations holding or waiting for their turn
+}
+
+// DetectHotAccounts starts detecting hot accounts as opts says, reported by
+// HotAccounts. It must be called before operations start.
+func (sm *StateMachine) DetectHotAccounts(opts HotAccountOptions) {
+	if opts.Window <= 0 {
+		opts.Window = defaultHotWindow
+	}
+	sm.hot = hotAccounts{enabled: true, opts: opts}
+}
+
+// roll starts a new window once the current one is over. h.mu must be
+// held.
+func (h *hotAccounts) roll(now time.Time) {
+	if h.current == nil {
+		h.start, h.current = now, map[string]contention{}
+	}
+	elapsed := now.Sub(h.start)
+	if elapsed < h.opts.Window {
+		return
+	}
+	h.previous = h.current
+	if elapsed >= 2*h.opts.Window {
+		h.previous = nil // nothing happened in the last window
+	}
+	h.start = h.start.Add(elapsed.Truncate(h.opts.Window))
+	h.current = map[string]contention{}
+	for id, q := range h.queues {
+		if q.waiting == 0 {
+			delete(h.queues, id)
+		}
+	}
+}
+
+// record counts an operation on accounts that waited for the state lock.
+func (h *hotAccounts) record(now time.Time, accounts []string, wait time.Duration) {
+	if !h.enabled {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.roll(now)
+	for _, id := range accounts {
+		c := h.current[id]
+		c.ops++
+		c.wait += wait
+		h.current[id] = c
+	}
+}
+
+// contention returns the rate of operations on an account and their mean
+// wait for the state lock over the last window. h.mu must be held.
+func (h *hotAccounts) contention(now time.Time, id string) (float64, time.Duration) {
+	weight := 1 - float64(now.Sub(h.start))/float64(h.opts.Window)
+	previous, current := h.previous[id], h.current[id]
+	ops := float64(previous.ops)*weight + float64(current.ops)
+	if ops == 0 {
+		return 0, 0
+	}
+	wait := time.Duration(float64(previous.wait)*weight) + current.wait
+	return ops / h.opts.Window.Seconds(), time.Duration(float64(wait) / ops)
+}
+
+// isHot reports whether an account is hot. h.mu must be held.
+func (h *hotAccounts) isHot(now time.Time, id string) bool {
+	rate, wait := h.contention(now, id)
+	return h.opts.MinRate > 0 && rate >= h.opts.MinRate || h.opts.MinLockWait > 0 && wait >= h.opts.MinLockWait
+}
+
+// queue waits for the turn of an operation on accounts in the queue of
+// each hot one, with HotAccountOptions.Queue, and returns the function
+// giving it up. Queues are taken in account order, so operations on
+// several hot accounts cannot wait for each other's.
+func (h *hotAccounts) queue(ctx context.Context, now time.Time, accounts []string) (func(), error) {
+	if !h.enabled || !h.opts.Queue {
+		return func() {}, nil
+	}
+
+	h.mu.Lock()
+	h.roll(now)
+	var queues []*hotQueue
+	for _, id := range slices.Compact(slices.Sorted(slices.Values(accounts))) {
+		if !h.isHot(now, id) {
+			continue
+		}
+		if h.queues == nil {
+			h.queues = map[string]*hotQueue{}
+		}
+		q := h.queues[id]
+		if q == nil {
+			q = &hotQueue{turn: make(chan struct{}, 1)}
+			h.queues[id] = q
+		}
+		q.waiting++
+		queues = append(queues, q)
+	}
+	h.mu.Unlock()
+
+	taken := 0
+	release := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for i, q := range queues {
+			if i < taken {
+				<-q.turn
+			}
+			q.waiting--
+		}
+	}
+	for _, q := range queues {
+		select {
+		case q.turn <- struct{}{}:
+			taken++
+		case <-ctx.Done():
+			release()
+			return nil, ctx.Err()
+		}
+	}
+	return release, nil
+}
+
+// HotAccounts returns the accounts hot over the last window of detection,
+// the busiest first, or none unless DetectHotAccounts was called.
+func (sm *StateMachine) HotAccounts() []HotAccount {
+	h := &sm.hot
+	if !h.enabled {
+		return []HotAccount{}
+	}
+	now := sm.now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.roll(now)
+
+	hot := []HotAccount{}
+	for id := range h.current {
+		if h.isHot(now, id) {
+			rate, wait := h.contention(now, id)
+			hot = append(hot, HotAccount{ID: id, Rate: rate, LockWait: wait})
+		}
+	}
+	for id := range h.previous {
+		if _, ok := h.current[id]; !ok && h.isHot(now, id) {
+			rate, wait := h.contention(now, id)
+			hot = append(hot, HotAccount{ID: id, Rate: rate, LockWait: wait})
+		}
+	}
+	for i := range hot {
+		if q := h.queues[hot[i].ID]; q != nil {
+			hot[i].Queued = q.waiting
+		}
+	}
+	slices.SortFunc(hot, func(a, b HotAccount) int {
+		return cmp.Or(cmp.Compare(b.Rate, a.Rate), cmp.Compare(a.ID, b.ID))
+	})
+	return hot
+}
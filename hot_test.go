@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHotAccounts(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"acc1": 0, "acc2": 0}}
+	sm.UseClock(clock)
+	sm.DetectHotAccounts(HotAccountOptions{MinRate: 1, Window: 10 * time.Second})
+
+	for range 20 {
+		_ = sm.Deposit("acc1", 1)
+	}
+	_ = sm.Deposit("acc2", 1)
+	_ = sm.Transfer("acc1", "acc2", 1)
+
+	tests := []struct {
+		name    string
+		advance time.Duration
+		want    []string
+		rate    float64 // of the first one
+	}{
+		{"Current window", 0, []string{"acc1"}, 2.1},
+		{"Half of the window before", 15 * time.Second, []string{"acc1"}, 1.05},
+		{"Windows without operations", 10 * time.Second, nil, 0},
+	}
+	for _, tt := range tests {
+		clock.Advance(tt.advance)
+		hot := sm.HotAccounts()
+		var ids []string
+		for _, account := range hot {
+			ids = append(ids, account.ID)
+		}
+		if len(ids) != len(tt.want) || len(ids) > 0 && (ids[0] != tt.want[0] || hot[0].Rate != tt.rate) {
+			t.Errorf("%s: HotAccounts() = %+v; want %v at %g per second", tt.name, hot, tt.want, tt.rate)
+		}
+	}
+
+	if hot := (&StateMachine{}).HotAccounts(); len(hot) != 0 {
+		t.Errorf("HotAccounts() without detection = %+v", hot)
+	}
+}
+
+func TestHotAccountLockWait(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 0, "acc2": 0}}
+	sm.DetectHotAccounts(HotAccountOptions{MinLockWait: 10 * time.Millisecond})
+	_ = sm.Deposit("acc2", 1)
+
+	sm.mu.Lock()
+	done := make(chan error)
+	go func() { done <- sm.Deposit("acc1", 1) }()
+	time.Sleep(30 * time.Millisecond)
+	sm.mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	hot := sm.HotAccounts()
+	if len(hot) != 1 || hot[0].ID != "acc1" || hot[0].LockWait < 10*time.Millisecond {
+		t.Errorf("HotAccounts() = %+v; want acc1 waiting for the lock", hot)
+	}
+}
+
+func TestHotAccountQueue(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 0, "acc2": 0}}
+	sm.DetectHotAccounts(HotAccountOptions{MinRate: 1, Window: time.Hour, Queue: true})
+	for range 4000 {
+		_ = sm.Deposit("acc1", 1)
+	}
+
+	// One operation on acc1 holds its turn waiting for the lock, the others
+	// queue behind it, while acc2 is not hot and does not queue.
+	sm.mu.Lock()
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sm.Deposit("acc1", 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	queued := func() int {
+		sm.hot.mu.Lock()
+		defer sm.hot.mu.Unlock()
+		if q := sm.hot.queues["acc1"]; q != nil {
+			return q.waiting
+		}
+		return 0
+	}
+	for deadline := time.Now().Add(5 * time.Second); queued() < 3; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d operations queued for acc1; want 3", queued())
+		}
+	}
+	if hot := sm.HotAccounts(); len(hot) != 1 || hot[0].Queued != 3 {
+		t.Errorf("HotAccounts() = %+v; want acc1 with 3 queued", hot)
+	}
+
+	// An operation giving up leaves the queue.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sm.DepositContext(ctx, "acc1", 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DepositContext() error = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	sm.mu.Unlock()
+	wg.Wait()
+	if got := queued(); got != 0 || sm.accounts["acc1"] != 4003 {
+		t.Errorf("%d queued, acc1 = %d; want none left and every deposit applied", got, sm.accounts["acc1"])
+	}
+}
+
+func TestServerHotAccounts(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 100})
+	sm.DetectHotAccounts(HotAccountOptions{MinRate: 0.01})
+	_ = sm.Deposit("acc1", 1)
+
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/hot-accounts", nil))
+	var hot []HotAccount
+	if err := json.NewDecoder(rec.Body).Decode(&hot); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /hot-accounts = %d, %v", rec.Code, err)
+	}
+	if len(hot) != 1 || hot[0].ID != "acc1" {
+		t.Errorf("GET /hot-accounts = %+v; want acc1", hot)
+	}
+}
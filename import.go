@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// defaultImportBatch is how many rows Import applies at once by default.
+const defaultImportBatch = 500
+
+// errBatchAborted fails the transaction of a batch with invalid rows.
+var errBatchAborted = errors.New("batch has invalid rows")
+
+type ImportFormat string
+
+const (
+	// ImportCSV reads id,balance records. A first record of exactly
+	// "id,balance" is skipped as a header.
+	ImportCSV ImportFormat = "csv"
+	// ImportJSON reads an array of {"id": ..., "balance": ...} objects.
+	ImportJSON ImportFormat = "json"
+)
+
+// ImportFormatOf returns the format of a file from its extension.
+func ImportFormatOf(path string) (ImportFormat, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return ImportCSV, nil
+	case ".json":
+		return ImportJSON, nil
+	}
+	return "", fmt.Errorf("unsupported import file %s, want .csv or .json", path)
+}
+
+type ImportOptions struct {
+	Format    ImportFormat
+	BatchSize int // rows applied at once, defaultImportBatch if 0
+
+	// SkipInvalid applies the valid rows of a batch that has invalid ones.
+	// By default such a batch is not applied at all, so a file can be fixed
+	// and its failed batches imported again.
+	SkipInvalid bool
+}
+
+// RowError reports why a row of an import was not applied.
+type RowError struct {
+	Row int    // 1-based record number in the file, counting any header
+	ID  string // account id, empty if the row could not be read
+	Err error
+}
+
+func (e *RowError) Error() string {
+	if e.ID == "" {
+		return fmt.Sprintf("row %d: %v", e.Row, e.Err)
+	}
+	return fmt.Sprintf("row %d (%s): %v", e.Row, e.ID, e.Err)
+}
+
+func (e *RowError) Unwrap() error {
+	return e.Err
+}
+
+type ImportReport struct {
+	Imported int        // accounts opened
+	Batches  int        // batches applied
+	Skipped  int        // valid rows not applied because their batch had invalid ones
+	Errors   []RowError // invalid rows, in file order
+}
+
+// importRow is an account read from an import file, or the error reading it.
+type importRow struct {
+	row     int
+	id      string
+	balance int
+	err     error
+}
+
+// Import opens the accounts listed in r with their initial balances. Rows
+// are applied in batches, each as a single transaction, so a reader sees
+// either none or all of a batch and one Rollback undoes it. Rows that cannot
+// be read, hold a negative balance or name an account that already exists
+// are reported in the ImportReport rather than failing the import.
+//
+// Import only fails if r cannot be read as a whole, or ctx is done; the
+// report then covers the batches applied until then. Opening an account is
+// an operation like any other, subject to rate limits and hooks.
+func (sm *StateMachine) Import(ctx context.Context, r io.Reader, opts ImportOptions) (ImportReport, error) {
+	var report ImportReport
+
+	var next func() (importRow, error)
+	switch opts.Format {
+	case ImportCSV:
+		next = csvRows(r)
+	case ImportJSON:
+		var err error
+		if next, err = jsonRows(r); err != nil {
+			return report, err
+		}
+	default:
+		return report, fmt.Errorf("unknown import format %q", opts.Format)
+	}
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultImportBatch
+	}
+
+	batch := make([]importRow, 0, batchSize)
+	for {
+		row, err := next()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return report, err
+		}
+		if err == nil {
+			batch = append(batch, row)
+		}
+		if len(batch) == batchSize || errors.Is(err, io.EOF) && len(batch) > 0 {
+			if err := sm.importBatch(ctx, batch, opts.SkipInvalid, &report); err != nil {
+				return report, err
+			}
+			batch = batch[:0]
+		}
+		if errors.Is(err, io.EOF) {
+			return report, nil
+		}
+	}
+}
+
+// importBatch applies the valid rows of batch in one transaction, unless
+// some are invalid and skipInvalid is false.
+func (sm *StateMachine) importBatch(ctx context.Context, batch []importRow, skipInvalid bool, report *ImportReport) error {
+	var invalid []RowError
+	opened := 0
+
+	err := sm.TxContext(ctx, func(tx *Tx) error {
+		for _, row := range batch {
+			err := row.err
+			if err == nil {
+				err = tx.Open(row.id, row.balance)
+			}
+			if err != nil {
+				invalid = append(invalid, RowError{Row: row.row, ID: row.id, Err: err})
+				continue
+			}
+			opened++
+		}
+		if len(invalid) > 0 && !skipInvalid {
+			return errBatchAborted
+		}
+		return nil
+	})
+	report.Errors = append(report.Errors, invalid...)
+
+	switch {
+	case errors.Is(err, errBatchAborted):
+		report.Skipped += opened
+		return nil
+	case err != nil:
+		return err
+	}
+	if opened > 0 {
+		report.Imported += opened
+		report.Batches++
+	}
+	return nil
+}
+
+// ImportFile imports the accounts of a .csv or .json file, see Import.
+func (sm *StateMachine) ImportFile(ctx context.Context, path string, opts ImportOptions) (ImportReport, error) {
+	format, err := ImportFormatOf(path)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	opts.Format = format
+
+	f, err := os.Open(path)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	defer f.Close()
+	return sm.Import(ctx, f, opts)
+}
+
+func csvRows(r io.Reader) func() (importRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	row := 0
+
+	return func() (importRow, error) {
+		for {
+			record, err := reader.Read()
+			row++
+			var parseErr *csv.ParseError
+			switch {
+			case errors.As(err, &parseErr):
+				return importRow{row: row, err: parseErr.Err}, nil
+			case err != nil:
+				return importRow{}, err
+			case row == 1 && len(record) == 2 && strings.EqualFold(record[0], "id") && strings.EqualFold(record[1], "balance"):
+				continue
+			case len(record) != 2:
+				return importRow{row: row, err: fmt.Errorf("%w: want 2 fields, got %d", ErrInvalidOperation, len(record))}, nil
+			}
+
+			parsed := importRow{row: row, id: strings.TrimSpace(record[0])}
+			parsed.balance, parsed.err = parseBalance(parsed.id, strings.TrimSpace(record[1]))
+			return parsed, nil
+		}
+	}
+}
+
+func jsonRows(r io.Reader) (func() (importRow, error), error) {
+	decoder := json.NewDecoder(r)
+	if tok, err := decoder.Token(); err != nil {
+		return nil, fmt.Errorf("invalid import file: %w", err)
+	} else if tok != json.Delim('[') {
+		return nil, fmt.Errorf("invalid import file: want an array of accounts")
+	}
+	row := 0
+
+	return func() (importRow, error) {
+		if !decoder.More() {
+			if _, err := decoder.Token(); err != nil {
+				return importRow{}, fmt.Errorf("invalid import file: %w", err)
+			}
+			return importRow{}, io.EOF
+		}
+		row++
+
+		var record struct {
+			ID      string          `json:"id"`
+			Balance json.RawMessage `json:"balance"`
+		}
+		if err := decoder.Decode(&record); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if !errors.As(err, &typeErr) {
+				return importRow{}, fmt.Errorf("invalid import file: %w", err)
+			}
+			return importRow{row: row, err: fmt.Errorf("%w: %v", ErrInvalidOperation, err)}, nil
+		}
+
+		parsed := importRow{row: row, id: record.ID}
+		parsed.balance, parsed.err = parseBalance(record.ID, string(record.Balance))
+		return parsed, nil
+	}, nil
+}
+
+// parseBalance checks an imported row and parses its balance.
+func parseBalance(id, balance string) (int, error) {
+	if id == "" {
+		return 0, fmt.Errorf("%w: empty account id", ErrInvalidOperation)
+	}
+	b, err := strconv.Atoi(balance)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid balance %q", ErrInvalidOperation, balance)
+	}
+	if b < 0 {
+		return 0, fmt.Errorf("%w: negative amount %d", ErrInvalidOperation, b)
+	}
+	return b, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenAccount(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+
+	tests := []struct {
+		name        string
+		id          string
+		balance     int
+		expectedErr error
+	}{
+		{name: "Open", id: "acc2", balance: 50},
+		{name: "Open empty", id: "acc3"},
+		{name: "Existing account", id: "acc1", balance: 1, expectedErr: ErrAccountExists},
+		{name: "Negative balance", id: "acc4", balance: -1, expectedErr: ErrInvalidOperation},
+		{name: "Empty id", expectedErr: ErrInvalidOperation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := sm.OpenAccount(tt.id, tt.balance); !errors.Is(err, tt.expectedErr) {
+				t.Errorf("OpenAccount(%q, %d) = %v; want %v", tt.id, tt.balance, err, tt.expectedErr)
+			}
+		})
+	}
+
+	expected := map[string]int{"acc1": 100, "acc2": 50, "acc3": 0}
+	if !maps.Equal(sm.accounts, expected) {
+		t.Errorf("Accounts = %v; want %v", sm.accounts, expected)
+	}
+
+	if _, err := sm.BalanceAt("acc2", 0); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("BalanceAt before acc2 was opened = %v; want %v", err, ErrInvalidAccount)
+	}
+
+	// A rollback closes the account again, even after deltas of it.
+	if err := sm.Deposit("acc2", 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.RollbackTo(1); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]int{"acc1": 100, "acc2": 50}; !maps.Equal(sm.accounts, expected) {
+		t.Errorf("Accounts after RollbackTo(1) = %v; want %v", sm.accounts, expected)
+	}
+	if err := sm.RollbackTo(0); err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]int{"acc1": 100}; !maps.Equal(sm.accounts, expected) {
+		t.Errorf("Accounts after RollbackTo(0) = %v; want %v", sm.accounts, expected)
+	}
+}
+
+func TestImport(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name             string
+		input            string
+		opts             ImportOptions
+		expectedAccounts map[string]int
+		expectedReport   ImportReport
+		expectedRows     []int // rows reported as errors
+	}{
+		{
+			name:             "CSV",
+			input:            "id,balance\nacc2,100\nacc3, 250\n",
+			opts:             ImportOptions{Format: ImportCSV},
+			expectedAccounts: map[string]int{"acc1": 1, "acc2": 100, "acc3": 250},
+			expectedReport:   ImportReport{Imported: 2, Batches: 1},
+		},
+		{
+			name:             "CSV without header",
+			input:            "acc2,100\n",
+			opts:             ImportOptions{Format: ImportCSV},
+			expectedAccounts: map[string]int{"acc1": 1, "acc2": 100},
+			expectedReport:   ImportReport{Imported: 1, Batches: 1},
+		},
+		{
+			name:             "Invalid rows abort their batch",
+			input:            "acc2,100\nacc3,lots\nacc4,1\nacc5,2\nacc1,9\nacc6,3\nacc7,-1,x\n",
+			opts:             ImportOptions{Format: ImportCSV, BatchSize: 2},
+			expectedAccounts: map[string]int{"acc1": 1, "acc4": 1, "acc5": 2},
+			expectedReport:   ImportReport{Imported: 2, Batches: 1, Skipped: 2},
+			expectedRows:     []int{2, 5, 7},
+		},
+		{
+			name:             "Skip invalid rows",
+			input:            "acc2,100\nacc3,lots\nacc2,5\n,4\nacc4,-1\n",
+			opts:             ImportOptions{Format: ImportCSV, BatchSize: 2, SkipInvalid: true},
+			expectedAccounts: map[string]int{"acc1": 1, "acc2": 100},
+			expectedReport:   ImportReport{Imported: 1, Batches: 1},
+			expectedRows:     []int{2, 3, 4, 5},
+		},
+		{
+			name:             "JSON",
+			input:            `[{"id": "acc2", "balance": 100}, {"id": "acc3", "balance": "x"}, {"id": 7}, {"id": "acc4", "balance": 0}]`,
+			opts:             ImportOptions{Format: ImportJSON, SkipInvalid: true},
+			expectedAccounts: map[string]int{"acc1": 1, "acc2": 100, "acc4": 0},
+			expectedReport:   ImportReport{Imported: 2, Batches: 1},
+			expectedRows:     []int{2, 3},
+		},
+		{
+			name:             "Empty",
+			input:            `[]`,
+			opts:             ImportOptions{Format: ImportJSON},
+			expectedAccounts: map[string]int{"acc1": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"acc1": 1}}
+
+			report, err := sm.Import(context.Background(), strings.NewReader(tt.input), tt.opts)
+			if err != nil {
+				t.Fatalf("Import failed: %v", err)
+			}
+			if !maps.Equal(sm.accounts, tt.expectedAccounts) {
+				t.Errorf("Accounts = %v; want %v", sm.accounts, tt.expectedAccounts)
+			}
+
+			var rows []int
+			for _, rowErr := range report.Errors {
+				rows = append(rows, rowErr.Row)
+			}
+			if fmt.Sprint(rows) != fmt.Sprint(tt.expectedRows) {
+				t.Errorf("Rows with errors = %v; want %v (%v)", rows, tt.expectedRows, report.Errors)
+			}
+			report.Errors = nil
+			if report.Imported != tt.expectedReport.Imported || report.Batches != tt.expectedReport.Batches || report.Skipped != tt.expectedReport.Skipped {
+				t.Errorf("Report = %+v; want %+v", report, tt.expectedReport)
+			}
+		})
+	}
+}
+
+func TestImportBatches(t *testing.T) {
+	quiet(t)
+
+	var input strings.Builder
+	input.WriteString("[")
+	for i := range 1200 {
+		if i > 0 {
+			input.WriteString(",")
+		}
+		fmt.Fprintf(&input, `{"id": "acc%d", "balance": %d}`, i, i)
+	}
+	input.WriteString("]")
+
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	if err := os.WriteFile(path, []byte(input.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := &StateMachine{accounts: map[string]int{}}
+	report, err := sm.ImportFile(context.Background(), path, ImportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 1200 || report.Batches != 3 || sm.Version() != 3 || len(sm.accounts) != 1200 {
+		t.Errorf("Imported %d accounts in %d batches to version %d; want 1200 in 3 to version 3", report.Imported, report.Batches, sm.Version())
+	}
+
+	// Each batch is one step of history.
+	if err := sm.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sm.accounts) != 1000 {
+		t.Errorf("Rollback left %d accounts; want 1000", len(sm.accounts))
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	sm := &StateMachine{accounts: map[string]int{}}
+
+	tests := []struct {
+		name  string
+		input string
+		opts  ImportOptions
+	}{
+		{name: "Unknown format", input: "", opts: ImportOptions{Format: "xml"}},
+		{name: "Not an array", input: `{"id": "acc1"}`, opts: ImportOptions{Format: ImportJSON}},
+		{name: "Truncated", input: `[{"id": "acc1", "balance": 1}`, opts: ImportOptions{Format: ImportJSON}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := sm.Import(context.Background(), strings.NewReader(tt.input), tt.opts); err == nil {
+				t.Errorf("Import succeeded; want an error")
+			}
+		})
+	}
+
+	if _, err := sm.ImportFile(context.Background(), "accounts.xml", ImportOptions{}); err == nil {
+		t.Errorf("ImportFile of an .xml file succeeded; want an error")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrDuplicateMessage is returned for operations with the MessageID of an
+// operation applied before, e.g. a command a queue redelivered. Nothing is
+// applied; ProcessedMessage returns the operation first applied.
+var ErrDuplicateMessage = errors.New("duplicate message")
+
+// inboxSize is how many processed message IDs are remembered. A message
+// redelivered after this many others is applied again.
+const inboxSize = 100_000
+
+// inbox remembers the operations of processed messages, oldest first.
+type inbox struct {
+	processed map[string]Operation
+	order     []string
+}
+
+func (in *inbox) add(op Operation) {
+	if in.processed == nil {
+		in.processed = map[string]Operation{}
+	}
+	in.processed[op.MessageID] = op
+	in.order = append(in.order, op.MessageID)
+
+	if len(in.order) > inboxSize {
+		forgotten := len(in.order) - inboxSize
+		for _, id := range in.order[:forgotten] {
+			delete(in.processed, id)
+		}
+		in.order = append(in.order[:0], in.order[forgotten:]...)
+	}
+}
+
+// forget removes the message processed last, see revertUnlogged.
+func (in *inbox) forget(messageId string) {
+	delete(in.processed, messageId)
+	if n := len(in.order); n > 0 && in.order[n-1] == messageId {
+		in.order = in.order[:n-1]
+	}
+}
+
+// operations returns the operations of processed messages, oldest first.
+func (in *inbox) operations() []Operation {
+	ops := make([]Operation, len(in.order))
+	for i, id := range in.order {
+		ops[i] = in.processed[id]
+	}
+	return ops
+}
+
+// restore replaces the inbox with the operations of processed messages.
+func (in *inbox) restore(ops []Operation) {
+	*in = inbox{}
+	for _, op := range ops {
+		in.add(op)
+	}
+}
+
+// checkMessage fails with ErrDuplicateMessage if the message was processed.
+// sm.mu must be held.
+func (sm *StateMachine) checkMessage(messageId string) error {
+	if op, ok := sm.inbox.processed[messageId]; ok {
+		return fmt.Errorf("%w (%s) applied as %s", ErrDuplicateMessage, messageId, op.ID)
+	}
+	return nil
+}
+
+// ProcessedMessage returns the operation applied for a message, if it is
+// still remembered. Messages are only marked processed once their
+// operation succeeds, so a failed one can be redelivered and retried.
+func (sm *StateMachine) ProcessedMessage(messageId string) (Operation, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	op, ok := sm.inbox.processed[messageId]
+	return op, ok
+}
+
+// IdempotencyKeyHeader carries a client-chosen key for a request applying an
+// operation, e.g. a deposit, making it safe to retry: the key is the
+// MessageID of the operation, and a request repeating the key of an applied
+// operation applies nothing and is answered as the first one was, with
+// IdempotentReplayedHeader set.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set on the answer to a repeated request.
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength bounds idempotency keys.
+const maxIdempotencyKeyLength = 128
+
+// idempotencyKey returns the idempotency key of r, empty if it has none.
+func idempotencyKey(r *http.Request) (string, error) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		return "", fmt.Errorf("%w: %s longer than %d characters", errBadRequest, IdempotencyKeyHeader, maxIdempotencyKeyLength)
+	}
+	return key, nil
+}
+
+// replayed returns the operation first applied for the idempotency key of
+// op when err reports op a repetition of it, and marks the answer replayed.
+// A key reused for a different operation stays a conflict.
+func replayed(w http.ResponseWriter, sm *StateMachine, op Operation, err error) (Operation, bool) {
+	if op.MessageID == "" || !errors.Is(err, ErrDuplicateMessage) {
+		return Operation{}, false
+	}
+	first, ok := sm.ProcessedMessage(op.MessageID)
+	if !ok || first.Type != op.Type || first.From != op.From || first.To != op.To || first.Amount != op.Amount {
+		return Operation{}, false
+	}
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	return first, true
+}
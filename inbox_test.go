@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInbox(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 0}}
+	transfer := Operation{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 150, MessageID: "msg-1"}
+
+	// Fails for lack of funds, so the redelivered message is retried.
+	if _, err := sm.Apply(transfer); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("Apply() error = %v; want ErrInsufficientBalance", err)
+	}
+	if _, ok := sm.ProcessedMessage("msg-1"); ok {
+		t.Fatalf("ProcessedMessage() of a failed operation = true; want false")
+	}
+
+	_ = sm.Deposit("acc1", 50)
+	applied, err := sm.Apply(transfer)
+	if err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	if _, err := sm.Apply(transfer); !errors.Is(err, ErrDuplicateMessage) {
+		t.Fatalf("Apply() of a duplicate error = %v; want ErrDuplicateMessage", err)
+	}
+	if balances := sm.Balances(); balances["acc1"] != 0 || balances["acc2"] != 150 {
+		t.Errorf("Balances() = %v; want the transfer applied once", balances)
+	}
+
+	processed, ok := sm.ProcessedMessage("msg-1")
+	if !ok || processed.ID != applied.ID {
+		t.Errorf("ProcessedMessage() = %v, %v; want %s", processed.ID, ok, applied.ID)
+	}
+
+	// Messages are deduplicated whatever their operation.
+	deposit := Operation{Type: OpDeposit, To: "acc1", Amount: 1, MessageID: "msg-1"}
+	if _, err := sm.Apply(deposit); !errors.Is(err, ErrDuplicateMessage) {
+		t.Errorf("Apply() of another operation of the message error = %v; want ErrDuplicateMessage", err)
+	}
+}
+
+func TestInboxEviction(t *testing.T) {
+	var in inbox
+	for i := range inboxSize + 10 {
+		in.add(Operation{ID: fmt.Sprint(i), MessageID: fmt.Sprintf("msg-%d", i)})
+	}
+
+	if len(in.processed) != inboxSize || len(in.order) != inboxSize {
+		t.Fatalf("inbox holds %d messages in order %d; want %d", len(in.processed), len(in.order), inboxSize)
+	}
+	if _, ok := in.processed["msg-9"]; ok {
+		t.Errorf("inbox still holds msg-9; want the oldest evicted")
+	}
+	if _, ok := in.processed["msg-10"]; !ok {
+		t.Errorf("inbox lost msg-10; want it kept")
+	}
+}
+
+func TestInboxSnapshot(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	if _, err := sm.Apply(Operation{Type: OpDeposit, To: "acc1", Amount: 10, MessageID: "msg-1"}); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := sm.WriteSnapshot(&buf, nil); err != nil {
+		t.Fatalf("WriteSnapshot() error = %v", err)
+	}
+	restored := &StateMachine{}
+	if err := restored.ReadSnapshot(&buf, nil); err != nil {
+		t.Fatalf("ReadSnapshot() error = %v", err)
+	}
+
+	_, err := restored.Apply(Operation{Type: OpDeposit, To: "acc1", Amount: 10, MessageID: "msg-1"})
+	if !errors.Is(err, ErrDuplicateMessage) {
+		t.Errorf("Apply() after restore error = %v; want ErrDuplicateMessage", err)
+	}
+	if balance, _ := restored.Balance("acc1"); balance != 110 {
+		t.Errorf("Balance() = %d; want 110", balance)
+	}
+}
+
+func TestServerIdempotencyKey(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 100, "acc2": 0})
+
+	tests := []struct {
+		name             string
+		path             string
+		key              string
+		body             string
+		expectedStatus   int
+		expectedReplayed bool
+	}{
+		{"First deposit", "/accounts/acc1/deposit", "k1", `{"amount": 10}`, http.StatusOK, false},
+		{"Repeated deposit", "/accounts/acc1/deposit", "k1", `{"amount": 10}`, http.StatusOK, true},
+		{"Key of another operation", "/accounts/acc1/deposit", "k1", `{"amount": 20}`, http.StatusConflict, false},
+		{"Failed transfer", "/transfers", "k2", `{"from": "acc2", "to": "acc1", "amount": 10}`, http.StatusConflict, false},
+		{"Transfer", "/transfers", "k3", `{"from": "acc1", "to": "acc2", "amount": 10}`, http.StatusOK, false},
+		{"Repeated transfer", "/transfers", "k3", `{"from": "acc1", "to": "acc2", "amount": 10}`, http.StatusOK, true},
+		{"Too long", "/accounts/acc1/deposit", strings.Repeat("k", maxIdempotencyKeyLength+1), `{"amount": 10}`, http.StatusBadRequest, false},
+	}
+
+	ids := map[string]string{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			req.Header.Set(IdempotencyKeyHeader, tt.key)
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, req)
+
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("POST %s = %d; want %d (%s)", tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if replayed := rec.Header().Get(IdempotentReplayedHeader) == "true"; replayed != tt.expectedReplayed {
+				t.Errorf("%s = %v; want %v", IdempotentReplayedHeader, replayed, tt.expectedReplayed)
+			}
+			var resp struct {
+				OperationID string `json:"operation_id"`
+			}
+			_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+			if tt.expectedReplayed && resp.OperationID != ids[tt.key] {
+				t.Errorf("operation_id = %q; want %q of the first request", resp.OperationID, ids[tt.key])
+			}
+			ids[tt.key] = resp.OperationID
+		})
+	}
+
+	for id, want := range map[string]int{"acc1": 100, "acc2": 10} {
+		if balance, _ := sm.Balance(id); balance != want {
+			t.Errorf("Balance(%s) = %d; want %d", id, balance, want)
+		}
+	}
+}
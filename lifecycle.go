@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned by operations started after Close was called.
+var ErrClosed = errors.New("state machine is closed")
+
+// lifecycle tracks in-flight operations so Close can drain them.
+type lifecycle struct {
+	mu       sync.Mutex
+	closed   bool
+	inflight int
+	drained  chan struct{} // closed once closed is set and inflight reaches 0
+}
+
+// begin registers an operation, failing once the state machine is closing.
+// Every successful begin must be paired with a call to end.
+func (l *lifecycle) begin() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return ErrClosed
+	}
+	l.inflight++
+	return nil
+}
+
+func (l *lifecycle) end() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inflight--
+	if l.closed && l.inflight == 0 {
+		close(l.drained)
+	}
+}
+
+// close marks the lifecycle as closed and returns a channel that is closed
+// once every in-flight operation has ended.
+func (l *lifecycle) close() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.closed {
+		l.closed = true
+		l.drained = make(chan struct{})
+		if l.inflight == 0 {
+			close(l.drained)
+		}
+	}
+	return l.drained
+}
+
+// Close stops the state machine and its tenants from accepting new operations
+// and waits for in-flight operations to finish, or for ctx to be done,
+// whichever is first. Calling Close more than once is safe.
+func (sm *StateMachine) Close(ctx context.Context) error {
+	select {
+	case <-sm.lifecycle.close():
+		return sm.closeTenants(ctx)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Closed reports whether Close has been called.
+func (sm *StateMachine) Closed() bool {
+	sm.lifecycle.mu.Lock()
+	defer sm.lifecycle.mu.Unlock()
+	return sm.lifecycle.closed
+}
+
+// InFlight returns the number of operations currently being applied.
+func (sm *StateMachine) InFlight() int {
+	sm.lifecycle.mu.Lock()
+	defer sm.lifecycle.mu.Unlock()
+	return sm.lifecycle.inflight
+}
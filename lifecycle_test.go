@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStateMachineClose(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 100},
+	}
+
+	// Hold the state lock so the deposit below stays in flight.
+	sm.mu.Lock()
+	done := make(chan error)
+	go func() { done <- sm.Deposit("acc1", 50) }()
+
+	for sm.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sm.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Close with in-flight operation = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	if err := sm.Withdraw("acc1", 10); !errors.Is(err, ErrClosed) {
+		t.Errorf("Withdraw after Close = %v; want %v", err, ErrClosed)
+	}
+	if err := sm.Rollback(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Rollback after Close = %v; want %v", err, ErrClosed)
+	}
+
+	sm.mu.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("In-flight deposit failed: %v", err)
+	}
+
+	if err := sm.Close(context.Background()); err != nil {
+		t.Fatalf("Close after drain failed: %v", err)
+	}
+	if sm.accounts["acc1"] != 150 {
+		t.Errorf("Account acc1 balance = %d; want 150", sm.accounts["acc1"])
+	}
+}
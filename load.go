@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Olusamimaths/vaultflow/client"
+	"github.com/Olusamimaths/vaultflow/config"
+	"github.com/Olusamimaths/vaultflow/loadgen"
+)
+
+// machineTarget is the loadgen target applying operations to sm.
+func machineTarget(sm *StateMachine) loadgen.Target {
+	return loadgen.TargetFunc(func(ctx context.Context, op loadgen.Op) error {
+		operation := Operation{From: op.From, To: op.To, Amount: op.Amount}
+		switch op.Kind {
+		case loadgen.Deposit:
+			operation.Type = OpDeposit
+		case loadgen.Withdraw:
+			operation.Type = OpWithdraw
+		case loadgen.Transfer:
+			operation.Type = OpTransfer
+		default:
+			return fmt.Errorf("%w: %s", ErrInvalidOperation, op.Kind)
+		}
+		_, err := sm.ApplyContext(ctx, operation)
+		return err
+	})
+}
+
+// parseLoadAccounts parses the -accounts of "vaultflow loadgen": a number of
+// accounts to open, named load-0, load-1 and so on, or a comma separated
+// list of account IDs.
+func parseLoadAccounts(s string) ([]string, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return strings.Split(s, ","), nil
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of accounts (%d)", n)
+	}
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("load-%d", i)
+	}
+	return ids, nil
+}
+
+// parseMix parses a mix of deposits, withdrawals and transfers given as
+// "deposit:withdraw:transfer" weights, e.g. "2:1:1".
+func parseMix(s string) (loadgen.Mix, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return loadgen.Mix{}, fmt.Errorf("invalid mix %q, want deposit:withdraw:transfer weights", s)
+	}
+	var weights [3]int
+	for i, part := range parts {
+		var err error
+		if weights[i], err = strconv.Atoi(part); err != nil {
+			return loadgen.Mix{}, fmt.Errorf("invalid mix %q: %w", s, err)
+		}
+	}
+	return loadgen.Mix{Deposit: weights[0], Withdraw: weights[1], Transfer: weights[2]}, nil
+}
+
+// discardStdout discards what is printed to os.Stdout, such as the log of
+// every operation, until the function returned is called.
+func discardStdout() (restore func()) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		return func() {}
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	return func() {
+		os.Stdout = stdout
+		devNull.Close()
+	}
+}
+
+// runLoadgen implements "vaultflow loadgen": it applies a simulated workload
+// to a running instance, or to a state machine of its own, and prints its
+// throughput and latency percentiles.
+func runLoadgen(args []string) error {
+	flags := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	addr := flags.String("addr", "", "base URL of an instance to load, instead of a state machine in this process")
+	apiKey := flags.String("api-key", os.Getenv(config.EnvPrefix+"API_KEY"), "operator API key, sent as X-API-Key")
+	accounts := flags.String("accounts", "100", "number of accounts to open, or comma separated IDs of existing accounts with -addr")
+	balance := flags.Int("balance", 1000000, "initial balance of the accounts opened")
+	mix := flags.String("mix", "2:1:1", "weights of deposits, withdrawals and transfers")
+	amount := flags.String("amount", "1-100", "range of the amounts, e.g. 1-100")
+	skew := flags.Float64("skew", 0, "Zipf exponent above 1 concentrating operations on hot accounts, 0 for uniform")
+	rps := flags.Float64("rps", 0, "target operations per second, 0 for as fast as possible")
+	duration := flags.Duration("duration", 10*time.Second, "how long to run")
+	ops := flags.Int("ops", 0, "stop after this many operations, 0 for no limit")
+	concurrency := flags.Int("concurrency", 8, "operations in flight")
+	seed := flags.Uint64("seed", uint64(time.Now().UnixNano()), "seed of the operations generated")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: vaultflow loadgen [-addr url] [flags]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	w := loadgen.Workload{Skew: *skew, Rate: *rps, Duration: *duration, Operations: *ops, Concurrency: *concurrency, Seed: *seed}
+	var err error
+	if w.Accounts, err = parseLoadAccounts(*accounts); err != nil {
+		return err
+	}
+	if w.Mix, err = parseMix(*mix); err != nil {
+		return err
+	}
+	low, high, _ := strings.Cut(*amount, "-")
+	if w.MinAmount, err = strconv.Atoi(low); err == nil {
+		w.MaxAmount, err = strconv.Atoi(high)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid amount range %q, want min-max", *amount)
+	}
+	if err := w.Validate(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var report loadgen.Report
+	if *addr != "" {
+		c := client.New(*addr)
+		c.APIKey = *apiKey
+		report, err = loadgen.Run(ctx, loadgen.ClientTarget(c), w)
+	} else {
+		sm := &StateMachine{accounts: map[string]int{}}
+		for _, id := range w.Accounts {
+			sm.accounts[id] = *balance
+		}
+		// The state machine logs every operation; that is not the load.
+		restore := discardStdout()
+		report, err = loadgen.Run(ctx, machineTarget(sm), w)
+		restore()
+	}
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(report)
+	}
+	_, err = report.WriteTo(os.Stdout)
+	return err
+}
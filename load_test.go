@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/Olusamimaths/vaultflow/loadgen"
+)
+
+func TestMachineTarget(t *testing.T) {
+	quiet(t)
+
+	accounts, err := parseLoadAccounts("4")
+	if err != nil || !slices.Equal(accounts, []string{"load-0", "load-1", "load-2", "load-3"}) {
+		t.Fatalf("parseLoadAccounts(4) = %v, %v", accounts, err)
+	}
+	mix, err := parseMix("1:1:2")
+	if err != nil || mix != (loadgen.Mix{Deposit: 1, Withdraw: 1, Transfer: 2}) {
+		t.Fatalf("parseMix(1:1:2) = %+v, %v", mix, err)
+	}
+
+	sm := &StateMachine{accounts: map[string]int{}}
+	for _, id := range accounts {
+		sm.accounts[id] = 1000
+	}
+	report, err := loadgen.Run(context.Background(), machineTarget(sm), loadgen.Workload{
+		Accounts:    accounts,
+		Mix:         mix,
+		MinAmount:   1,
+		MaxAmount:   10,
+		Operations:  200,
+		Concurrency: 4,
+		Seed:        7,
+	})
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if report.Operations != 200 || report.Errors != 0 {
+		t.Errorf("Report = %+v; want 200 operations applied", report)
+	}
+	if ops := sm.Operations(); len(ops) != 200 {
+		t.Errorf("Operations() = %d; want 200", len(ops))
+	}
+}
@@ -0,0 +1,315 @@
+// Package loadgen generates simulated workloads of deposits, withdrawals
+// and transfers against a vaultflow state machine or running server, and
+// reports their throughput and latency percentiles.
+//
+// A Workload describes the mix of operations, the accounts they pick, with
+// an optional skew towards a few hot accounts, their amounts and the target
+// rate. Run applies it to a Target: ClientTarget for a server, or any
+// function applying an Op, e.g. to an embedded state machine.
+package loadgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Olusamimaths/vaultflow/client"
+)
+
+type Kind string
+
+const (
+	Deposit  Kind = "deposit"
+	Withdraw Kind = "withdraw"
+	Transfer Kind = "transfer"
+)
+
+// Op is an operation of a workload. From is empty for deposits and To for
+// withdrawals.
+type Op struct {
+	Kind   Kind
+	From   string
+	To     string
+	Amount int
+}
+
+// Target applies the operations of a workload.
+type Target interface {
+	Apply(ctx context.Context, op Op) error
+}
+
+// TargetFunc adapts a function to a Target.
+type TargetFunc func(ctx context.Context, op Op) error
+
+func (f TargetFunc) Apply(ctx context.Context, op Op) error {
+	return f(ctx, op)
+}
+
+// ClientTarget applies operations to the server of c.
+func ClientTarget(c *client.Client) Target {
+	return TargetFunc(func(ctx context.Context, op Op) error {
+		var err error
+		switch op.Kind {
+		case Deposit:
+			_, err = c.Deposit(ctx, op.To, client.AmountRequest{Amount: op.Amount})
+		case Withdraw:
+			_, err = c.Withdraw(ctx, op.From, client.AmountRequest{Amount: op.Amount})
+		case Transfer:
+			_, err = c.Transfer(ctx, client.TransferRequest{From: op.From, To: op.To, Amount: op.Amount})
+		default:
+			err = fmt.Errorf("unknown operation kind %q", op.Kind)
+		}
+		return err
+	})
+}
+
+// Mix weighs the kinds of operations of a workload, e.g. 2, 1 and 1 for
+// half deposits and a quarter each of withdrawals and transfers.
+type Mix struct {
+	Deposit  int
+	Withdraw int
+	Transfer int
+}
+
+func (m Mix) total() int {
+	return m.Deposit + m.Withdraw + m.Transfer
+}
+
+// Workload describes the operations Run applies.
+type Workload struct {
+	Accounts []string
+	Mix      Mix
+
+	// Amounts are picked uniformly from MinAmount to MaxAmount.
+	MinAmount int
+	MaxAmount int
+
+	// Skew concentrates operations on the first accounts with a Zipf
+	// distribution of that exponent, above 1, the higher the hotter; 0
+	// picks accounts uniformly.
+	Skew float64
+
+	// Rate is the target of operations started per second, 0 applying them
+	// as fast as Concurrency allows.
+	Rate float64
+
+	// Run stops after Duration or once Operations were started, whichever
+	// comes first; at least one of them must be set.
+	Duration   time.Duration
+	Operations int
+
+	Concurrency int    // operations in flight, 1 if 0
+	Seed        uint64 // of the operations generated, the same for the same seed
+}
+
+// Validate reports the first invalid setting of w.
+func (w Workload) Validate() error {
+	switch {
+	case len(w.Accounts) == 0:
+		return errors.New("no accounts")
+	case w.Mix.Deposit < 0 || w.Mix.Withdraw < 0 || w.Mix.Transfer < 0 || w.Mix.total() == 0:
+		return fmt.Errorf("invalid mix %+v", w.Mix)
+	case w.Mix.Transfer > 0 && len(w.Accounts) < 2:
+		return errors.New("transfers need at least 2 accounts")
+	case w.MinAmount <= 0 || w.MaxAmount < w.MinAmount:
+		return fmt.Errorf("invalid amounts (%d to %d)", w.MinAmount, w.MaxAmount)
+	case w.Skew != 0 && w.Skew <= 1:
+		return fmt.Errorf("invalid skew (%g), must be 0 or above 1", w.Skew)
+	case w.Rate < 0 || w.Duration < 0 || w.Operations < 0 || w.Concurrency < 0:
+		return errors.New("negative rate, duration, operations or concurrency")
+	case w.Duration == 0 && w.Operations == 0:
+		return errors.New("neither duration nor operations set")
+	}
+	return nil
+}
+
+// generator generates the operations of a workload.
+type generator struct {
+	w    Workload
+	rand *rand.Rand
+	zipf *rand.Zipf // nil if uniform
+}
+
+func newGenerator(w Workload, stream uint64) *generator {
+	g := &generator{w: w, rand: rand.New(rand.NewPCG(w.Seed, stream))}
+	if w.Skew > 1 {
+		g.zipf = rand.NewZipf(g.rand, w.Skew, 1, uint64(len(w.Accounts)-1))
+	}
+	return g
+}
+
+func (g *generator) account() string {
+	if g.zipf != nil {
+		return g.w.Accounts[g.zipf.Uint64()]
+	}
+	return g.w.Accounts[g.rand.IntN(len(g.w.Accounts))]
+}
+
+func (g *generator) next() Op {
+	op := Op{Amount: g.w.MinAmount + g.rand.IntN(g.w.MaxAmount-g.w.MinAmount+1)}
+	switch n := g.rand.IntN(g.w.Mix.total()); {
+	case n < g.w.Mix.Deposit:
+		op.Kind, op.To = Deposit, g.account()
+	case n < g.w.Mix.Deposit+g.w.Mix.Withdraw:
+		op.Kind, op.From = Withdraw, g.account()
+	default:
+		op.Kind, op.From, op.To = Transfer, g.account(), g.account()
+		for op.To == op.From {
+			op.To = g.account()
+		}
+	}
+	return op
+}
+
+// Latencies are percentiles of the latencies of operations.
+type Latencies struct {
+	P50 time.Duration `json:"p50"`
+	P90 time.Duration `json:"p90"`
+	P99 time.Duration `json:"p99"`
+	Max time.Duration `json:"max"`
+}
+
+func latencies(sorted []time.Duration) Latencies {
+	if len(sorted) == 0 {
+		return Latencies{}
+	}
+	percentile := func(p float64) time.Duration {
+		return sorted[max(int(math.Ceil(p*float64(len(sorted))))-1, 0)]
+	}
+	return Latencies{P50: percentile(0.5), P90: percentile(0.9), P99: percentile(0.99), Max: sorted[len(sorted)-1]}
+}
+
+// Report is the outcome of Run.
+type Report struct {
+	Operations int           `json:"operations"`
+	Errors     int           `json:"errors"`
+	ByKind     map[Kind]int  `json:"by_kind"`
+	ErrorsBy   map[Kind]int  `json:"errors_by_kind"`
+	Elapsed    time.Duration `json:"elapsed"`
+	Throughput float64       `json:"throughput"` // operations per second
+	Latency    Latencies     `json:"latency"`
+}
+
+// WriteTo writes r as text, e.g. to print it.
+func (r Report) WriteTo(w io.Writer) (int64, error) {
+	n, err := fmt.Fprintf(w, "operations: %d in %s (%.1f/s), %d failed\n", r.Operations, r.Elapsed.Round(time.Millisecond), r.Throughput, r.Errors)
+	for _, kind := range []Kind{Deposit, Withdraw, Transfer} {
+		if err == nil && r.ByKind[kind] > 0 {
+			var m int
+			m, err = fmt.Fprintf(w, "  %-8s %d, %d failed\n", kind, r.ByKind[kind], r.ErrorsBy[kind])
+			n += m
+		}
+	}
+	if err == nil {
+		var m int
+		m, err = fmt.Fprintf(w, "latency: p50 %s, p90 %s, p99 %s, max %s\n", r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+		n += m
+	}
+	return int64(n), err
+}
+
+// Run applies the operations of w to target until w's duration or number
+// of operations is reached, or ctx is done, and reports them. Operations
+// failing, e.g. withdrawals exceeding the balance, are counted as errors.
+//
+// With a Rate, operations are started on a fixed schedule and their latency
+// is measured from when they were scheduled, so a target falling behind
+// shows in the percentiles instead of slowing the schedule down.
+func Run(ctx context.Context, target Target, w Workload) (Report, error) {
+	if err := w.Validate(); err != nil {
+		return Report{}, err
+	}
+	if w.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Duration)
+		defer cancel()
+	}
+
+	var (
+		started atomic.Int64
+		mu      sync.Mutex
+		report  = Report{ByKind: map[Kind]int{}, ErrorsBy: map[Kind]int{}}
+		all     []time.Duration
+		wg      sync.WaitGroup
+	)
+	start := time.Now()
+	for worker := range max(w.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g := newGenerator(w, uint64(worker))
+			var measured []time.Duration
+			byKind, errorsBy := map[Kind]int{}, map[Kind]int{}
+			for {
+				i := started.Add(1) - 1
+				if w.Operations > 0 && i >= int64(w.Operations) {
+					break
+				}
+				scheduled := time.Now()
+				if w.Rate > 0 {
+					scheduled = start.Add(time.Duration(float64(i) / w.Rate * float64(time.Second)))
+					if !sleepUntil(ctx, scheduled) {
+						break
+					}
+				} else if ctx.Err() != nil {
+					break
+				}
+
+				op := g.next()
+				err := target.Apply(ctx, op)
+				if ctx.Err() != nil && err != nil {
+					break // cut short, not failed
+				}
+				measured = append(measured, time.Since(scheduled))
+				byKind[op.Kind]++
+				if err != nil {
+					errorsBy[op.Kind]++
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			all = append(all, measured...)
+			for kind, n := range byKind {
+				report.ByKind[kind] += n
+				report.Operations += n
+			}
+			for kind, n := range errorsBy {
+				report.ErrorsBy[kind] += n
+				report.Errors += n
+			}
+		}()
+	}
+	wg.Wait()
+
+	report.Elapsed = time.Since(start)
+	if report.Elapsed > 0 {
+		report.Throughput = float64(report.Operations) / report.Elapsed.Seconds()
+	}
+	slices.Sort(all)
+	report.Latency = latencies(all)
+	return report, nil
+}
+
+// sleepUntil waits until t and reports whether ctx is still not done.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,162 @@
+package loadgen
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a Target recording the operations applied, failing
+// withdrawals.
+type recorder struct {
+	mu  sync.Mutex
+	ops []Op
+}
+
+func (r *recorder) Apply(ctx context.Context, op Op) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ops = append(r.ops, op)
+	if op.Kind == Withdraw {
+		return errors.New("insufficient balance")
+	}
+	return nil
+}
+
+func testWorkload() Workload {
+	return Workload{
+		Accounts:    []string{"a", "b", "c", "d", "e", "f", "g", "h"},
+		Mix:         Mix{Deposit: 2, Withdraw: 1, Transfer: 1},
+		MinAmount:   10,
+		MaxAmount:   20,
+		Operations:  4000,
+		Concurrency: 4,
+		Seed:        1,
+	}
+}
+
+func TestRun(t *testing.T) {
+	target := &recorder{}
+	report, err := Run(context.Background(), target, testWorkload())
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if report.Operations != 4000 || len(target.ops) != 4000 {
+		t.Fatalf("Run() applied %d operations, reported %d; want 4000", len(target.ops), report.Operations)
+	}
+	if report.Errors != report.ByKind[Withdraw] || report.ErrorsBy[Withdraw] != report.Errors {
+		t.Errorf("Report = %+v; want the withdrawals failed", report)
+	}
+	// Half deposits, a quarter each of withdrawals and transfers, give or
+	// take.
+	for kind, want := range map[Kind]int{Deposit: 2000, Withdraw: 1000, Transfer: 1000} {
+		if got := report.ByKind[kind]; got < want*9/10 || got > want*11/10 {
+			t.Errorf("%d %s operations; want about %d", got, kind, want)
+		}
+	}
+	for _, op := range target.ops {
+		if op.Amount < 10 || op.Amount > 20 || op.Kind == Transfer && (op.From == op.To || op.From == "") {
+			t.Fatalf("generated %+v; want amounts from 10 to 20 between distinct accounts", op)
+		}
+	}
+	if report.Latency.P50 > report.Latency.P99 || report.Latency.P99 > report.Latency.Max || report.Latency.Max == 0 {
+		t.Errorf("Latency = %+v; want increasing percentiles", report.Latency)
+	}
+}
+
+func TestRunSkew(t *testing.T) {
+	w := testWorkload()
+	w.Skew = 2
+	target := &recorder{}
+	if _, err := Run(context.Background(), target, w); err != nil {
+		t.Fatal(err)
+	}
+
+	hot := 0
+	for _, op := range target.ops {
+		if op.To == "a" || op.From == "a" {
+			hot++
+		}
+	}
+	// The first of 8 accounts takes about 60% of operations instead of an
+	// eighth of them.
+	if hot < len(target.ops)/2 {
+		t.Errorf("hot account in %d of %d operations; want most", hot, len(target.ops))
+	}
+}
+
+func TestRunRate(t *testing.T) {
+	w := testWorkload()
+	w.Operations, w.Rate, w.Duration = 0, 200, 250*time.Millisecond
+	report, err := Run(context.Background(), &recorder{}, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 50 operations scheduled within the duration, the first right away.
+	if report.Operations < 40 || report.Operations > 51 {
+		t.Errorf("Run() at 200/s for 250ms applied %d operations; want about 50", report.Operations)
+	}
+}
+
+func TestGeneratorSeed(t *testing.T) {
+	w := testWorkload()
+	a, b := newGenerator(w, 0), newGenerator(w, 0)
+	for range 100 {
+		if opA, opB := a.next(), b.next(); opA != opB {
+			t.Fatalf("generators of the same seed diverged: %+v and %+v", opA, opB)
+		}
+	}
+}
+
+func TestWorkloadValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		modify   func(w *Workload)
+		expected string
+	}{
+		{"No accounts", func(w *Workload) { w.Accounts = nil }, "no accounts"},
+		{"Empty mix", func(w *Workload) { w.Mix = Mix{} }, "invalid mix"},
+		{"Transfers on one account", func(w *Workload) { w.Accounts = w.Accounts[:1] }, "at least 2 accounts"},
+		{"Inverted amounts", func(w *Workload) { w.MinAmount, w.MaxAmount = 20, 10 }, "invalid amounts"},
+		{"Skew of 1", func(w *Workload) { w.Skew = 1 }, "invalid skew"},
+		{"Endless", func(w *Workload) { w.Operations = 0 }, "neither duration nor operations"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := testWorkload()
+			tt.modify(&w)
+			if err := w.Validate(); err == nil || !strings.Contains(err.Error(), tt.expected) {
+				t.Errorf("Validate() = %v; want %q", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReportWriteTo(t *testing.T) {
+	report := Report{
+		Operations: 3,
+		Errors:     1,
+		ByKind:     map[Kind]int{Deposit: 2, Withdraw: 1},
+		ErrorsBy:   map[Kind]int{Withdraw: 1},
+		Elapsed:    time.Second,
+		Throughput: 3,
+		Latency:    Latencies{P50: time.Millisecond, P90: 2 * time.Millisecond, P99: 3 * time.Millisecond, Max: 4 * time.Millisecond},
+	}
+	var b strings.Builder
+	if _, err := report.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"operations: 3 in 1s (3.0/s), 1 failed", "withdraw 1, 1 failed", "p99 3ms"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("WriteTo() = %q; want %q in it", b.String(), want)
+		}
+	}
+	if strings.Contains(b.String(), "transfer") {
+		t.Errorf("WriteTo() = %q; want no line for transfers", b.String())
+	}
+}
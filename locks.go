@@ -0,0 +1,372 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrDeadlock is matched by a DeadlockError.
+var ErrDeadlock = errors.New("deadlock")
+
+// DeadlockError is returned to the victim of a deadlock between lock
+// owners, each waiting for accounts locked by the next: the waiting
+// operation or LockAccounts call of Victim is aborted, rather than every
+// one of them hanging until its locks time out.
+type DeadlockError struct {
+	Cycle  []string // owners, each waiting for the next, the last for the first
+	Victim string
+}
+
+func (e *DeadlockError) Error() string {
+	return fmt.Sprintf("%s: %s aborted waiting in %s", ErrDeadlock, e.Victim, strings.Join(append(slices.Clone(e.Cycle), e.Cycle[0]), " -> "))
+}
+
+func (e *DeadlockError) Is(target error) bool {
+	return target == ErrDeadlock
+}
+
+// LockOwnerHeader names the lock owner of a request, see WithLockOwner.
+const LockOwnerHeader = "X-Lock-Owner"
+
+// defaultLockTimeout is how long account locks are held at most unless
+// SetLockTimeout says otherwise.
+const defaultLockTimeout = 30 * time.Second
+
+// AccountLock is a lock held on an account, see LockAccounts.
+type AccountLock struct {
+	Account string    `json:"account"`
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+type lockOwnerKey struct{}
+
+// WithLockOwner runs the operations of ctx, including transactions, as
+// owner of account locks: LockAccounts locks accounts for it, and its
+// operations go through the accounts it locked, while those of others wait.
+func WithLockOwner(ctx context.Context, owner string) context.Context {
+	return context.WithValue(ctx, lockOwnerKey{}, owner)
+}
+
+func LockOwnerFrom(ctx context.Context) string {
+	owner, _ := ctx.Value(lockOwnerKey{}).(string)
+	return owner
+}
+
+// accountLocks are the locks held on accounts, and the owners waiting for
+// them, the edges of the wait-for graph deadlocks are cycles of.
+type accountLocks struct {
+	mu      sync.Mutex
+	timeout time.Duration           // 0 means defaultLockTimeout
+	held    map[string]*accountLock // by account
+	waiters map[*lockWaiter]bool
+}
+
+type accountLock struct {
+	owner    string
+	holds    int // calls of LockAccounts holding it
+	expires  time.Time
+	released chan struct{} // closed once released or expired
+}
+
+// lockWaiter is an operation or LockAccounts call of owner waiting for a
+// lock of blocker.
+type lockWaiter struct {
+	owner   string
+	blocker string
+	since   time.Time
+	abort   chan error // receives the DeadlockError of a victim
+}
+
+// lockWait is a lock an operation waits for.
+type lockWait struct {
+	waiter   *lockWaiter // nil for an operation of no owner
+	released <-chan struct{}
+	expires  time.Time
+}
+
+// release drops the lock on an account. l.mu must be held.
+func (l *accountLocks) release(id string) {
+	close(l.held[id].released)
+	delete(l.held, id)
+}
+
+// expire releases the locks held past their timeout. l.mu must be held.
+func (l *accountLocks) expire(now time.Time) {
+	for id, lock := range l.held {
+		if !now.Before(lock.expires) {
+			fmt.Printf("\n\nLock of %s on account %s expired\n", lock.owner, id)
+			l.release(id)
+		}
+	}
+}
+
+// blocking returns the lock of another owner than owner an operation on
+// accounts, or on every account with all, must wait for, if any, and adds
+// the wait to the wait-for graph. If waiting would close a cycle, a victim
+// among its owners is aborted with a DeadlockError: the one holding the
+// fewest locks, so the least work is undone, or of those the one waiting
+// since last.
+func (l *accountLocks) blocking(owner string, accounts []string, all bool, now time.Time) (*lockWait, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.held) == 0 {
+		return nil, nil
+	}
+	l.expire(now)
+
+	var blocker *accountLock
+	if all {
+		for _, lock := range l.held {
+			if lock.owner != owner {
+				blocker = lock
+				break
+			}
+		}
+	}
+	for _, id := range accounts {
+		if lock := l.held[id]; blocker == nil && lock != nil && lock.owner != owner {
+			blocker = lock
+		}
+	}
+	if blocker == nil {
+		return nil, nil
+	}
+	wait := &lockWait{released: blocker.released, expires: blocker.expires}
+	if owner == "" {
+		// It holds no lock, so no other operation waits for it.
+		return wait, nil
+	}
+
+	waiter := &lockWaiter{owner: owner, blocker: blocker.owner, since: now, abort: make(chan error, 1)}
+	if path := l.path(blocker.owner, owner, map[string]bool{}); path != nil {
+		cycle := append([]*lockWaiter{waiter}, path...)
+		victim := l.victim(cycle)
+		err := &DeadlockError{Victim: victim.owner}
+		for _, w := range cycle {
+			err.Cycle = append(err.Cycle, w.owner)
+		}
+		fmt.Println("\n\nDeadlock Error:", err)
+		if victim == waiter {
+			return nil, err
+		}
+		victim.abort <- err
+		delete(l.waiters, victim)
+	}
+	if l.waiters == nil {
+		l.waiters = map[*lockWaiter]bool{}
+	}
+	l.waiters[waiter] = true
+	wait.waiter = waiter
+	return wait, nil
+}
+
+// path returns the waiters through which from waits, directly or not, for
+// to, if it does. l.mu must be held.
+func (l *accountLocks) path(from, to string, visited map[string]bool) []*lockWaiter {
+	visited[from] = true
+	for w := range l.waiters {
+		if w.owner != from {
+			continue
+		}
+		if w.blocker == to {
+			return []*lockWaiter{w}
+		}
+		if !visited[w.blocker] {
+			if path := l.path(w.blocker, to, visited); path != nil {
+				return append([]*lockWaiter{w}, path...)
+			}
+		}
+	}
+	return nil
+}
+
+// victim returns the waiter of a cycle to abort. l.mu must be held.
+func (l *accountLocks) victim(cycle []*lockWaiter) *lockWaiter {
+	held := map[string]int{}
+	for _, lock := range l.held {
+		held[lock.owner]++
+	}
+	return slices.MinFunc(cycle, func(a, b *lockWaiter) int {
+		return cmp.Or(cmp.Compare(held[a.owner], held[b.owner]), b.since.Compare(a.since))
+	})
+}
+
+// await waits until the lock an operation waits for is released or
+// expires, unless ctx is done or it is the victim of a deadlock first.
+func (l *accountLocks) await(ctx context.Context, wait *lockWait) error {
+	expiry := time.NewTimer(time.Until(wait.expires))
+	defer expiry.Stop()
+	var abort <-chan error
+	if wait.waiter != nil {
+		abort = wait.waiter.abort
+	}
+
+	var err error
+	select {
+	case <-wait.released:
+	case <-expiry.C:
+	case err = <-abort:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if wait.waiter != nil {
+		l.mu.Lock()
+		delete(l.waiters, wait.waiter)
+		l.mu.Unlock()
+	}
+	return err
+}
+
+// notHeldBy returns accounts but those owner locked: its operations skip
+// the hot account queues of those, where an operation of another owner may
+// hold its turn waiting for them to be unlocked.
+func (l *accountLocks) notHeldBy(owner string, accounts []string) []string {
+	if owner == "" {
+		return accounts
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return slices.DeleteFunc(accounts, func(id string) bool {
+		lock := l.held[id]
+		return lock != nil && lock.owner == owner
+	})
+}
+
+// take locks accounts for owner and returns the function unlocking them.
+// The accounts must not be locked by another owner.
+func (l *accountLocks) take(owner string, accounts []string, now time.Time) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	taken := map[string]*accountLock{}
+	for _, id := range accounts {
+		lock := l.held[id]
+		if lock == nil {
+			if l.held == nil {
+				l.held = map[string]*accountLock{}
+			}
+			lock = &accountLock{owner: owner, released: make(chan struct{})}
+			l.held[id] = lock
+		}
+		lock.holds++
+		lock.expires = now.Add(cmp.Or(l.timeout, defaultLockTimeout))
+		taken[id] = lock
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			for id, lock := range taken {
+				// A lock that expired may have been taken by another owner since.
+				if l.held[id] == lock {
+					if lock.holds--; lock.holds == 0 {
+						l.release(id)
+					}
+				}
+			}
+		})
+	}
+}
+
+// lockFor takes the state lock for an operation of the lock owner of ctx on
+// accounts, or on every account with all, once no other owner holds a lock
+// on them, giving up if ctx is done first.
+func (sm *StateMachine) lockFor(ctx context.Context, accounts []string, all bool) error {
+	owner := LockOwnerFrom(ctx)
+	for {
+		if err := sm.lockContext(ctx); err != nil {
+			return err
+		}
+		wait, err := sm.locks.blocking(owner, accounts, all, time.Now())
+		if wait == nil && err == nil {
+			return nil
+		}
+		sm.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if err := sm.locks.await(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// LockAccounts locks accounts for the lock owner of ctx, see WithLockOwner,
+// e.g. for an external workflow engine to hold them across several calls.
+// It waits for other owners to release their locks on them, unless ctx is
+// done first, or it is the victim of a deadlock, see DeadlockError.
+// Operations of other owners, or of none, on locked accounts wait until
+// unlock is called, or the lock timeout passes, see SetLockTimeout, so a
+// coordinator that died does not hold them for good. Rollbacks, which may
+// change any account, wait for every lock of other owners. An owner may
+// lock an account again; it stays locked until every unlock.
+func (sm *StateMachine) LockAccounts(ctx context.Context, ids ...string) (unlock func(), err error) {
+	owner := LockOwnerFrom(ctx)
+	if owner == "" {
+		return nil, fmt.Errorf("%w: no lock owner to lock accounts for", ErrInvalidOperation)
+	}
+	if sm.readOnly {
+		return nil, ErrReadOnly
+	}
+	ids = slices.Compact(slices.Sorted(slices.Values(ids)))
+	if err := sm.lockFor(ctx, ids, false); err != nil {
+		return nil, err
+	}
+	defer sm.mu.Unlock()
+
+	for _, id := range ids {
+		if _, ok := sm.accounts[id]; !ok {
+			return nil, fmt.Errorf("%w (%s) to lock", ErrInvalidAccount, id)
+		}
+	}
+	return sm.locks.take(owner, ids, time.Now()), nil
+}
+
+// SetLockTimeout sets how long account locks are held at most, 30 seconds
+// if 0. It applies to locks taken from then on.
+func (sm *StateMachine) SetLockTimeout(timeout time.Duration) {
+	sm.locks.mu.Lock()
+	defer sm.locks.mu.Unlock()
+	sm.locks.timeout = timeout
+}
+
+// ReleaseLocks releases every lock held by owner and returns how many it
+// held.
+func (sm *StateMachine) ReleaseLocks(owner string) int {
+	l := &sm.locks
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	released := 0
+	for id, lock := range l.held {
+		if lock.owner == owner {
+			l.release(id)
+			released++
+		}
+	}
+	return released
+}
+
+// Locks returns the locks held on accounts, by account.
+func (sm *StateMachine) Locks() []AccountLock {
+	l := &sm.locks
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(time.Now())
+
+	locks := []AccountLock{}
+	for id, lock := range l.held {
+		locks = append(locks, AccountLock{Account: id, Owner: lock.owner, Expires: lock.expires})
+	}
+	slices.SortFunc(locks, func(a, b AccountLock) int { return cmp.Compare(a.Account, b.Account) })
+	return locks
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitingFor returns the owners an owner waits for.
+func waitingFor(sm *StateMachine, owner string) []string {
+	sm.locks.mu.Lock()
+	defer sm.locks.mu.Unlock()
+	var blockers []string
+	for w := range sm.locks.waiters {
+		if w.owner == owner {
+			blockers = append(blockers, w.blocker)
+		}
+	}
+	return blockers
+}
+
+// awaitWaiting waits until owner waits for blocker.
+func awaitWaiting(t *testing.T, sm *StateMachine, owner, blocker string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !slices.Contains(waitingFor(sm, owner), blocker); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not waiting for %s", owner, blocker)
+		}
+	}
+}
+
+func TestLockAccounts(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 0}}
+	coordinator := WithLockOwner(context.Background(), "workflow-1")
+
+	if _, err := sm.LockAccounts(context.Background(), "acc1"); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("LockAccounts() without owner error = %v; want %v", err, ErrInvalidOperation)
+	}
+	if _, err := sm.LockAccounts(coordinator, "acc1", "nope"); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("LockAccounts() of an unknown account error = %v; want %v", err, ErrInvalidAccount)
+	}
+
+	unlock, err := sm.LockAccounts(coordinator, "acc1", "acc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.TransferContext(coordinator, "acc1", "acc2", 10); err != nil {
+		t.Errorf("TransferContext() of the owner error = %v", err)
+	}
+
+	timeout := func() context.Context {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		t.Cleanup(cancel)
+		return ctx
+	}
+	tests := []struct {
+		name string
+		op   func(ctx context.Context) error
+	}{
+		{"Deposit", func(ctx context.Context) error { return sm.DepositContext(ctx, "acc1", 1) }},
+		{"Transfer in", func(ctx context.Context) error { return sm.TransferContext(ctx, "acc2", "acc1", 1) }},
+		{"Rollback", sm.RollbackContext},
+		{"Transaction", func(ctx context.Context) error {
+			return sm.TxContext(ctx, func(tx *Tx) error { return tx.Deposit("acc1", 1) })
+		}},
+		{"Lock of another owner", func(ctx context.Context) error {
+			_, err := sm.LockAccounts(WithLockOwner(ctx, "workflow-2"), "acc1")
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		if err := tt.op(timeout()); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s on a locked account error = %v; want %v", tt.name, err, context.DeadlineExceeded)
+		}
+	}
+	if err := sm.DepositContext(timeout(), "acc2", 1); err != nil {
+		t.Errorf("DepositContext() to an account not locked error = %v", err)
+	}
+
+	done := make(chan error)
+	go func() { done <- sm.Deposit("acc1", 5) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Deposit() = %v before unlock; want it waiting", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	unlock() // a no-op
+	if err := <-done; err != nil || sm.accounts["acc1"] != 95 {
+		t.Errorf("Deposit() after unlock = %v, acc1 = %d; want 95", err, sm.accounts["acc1"])
+	}
+	if locks := sm.Locks(); len(locks) != 0 {
+		t.Errorf("Locks() = %+v after unlock; want none", locks)
+	}
+}
+
+func TestLockReentry(t *testing.T) {
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	ctx := WithLockOwner(context.Background(), "workflow-1")
+
+	first, _ := sm.LockAccounts(ctx, "acc1")
+	second, _ := sm.LockAccounts(ctx, "acc1")
+	first()
+	if locks := sm.Locks(); len(locks) != 1 || locks[0].Owner != "workflow-1" {
+		t.Errorf("Locks() = %+v; want acc1 still locked", locks)
+	}
+	second()
+	if locks := sm.Locks(); len(locks) != 0 {
+		t.Errorf("Locks() = %+v; want none", locks)
+	}
+
+	_, _ = sm.LockAccounts(ctx, "acc1")
+	if released := sm.ReleaseLocks("workflow-1"); released != 1 || len(sm.Locks()) != 0 {
+		t.Errorf("ReleaseLocks() = %d, leaving %+v; want 1 released", released, sm.Locks())
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	sm.SetLockTimeout(20 * time.Millisecond)
+	unlock, err := sm.LockAccounts(WithLockOwner(context.Background(), "workflow-1"), "acc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := sm.Deposit("acc1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 10*time.Millisecond {
+		t.Errorf("Deposit() waited %s; want until the lock expired", waited)
+	}
+
+	// Unlocking late leaves the lock of the next owner alone.
+	next, _ := sm.LockAccounts(WithLockOwner(context.Background(), "workflow-2"), "acc1")
+	defer next()
+	unlock()
+	if locks := sm.Locks(); len(locks) != 1 || locks[0].Owner != "workflow-2" {
+		t.Errorf("Locks() = %+v; want workflow-2's", locks)
+	}
+}
+
+func TestLockDeadlock(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 0}}
+	a := WithLockOwner(context.Background(), "a")
+	b := WithLockOwner(context.Background(), "b")
+	unlockA, _ := sm.LockAccounts(a, "acc1")
+	unlockB, _ := sm.LockAccounts(b, "acc2")
+
+	done := make(chan error)
+	go func() { done <- sm.TransferContext(a, "acc1", "acc2", 10) }()
+	awaitWaiting(t, sm, "a", "b")
+
+	// Both hold a lock, so the one waiting since last is the victim.
+	_, err := sm.LockAccounts(b, "acc1")
+	var deadlock *DeadlockError
+	if !errors.As(err, &deadlock) || !errors.Is(err, ErrDeadlock) || deadlock.Victim != "b" || !slices.Equal(deadlock.Cycle, []string{"b", "a"}) {
+		t.Errorf("LockAccounts() closing a cycle error = %v; want b aborted in b -> a -> b", err)
+	}
+	unlockB()
+	if err := <-done; err != nil {
+		t.Errorf("TransferContext() once b unlocked error = %v", err)
+	}
+	unlockA()
+}
+
+func TestDeadlockVictim(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 100, "acc3": 100, "acc4": 100, "acc5": 100}}
+	a := WithLockOwner(context.Background(), "a")
+	b := WithLockOwner(context.Background(), "b")
+	c := WithLockOwner(context.Background(), "c")
+	unlockA, _ := sm.LockAccounts(a, "acc1", "acc4")
+	unlockB, _ := sm.LockAccounts(b, "acc2")
+	unlockC, _ := sm.LockAccounts(c, "acc3", "acc5")
+	defer unlockA()
+	defer unlockC()
+
+	// a waits for b, b for c: c closing the cycle aborts b, the one holding
+	// a single lock.
+	aDone := make(chan error)
+	go func() { aDone <- sm.TransferContext(a, "acc1", "acc2", 1) }()
+	awaitWaiting(t, sm, "a", "b")
+	bDone := make(chan error)
+	go func() { bDone <- sm.TransferContext(b, "acc2", "acc3", 1) }()
+	awaitWaiting(t, sm, "b", "c")
+	cDone := make(chan error)
+	go func() { cDone <- sm.TransferContext(c, "acc3", "acc1", 1) }()
+
+	err := <-bDone
+	var deadlock *DeadlockError
+	if !errors.As(err, &deadlock) || deadlock.Victim != "b" || !slices.Equal(deadlock.Cycle, []string{"c", "a", "b"}) {
+		t.Fatalf("TransferContext() of b error = %v; want b aborted in c -> a -> b -> c", err)
+	}
+	awaitWaiting(t, sm, "c", "a")
+
+	// Once the victim gives its locks up, the others go through.
+	unlockB()
+	if err := <-aDone; err != nil {
+		t.Errorf("TransferContext() of a error = %v", err)
+	}
+	unlockA()
+	if err := <-cDone; err != nil {
+		t.Errorf("TransferContext() of c error = %v", err)
+	}
+}
+
+func TestLockedHotAccount(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 0}}
+	sm.DetectHotAccounts(HotAccountOptions{MinRate: 1, Window: time.Hour, Queue: true})
+	for range 4000 {
+		_ = sm.Deposit("acc1", 1)
+	}
+	owner := WithLockOwner(context.Background(), "workflow-1")
+	unlock, _ := sm.LockAccounts(owner, "acc1")
+
+	// Another operation holds the turn of acc1 waiting for the lock, which
+	// the owner's operations get past.
+	done := make(chan error)
+	go func() { done <- sm.Deposit("acc1", 1) }()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if hot := sm.HotAccounts(); len(hot) == 1 && hot[0].Queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no deposit queued for acc1")
+		}
+	}
+	ctx, cancel := context.WithTimeout(owner, time.Second)
+	defer cancel()
+	if err := sm.DepositContext(ctx, "acc1", 1); err != nil {
+		t.Errorf("DepositContext() of the owner error = %v", err)
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServerLocks(t *testing.T) {
+	srv, _ := newTestServer(map[string]int{"acc1": 100})
+	handler := srv.Handler()
+
+	request := func(method, path, owner, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if owner != "" {
+			req.Header.Set(LockOwnerHeader, owner)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request(http.MethodPost, "/locks", "", `{"accounts": ["acc1"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /locks without owner = %d; want %d", rec.Code, http.StatusBadRequest)
+	}
+	rec := request(http.MethodPost, "/locks", "workflow-1", `{"accounts": ["acc1"]}`)
+	var locks []AccountLock
+	if err := json.NewDecoder(rec.Body).Decode(&locks); err != nil || rec.Code != http.StatusOK || len(locks) != 1 || locks[0].Account != "acc1" {
+		t.Fatalf("POST /locks = %d, %+v, %v; want acc1 locked", rec.Code, locks, err)
+	}
+	if rec := request(http.MethodPost, "/accounts/acc1/deposit", "workflow-1", `{"amount": 1}`); rec.Code != http.StatusOK {
+		t.Errorf("POST deposit of the owner = %d; want %d", rec.Code, http.StatusOK)
+	}
+	if rec := request(http.MethodGet, "/locks", "", ""); !strings.Contains(rec.Body.String(), "workflow-1") {
+		t.Errorf("GET /locks = %s; want workflow-1's lock", rec.Body)
+	}
+
+	rec = request(http.MethodDelete, "/locks", "workflow-1", "")
+	var released releaseLocksResponse
+	if err := json.NewDecoder(rec.Body).Decode(&released); err != nil || released.Released != 1 {
+		t.Errorf("DELETE /locks = %d, %+v, %v; want 1 released", rec.Code, released, err)
+	}
+}
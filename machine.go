@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Transition computes the next state of a Machine. It is given a copy of the
+// current state, so it may modify it in place, and returns the state to move
+// to or an error to leave the state untouched.
+type Transition[S any] func(state S) (S, error)
+
+// Machine manages a state of any type with the guarantees StateMachine gives
+// account balances: transitions are applied one at a time, every applied
+// transition can be rolled back, and Close drains in-flight transitions. It
+// lets inventories, quotas and the like be managed the same way, e.g.
+//
+//	stock := NewMachine(map[string]int{"widget": 10}, maps.Clone[map[string]int], 100)
+//	err := stock.Apply(func(s map[string]int) (map[string]int, error) {
+//		s["widget"] -= 2
+//		return s, nil
+//	})
+type Machine[S any] struct {
+	mu         sync.Mutex
+	state      S
+	history    []S // past states for rollback, oldest first
+	clone      func(S) S
+	maxHistory int
+	version    int
+	lifecycle  lifecycle
+}
+
+// NewMachine returns a machine in the initial state. clone copies a state so
+// transitions cannot modify the states the machine holds; nil means S is
+// copied by assignment, which suits states holding no maps, slices or
+// pointers. maxHistory bounds the number of states kept for rollback, 0 means
+// no bound.
+func NewMachine[S any](initial S, clone func(S) S, maxHistory int) *Machine[S] {
+	if clone == nil {
+		clone = func(s S) S { return s }
+	}
+	return &Machine[S]{
+		state:      initial,
+		clone:      clone,
+		maxHistory: maxHistory,
+	}
+}
+
+// State returns a copy of the current state.
+func (m *Machine[S]) State() S {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.clone(m.state)
+}
+
+// Version returns the number of transitions applied and not rolled back.
+func (m *Machine[S]) Version() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.version
+}
+
+// Apply moves the machine to the state t returns. If t fails the state is
+// left untouched and its error is returned.
+func (m *Machine[S]) Apply(t Transition[S]) error {
+	return m.ApplyContext(context.Background(), t)
+}
+
+// ApplyContext is like Apply but gives up without applying anything if ctx
+// is done before the transition starts.
+func (m *Machine[S]) ApplyContext(ctx context.Context, t Transition[S]) error {
+	if err := m.lifecycle.begin(); err != nil {
+		return err
+	}
+	defer m.lifecycle.end()
+
+	if err := lockContext(ctx, &m.mu); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	next, err := t(m.clone(m.state))
+	if err != nil {
+		return err
+	}
+
+	m.history = append(m.history, m.state)
+	if m.maxHistory > 0 && len(m.history) > m.maxHistory {
+		m.history = m.history[len(m.history)-m.maxHistory:] // forget the oldest states
+	}
+	m.state = next
+	m.version++
+
+	return nil
+}
+
+// Simulate returns the state t would move the machine to, without applying
+// it.
+func (m *Machine[S]) Simulate(t Transition[S]) (S, error) {
+	return t(m.State())
+}
+
+// Rollback returns the machine to the state before the last applied
+// transition.
+func (m *Machine[S]) Rollback() error {
+	return m.RollbackContext(context.Background())
+}
+
+// RollbackContext is like Rollback but gives up without rolling back if ctx
+// is done before the rollback starts.
+func (m *Machine[S]) RollbackContext(ctx context.Context) error {
+	if err := m.lifecycle.begin(); err != nil {
+		return err
+	}
+	defer m.lifecycle.end()
+
+	if err := lockContext(ctx, &m.mu); err != nil {
+		return err
+	}
+	defer m.mu.Unlock()
+
+	historyLength := len(m.history)
+	if historyLength == 0 {
+		return fmt.Errorf("%w (version %d)", ErrNothingToRollback, m.version)
+	}
+
+	m.state = m.history[historyLength-1]
+	m.history = m.history[:historyLength-1]
+	m.version--
+
+	return nil
+}
+
+// Close stops the machine from accepting new transitions and waits for
+// in-flight ones to finish, or for ctx to be done, whichever is first.
+func (m *Machine[S]) Close(ctx context.Context) error {
+	select {
+	case <-m.lifecycle.close():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
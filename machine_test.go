@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+	"testing"
+)
+
+var errOutOfStock = errors.New("out of stock")
+
+func take(sku string, n int) Transition[map[string]int] {
+	return func(stock map[string]int) (map[string]int, error) {
+		if stock[sku] < n {
+			return nil, fmt.Errorf("%w (%s)", errOutOfStock, sku)
+		}
+		stock[sku] -= n
+		return stock, nil
+	}
+}
+
+func TestMachine(t *testing.T) {
+	m := NewMachine(map[string]int{"widget": 10, "gadget": 3}, maps.Clone[map[string]int], 0)
+
+	tests := []struct {
+		name          string
+		transition    Transition[map[string]int]
+		rollback      bool
+		expectedErr   error
+		expectedStock map[string]int
+	}{
+		{name: "Take", transition: take("widget", 4), expectedStock: map[string]int{"widget": 6, "gadget": 3}},
+		{name: "Take more", transition: take("gadget", 3), expectedStock: map[string]int{"widget": 6, "gadget": 0}},
+		{name: "Out of stock", transition: take("gadget", 1), expectedErr: errOutOfStock, expectedStock: map[string]int{"widget": 6, "gadget": 0}},
+		{name: "Rollback", rollback: true, expectedStock: map[string]int{"widget": 6, "gadget": 3}},
+		{name: "Rollback again", rollback: true, expectedStock: map[string]int{"widget": 10, "gadget": 3}},
+		{name: "Nothing to rollback", rollback: true, expectedErr: ErrNothingToRollback, expectedStock: map[string]int{"widget": 10, "gadget": 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			if tt.rollback {
+				err = m.Rollback()
+			} else {
+				err = m.Apply(tt.transition)
+			}
+			if !errors.Is(err, tt.expectedErr) {
+				t.Errorf("err = %v; want %v", err, tt.expectedErr)
+			}
+			if stock := m.State(); !maps.Equal(stock, tt.expectedStock) {
+				t.Errorf("State = %v; want %v", stock, tt.expectedStock)
+			}
+		})
+	}
+}
+
+func TestMachineFailedTransitionLeavesState(t *testing.T) {
+	m := NewMachine(map[string]int{"widget": 1}, maps.Clone[map[string]int], 0)
+
+	err := m.Apply(func(stock map[string]int) (map[string]int, error) {
+		stock["widget"] = 100
+		return nil, errOutOfStock
+	})
+	if !errors.Is(err, errOutOfStock) {
+		t.Fatalf("Apply = %v; want %v", err, errOutOfStock)
+	}
+	if stock := m.State(); stock["widget"] != 1 || m.Version() != 0 {
+		t.Errorf("State = %v at version %d; want untouched", stock, m.Version())
+	}
+}
+
+func TestMachineValueState(t *testing.T) {
+	type quota struct{ Used, Limit int }
+	m := NewMachine(quota{Limit: 2}, nil, 1)
+
+	use := func(q quota) (quota, error) {
+		if q.Used == q.Limit {
+			return q, errors.New("quota exceeded")
+		}
+		q.Used++
+		return q, nil
+	}
+
+	for range 2 {
+		if err := m.Apply(use); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.Apply(use); err == nil {
+		t.Error("Apply over the limit succeeded")
+	}
+	if q, err := m.Simulate(use); err == nil {
+		t.Errorf("Simulate over the limit = %v; want error", q)
+	}
+
+	if err := m.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Rollback(); !errors.Is(err, ErrNothingToRollback) {
+		t.Errorf("Rollback past maxHistory = %v; want %v", err, ErrNothingToRollback)
+	}
+	if q := m.State(); q.Used != 1 {
+		t.Errorf("State = %+v; want 1 used", q)
+	}
+}
+
+func TestMachineConcurrentApplyAndClose(t *testing.T) {
+	m := NewMachine(0, nil, 10)
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = m.Apply(func(n int) (int, error) { return n + 1, nil })
+		}()
+	}
+	wg.Wait()
+
+	if n := m.State(); n != 50 {
+		t.Errorf("State = %d; want 50", n)
+	}
+
+	if err := m.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Apply(func(n int) (int, error) { return n, nil }); !errors.Is(err, ErrClosed) {
+		t.Errorf("Apply after Close = %v; want %v", err, ErrClosed)
+	}
+}
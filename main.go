@@ -1,16 +1,37 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"maps"
 	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Olusamimaths/vaultflow/config"
+	"github.com/Olusamimaths/vaultflow/plugin"
 )
 
+var (
+	ErrInvalidAccount      = errors.New("invalid account")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrNothingToRollback   = errors.New("nothing to rollback")
+	ErrVersionConflict     = errors.New("state changed since the version expected")
+)
 
 type Account struct {
-	ID      string
-	Balance int
+	ID      string   `json:"id"`
+	Balance int      `json:"balance"`
+	Tags    []string `json:"tags,omitempty"`
 }
 
 type StateTransitions interface {
@@ -21,22 +42,280 @@ type StateTransitions interface {
 }
 
 type StateMachine struct {
-	accounts map[string]int   // store current state => current balance of each account
-	history  []map[string]int // => stores past states for rollback
+	accounts map[string]int      // store current state => current balance of each account
+	history  stateHistory        // => stores past states for rollback
+	tags     map[string][]string // tags of each account, see SetAccountTags
+	aliases  aliases             // see SetAlias
 	mu       sync.Mutex
+
+	maxHistory int // max number of states kept in history, 0 means unbounded
+	lifecycle  lifecycle
+	limiter    *RateLimiter // nil means operations are not rate limited
+
+	tenants map[string]*StateMachine // isolated account namespaces, by tenant id
+
+	hooksMu sync.RWMutex
+	hooks   []Hooks
+
+	approvals      atomic.Pointer[approvals] // nil means transfers never need approval
+	clock          Clock                     // nil means WallClock
+	streams        streams                   // subscribers to operation events
+	outbox         outbox                    // events waiting to be published, guarded by mu
+	inbox          inbox                     // operations of processed messages, guarded by mu
+	escrows        escrows
+	multisig       multisig // signer sets and debits waiting for signatures
+	standingOrders standingOrders
+	scripts        scripts
+	policies       policies
+	alerts         alerts // guarded by mu
+	stats          stats  // guarded by mu
+	balanceIndex   balanceIndex
+	state          atomic.Pointer[State]      // balances for reads, see State
+	archived       map[string]ArchivedAccount // accounts set aside, see ArchiveAccount; guarded by mu
+	lastActive     map[string]time.Time       // when each account was last touched, guarded by mu
+	statuses       map[string]AccountStatus   // of the accounts not active, guarded by mu
+	tombstones     []Tombstone                // of pruned operations, guarded by mu
+	exported       string                     // ID of the last operation exported, see Export; guarded by mu
+	settings       settings                   // changes of the settings, see Reconfigure
+	flags          flags                      // feature flags set at runtime, see SetFlag
+	compensations  compensations              // of failed composite operations, see RunComposite
+	deadLetters    deadLetters                // operations submitted that failed, guarded by mu
+	quota          quota                      // limits of a tenant, see SetQuota
+	memory         memoryLimit                // see SetMemoryLimit, guarded by mu
+	hot            hotAccounts                // see DetectHotAccounts
+	locks          accountLocks               // see LockAccounts
+
+	readOnly    bool        // set on replicas, which only apply their leader's operations
+	version     int         // number of states saved and not rolled back
+	journal     []Operation // applied operations, oldest first
+	opIndex     operationIndex
+	ids         ulids                  // generates operation, alert, escrow, debit and standing order IDs
+	accountIDs  AccountIDGenerator     // see UseAccountIDs, nil means ULIDs from ids
+	codec       Codec                  // of snapshots, see UseCodec, nil means JSON
+	compression Compression            // of snapshots, see UseCompression
+	wal         *WAL                   // see UseWAL
+	unlogged    []unlogged             // changes the log may not keep yet, see revertUnlogged
+	epoch       atomic.Pointer[string] // see Epoch, nil until it starts
+}
+
+// execute runs the admission checks and hooks shared by every operation, then
+// applies op with the state lock held, giving up if ctx is done before the
+// lock is taken. op is applied entirely under the lock, so an operation that
+// times out has never applied anything. The applied operation, with its ID
+// and resulting version, is returned.
+func (sm *StateMachine) execute(ctx context.Context, op Operation) (Operation, error) {
+	if err := sm.lifecycle.begin(); err != nil {
+		return op, err
+	}
+	defer sm.lifecycle.end()
+
+	if sm.readOnly {
+		return op, ErrReadOnly
+	}
+	if err := sm.wal.Err(); err != nil {
+		return op, err
+	}
+	if err := checkEscrowAccounts(ctx, op); err != nil {
+		return op, err
+	}
+	if err := sm.parkDebit(ctx, op); err != nil {
+		return op, err
+	}
+	if err := sm.limiter.AllowOperation(op.accounts()...); err != nil {
+		return op, err
+	}
+
+	op.Time = sm.now()
+	op.ID = sm.newOperationID(op.Time)
+	op = correlate(ctx, op)
+	op = fence(ctx, op)
+
+	hooks := sm.registeredHooks()
+	op = sm.classify(ctx, hooks, op)
+	err := sm.runBeforeHooks(ctx, hooks, op)
+	release := func() {}
+	if err == nil {
+		release, err = sm.hot.queue(ctx, op.Time, sm.locks.notHeldBy(LockOwnerFrom(ctx), op.accounts()))
+	}
+	if err == nil {
+		waitedSince := time.Now()
+		err = sm.lockFor(ctx, op.accounts(), op.Type == OpRollback || op.Type == OpRollbackTo)
+		if err == nil {
+			sm.hot.record(op.Time, op.accounts(), time.Since(waitedSince))
+		} else {
+			release()
+		}
+	}
+	if err == nil {
+		var written uint64
+		err = sm.checkEpoch(op.Epoch)
+		if err == nil {
+			err = sm.apply(op)
+		}
+		if err == nil {
+			if op, err = sm.record(op); err == nil {
+				written = sm.wal.Written()
+				sm.logged(written)
+			} else {
+				err = errors.Join(err, sm.revertUnlogged())
+			}
+		} else if live := sm.state.Load(); live != nil && live.version != sm.version {
+			// The state a rejected operation saved to history still counts
+			// as a version, which readers must see too.
+			sm.updateState()
+		}
+		sm.mu.Unlock()
+		release()
+		if err == nil {
+			// Wait for the operation to be durable once unlocked, so the
+			// operations applied meanwhile share the flush.
+			if err = sm.wal.Sync(written); err != nil {
+				sm.mu.Lock()
+				err = errors.Join(err, sm.revertUnlogged())
+				sm.mu.Unlock()
+			}
+		}
+	}
+
+	sm.runAfterHooks(ctx, hooks, op, err)
+	return op, err
+}
+
+// apply dispatches op to the function applying its type. sm.mu must be held.
+func (sm *StateMachine) apply(op Operation) error {
+	if op.MessageID != "" {
+		if err := sm.checkMessage(op.MessageID); err != nil {
+			return err
+		}
+	}
+	if op.Reverses != "" {
+		if err := sm.checkReversible(op.Reverses); err != nil {
+			return err
+		}
+	}
+	if err := sm.checkArchived(op); err != nil {
+		return err
+	}
+	if err := sm.checkStatus(op); err != nil {
+		return err
+	}
+	if err := sm.checkQuota(op); err != nil {
+		return err
+	}
+	if err := sm.checkMemory(op); err != nil {
+		return err
+	}
+
+	switch op.Type {
+	case OpDeposit:
+		return sm.applyDeposit(op)
+	case OpWithdraw:
+		return sm.applyWithdraw(op)
+	case OpTransfer:
+		return sm.applyTransfer(op)
+	case OpOpen:
+		return sm.applyOpen(op)
+	case OpMove:
+		return sm.applyMove(op)
+	case OpArchive:
+		return sm.applyArchive(op)
+	case OpUnarchive:
+		return sm.applyUnarchive(op)
+	case OpSetStatus:
+		return sm.applySetStatus(op)
+	case OpRollback:
+		return sm.applyRollback(op)
+	case OpRollbackTo:
+		return sm.applyRollbackTo(op)
+	}
+	return fmt.Errorf("%w: unknown type %q", ErrInvalidOperation, op.Type)
+}
+
+// record publishes the event of an applied operation, then journals it and
+// marks its message processed, returning it with its resulting version. It
+// fails if the write-ahead log cannot record the event, leaving the
+// operation to be undone with revertUnlogged. sm.mu must be held.
+func (sm *StateMachine) record(op Operation) (Operation, error) {
+	rollback := op.Type == OpRollback || op.Type == OpRollbackTo
+	if !rollback {
+		op.Version = sm.version
+	}
+	if err := sm.publish(op); err != nil {
+		return op, err
+	}
+	if !rollback {
+		sm.journalOperation(op)
+	}
+	if op.MessageID != "" {
+		sm.inbox.add(op)
+		sm.onRevert(func() error {
+			sm.inbox.forget(op.MessageID)
+			return nil
+		})
+	}
+	return op, nil
+}
+
+// lockContext locks sm.mu unless ctx is done first.
+func (sm *StateMachine) lockContext(ctx context.Context) error {
+	return lockContext(ctx, &sm.mu)
+}
+
+// lockContext locks mu unless ctx is done first.
+func lockContext(ctx context.Context, mu *sync.Mutex) error {
+	if ctx.Done() == nil {
+		mu.Lock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		mu.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		if err := ctx.Err(); err != nil {
+			mu.Unlock()
+			return err
+		}
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			mu.Unlock() // the lock is no longer wanted
+		}()
+		return ctx.Err()
+	}
 }
 
 func (sm *StateMachine) Deposit(accountId string, amount int) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	return sm.DepositContext(context.Background(), accountId, amount)
+}
+
+// DepositContext is like Deposit but gives up without applying anything if
+// ctx is done before the operation starts.
+func (sm *StateMachine) DepositContext(ctx context.Context, accountId string, amount int) error {
+	_, err := sm.execute(ctx, Operation{Type: OpDeposit, To: accountId, Amount: amount})
+	return err
+}
+
+func (sm *StateMachine) applyDeposit(op Operation) error {
+	accountId, amount := op.To, op.Amount
 	fmt.Printf("\n\nDepositing %d to account %s\n", amount, accountId)
 
-	sm.saveState()
+	sm.saveState(bucketKeys(accountId, op.ToBucket)...)
 
 	if _, ok := sm.accounts[accountId]; !ok {
-		return fmt.Errorf("invalid account (%s) to deposit to", accountId)
+		return fmt.Errorf("%w (%s) to deposit to", ErrInvalidAccount, accountId)
 	}
 
+	sm.useBuckets(accountId, op.ToBucket)
+	sm.addToBucket(accountId, op.ToBucket, amount)
 	sm.accounts[accountId] += amount
 
 	fmt.Println("After Deposit:", sm.accounts)
@@ -45,21 +324,33 @@ func (sm *StateMachine) Deposit(accountId string, amount int) error {
 }
 
 func (sm *StateMachine) Withdraw(accountId string, amount int) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	return sm.WithdrawContext(context.Background(), accountId, amount)
+}
+
+// WithdrawContext is like Withdraw but gives up without applying anything if
+// ctx is done before the operation starts.
+func (sm *StateMachine) WithdrawContext(ctx context.Context, accountId string, amount int) error {
+	_, err := sm.execute(ctx, Operation{Type: OpWithdraw, From: accountId, Amount: amount})
+	return err
+}
+
+func (sm *StateMachine) applyWithdraw(op Operation) error {
+	accountId, amount := op.From, op.Amount
 	fmt.Printf("\n\nWithdrawing %d from account %s\n", amount, accountId)
 
-	sm.saveState()
+	sm.saveState(bucketKeys(accountId, op.FromBucket)...)
 
 	if _, ok := sm.accounts[accountId]; !ok {
-		return fmt.Errorf("invalid account (%s) to withdraw from", accountId)
+		return fmt.Errorf("%w (%s) to withdraw from", ErrInvalidAccount, accountId)
 	}
 
-	currentBalance := sm.accounts[accountId]
+	currentBalance := sm.bucketBalance(accountId, op.FromBucket)
 	if currentBalance < amount {
-		return fmt.Errorf("insufficient balance (%d)", currentBalance)
+		return fmt.Errorf("%w (%d)", ErrInsufficientBalance, currentBalance)
 	}
 
+	sm.useBuckets(accountId, op.FromBucket)
+	sm.addToBucket(accountId, op.FromBucket, -amount)
 	sm.accounts[accountId] -= amount
 
 	fmt.Println("After Withdraw:", sm.accounts)
@@ -68,25 +359,46 @@ func (sm *StateMachine) Withdraw(accountId string, amount int) error {
 }
 
 func (sm *StateMachine) Transfer(fromAccountId, toAccountId string, amount int) error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	return sm.TransferContext(context.Background(), fromAccountId, toAccountId, amount)
+}
+
+// TransferContext is like Transfer but gives up without applying anything if
+// ctx is done before the operation starts.
+//
+// When approvals are required and amount is above the threshold, the transfer
+// is parked instead and an *ApprovalRequiredError is returned.
+func (sm *StateMachine) TransferContext(ctx context.Context, fromAccountId, toAccountId string, amount int) error {
+	if err := sm.parkTransfer(ctx, fromAccountId, toAccountId, amount); err != nil {
+		return err
+	}
+
+	_, err := sm.execute(ctx, Operation{Type: OpTransfer, From: fromAccountId, To: toAccountId, Amount: amount})
+	return err
+}
+
+func (sm *StateMachine) applyTransfer(op Operation) error {
+	fromAccountId, toAccountId, amount := op.From, op.To, op.Amount
 	fmt.Printf("\n\nTransfering %d from account %s to account %s\n", amount, fromAccountId, toAccountId)
 
-	sm.saveState()
+	sm.saveState(append(bucketKeys(fromAccountId, op.FromBucket), bucketKeys(toAccountId, op.ToBucket)...)...)
 
 	if _, ok := sm.accounts[fromAccountId]; !ok {
-		return fmt.Errorf("invalid sender account %s", fromAccountId)
+		return fmt.Errorf("%w (%s) to transfer from", ErrInvalidAccount, fromAccountId)
 	}
 
 	if _, ok := sm.accounts[toAccountId]; !ok {
-		return fmt.Errorf("invalid receiver account %s", toAccountId)
+		return fmt.Errorf("%w (%s) to transfer to", ErrInvalidAccount, toAccountId)
 	}
 
-	currentBalanceOfSender := sm.accounts[fromAccountId]
+	currentBalanceOfSender := sm.bucketBalance(fromAccountId, op.FromBucket)
 	if currentBalanceOfSender < amount {
-		return fmt.Errorf("insufficient balance (%d) to transfer (%d) from", currentBalanceOfSender, amount)
+		return fmt.Errorf("%w (%d) to transfer (%d) from", ErrInsufficientBalance, currentBalanceOfSender, amount)
 	}
 
+	sm.useBuckets(fromAccountId, op.FromBucket)
+	sm.useBuckets(toAccountId, op.ToBucket)
+	sm.addToBucket(fromAccountId, op.FromBucket, -amount)
+	sm.addToBucket(toAccountId, op.ToBucket, amount)
 	sm.accounts[fromAccountId] -= amount
 	sm.accounts[toAccountId] += amount
 
@@ -95,24 +407,105 @@ func (sm *StateMachine) Transfer(fromAccountId, toAccountId string, amount int)
 	return nil
 }
 
-func (sm *StateMachine) saveState() {
-	snapshot := make(map[string]int)
-	maps.Copy(snapshot, sm.accounts)
-	sm.history = append(sm.history, snapshot)
+// Balance returns the current balance of an account. Like Balances, it
+// reads the current State and never waits for an operation being applied,
+// unless FlagStateReads is off.
+func (sm *StateMachine) Balance(accountId string) (int, error) {
+	if !sm.Enabled(FlagStateReads) {
+		return sm.lockedBalance(accountId)
+	}
+	return sm.State().Balance(accountId)
 }
 
+// Balances returns the current balance of every account. The balances of
+// their buckets are left out, see Buckets.
+func (sm *StateMachine) Balances() map[string]int {
+	if !sm.Enabled(FlagStateReads) {
+		return sm.lockedBalances()
+	}
+	return sm.State().Balances()
+}
+
+// saveState saves the current state to history before the accounts with the
+// given ids change, or any account when no ids are given.
+func (sm *StateMachine) saveState(ids ...string) {
+	version := sm.version
+	sm.history.save(version, sm.now(), sm.accounts, ids...)
+	sm.history.trim(sm.maxHistory)
+	sm.version++
+	sm.onRevert(func() error {
+		accounts, err := sm.history.restore(sm.accounts, version)
+		if err != nil {
+			return err
+		}
+		sm.accounts, sm.version = accounts, version
+		sm.forgetOperationsAfter(version)
+		return nil
+	})
+}
+
+// Rollback undoes the latest state change.
+//
+// Rollbacks are operations like any other: they are applied one at a time
+// in the order they take the state lock, journaled and published at their
+// place in the log. A rollback undoes the change applied just before it,
+// whichever writer applied it, and operations still in flight when it is
+// requested are applied after it, on the state it rolled back to; it never
+// undoes part of an operation or transaction. To undo a given change
+// without undoing another one applied since, use RollbackIfVersion.
 func (sm *StateMachine) Rollback() error {
-	sm.mu.Lock()
-	defer sm.mu.Unlock()
+	return sm.RollbackContext(context.Background())
+}
+
+// RollbackContext is like Rollback but gives up without rolling back if ctx
+// is done before the rollback starts.
+func (sm *StateMachine) RollbackContext(ctx context.Context) error {
+	_, err := sm.execute(ctx, Operation{Type: OpRollback})
+	return err
+}
+
+// RollbackIfVersion undoes the change that produced version, such as the
+// Version of an operation just applied, only if it is still the latest
+// change. If another change was applied since, nothing is rolled back and
+// ErrVersionConflict is returned. Version 0, which no change produces, rolls
+// back whatever the latest change is, as Rollback does.
+func (sm *StateMachine) RollbackIfVersion(ctx context.Context, version int) error {
+	_, err := sm.execute(ctx, Operation{Type: OpRollback, IfVersion: version})
+	return err
+}
+
+// checkIfVersion fails with ErrVersionConflict if op expects another
+// version than the current one. sm.mu must be held.
+func (sm *StateMachine) checkIfVersion(op Operation) error {
+	if op.IfVersion != 0 && op.IfVersion != sm.version {
+		return fmt.Errorf("%w: at version %d, not %d", ErrVersionConflict, sm.version, op.IfVersion)
+	}
+	return nil
+}
 
-	historyLength := len(sm.history)
+func (sm *StateMachine) applyRollback(op Operation) error {
+	if err := sm.checkIfVersion(op); err != nil {
+		return err
+	}
+	historyLength := sm.history.len()
 	if historyLength == 0 {
-		return fmt.Errorf("nothing to rollback")
+		return ErrNothingToRollback
 	}
 
-	lastState := sm.history[historyLength-1]
-	sm.accounts = lastState                   // reverse to the last state
-	sm.history = sm.history[:historyLength-1] // delete the last state from history
+	lastVersion := sm.history.entries[historyLength-1].version
+	if err := checkIrreversibleAfter(sm.journal, lastVersion); err != nil {
+		return err
+	}
+	sm.onRevertRollback()
+	sm.keepImages()
+	accounts, err := sm.history.restore(sm.accounts, lastVersion) // reverse to the last state
+	if err != nil {
+		return err
+	}
+	sm.accounts = accounts
+	sm.version = lastVersion
+	sm.forgetOperationsAfter(sm.version)
+	sm.endEpoch()
 
 	fmt.Println("After Rollback:", sm.accounts)
 
@@ -120,61 +513,333 @@ func (sm *StateMachine) Rollback() error {
 }
 
 func main() {
-	var wg sync.WaitGroup
-	noOfWorkers := 4
+	if len(os.Args) > 1 {
+		var command func(args []string) error
+		switch os.Args[1] {
+		case "backup":
+			command = runBackup
+		case "restore":
+			command = runRestore
+		case "migrate":
+			command = runMigrate
+		case "verify":
+			command = runVerify
+		case "openapi":
+			command = runOpenAPI
+		case "loadgen":
+			command = runLoadgen
+		case "sim":
+			command = runSim
+		}
+		if command != nil {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Println("Error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	configPath := flag.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "path to a YAML, TOML or JSON config file")
+	serve := flag.Bool("serve", false, "serve the HTTP API on server.addr after the simulation until interrupted")
+	importPath := flag.String("import", "", "path to a .csv or .json file of accounts to open before the simulation")
+	bootstrap := flag.Bool("bootstrap", false, "start from the newest backup in the archive bucket instead of the configured accounts")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Println("Config Error:", err)
+		os.Exit(1)
+	}
+
+	if cfg.Replication.Leader != "" {
+		follow(cfg)
+		return
+	}
+
+	noOfWorkers := cfg.Limits.Workers
 
 	sm := &StateMachine{
-		accounts: map[string]int{
-			"acc1": 1000,
-			"acc2": 500,
-			"acc3": 300,
-		},
-		history: []map[string]int{},
+		accounts:   maps.Clone(cfg.Accounts),
+		maxHistory: cfg.Limits.MaxHistory,
+		limiter: NewRateLimiter(
+			RateLimit{Rate: cfg.Limits.GlobalRate, Burst: cfg.Limits.GlobalBurst},
+			RateLimit{Rate: cfg.Limits.AccountRate, Burst: cfg.Limits.AccountBurst},
+			RateLimit{Rate: cfg.Limits.ClientRate, Burst: cfg.Limits.ClientBurst},
+		),
 	}
 
-	accountIds := []string{"acc1", "acc2", "acc3"}
+	applyFeatures(sm, cfg)
+
+	plugins := map[string]plugin.Plugin{}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Plugins)) {
+		p, err := LoadPlugin(cfg.Plugins[name])
+		if err != nil {
+			fmt.Println("Plugin Error:", err)
+			os.Exit(1)
+		}
+		if c, ok := p.(io.Closer); ok {
+			defer c.Close()
+		}
+		m, _, err := sm.UsePlugin(context.Background(), p)
+		if err == nil && name == cfg.Archive.Plugin && !m.Storage {
+			err = fmt.Errorf("%w: %s provides no storage for archive.plugin", ErrInvalidPlugin, name)
+		}
+		if err != nil {
+			fmt.Println("Plugin Error:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Loaded plugin %s (%s) from %s\n", name, m.Name, cfg.Plugins[name])
+		plugins[name] = p
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Scripts)) {
+		if _, err := sm.SetScript(name, cfg.Scripts[name]); err != nil {
+			fmt.Println("Script Error:", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.Limits.Policies != "" {
+		if err := sm.LoadPolicyFile(cfg.Limits.Policies); err != nil {
+			fmt.Println("Policy Error:", err)
+			os.Exit(1)
+		}
+		policyCtx, stopPolicyReload := context.WithCancel(context.Background())
+		defer stopPolicyReload()
+		go sm.RunPolicyReload(policyCtx, cfg.Limits.Policies, policyReloadInterval)
+	}
+
+	retry := RetryPolicy{
+		MaxAttempts: cfg.Retry.MaxAttempts,
+		Backoff:     cfg.Retry.Backoff,
+		MaxBackoff:  cfg.Retry.MaxBackoff,
+		Jitter:      cfg.Retry.Jitter,
+	}
+
+	// Approvals are required before the checkpoint restores those pending,
+	// and the outbox enabled before the log replays the entries recorded
+	// since.
+	if cfg.Limits.ApprovalThreshold > 0 {
+		sm.RequireApproval(cfg.Limits.ApprovalThreshold, cfg.Limits.ApprovalTTL)
+	}
+	if cfg.Storage.Outbox {
+		sm.EnableOutbox()
+	}
+
+	enc, err := newEncryptor(cfg)
+	if err != nil {
+		fmt.Println("Config Error:", err)
+		os.Exit(1)
+	}
+
+	var wal *WAL
+	checkpoint := filepath.Join(cfg.Storage.Dir, checkpointName)
+	if cfg.Storage.WAL {
+		wal, err = OpenWAL(filepath.Join(cfg.Storage.Dir, "wal"), WALOptions{
+			SegmentSize:  cfg.Storage.SegmentSize,
+			SegmentAge:   cfg.Storage.SegmentAge,
+			Sync:         SyncPolicy(cfg.Storage.Sync),
+			SyncInterval: cfg.Storage.SyncInterval,
+			GroupWindow:  cfg.Storage.GroupWindow,
+			Encryptor:    enc,
+		})
+		if err != nil {
+			fmt.Println("WAL Error:", err)
+			os.Exit(1)
+		}
+		if !*bootstrap {
+			restored, err := sm.RestoreCheckpoint(checkpoint, enc)
+			if err != nil {
+				fmt.Println("Checkpoint Error:", err)
+				os.Exit(1)
+			}
+			if restored {
+				fmt.Printf("Restored the checkpoint at version %d\n", sm.Version())
+			}
+		}
+	}
+
+	var breakers []*CircuitBreaker
+	var store ObjectStore
+	if cfg.Archive.Enabled() {
+		store = &DirStore{Dir: cfg.Archive.Dir}
+		if cfg.Archive.Bucket != "" {
+			store = &S3Store{
+				Endpoint:  cfg.Archive.Endpoint,
+				Region:    cfg.Archive.Region,
+				Bucket:    cfg.Archive.Bucket,
+				AccessKey: cfg.Archive.AccessKey,
+				SecretKey: cfg.Archive.SecretKey,
+			}
+		}
+		if cfg.Archive.Plugin != "" {
+			store = PluginStore(plugins[cfg.Archive.Plugin])
+		}
+		archiveBreaker := NewCircuitBreaker("archive", cfg.Breaker.Threshold, cfg.Breaker.Cooldown)
+		breakers = append(breakers, archiveBreaker)
+		store = BreakerStore{Store: RetryStore{Store: store, Policy: retry}, Breaker: archiveBreaker}
+		if *bootstrap {
+			key, err := sm.RestoreArchive(context.Background(), store, cfg.Archive.Prefix, enc)
+			if err != nil {
+				fmt.Println("Bootstrap Error:", err)
+				os.Exit(1)
+			}
+			fmt.Println("Bootstrapped from", key)
+		}
+	} else if *bootstrap {
+		fmt.Println("Bootstrap Error: archive.bucket or archive.dir is not configured")
+		os.Exit(1)
+	}
+
+	if wal != nil {
+		replayed, err := sm.ReplayWAL(wal)
+		if err != nil {
+			fmt.Println("WAL Error:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Replayed %d operations from the write-ahead log\n", replayed)
+		sm.UseWAL(wal)
+
+		if cfg.Storage.CheckpointInterval > 0 {
+			checkpointCtx, stopCheckpoints := context.WithCancel(context.Background())
+			defer stopCheckpoints()
+			go sm.RunCheckpoints(checkpointCtx, checkpoint, cfg.Storage.CheckpointInterval, enc)
+		}
+	}
+
+	// Archival starts once the log is replayed, so it never archives the
+	// state from before.
+	if store != nil {
+		archiveCtx, stopArchival := context.WithCancel(context.Background())
+		defer stopArchival()
+		go sm.RunArchival(archiveCtx, store, cfg.Archive.Interval, ArchiveOptions{
+			Prefix: cfg.Archive.Prefix,
+			Keep:   cfg.Archive.Keep,
+			MaxAge: cfg.Archive.MaxAge,
+
+			Compression: Compression(cfg.Archive.Compression),
+			WAL:         wal,
+			Encryptor:   enc,
+		})
+		if cfg.Archive.HistoryRetention > 0 {
+			go sm.RunHistoryPruning(archiveCtx, store, cfg.Archive.Prefix, cfg.Archive.Interval, cfg.Archive.HistoryRetention)
+		}
+		if cfg.Archive.ExportInterval > 0 {
+			go sm.RunExports(archiveCtx, store, cfg.Archive.ExportInterval, ExportOptions{
+				Prefix:      cfg.Archive.Prefix,
+				Format:      ExportFormat(cfg.Archive.ExportFormat),
+				Compression: Compression(cfg.Archive.Compression),
+			})
+		}
+	}
+
+	if cfg.Limits.HotRate > 0 || cfg.Limits.HotLockWait > 0 {
+		sm.DetectHotAccounts(HotAccountOptions{
+			MinRate:     cfg.Limits.HotRate,
+			MinLockWait: cfg.Limits.HotLockWait,
+			Queue:       cfg.Limits.HotQueue,
+		})
+	}
+	sm.SetLockTimeout(cfg.Limits.LockTimeout)
+	if cfg.Limits.MemoryLimit > 0 {
+		sm.SetMemoryLimit(cfg.Limits.MemoryLimit, cfg.Limits.CompactKeep)
+	}
+	if cfg.Limits.CompactInterval > 0 {
+		compactCtx, stopCompaction := context.WithCancel(context.Background())
+		defer stopCompaction()
+		go sm.RunCompaction(compactCtx, cfg.Limits.CompactInterval, cfg.Limits.CompactKeep)
+	}
+
+	if cfg.Limits.DormantAfter > 0 {
+		dormancyCtx, stopDormancyArchival := context.WithCancel(context.Background())
+		defer stopDormancyArchival()
+		go sm.RunDormancyArchival(dormancyCtx, dormancyCheckInterval, cfg.Limits.DormantAfter)
+	}
+
+	escrowCtx, stopEscrowExpiry := context.WithCancel(context.Background())
+	defer stopEscrowExpiry()
+	go sm.RunEscrowExpiry(escrowCtx, escrowExpiryInterval)
+
+	compensatorCtx, stopCompensator := context.WithCancel(context.Background())
+	defer stopCompensator()
+	go sm.RunCompensator(compensatorCtx, compensationInterval)
+
+	standingOrderCtx, stopStandingOrders := context.WithCancel(context.Background())
+	defer stopStandingOrders()
+	go sm.RunStandingOrders(standingOrderCtx, standingOrderInterval)
+
+	if len(cfg.Sweeps) > 0 {
+		var sweeps []Sweep
+		for _, name := range slices.Sorted(maps.Keys(cfg.Sweeps)) {
+			sweep := cfg.Sweeps[name]
+			sweeps = append(sweeps, Sweep{Name: name, From: sweep.From, To: sweep.To, Target: sweep.Target, At: sweep.At})
+		}
+		sweepCtx, stopSweeps := context.WithCancel(context.Background())
+		defer stopSweeps()
+		go sm.RunSweeps(sweepCtx, sweeps...)
+	}
+
+	if *importPath != "" {
+		report, err := sm.ImportFile(context.Background(), *importPath, ImportOptions{})
+		for _, rowErr := range report.Errors {
+			fmt.Println("Import Error:", &rowErr)
+		}
+		if err != nil {
+			fmt.Println("Import Error:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Imported %d accounts in %d batches, skipped %d\n", report.Imported, report.Batches, report.Skipped)
+	}
+
+	// Signer sets may name imported accounts.
+	for _, id := range slices.Sorted(maps.Keys(cfg.Signers)) {
+		set := cfg.Signers[id]
+		if err := sm.RequireSignatures(id, SignerSet{Signers: set.Signers, Required: set.Required}); err != nil {
+			fmt.Println("Config Error:", err)
+			os.Exit(1)
+		}
+	}
+
+	accountIds := cfg.AccountIDs()
 
 	fmt.Println("Initial State:", sm.accounts)
 
-	wg.Add(noOfWorkers)
+	dispatcher := NewDispatcher(noOfWorkers, cfg.Limits.QueueSize)
+	var futures []*Future
+	var errorLabels []string
+
+	submit := func(errorLabel string, priority Priority, fn func() error) {
+		future, err := dispatcher.SubmitPriority(context.Background(), priority, fn)
+		if err != nil {
+			fmt.Println("Submit Error:", err)
+			return
+		}
+		futures = append(futures, future)
+		errorLabels = append(errorLabels, errorLabel)
+	}
+
 	for range noOfWorkers {
 		accountID := accountIds[rand.Intn(len(accountIds))]
-		go func(id string) {
-			defer wg.Done()
-			if err := sm.Deposit(id, 200); err != nil {
-				fmt.Println("Error:", err)
-			} 
-		}(accountID)
+		submit("Error:", PriorityNormal, func() error { return sm.Deposit(accountID, 200) })
 	}
 
-	wg.Add(noOfWorkers)
 	for range noOfWorkers {
 		accountID := accountIds[rand.Intn(len(accountIds))]
-		go func(id string) {
-			defer wg.Done()
-			if err := sm.Withdraw(id, 100); err != nil {
-				fmt.Println("Error:", err)
-			} 
-		}(accountID)
+		submit("Error:", PriorityHigh, func() error { return sm.Withdraw(accountID, 100) })
 	}
 
-	wg.Add(noOfWorkers)
 	for range noOfWorkers {
-        fromAccountID := accountIds[rand.Intn(len(accountIds))]
-        toAccountID := accountIds[rand.Intn(len(accountIds))]
-        if fromAccountID != toAccountID {
-            go func(fromID, toID string) {
-                defer wg.Done()
-                if err := sm.Transfer(fromID, toID, 75); err != nil {
-                    fmt.Println("Transfer Error:", err)
-                }
-            }(fromAccountID, toAccountID)
-        } else {
-            wg.Done() // Avoid hanging if the same ID is chosen
-        }
-    }
-
-	wg.Wait()
+		fromAccountID := accountIds[rand.Intn(len(accountIds))]
+		toAccountID := accountIds[rand.Intn(len(accountIds))]
+		if fromAccountID != toAccountID {
+			submit("Transfer Error:", PriorityNormal, func() error { return sm.Transfer(fromAccountID, toAccountID, 75) })
+		}
+	}
+
+	for i, future := range futures {
+		if err := future.Wait(); err != nil {
+			fmt.Println(errorLabels[i], err)
+		}
+	}
 
 	fmt.Println("\nRolling back the last operation...")
 	if err := sm.Rollback(); err != nil {
@@ -185,5 +850,109 @@ func main() {
 		fmt.Println("Withdraw Error:", err)
 	}
 
+	var srv *Server
+	if *serve {
+		srv = newServer(sm, cfg)
+		srv.UseDispatcher(dispatcher)
+		srv.UseBreakers(breakers...)
+		serveUntilStopped(srv, cfg.Server.Addr)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if srv != nil {
+		if err := srv.Close(ctx); err != nil {
+			fmt.Println("Server Close Error:", err)
+		}
+	}
+	if err := dispatcher.Close(ctx); err != nil {
+		fmt.Println("Dispatcher Close Error:", err)
+	}
+	if err := sm.Close(ctx); err != nil {
+		fmt.Println("Close Error:", err)
+	}
+	if wal != nil {
+		if err := sm.WriteCheckpoint(checkpoint, enc); err != nil {
+			fmt.Println("Checkpoint Error:", err)
+		}
+		if err := wal.Close(); err != nil {
+			fmt.Println("WAL Close Error:", err)
+		}
+	}
+
 	fmt.Println("\nFinal State:", sm.accounts)
 }
+
+// applyFeatures sets the feature flags of cfg, exiting if one is unknown.
+func applyFeatures(sm *StateMachine, cfg *config.Config) {
+	ctx := WithActor(context.Background(), "config")
+	for _, name := range slices.Sorted(maps.Keys(cfg.Features)) {
+		if err := sm.SetFlag(ctx, Flag(name), cfg.Features[name]); err != nil {
+			fmt.Println("Config Error:", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// newServer returns a server of sm configured by cfg, exiting if cfg cannot
+// be applied.
+func newServer(sm *StateMachine, cfg *config.Config) *Server {
+	srv := NewServer(sm, cfg.Server.Addr)
+	srv.UseOperationTimeout(cfg.Server.OperationTimeout)
+	srv.UseBackpressure(cfg.Server.MaxQueueDepth, cfg.Server.MaxQueueLatency)
+	if cfg.Auth.Enabled() {
+		auth, err := newAuthenticator(cfg.Auth)
+		if err != nil {
+			fmt.Println("Auth Error:", err)
+			os.Exit(1)
+		}
+		srv.UseAuth(auth)
+	}
+	if cfg.Server.TLSEnabled() {
+		tlsConfig, err := NewTLSConfig(cfg.Server.TLSCert, cfg.Server.TLSKey, cfg.Server.ClientCA, cfg.Server.RequireClientCert)
+		if err != nil {
+			fmt.Println("TLS Error:", err)
+			os.Exit(1)
+		}
+		srv.UseTLS(tlsConfig)
+	}
+	return srv
+}
+
+// serveUntilStopped serves srv until interrupted or it fails.
+func serveUntilStopped(srv *Server, addr string) {
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- srv.ListenAndServe() }()
+
+	fmt.Println("\nListening on", addr)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-stop:
+	case err := <-serveErr:
+		fmt.Println("Server Error:", err)
+	}
+}
+
+// follow serves a read-only replica of cfg.Replication.Leader until
+// interrupted.
+func follow(cfg *config.Config) {
+	replica := NewReplica(cfg.Replication.Leader, cfg.Replication.MaxStaleness)
+	replica.APIKey = cfg.Replication.APIKey
+
+	replicaCtx, stopReplication := context.WithCancel(context.Background())
+	defer stopReplication()
+	go replica.Run(replicaCtx)
+
+	applyFeatures(replica.StateMachine(), cfg)
+	srv := newServer(replica.StateMachine(), cfg)
+	srv.UseReplica(replica)
+	fmt.Println("Following", cfg.Replication.Leader)
+	serveUntilStopped(srv, cfg.Server.Addr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Close(ctx); err != nil {
+		fmt.Println("Server Close Error:", err)
+	}
+}
@@ -1,9 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"math/rand"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/Olusamimaths/vaultflow/vaultflowtest"
+)
+
+// The state machine works with the vaultflowtest helpers.
+var (
+	_ vaultflowtest.StateTransitions = (*StateMachine)(nil)
+	_ vaultflowtest.Balancer         = (*StateMachine)(nil)
+	_ vaultflowtest.HistoryDepther   = (*StateMachine)(nil)
+	_ StateTransitions               = (*vaultflowtest.Mock)(nil)
 )
 
 func TestStateMachine(t *testing.T) {
@@ -57,21 +70,17 @@ func TestStateMachine(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			sm := &StateMachine{
 				accounts: tt.initialAccounts,
-				history:  []map[string]int{},
 			}
 
-			var wg sync.WaitGroup
+			s := NewScheduler(1)
 			for _, action := range tt.actions {
-				wg.Add(1)
-				go func(act Action) {
-					defer wg.Done()
-					err := act.fn(sm)
-					if (err != nil) != act.expectedErr {
-						t.Errorf("Unexpected error state: got %v, expectedErr %v", err, act.expectedErr)
-					}
-				}(action)
+				s.Go(func() error { return action.fn(sm) })
+			}
+			for _, step := range s.Run() {
+				if (step.Err != nil) != tt.actions[step.Task].expectedErr {
+					t.Errorf("Unexpected error state: got %v, expectedErr %v", step.Err, tt.actions[step.Task].expectedErr)
+				}
 			}
-			wg.Wait()
 
 			for acc, expectedBalance := range tt.expectedAccounts {
 				if sm.accounts[acc] != expectedBalance {
@@ -88,7 +97,6 @@ func TestStateMachineRollback(t *testing.T) {
 			"acc1": 1000,
 			"acc2": 500,
 		},
-		history: []map[string]int{},
 	}
 
 	_ = sm.Deposit("acc1", 200)
@@ -112,6 +120,71 @@ func TestStateMachineRollback(t *testing.T) {
 	}
 }
 
+func TestStateMachineRollbackIfVersion(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000}}
+	ctx := context.Background()
+	first, _ := sm.ApplyContext(ctx, Operation{Type: OpDeposit, To: "acc1", Amount: 100})
+	second, _ := sm.ApplyContext(ctx, Operation{Type: OpDeposit, To: "acc1", Amount: 10})
+
+	// The first deposit is no longer the latest change.
+	if err := sm.RollbackIfVersion(ctx, first.Version); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("RollbackIfVersion(%d) = %v; want ErrVersionConflict", first.Version, err)
+	}
+	if _, err := sm.execute(ctx, Operation{Type: OpRollbackTo, Version: 0, IfVersion: first.Version}); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("RollbackTo(0) expecting version %d = %v; want ErrVersionConflict", first.Version, err)
+	}
+	vaultflowtest.ExpectBalances(t, sm, map[string]int{"acc1": 1110})
+
+	// The second is, once: it is not undone twice.
+	if err := sm.RollbackIfVersion(ctx, second.Version); err != nil {
+		t.Fatalf("RollbackIfVersion(%d) = %v", second.Version, err)
+	}
+	if err := sm.RollbackIfVersion(ctx, second.Version); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("second RollbackIfVersion(%d) = %v; want ErrVersionConflict", second.Version, err)
+	}
+	vaultflowtest.ExpectBalances(t, sm, map[string]int{"acc1": 1100})
+}
+
+// TestStateMachineRollbackRacingDeposits has writers deposit and then try to
+// roll back their own deposit while others do the same: a rollback either
+// undoes exactly the deposit it was meant for or nothing, so the balance
+// ends up holding exactly the deposits not rolled back.
+func TestStateMachineRollbackRacingDeposits(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 0}}
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	kept := 0 // sum of the deposits not rolled back
+	var wg sync.WaitGroup
+	for writer := range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			amount := 1 << (writer % 20)
+			op, err := sm.ApplyContext(ctx, Operation{Type: OpDeposit, To: "acc1", Amount: amount})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			switch err := sm.RollbackIfVersion(ctx, op.Version); {
+			case errors.Is(err, ErrVersionConflict):
+				mu.Lock()
+				kept += amount
+				mu.Unlock()
+			case err != nil:
+				t.Errorf("RollbackIfVersion(%d) = %v", op.Version, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	vaultflowtest.ExpectBalances(t, sm, map[string]int{"acc1": kept})
+}
+
 func TestStateMachineConcurrentStress(t *testing.T) {
 	sm := &StateMachine{
 		accounts: map[string]int{
@@ -119,7 +192,6 @@ func TestStateMachineConcurrentStress(t *testing.T) {
 			"acc2": 500,
 			"acc3": 300,
 		},
-		history: []map[string]int{},
 	}
 
 	accountIds := []string{"acc1", "acc2", "acc3"}
@@ -160,3 +232,70 @@ func TestStateMachineConcurrentStress(t *testing.T) {
 		t.Errorf("Total balance = %d; expected at least %d", totalBalance, expectedMinimumBalance)
 	}
 }
+
+func TestStateMachineMaxHistory(t *testing.T) {
+	sm := &StateMachine{
+		accounts:   map[string]int{"acc1": 0},
+		maxHistory: 2,
+	}
+
+	for range 5 {
+		_ = sm.Deposit("acc1", 10)
+	}
+
+	if sm.history.len() != 2 {
+		t.Fatalf("History length = %d; want 2", sm.history.len())
+	}
+
+	for range 2 {
+		if err := sm.Rollback(); err != nil {
+			t.Fatalf("Rollback failed: %v", err)
+		}
+	}
+	if sm.accounts["acc1"] != 30 {
+		t.Errorf("Account acc1 balance = %d; want 30", sm.accounts["acc1"])
+	}
+	if err := sm.Rollback(); err == nil {
+		t.Errorf("Rollback past max history succeeded; want error")
+	}
+}
+
+func TestStateMachineOperationTimeout(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000, "acc2": 500},
+	}
+
+	// A stuck operation holding the state lock.
+	sm.mu.Lock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sm.TransferContext(ctx, "acc1", "acc2", 100); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("TransferContext = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	if err := sm.DepositContext(cancelled, "acc1", 100); !errors.Is(err, context.Canceled) {
+		t.Errorf("DepositContext = %v; want %v", err, context.Canceled)
+	}
+
+	sm.mu.Unlock()
+
+	if err := sm.Withdraw("acc2", 50); err != nil {
+		t.Fatalf("Withdraw after timeouts failed: %v", err)
+	}
+
+	if sm.history.len() != 1 {
+		t.Errorf("History length = %d; want 1", sm.history.len())
+	}
+	expectedAccounts := map[string]int{"acc1": 1000, "acc2": 450}
+	for acc, expectedBalance := range expectedAccounts {
+		if sm.accounts[acc] != expectedBalance {
+			t.Errorf("Account %s balance = %d; want %d", acc, sm.accounts[acc], expectedBalance)
+		}
+	}
+	if n := sm.InFlight(); n != 0 {
+		t.Errorf("InFlight = %d; want 0", n)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// ErrMemoryLimit is matched by a MemoryLimitError.
+var ErrMemoryLimit = errors.New("memory limit reached")
+
+// MemoryLimitError is returned for operations while the state machine
+// holds more than its memory limit even after compacting its history, see
+// SetMemoryLimit.
+type MemoryLimitError struct {
+	Limit int64
+	Used  int64 // estimated, see MemStats
+}
+
+func (e *MemoryLimitError) Error() string {
+	return fmt.Sprintf("%s: %d bytes used of %d", ErrMemoryLimit, e.Used, e.Limit)
+}
+
+func (e *MemoryLimitError) Is(target error) bool {
+	return target == ErrMemoryLimit
+}
+
+// MemStats estimates the bytes a state machine holds, by what holds them:
+// the balances, tags, aliases, statuses and archives of Accounts, the
+// past states, journal and tombstones of History, the balance, operation
+// and message Indexes, and the outbox and dead letters in Queues. Tenants
+// are state machines of their own, which report theirs.
+//
+// Estimates count the keys, values and per-entry overhead of maps and
+// slices on a 64-bit platform, not the exact heap: compare them to each
+// other and over time, and use runtime.ReadMemStats for the process.
+type MemStats struct {
+	Accounts int64 `json:"accounts"`
+	History  int64 `json:"history"`
+	Indexes  int64 `json:"indexes"`
+	Queues   int64 `json:"queues"`
+	Total    int64 `json:"total"`
+	Limit    int64 `json:"limit,omitempty"` // see SetMemoryLimit
+}
+
+// Sizes of values the estimates of MemStats add up.
+const (
+	stringSize   = 16 // header, plus the bytes
+	sliceSize    = 24 // header, plus the elements
+	mapEntrySize = 16 // overhead of an entry, plus its key and value
+	intSize      = 8
+)
+
+var (
+	timeSize           = int64(reflect.TypeFor[time.Time]().Size())
+	operationSize      = int64(reflect.TypeFor[Operation]().Size())
+	historyEntrySize   = int64(reflect.TypeFor[historyEntry]().Size())
+	accountBalanceSize = int64(reflect.TypeFor[AccountBalance]().Size())
+	amountEntrySize    = int64(reflect.TypeFor[amountEntry]().Size())
+	timeEntrySize      = int64(reflect.TypeFor[timeEntry]().Size())
+	archivedSize       = int64(reflect.TypeFor[ArchivedAccount]().Size())
+	tombstoneSize      = int64(reflect.TypeFor[Tombstone]().Size())
+	// Of the fields of a dead letter beside its operation.
+	deadLetterSize = int64(reflect.TypeFor[DeadLetter]().Size()) - operationSize
+)
+
+// memoryCheckEvery is how many operations apart the memory used is
+// estimated again while under the limit, as estimating walks every
+// structure.
+const memoryCheckEvery = 256
+
+// memoryLimit bounds the memory a state machine holds, see SetMemoryLimit.
+type memoryLimit struct {
+	limit       int64 // 0 means no limit
+	compactKeep int
+	untilCheck  int  // operations before the next estimate
+	over        bool // at the last estimate
+}
+
+func sizeOfString(s string) int64 {
+	return stringSize + int64(len(s))
+}
+
+func sizeOfStrings(ss []string) int64 {
+	size := int64(sliceSize)
+	for _, s := range ss {
+		size += sizeOfString(s)
+	}
+	return size
+}
+
+func sizeOfBalances(balances map[string]int) int64 {
+	var size int64
+	for id := range balances {
+		size += mapEntrySize + sizeOfString(id) + intSize
+	}
+	return size
+}
+
+func sizeOfOperation(op Operation) int64 {
+	size := operationSize + int64(len(op.ID)+len(op.From)+len(op.To)+len(op.Reverses)+len(op.Epoch)+
+		len(op.MessageID)+len(op.CorrelationID)+len(op.FromBucket)+len(op.ToBucket)+len(op.Memo)+len(op.Category))
+	for k, v := range op.Metadata {
+		size += mapEntrySize + sizeOfString(k) + sizeOfString(v)
+	}
+	return size
+}
+
+func sizeOfEvent(event Event) int64 {
+	return sizeOfOperation(event.Operation) + intSize + sizeOfBalances(event.Balances) + sliceSize
+}
+
+func sizeOfPostings(postings map[string][]int) int64 {
+	var size int64
+	for key, seqs := range postings {
+		size += mapEntrySize + sizeOfString(key) + sliceSize + int64(intSize*cap(seqs))
+	}
+	return size
+}
+
+// memStats estimates the memory held, see MemStats. sm.mu must be held.
+func (sm *StateMachine) memStats() MemStats {
+	var stats MemStats
+
+	stats.Accounts = sizeOfBalances(sm.accounts)
+	for id, tags := range sm.tags {
+		stats.Accounts += mapEntrySize + sizeOfString(id) + sizeOfStrings(tags)
+	}
+	sm.aliases.mu.RLock()
+	for alias, id := range sm.aliases.owners {
+		stats.Accounts += mapEntrySize + sizeOfString(alias) + sizeOfString(id)
+	}
+	sm.aliases.mu.RUnlock()
+	for id, status := range sm.statuses {
+		stats.Accounts += mapEntrySize + sizeOfString(id) + sizeOfString(string(status))
+	}
+	for id, account := range sm.archived {
+		stats.Accounts += mapEntrySize + sizeOfString(id) + archivedSize + sizeOfBalances(account.Buckets)
+	}
+	for id := range sm.lastActive {
+		stats.Accounts += mapEntrySize + sizeOfString(id) + timeSize
+	}
+
+	for _, entry := range sm.history.entries {
+		stats.History += historyEntrySize + sizeOfBalances(entry.balances) + sizeOfStrings(entry.absent)
+	}
+	for _, op := range sm.journal {
+		stats.History += sizeOfOperation(op)
+	}
+	for _, t := range sm.tombstones {
+		stats.History += tombstoneSize + sizeOfString(t.Account) + sizeOfStrings(t.Accounts) + int64(len(t.FirstID)+len(t.LastID))
+	}
+
+	stats.Indexes = sizeOfBalances(sm.balanceIndex.balances) + int64(len(sm.balanceIndex.ordered))*accountBalanceSize +
+		sizeOfPostings(sm.opIndex.byAccount) + sizeOfPostings(sm.opIndex.byMetadata) +
+		int64(len(sm.opIndex.byAmount))*amountEntrySize + int64(len(sm.opIndex.byTime))*timeEntrySize
+	for id, op := range sm.inbox.processed {
+		stats.Indexes += mapEntrySize + sizeOfString(id) + sizeOfOperation(op)
+	}
+
+	for _, entry := range sm.outbox.entries {
+		stats.Queues += intSize + sizeOfEvent(entry.Event)
+	}
+	for _, dl := range sm.deadLetters.entries {
+		stats.Queues += deadLetterSize + sizeOfOperation(dl.Operation) + int64(len(dl.ID)+len(dl.Error))
+	}
+
+	stats.Total = stats.Accounts + stats.History + stats.Indexes + stats.Queues
+	stats.Limit = sm.memory.limit
+	return stats
+}
+
+// MemStats estimates the bytes the state machine holds, e.g. to size its
+// memory limit or history bound.
+func (sm *StateMachine) MemStats() MemStats {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.memStats()
+}
+
+// SetMemoryLimit bounds the bytes the state machine holds, by the estimate
+// of MemStats, before it runs out of memory: once over limit, history
+// older than the newest compactKeep states is compacted, and if that is
+// not enough, operations fail with a MemoryLimitError until memory is
+// released, e.g. by pruning history. Rollbacks, which release memory, are
+// still applied. The estimate is refreshed every 256 operations, and every
+// operation while over the limit. A zero limit removes it.
+func (sm *StateMachine) SetMemoryLimit(limit int64, compactKeep int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.memory = memoryLimit{limit: limit, compactKeep: compactKeep}
+}
+
+// checkMemory fails with a MemoryLimitError while over the memory limit
+// once history is compacted. sm.mu must be held.
+func (sm *StateMachine) checkMemory(op Operation) error {
+	m := &sm.memory
+	if m.limit <= 0 || op.Type == OpRollback || op.Type == OpRollbackTo {
+		return nil
+	}
+	if !m.over && m.untilCheck > 0 {
+		m.untilCheck--
+		return nil
+	}
+	m.untilCheck = memoryCheckEvery
+
+	used := sm.memStats().Total
+	if used > m.limit {
+		if dropped := sm.history.compact(m.compactKeep); dropped > 0 {
+			fmt.Printf("\n\nCompacted %d states from history over the memory limit\n", dropped)
+			used = sm.memStats().Total
+		}
+	}
+	m.over = used > m.limit
+	if m.over {
+		return &MemoryLimitError{Limit: m.limit, Used: used}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMemStats(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+	before := sm.MemStats()
+	if before.Accounts == 0 || before.History != 0 || before.Queues != 0 || before.Total != before.Accounts+before.Indexes {
+		t.Errorf("MemStats() = %+v; want only accounts", before)
+	}
+
+	for i := range 10 {
+		_ = sm.OpenAccount("new"+strconv.Itoa(i), 0)
+	}
+	for range 10 {
+		_ = sm.Transfer("acc1", "acc2", 1)
+	}
+	sm.EnableOutbox()
+	_ = sm.Deposit("acc1", 1)
+	_ = sm.TopAccountsByBalance(1) // builds the balance index
+
+	after := sm.MemStats()
+	if after.Accounts <= before.Accounts || after.History == 0 || after.Indexes <= before.Indexes || after.Queues == 0 {
+		t.Errorf("MemStats() = %+v after operations; want every part grown from %+v", after, before)
+	}
+	if after.Total != after.Accounts+after.History+after.Indexes+after.Queues {
+		t.Errorf("MemStats() total %d; want the sum of %+v", after.Total, after)
+	}
+}
+
+func TestMemoryLimit(t *testing.T) {
+	quiet(t)
+
+	t.Run("Compaction", func(t *testing.T) {
+		sm := &StateMachine{accounts: map[string]int{"acc1": 1 << 40, "acc2": 0}}
+		for range 3 * snapshotInterval {
+			_ = sm.Transfer("acc1", "acc2", 1)
+		}
+		stats := sm.MemStats()
+		// Below the history held, above what remains once compacted.
+		sm.SetMemoryLimit(stats.Total-stats.History/4, 1)
+		if err := sm.Transfer("acc1", "acc2", 1); err != nil {
+			t.Fatalf("Transfer() error = %v; want history compacted to make room", err)
+		}
+		if got := sm.MemStats(); got.History >= stats.History || got.Total > got.Limit {
+			t.Errorf("MemStats() = %+v; want history compacted from %d bytes under the limit", got, stats.History)
+		}
+	})
+
+	t.Run("Admission", func(t *testing.T) {
+		sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+		_ = sm.Transfer("acc1", "acc2", 10)
+		sm.SetMemoryLimit(1, 0)
+
+		err := sm.Transfer("acc1", "acc2", 10)
+		var limitErr *MemoryLimitError
+		if !errors.As(err, &limitErr) || !errors.Is(err, ErrMemoryLimit) || limitErr.Limit != 1 || limitErr.Used <= 1 {
+			t.Fatalf("Transfer() error = %v; want the memory limit reached", err)
+		}
+		if err := sm.Tx(func(tx *Tx) error { return tx.Deposit("acc1", 1) }); !errors.Is(err, ErrMemoryLimit) {
+			t.Errorf("Tx() error = %v; want %v", err, ErrMemoryLimit)
+		}
+		// Rollbacks release memory, so they are still applied.
+		if err := sm.Rollback(); err != nil {
+			t.Errorf("Rollback() error = %v", err)
+		}
+
+		sm.SetMemoryLimit(0, 0)
+		if err := sm.Transfer("acc1", "acc2", 10); err != nil {
+			t.Errorf("Transfer() without limit error = %v", err)
+		}
+	})
+}
+
+func TestServerMemory(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 100})
+	sm.SetMemoryLimit(1<<30, 0)
+
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/memory", nil))
+	var stats MemStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /memory = %d, %v", rec.Code, err)
+	}
+	if stats.Accounts == 0 || stats.Limit != 1<<30 {
+		t.Errorf("GET /memory = %+v", stats)
+	}
+
+	sm.SetMemoryLimit(1, 0)
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/accounts/acc1/deposit", strings.NewReader(`{"amount": 1}`)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST deposit over the memory limit = %d; want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOperationMetadata(t *testing.T) {
+	quiet(t)
+
+	tooMany := map[string]string{}
+	for i := range maxMetadataKeys + 1 {
+		tooMany[strings.Repeat("k", i+1)] = "v"
+	}
+
+	tests := []struct {
+		name        string
+		op          Operation
+		expectedErr error
+	}{
+		{"Memo", Operation{Type: OpDeposit, To: "acc1", Amount: 10, Memo: "rent"}, nil},
+		{"Metadata", Operation{Type: OpDeposit, To: "acc1", Amount: 10, Metadata: map[string]string{"invoice": "42"}}, nil},
+		{"Memo too long", Operation{Type: OpDeposit, To: "acc1", Amount: 10, Memo: strings.Repeat("x", maxMemoLength+1)}, ErrInvalidOperation},
+		{"Too many keys", Operation{Type: OpDeposit, To: "acc1", Amount: 10, Metadata: tooMany}, ErrInvalidOperation},
+		{"Empty key", Operation{Type: OpDeposit, To: "acc1", Amount: 10, Metadata: map[string]string{"": "x"}}, ErrInvalidOperation},
+		{"Value too long", Operation{Type: OpDeposit, To: "acc1", Amount: 10, Metadata: map[string]string{"k": strings.Repeat("x", maxMetadataLength+1)}}, ErrInvalidOperation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"acc1": 0}}
+			op, err := sm.Apply(tt.op)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Apply() error = %v; want %v", err, tt.expectedErr)
+			}
+			if err != nil {
+				if ops := sm.Operations(); len(ops) != 0 {
+					t.Errorf("Operations() = %+v; want none", ops)
+				}
+				return
+			}
+
+			recorded := sm.Operations()
+			if len(recorded) != 1 || recorded[0].Memo != tt.op.Memo || !maps.Equal(recorded[0].Metadata, tt.op.Metadata) {
+				t.Errorf("Operations() = %+v; want one with memo %q and metadata %v", recorded, tt.op.Memo, tt.op.Metadata)
+			}
+			if op.Memo != tt.op.Memo {
+				t.Errorf("Apply() memo = %q; want %q", op.Memo, tt.op.Memo)
+			}
+		})
+	}
+}
+
+func TestOperationMetadataIsCopied(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 0}}
+	metadata := map[string]string{"invoice": "42"}
+	if _, err := sm.Apply(Operation{Type: OpDeposit, To: "acc1", Amount: 10, Metadata: metadata}); err != nil {
+		t.Fatal(err)
+	}
+	metadata["invoice"] = "43"
+
+	if ops := sm.OperationsWithMetadata(map[string]string{"invoice": "42"}); len(ops) != 1 {
+		t.Errorf("OperationsWithMetadata(invoice=42) = %+v; want the deposit, unchanged by the caller", ops)
+	}
+}
+
+func TestServerOperationMetadata(t *testing.T) {
+	quiet(t)
+
+	srv, _ := newTestServer(map[string]int{"acc1": 1000, "acc2": 500})
+	for _, req := range []struct{ path, body string }{
+		{"/accounts/acc1/deposit", `{"amount": 100, "memo": "Salary", "metadata": {"source": "payroll"}}`},
+		{"/accounts/acc1/withdraw", `{"amount": 50, "metadata": {"invoice": "42", "source": "card"}}`},
+		{"/transfers", `{"from": "acc1", "to": "acc2", "amount": 25, "memo": "Rent for March", "metadata": {"invoice": "43"}}`},
+	} {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, req.path, strings.NewReader(req.body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST %s = %d; want 200 (%s)", req.path, rec.Code, rec.Body)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedTypes  []OperationType
+	}{
+		{"All", "", http.StatusOK, []OperationType{OpDeposit, OpWithdraw, OpTransfer}},
+		{"Metadata", "?metadata=invoice:42", http.StatusOK, []OperationType{OpWithdraw}},
+		{"Metadata key", "?metadata=source:card&metadata=invoice:42", http.StatusOK, []OperationType{OpWithdraw}},
+		{"No match", "?metadata=invoice:44", http.StatusOK, nil},
+		{"Memo", "?memo=rent", http.StatusOK, []OperationType{OpTransfer}},
+		{"Memo and metadata", "?memo=salary&metadata=source:payroll", http.StatusOK, []OperationType{OpDeposit}},
+		{"Malformed", "?metadata=invoice", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/operations"+tt.query, nil))
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("GET = %d; want %d (%s)", rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			var ops []Operation
+			if err := json.Unmarshal(rec.Body.Bytes(), &ops); err != nil {
+				t.Fatal(err)
+			}
+			var types []OperationType
+			for _, op := range ops {
+				types = append(types, op.Type)
+			}
+			if !slices.Equal(types, tt.expectedTypes) {
+				t.Errorf("GET /operations%s = %v; want %v", tt.query, types, tt.expectedTypes)
+			}
+		})
+	}
+}
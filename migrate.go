@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// ErrNoMigration is returned for a persisted document that no chain of
+// migrations brings to the current format, e.g. one written by a newer
+// release.
+var ErrNoMigration = errors.New("no migration")
+
+// Kinds of persisted documents, each with its own format version.
+const (
+	KindSnapshot = "snapshot" // see WriteSnapshot, versioned by "version"
+	KindBackup   = "backup"   // see Backup, versioned by "format"
+)
+
+// formats holds the current format version of each kind of document and
+// the field holding it.
+var formats = map[string]struct {
+	version int
+	field   string
+}{
+	KindSnapshot: {snapshotVersion, "version"},
+	KindBackup:   {backupFormat, "format"},
+}
+
+// Migration upgrades a persisted document of Kind from format version From
+// to From+1. Apply edits the document's top-level fields in place; the
+// version field is updated after it succeeds.
+type Migration struct {
+	Kind        string
+	From        int
+	Description string
+	Apply       func(doc map[string]json.RawMessage) error
+}
+
+// Migrations is an ordered set of migrations.
+type Migrations []Migration
+
+// migrations holds every migration, applied automatically by ReadSnapshot
+// and Restore to documents in an older format. A change of a persisted
+// format bumps snapshotVersion or backupFormat and registers here the
+// migration from the previous version.
+var migrations Migrations
+
+// Migrate brings a document of kind to its current format, applying every
+// migration from its version on in order, and returns it with the
+// migrations applied, none if it is current. Backups also have their
+// snapshot migrated. Nothing is written: discarding the result is a dry run.
+func (m Migrations) Migrate(kind string, data []byte) ([]byte, []Migration, error) {
+	doc := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("decode %s: %w", kind, err)
+	}
+	applied, err := m.migrate(kind, doc)
+	if err != nil || len(applied) == 0 {
+		return data, applied, err
+	}
+	data, err = json.Marshal(doc)
+	return data, applied, err
+}
+
+func (m Migrations) migrate(kind string, doc map[string]json.RawMessage) ([]Migration, error) {
+	format, ok := formats[kind]
+	if !ok {
+		return nil, fmt.Errorf("%w of %s documents", ErrNoMigration, kind)
+	}
+	var version int
+	if raw, ok := doc[format.field]; ok {
+		if err := json.Unmarshal(raw, &version); err != nil {
+			return nil, fmt.Errorf("decode %s %s: %w", kind, format.field, err)
+		}
+	}
+
+	var applied []Migration
+	for version < format.version {
+		step, ok := m.find(kind, version)
+		if !ok {
+			return applied, fmt.Errorf("%w of %s from version %d", ErrNoMigration, kind, version)
+		}
+		if err := step.Apply(doc); err != nil {
+			return applied, fmt.Errorf("migrate %s from version %d (%s): %w", kind, version, step.Description, err)
+		}
+		version++
+		doc[format.field], _ = json.Marshal(version)
+		applied = append(applied, step)
+	}
+	if version > format.version {
+		return applied, fmt.Errorf("%w of %s from version %d, newer than %d", ErrNoMigration, kind, version, format.version)
+	}
+
+	if raw, ok := doc["snapshot"]; ok && kind == KindBackup {
+		snapshot := map[string]json.RawMessage{}
+		if err := json.Unmarshal(raw, &snapshot); err != nil {
+			return applied, fmt.Errorf("decode backup snapshot: %w", err)
+		}
+		steps, err := m.migrate(KindSnapshot, snapshot)
+		if err != nil {
+			return applied, err
+		}
+		if len(steps) > 0 {
+			doc["snapshot"], _ = json.Marshal(snapshot)
+			applied = append(applied, steps...)
+		}
+	}
+	return applied, nil
+}
+
+func (m Migrations) find(kind string, from int) (Migration, bool) {
+	for _, step := range m {
+		if step.Kind == kind && step.From == from {
+			return step, true
+		}
+	}
+	return Migration{}, false
+}
+
+// logMigrations reports migrations applied on reading a document.
+func logMigrations(applied []Migration) {
+	for _, step := range applied {
+		fmt.Printf("Migrated %s from version %d to %d: %s\n", step.Kind, step.From, step.From+1, step.Description)
+	}
+}
+
+// runMigrate implements "vaultflow migrate": it brings snapshot or backup
+// files to the current formats in place, or with -dry-run only lists the
+// migrations that would be applied.
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	kind := flags.String("kind", KindBackup, "kind of the files, backup or snapshot")
+	dryRun := flags.Bool("dry-run", false, "list the migrations without writing the files")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: vaultflow migrate [-kind backup|snapshot] [-dry-run] file...")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("want a file to migrate")
+	}
+
+	for _, path := range flags.Args() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if IsSealed(data) {
+			return fmt.Errorf("%s is encrypted: it is migrated when read with its key", path)
+		}
+		migrated, applied, err := migrations.Migrate(*kind, data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if len(applied) == 0 {
+			fmt.Printf("%s: up to date\n", path)
+			continue
+		}
+		for _, step := range applied {
+			fmt.Printf("%s: %s from version %d to %d: %s\n", path, step.Kind, step.From, step.From+1, step.Description)
+		}
+		if *dryRun || bytes.Equal(migrated, data) {
+			continue
+		}
+		if err := os.WriteFile(path, migrated, 0o600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testMigrations upgrades snapshots from a version 0 that held balances
+// under "balances" rather than "accounts".
+var testMigrations = Migrations{{
+	Kind:        KindSnapshot,
+	From:        0,
+	Description: "rename balances to accounts",
+	Apply: func(doc map[string]json.RawMessage) error {
+		balances, ok := doc["balances"]
+		if !ok {
+			return errors.New("no balances")
+		}
+		doc["accounts"] = balances
+		delete(doc, "balances")
+		return nil
+	},
+}}
+
+// useMigrations replaces the registered migrations for the duration of t.
+func useMigrations(t *testing.T, m Migrations) {
+	previous := migrations
+	migrations = m
+	t.Cleanup(func() { migrations = previous })
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name          string
+		kind          string
+		data          string
+		expectedSteps int
+		expected      string
+		expectedErr   error
+	}{
+		{"Current snapshot", KindSnapshot, `{"version":1,"accounts":{"acc1":10}}`, 0, `{"version":1,"accounts":{"acc1":10}}`, nil},
+		{"Old snapshot", KindSnapshot, `{"version":0,"balances":{"acc1":10}}`, 1, `{"accounts":{"acc1":10},"version":1}`, nil},
+		{"Unversioned snapshot", KindSnapshot, `{"balances":{"acc1":10}}`, 1, `{"accounts":{"acc1":10},"version":1}`, nil},
+		{"Backup of an old snapshot", KindBackup, `{"format":1,"snapshot":{"version":0,"balances":{}}}`, 1, `{"format":1,"snapshot":{"accounts":{},"version":1}}`, nil},
+		{"Failing migration", KindSnapshot, `{"version":0}`, 0, "", nil},
+		{"Missing migration", KindBackup, `{"format":0}`, 0, "", ErrNoMigration},
+		{"Newer snapshot", KindSnapshot, `{"version":2}`, 0, "", ErrNoMigration},
+		{"Unknown kind", "ledger", `{}`, 0, "", ErrNoMigration},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, applied, err := testMigrations.Migrate(tt.kind, []byte(tt.data))
+			if tt.expected == "" {
+				if err == nil || (tt.expectedErr != nil && !errors.Is(err, tt.expectedErr)) {
+					t.Fatalf("Migrate() error = %v; want %v", err, tt.expectedErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Migrate() error = %v", err)
+			}
+			if len(applied) != tt.expectedSteps {
+				t.Errorf("Migrate() applied %d migrations; want %d", len(applied), tt.expectedSteps)
+			}
+			if string(data) != tt.expected {
+				t.Errorf("Migrate() = %s; want %s", data, tt.expected)
+			}
+		})
+	}
+}
+
+func TestReadSnapshotMigrates(t *testing.T) {
+	quiet(t)
+	useMigrations(t, testMigrations)
+
+	sm := &StateMachine{}
+	if err := sm.ReadSnapshot(bytes.NewReader([]byte(`{"version":0,"balances":{"acc1":10}}`)), nil); err != nil {
+		t.Fatalf("ReadSnapshot() of an old snapshot error = %v", err)
+	}
+	if balance, err := sm.Balance("acc1"); err != nil || balance != 10 {
+		t.Errorf("Balance(acc1) = %d, %v; want 10", balance, err)
+	}
+
+	if err := sm.ReadSnapshot(bytes.NewReader([]byte(`{"version":2}`)), nil); !errors.Is(err, ErrNoMigration) {
+		t.Errorf("ReadSnapshot() of a newer snapshot error = %v; want ErrNoMigration", err)
+	}
+}
+
+func TestMigrateCommand(t *testing.T) {
+	quiet(t)
+	useMigrations(t, testMigrations)
+
+	old := []byte(`{"version":0,"balances":{"acc1":10}}`)
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(path, old, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runMigrate([]string{"-kind", KindSnapshot, "-dry-run", path}); err != nil {
+		t.Fatalf("runMigrate(-dry-run) error = %v", err)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, old) {
+		t.Errorf("runMigrate(-dry-run) rewrote the file to %s", data)
+	}
+
+	if err := runMigrate([]string{"-kind", KindSnapshot, path}); err != nil {
+		t.Fatalf("runMigrate() error = %v", err)
+	}
+	sm := &StateMachine{}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	useMigrations(t, nil)
+	if err := sm.ReadSnapshot(f, nil); err != nil {
+		t.Errorf("ReadSnapshot() of the migrated file without migrations error = %v", err)
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSignaturesRequired = errors.New("debit requires signatures")
+	ErrUnknownDebit       = errors.New("unknown pending debit")
+	ErrDebitDecided       = errors.New("debit already decided")
+	ErrNotSigner          = errors.New("not a signer of the account")
+	ErrAlreadySigned      = errors.New("debit already signed by this signer")
+	ErrInvalidSigners     = errors.New("invalid signer set")
+)
+
+// SignerSet makes debits of an account wait until Required of its Signers
+// signed them.
+type SignerSet struct {
+	Signers  []string `json:"signers"`
+	Required int      `json:"required"`
+}
+
+func (set SignerSet) validate() error {
+	if set.Required < 1 || set.Required > len(set.Signers) {
+		return fmt.Errorf("%w: %d of %d signers required", ErrInvalidSigners, set.Required, len(set.Signers))
+	}
+	for i, signer := range set.Signers {
+		if signer == "" || slices.Contains(set.Signers[:i], signer) {
+			return fmt.Errorf("%w: empty or repeated signer %q", ErrInvalidSigners, signer)
+		}
+	}
+	return nil
+}
+
+type DebitStatus string
+
+const (
+	DebitPending  DebitStatus = "pending"
+	DebitApplied  DebitStatus = "applied" // signed and applied
+	DebitFailed   DebitStatus = "failed"  // signed, but the operation failed
+	DebitRejected DebitStatus = "rejected"
+)
+
+// PendingDebit is a withdrawal or transfer out of an account with a signer
+// set, waiting for, or having received, enough signatures.
+type PendingDebit struct {
+	ID          string
+	Operation   Operation
+	RequestedBy string
+	RequestedAt time.Time
+	Signers     SignerSet // the signer set of the account when requested
+	Signatures  []string  // distinct signers, in signing order
+
+	Status    DebitStatus
+	DecidedBy string
+	DecidedAt time.Time
+	Reason    string // rejection reason or operation error
+}
+
+// SignaturesRequiredError is returned by a debit that was parked for
+// signatures instead of being applied.
+type SignaturesRequiredError struct {
+	ID string
+}
+
+func (e *SignaturesRequiredError) Error() string {
+	return fmt.Sprintf("%s: pending as %s", ErrSignaturesRequired, e.ID)
+}
+
+func (e *SignaturesRequiredError) Is(target error) bool {
+	return target == ErrSignaturesRequired
+}
+
+// multisig holds the signer sets and the debits parked for signatures. Its
+// lock is never held while taking the state lock.
+type multisig struct {
+	mu     sync.Mutex
+	sets   map[string]SignerSet // by account
+	debits map[string]*PendingDebit
+	order  []string // ids in request order
+}
+
+type signedKey struct{}
+
+// RequireSignatures makes withdrawals and transfers out of an account wait
+// for set.Required distinct signers of set.Signers, see SignDebit. An empty
+// set lifts the requirement. Signer sets are not versioned and rollbacks do
+// not touch them.
+func (sm *StateMachine) RequireSignatures(accountId string, set SignerSet) error {
+	if sm.readOnly {
+		return ErrReadOnly
+	}
+	if _, err := sm.Balance(accountId); err != nil {
+		return err
+	}
+	if len(set.Signers) > 0 || set.Required != 0 {
+		if err := set.validate(); err != nil {
+			return err
+		}
+	}
+
+	sm.multisig.mu.Lock()
+	defer sm.multisig.mu.Unlock()
+
+	if len(set.Signers) == 0 {
+		delete(sm.multisig.sets, accountId)
+		return nil
+	}
+	if sm.multisig.sets == nil {
+		sm.multisig.sets = map[string]SignerSet{}
+	}
+	sm.multisig.sets[accountId] = SignerSet{Signers: slices.Clone(set.Signers), Required: set.Required}
+	return nil
+}
+
+// Signers returns the signer set of an account, if it has one.
+func (sm *StateMachine) Signers(accountId string) (SignerSet, bool) {
+	sm.multisig.mu.Lock()
+	defer sm.multisig.mu.Unlock()
+
+	set, ok := sm.multisig.sets[accountId]
+	set.Signers = slices.Clone(set.Signers)
+	return set, ok
+}
+
+// signerSets returns a copy of every signer set, by account.
+func (ms *multisig) signerSets() map[string]SignerSet {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if len(ms.sets) == 0 {
+		return nil
+	}
+	sets := make(map[string]SignerSet, len(ms.sets))
+	for id, set := range ms.sets {
+		sets[id] = SignerSet{Signers: slices.Clone(set.Signers), Required: set.Required}
+	}
+	return sets
+}
+
+// restore replaces the signer sets. Pending debits are kept.
+func (ms *multisig) restore(sets map[string]SignerSet) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.sets = sets
+}
+
+// restoreDebits replaces the pending debits.
+func (ms *multisig) restoreDebits(debits []PendingDebit) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.debits, ms.order = map[string]*PendingDebit{}, nil
+	for _, pending := range debits {
+		ms.debits[pending.ID] = &pending
+		ms.order = append(ms.order, pending.ID)
+	}
+}
+
+// signerSet returns the signer set op must be signed by, if any.
+func (ms *multisig) signerSet(op Operation) (SignerSet, bool) {
+	if op.Type != OpWithdraw && op.Type != OpTransfer {
+		return SignerSet{}, false
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	set, ok := ms.sets[op.From]
+	return set, ok
+}
+
+// checkSignatures fails with ErrSignaturesRequired if op must be signed and
+// ctx does not come from SignDebit, for transactions, which cannot wait.
+func (sm *StateMachine) checkSignatures(ctx context.Context, op Operation) error {
+	if ctx.Value(signedKey{}) != nil {
+		return nil
+	}
+	if set, ok := sm.multisig.signerSet(op); ok {
+		return fmt.Errorf("%w: %s needs %d signatures and cannot be debited in a transaction", ErrSignaturesRequired, op.From, set.Required)
+	}
+	return nil
+}
+
+// parkDebit records a debit of an account with a signer set and returns the
+// *SignaturesRequiredError to hand back to the caller, or nil when op may
+// be applied right away. The requester's own signature counts if they are
+// one of the signers.
+func (sm *StateMachine) parkDebit(ctx context.Context, op Operation) error {
+	if ctx.Value(signedKey{}) != nil {
+		return nil
+	}
+	set, ok := sm.multisig.signerSet(op)
+	if !ok {
+		return nil
+	}
+	actor := ActorFrom(ctx)
+	var signatures []string
+	if slices.Contains(set.Signers, actor) {
+		if set.Required == 1 {
+			return nil
+		}
+		signatures = []string{actor}
+	}
+
+	// Reject debits that could never be applied before asking anyone.
+	if _, err := sm.SimulateContext(ctx, func(scratch *StateMachine) error {
+		_, err := scratch.ApplyContext(ctx, op)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	now := sm.now()
+	pending := &PendingDebit{
+		ID:          sm.ids.next(now),
+		Operation:   op,
+		RequestedBy: actor,
+		RequestedAt: now,
+		Signers:     set,
+		Signatures:  signatures,
+		Status:      DebitPending,
+	}
+
+	sm.multisig.mu.Lock()
+	defer sm.multisig.mu.Unlock()
+
+	if sm.multisig.debits == nil {
+		sm.multisig.debits = map[string]*PendingDebit{}
+	}
+	sm.multisig.debits[pending.ID] = pending
+	sm.multisig.order = append(sm.multisig.order, pending.ID)
+
+	fmt.Printf("\n\nDebit of %d from account %s pending %d signatures as %s\n", op.Amount, op.From, set.Required, pending.ID)
+
+	return &SignaturesRequiredError{ID: pending.ID}
+}
+
+// SignDebit signs a pending debit on behalf of the actor in ctx, who must
+// be one of the signers of the account, and applies it once it has enough
+// signatures. Signed debits need no further approval.
+func (sm *StateMachine) SignDebit(ctx context.Context, id string) (PendingDebit, error) {
+	actor := ActorFrom(ctx)
+
+	sm.multisig.mu.Lock()
+	pending, ok := sm.multisig.debits[id]
+	if !ok {
+		sm.multisig.mu.Unlock()
+		return PendingDebit{}, fmt.Errorf("%w (%s)", ErrUnknownDebit, id)
+	}
+	if err := pending.checkPending(); err != nil {
+		defer sm.multisig.mu.Unlock()
+		return pending.clone(), err
+	}
+	if !slices.Contains(pending.Signers.Signers, actor) {
+		defer sm.multisig.mu.Unlock()
+		return pending.clone(), fmt.Errorf("%w (%q)", ErrNotSigner, actor)
+	}
+	if slices.Contains(pending.Signatures, actor) {
+		defer sm.multisig.mu.Unlock()
+		return pending.clone(), fmt.Errorf("%w (%q)", ErrAlreadySigned, actor)
+	}
+
+	pending.Signatures = append(pending.Signatures, actor)
+	if len(pending.Signatures) < pending.Signers.Required {
+		defer sm.multisig.mu.Unlock()
+		fmt.Printf("\n\nDebit %s signed by %q\n", id, actor)
+		return pending.clone(), nil
+	}
+	// Decide it now, so it cannot be applied twice meanwhile.
+	pending.Status, pending.DecidedBy, pending.DecidedAt = DebitApplied, actor, sm.now()
+	signed := pending.clone()
+	sm.multisig.mu.Unlock()
+
+	fmt.Printf("\n\nDebit %s signed by %q and applied\n", id, actor)
+
+	ctx = context.WithValue(context.WithValue(ctx, signedKey{}, id), approvedKey{}, id)
+	if _, err := sm.ApplyContext(ctx, signed.Operation); err != nil {
+		sm.multisig.mu.Lock()
+		defer sm.multisig.mu.Unlock()
+		pending.Status, pending.Reason = DebitFailed, err.Error()
+		return pending.clone(), err
+	}
+	return signed, nil
+}
+
+// RejectDebit discards a pending debit without moving funds. It may be
+// rejected by any of the signers or by its requester.
+func (sm *StateMachine) RejectDebit(ctx context.Context, id, reason string) (PendingDebit, error) {
+	actor := ActorFrom(ctx)
+
+	sm.multisig.mu.Lock()
+	defer sm.multisig.mu.Unlock()
+
+	pending, ok := sm.multisig.debits[id]
+	if !ok {
+		return PendingDebit{}, fmt.Errorf("%w (%s)", ErrUnknownDebit, id)
+	}
+	if err := pending.checkPending(); err != nil {
+		return pending.clone(), err
+	}
+	if actor != pending.RequestedBy && !slices.Contains(pending.Signers.Signers, actor) {
+		return pending.clone(), fmt.Errorf("%w (%q)", ErrNotSigner, actor)
+	}
+
+	pending.Status, pending.DecidedBy, pending.DecidedAt, pending.Reason = DebitRejected, actor, sm.now(), reason
+	fmt.Printf("\n\nDebit %s rejected by %q: %s\n", id, actor, reason)
+	return pending.clone(), nil
+}
+
+func (pending *PendingDebit) checkPending() error {
+	if pending.Status != DebitPending {
+		return fmt.Errorf("%w: %s is %s", ErrDebitDecided, pending.ID, pending.Status)
+	}
+	return nil
+}
+
+// PendingDebit returns a debit parked for signatures, whatever its status.
+func (sm *StateMachine) PendingDebit(id string) (PendingDebit, error) {
+	sm.multisig.mu.Lock()
+	defer sm.multisig.mu.Unlock()
+
+	pending, ok := sm.multisig.debits[id]
+	if !ok {
+		return PendingDebit{}, fmt.Errorf("%w (%s)", ErrUnknownDebit, id)
+	}
+	return pending.clone(), nil
+}
+
+// PendingDebits returns every debit parked for signatures, oldest first.
+func (sm *StateMachine) PendingDebits() []PendingDebit {
+	sm.multisig.mu.Lock()
+	defer sm.multisig.mu.Unlock()
+
+	list := make([]PendingDebit, 0, len(sm.multisig.order))
+	for _, id := range sm.multisig.order {
+		list = append(list, sm.multisig.debits[id].clone())
+	}
+	return list
+}
+
+func (pending *PendingDebit) clone() PendingDebit {
+	c := *pending
+	c.Signatures = slices.Clone(pending.Signatures)
+	return c
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMultisig(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"joint": 1000, "acc2": 0}}
+	if err := sm.RequireSignatures("joint", SignerSet{Signers: []string{"alice", "bob", "carol"}, Required: 2}); err != nil {
+		t.Fatal(err)
+	}
+	as := func(actor string) context.Context { return WithActor(context.Background(), actor) }
+
+	// Deposits need no signatures.
+	if err := sm.Deposit("joint", 100); err != nil {
+		t.Fatalf("Deposit() error = %v", err)
+	}
+
+	var parked *SignaturesRequiredError
+	err := sm.TransferContext(as("dave"), "joint", "acc2", 300)
+	if !errors.As(err, &parked) {
+		t.Fatalf("TransferContext() error = %v; want a *SignaturesRequiredError", err)
+	}
+	if balance, _ := sm.Balance("joint"); balance != 1100 {
+		t.Fatalf("Balance() = %d after parking; want 1100", balance)
+	}
+
+	tests := []struct {
+		name               string
+		actor              string
+		expectedErr        error
+		expectedStatus     DebitStatus
+		expectedSignatures []string
+	}{
+		{"Not a signer", "dave", ErrNotSigner, DebitPending, nil},
+		{"First signature", "alice", nil, DebitPending, []string{"alice"}},
+		{"Same signer again", "alice", ErrAlreadySigned, DebitPending, []string{"alice"}},
+		{"Second signature", "carol", nil, DebitApplied, []string{"alice", "carol"}},
+		{"After applied", "bob", ErrDebitDecided, DebitApplied, []string{"alice", "carol"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			debit, err := sm.SignDebit(as(tt.actor), parked.ID)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("SignDebit() error = %v; want %v", err, tt.expectedErr)
+			}
+			if debit.Status != tt.expectedStatus || !slices.Equal(debit.Signatures, tt.expectedSignatures) {
+				t.Errorf("SignDebit() = %s signed by %v; want %s signed by %v", debit.Status, debit.Signatures, tt.expectedStatus, tt.expectedSignatures)
+			}
+		})
+	}
+
+	if balances := sm.Balances(); balances["joint"] != 800 || balances["acc2"] != 300 {
+		t.Errorf("Balances() = %v; want 800 left in joint", balances)
+	}
+}
+
+func TestMultisigRequesterSigns(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"joint": 1000}}
+	_ = sm.RequireSignatures("joint", SignerSet{Signers: []string{"alice", "bob"}, Required: 2})
+
+	err := sm.WithdrawContext(WithActor(context.Background(), "alice"), "joint", 100)
+	var parked *SignaturesRequiredError
+	if !errors.As(err, &parked) {
+		t.Fatalf("WithdrawContext() error = %v; want a *SignaturesRequiredError", err)
+	}
+	if debit, _ := sm.PendingDebit(parked.ID); !slices.Equal(debit.Signatures, []string{"alice"}) {
+		t.Errorf("Signatures = %v; want the requester's", debit.Signatures)
+	}
+	if debit, err := sm.SignDebit(WithActor(context.Background(), "bob"), parked.ID); err != nil || debit.Status != DebitApplied {
+		t.Fatalf("SignDebit() = %s, %v; want applied", debit.Status, err)
+	}
+
+	// With a single signature required, its signer debits right away.
+	_ = sm.RequireSignatures("joint", SignerSet{Signers: []string{"alice", "bob"}, Required: 1})
+	if err := sm.WithdrawContext(WithActor(context.Background(), "bob"), "joint", 100); err != nil {
+		t.Fatalf("WithdrawContext() by a signer error = %v", err)
+	}
+	if balance, _ := sm.Balance("joint"); balance != 800 {
+		t.Errorf("Balance() = %d; want 800", balance)
+	}
+}
+
+func TestMultisigReject(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"joint": 1000}}
+	_ = sm.RequireSignatures("joint", SignerSet{Signers: []string{"alice", "bob"}, Required: 2})
+
+	var parked *SignaturesRequiredError
+	if err := sm.WithdrawContext(WithActor(context.Background(), "dave"), "joint", 100); !errors.As(err, &parked) {
+		t.Fatalf("WithdrawContext() error = %v; want a *SignaturesRequiredError", err)
+	}
+	if _, err := sm.RejectDebit(WithActor(context.Background(), "eve"), parked.ID, "no"); !errors.Is(err, ErrNotSigner) {
+		t.Errorf("RejectDebit() by a stranger error = %v; want ErrNotSigner", err)
+	}
+	if debit, err := sm.RejectDebit(WithActor(context.Background(), "dave"), parked.ID, "typo"); err != nil || debit.Status != DebitRejected {
+		t.Fatalf("RejectDebit() by the requester = %s, %v; want rejected", debit.Status, err)
+	}
+	if _, err := sm.SignDebit(WithActor(context.Background(), "alice"), parked.ID); !errors.Is(err, ErrDebitDecided) {
+		t.Errorf("SignDebit() of a rejected debit error = %v; want ErrDebitDecided", err)
+	}
+	if _, err := sm.SignDebit(WithActor(context.Background(), "alice"), "nope"); !errors.Is(err, ErrUnknownDebit) {
+		t.Errorf("SignDebit() of an unknown debit error = %v; want ErrUnknownDebit", err)
+	}
+	if balance, _ := sm.Balance("joint"); balance != 1000 {
+		t.Errorf("Balance() = %d; want 1000", balance)
+	}
+}
+
+func TestMultisigFailures(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"joint": 100, "acc2": 0}}
+	_ = sm.RequireSignatures("joint", SignerSet{Signers: []string{"alice", "bob"}, Required: 2})
+
+	// Debits that could never apply are not parked.
+	if err := sm.Withdraw("joint", 500); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Withdraw() error = %v; want ErrInsufficientBalance", err)
+	}
+	if debits := sm.PendingDebits(); len(debits) != 0 {
+		t.Errorf("PendingDebits() = %+v; want none", debits)
+	}
+
+	// Transactions cannot wait for signatures.
+	err := sm.Tx(func(tx *Tx) error { return tx.Transfer("joint", "acc2", 10) })
+	if !errors.Is(err, ErrSignaturesRequired) {
+		t.Errorf("Tx() error = %v; want ErrSignaturesRequired", err)
+	}
+
+	// A debit that no longer applies once signed fails.
+	var parked *SignaturesRequiredError
+	if err := sm.Withdraw("joint", 80); !errors.As(err, &parked) {
+		t.Fatalf("Withdraw() error = %v; want a *SignaturesRequiredError", err)
+	}
+	_ = sm.RequireSignatures("joint", SignerSet{})
+	if err := sm.Withdraw("joint", 50); err != nil {
+		t.Fatalf("Withdraw() without signers error = %v", err)
+	}
+	_, _ = sm.SignDebit(WithActor(context.Background(), "alice"), parked.ID)
+	debit, err := sm.SignDebit(WithActor(context.Background(), "bob"), parked.ID)
+	if !errors.Is(err, ErrInsufficientBalance) || debit.Status != DebitFailed || debit.Reason == "" {
+		t.Errorf("SignDebit() = %+v, %v; want failed with ErrInsufficientBalance", debit, err)
+	}
+}
+
+func TestRequireSignatures(t *testing.T) {
+	sm := &StateMachine{accounts: map[string]int{"joint": 0}}
+
+	tests := []struct {
+		name        string
+		account     string
+		set         SignerSet
+		expectedErr error
+	}{
+		{"Valid", "joint", SignerSet{Signers: []string{"alice", "bob"}, Required: 2}, nil},
+		{"Too many required", "joint", SignerSet{Signers: []string{"alice"}, Required: 2}, ErrInvalidSigners},
+		{"None required", "joint", SignerSet{Signers: []string{"alice"}}, ErrInvalidSigners},
+		{"Repeated signer", "joint", SignerSet{Signers: []string{"alice", "alice"}, Required: 2}, ErrInvalidSigners},
+		{"Unknown account", "nope", SignerSet{Signers: []string{"alice"}, Required: 1}, ErrInvalidAccount},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := sm.RequireSignatures(tt.account, tt.set); !errors.Is(err, tt.expectedErr) {
+				t.Errorf("RequireSignatures() error = %v; want %v", err, tt.expectedErr)
+			}
+		})
+	}
+
+	if set, ok := sm.Signers("joint"); !ok || set.Required != 2 || len(set.Signers) != 2 {
+		t.Errorf("Signers() = %+v, %t; want the valid set", set, ok)
+	}
+	_ = sm.RequireSignatures("joint", SignerSet{})
+	if set, ok := sm.Signers("joint"); ok {
+		t.Errorf("Signers() = %+v after lifting; want none", set)
+	}
+}
+
+func TestMultisigSnapshot(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"joint": 100}}
+	_ = sm.RequireSignatures("joint", SignerSet{Signers: []string{"alice", "bob"}, Required: 2})
+	var buf bytes.Buffer
+	if err := sm.WriteSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &StateMachine{}
+	if err := restored.ReadSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Withdraw("joint", 10); !errors.Is(err, ErrSignaturesRequired) {
+		t.Errorf("Withdraw() after restoring error = %v; want ErrSignaturesRequired", err)
+	}
+}
+
+func TestServerMultisig(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"joint": 1000, "acc2": 0})
+	do := func(method, path, client, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(ClientIDHeader, client)
+		srv.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := do(http.MethodPut, "/accounts/joint/signers", "admin", `{"signers": ["alice", "bob"], "required": 3}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT invalid signers = %d; want 400 (%s)", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/accounts/joint/signers", "admin", `{"signers": ["alice", "bob"], "required": 2}`); rec.Code != http.StatusOK {
+		t.Fatalf("PUT signers = %d; want 200 (%s)", rec.Code, rec.Body)
+	}
+
+	rec := do(http.MethodPost, "/transfers", "dave", `{"from": "joint", "to": "acc2", "amount": 250}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("POST /transfers = %d; want 202 (%s)", rec.Code, rec.Body)
+	}
+	var pending map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &pending); err != nil {
+		t.Fatal(err)
+	}
+	id := pending["debit_id"]
+
+	tests := []struct {
+		name           string
+		method, path   string
+		client         string
+		expectedStatus int
+	}{
+		{"Get", http.MethodGet, "/debits/" + id, "dave", http.StatusOK},
+		{"Unknown", http.MethodGet, "/debits/nope", "dave", http.StatusNotFound},
+		{"Sign by a stranger", http.MethodPost, "/debits/" + id + "/sign", "dave", http.StatusForbidden},
+		{"Sign", http.MethodPost, "/debits/" + id + "/sign", "alice", http.StatusOK},
+		{"Sign twice", http.MethodPost, "/debits/" + id + "/sign", "alice", http.StatusConflict},
+		{"Last signature", http.MethodPost, "/debits/" + id + "/sign", "bob", http.StatusOK},
+		{"Reject after applied", http.MethodPost, "/debits/" + id + "/reject", "bob", http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.method, tt.path, tt.client, `{}`); rec.Code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+
+	if balance, _ := sm.Balance("acc2"); balance != 250 {
+		t.Errorf("Balance() = %d; want 250", balance)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var ErrInvalidObligation = errors.New("invalid obligation")
+
+// maxObligations bounds the obligations settled in one batch.
+const maxObligations = 10000
+
+// Obligation is an amount one account owes another, to be settled with the
+// others of its batch by Settle.
+type Obligation struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount int    `json:"amount"`
+}
+
+// Settlement is a batch of obligations settled by net transfers.
+type Settlement struct {
+	ID          string      `json:"id"`
+	Obligations int         `json:"obligations"`
+	Gross       int         `json:"gross"` // total of the obligations
+	Net         int         `json:"net"`   // total of the transfers
+	Transfers   []Operation `json:"transfers"`
+}
+
+// position is the net amount an account receives, negative if it pays.
+type position struct {
+	account string
+	amount  int
+}
+
+// Net returns the transfers settling obligations: each account pays or
+// receives only its net position, the difference between what it is owed
+// and what it owes. The largest payer pays the largest receiver first, so
+// there are fewer transfers than accounts with a net position, and never
+// more than obligations. Equal positions are taken in account order, so the
+// same obligations always give the same transfers.
+func Net(obligations []Obligation) ([]Operation, error) {
+	if len(obligations) > maxObligations {
+		return nil, fmt.Errorf("%w: more than %d obligations in a batch", ErrInvalidObligation, maxObligations)
+	}
+	net := map[string]int{}
+	for i, o := range obligations {
+		if o.Amount <= 0 || o.From == o.To {
+			return nil, fmt.Errorf("%w %d: needs a positive amount owed to another account", ErrInvalidObligation, i)
+		}
+		op := Operation{Type: OpTransfer, From: o.From, To: o.To, Amount: o.Amount}
+		if err := op.Validate(); err != nil {
+			return nil, fmt.Errorf("%w %d: %w", ErrInvalidObligation, i, err)
+		}
+		net[o.From] -= o.Amount
+		net[o.To] += o.Amount
+	}
+
+	var payers, receivers []position
+	for account, amount := range net {
+		switch {
+		case amount < 0:
+			payers = append(payers, position{account, -amount})
+		case amount > 0:
+			receivers = append(receivers, position{account, amount})
+		}
+	}
+	largestFirst := func(a, b position) int {
+		return cmp.Or(cmp.Compare(b.amount, a.amount), cmp.Compare(a.account, b.account))
+	}
+	slices.SortFunc(payers, largestFirst)
+	slices.SortFunc(receivers, largestFirst)
+
+	var transfers []Operation
+	for len(payers) > 0 && len(receivers) > 0 {
+		payer, receiver := &payers[0], &receivers[0]
+		amount := min(payer.amount, receiver.amount)
+		transfers = append(transfers, Operation{Type: OpTransfer, From: payer.account, To: receiver.account, Amount: amount})
+
+		if payer.amount -= amount; payer.amount == 0 {
+			payers = payers[1:]
+		}
+		if receiver.amount -= amount; receiver.amount == 0 {
+			receivers = receivers[1:]
+		}
+	}
+	return transfers, nil
+}
+
+// Settle nets obligations and applies the resulting transfers as one
+// transaction, so either every obligation is settled or none is. Each
+// transfer has the memo "settlement <id>" and the settlement's ID as its
+// "settlement" metadata. Like in any transaction, net transfers above the
+// approval threshold or out of accounts with signers fail the settlement.
+func (sm *StateMachine) Settle(ctx context.Context, obligations []Obligation) (Settlement, error) {
+	transfers, err := Net(obligations)
+	if err != nil {
+		return Settlement{}, err
+	}
+
+	s := Settlement{ID: sm.ids.next(sm.now()), Obligations: len(obligations)}
+	for _, o := range obligations {
+		s.Gross += o.Amount
+	}
+	for i := range transfers {
+		transfers[i].Memo = "settlement " + s.ID
+		transfers[i].Metadata = map[string]string{"settlement": s.ID}
+		s.Net += transfers[i].Amount
+	}
+
+	var settled *Tx
+	err = sm.TxContext(ctx, func(tx *Tx) error {
+		settled = tx
+		for _, op := range transfers {
+			if err := tx.Apply(op); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Settlement{}, fmt.Errorf("settlement %s: %w", s.ID, err)
+	}
+	s.Transfers = append([]Operation{}, settled.ops...)
+
+	fmt.Printf("\n\nSettled %d obligations of %d with %d transfers of %d as %s\n", s.Obligations, s.Gross, len(s.Transfers), s.Net, s.ID)
+	return s, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNet(t *testing.T) {
+	tests := []struct {
+		name        string
+		obligations []Obligation
+		expected    []Operation
+		expectedErr error
+	}{
+		{"Nothing owed", nil, nil, nil},
+		{
+			"Offsetting",
+			[]Obligation{{"a", "b", 100}, {"b", "a", 60}},
+			[]Operation{{Type: OpTransfer, From: "a", To: "b", Amount: 40}},
+			nil,
+		},
+		{
+			"Cancelling out",
+			[]Obligation{{"a", "b", 50}, {"b", "c", 50}, {"c", "a", 50}},
+			nil,
+			nil,
+		},
+		{
+			"Chain",
+			[]Obligation{{"a", "b", 100}, {"b", "c", 100}},
+			[]Operation{{Type: OpTransfer, From: "a", To: "c", Amount: 100}},
+			nil,
+		},
+		{
+			"Largest first",
+			[]Obligation{{"a", "c", 30}, {"b", "c", 70}, {"b", "d", 20}, {"c", "d", 10}},
+			[]Operation{
+				{Type: OpTransfer, From: "b", To: "c", Amount: 90},
+				{Type: OpTransfer, From: "a", To: "d", Amount: 30},
+			},
+			nil,
+		},
+		{"Zero amount", []Obligation{{"a", "b", 0}}, nil, ErrInvalidObligation},
+		{"Owed to itself", []Obligation{{"a", "a", 10}}, nil, ErrInvalidObligation},
+		{"Bucket key", []Obligation{{"a#reserved", "b", 10}}, nil, ErrInvalidObligation},
+		{"Too many", make([]Obligation, maxObligations+1), nil, ErrInvalidObligation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transfers, err := Net(tt.obligations)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Net() error = %v; want %v", err, tt.expectedErr)
+			}
+			if !reflect.DeepEqual(transfers, tt.expected) {
+				t.Errorf("Net() = %+v; want %+v", transfers, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSettle(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"a": 100, "b": 50, "c": 0}}
+	obligations := []Obligation{{"a", "b", 100}, {"b", "c", 150}, {"c", "a", 20}}
+
+	s, err := sm.Settle(context.Background(), obligations)
+	if err != nil {
+		t.Fatalf("Settle() error = %v", err)
+	}
+	if s.Obligations != 3 || s.Gross != 270 || s.Net != 130 || len(s.Transfers) != 2 {
+		t.Errorf("Settle() = %+v; want 3 obligations of 270 settled by 2 transfers of 130", s)
+	}
+	if balances := sm.Balances(); !maps.Equal(balances, map[string]int{"a": 20, "b": 0, "c": 130}) {
+		t.Errorf("Balances() = %v", balances)
+	}
+	if ops := sm.OperationsWithMetadata(map[string]string{"settlement": s.ID}); len(ops) != 2 || ops[0].ID != s.Transfers[0].ID {
+		t.Errorf("Settlement operations = %+v; want %+v", ops, s.Transfers)
+	}
+
+	// One Rollback undoes the whole settlement.
+	if err := sm.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if balances := sm.Balances(); !maps.Equal(balances, map[string]int{"a": 100, "b": 50, "c": 0}) {
+		t.Errorf("Balances() after Rollback = %v; want the balances before settling", balances)
+	}
+}
+
+func TestSettleAtomic(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name        string
+		obligations []Obligation
+		expectedErr error
+	}{
+		{"Insufficient balance", []Obligation{{"a", "c", 50}, {"b", "c", 150}}, ErrInsufficientBalance},
+		{"Unknown account", []Obligation{{"a", "c", 50}, {"a", "nobody", 10}}, ErrInvalidAccount},
+		{"Above the approval threshold", []Obligation{{"a", "c", 100}, {"a", "c", 100}}, ErrApprovalRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"a": 200, "b": 100, "c": 0}}
+			sm.RequireApproval(150, time.Hour)
+			if _, err := sm.Settle(context.Background(), tt.obligations); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Settle() error = %v; want %v", err, tt.expectedErr)
+			}
+			if balances := sm.Balances(); !maps.Equal(balances, map[string]int{"a": 200, "b": 100, "c": 0}) {
+				t.Errorf("Balances() = %v; want nothing settled", balances)
+			}
+		})
+	}
+}
+
+func TestServerSettle(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"a": 100, "b": 0, "c": 0})
+	do := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return rec
+	}
+	body := `{"obligations": [{"from": "a", "to": "b", "amount": 100}, {"from": "b", "to": "c", "amount": 60}]}`
+
+	tests := []struct {
+		name              string
+		path, body        string
+		expectedStatus    int
+		expectedTransfers int
+	}{
+		{"Dry run", "/settlements?dry_run=true", body, http.StatusOK, 2},
+		{"Settle", "/settlements", body, http.StatusOK, 2},
+		{"Insufficient balance", "/settlements", body, http.StatusConflict, 0},
+		{"Negative amount", "/settlements", `{"obligations": [{"from": "a", "to": "b", "amount": -1}]}`, http.StatusBadRequest, 0},
+		{"Same account", "/settlements", `{"obligations": [{"from": "a", "to": "a", "amount": 1}]}`, http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(tt.path, tt.body)
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("POST %s = %d; want %d (%s)", tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if tt.expectedTransfers == 0 {
+				return
+			}
+			var resp struct {
+				Transfers []Operation `json:"transfers"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Transfers) != tt.expectedTransfers {
+				t.Errorf("Transfers = %+v; want %d", resp.Transfers, tt.expectedTransfers)
+			}
+		})
+	}
+
+	if balances := sm.Balances(); !maps.Equal(balances, map[string]int{"a": 0, "b": 40, "c": 60}) {
+		t.Errorf("Balances() = %v; want the obligations settled once", balances)
+	}
+}
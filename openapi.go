@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// APIVersion prefixes the path of every API route, e.g. /v1/transfers. A
+// change breaking clients is made under a new version, the previous one
+// being served until they moved on.
+const APIVersion = "v1"
+
+// route is an API route, see Server.routes.
+type route struct {
+	method  string
+	path    string // within the namespace
+	handler apiHandler
+	summary string
+
+	rootOnly bool     // not served for tenants
+	query    []string // query parameters
+
+	request      any    // the body, nil if none
+	requestType  string // its content type, application/json if empty
+	response     any    // the body of a success, nil if none
+	responseType string // its content type, application/json if empty
+	status       int    // of a success, 200 if 0
+}
+
+// prefixes returns the path prefixes the route is served under.
+func (rt route) prefixes() []string {
+	if rt.rootOnly {
+		return []string{""}
+	}
+	return []string{"", "/tenants/{tenant}"}
+}
+
+// patterns returns the ServeMux patterns of the route, versioned and not.
+func (rt route) patterns() []string {
+	var patterns []string
+	for _, version := range []string{"/" + APIVersion, ""} {
+		for _, prefix := range rt.prefixes() {
+			patterns = append(patterns, rt.method+" "+version+prefix+rt.path)
+		}
+	}
+	return patterns
+}
+
+// handleOpenAPI serves the OpenAPI document of the API.
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, openAPIDocument())
+}
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// openAPIDocument returns the OpenAPI 3.0 document of the versioned API,
+// generated from Server.routes: clients in other languages can be generated
+// from it. Body schemas are derived from the Go types of the bodies, as
+// encoding/json encodes them.
+func openAPIDocument() map[string]any {
+	schemas := openAPISchemas{}
+	paths := map[string]map[string]any{}
+	for _, rt := range (&Server{}).routes() {
+		for _, prefix := range rt.prefixes() {
+			path := "/" + APIVersion + prefix + rt.path
+			if paths[path] == nil {
+				paths[path] = map[string]any{}
+			}
+			paths[path][strings.ToLower(rt.method)] = schemas.operation(rt, path)
+		}
+	}
+	schemas["Error"] = map[string]any{
+		"type":       "object",
+		"properties": map[string]any{"error": map[string]any{"type": "string"}},
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "vaultflow",
+			"version": APIVersion,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": schemas,
+			"securitySchemes": map[string]any{
+				"apiKey":     map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"bearerAuth": map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+		// Authentication is optional, see auth in the config.
+		"security": []any{map[string]any{"apiKey": []string{}}, map[string]any{"bearerAuth": []string{}}, map[string]any{}},
+	}
+}
+
+// operation returns the OpenAPI operation of rt served at path.
+func (schemas openAPISchemas) operation(rt route, path string) map[string]any {
+	var parameters []any
+	for _, match := range pathParam.FindAllStringSubmatch(path, -1) {
+		parameters = append(parameters, map[string]any{
+			"name": match[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"},
+		})
+	}
+	for _, name := range rt.query {
+		parameters = append(parameters, map[string]any{
+			"name": name, "in": "query", "schema": map[string]any{"type": "string"},
+		})
+	}
+
+	status := rt.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := map[string]any{"description": http.StatusText(status)}
+	if rt.response != nil || rt.responseType != "" {
+		success["content"] = schemas.content(rt.response, rt.responseType)
+	}
+	op := map[string]any{
+		"operationId": operationID(rt.method, path),
+		"summary":     rt.summary,
+		"responses": map[string]any{
+			fmt.Sprint(status): success,
+			"default": map[string]any{
+				"description": "Error",
+				"content":     schemas.content(map[string]string{}, "application/json", "Error"),
+			},
+		},
+	}
+	if parameters != nil {
+		op["parameters"] = parameters
+	}
+	if rt.request != nil {
+		op["requestBody"] = map[string]any{"required": true, "content": schemas.content(rt.request, rt.requestType)}
+	}
+	return op
+}
+
+// content returns the media type map of a body of contentType, of the
+// schema of v or, if given, of a named schema.
+func (schemas openAPISchemas) content(v any, contentType string, ref ...string) map[string]any {
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	schema := map[string]any{}
+	switch {
+	case len(ref) > 0:
+		schema = map[string]any{"$ref": "#/components/schemas/" + ref[0]}
+	case v != nil:
+		schema = schemas.of(reflect.TypeOf(v))
+	}
+	return map[string]any{contentType: map[string]any{"schema": schema}}
+}
+
+// operationID names the operation at path, e.g. postV1TransfersTo for
+// POST /v1/transfers/{to}.
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, word := range strings.FieldsFunc(path, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+		id += strings.ToUpper(word[:1]) + word[1:]
+	}
+	return id
+}
+
+// openAPISchemas holds the named schemas of the document, by name.
+type openAPISchemas map[string]any
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	durationType  = reflect.TypeOf(time.Duration(0))
+	rawType       = reflect.TypeOf(json.RawMessage(nil))
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// of returns the schema of values of t as encoding/json encodes them. Named
+// structs are added to schemas and referenced.
+func (schemas openAPISchemas) of(t reflect.Type) map[string]any {
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return map[string]any{"type": "integer", "format": "int64", "description": "nanoseconds"}
+	case t == rawType, t.Implements(marshalerType), reflect.PointerTo(t).Implements(marshalerType):
+		return map[string]any{}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemas.of(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": schemas.of(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemas.of(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return schemas.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = map[string]any{} // placeholder for recursive types
+			schemas[name] = schemas.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{} // any value, e.g. an interface
+}
+
+// object returns the schema of a struct, with a property for each field
+// encoded, those of embedded structs included.
+func (schemas openAPISchemas) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var fields func(t reflect.Type)
+	fields = func(t reflect.Type) {
+		for i := range t.NumField() {
+			field := t.Field(i)
+			tag := field.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+				fields(field.Type)
+				continue
+			}
+			if !field.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemas.of(field.Type)
+		}
+	}
+	fields(t)
+	return map[string]any{"type": "object", "properties": properties}
+}
+
+// schemaName names the schema of a named type, exported, e.g.
+// TransferRequest for transferRequest.
+func schemaName(t reflect.Type) string {
+	name := t.Name()
+	return strings.ToUpper(name[:1]) + name[1:]
+}
+
+// runOpenAPI implements "vaultflow openapi": it prints the OpenAPI document,
+// to generate clients from without a running instance.
+func runOpenAPI(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("usage: vaultflow openapi > openapi.json")
+	}
+	data, err := json.MarshalIndent(openAPIDocument(), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
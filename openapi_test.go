@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIDocument(t *testing.T) {
+	data, err := json.Marshal(openAPIDocument())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths      map[string]map[string]struct{ OperationID string }
+		Components struct{ Schemas map[string]json.RawMessage }
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every route is documented, under each of its prefixes.
+	ids := map[string]bool{}
+	for _, rt := range (&Server{}).routes() {
+		for _, prefix := range rt.prefixes() {
+			path := "/v1" + prefix + rt.path
+			op, ok := doc.Paths[path][strings.ToLower(rt.method)]
+			if !ok {
+				t.Errorf("%s %s is not documented", rt.method, path)
+				continue
+			}
+			if ids[op.OperationID] {
+				t.Errorf("%s %s has the operation ID %s of another", rt.method, path, op.OperationID)
+			}
+			ids[op.OperationID] = true
+		}
+	}
+
+	// Every referenced schema is defined.
+	for _, ref := range regexp.MustCompile(`"#/components/schemas/(\w+)"`).FindAllStringSubmatch(string(data), -1) {
+		if _, ok := doc.Components.Schemas[ref[1]]; !ok {
+			t.Errorf("schema %s is referenced but not defined", ref[1])
+		}
+	}
+
+	var transfer struct{ Properties map[string]map[string]any }
+	if err := json.Unmarshal(doc.Components.Schemas["TransferRequest"], &transfer); err != nil {
+		t.Fatal(err)
+	}
+	for property, typ := range map[string]string{"from": "string", "to": "string", "amount": "integer", "metadata": "object"} {
+		if transfer.Properties[property]["type"] != typ {
+			t.Errorf("TransferRequest.%s = %v; want a %s", property, transfer.Properties[property], typ)
+		}
+	}
+}
+
+func TestServerVersionedRoutes(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 100})
+	if _, err := sm.CreateTenant("acme", map[string]int{"acc1": 5}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method         string
+		path           string
+		expectedStatus int
+	}{
+		{http.MethodPost, "/v1/accounts/acc1/deposit", http.StatusOK},
+		{http.MethodPost, "/accounts/acc1/deposit", http.StatusOK},
+		{http.MethodPost, "/v1/tenants/acme/accounts/acc1/deposit", http.StatusOK},
+		{http.MethodGet, "/v1/backup", http.StatusOK},
+		{http.MethodGet, "/v1/tenants/acme/backup", http.StatusNotFound},
+		{http.MethodGet, "/v2/accounts/acc1", http.StatusNotFound},
+		{http.MethodGet, "/v1/openapi.json", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{"amount": 1}`)))
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+
+	if balance, _ := sm.Balance("acc1"); balance != 102 {
+		t.Errorf("Balance(acc1) = %d; want 102", balance)
+	}
+}
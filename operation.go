@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+)
+
+var ErrInvalidOperation = errors.New("invalid operation")
+
+type OperationType string
+
+const (
+	OpDeposit  OperationType = "deposit"
+	OpWithdraw OperationType = "withdraw"
+	OpTransfer OperationType = "transfer"
+	OpRollback OperationType = "rollback"
+
+	// OpOpen opens the account To with a balance of Amount.
+	OpOpen OperationType = "open"
+
+	// OpRollbackTo rolls back to the state at Version.
+	OpRollbackTo OperationType = "rollback_to"
+
+	// OpMove moves Amount from the bucket FromBucket of the account From to
+	// its bucket ToBucket.
+	OpMove OperationType = "move"
+
+	// OpArchive archives the account From and OpUnarchive restores the
+	// archived account To, see ArchiveAccount.
+	OpArchive   OperationType = "archive"
+	OpUnarchive OperationType = "unarchive"
+
+	// OpSetStatus changes the status of the account To to Status, see
+	// SetAccountStatus.
+	OpSetStatus OperationType = "set_status"
+)
+
+// Operation describes a mutation of the state machine. Deposits credit To,
+// withdrawals debit From and transfers do both, in the buckets FromBucket
+// and ToBucket, BucketAvailable if empty. Opening an account creates
+// To, with the given Status, StatusActive if empty. Every mutation goes through
+// an Operation, and operations encode to JSON, so they can be queued,
+// replayed or shipped elsewhere and applied with Apply.
+//
+// ID, Version and Time are set once the operation has been executed: ID is
+// a ULID, unique and sorting in the order operations were applied, that
+// follows the operation into history, hooks, events and the outbox, and
+// Version is the state version the operation produced. Reverses is the ID of the
+// operation a compensating operation reverses. IfVersion, if set on a
+// rollback, is the version it expects the state to be at, see
+// RollbackIfVersion, and Epoch, if set, the epoch the operation was made for,
+// see Epoch. MessageID identifies the
+// message an operation was consumed from, see ErrDuplicateMessage, and
+// CorrelationID the request that caused it, see WithCorrelationID. Memo and
+// Metadata are free to the caller, e.g. an invoice number or the ID of the
+// transaction in another system; they are kept in history with the
+// operation and can be searched with OperationsWithMetadata. Category, e.g.
+// "groceries" or "salary", files a deposit, withdrawal or transfer for
+// budgeting; it is set by the caller or by a Classify hook, and its
+// operations are summed by category in Stats.
+type Operation struct {
+	ID        string        `json:"id,omitempty"`
+	Type      OperationType `json:"type"`
+	From      string        `json:"from,omitempty"`
+	To        string        `json:"to,omitempty"`
+	Amount    int           `json:"amount,omitempty"`
+	Version   int           `json:"version,omitempty"`
+	Time      time.Time     `json:"time"`
+	Reverses  string        `json:"reverses,omitempty"`
+	IfVersion int           `json:"if_version,omitempty"`
+	Epoch     string        `json:"epoch,omitempty"`
+	MessageID string        `json:"message_id,omitempty"`
+
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	FromBucket string `json:"from_bucket,omitempty"`
+	ToBucket   string `json:"to_bucket,omitempty"`
+
+	Status AccountStatus `json:"status,omitempty"`
+
+	Memo     string            `json:"memo,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Category string            `json:"category,omitempty"`
+}
+
+// Bounds of the memo and metadata of an operation.
+const (
+	maxMemoLength     = 256
+	maxMetadataKeys   = 16
+	maxMetadataLength = 256 // of each key and value, and of the category
+)
+
+// Validate checks that op has the fields its type needs.
+func (op Operation) Validate() error {
+	if err := op.validateMetadata(); err != nil {
+		return err
+	}
+	if err := op.validateBuckets(); err != nil {
+		return err
+	}
+
+	switch op.Type {
+	case OpDeposit:
+		if op.To == "" {
+			return fmt.Errorf("%w: %s needs an account to deposit to", ErrInvalidOperation, op.Type)
+		}
+	case OpOpen:
+		if op.To == "" {
+			return fmt.Errorf("%w: %s needs an account to open", ErrInvalidOperation, op.Type)
+		}
+		if op.Status != "" && op.Status != StatusPending && op.Status != StatusActive {
+			return fmt.Errorf("%w: accounts are opened %s or %s, not %q", ErrInvalidStatus, StatusPending, StatusActive, op.Status)
+		}
+	case OpWithdraw:
+		if op.From == "" {
+			return fmt.Errorf("%w: %s needs an account to withdraw from", ErrInvalidOperation, op.Type)
+		}
+	case OpTransfer:
+		if op.From == "" || op.To == "" {
+			return fmt.Errorf("%w: %s needs accounts to transfer from and to", ErrInvalidOperation, op.Type)
+		}
+	case OpMove:
+		if op.From == "" || bucketName(op.FromBucket) == bucketName(op.ToBucket) {
+			return fmt.Errorf("%w: %s needs an account and two different buckets", ErrInvalidOperation, op.Type)
+		}
+	case OpArchive:
+		if op.From == "" || op.To != "" {
+			return fmt.Errorf("%w: %s needs just the account to archive", ErrInvalidOperation, op.Type)
+		}
+	case OpUnarchive:
+		if op.To == "" || op.From != "" {
+			return fmt.Errorf("%w: %s needs just the account to restore", ErrInvalidOperation, op.Type)
+		}
+	case OpSetStatus:
+		if op.To == "" || op.From != "" {
+			return fmt.Errorf("%w: %s needs just the account to change", ErrInvalidOperation, op.Type)
+		}
+		if !op.Status.valid() {
+			return fmt.Errorf("%w (%q)", ErrInvalidStatus, op.Status)
+		}
+	case OpRollback:
+		return nil
+	case OpRollbackTo:
+		if op.Version < 0 {
+			return fmt.Errorf("%w: negative version %d", ErrInvalidOperation, op.Version)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidOperation, op.Type)
+	}
+
+	if op.Amount < 0 {
+		return fmt.Errorf("%w: negative amount %d", ErrInvalidOperation, op.Amount)
+	}
+	return nil
+}
+
+// validateBuckets checks the accounts and buckets of op are well-formed.
+func (op Operation) validateBuckets() error {
+	for _, id := range op.accounts() {
+		if err := validateAccountId(id); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidOperation, err)
+		}
+	}
+	if err := validateBucket(op.FromBucket); err != nil {
+		return err
+	}
+	return validateBucket(op.ToBucket)
+}
+
+// validateMetadata checks the memo, metadata and category of op are within
+// bounds.
+func (op Operation) validateMetadata() error {
+	if len(op.Memo) > maxMemoLength {
+		return fmt.Errorf("%w: memo longer than %d bytes", ErrInvalidOperation, maxMemoLength)
+	}
+	if len(op.Category) > maxMetadataLength {
+		return fmt.Errorf("%w: category longer than %d bytes", ErrInvalidOperation, maxMetadataLength)
+	}
+	if len(op.Metadata) > maxMetadataKeys {
+		return fmt.Errorf("%w: more than %d metadata keys", ErrInvalidOperation, maxMetadataKeys)
+	}
+	for key, value := range op.Metadata {
+		if key == "" || len(key) > maxMetadataLength || len(value) > maxMetadataLength {
+			return fmt.Errorf("%w: metadata key %q must be 1 to %d bytes, and its value at most %d", ErrInvalidOperation, key, maxMetadataLength, maxMetadataLength)
+		}
+	}
+	return nil
+}
+
+// Apply executes op as the matching method would, e.g. an OpTransfer as
+// Transfer, and returns it with its ID, Version and Time set. Any ID,
+// Version or Time op already has is replaced, except the Version of an
+// OpRollbackTo.
+func (sm *StateMachine) Apply(op Operation) (Operation, error) {
+	return sm.ApplyContext(context.Background(), op)
+}
+
+// ApplyContext is like Apply but gives up without applying anything if ctx
+// is done before the operation starts.
+func (sm *StateMachine) ApplyContext(ctx context.Context, op Operation) (Operation, error) {
+	if err := op.Validate(); err != nil {
+		return op, err
+	}
+	op.ID, op.Time = "", time.Time{}
+	op.Metadata = maps.Clone(op.Metadata) // history must not change with the caller's map
+	if op.Type != OpRollbackTo {
+		op.Version = 0
+	}
+
+	if op.Type == OpTransfer {
+		if err := sm.parkTransfer(ctx, op.From, op.To, op.Amount); err != nil {
+			return op, err
+		}
+	}
+	return sm.execute(ctx, op)
+}
+
+// accounts returns the ids of the accounts the operation touches.
+func (op Operation) accounts() []string {
+	var ids []string
+	if op.From != "" {
+		ids = append(ids, op.From)
+	}
+	if op.To != "" {
+		ids = append(ids, op.To)
+	}
+	return ids
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestOperationValidate(t *testing.T) {
+	tests := []struct {
+		name        string
+		op          Operation
+		expectedErr error
+	}{
+		{name: "Deposit", op: Operation{Type: OpDeposit, To: "acc1", Amount: 1}},
+		{name: "Withdraw", op: Operation{Type: OpWithdraw, From: "acc1", Amount: 1}},
+		{name: "Transfer", op: Operation{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 1}},
+		{name: "Rollback", op: Operation{Type: OpRollback}},
+		{name: "Deposit without account", op: Operation{Type: OpDeposit, From: "acc1", Amount: 1}, expectedErr: ErrInvalidOperation},
+		{name: "Transfer without destination", op: Operation{Type: OpTransfer, From: "acc1", Amount: 1}, expectedErr: ErrInvalidOperation},
+		{name: "Negative amount", op: Operation{Type: OpWithdraw, From: "acc1", Amount: -1}, expectedErr: ErrInvalidOperation},
+		{name: "Unknown type", op: Operation{Type: "mint", To: "acc1"}, expectedErr: ErrInvalidOperation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.op.Validate(); !errors.Is(err, tt.expectedErr) {
+				t.Errorf("Validate(%+v) = %v; want %v", tt.op, err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestStateMachineApplyReplay(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000, "acc2": 500},
+	}
+	replica := &StateMachine{
+		accounts: map[string]int{"acc1": 1000, "acc2": 500},
+	}
+
+	if err := sm.Deposit("acc1", 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Transfer("acc1", "acc2", 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Withdraw("acc2", 50); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(sm.Operations())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []Operation
+	if err := json.Unmarshal(data, &ops); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, op := range ops {
+		applied, err := replica.Apply(op)
+		if err != nil {
+			t.Fatalf("Apply(%+v) failed: %v", op, err)
+		}
+		if applied.ID == "" || applied.Time.IsZero() || applied.Version != op.Version {
+			t.Errorf("Apply(%+v) = %+v; want an ID, time and version %d", op, applied, op.Version)
+		}
+	}
+
+	for acc, expectedBalance := range sm.accounts {
+		if replica.accounts[acc] != expectedBalance {
+			t.Errorf("Replica account %s balance = %d; want %d", acc, replica.accounts[acc], expectedBalance)
+		}
+	}
+
+	if _, err := replica.Apply(Operation{Type: "mint", To: "acc1", Amount: 1}); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Apply of unknown type = %v; want %v", err, ErrInvalidOperation)
+	}
+}
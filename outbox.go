@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+)
+
+var (
+	ErrOutboxDisabled = errors.New("outbox is not enabled")
+	ErrEventsPruned   = errors.New("events no longer in the outbox")
+)
+
+// OutboxEntry is an event waiting in the outbox to be published. Seq
+// numbers entries in the order they were recorded; a publisher may see an
+// entry more than once and should deduplicate by Seq.
+type OutboxEntry struct {
+	Seq   uint64 `json:"seq"`
+	Event Event  `json:"event"`
+}
+
+// Publisher delivers outbox entries downstream, e.g. to a message broker or
+// a webhook. It returns nil only once every entry has been delivered.
+type Publisher interface {
+	Publish(ctx context.Context, entries []OutboxEntry) error
+}
+
+// PublisherFunc adapts a function to a Publisher.
+type PublisherFunc func(ctx context.Context, entries []OutboxEntry) error
+
+func (f PublisherFunc) Publish(ctx context.Context, entries []OutboxEntry) error {
+	return f(ctx, entries)
+}
+
+// outbox holds the events of applied operations until they are published,
+// by RelayOutbox, and consumed, by every consumer polling it. It is guarded
+// by the state lock, so events are recorded atomically with the state
+// changes they report.
+type outbox struct {
+	enabled  bool
+	entries  []OutboxEntry
+	lastSeq  uint64
+	notify   chan struct{}     // signalled when an entry is added
+	relaying bool              // RelayOutbox runs
+	relayed  uint64            // Seq of the last entry it published
+	offsets  map[string]uint64 // Seq of the last entry each consumer processed
+
+	rolledBack map[string]int // balances before the rollback being applied, see keepImages
+}
+
+func (o *outbox) add(event Event) {
+	o.lastSeq++
+	o.entries = append(o.entries, OutboxEntry{Seq: o.lastSeq, Event: event})
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// EnableOutbox records the event of every later operation in an outbox
+// until RelayOutbox publishes it. The outbox is written under the same lock
+// as the state change, and WriteSnapshot persists it with the balances, so
+// events of operations in a snapshot are never lost: after a crash,
+// ReadSnapshot restores those not yet published.
+func (sm *StateMachine) EnableOutbox() {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.outbox.enabled = true
+	if sm.outbox.notify == nil {
+		sm.outbox.notify = make(chan struct{}, 1)
+	}
+}
+
+// OutboxEntries returns the entries not published yet, oldest first.
+func (sm *StateMachine) OutboxEntries() []OutboxEntry {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return append([]OutboxEntry(nil), sm.outbox.entries...)
+}
+
+// after returns up to limit entries after seq, oldest first.
+func (o *outbox) after(seq uint64, limit int) []OutboxEntry {
+	i, _ := slices.BinarySearchFunc(o.entries, seq+1, func(e OutboxEntry, seq uint64) int {
+		return cmp.Compare(e.Seq, seq)
+	})
+	return slices.Clone(o.entries[i:min(i+limit, len(o.entries))])
+}
+
+// pruned returns the Seq of the last entry removed.
+func (o *outbox) pruned() uint64 {
+	if len(o.entries) == 0 {
+		return o.lastSeq
+	}
+	return o.entries[0].Seq - 1
+}
+
+// trim removes the entries RelayOutbox, if it runs, and every consumer are
+// past. Entries are kept while neither consumes them.
+func (o *outbox) trim() {
+	if !o.relaying && len(o.offsets) == 0 {
+		return
+	}
+	floor := o.lastSeq
+	if o.relaying {
+		floor = o.relayed
+	}
+	for _, seq := range o.offsets {
+		floor = min(floor, seq)
+	}
+	i := 0
+	for i < len(o.entries) && o.entries[i].Seq <= floor {
+		i++
+	}
+	o.entries = append(o.entries[:0], o.entries[i:]...)
+}
+
+// ackOutbox removes the entries up to seq once they are published, unless
+// a consumer has yet to process them.
+func (sm *StateMachine) ackOutbox(seq uint64) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.outbox.relayed = seq
+	sm.outbox.trim()
+}
+
+// Events returns up to limit entries of the outbox after the one numbered
+// after, oldest first, defaultPageSize if limit is 0, for consumers polling
+// it rather than being published to. Entries are numbered by Seq rather
+// than by the version of their event, as rollbacks take versions back.
+// A consumer polls after the Seq of the last entry it processed, recorded
+// with CommitOffset, so after a crash it polls again the entries it had
+// not committed, and should deduplicate them by Seq. It fails with
+// ErrEventsPruned if entries after after were removed already, or if after
+// is past the last entry, as entries it had seen were lost since.
+func (sm *StateMachine) Events(after uint64, limit int) ([]OutboxEntry, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if !sm.outbox.enabled {
+		return nil, ErrOutboxDisabled
+	}
+	if pruned := sm.outbox.pruned(); after < pruned {
+		return nil, fmt.Errorf("%w: polled after %d, removed up to %d", ErrEventsPruned, after, pruned)
+	}
+	if after > sm.outbox.lastSeq {
+		return nil, fmt.Errorf("%w: polled after %d, past the last event %d", ErrEventsPruned, after, sm.outbox.lastSeq)
+	}
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	return sm.outbox.after(after, min(limit, maxPageSize)), nil
+}
+
+// CommitOffset records that consumer processed the entries of the outbox
+// up to seq, registering it on its first commit. Entries are kept until
+// every consumer, and RelayOutbox if it runs, is past them. A consumer's
+// offset never moves back. Offsets are persisted with the outbox by
+// snapshots, backups and checkpoints.
+func (sm *StateMachine) CommitOffset(consumer string, seq uint64) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	o := &sm.outbox
+	if !o.enabled {
+		return ErrOutboxDisabled
+	}
+	if consumer == "" || seq > o.lastSeq {
+		return fmt.Errorf("%w: offset %d of consumer %q, the last event is %d", ErrInvalidOperation, seq, consumer, o.lastSeq)
+	}
+	current, ok := o.offsets[consumer]
+	if !ok && seq < o.pruned() {
+		return fmt.Errorf("%w: consumer %s registering at %d, removed up to %d", ErrEventsPruned, consumer, seq, o.pruned())
+	}
+	if o.offsets == nil {
+		o.offsets = map[string]uint64{}
+	}
+	o.offsets[consumer] = max(current, seq)
+	o.trim()
+	return nil
+}
+
+// Offsets returns the offset of each consumer of the outbox.
+func (sm *StateMachine) Offsets() map[string]uint64 {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return maps.Clone(sm.outbox.offsets)
+}
+
+// RemoveConsumer stops keeping the entries of the outbox consumer has yet
+// to process.
+func (sm *StateMachine) RemoveConsumer(consumer string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	delete(sm.outbox.offsets, consumer)
+	sm.outbox.trim()
+}
+
+// RelayOutbox publishes the outbox with pub until ctx is done, in batches of
+// up to batchSize entries (defaultPageSize if 0), in order. A batch that
+// fails to publish is retried after the delays of retry, waiting its
+// longest delay between attempts once its MaxAttempts are spent but never
+// giving up, so entries are delivered at least once. Only one relayer
+// should run per state machine.
+func (sm *StateMachine) RelayOutbox(ctx context.Context, pub Publisher, batchSize int, retry RetryPolicy) {
+	sm.mu.Lock()
+	notify := sm.outbox.notify
+	sm.mu.Unlock()
+	if notify == nil {
+		return // the outbox is not enabled
+	}
+
+	if batchSize <= 0 {
+		batchSize = defaultPageSize
+	}
+
+	sm.mu.Lock()
+	sm.outbox.relaying = true
+	sm.outbox.relayed = sm.outbox.pruned()
+	sm.mu.Unlock()
+
+	failures := 0
+	for {
+		sm.mu.Lock()
+		batch := sm.outbox.after(sm.outbox.relayed, batchSize)
+		sm.mu.Unlock()
+
+		if len(batch) == 0 {
+			select {
+			case <-notify:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err := pub.Publish(ctx, batch); err != nil {
+			fmt.Println("Outbox Error:", err)
+			failures++
+			select {
+			case <-time.After(retry.Delay(min(failures, max(retry.MaxAttempts-1, 1)))):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		failures = 0
+		sm.ackOutbox(batch[len(batch)-1].Seq)
+	}
+}
+
+// WebhookPublisher publishes outbox entries by POSTing them as a
+// {"entries": [...]} body to a URL, encoded with Codec, JSON if nil. Any
+// status other than 2xx fails the batch. Deliveries failing with a 5xx status, 408, 429 or a network error
+// are retried with Retry, attempted once if zero.
+type WebhookPublisher struct {
+	URL    string
+	Client *http.Client // http.DefaultClient if nil
+	Retry  RetryPolicy
+	Codec  Codec
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, entries []OutboxEntry) error {
+	codec := p.Codec
+	if codec == nil {
+		codec = JSONCodec
+	}
+	body, err := codec.Encode(map[string][]OutboxEntry{"entries": entries})
+	if err != nil {
+		return err
+	}
+	return p.Retry.Do(ctx, func(ctx context.Context) error {
+		return p.deliver(ctx, codec.ContentType(), body)
+	})
+}
+
+func (p *WebhookPublisher) deliver(ctx context.Context, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return statusError(resp.StatusCode, fmt.Errorf("webhook %s answered %s", p.URL, resp.Status))
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func outboxSeqs(entries []OutboxEntry) []uint64 {
+	seqs := make([]uint64, len(entries))
+	for i, entry := range entries {
+		seqs[i] = entry.Seq
+	}
+	return seqs
+}
+
+func TestOutbox(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 500}}
+	_ = sm.Deposit("acc1", 1) // before the outbox is enabled
+	sm.EnableOutbox()
+
+	_ = sm.Transfer("acc1", "acc2", 100)
+	_ = sm.Withdraw("acc2", 5000) // fails, so has no event
+	_ = sm.Tx(func(tx *Tx) error {
+		_ = tx.Deposit("acc1", 10)
+		return tx.Deposit("acc2", 20)
+	})
+	_ = sm.Rollback()
+
+	entries := sm.OutboxEntries()
+	var types []OperationType
+	for _, entry := range entries {
+		types = append(types, entry.Event.Operation.Type)
+	}
+	if expected := []OperationType{OpTransfer, OpDeposit, OpDeposit, OpRollback}; !slices.Equal(types, expected) {
+		t.Fatalf("Outbox = %v; want %v", types, expected)
+	}
+	if !slices.Equal(outboxSeqs(entries), []uint64{1, 2, 3, 4}) {
+		t.Errorf("Outbox seqs = %v; want 1 to 4", outboxSeqs(entries))
+	}
+	if balances := entries[0].Event.Balances; balances["acc1"] != 901 || balances["acc2"] != 600 {
+		t.Errorf("Transfer event balances = %v; want acc1 901 and acc2 600", balances)
+	}
+	if balances := entries[3].Event.Balances; len(balances) != 2 || balances["acc1"] != 901 {
+		t.Errorf("Rollback event balances = %v; want every account", balances)
+	}
+}
+
+// recordingPublisher fails the first failures batches, then records the
+// entries it publishes.
+type recordingPublisher struct {
+	mu        sync.Mutex
+	failures  int
+	published []OutboxEntry
+}
+
+func (p *recordingPublisher) Publish(ctx context.Context, entries []OutboxEntry) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, entries...)
+	return nil
+}
+
+// waitPublished waits until pub has published n entries.
+func (p *recordingPublisher) waitPublished(t *testing.T, n int) []OutboxEntry {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		published := slices.Clone(p.published)
+		p.mu.Unlock()
+		if len(published) >= n {
+			return published
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Published fewer than %d entries", n)
+	return nil
+}
+
+func TestRelayOutbox(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000}}
+	sm.EnableOutbox()
+	for range 5 {
+		_ = sm.Deposit("acc1", 1)
+	}
+
+	pub := &recordingPublisher{failures: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	relayed := make(chan struct{})
+	go func() {
+		sm.RelayOutbox(ctx, pub, 2, RetryPolicy{Backoff: time.Millisecond})
+		close(relayed)
+	}()
+
+	pub.waitPublished(t, 5)
+	_ = sm.Deposit("acc1", 1) // wakes the relayer
+	published := pub.waitPublished(t, 6)
+
+	cancel()
+	<-relayed
+
+	if !slices.Equal(outboxSeqs(published), []uint64{1, 2, 3, 4, 5, 6}) {
+		t.Errorf("Published %v; want 1 to 6 in order", outboxSeqs(published))
+	}
+	if pending := sm.OutboxEntries(); len(pending) != 0 {
+		t.Errorf("Outbox holds %v after publishing; want none", outboxSeqs(pending))
+	}
+}
+
+func TestPollOutbox(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000}}
+	if _, err := sm.Events(0, 10); !errors.Is(err, ErrOutboxDisabled) {
+		t.Errorf("Events() without outbox error = %v; want %v", err, ErrOutboxDisabled)
+	}
+	sm.EnableOutbox()
+	for range 5 {
+		_ = sm.Deposit("acc1", 1)
+	}
+
+	// Two consumers poll at their pace; entries are kept until both are
+	// past them.
+	steps := []struct {
+		name     string
+		consumer string
+		commit   uint64
+		wantErr  error
+		kept     []uint64 // entries left in the outbox
+	}{
+		{"First consumer", "audit", 1, nil, []uint64{2, 3, 4, 5}},
+		{"Second consumer ahead", "ledger", 2, nil, []uint64{2, 3, 4, 5}},
+		{"Offset moving back", "ledger", 1, nil, []uint64{2, 3, 4, 5}},
+		{"Slowest consumer catching up", "audit", 4, nil, []uint64{3, 4, 5}},
+		{"Past the last event", "ledger", 6, ErrInvalidOperation, []uint64{3, 4, 5}},
+		{"New consumer behind", "late", 1, ErrEventsPruned, []uint64{3, 4, 5}},
+	}
+	for _, step := range steps {
+		if err := sm.CommitOffset(step.consumer, step.commit); !errors.Is(err, step.wantErr) {
+			t.Fatalf("%s: CommitOffset() error = %v; want %v", step.name, err, step.wantErr)
+		}
+		if kept := outboxSeqs(sm.OutboxEntries()); !slices.Equal(kept, step.kept) {
+			t.Errorf("%s: outbox holds %v; want %v", step.name, kept, step.kept)
+		}
+	}
+	if offsets := sm.Offsets(); offsets["ledger"] != 2 || offsets["audit"] != 4 {
+		t.Errorf("Offsets() = %v; want ledger at 2 and audit at 4", offsets)
+	}
+
+	// A consumer that crashed before committing polls the same entries again.
+	for range 2 {
+		entries, err := sm.Events(sm.Offsets()["ledger"], 2)
+		if err != nil || !slices.Equal(outboxSeqs(entries), []uint64{3, 4}) {
+			t.Errorf("Events(2, 2) = %v, %v; want 3 and 4", outboxSeqs(entries), err)
+		}
+	}
+	if _, err := sm.Events(1, 10); !errors.Is(err, ErrEventsPruned) {
+		t.Errorf("Events(1) error = %v; want %v", err, ErrEventsPruned)
+	}
+	if _, err := sm.Events(6, 10); !errors.Is(err, ErrEventsPruned) {
+		t.Errorf("Events(6) past the last event error = %v; want %v", err, ErrEventsPruned)
+	}
+
+	sm.RemoveConsumer("ledger")
+	if kept := outboxSeqs(sm.OutboxEntries()); !slices.Equal(kept, []uint64{5}) {
+		t.Errorf("Outbox holds %v once ledger is removed; want 5", kept)
+	}
+}
+
+func TestRelayOutboxWithConsumers(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000}}
+	sm.EnableOutbox()
+	for range 3 {
+		_ = sm.Deposit("acc1", 1)
+	}
+	_ = sm.CommitOffset("ledger", 1)
+
+	pub := &recordingPublisher{}
+	ctx, cancel := context.WithCancel(context.Background())
+	relayed := make(chan struct{})
+	go func() {
+		sm.RelayOutbox(ctx, pub, 10, RetryPolicy{Backoff: time.Millisecond})
+		close(relayed)
+	}()
+	published := pub.waitPublished(t, 2)
+	cancel()
+	<-relayed
+
+	// Published entries the consumer has yet to process stay.
+	if !slices.Equal(outboxSeqs(published), []uint64{2, 3}) {
+		t.Errorf("Published %v; want 2 and 3", outboxSeqs(published))
+	}
+	if kept := outboxSeqs(sm.OutboxEntries()); !slices.Equal(kept, []uint64{2, 3}) {
+		t.Errorf("Outbox holds %v; want 2 and 3 for ledger", kept)
+	}
+	_ = sm.CommitOffset("ledger", 3)
+	if kept := sm.OutboxEntries(); len(kept) != 0 {
+		t.Errorf("Outbox holds %v; want none", outboxSeqs(kept))
+	}
+}
+
+func TestServerOutbox(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 100})
+	sm.EnableOutbox()
+	for range 3 {
+		_ = sm.Deposit("acc1", 1)
+	}
+	handler := srv.Handler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/outbox/offsets/ledger", bytes.NewReader([]byte(`{"seq": 1}`))))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /outbox/offsets/ledger = %d: %s", rec.Code, rec.Body)
+	}
+
+	tests := []struct {
+		query string
+		code  int
+		want  []uint64
+	}{
+		{"?consumer=ledger", http.StatusOK, []uint64{2, 3}},
+		{"?after=2", http.StatusOK, []uint64{3}},
+		{"?consumer=ledger&limit=1", http.StatusOK, []uint64{2}},
+		{"?after=0", http.StatusGone, nil},
+		{"?after=x", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/outbox"+tt.query, nil))
+		var entries []OutboxEntry
+		if rec.Code == http.StatusOK {
+			_ = json.NewDecoder(rec.Body).Decode(&entries)
+		}
+		if rec.Code != tt.code || !slices.Equal(outboxSeqs(entries), tt.want) {
+			t.Errorf("GET /outbox%s = %d, %v; want %d, %v", tt.query, rec.Code, outboxSeqs(entries), tt.code, tt.want)
+		}
+	}
+}
+
+func TestOutboxSnapshot(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000}}
+	sm.EnableOutbox()
+	_ = sm.Deposit("acc1", 1)
+	_ = sm.Deposit("acc1", 2)
+
+	// The process crashes after the snapshot, before the relayer ran.
+	var buf bytes.Buffer
+	if err := sm.WriteSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &StateMachine{accounts: map[string]int{}}
+	restored.EnableOutbox()
+	if err := restored.ReadSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	_ = restored.Deposit("acc1", 3)
+
+	pub := &recordingPublisher{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go restored.RelayOutbox(ctx, pub, 0, RetryPolicy{Backoff: time.Millisecond})
+
+	published := pub.waitPublished(t, 3)
+	var amounts []int
+	for _, entry := range published {
+		amounts = append(amounts, entry.Event.Operation.Amount)
+	}
+	if !slices.Equal(outboxSeqs(published), []uint64{1, 2, 3}) || !slices.Equal(amounts, []int{1, 2, 3}) {
+		t.Errorf("Published seqs %v with amounts %v; want 1 to 3", outboxSeqs(published), amounts)
+	}
+}
+
+func TestOutboxRestart(t *testing.T) {
+	quiet(t)
+	dir := t.TempDir()
+	checkpoint := filepath.Join(dir, checkpointName)
+
+	sm, w := walMachine(t, filepath.Join(dir, "wal"), WALOptions{})
+	sm.EnableOutbox()
+	for range 3 {
+		_ = sm.Deposit("acc1", 1)
+	}
+	if err := sm.CommitOffset("ledger", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.WriteCheckpoint(checkpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The entry of an operation after the checkpoint comes back from the log.
+	_ = sm.Deposit("acc1", 4)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := OpenWAL(filepath.Join(dir, "wal"), WALOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	restarted := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+	restarted.EnableOutbox()
+	if _, err := restarted.RestoreCheckpoint(checkpoint, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.ReplayWAL(w); err != nil {
+		t.Fatal(err)
+	}
+
+	if offsets := restarted.Offsets(); offsets["ledger"] != 2 {
+		t.Errorf("Offsets() = %v; want ledger at 2", offsets)
+	}
+	entries, err := restarted.Events(2, 10)
+	if err != nil || !slices.Equal(outboxSeqs(entries), []uint64{3, 4}) {
+		t.Errorf("Events(2) = %v, %v; want 3 and 4", outboxSeqs(entries), err)
+	}
+	if len(entries) == 2 && entries[1].Event.Operation.Amount != 4 {
+		t.Errorf("Entry 4 = %+v; want the deposit of 4", entries[1])
+	}
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	var received []OutboxEntry
+	status := http.StatusNoContent
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Entries []OutboxEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Webhook body: %v", err)
+		}
+		received = append(received, body.Entries...)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	pub := &WebhookPublisher{URL: ts.URL}
+	entries := []OutboxEntry{{Seq: 1, Event: Event{Operation: Operation{ID: "txn-1", Type: OpDeposit}}}}
+
+	if err := pub.Publish(context.Background(), entries); err != nil {
+		t.Fatalf("Publish = %v; want nil", err)
+	}
+	if len(received) != 1 || received[0].Event.Operation.ID != "txn-1" {
+		t.Errorf("Webhook received %+v; want the entry", received)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := pub.Publish(context.Background(), entries); err == nil {
+		t.Errorf("Publish to a failing webhook = nil; want an error")
+	}
+}
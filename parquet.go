@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"time"
+)
+
+// Parquet identifiers of the format's thrift definitions.
+const (
+	parquetInt64     = 2 // physical types
+	parquetByteArray = 6
+
+	parquetRequired = 0 // repetition
+
+	parquetUTF8            = 0 // converted types
+	parquetTimestampMillis = 9
+
+	parquetPlain = 0 // encodings
+	parquetRLE   = 3
+
+	parquetDataPage = 0
+
+	parquetUncompressed = 0 // codecs
+	parquetSnappy       = 1
+	parquetGzip         = 2
+)
+
+var parquetMagic = []byte("PAR1")
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs in the thrift compact protocol, which the
+// metadata of Parquet files is written in.
+type thriftWriter struct {
+	buf  []byte
+	last []int16 // id of the last field written of each struct being written
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{last: []int16{0}}
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.buf = append(t.buf, byte(delta)<<4|typ)
+	} else {
+		t.buf = append(t.buf, typ)
+		t.buf = binary.AppendVarint(t.buf, int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.buf = binary.AppendVarint(t.buf, int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.buf = binary.AppendVarint(t.buf, v)
+}
+
+func (t *thriftWriter) string(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.appendString(s)
+}
+
+func (t *thriftWriter) appendString(s string) {
+	t.buf = binary.AppendUvarint(t.buf, uint64(len(s)))
+	t.buf = append(t.buf, s...)
+}
+
+// list starts a list field of n elements of typ, which follow it.
+func (t *thriftWriter) list(id int16, typ byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.buf = append(t.buf, byte(n)<<4|typ)
+	} else {
+		t.buf = append(t.buf, 0xf0|typ)
+		t.buf = binary.AppendUvarint(t.buf, uint64(n))
+	}
+}
+
+// begin starts a struct field, or with id 0 a struct element of a list,
+// whose fields follow until end.
+func (t *thriftWriter) begin(id int16) {
+	if id != 0 {
+		t.field(id, thriftStruct)
+	}
+	t.last = append(t.last, 0)
+}
+
+func (t *thriftWriter) end() {
+	t.buf = append(t.buf, 0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// parquetColumn is a column chunk written, for the footer.
+type parquetColumn struct {
+	offset       int64
+	uncompressed int64
+	compressed   int64
+}
+
+// writeParquet encodes table as a Parquet file of a single row group, with
+// one plain-encoded page per column, compressed with c: gzip or snappy, as
+// Parquet readers expect them, or none. Every column is required: strings
+// are UTF-8 byte arrays, integers int64 and times timestamps in
+// milliseconds.
+func writeParquet(table exportTable, c Compression) ([]byte, error) {
+	codec := int32(parquetUncompressed)
+	switch c {
+	case CompressionGzip:
+		codec = parquetGzip
+	case CompressionSnappy:
+		codec = parquetSnappy
+	}
+
+	out := bytes.Clone(parquetMagic)
+	var columns []parquetColumn
+	for i := range table.columns {
+		var values []byte
+		for _, row := range table.rows {
+			switch v := row[i].(type) {
+			case string:
+				values = binary.LittleEndian.AppendUint32(values, uint32(len(v)))
+				values = append(values, v...)
+			case int:
+				values = binary.LittleEndian.AppendUint64(values, uint64(v))
+			case time.Time:
+				values = binary.LittleEndian.AppendUint64(values, uint64(v.UnixMilli()))
+			}
+		}
+		page := values
+		switch c {
+		case CompressionGzip:
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(values); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			page = buf.Bytes()
+		case CompressionSnappy:
+			page = snappyEncode(values)
+		}
+
+		header := newThriftWriter()
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(values)))
+		header.i32(3, int32(len(page)))
+		header.begin(5)
+		header.i32(1, int32(len(table.rows)))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.end()
+		header.end()
+
+		columns = append(columns, parquetColumn{
+			offset:       int64(len(out)),
+			uncompressed: int64(len(header.buf) + len(values)),
+			compressed:   int64(len(header.buf) + len(page)),
+		})
+		out = append(out, header.buf...)
+		out = append(out, page...)
+	}
+
+	meta := newThriftWriter()
+	meta.i32(1, 1)
+	meta.list(2, thriftStruct, len(table.columns)+1)
+	meta.begin(0)
+	meta.string(4, "schema")
+	meta.i32(5, int32(len(table.columns)))
+	meta.end()
+	for _, column := range table.columns {
+		meta.begin(0)
+		meta.i32(1, column.parquetType())
+		meta.i32(3, parquetRequired)
+		meta.string(4, column.name)
+		switch column.kind {
+		case columnString:
+			meta.i32(6, parquetUTF8)
+		case columnTime:
+			meta.i32(6, parquetTimestampMillis)
+		}
+		meta.end()
+	}
+	meta.i64(3, int64(len(table.rows)))
+	if len(table.rows) == 0 {
+		meta.list(4, thriftStruct, 0)
+	} else {
+		meta.list(4, thriftStruct, 1)
+		meta.begin(0)
+		meta.list(1, thriftStruct, len(columns))
+		var size int64
+		for i, chunk := range columns {
+			column := table.columns[i]
+			meta.begin(0)
+			meta.i64(2, chunk.offset)
+			meta.begin(3)
+			meta.i32(1, column.parquetType())
+			meta.list(2, thriftI32, 1)
+			meta.buf = binary.AppendVarint(meta.buf, parquetPlain)
+			meta.list(3, thriftBinary, 1)
+			meta.appendString(column.name)
+			meta.i32(4, codec)
+			meta.i64(5, int64(len(table.rows)))
+			meta.i64(6, chunk.uncompressed)
+			meta.i64(7, chunk.compressed)
+			meta.i64(9, chunk.offset)
+			meta.end()
+			meta.end()
+			size += chunk.uncompressed
+		}
+		meta.i64(2, size)
+		meta.i64(3, int64(len(table.rows)))
+		meta.end()
+	}
+	meta.string(6, "vaultflow")
+	meta.end()
+
+	out = append(out, meta.buf...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(meta.buf)))
+	return append(out, parquetMagic...), nil
+}
+
+// parquetType returns the physical type of the column's values.
+func (c exportColumn) parquetType() int32 {
+	if c.kind == columnString {
+		return parquetByteArray
+	}
+	return parquetInt64
+}
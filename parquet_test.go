@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// thriftReader decodes the thrift compact protocol into maps of field IDs
+// to int64, string, []any or nested maps, to check what writeParquet wrote.
+type thriftReader struct {
+	buf []byte
+}
+
+func (r *thriftReader) varint() int64 {
+	v, n := binary.Varint(r.buf)
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.buf)
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.varint()
+	case thriftBinary:
+		n := r.uvarint()
+		s := string(r.buf[:n])
+		r.buf = r.buf[n:]
+		return s
+	case thriftList:
+		header := r.buf[0]
+		r.buf = r.buf[1:]
+		n := int(header >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		list := make([]any, n)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.structure()
+	}
+	panic(fmt.Sprintf("thrift type %d", typ))
+}
+
+func (r *thriftReader) structure() map[int16]any {
+	fields := map[int16]any{}
+	var last int16
+	for {
+		header := r.buf[0]
+		r.buf = r.buf[1:]
+		if header == 0 {
+			return fields
+		}
+		if delta := int16(header >> 4); delta != 0 {
+			last += delta
+		} else {
+			last = int16(r.varint())
+		}
+		fields[last] = r.value(header & 0x0f)
+	}
+}
+
+// readParquet decodes the columns of a file written by writeParquet.
+func readParquet(t *testing.T, data []byte) (names []string, columns [][]any) {
+	t.Helper()
+	if !bytes.HasPrefix(data, parquetMagic) || !bytes.HasSuffix(data, parquetMagic) {
+		t.Fatal("no PAR1 magic")
+	}
+	size := binary.LittleEndian.Uint32(data[len(data)-8:])
+	footer := (&thriftReader{buf: data[len(data)-8-int(size) : len(data)-8]}).structure()
+
+	schema := footer[2].([]any)
+	kinds := map[string]int64{}
+	for _, element := range schema[1:] {
+		fields := element.(map[int16]any)
+		names = append(names, fields[4].(string))
+		kinds[fields[4].(string)], _ = fields[6].(int64)
+	}
+	rows := footer[3].(int64)
+	groups := footer[4].([]any)
+	if rows == 0 {
+		return names, make([][]any, len(names))
+	}
+
+	for _, chunk := range groups[0].(map[int16]any)[1].([]any) {
+		meta := chunk.(map[int16]any)[3].(map[int16]any)
+		r := &thriftReader{buf: data[meta[9].(int64):]}
+		header := r.structure()
+		page := r.buf[:header[3].(int64)]
+		switch meta[4].(int64) {
+		case parquetSnappy:
+			page, _ = snappyDecode(page, int(header[2].(int64)))
+		case parquetGzip:
+			zr, err := gzip.NewReader(bytes.NewReader(page))
+			if err != nil {
+				t.Fatal(err)
+			}
+			page, _ = io.ReadAll(zr)
+		}
+
+		var values []any
+		for range rows {
+			if meta[1].(int64) == parquetByteArray {
+				n := binary.LittleEndian.Uint32(page)
+				values = append(values, string(page[4:4+n]))
+				page = page[4+n:]
+			} else {
+				v := int(binary.LittleEndian.Uint64(page))
+				if kinds[meta[3].([]any)[0].(string)] == parquetTimestampMillis {
+					values = append(values, time.UnixMilli(int64(v)).UTC())
+				} else {
+					values = append(values, v)
+				}
+				page = page[8:]
+			}
+		}
+		columns = append(columns, values)
+	}
+	return names, columns
+}
+
+func TestWriteParquet(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 6_000_000, time.UTC)
+	table := exportTable{columns: []exportColumn{{"id", columnString}, {"balance", columnInt}, {"time", columnTime}}}
+	for i := range 20 {
+		table.rows = append(table.rows, []any{fmt.Sprintf("acc%d", i), i * -100, at.Add(time.Duration(i) * time.Second)})
+	}
+
+	for _, c := range []Compression{CompressionNone, CompressionGzip, CompressionSnappy} {
+		data, err := writeParquet(table, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, columns := readParquet(t, data)
+		if fmt.Sprint(names) != "[id balance time]" || len(columns) != 3 {
+			t.Fatalf("%q: columns %v", c, names)
+		}
+		for i, row := range table.rows {
+			for j, value := range row {
+				if columns[j][i] != value {
+					t.Errorf("%q: row %d column %s = %v; want %v", c, i, names[j], columns[j][i], value)
+				}
+			}
+		}
+	}
+
+	data, _ := writeParquet(exportTable{columns: table.columns}, CompressionNone)
+	if names, columns := readParquet(t, data); len(names) != 3 || len(columns[0]) != 0 {
+		t.Errorf("Empty table read back as %v, %v", names, columns)
+	}
+}
@@ -0,0 +1,110 @@
+// Package plugin is the interface vaultflow plugins implement, so third
+// parties can extend vaultflow without forking it: hooks observing and
+// vetoing operations, rules flagging them, a codec for snapshots and object
+// storage for archives.
+//
+// A plugin is loaded either in process, as a Go plugin built with
+// -buildmode=plugin that exports a variable named Plugin of type Plugin, or
+// out of process, as an executable whose main function calls Serve, which
+// vaultflow starts and talks to over net/rpc, in the style of
+// hashicorp/go-plugin. Go plugins must be built with the same Go version
+// and dependencies as vaultflow; executables need not be, and a crashing
+// executable does not take vaultflow down with it.
+//
+// A plugin embeds Base and implements the methods of what its Manifest
+// says it provides.
+package plugin
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Olusamimaths/vaultflow/client"
+)
+
+// Operation is an operation as vaultflow encodes it.
+type Operation = client.Operation
+
+// Rule actions, as vaultflow's rule engine takes them.
+const (
+	ActionBlock    = "block"    // veto the operation
+	ActionFlag     = "flag"     // apply it, but queue it for review
+	ActionAnnotate = "annotate" // apply it and only record the finding
+)
+
+// Rule is a rule of a plugin, matched against operations with Match.
+type Rule struct {
+	Name   string
+	Action string // ActionBlock, ActionFlag or ActionAnnotate
+}
+
+// Manifest says what a plugin provides.
+type Manifest struct {
+	Name    string
+	Hooks   bool   // BeforeOperation and AfterOperation are called for every operation
+	Rules   []Rule // each matched against every operation with Match
+	Codec   string // content type of the snapshot codec of Encode and Decode, if any
+	Storage bool   // objects are stored with Put, Get, List and Delete
+}
+
+// Plugin is implemented by plugins. Methods of what the manifest does not
+// provide are never called.
+type Plugin interface {
+	Manifest(ctx context.Context) (Manifest, error)
+
+	// BeforeOperation runs before an operation is applied; returning an
+	// error vetoes it. AfterOperation runs once it has been applied.
+	BeforeOperation(ctx context.Context, op Operation) error
+	AfterOperation(ctx context.Context, op Operation) error
+
+	// Match reports whether the rule of the given name matches op.
+	Match(ctx context.Context, rule string, op Operation) (bool, error)
+
+	// Encode encodes a snapshot, given as JSON, and Decode decodes one
+	// back to JSON.
+	Encode(ctx context.Context, data []byte) ([]byte, error)
+	Decode(ctx context.Context, data []byte) ([]byte, error)
+
+	// Put, Get, List and Delete store objects by key. List returns the
+	// keys starting with prefix, in lexical order.
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Base implements every method of Plugin but Manifest, failing with
+// errors.ErrUnsupported, or doing nothing for hooks. Plugins embed it and
+// override what they provide.
+type Base struct{}
+
+func (Base) BeforeOperation(ctx context.Context, op Operation) error { return nil }
+func (Base) AfterOperation(ctx context.Context, op Operation) error  { return nil }
+
+func (Base) Match(ctx context.Context, rule string, op Operation) (bool, error) {
+	return false, errors.ErrUnsupported
+}
+
+func (Base) Encode(ctx context.Context, data []byte) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (Base) Decode(ctx context.Context, data []byte) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (Base) Put(ctx context.Context, key string, data []byte) error {
+	return errors.ErrUnsupported
+}
+
+func (Base) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (Base) List(ctx context.Context, prefix string) ([]string, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (Base) Delete(ctx context.Context, key string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,190 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPlugin vetoes withdrawals, matches large operations with its rule,
+// encodes snapshots reversed and stores objects in memory.
+type testPlugin struct {
+	Base
+	mu      sync.Mutex
+	applied []string
+	objects map[string][]byte
+	block   chan struct{} // if set, BeforeOperation waits for it
+}
+
+func (p *testPlugin) Manifest(ctx context.Context) (Manifest, error) {
+	return Manifest{Name: "test", Hooks: true, Rules: []Rule{{Name: "large", Action: ActionFlag}}, Codec: "application/x-reversed", Storage: true}, nil
+}
+
+func (p *testPlugin) BeforeOperation(ctx context.Context, op Operation) error {
+	if p.block != nil {
+		<-p.block
+	}
+	if op.Type == "withdraw" {
+		return errors.New("withdrawals are closed")
+	}
+	return nil
+}
+
+func (p *testPlugin) AfterOperation(ctx context.Context, op Operation) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.applied = append(p.applied, op.ID)
+	return nil
+}
+
+func (p *testPlugin) Match(ctx context.Context, rule string, op Operation) (bool, error) {
+	return rule == "large" && op.Amount > 100, nil
+}
+
+func (p *testPlugin) Encode(ctx context.Context, data []byte) ([]byte, error) {
+	data = slices.Clone(data)
+	slices.Reverse(data)
+	return data, nil
+}
+
+func (p *testPlugin) Decode(ctx context.Context, data []byte) ([]byte, error) {
+	return p.Encode(ctx, data)
+}
+
+func (p *testPlugin) Put(ctx context.Context, key string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.objects == nil {
+		p.objects = map[string][]byte{}
+	}
+	p.objects[key] = data
+	return nil
+}
+
+func (p *testPlugin) Get(ctx context.Context, key string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, ok := p.objects[key]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	return data, nil
+}
+
+// serve serves p on a local address for the duration of the test.
+func serve(t *testing.T, p Plugin) *Client {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = ServeListener(l, p) }()
+	c, err := Connect("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		l.Close()
+	})
+	return c
+}
+
+func TestClient(t *testing.T) {
+	p := &testPlugin{}
+	c := serve(t, p)
+	ctx := context.Background()
+
+	if m, err := c.Manifest(ctx); err != nil || m.Name != "test" || len(m.Rules) != 1 || !m.Storage {
+		t.Fatalf("Manifest() = %+v, %v", m, err)
+	}
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	op := Operation{ID: "op1", Type: "deposit", To: "acc1", Amount: 500, Time: at, Metadata: map[string]string{"invoice": "42"}}
+	if err := c.BeforeOperation(ctx, op); err != nil {
+		t.Errorf("BeforeOperation(deposit) = %v", err)
+	}
+	if err := c.BeforeOperation(ctx, Operation{Type: "withdraw"}); err == nil || !strings.Contains(err.Error(), "withdrawals are closed") {
+		t.Errorf("BeforeOperation(withdraw) = %v; want the veto", err)
+	}
+	if err := c.AfterOperation(ctx, op); err != nil || !slices.Equal(p.applied, []string{"op1"}) {
+		t.Errorf("AfterOperation() = %v, applied %v", err, p.applied)
+	}
+	if matched, err := c.Match(ctx, "large", op); err != nil || !matched {
+		t.Errorf("Match(large) = %t, %v; want a match", matched, err)
+	}
+
+	encoded, err := c.Encode(ctx, []byte(`{"a":1}`))
+	if err != nil || string(encoded) != `}1:"a"{` {
+		t.Errorf("Encode() = %q, %v", encoded, err)
+	}
+	if decoded, err := c.Decode(ctx, encoded); err != nil || string(decoded) != `{"a":1}` {
+		t.Errorf("Decode() = %q, %v", decoded, err)
+	}
+
+	if err := c.Put(ctx, "k", []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := c.Get(ctx, "k"); err != nil || string(data) != "v" {
+		t.Errorf("Get() = %q, %v", data, err)
+	}
+	if _, err := c.Get(ctx, "nope"); err == nil {
+		t.Errorf("Get() of a missing key succeeded")
+	}
+	if _, err := c.List(ctx, ""); err == nil || !strings.Contains(err.Error(), errors.ErrUnsupported.Error()) {
+		t.Errorf("List() = %v; want the unsupported error of Base", err)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	p := &testPlugin{block: make(chan struct{})}
+	defer close(p.block)
+	c := serve(t, p)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.BeforeOperation(ctx, Operation{Type: "deposit"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("BeforeOperation() error = %v; want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// TestHelperPlugin is the plugin executable started by TestStart, the test
+// binary run again with the handshake cookie set.
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv(CookieKey) != CookieValue {
+		t.Skip("only run as a plugin")
+	}
+	if err := Serve(&testPlugin{}); err != nil {
+		t.Fatal(err)
+	}
+	os.Exit(0)
+}
+
+func TestStart(t *testing.T) {
+	if err := Serve(&testPlugin{}); !errors.Is(err, ErrNotPlugin) {
+		t.Errorf("Serve() not started by vaultflow error = %v; want %v", err, ErrNotPlugin)
+	}
+
+	c, err := Start(os.Args[0], "-test.run=^TestHelperPlugin$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, err := c.Manifest(context.Background()); err != nil || m.Name != "test" {
+		t.Errorf("Manifest() = %+v, %v", m, err)
+	}
+	if err := c.Close(); err != nil {
+		t.Errorf("Close() = %v", err)
+	}
+	if c.cmd.ProcessState == nil || !c.cmd.ProcessState.Exited() {
+		t.Errorf("Plugin still running after Close()")
+	}
+
+	if _, err := Start(os.Args[0], "-test.list=^$"); !errors.Is(err, ErrNotPlugin) {
+		t.Errorf("Start() of a test binary error = %v; want %v", err, ErrNotPlugin)
+	}
+}
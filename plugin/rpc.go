@@ -0,0 +1,293 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The handshake of out-of-process plugins. vaultflow starts a plugin with
+// CookieKey=CookieValue in its environment, so a plugin run by hand can
+// tell it is not run by vaultflow. The plugin listens on a local address
+// and prints ProtocolVersion|network|address on a line of its standard
+// output, then serves calls until its standard input is closed.
+const (
+	CookieKey       = "VAULTFLOW_PLUGIN"
+	CookieValue     = "d5c0c1a2-vaultflow-plugin"
+	ProtocolVersion = "1"
+)
+
+// ErrNotPlugin is returned by Serve when the process was not started by
+// vaultflow, and by Start when the executable does not answer the
+// handshake.
+var ErrNotPlugin = errors.New("not a vaultflow plugin")
+
+// handshakeTimeout is how long Start waits for a plugin to print its
+// address.
+const handshakeTimeout = 10 * time.Second
+
+// closeTimeout is how long Close waits for a plugin to exit once its
+// standard input is closed, before killing it.
+const closeTimeout = 5 * time.Second
+
+// Arguments of the RPC methods taking more than one value.
+type (
+	matchArgs = struct {
+		Rule string
+		Op   Operation
+	}
+	putArgs = struct {
+		Key  string
+		Data []byte
+	}
+)
+
+// server exposes a Plugin over net/rpc. Calls run with a background
+// context, as the context of the caller does not cross the process.
+type server struct {
+	p Plugin
+}
+
+func (s *server) Manifest(_ struct{}, reply *Manifest) (err error) {
+	*reply, err = s.p.Manifest(context.Background())
+	return err
+}
+
+func (s *server) BeforeOperation(op Operation, _ *struct{}) error {
+	return s.p.BeforeOperation(context.Background(), op)
+}
+
+func (s *server) AfterOperation(op Operation, _ *struct{}) error {
+	return s.p.AfterOperation(context.Background(), op)
+}
+
+func (s *server) Match(args matchArgs, reply *bool) (err error) {
+	*reply, err = s.p.Match(context.Background(), args.Rule, args.Op)
+	return err
+}
+
+func (s *server) Encode(data []byte, reply *[]byte) (err error) {
+	*reply, err = s.p.Encode(context.Background(), data)
+	return err
+}
+
+func (s *server) Decode(data []byte, reply *[]byte) (err error) {
+	*reply, err = s.p.Decode(context.Background(), data)
+	return err
+}
+
+func (s *server) Put(args putArgs, _ *struct{}) error {
+	return s.p.Put(context.Background(), args.Key, args.Data)
+}
+
+func (s *server) Get(key string, reply *[]byte) (err error) {
+	*reply, err = s.p.Get(context.Background(), key)
+	return err
+}
+
+func (s *server) List(prefix string, reply *[]string) (err error) {
+	*reply, err = s.p.List(context.Background(), prefix)
+	return err
+}
+
+func (s *server) Delete(key string, _ *struct{}) error {
+	return s.p.Delete(context.Background(), key)
+}
+
+// Serve serves p to the vaultflow process that started this one, see
+// Start, until vaultflow closes its standard input. Plugin executables call
+// it from main.
+func Serve(p Plugin) error {
+	if os.Getenv(CookieKey) != CookieValue {
+		return fmt.Errorf("%w: plugins are started by vaultflow", ErrNotPlugin)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go func() {
+		_, _ = io.Copy(io.Discard, os.Stdin)
+		l.Close()
+	}()
+	fmt.Printf("%s|%s|%s\n", ProtocolVersion, l.Addr().Network(), l.Addr())
+	return ServeListener(l, p)
+}
+
+// ServeListener serves p to the connections accepted on l until l is
+// closed, e.g. to run a plugin as a long-lived service reached with
+// Connect.
+func ServeListener(l net.Listener, p Plugin) error {
+	s := rpc.NewServer()
+	if err := s.RegisterName("Plugin", &server{p: p}); err != nil {
+		return err
+	}
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Client is a Plugin served by another process, see Start and Connect.
+type Client struct {
+	rpc   *rpc.Client
+	cmd   *exec.Cmd
+	stdin io.Closer
+}
+
+// Start starts the plugin executable at path with args, and connects to it
+// once it has printed its address.
+func Start(path string, args ...string) (*Client, error) {
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(os.Environ(), CookieKey+"="+CookieValue)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	handshake := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		if scanner.Scan() {
+			handshake <- scanner.Text()
+		}
+		close(handshake)
+		// Later output of the plugin is its own logging.
+		_, _ = io.Copy(os.Stderr, stdout)
+	}()
+
+	fail := func(err error) (*Client, error) {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+	var line string
+	select {
+	case line = <-handshake:
+	case <-time.After(handshakeTimeout):
+		return fail(fmt.Errorf("%w: no handshake within %s", ErrNotPlugin, handshakeTimeout))
+	}
+	parts := strings.Split(line, "|")
+	if len(parts) != 3 || parts[0] != ProtocolVersion {
+		return fail(fmt.Errorf("%w: handshake %q, want protocol %s", ErrNotPlugin, line, ProtocolVersion))
+	}
+	c, err := Connect(parts[1], parts[2])
+	if err != nil {
+		return fail(err)
+	}
+	c.cmd, c.stdin = cmd, stdin
+	return c, nil
+}
+
+// Connect connects to a plugin served at address, e.g. by ServeListener.
+func Connect(network, address string) (*Client, error) {
+	conn, err := rpc.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{rpc: conn}, nil
+}
+
+// Close closes the connection to the plugin, and stops it if it was
+// started by Start.
+func (c *Client) Close() error {
+	err := c.rpc.Close()
+	if c.cmd == nil {
+		return err
+	}
+
+	_ = c.stdin.Close()
+	exited := make(chan error, 1)
+	go func() { exited <- c.cmd.Wait() }()
+	select {
+	case <-exited:
+	case <-time.After(closeTimeout):
+		_ = c.cmd.Process.Kill()
+		<-exited
+	}
+	return err
+}
+
+// call calls a method of the plugin, giving up if ctx is done first.
+func (c *Client) call(ctx context.Context, method string, args, reply any) error {
+	call := c.rpc.Go("Plugin."+method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *Client) Manifest(ctx context.Context) (Manifest, error) {
+	var m Manifest
+	err := c.call(ctx, "Manifest", struct{}{}, &m)
+	return m, err
+}
+
+func (c *Client) BeforeOperation(ctx context.Context, op Operation) error {
+	return c.call(ctx, "BeforeOperation", op, &struct{}{})
+}
+
+func (c *Client) AfterOperation(ctx context.Context, op Operation) error {
+	return c.call(ctx, "AfterOperation", op, &struct{}{})
+}
+
+func (c *Client) Match(ctx context.Context, rule string, op Operation) (bool, error) {
+	var matched bool
+	err := c.call(ctx, "Match", matchArgs{Rule: rule, Op: op}, &matched)
+	return matched, err
+}
+
+func (c *Client) Encode(ctx context.Context, data []byte) ([]byte, error) {
+	var encoded []byte
+	err := c.call(ctx, "Encode", data, &encoded)
+	return encoded, err
+}
+
+func (c *Client) Decode(ctx context.Context, data []byte) ([]byte, error) {
+	var decoded []byte
+	err := c.call(ctx, "Decode", data, &decoded)
+	return decoded, err
+}
+
+func (c *Client) Put(ctx context.Context, key string, data []byte) error {
+	return c.call(ctx, "Put", putArgs{Key: key, Data: data}, &struct{}{})
+}
+
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+	err := c.call(ctx, "Get", key, &data)
+	return data, err
+}
+
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := c.call(ctx, "List", prefix, &keys)
+	return keys, err
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.call(ctx, "Delete", key, &struct{}{})
+}
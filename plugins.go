@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	goplugin "plugin"
+	"strings"
+
+	"github.com/Olusamimaths/vaultflow/plugin"
+)
+
+// ErrInvalidPlugin is returned for plugins that cannot be loaded, or whose
+// manifest is invalid.
+var ErrInvalidPlugin = errors.New("invalid plugin")
+
+// LoadPlugin loads the plugin at path: a Go plugin if its name ends in .so,
+// whose exported Plugin variable is used, or else an executable, started and
+// called over RPC, see the plugin package. Started executables run until the
+// plugin, an io.Closer, is closed.
+func LoadPlugin(path string) (plugin.Plugin, error) {
+	if !strings.HasSuffix(path, ".so") {
+		c, err := plugin.Start(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPlugin, err)
+		}
+		return c, nil
+	}
+
+	lib, err := goplugin.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPlugin, err)
+	}
+	sym, err := lib.Lookup("Plugin")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPlugin, err)
+	}
+	if p, ok := sym.(*plugin.Plugin); ok && *p != nil {
+		return *p, nil
+	}
+	return nil, fmt.Errorf("%w: %s exports no Plugin variable of type plugin.Plugin", ErrInvalidPlugin, path)
+}
+
+// UsePlugin wires what a plugin provides into the state machine, as its
+// manifest says: its hooks run for every later operation, its rules are
+// evaluated by a rule engine of their own, registered as hooks too, and its
+// codec, if any, encodes snapshots, see UseCodec. Its storage is not used
+// here, see PluginStore. It returns the manifest, and the engine of the
+// rules, nil without rules, for their findings.
+func (sm *StateMachine) UsePlugin(ctx context.Context, p plugin.Plugin) (plugin.Manifest, *RuleEngine, error) {
+	m, err := p.Manifest(ctx)
+	if err != nil {
+		return m, nil, fmt.Errorf("%w: manifest: %w", ErrInvalidPlugin, err)
+	}
+	if m.Name == "" {
+		return m, nil, fmt.Errorf("%w: no name", ErrInvalidPlugin)
+	}
+
+	var rules []Rule
+	for _, r := range m.Rules {
+		switch action := RuleAction(r.Action); action {
+		case RuleBlock, RuleFlag, RuleAnnotate:
+			rules = append(rules, Rule{Name: r.Name, Action: action, Condition: pluginCondition(m.Name, p, r.Name)})
+		default:
+			return m, nil, fmt.Errorf("%w: %s: rule %q has unknown action %q", ErrInvalidPlugin, m.Name, r.Name, r.Action)
+		}
+	}
+
+	if m.Hooks {
+		sm.RegisterHooks(pluginHooks(m.Name, p))
+	}
+	var engine *RuleEngine
+	if len(rules) > 0 {
+		engine = NewRuleEngine(0, rules...)
+		if sm.clock != nil {
+			engine.UseClock(sm.clock)
+		}
+		sm.RegisterHooks(engine.Hooks())
+	}
+	if m.Codec != "" {
+		sm.UseCodec(pluginCodec{p: p, contentType: m.Codec})
+	}
+	return m, engine, nil
+}
+
+// pluginOperation returns op as plugins see it.
+func pluginOperation(op Operation) plugin.Operation {
+	return plugin.Operation{
+		ID:            op.ID,
+		Type:          string(op.Type),
+		From:          op.From,
+		To:            op.To,
+		Amount:        op.Amount,
+		Version:       op.Version,
+		Time:          op.Time,
+		Reverses:      op.Reverses,
+		MessageID:     op.MessageID,
+		CorrelationID: op.CorrelationID,
+		FromBucket:    op.FromBucket,
+		ToBucket:      op.ToBucket,
+		Status:        string(op.Status),
+		Memo:          op.Memo,
+		Metadata:      op.Metadata,
+		Category:      op.Category,
+	}
+}
+
+// pluginHooks calls the hooks of a plugin. Failures of AfterOperation are
+// only logged, as the operation is applied by then.
+func pluginHooks(name string, p plugin.Plugin) Hooks {
+	return Hooks{
+		BeforeOperation: func(ctx context.Context, op Operation) error {
+			if err := p.BeforeOperation(ctx, pluginOperation(op)); err != nil {
+				return fmt.Errorf("plugin %s: %w", name, err)
+			}
+			return nil
+		},
+		AfterOperation: func(ctx context.Context, op Operation) {
+			if err := p.AfterOperation(ctx, pluginOperation(op)); err != nil {
+				fmt.Printf("Plugin Error: %s: %v\n", name, err)
+			}
+		},
+	}
+}
+
+// pluginCondition matches a rule of a plugin. A rule the plugin fails to
+// evaluate does not match.
+func pluginCondition(name string, p plugin.Plugin, rule string) Condition {
+	return func(op Operation, activity *RuleActivity) bool {
+		matched, err := p.Match(context.Background(), rule, pluginOperation(op))
+		if err != nil {
+			fmt.Printf("Plugin Error: %s: rule %s: %v\n", name, rule, err)
+		}
+		return matched && err == nil
+	}
+}
+
+// pluginCodec encodes values as JSON, which the plugin then encodes in its
+// format.
+type pluginCodec struct {
+	p           plugin.Plugin
+	contentType string
+}
+
+func (c pluginCodec) ContentType() string { return c.contentType }
+
+func (c pluginCodec) Encode(v any) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return c.p.Encode(context.Background(), data)
+}
+
+func (c pluginCodec) Decode(data []byte, v any) error {
+	data, err := c.p.Decode(context.Background(), data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// pluginStore is an ObjectStore backed by the storage of a plugin.
+type pluginStore struct {
+	p plugin.Plugin
+}
+
+// PluginStore returns an ObjectStore keeping objects in the storage of a
+// plugin whose manifest says it provides storage, e.g. for archives.
+func PluginStore(p plugin.Plugin) ObjectStore {
+	return pluginStore{p: p}
+}
+
+func (s pluginStore) Put(ctx context.Context, key string, data []byte) error {
+	return s.p.Put(ctx, key, data)
+}
+
+func (s pluginStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	data, err := s.p.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s pluginStore) List(ctx context.Context, prefix string) ([]string, error) {
+	return s.p.List(ctx, prefix)
+}
+
+func (s pluginStore) Delete(ctx context.Context, key string) error {
+	return s.p.Delete(ctx, key)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Olusamimaths/vaultflow/plugin"
+)
+
+// fakePlugin vetoes withdrawals from frozen, flags transfers above 100,
+// encodes snapshots reversed and keeps objects in memory.
+type fakePlugin struct {
+	plugin.Base
+	manifest plugin.Manifest
+
+	mu      sync.Mutex
+	applied []plugin.Operation
+	objects map[string][]byte
+}
+
+func newFakePlugin() *fakePlugin {
+	return &fakePlugin{
+		manifest: plugin.Manifest{
+			Name:    "fake",
+			Hooks:   true,
+			Rules:   []plugin.Rule{{Name: "large-transfer", Action: plugin.ActionFlag}},
+			Codec:   "application/x-reversed",
+			Storage: true,
+		},
+		objects: map[string][]byte{},
+	}
+}
+
+func (p *fakePlugin) Manifest(ctx context.Context) (plugin.Manifest, error) {
+	return p.manifest, nil
+}
+
+func (p *fakePlugin) BeforeOperation(ctx context.Context, op plugin.Operation) error {
+	if op.From == "frozen" {
+		return errors.New("account frozen")
+	}
+	return nil
+}
+
+func (p *fakePlugin) AfterOperation(ctx context.Context, op plugin.Operation) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.applied = append(p.applied, op)
+	return nil
+}
+
+func (p *fakePlugin) Match(ctx context.Context, rule string, op plugin.Operation) (bool, error) {
+	return op.Type == string(OpTransfer) && op.Amount > 100, nil
+}
+
+func (p *fakePlugin) Encode(ctx context.Context, data []byte) ([]byte, error) {
+	data = slices.Clone(data)
+	slices.Reverse(data)
+	return data, nil
+}
+
+func (p *fakePlugin) Decode(ctx context.Context, data []byte) ([]byte, error) {
+	return p.Encode(ctx, data)
+}
+
+func (p *fakePlugin) Put(ctx context.Context, key string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.objects[key] = data
+	return nil
+}
+
+func (p *fakePlugin) Get(ctx context.Context, key string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	data, ok := p.objects[key]
+	if !ok {
+		return nil, errors.New("no such object")
+	}
+	return data, nil
+}
+
+func (p *fakePlugin) List(ctx context.Context, prefix string) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var keys []string
+	for key := range p.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (p *fakePlugin) Delete(ctx context.Context, key string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.objects, key)
+	return nil
+}
+
+func TestUsePlugin(t *testing.T) {
+	quiet(t)
+
+	// The plugin is served over RPC, as an executable would be.
+	fake := newFakePlugin()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() { _ = plugin.ServeListener(l, fake) }()
+	p, err := plugin.Connect("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0, "frozen": 100}}
+	m, engine, err := sm.UsePlugin(context.Background(), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "fake" || engine == nil {
+		t.Fatalf("UsePlugin() = %+v, %v; want the fake manifest and a rule engine", m, engine)
+	}
+
+	if err := sm.Withdraw("frozen", 10); !errors.Is(err, ErrVetoed) || !strings.Contains(err.Error(), "plugin fake: ") {
+		t.Errorf("Withdraw() from a frozen account error = %v; want the plugin's veto", err)
+	}
+	_ = sm.Transfer("acc1", "acc2", 50)
+	_, _ = sm.Apply(Operation{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 500, Category: "rent"})
+	if findings := engine.ReviewQueue(); len(findings) != 1 || findings[0].Rule != "large-transfer" || findings[0].Op.Amount != 500 {
+		t.Errorf("ReviewQueue() = %+v; want the transfer of 500 flagged", findings)
+	}
+	fake.mu.Lock()
+	applied := fake.applied
+	fake.mu.Unlock()
+	if len(applied) != 2 || applied[1].Category != "rent" || applied[1].ID == "" {
+		t.Errorf("Plugin saw %+v applied; want both transfers", applied)
+	}
+
+	// Snapshots are encoded by the plugin.
+	var snapshot bytes.Buffer
+	if err := sm.WriteSnapshot(&snapshot, nil); err != nil {
+		t.Fatal(err)
+	}
+	if isJSONObject(snapshot.Bytes()) {
+		t.Errorf("Snapshot written as JSON; want it encoded by the plugin")
+	}
+	restored := &StateMachine{}
+	restored.UseCodec(pluginCodec{p: p, contentType: m.Codec})
+	if err := restored.ReadSnapshot(&snapshot, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(restored.Balances(), sm.Balances()) {
+		t.Errorf("Restored balances = %v; want %v", restored.Balances(), sm.Balances())
+	}
+
+	// And so are archives.
+	store := PluginStore(p)
+	if err := store.Put(context.Background(), "a/1", []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := store.List(context.Background(), "a/"); err != nil || !slices.Equal(keys, []string{"a/1"}) {
+		t.Errorf("List() = %v, %v", keys, err)
+	}
+	rc, err := store.Get(context.Background(), "a/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(rc); string(data) != "one" {
+		t.Errorf("Get() = %q; want one", data)
+	}
+	if err := store.Delete(context.Background(), "a/1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(context.Background(), "a/1"); err == nil {
+		t.Errorf("Get() of a deleted object succeeded")
+	}
+}
+
+func TestUsePluginInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest plugin.Manifest
+	}{
+		{"No name", plugin.Manifest{Hooks: true}},
+		{"Unknown rule action", plugin.Manifest{Name: "fake", Rules: []plugin.Rule{{Name: "r", Action: "ignore"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newFakePlugin()
+			p.manifest = tt.manifest
+			sm := &StateMachine{accounts: map[string]int{"frozen": 100}}
+			if _, _, err := sm.UsePlugin(context.Background(), p); !errors.Is(err, ErrInvalidPlugin) {
+				t.Fatalf("UsePlugin() error = %v; want %v", err, ErrInvalidPlugin)
+			}
+			if err := sm.Withdraw("frozen", 1); err != nil {
+				t.Errorf("Withdraw() = %v; want no hooks of an invalid plugin registered", err)
+			}
+		})
+	}
+}
+
+func TestLoadPlugin(t *testing.T) {
+	dir := t.TempDir()
+	for _, path := range []string{filepath.Join(dir, "missing.so"), filepath.Join(dir, "missing")} {
+		if _, err := LoadPlugin(path); !errors.Is(err, ErrInvalidPlugin) {
+			t.Errorf("LoadPlugin(%s) error = %v; want %v", path, err, ErrInvalidPlugin)
+		}
+	}
+}
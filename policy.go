@@ -0,0 +1,696 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidPolicy   = errors.New("invalid policy")
+	ErrPolicyViolation = errors.New("policy violated")
+)
+
+// policyReloadInterval is how often RunPolicyReload checks the policy file
+// for changes.
+const policyReloadInterval = 10 * time.Second
+
+// Policy constrains operations declaratively. A policy applies to the
+// operations of one of its Types and of one of its Accounts, the account
+// debited, or credited if none is, and for which When holds, each of these
+// matching any operation if not set. The operations it applies to must
+// satisfy each constraint set:
+//
+//   - MinAmount and MaxAmount bound the amount of each operation.
+//   - Limit bounds the total amount of the operations the policy applied
+//     to, per account, within the trailing Window, e.g. a daily withdrawal
+//     limit of 20000 with a window of 24h.
+//   - Counterparties are the accounts transfers may credit.
+//   - Hours, e.g. "09:00-17:00", and Days, e.g. [mon, tue, wed, thu, fri],
+//     are when operations may be made, in the time zone of the clock.
+//     Hours wrap around midnight if they end before they start.
+//   - Require is a condition that must hold.
+//
+// When and Require are expressions in the language of scripts, see Script,
+// e.g. op.metadata["invoice"] != "" or balance(op.from) - op.amount >= 1000.
+// An operation breaking a constraint is vetoed with Message, or a message
+// saying which constraint it breaks. An expression failing to evaluate, e.g.
+// dividing by zero, breaks the policy.
+type Policy struct {
+	Name           string          `json:"name"`
+	Types          []OperationType `json:"types,omitempty"`
+	Accounts       []string        `json:"accounts,omitempty"`
+	When           string          `json:"when,omitempty"`
+	MinAmount      int             `json:"min_amount,omitempty"`
+	MaxAmount      int             `json:"max_amount,omitempty"`
+	Limit          int             `json:"limit,omitempty"`
+	Window         string          `json:"window,omitempty"` // e.g. 24h
+	Counterparties []string        `json:"counterparties,omitempty"`
+	Hours          string          `json:"hours,omitempty"`
+	Days           []string        `json:"days,omitempty"`
+	Require        string          `json:"require,omitempty"`
+	Message        string          `json:"message,omitempty"`
+}
+
+// PolicyViolation is a constraint of a policy an operation breaks.
+type PolicyViolation struct {
+	Policy     string `json:"policy"`
+	Constraint string `json:"constraint"` // the field of Policy, e.g. max_amount
+	Message    string `json:"message"`
+}
+
+func (v *PolicyViolation) Error() string {
+	return v.Policy + ": " + v.Message
+}
+
+// compiledPolicy is a policy ready to be evaluated.
+type compiledPolicy struct {
+	Policy
+	when, require *scriptExpr // nil if not set
+	window        time.Duration
+	hours         bool
+	from, until   time.Duration // since midnight, if hours is set
+	days          []time.Weekday
+}
+
+var policyDays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func compilePolicy(p Policy) (*compiledPolicy, error) {
+	invalid := func(format string, args ...any) (*compiledPolicy, error) {
+		return nil, fmt.Errorf("%w: %s: %s", ErrInvalidPolicy, cmp.Or(p.Name, "unnamed"), fmt.Sprintf(format, args...))
+	}
+	if p.Name == "" {
+		return invalid("no name")
+	}
+	if p.MinAmount < 0 || p.MaxAmount < 0 || p.Limit < 0 {
+		return invalid("negative amount")
+	}
+	if p.MaxAmount > 0 && p.MinAmount > p.MaxAmount {
+		return invalid("min_amount %d above max_amount %d", p.MinAmount, p.MaxAmount)
+	}
+	for _, t := range p.Types {
+		switch t {
+		case OpDeposit, OpWithdraw, OpTransfer, OpRollback, OpOpen, OpRollbackTo, OpMove, OpArchive, OpUnarchive, OpSetStatus:
+		default:
+			return invalid("unknown type %q", t)
+		}
+	}
+
+	c := &compiledPolicy{Policy: p}
+	if p.When != "" {
+		when, err := compileCondition(p.When)
+		if err != nil {
+			return invalid("when: %v", err)
+		}
+		c.when = &when
+	}
+	if p.Require != "" {
+		require, err := compileCondition(p.Require)
+		if err != nil {
+			return invalid("require: %v", err)
+		}
+		c.require = &require
+	}
+
+	var err error
+	if p.Window != "" {
+		if c.window, err = time.ParseDuration(p.Window); err != nil || c.window <= 0 {
+			return invalid("window %q is not a positive duration", p.Window)
+		}
+	}
+	if (p.Limit > 0) != (c.window > 0) {
+		return invalid("limit and window go together")
+	}
+
+	if p.Hours != "" {
+		from, until, ok := strings.Cut(p.Hours, "-")
+		start, err1 := time.Parse("15:04", strings.TrimSpace(from))
+		end, err2 := time.Parse("15:04", strings.TrimSpace(until))
+		if !ok || err1 != nil || err2 != nil || start.Equal(end) {
+			return invalid("hours %q are not like 09:00-17:00", p.Hours)
+		}
+		c.hours = true
+		c.from = time.Duration(start.Hour())*time.Hour + time.Duration(start.Minute())*time.Minute
+		c.until = time.Duration(end.Hour())*time.Hour + time.Duration(end.Minute())*time.Minute
+	}
+	for _, day := range p.Days {
+		weekday, ok := policyDays[strings.ToLower(day[:min(len(day), 3)])]
+		if !ok {
+			return invalid("unknown day %q", day)
+		}
+		c.days = append(c.days, weekday)
+	}
+	return c, nil
+}
+
+// compilePolicies compiles a set of policies, whose names must be unique.
+func compilePolicies(policies []Policy) ([]*compiledPolicy, error) {
+	var compiled []*compiledPolicy
+	for i, p := range policies {
+		if slices.ContainsFunc(policies[:i], func(q Policy) bool { return q.Name == p.Name }) {
+			return nil, fmt.Errorf("%w: %s: defined twice", ErrInvalidPolicy, p.Name)
+		}
+		c, err := compilePolicy(p)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// policySubject returns the account an operation is accounted to.
+func policySubject(op Operation) string {
+	return cmp.Or(op.From, op.To)
+}
+
+// applies reports whether the policy applies to the operation of env.
+func (c *compiledPolicy) applies(env *scriptEnv) (bool, error) {
+	if len(c.Types) > 0 && !slices.Contains(c.Types, env.op.Type) {
+		return false, nil
+	}
+	if len(c.Accounts) > 0 && !slices.Contains(c.Accounts, policySubject(env.op)) {
+		return false, nil
+	}
+	if c.when == nil {
+		return true, nil
+	}
+	return c.when.holds(env)
+}
+
+// check returns the constraint of the policy the operation of env breaks,
+// if any, given the activity of the policies.
+func (c *compiledPolicy) check(env *scriptEnv, activity *policyActivity) *PolicyViolation {
+	violation := func(constraint, format string, args ...any) *PolicyViolation {
+		return &PolicyViolation{Policy: c.Name, Constraint: constraint, Message: cmp.Or(c.Message, fmt.Sprintf(format, args...))}
+	}
+	op, at := env.op, env.opTime()
+
+	applies, err := c.applies(env)
+	if err != nil {
+		return violation("when", "when failed: %v", err)
+	}
+	if !applies {
+		return nil
+	}
+
+	if c.MinAmount > 0 && op.Amount < c.MinAmount {
+		return violation("min_amount", "amount %d below the minimum of %d", op.Amount, c.MinAmount)
+	}
+	if c.MaxAmount > 0 && op.Amount > c.MaxAmount {
+		return violation("max_amount", "amount %d above the maximum of %d", op.Amount, c.MaxAmount)
+	}
+	if c.Limit > 0 {
+		if total := activity.total(c.Name, policySubject(op), at.Add(-c.window)) + op.Amount; total > c.Limit {
+			return violation("limit", "%d within %s above the limit of %d", total, c.window, c.Limit)
+		}
+	}
+	if len(c.Counterparties) > 0 && op.From != "" && op.To != "" && !slices.Contains(c.Counterparties, op.To) {
+		return violation("counterparties", "counterparty %s not allowed", op.To)
+	}
+	if c.hours {
+		midnight := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location())
+		of := at.Sub(midnight)
+		inside := c.from <= of && of < c.until
+		if c.until < c.from {
+			inside = of >= c.from || of < c.until
+		}
+		if !inside {
+			return violation("hours", "not allowed at %s, only %s", at.Format("15:04"), c.Hours)
+		}
+	}
+	if len(c.days) > 0 && !slices.Contains(c.days, at.Weekday()) {
+		return violation("days", "not allowed on %s", at.Weekday())
+	}
+	if c.require != nil {
+		held, err := c.require.holds(env)
+		if err != nil {
+			return violation("require", "require failed: %v", err)
+		}
+		if !held {
+			return violation("require", "%s does not hold", c.Require)
+		}
+	}
+	return nil
+}
+
+// evaluatePolicies returns the constraints the operation of env breaks.
+func evaluatePolicies(policies []*compiledPolicy, activity *policyActivity, env *scriptEnv) []PolicyViolation {
+	var violations []PolicyViolation
+	for _, c := range policies {
+		if v := c.check(env, activity); v != nil {
+			violations = append(violations, *v)
+		}
+	}
+	return violations
+}
+
+// policyActivity is the amounts of the operations policies with a limit
+// applied to, by policy and account, within their window.
+type policyActivity struct {
+	entries map[string][]policyEntry
+}
+
+type policyEntry struct {
+	at     time.Time
+	amount int
+}
+
+func policyActivityKey(policy, account string) string {
+	return policy + "\x00" + account
+}
+
+func (a *policyActivity) total(policy, account string, since time.Time) int {
+	total := 0
+	for _, e := range a.entries[policyActivityKey(policy, account)] {
+		if e.at.After(since) {
+			total += e.amount
+		}
+	}
+	return total
+}
+
+// record adds the operation of env to the activity of the policies with a
+// limit applying to it, forgetting what is out of their window.
+func (a *policyActivity) record(policies []*compiledPolicy, env *scriptEnv) {
+	at := env.opTime()
+	for _, c := range policies {
+		if c.Limit == 0 {
+			continue
+		}
+		if applies, err := c.applies(env); err != nil || !applies {
+			continue
+		}
+		if a.entries == nil {
+			a.entries = map[string][]policyEntry{}
+		}
+		key := policyActivityKey(c.Name, policySubject(env.op))
+		entries := slices.DeleteFunc(a.entries[key], func(e policyEntry) bool { return !e.at.After(at.Add(-c.window)) })
+		a.entries[key] = append(entries, policyEntry{at: at, amount: env.op.Amount})
+	}
+}
+
+// retain forgets the activity of policies not in policies.
+func (a *policyActivity) retain(policies []*compiledPolicy) {
+	for key := range a.entries {
+		name, _, _ := strings.Cut(key, "\x00")
+		if !slices.ContainsFunc(policies, func(c *compiledPolicy) bool { return c.Name == name && c.Limit > 0 }) {
+			delete(a.entries, key)
+		}
+	}
+}
+
+func (a *policyActivity) clone() *policyActivity {
+	clone := &policyActivity{entries: map[string][]policyEntry{}}
+	for key, entries := range a.entries {
+		clone.entries[key] = slices.Clone(entries)
+	}
+	return clone
+}
+
+// policies are the policies set on a state machine, see SetPolicies.
+type policies struct {
+	mu       sync.Mutex
+	defined  []*compiledPolicy
+	activity policyActivity
+	file     []byte // the policy file they were last loaded from, see LoadPolicyFile
+	hooked   bool   // the hooks evaluating them are registered
+}
+
+// SetPolicies replaces the policies evaluated for every operation from now
+// on, see Policy. If any policy is invalid, the policies in place are kept.
+// The activity of policies kept by name counts towards their limits.
+func (sm *StateMachine) SetPolicies(policies []Policy) error {
+	compiled, err := compilePolicies(policies)
+	if err != nil {
+		return err
+	}
+
+	sm.policies.mu.Lock()
+	defer sm.policies.mu.Unlock()
+
+	sm.policies.defined = compiled
+	sm.policies.activity.retain(compiled)
+	if !sm.policies.hooked {
+		sm.RegisterHooks(sm.policyHooks())
+		sm.policies.hooked = true
+	}
+	return nil
+}
+
+// Policies returns the policies set, in the order they are evaluated.
+func (sm *StateMachine) Policies() []Policy {
+	sm.policies.mu.Lock()
+	defer sm.policies.mu.Unlock()
+
+	var list []Policy
+	for _, c := range sm.policies.defined {
+		list = append(list, c.Policy)
+	}
+	return list
+}
+
+// policyHooks veto operations breaking a policy, with the first constraint
+// broken, and record the activity of those applied.
+func (sm *StateMachine) policyHooks() Hooks {
+	return Hooks{
+		BeforeOperation: func(ctx context.Context, op Operation) error {
+			env := sm.scriptEnv(op)
+			sm.policies.mu.Lock()
+			violations := evaluatePolicies(sm.policies.defined, &sm.policies.activity, env)
+			sm.policies.mu.Unlock()
+			if len(violations) > 0 {
+				return fmt.Errorf("%w: %w", ErrPolicyViolation, &violations[0])
+			}
+			return nil
+		},
+		AfterOperation: func(ctx context.Context, op Operation) {
+			env := sm.scriptEnv(op)
+			sm.policies.mu.Lock()
+			defer sm.policies.mu.Unlock()
+			sm.policies.activity.record(sm.policies.defined, env)
+		},
+	}
+}
+
+// PolicyDecision is the outcome of an operation in a policy simulation.
+type PolicyDecision struct {
+	Operation  Operation         `json:"operation"`
+	Allowed    bool              `json:"allowed"`
+	Violations []PolicyViolation `json:"violations,omitempty"`
+	Error      string            `json:"error,omitempty"` // of applying the operation, if allowed
+}
+
+// SimulatePolicies decides ops in order under policies, or the policies set
+// if nil, without changing anything, e.g. to test policies before setting
+// them. Operations are evaluated at their Time, or now, against the current
+// balances and the activity of the policies set; allowed operations are
+// applied to a copy of the balances, so later operations see their effect
+// on balances and limits.
+func (sm *StateMachine) SimulatePolicies(ctx context.Context, policies []Policy, ops []Operation) ([]PolicyDecision, error) {
+	sm.policies.mu.Lock()
+	compiled, activity := sm.policies.defined, sm.policies.activity.clone()
+	sm.policies.mu.Unlock()
+	if policies != nil {
+		var err error
+		if compiled, err = compilePolicies(policies); err != nil {
+			return nil, err
+		}
+		activity.retain(compiled)
+	}
+
+	var decisions []PolicyDecision
+	_, err := sm.SimulateContext(ctx, func(scratch *StateMachine) error {
+		for _, op := range ops {
+			env := &scriptEnv{op: op, now: sm.now(), balance: scratch.Balance}
+			decision := PolicyDecision{Operation: op, Violations: evaluatePolicies(compiled, activity, env)}
+			if decision.Allowed = len(decision.Violations) == 0; decision.Allowed {
+				if _, err := scratch.Apply(op); err != nil {
+					decision.Error = err.Error()
+				} else {
+					activity.record(compiled, env)
+				}
+			}
+			decisions = append(decisions, decision)
+		}
+		return nil
+	})
+	return decisions, err
+}
+
+// PolicyFormat is the format of a policy file, see ReadPolicies.
+type PolicyFormat string
+
+const (
+	PolicyYAML PolicyFormat = "yaml"
+	PolicyJSON PolicyFormat = "json"
+)
+
+// LoadPolicies reads the policies in the file at path, in YAML if its name
+// ends in .yaml or .yml, or else in JSON.
+func LoadPolicies(path string) ([]Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadPolicies(f, policyFileFormat(path))
+}
+
+func policyFileFormat(path string) PolicyFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return PolicyYAML
+	}
+	return PolicyJSON
+}
+
+// ReadPolicies reads a list of policies. In JSON, it is an array of the
+// policies; in YAML, a sequence of mappings of their fields, e.g.
+//
+//	# policies.yaml
+//	- name: withdrawal-cap
+//	  types: [withdraw, transfer]
+//	  max_amount: 5000 # per operation
+//
+// of which only this subset of YAML is understood: scalars, which may be
+// quoted, and lists in brackets.
+func ReadPolicies(r io.Reader, format PolicyFormat) ([]Policy, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var policies []Policy
+	switch format {
+	case PolicyJSON:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&policies); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPolicy, err)
+		}
+	case PolicyYAML:
+		if policies, err = parsePolicyYAML(data); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPolicy, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidPolicy, format)
+	}
+	return policies, nil
+}
+
+func parsePolicyYAML(data []byte) ([]Policy, error) {
+	var policies []Policy
+	for n, line := range strings.Split(string(data), "\n") {
+		line = stripPolicyComment(line)
+		entry := strings.TrimSpace(line)
+		if entry == "" {
+			continue
+		}
+
+		if item, ok := strings.CutPrefix(entry, "-"); ok && (item == "" || item[0] == ' ' || item[0] == '\t') {
+			policies = append(policies, Policy{})
+			if entry = strings.TrimSpace(item); entry == "" {
+				continue
+			}
+		} else if len(policies) == 0 || line[0] != ' ' && line[0] != '\t' {
+			return nil, fmt.Errorf("line %d: expected \"- key: value\"", n+1)
+		}
+
+		key, value, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", n+1)
+		}
+		if err := policies[len(policies)-1].set(strings.TrimSpace(key), strings.TrimSpace(value)); err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", n+1, strings.TrimSpace(key), err)
+		}
+	}
+	return policies, nil
+}
+
+// set sets the field of the policy named key, as in JSON, from a YAML value.
+func (p *Policy) set(key, value string) error {
+	var err error
+	switch key {
+	case "name":
+		p.Name = policyScalar(value)
+	case "when":
+		p.When = policyScalar(value)
+	case "window":
+		p.Window = policyScalar(value)
+	case "hours":
+		p.Hours = policyScalar(value)
+	case "require":
+		p.Require = policyScalar(value)
+	case "message":
+		p.Message = policyScalar(value)
+	case "min_amount":
+		p.MinAmount, err = strconv.Atoi(value)
+	case "max_amount":
+		p.MaxAmount, err = strconv.Atoi(value)
+	case "limit":
+		p.Limit, err = strconv.Atoi(value)
+	case "types":
+		var types []string
+		if types, err = policyList(value); err == nil {
+			p.Types = nil
+			for _, t := range types {
+				p.Types = append(p.Types, OperationType(t))
+			}
+		}
+	case "accounts":
+		p.Accounts, err = policyList(value)
+	case "counterparties":
+		p.Counterparties, err = policyList(value)
+	case "days":
+		p.Days, err = policyList(value)
+	default:
+		err = errors.New("unknown field")
+	}
+	return err
+}
+
+// stripPolicyComment strips a comment, starting with # at the start of the
+// line or after a space, outside quotes.
+func stripPolicyComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// policyScalar unquotes a quoted YAML scalar.
+func policyScalar(value string) string {
+	if len(value) < 2 || value[0] != value[len(value)-1] {
+		return value
+	}
+	switch value[0] {
+	case '"':
+		if s, err := strconv.Unquote(value); err == nil {
+			return s
+		}
+	case '\'':
+		if s := value[1 : len(value)-1]; !strings.Contains(s, "'") {
+			return s
+		}
+	}
+	return value
+}
+
+// policyList parses a YAML list in brackets, e.g. [acc1, "acc 2"].
+func policyList(value string) ([]string, error) {
+	inner, ok := strings.CutPrefix(value, "[")
+	if inner, ok = strings.CutSuffix(inner, "]"); !ok {
+		return nil, errors.New("expected a list like [a, b]")
+	}
+
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i <= len(inner); i++ {
+		if i < len(inner) {
+			c := inner[i]
+			if quote != 0 {
+				if c == quote {
+					quote = 0
+				}
+				continue
+			}
+			if c == '"' || c == '\'' {
+				quote = c
+			}
+			if c != ',' {
+				continue
+			}
+		}
+		if item := strings.TrimSpace(inner[start:i]); item != "" {
+			items = append(items, policyScalar(item))
+		}
+		start = i + 1
+	}
+	return items, nil
+}
+
+// LoadPolicyFile sets the policies in the file at path, see LoadPolicies
+// and SetPolicies.
+func (sm *StateMachine) LoadPolicyFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return sm.setPolicyFile(path, data)
+}
+
+func (sm *StateMachine) setPolicyFile(path string, data []byte) error {
+	policies, err := ReadPolicies(bytes.NewReader(data), policyFileFormat(path))
+	if err != nil {
+		return err
+	}
+	if err := sm.SetPolicies(policies); err != nil {
+		return err
+	}
+	sm.policies.mu.Lock()
+	sm.policies.file = data
+	sm.policies.mu.Unlock()
+	return nil
+}
+
+// RunPolicyReload sets the policies in the file at path again whenever it
+// changes, checking every interval, until ctx is done, so policies can be
+// changed without restarting. A file that cannot be read or holds invalid
+// policies is reported, and the policies in place are kept.
+func (sm *StateMachine) RunPolicyReload(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var failed []byte // content last reported invalid
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Println("Policy Error:", err)
+			continue
+		}
+		sm.policies.mu.Lock()
+		unchanged := bytes.Equal(data, sm.policies.file)
+		sm.policies.mu.Unlock()
+		if unchanged || failed != nil && bytes.Equal(data, failed) {
+			continue
+		}
+
+		if err := sm.setPolicyFile(path, data); err != nil {
+			fmt.Println("Policy Error:", err)
+			failed = data
+			continue
+		}
+		fmt.Println("Reloaded policies from", path)
+	}
+}
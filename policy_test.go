@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPoliciesYAML = `
+# Withdrawals and transfers of at most 500 each, and 800 a day.
+- name: cap
+  types: [withdraw, transfer]
+  max_amount: 500
+  limit: 800
+  window: 24h
+- name: payroll
+  accounts: ["payroll"]
+  counterparties: [alice, 'bob']
+  hours: 09:00-17:00 # business hours
+  days: [mon, tue, wed, thu, fri]
+-
+  name: reserve
+  when: op.from == "ops" # and no other
+  require: balance(op.from) - op.amount >= 100
+  message: 'ops must keep a reserve of 100'
+`
+
+func testPolicies() []Policy {
+	return []Policy{
+		{Name: "cap", Types: []OperationType{OpWithdraw, OpTransfer}, MaxAmount: 500, Limit: 800, Window: "24h"},
+		{Name: "payroll", Accounts: []string{"payroll"}, Counterparties: []string{"alice", "bob"}, Hours: "09:00-17:00", Days: []string{"mon", "tue", "wed", "thu", "fri"}},
+		{Name: "reserve", When: `op.from == "ops"`, Require: "balance(op.from) - op.amount >= 100", Message: "ops must keep a reserve of 100"},
+	}
+}
+
+func TestReadPolicies(t *testing.T) {
+	policies, err := ReadPolicies(strings.NewReader(testPoliciesYAML), PolicyYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(policies, testPolicies()) {
+		t.Errorf("ReadPolicies(yaml) = %+v; want %+v", policies, testPolicies())
+	}
+
+	data, err := json.Marshal(testPolicies())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies, err := ReadPolicies(strings.NewReader(string(data)), PolicyJSON); err != nil || !reflect.DeepEqual(policies, testPolicies()) {
+		t.Errorf("ReadPolicies(json) = %+v, %v; want %+v", policies, err, testPolicies())
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		format  PolicyFormat
+	}{
+		{"Not a list", "name: cap\n", PolicyYAML},
+		{"Unknown field", "- name: cap\n  max: 5\n", PolicyYAML},
+		{"Not a number", "- name: cap\n  max_amount: lots\n", PolicyYAML},
+		{"Not a list of types", "- name: cap\n  types: withdraw\n", PolicyYAML},
+		{"No value", "- name: cap\n  types\n", PolicyYAML},
+		{"Unknown JSON field", `[{"name": "cap", "max": 5}]`, PolicyJSON},
+		{"Unknown format", "[]", "toml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadPolicies(strings.NewReader(tt.content), tt.format); !errors.Is(err, ErrInvalidPolicy) {
+				t.Errorf("ReadPolicies() error = %v; want %v", err, ErrInvalidPolicy)
+			}
+		})
+	}
+}
+
+func TestSetPoliciesInvalid(t *testing.T) {
+	tests := []struct {
+		name     string
+		policies []Policy
+	}{
+		{"No name", []Policy{{MaxAmount: 5}}},
+		{"Defined twice", []Policy{{Name: "cap"}, {Name: "cap"}}},
+		{"Negative amount", []Policy{{Name: "cap", MaxAmount: -1}}},
+		{"Minimum above maximum", []Policy{{Name: "cap", MinAmount: 10, MaxAmount: 5}}},
+		{"Limit without window", []Policy{{Name: "cap", Limit: 10}}},
+		{"Window without limit", []Policy{{Name: "cap", Window: "24h"}}},
+		{"Bad window", []Policy{{Name: "cap", Limit: 10, Window: "daily"}}},
+		{"Bad hours", []Policy{{Name: "cap", Hours: "9-5"}}},
+		{"Unknown day", []Policy{{Name: "cap", Days: []string{"someday"}}}},
+		{"Unknown type", []Policy{{Name: "cap", Types: []OperationType{"mint"}}}},
+		{"Condition not bool", []Policy{{Name: "cap", When: "op.amount"}}},
+		{"Invalid requirement", []Policy{{Name: "cap", Require: "op.amount >"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+			if err := sm.SetPolicies([]Policy{{Name: "kept", MaxAmount: 50}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := sm.SetPolicies(tt.policies); !errors.Is(err, ErrInvalidPolicy) {
+				t.Fatalf("SetPolicies() error = %v; want %v", err, ErrInvalidPolicy)
+			}
+			if policies := sm.Policies(); len(policies) != 1 || policies[0].Name != "kept" {
+				t.Errorf("Policies() = %+v; want the previous policies kept", policies)
+			}
+		})
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)) // a Monday
+	sm := &StateMachine{accounts: map[string]int{"acc1": 5000, "payroll": 5000, "ops": 500, "alice": 0, "eve": 0}}
+	sm.UseClock(clock)
+	if err := sm.SetPolicies(testPolicies()); err != nil {
+		t.Fatal(err)
+	}
+
+	violation := func(err error, policy, constraint string) bool {
+		var v *PolicyViolation
+		return errors.Is(err, ErrVetoed) && errors.Is(err, ErrPolicyViolation) && errors.As(err, &v) && v.Policy == policy && v.Constraint == constraint
+	}
+
+	if err := sm.Withdraw("acc1", 600); !violation(err, "cap", "max_amount") {
+		t.Errorf("Withdraw(600) error = %v; want cap's max_amount broken", err)
+	}
+	if err := sm.Deposit("acc1", 600); err != nil {
+		t.Errorf("Deposit(600) = %v; want deposits not capped", err)
+	}
+	for _, amount := range []int{500, 300} {
+		if err := sm.Withdraw("acc1", amount); err != nil {
+			t.Fatalf("Withdraw(%d) = %v", amount, err)
+		}
+	}
+	if err := sm.Withdraw("acc1", 1); !violation(err, "cap", "limit") {
+		t.Errorf("Withdraw() above the daily limit error = %v; want cap's limit broken", err)
+	}
+	if err := sm.Withdraw("payroll", 1); err != nil {
+		t.Errorf("Withdraw() from another account = %v; want limits per account", err)
+	}
+	clock.Advance(24 * time.Hour)
+	if err := sm.Withdraw("acc1", 100); err != nil {
+		t.Errorf("Withdraw() a day later = %v; want the limit's window passed", err)
+	}
+
+	if err := sm.Transfer("payroll", "eve", 10); !violation(err, "payroll", "counterparties") {
+		t.Errorf("Transfer() to eve error = %v; want payroll's counterparties broken", err)
+	}
+	if err := sm.Transfer("payroll", "alice", 10); err != nil {
+		t.Errorf("Transfer() to alice = %v", err)
+	}
+	clock.Set(time.Date(2026, 3, 3, 18, 0, 0, 0, time.UTC))
+	if err := sm.Transfer("payroll", "alice", 10); !violation(err, "payroll", "hours") {
+		t.Errorf("Transfer() at 18:00 error = %v; want payroll's hours broken", err)
+	}
+	clock.Set(time.Date(2026, 3, 7, 10, 0, 0, 0, time.UTC))
+	if err := sm.Transfer("payroll", "alice", 10); !violation(err, "payroll", "days") {
+		t.Errorf("Transfer() on a Saturday error = %v; want payroll's days broken", err)
+	}
+
+	err := sm.Withdraw("ops", 450)
+	if !violation(err, "reserve", "require") || !strings.Contains(err.Error(), "ops must keep a reserve of 100") {
+		t.Errorf("Withdraw() below the reserve error = %v; want reserve's message", err)
+	}
+	if err := sm.Withdraw("ops", 350); err != nil {
+		t.Errorf("Withdraw() above the reserve = %v", err)
+	}
+
+	// Replacing the policies applies right away.
+	if err := sm.SetPolicies(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Withdraw("acc1", 600); err != nil {
+		t.Errorf("Withdraw(600) without policies = %v", err)
+	}
+}
+
+func TestPolicyHours(t *testing.T) {
+	tests := []struct {
+		hours string
+		at    int // hour of the day
+		want  bool
+	}{
+		{"09:00-17:00", 9, true},
+		{"09:00-17:00", 16, true},
+		{"09:00-17:00", 17, false},
+		{"09:00-17:00", 3, false},
+		{"22:00-06:00", 23, true},
+		{"22:00-06:00", 2, true},
+		{"22:00-06:00", 12, false},
+	}
+	for _, tt := range tests {
+		c, err := compilePolicy(Policy{Name: "hours", Hours: tt.hours})
+		if err != nil {
+			t.Fatal(err)
+		}
+		env := &scriptEnv{op: Operation{Type: OpDeposit, To: "acc1", Amount: 1, Time: time.Date(2026, 3, 2, tt.at, 30, 0, 0, time.UTC)}}
+		if got := c.check(env, &policyActivity{}) == nil; got != tt.want {
+			t.Errorf("%s at %d:30 allowed = %t; want %t", tt.hours, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestSimulatePolicies(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 5000, "ops": 500}}
+	if err := sm.SetPolicies(testPolicies()); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Withdraw("acc1", 500); err != nil {
+		t.Fatal(err)
+	}
+
+	at := time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC)
+	ops := []Operation{
+		{Type: OpWithdraw, From: "acc1", Amount: 200, Time: at},
+		{Type: OpWithdraw, From: "acc1", Amount: 200, Time: at}, // above the daily limit, counting the first
+		{Type: OpWithdraw, From: "ops", Amount: 350, Time: at},
+		{Type: OpWithdraw, From: "ops", Amount: 100, Time: at}, // below the reserve after the previous
+		{Type: OpWithdraw, From: "unknown", Amount: 1, Time: at},
+	}
+	decisions, err := sm.SimulatePolicies(context.Background(), nil, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		allowed    bool
+		constraint string
+		failed     bool
+	}{{true, "", false}, {false, "limit", false}, {true, "", false}, {false, "require", false}, {true, "", true}}
+	if len(decisions) != len(want) {
+		t.Fatalf("SimulatePolicies() = %d decisions; want %d", len(decisions), len(want))
+	}
+	for i, d := range decisions {
+		constraint := ""
+		if len(d.Violations) > 0 {
+			constraint = d.Violations[0].Constraint
+		}
+		if d.Allowed != want[i].allowed || constraint != want[i].constraint || (d.Error != "") != want[i].failed {
+			t.Errorf("Decision %d = %+v; want allowed %t, constraint %q", i, d, want[i].allowed, want[i].constraint)
+		}
+	}
+	if balances := sm.Balances(); balances["acc1"] != 4500 || balances["ops"] != 500 {
+		t.Errorf("Balances() = %v; want unchanged by the simulation", balances)
+	}
+
+	// Policies not yet set can be tried out.
+	decisions, err = sm.SimulatePolicies(context.Background(), []Policy{{Name: "tiny", MaxAmount: 100}}, ops[:1])
+	if err != nil || len(decisions) != 1 || decisions[0].Allowed || decisions[0].Violations[0].Policy != "tiny" {
+		t.Errorf("SimulatePolicies(tiny) = %+v, %v; want the withdrawal denied by tiny", decisions, err)
+	}
+	if _, err := sm.SimulatePolicies(context.Background(), []Policy{{}}, ops); !errors.Is(err, ErrInvalidPolicy) {
+		t.Errorf("SimulatePolicies() of invalid policies error = %v; want %v", err, ErrInvalidPolicy)
+	}
+}
+
+func TestRunPolicyReload(t *testing.T) {
+	quiet(t)
+
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	if err := os.WriteFile(path, []byte("- name: cap\n  max_amount: 500\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000}}
+	if err := sm.LoadPolicyFile(path); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sm.RunPolicyReload(ctx, path, time.Millisecond)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor := func(max int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if policies := sm.Policies(); len(policies) == 1 && policies[0].MaxAmount == max {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("Policies() = %+v; want a maximum of %d", sm.Policies(), max)
+	}
+
+	if err := os.WriteFile(path, []byte("- name: cap\n  max_amount: 100\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(100)
+	if err := sm.Withdraw("acc1", 200); !errors.Is(err, ErrPolicyViolation) {
+		t.Errorf("Withdraw(200) error = %v; want %v", err, ErrPolicyViolation)
+	}
+
+	// Invalid policies leave those in place.
+	if err := os.WriteFile(path, []byte("- name: cap\n  max_amount: -1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	waitFor(100)
+}
+
+func TestServerPolicies(t *testing.T) {
+	quiet(t)
+
+	srv, _ := newTestServer(map[string]int{"acc1": 1000})
+	do := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := do(http.MethodPut, "/policies", "application/yaml", "- name: cap\n  max_amount: 500\n")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /policies = %d; want 200 (%s)", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/policies", "application/json", `[{"name": "cap", "min_amount": 5, "max_amount": 1}]`); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT of invalid policies = %d; want 400", rec.Code)
+	}
+
+	var policies []Policy
+	if err := json.Unmarshal(do(http.MethodGet, "/policies", "", "").Body.Bytes(), &policies); err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies[0].MaxAmount != 500 {
+		t.Errorf("GET /policies = %+v; want cap", policies)
+	}
+
+	if rec := do(http.MethodPost, "/accounts/acc1/withdraw", "application/json", `{"amount": 600}`); rec.Code != http.StatusForbidden {
+		t.Errorf("POST withdraw above the cap = %d; want 403 (%s)", rec.Code, rec.Body)
+	}
+
+	rec = do(http.MethodPost, "/policies/simulate", "application/json", `{"operations": [{"type": "withdraw", "from": "acc1", "amount": 600}, {"type": "withdraw", "from": "acc1", "amount": 60}]}`)
+	var decisions []PolicyDecision
+	if err := json.Unmarshal(rec.Body.Bytes(), &decisions); err != nil {
+		t.Fatalf("POST /policies/simulate = %d (%s): %v", rec.Code, rec.Body, err)
+	}
+	if len(decisions) != 2 || decisions[0].Allowed || !decisions[1].Allowed {
+		t.Errorf("POST /policies/simulate = %+v; want the first withdrawal denied", decisions)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// propertyAccounts are the accounts operation sequences are generated over.
+// The last one does not exist.
+var propertyAccounts = []string{"acc1", "acc2", "acc3", "nope"}
+
+// FuzzStateMachine applies random operation sequences, decoded four bytes
+// per operation, and checks the state machine's invariants after every step:
+//
+//   - balances never go negative,
+//   - money is only created by deposits and destroyed by withdrawals,
+//   - Rollback and RollbackTo restore exactly the earlier states.
+//
+// Run it with go test -fuzz FuzzStateMachine.
+func FuzzStateMachine(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 50, 1, 1, 0, 200, 2, 0, 1, 30, 3, 0, 0, 0})
+	f.Add([]byte{2, 0, 2, 255, 3, 0, 0, 0, 3, 0, 0, 0, 0, 3, 0, 10})
+	f.Add([]byte{0, 1, 0, 1, 4, 0, 0, 1, 5, 0, 0, 0, 1, 2, 0, 1, 4, 1, 1, 0})
+
+	quiet(f)
+	f.Fuzz(checkOperationSequence)
+}
+
+// TestStateMachineProperties checks the invariants of FuzzStateMachine
+// against a fixed set of random operation sequences.
+func TestStateMachineProperties(t *testing.T) {
+	quiet(t)
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range 200 {
+		data := make([]byte, 4*rng.IntN(100))
+		for j := range data {
+			data[j] = byte(rng.Uint32())
+		}
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			checkOperationSequence(t, data)
+		})
+	}
+}
+
+// checkOperationSequence applies the operations data decodes to and checks
+// the invariants after every step.
+func checkOperationSequence(t *testing.T, data []byte) {
+	initial := map[string]int{"acc1": 1000, "acc2": 500, "acc3": 0}
+	sm := &StateMachine{accounts: maps.Clone(initial)}
+
+	states := []map[string]int{maps.Clone(initial)} // expected state at every version
+	total := 1500                                   // expected sum of balances
+
+	for ; len(data) >= 4; data = data[4:] {
+		from := propertyAccounts[int(data[1])%len(propertyAccounts)]
+		to := propertyAccounts[int(data[2])%len(propertyAccounts)]
+		amount := int(data[3]) * 7
+
+		var err error
+		switch data[0] % 6 {
+		case 0:
+			if err = sm.Deposit(to, amount); err == nil {
+				total += amount
+			}
+		case 1:
+			if err = sm.Withdraw(from, amount); err == nil {
+				total -= amount
+			}
+		case 2:
+			err = sm.Transfer(from, to, amount)
+		case 3:
+			err = sm.Rollback()
+			if len(states) == 1 {
+				if !errors.Is(err, ErrNothingToRollback) {
+					t.Fatalf("Rollback of empty history = %v; want %v", err, ErrNothingToRollback)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("Rollback failed: %v", err)
+			}
+			states = states[:len(states)-1]
+			total = sum(states[len(states)-1])
+		case 4:
+			version := int(data[3]) % len(states)
+			if err := sm.RollbackTo(version); err != nil {
+				t.Fatalf("RollbackTo(%d) failed: %v", version, err)
+			}
+			states = states[:version+1]
+			total = sum(states[version])
+		case 5:
+			ops := sm.Operations()
+			if len(ops) == 0 {
+				continue
+			}
+			op := ops[int(data[3])%len(ops)]
+			var reversal Operation
+			if reversal, err = sm.Reverse(op.ID); err == nil {
+				if reversal.Type == OpDeposit {
+					total += reversal.Amount
+				} else if reversal.Type == OpWithdraw {
+					total -= reversal.Amount
+				}
+			}
+		}
+
+		if data[0]%6 < 3 || data[0]%6 == 5 {
+			if sm.Version() == len(states) {
+				states = append(states, maps.Clone(sm.accounts))
+			} else if err == nil {
+				t.Fatalf("Version = %d after operation; want %d", sm.Version(), len(states))
+			}
+		}
+
+		for acc, balance := range sm.accounts {
+			if balance < 0 {
+				t.Fatalf("Account %s balance = %d; want non-negative", acc, balance)
+			}
+		}
+		if got := sum(sm.accounts); got != total {
+			t.Fatalf("Total balance = %d; want %d", got, total)
+		}
+		if expected := states[len(states)-1]; !maps.Equal(sm.accounts, expected) {
+			t.Fatalf("Accounts = %v; want %v", sm.accounts, expected)
+		}
+	}
+
+	if err := sm.RollbackTo(0); err != nil {
+		t.Fatalf("RollbackTo(0) failed: %v", err)
+	}
+	if !maps.Equal(sm.accounts, initial) {
+		t.Fatalf("Accounts after RollbackTo(0) = %v; want %v", sm.accounts, initial)
+	}
+}
+
+// quiet discards what operations print for the rest of the test, which would
+// otherwise flood the output of property tests.
+func quiet(tb testing.TB) {
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = devNull
+	tb.Cleanup(func() {
+		os.Stdout = stdout
+		devNull.Close()
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Tombstone records operations pruned from history, and where they were
+// exported to before being pruned, so the audit trail of an account shows
+// what is missing from it and where to find it.
+type Tombstone struct {
+	Account  string    `json:"account"`  // whose history was pruned
+	Accounts []string  `json:"accounts"` // every account of the pruned operations
+	Before   time.Time `json:"before"`   // operations applied before were pruned
+	Count    int       `json:"count"`
+	FirstID  string    `json:"first_id"`
+	LastID   string    `json:"last_id"`
+	Export   string    `json:"export"` // key of the export in the object store
+	PrunedAt time.Time `json:"pruned_at"`
+}
+
+// historyExport is what PruneAccountHistory exports.
+type historyExport struct {
+	Account    string      `json:"account"`
+	Before     time.Time   `json:"before"`
+	Operations []Operation `json:"operations"`
+}
+
+// prunable reports whether op may be pruned from history. Archivals,
+// restores and status changes are kept, as rollbacks rely on them.
+func prunable(op Operation) bool {
+	return op.Type != OpArchive && op.Type != OpUnarchive && op.Type != OpSetStatus
+}
+
+// PruneAccountHistory prunes the operations of an account applied before
+// before from history, for retention. The operations are first exported to
+// store under prefix, and only pruned once the export succeeded; a
+// Tombstone recording them and the key of the export is kept in their place
+// and returned. Operations also involve other accounts, such as the
+// receiver of a transfer: they leave the history of those too, and the
+// tombstone lists every account concerned. If there is nothing to prune, a
+// tombstone with a zero Count is returned and none is kept.
+func (sm *StateMachine) PruneAccountHistory(ctx context.Context, store ObjectStore, prefix, accountId string, before time.Time) (Tombstone, error) {
+	sm.mu.Lock()
+	var pruned []Operation
+	for _, op := range sm.journal {
+		if !op.Time.Before(before) {
+			break
+		}
+		if prunable(op) && slices.Contains(op.accounts(), accountId) {
+			pruned = append(pruned, op)
+		}
+	}
+	sm.mu.Unlock()
+
+	now := sm.now()
+	tombstone := Tombstone{Account: accountId, Before: before, Count: len(pruned), PrunedAt: now}
+	if len(pruned) == 0 {
+		return tombstone, nil
+	}
+
+	data, err := json.Marshal(historyExport{Account: accountId, Before: before, Operations: pruned})
+	if err != nil {
+		return Tombstone{}, err
+	}
+	tombstone.Export = fmt.Sprintf("%shistory/%s/%s.json", prefix, accountId, now.UTC().Format(archiveTimeFormat))
+	if err := store.Put(ctx, tombstone.Export, data); err != nil {
+		return Tombstone{}, fmt.Errorf("export history of %s to %s: %w", accountId, tombstone.Export, err)
+	}
+
+	ids := make(map[string]bool, len(pruned))
+	for _, op := range pruned {
+		ids[op.ID] = true
+		for _, id := range op.accounts() {
+			if !slices.Contains(tombstone.Accounts, id) {
+				tombstone.Accounts = append(tombstone.Accounts, id)
+			}
+		}
+	}
+	slices.Sort(tombstone.Accounts)
+	tombstone.FirstID, tombstone.LastID = pruned[0].ID, pruned[len(pruned)-1].ID
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	// Operations rolled back since they were exported are already gone.
+	sm.journal = slices.DeleteFunc(sm.journal, func(op Operation) bool { return ids[op.ID] })
+	sm.opIndex.rebuild(sm.journal, sm.opIndex.start)
+	sm.tombstones = append(sm.tombstones, tombstone)
+	return tombstone, nil
+}
+
+// PruneHistory prunes the history of every account with operations applied
+// before before, see PruneAccountHistory, and returns the tombstones kept.
+// It stops at the first export that fails.
+func (sm *StateMachine) PruneHistory(ctx context.Context, store ObjectStore, prefix string, before time.Time) ([]Tombstone, error) {
+	sm.mu.Lock()
+	var accounts []string
+	for _, op := range sm.journal {
+		if !op.Time.Before(before) {
+			break
+		}
+		if prunable(op) {
+			for _, id := range op.accounts() {
+				if !slices.Contains(accounts, id) {
+					accounts = append(accounts, id)
+				}
+			}
+		}
+	}
+	sm.mu.Unlock()
+
+	slices.Sort(accounts)
+	var tombstones []Tombstone
+	for _, id := range accounts {
+		tombstone, err := sm.PruneAccountHistory(ctx, store, prefix, id, before)
+		if err != nil {
+			return tombstones, err
+		}
+		if tombstone.Count > 0 {
+			tombstones = append(tombstones, tombstone)
+		}
+	}
+	return tombstones, nil
+}
+
+// Tombstones returns the tombstones of the operations of an account pruned
+// from history, oldest first.
+func (sm *StateMachine) Tombstones(accountId string) []Tombstone {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	var tombstones []Tombstone
+	for _, t := range sm.tombstones {
+		if slices.Contains(t.Accounts, accountId) {
+			t.Accounts = slices.Clone(t.Accounts)
+			tombstones = append(tombstones, t)
+		}
+	}
+	return tombstones
+}
+
+// RunHistoryPruning prunes the operations older than retention from history
+// every interval until ctx is done, exporting them to store first.
+func (sm *StateMachine) RunHistoryPruning(ctx context.Context, store ObjectStore, prefix string, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			tombstones, err := sm.PruneHistory(ctx, store, prefix, sm.now().Add(-retention))
+			if err != nil && ctx.Err() == nil {
+				fmt.Println("History Pruning Error:", err)
+			}
+			for _, t := range tombstones {
+				fmt.Printf("\n\nPruned %d operations of %s, exported to %s\n", t.Count, t.Account, t.Export)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
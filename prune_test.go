@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// failingStore is an ObjectStore whose writes fail.
+type failingStore struct{ memStore }
+
+func (f *failingStore) Put(ctx context.Context, key string, data []byte) error {
+	return errors.New("bucket unreachable")
+}
+
+func TestPruneAccountHistory(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 0, "acc3": 0}}
+	sm.UseClock(clock)
+	for _, apply := range []func() error{
+		func() error { return sm.Transfer("acc1", "acc2", 10) },
+		func() error { return sm.Deposit("acc3", 10) },
+		func() error { return sm.SetAccountStatus("acc1", StatusRestricted, "review") },
+		func() error { return sm.SetAccountStatus("acc1", StatusActive, "cleared") },
+		func() error { return sm.Withdraw("acc1", 5) },
+	} {
+		if err := apply(); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Hour)
+	}
+	before := clock.Now().Add(-90 * time.Minute) // after all but the withdrawal
+	ops := sm.Operations()
+
+	if _, err := sm.PruneAccountHistory(context.Background(), &failingStore{}, "prod/", "acc1", before); err == nil {
+		t.Fatal("PruneAccountHistory() with a failing store succeeded")
+	}
+	if len(sm.Operations()) != len(ops) {
+		t.Fatalf("Operations() after a failed export = %d; want %d", len(sm.Operations()), len(ops))
+	}
+
+	store := &memStore{}
+	tombstone, err := sm.PruneAccountHistory(context.Background(), store, "prod/", "acc1", before)
+	if err != nil {
+		t.Fatalf("PruneAccountHistory() error = %v", err)
+	}
+	expected := Tombstone{
+		Account:  "acc1",
+		Accounts: []string{"acc1", "acc2"},
+		Before:   before,
+		Count:    1,
+		FirstID:  ops[0].ID,
+		LastID:   ops[0].ID,
+		Export:   "prod/history/acc1/20260101T050000.000000000Z.json",
+		PrunedAt: clock.Now(),
+	}
+	if !reflect.DeepEqual(tombstone, expected) {
+		t.Errorf("PruneAccountHistory() = %+v; want %+v", tombstone, expected)
+	}
+
+	var export historyExport
+	if err := json.Unmarshal(store.objects[expected.Export], &export); err != nil {
+		t.Fatal(err)
+	}
+	if len(export.Operations) != 1 || export.Operations[0].ID != ops[0].ID {
+		t.Errorf("Exported operations = %+v; want the transfer", export.Operations)
+	}
+
+	var types []OperationType
+	for _, op := range sm.Operations() {
+		types = append(types, op.Type)
+	}
+	if expectedTypes := []OperationType{OpDeposit, OpSetStatus, OpSetStatus, OpWithdraw}; !reflect.DeepEqual(types, expectedTypes) {
+		t.Errorf("Operations() after pruning = %v; want %v", types, expectedTypes)
+	}
+	if ops := sm.SearchOperations(OperationFilter{Account: "acc2"}); len(ops) != 0 {
+		t.Errorf("SearchOperations() of acc2 = %+v; want none", ops)
+	}
+	if tombstones := sm.Tombstones("acc2"); len(tombstones) != 1 || tombstones[0].Export != expected.Export {
+		t.Errorf("Tombstones() of acc2 = %+v; want the tombstone of acc1", tombstones)
+	}
+	if tombstones := sm.Tombstones("acc3"); len(tombstones) != 0 {
+		t.Errorf("Tombstones() of acc3 = %+v; want none", tombstones)
+	}
+
+	tombstones, err := sm.PruneHistory(context.Background(), store, "prod/", before)
+	if err != nil || len(tombstones) != 1 || tombstones[0].Account != "acc3" {
+		t.Errorf("PruneHistory() = %+v, %v; want the deposit of acc3", tombstones, err)
+	}
+
+	var buf bytes.Buffer
+	if err := sm.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	restored := &StateMachine{}
+	if err := restored.Restore(&buf, LatestVersion); err != nil {
+		t.Fatal(err)
+	}
+	if len(restored.Tombstones("acc1")) != 1 || len(restored.Tombstones("acc3")) != 1 {
+		t.Errorf("Tombstones() after Restore = %+v, %+v; want one each", restored.Tombstones("acc1"), restored.Tombstones("acc3"))
+	}
+}
+
+func TestServerTombstones(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 100})
+	if err := sm.Deposit("acc1", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.PruneAccountHistory(context.Background(), &memStore{}, "", "acc1", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/accounts/acc1/tombstones", nil))
+	var tombstones []Tombstone
+	if err := json.Unmarshal(rec.Body.Bytes(), &tombstones); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /accounts/acc1/tombstones = %d, %s", rec.Code, rec.Body)
+	}
+	if len(tombstones) != 1 || tombstones[0].Count != 1 {
+		t.Errorf("GET /accounts/acc1/tombstones = %+v; want one pruned operation", tombstones)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrQuotaExceeded is matched by a QuotaExceededError.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	ErrInvalidQuota  = errors.New("invalid quota")
+)
+
+// Quota limits what a tenant may hold and do, see SetQuota. A zero limit
+// means no limit.
+type Quota struct {
+	MaxAccounts         int `json:"max_accounts,omitempty"`
+	MaxOperationsPerDay int `json:"max_operations_per_day,omitempty"` // per UTC day
+	MaxTotalBalance     int `json:"max_total_balance,omitempty"`      // of all the accounts
+}
+
+// QuotaUsage is what a quota is checked against: the open accounts, the
+// operations applied on the current UTC day and the sum of the balances.
+type QuotaUsage struct {
+	Accounts        int `json:"accounts"`
+	OperationsToday int `json:"operations_today"`
+	TotalBalance    int `json:"total_balance"`
+}
+
+// QuotaExceededError is returned for an operation that would take the usage
+// of a quota past its limit.
+type QuotaExceededError struct {
+	Quota string // max_accounts, max_operations_per_day or max_total_balance
+	Limit int
+	Usage int // with the operation applied
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s: %s is %d, the operation would take it to %d", ErrQuotaExceeded, e.Quota, e.Limit, e.Usage)
+}
+
+func (e *QuotaExceededError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// quota holds the limits and counts the operations of a day, guarded by
+// sm.mu.
+type quota struct {
+	Quota
+	day        time.Time // UTC midnight of the day operations are counted for
+	operations int
+}
+
+// count counts an applied operation. Rollbacks are not counted, nor
+// limited, so a tenant can always undo its changes.
+func (q *quota) count(op Operation) {
+	if op.Type == OpRollback || op.Type == OpRollbackTo {
+		return
+	}
+	if day := op.Time.UTC().Truncate(24 * time.Hour); !day.Equal(q.day) {
+		q.day, q.operations = day, 0
+	}
+	q.operations++
+}
+
+// operationsOn returns the number of operations counted on the day of t.
+func (q *quota) operationsOn(t time.Time) int {
+	if !t.UTC().Truncate(24 * time.Hour).Equal(q.day) {
+		return 0
+	}
+	return q.operations
+}
+
+// SetQuota sets the limits of the state machine, usually a tenant's. They
+// apply to the operations applied from then on: a lower limit than the
+// current usage rejects the operations increasing it, but removes nothing.
+func (sm *StateMachine) SetQuota(q Quota) error {
+	if q.MaxAccounts < 0 || q.MaxOperationsPerDay < 0 || q.MaxTotalBalance < 0 {
+		return fmt.Errorf("%w: limits cannot be negative", ErrInvalidQuota)
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.quota.Quota = q
+	return nil
+}
+
+// Quota returns the limits of the state machine and their usage.
+func (sm *StateMachine) Quota() (Quota, QuotaUsage) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.quota.Quota, sm.quotaUsage()
+}
+
+// quotaUsage returns the current usage of the quota, taking the accounts
+// and their total from the balance index rather than adding them up.
+// sm.mu must be held.
+func (sm *StateMachine) quotaUsage() QuotaUsage {
+	index := sm.index()
+	return QuotaUsage{
+		Accounts:        len(index.ordered),
+		OperationsToday: sm.quota.operationsOn(sm.now()),
+		TotalBalance:    index.total,
+	}
+}
+
+// checkQuota fails with a QuotaExceededError if applying op would exceed a
+// limit of the quota. Only the operations adding accounts or money are
+// checked against those limits, so a tenant over them can still move and
+// take out money. sm.mu must be held.
+func (sm *StateMachine) checkQuota(op Operation) error {
+	q := sm.quota
+	if q.Quota == (Quota{}) || op.Type == OpRollback || op.Type == OpRollbackTo {
+		return nil
+	}
+	if q.MaxOperationsPerDay > 0 {
+		if n := q.operationsOn(op.Time) + 1; n > q.MaxOperationsPerDay {
+			return &QuotaExceededError{Quota: "max_operations_per_day", Limit: q.MaxOperationsPerDay, Usage: n}
+		}
+	}
+
+	var accounts, amount int
+	switch op.Type {
+	case OpOpen:
+		accounts, amount = 1, op.Amount
+	case OpUnarchive:
+		accounts, amount = 1, sm.archived[op.To].Balance
+	case OpDeposit:
+		amount = op.Amount
+	}
+	if accounts == 0 && amount <= 0 {
+		return nil
+	}
+	usage := sm.quotaUsage()
+	if n := usage.Accounts + accounts; q.MaxAccounts > 0 && accounts > 0 && n > q.MaxAccounts {
+		return &QuotaExceededError{Quota: "max_accounts", Limit: q.MaxAccounts, Usage: n}
+	}
+	if n := usage.TotalBalance + amount; q.MaxTotalBalance > 0 && amount > 0 && n > q.MaxTotalBalance {
+		return &QuotaExceededError{Quota: "max_total_balance", Limit: q.MaxTotalBalance, Usage: n}
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateMachineQuota(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name   string
+		quota  Quota
+		run    func(sm *StateMachine) error // the operation exceeding the quota
+		exceed string
+	}{
+		{"Accounts", Quota{MaxAccounts: 2}, func(sm *StateMachine) error {
+			return sm.OpenAccount("acc3", 0)
+		}, "max_accounts"},
+		{"Accounts unarchived", Quota{MaxAccounts: 2}, func(sm *StateMachine) error {
+			if err := sm.ArchiveAccount("acc2"); err != nil {
+				return err
+			}
+			if err := sm.OpenAccount("acc3", 0); err != nil {
+				return err
+			}
+			return sm.UnarchiveAccount("acc2")
+		}, "max_accounts"},
+		{"Total balance", Quota{MaxTotalBalance: 1100}, func(sm *StateMachine) error {
+			if err := sm.Deposit("acc1", 100); err != nil {
+				return err
+			}
+			return sm.Deposit("acc2", 1)
+		}, "max_total_balance"},
+		{"Total balance in a transaction", Quota{MaxTotalBalance: 1100}, func(sm *StateMachine) error {
+			return sm.Tx(func(tx *Tx) error {
+				if err := tx.Deposit("acc1", 100); err != nil {
+					return err
+				}
+				return tx.Deposit("acc2", 1)
+			})
+		}, "max_total_balance"},
+		{"Total balance opening", Quota{MaxTotalBalance: 1100}, func(sm *StateMachine) error {
+			return sm.OpenAccount("acc3", 101)
+		}, "max_total_balance"},
+		{"Operations per day", Quota{MaxOperationsPerDay: 2}, func(sm *StateMachine) error {
+			_ = sm.Transfer("acc1", "acc2", 10)
+			_ = sm.Withdraw("acc1", 10)
+			return sm.Transfer("acc1", "acc2", 10)
+		}, "max_operations_per_day"},
+		{"Operations per day in a transaction", Quota{MaxOperationsPerDay: 2}, func(sm *StateMachine) error {
+			return sm.Tx(func(tx *Tx) error {
+				for range 3 {
+					if err := tx.Transfer("acc1", "acc2", 10); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}, "max_operations_per_day"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+			if err := sm.SetQuota(tt.quota); err != nil {
+				t.Fatal(err)
+			}
+			err := tt.run(sm)
+			var quotaErr *QuotaExceededError
+			if !errors.As(err, &quotaErr) || !errors.Is(err, ErrQuotaExceeded) || quotaErr.Quota != tt.exceed {
+				t.Fatalf("error = %v; want %s exceeded", err, tt.exceed)
+			}
+		})
+	}
+
+	t.Run("Within the quota", func(t *testing.T) {
+		clock := NewFakeClock(time.Date(2026, 1, 1, 23, 0, 0, 0, time.UTC))
+		sm := &StateMachine{accounts: map[string]int{"acc1": 1000}}
+		sm.UseClock(clock)
+		_ = sm.SetQuota(Quota{MaxAccounts: 2, MaxOperationsPerDay: 2, MaxTotalBalance: 1000})
+
+		if err := sm.OpenAccount("acc2", 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := sm.Transfer("acc1", "acc2", 500); err != nil {
+			t.Fatal(err)
+		}
+		// Rollbacks are neither limited nor counted.
+		if err := sm.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Hour) // the next day
+		if err := sm.Withdraw("acc1", 100); err != nil {
+			t.Fatal(err)
+		}
+		if err := sm.Deposit("acc1", 100); err != nil {
+			t.Fatal(err)
+		}
+
+		quota, usage := sm.Quota()
+		if want := (QuotaUsage{Accounts: 2, OperationsToday: 2, TotalBalance: 1000}); usage != want {
+			t.Errorf("Quota() usage = %+v; want %+v", usage, want)
+		}
+		if quota.MaxOperationsPerDay != 2 {
+			t.Errorf("Quota() = %+v", quota)
+		}
+	})
+
+	sm := &StateMachine{accounts: map[string]int{}}
+	if err := sm.SetQuota(Quota{MaxAccounts: -1}); !errors.Is(err, ErrInvalidQuota) {
+		t.Errorf("SetQuota(negative) = %v; want %v", err, ErrInvalidQuota)
+	}
+}
+
+func TestServerTenantQuota(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{})
+	if _, err := sm.CreateTenant("acme", map[string]int{"acc1": 100}, nil); err != nil {
+		t.Fatal(err)
+	}
+	auth := NewAuthenticator(nil)
+	_ = auth.AddAPIKey("root-admin", Principal{Subject: "root", Role: RoleAdmin})
+	_ = auth.AddAPIKey("acme-admin", Principal{Subject: "acme-admin", Role: RoleAdmin, Tenant: "acme"})
+	srv.UseAuth(auth)
+
+	do := func(apiKey, method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(APIKeyHeader, apiKey)
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name           string
+		apiKey         string
+		method, path   string
+		body           string
+		expectedStatus int
+	}{
+		{name: "Tenant admin sets quota", apiKey: "acme-admin", method: "PUT", path: "/tenants/acme/quota", body: `{"max_total_balance": 1000000}`, expectedStatus: http.StatusForbidden},
+		{name: "Negative quota", apiKey: "root-admin", method: "PUT", path: "/tenants/acme/quota", body: `{"max_accounts": -1}`, expectedStatus: http.StatusBadRequest},
+		{name: "Root admin sets quota", apiKey: "root-admin", method: "PUT", path: "/tenants/acme/quota", body: `{"max_total_balance": 150}`, expectedStatus: http.StatusOK},
+		{name: "Deposit within quota", apiKey: "acme-admin", method: "POST", path: "/tenants/acme/accounts/acc1/deposit", body: `{"amount": 50}`, expectedStatus: http.StatusOK},
+		{name: "Deposit over quota", apiKey: "acme-admin", method: "POST", path: "/tenants/acme/accounts/acc1/deposit", body: `{"amount": 1}`, expectedStatus: http.StatusForbidden},
+		{name: "Unknown tenant", apiKey: "root-admin", method: "GET", path: "/tenants/nope/quota", expectedStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.apiKey, tt.method, tt.path, tt.body); rec.Code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+
+	rec := do("root-admin", "GET", "/tenants/acme/quota", "")
+	var got quotaResponse
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := quotaResponse{Quota: Quota{MaxTotalBalance: 150}, Usage: QuotaUsage{Accounts: 1, OperationsToday: 1, TotalBalance: 150}}
+	if got != want {
+		t.Errorf("GET /tenants/acme/quota = %+v; want %+v", got, want)
+	}
+}
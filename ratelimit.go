@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is matched by every *RateLimitError.
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimit configures a token bucket refilled at Rate tokens per second and
+// holding at most Burst tokens. A zero Rate disables the limit.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// capacity is the bucket size, at least one token so the limit can be met.
+func (l RateLimit) capacity() float64 {
+	return math.Max(1, float64(l.Burst))
+}
+
+// RateLimitError is returned when an operation exceeds a rate limit. It is
+// retryable: the same operation is expected to succeed after RetryAfter.
+type RateLimitError struct {
+	Scope      string // "global", "account" or "client"
+	Key        string // account or client id, empty for the global scope
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("%s: %s limit exceeded, retry after %s", ErrRateLimited, e.Scope, e.RetryAfter)
+	}
+	return fmt.Sprintf("%s: %s limit exceeded for %s, retry after %s", ErrRateLimited, e.Scope, e.Key, e.RetryAfter)
+}
+
+func (e *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+func (e *RateLimitError) Retryable() bool {
+	return true
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill tops up the bucket for the time elapsed since it was last used and
+// reports how long until one token is available.
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) time.Duration {
+	b.tokens = math.Min(limit.capacity(), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// RateLimiter applies global, per-account and per-client token buckets.
+type RateLimiter struct {
+	mu  sync.Mutex
+	now func() time.Time
+
+	global  RateLimit
+	account RateLimit
+	client  RateLimit
+	buckets map[string]*tokenBucket // keyed by scope + ":" + key
+}
+
+func NewRateLimiter(global, perAccount, perClient RateLimit) *RateLimiter {
+	return &RateLimiter{
+		now:     time.Now,
+		global:  global,
+		account: perAccount,
+		client:  perClient,
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// Limits returns the global, per-account and per-client limits.
+func (rl *RateLimiter) Limits() (global, perAccount, perClient RateLimit) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.global, rl.account, rl.client
+}
+
+// SetLimits replaces the limits. Buckets keep their tokens, up to the new
+// capacity once they refill.
+func (rl *RateLimiter) SetLimits(global, perAccount, perClient RateLimit) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.global, rl.account, rl.client = global, perAccount, perClient
+}
+
+// AllowOperation takes a token from the global bucket and from the bucket of
+// every account touched by an operation. Either all tokens are taken or none.
+func (rl *RateLimiter) AllowOperation(accountIds ...string) error {
+	if rl == nil {
+		return nil
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	scopes := []rateScope{{name: "global", limit: rl.global}}
+	for _, id := range accountIds {
+		scopes = append(scopes, rateScope{name: "account", key: id, limit: rl.account})
+	}
+	return rl.take(scopes)
+}
+
+// AllowClient takes a token from the bucket of an API client.
+func (rl *RateLimiter) AllowClient(clientId string) error {
+	if rl == nil {
+		return nil
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	return rl.take([]rateScope{{name: "client", key: clientId, limit: rl.client}})
+}
+
+type rateScope struct {
+	name  string
+	key   string
+	limit RateLimit
+}
+
+func (rl *RateLimiter) take(scopes []rateScope) error {
+	now := rl.now()
+
+	var taken []*tokenBucket
+	for _, scope := range scopes {
+		if scope.limit.Rate <= 0 {
+			continue
+		}
+
+		bucketKey := scope.name + ":" + scope.key
+		bucket, ok := rl.buckets[bucketKey]
+		if !ok {
+			bucket = &tokenBucket{tokens: scope.limit.capacity(), last: now}
+			rl.buckets[bucketKey] = bucket
+		}
+
+		if slices.Contains(taken, bucket) {
+			continue // e.g. a transfer between the same account
+		}
+		if wait := bucket.refill(scope.limit, now); wait > 0 {
+			return &RateLimitError{Scope: scope.name, Key: scope.key, RetryAfter: wait}
+		}
+		taken = append(taken, bucket)
+	}
+
+	for _, bucket := range taken {
+		bucket.tokens--
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	rl := NewRateLimiter(RateLimit{}, RateLimit{Rate: 1, Burst: 2}, RateLimit{})
+	rl.now = func() time.Time { return now }
+
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000, "acc2": 500},
+		limiter:  rl,
+	}
+
+	for range 2 {
+		if err := sm.Deposit("acc1", 10); err != nil {
+			t.Fatalf("Deposit within burst failed: %v", err)
+		}
+	}
+
+	err := sm.Transfer("acc2", "acc1", 10)
+	var rateErr *RateLimitError
+	if !errors.As(err, &rateErr) || !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("Transfer over account limit = %v; want *RateLimitError", err)
+	}
+	if rateErr.Scope != "account" || rateErr.Key != "acc1" || rateErr.RetryAfter != time.Second {
+		t.Errorf("RateLimitError = %+v; want account limit for acc1 retrying after 1s", rateErr)
+	}
+	if !rateErr.Retryable() {
+		t.Errorf("RateLimitError is not retryable")
+	}
+
+	// A rejected transfer must not consume acc2's tokens.
+	for range 2 {
+		if err := sm.Withdraw("acc2", 10); err != nil {
+			t.Fatalf("Withdraw from acc2 failed: %v", err)
+		}
+	}
+
+	now = now.Add(time.Second)
+	if err := sm.Deposit("acc1", 10); err != nil {
+		t.Errorf("Deposit after refill failed: %v", err)
+	}
+
+	expectedAccounts := map[string]int{"acc1": 1030, "acc2": 480}
+	for acc, expectedBalance := range expectedAccounts {
+		if sm.accounts[acc] != expectedBalance {
+			t.Errorf("Account %s balance = %d; want %d", acc, sm.accounts[acc], expectedBalance)
+		}
+	}
+}
+
+func TestServerClientRateLimit(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+	sm.limiter = NewRateLimiter(RateLimit{}, RateLimit{}, RateLimit{Rate: 0.5, Burst: 1})
+
+	deposit := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/accounts/acc1/deposit", strings.NewReader(`{"amount": 1}`))
+		req.Header.Set(ClientIDHeader, client)
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := deposit("alice"); rec.Code != http.StatusOK {
+		t.Fatalf("First deposit = %d; want %d", rec.Code, http.StatusOK)
+	}
+
+	rec := deposit("alice")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("Second deposit = %d; want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if retryAfter := rec.Header().Get("Retry-After"); retryAfter == "" || retryAfter == "0" {
+		t.Errorf("Retry-After = %q; want a positive number of seconds", retryAfter)
+	}
+
+	if rec := deposit("bob"); rec.Code != http.StatusOK {
+		t.Errorf("Deposit from another client = %d; want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+)
+
+// readRaceAccounts are the accounts money moves between in the read race
+// tests. Only transfers, transactions moving money between them and
+// rollbacks are applied, so every consistent view of the balances sums to
+// readRaceTotal.
+var readRaceAccounts = []string{"acc1", "acc2", "acc3", "acc4"}
+
+const readRaceTotal = 4000
+
+// hammerWrites moves money between readRaceAccounts from a few goroutines,
+// with transfers, two-step transactions and rollbacks, until each applied
+// the given number of changes, then closes done.
+func hammerWrites(sm *StateMachine, changes int, done chan<- struct{}) {
+	var wg sync.WaitGroup
+	for worker := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(worker), 0))
+			for range changes {
+				from := readRaceAccounts[rng.IntN(len(readRaceAccounts))]
+				to := readRaceAccounts[rng.IntN(len(readRaceAccounts))]
+				amount := 1 + rng.IntN(100)
+				switch rng.IntN(10) {
+				case 0:
+					_ = sm.Rollback()
+				case 1:
+					_ = sm.RollbackTo(max(sm.Version()-rng.IntN(5), 0))
+				case 2, 3:
+					// A withdrawal and a deposit, published together or not
+					// at all.
+					_ = sm.Tx(func(tx *Tx) error {
+						if err := tx.Withdraw(from, amount); err != nil {
+							return err
+						}
+						return tx.Deposit(to, amount)
+					})
+				default:
+					_ = sm.Transfer(from, to, amount)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+}
+
+// TestReadRaces reads the balances in every way while transfers, rollbacks
+// and transactions are applied, checking that no reader ever sees money
+// halfway between accounts. Run it with -race.
+func TestReadRaces(t *testing.T) {
+	quiet(t)
+
+	balances := func(sm *StateMachine) error {
+		return checkTotal(sm.Balances())
+	}
+	balance := func(sm *StateMachine) error {
+		// A single account never goes negative, nor above the total.
+		for _, id := range readRaceAccounts {
+			balance, err := sm.Balance(id)
+			if err != nil || balance < 0 || balance > readRaceTotal {
+				return fmt.Errorf("Balance(%s) = %d, %v", id, balance, err)
+			}
+		}
+		return nil
+	}
+
+	tests := []struct {
+		name   string
+		locked bool // FlagStateReads off
+		read   func(sm *StateMachine) error
+	}{
+		{"Balances", false, balances},
+		{"Balances locked", true, balances},
+		{"Balance", false, balance},
+		{"Balance locked", true, balance},
+		{"State", false, func(sm *StateMachine) error {
+			state := sm.State()
+			balances := state.Balances()
+			if err := checkTotal(balances); err != nil {
+				return err
+			}
+			// A state keeps its balances while newer ones are published.
+			for _, id := range readRaceAccounts {
+				if balance, _ := state.Balance(id); balance != balances[id] {
+					return fmt.Errorf("State at %d changed: %s at %d, then %d", state.Version(), id, balances[id], balance)
+				}
+			}
+			return nil
+		}},
+		{"ListAccounts", false, func(sm *StateMachine) error {
+			page, err := sm.ListAccounts(ListOptions{Limit: len(readRaceAccounts)})
+			if err != nil {
+				return err
+			}
+			balances := map[string]int{}
+			for _, account := range page.Accounts {
+				balances[account.ID] = account.Balance
+			}
+			return checkTotal(balances)
+		}},
+		{"HistoryIter", false, func(sm *StateMachine) error {
+			version := -1
+			for entry := range sm.HistoryIter(0) {
+				if entry.Version <= version {
+					return fmt.Errorf("history entry %d after %d", entry.Version, version)
+				}
+				version = entry.Version
+				if err := checkTotal(entry.Balances); err != nil {
+					return fmt.Errorf("history at %d: %w", entry.Version, err)
+				}
+			}
+			return nil
+		}},
+		{"Operations", false, func(sm *StateMachine) error {
+			ops := sm.Operations()
+			for i := 1; i < len(ops); i++ {
+				if ops[i].Version < ops[i-1].Version {
+					return fmt.Errorf("operation %s at %d journaled after one at %d", ops[i].ID, ops[i].Version, ops[i-1].Version)
+				}
+			}
+			return nil
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{}, maxHistory: 100}
+			for _, id := range readRaceAccounts {
+				sm.accounts[id] = readRaceTotal / len(readRaceAccounts)
+			}
+			if tt.locked {
+				if err := sm.SetFlag(context.Background(), FlagStateReads, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			done := make(chan struct{})
+			go hammerWrites(sm, 200, done)
+
+			var wg sync.WaitGroup
+			for range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						select {
+						case <-done:
+							return
+						default:
+						}
+						if err := tt.read(sm); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if err := tt.read(sm); err != nil {
+				t.Errorf("after the writes: %v", err)
+			}
+		})
+	}
+}
+
+// checkTotal fails unless the balances of readRaceAccounts are all there
+// and sum to readRaceTotal.
+func checkTotal(balances map[string]int) error {
+	total := 0
+	for _, id := range readRaceAccounts {
+		balance, ok := balances[id]
+		if !ok || balance < 0 {
+			return fmt.Errorf("balances %v: %s missing or negative", balances, id)
+		}
+		total += balance
+	}
+	if total != readRaceTotal {
+		return fmt.Errorf("balances %v sum to %d; want %d, money is halfway between accounts", balances, total, readRaceTotal)
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidStatement is returned for statements that cannot be read.
+var ErrInvalidStatement = errors.New("invalid statement")
+
+// ReconcileOptions select the ledger a statement is reconciled against.
+type ReconcileOptions struct {
+	// Since and Until bound the times of the operations expected in the
+	// statement; zero means unbounded. Operations outside them are never
+	// reported as unrecorded.
+	Since, Until time.Time
+
+	// Tolerance is how far apart the times of a statement entry without an
+	// ID and an operation may be for them to match. Entries without a time
+	// match operations at any time.
+	Tolerance time.Duration
+}
+
+func (o ReconcileOptions) covers(t time.Time) bool {
+	return (o.Since.IsZero() || !t.Before(o.Since)) && (o.Until.IsZero() || t.Before(o.Until))
+}
+
+// Mismatch is a statement entry whose operation, matched by ID, differs.
+type Mismatch struct {
+	Expected Operation `json:"expected"`
+	Actual   Operation `json:"actual"`
+	Fields   []string  `json:"fields"` // json names of the differing fields
+}
+
+type ReconciliationReport struct {
+	Matched    int         `json:"matched"`
+	Missing    []Operation `json:"missing"`    // in the statement but not the ledger
+	Unrecorded []Operation `json:"unrecorded"` // in the ledger but not the statement
+	Duplicated []Operation `json:"duplicated"` // statement entries of an operation matched before
+	Mismatched []Mismatch  `json:"mismatched"`
+}
+
+// Reconciled reports whether the statement and ledger agree.
+func (r *ReconciliationReport) Reconciled() bool {
+	return len(r.Missing) == 0 && len(r.Unrecorded) == 0 && len(r.Duplicated) == 0 && len(r.Mismatched) == 0
+}
+
+// Reconcile matches the entries of an external statement, e.g. a bank's or
+// a downstream system's record of the operations it saw, against the
+// operations in history.
+//
+// Entries with an ID are matched to the operation with that ID, and
+// reported as mismatched if their type, accounts, amount or, when given,
+// time differ. Entries without an ID are matched to the earliest unmatched
+// operation of the same type, accounts and amount, within opts.Tolerance of
+// their time. Operations undone by a rollback are not in history, so
+// statement entries of them are reported missing.
+func (sm *StateMachine) Reconcile(statement []Operation, opts ReconcileOptions) ReconciliationReport {
+	var ledger []Operation
+	for _, op := range sm.Operations() {
+		if opts.covers(op.Time) {
+			ledger = append(ledger, op)
+		}
+	}
+	byID := make(map[string]int, len(ledger))
+	for i, op := range ledger {
+		byID[op.ID] = i
+	}
+	matched := make([]bool, len(ledger))
+
+	report := ReconciliationReport{
+		Missing:    []Operation{},
+		Unrecorded: []Operation{},
+		Duplicated: []Operation{},
+		Mismatched: []Mismatch{},
+	}
+
+	// Entries with an ID go first, so entries without one cannot take their
+	// operations.
+	for _, entry := range statement {
+		if entry.ID == "" {
+			continue
+		}
+		i, ok := byID[entry.ID]
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, entry)
+		case matched[i]:
+			report.Duplicated = append(report.Duplicated, entry)
+		default:
+			matched[i] = true
+			if fields := differingFields(entry, ledger[i], 0); len(fields) > 0 {
+				report.Mismatched = append(report.Mismatched, Mismatch{Expected: entry, Actual: ledger[i], Fields: fields})
+			} else {
+				report.Matched++
+			}
+		}
+	}
+
+	for _, entry := range statement {
+		if entry.ID != "" {
+			continue
+		}
+		candidate, duplicate := -1, false
+		for i, op := range ledger {
+			if len(differingFields(entry, op, opts.Tolerance)) > 0 {
+				continue
+			}
+			if !matched[i] {
+				candidate = i
+				break
+			}
+			duplicate = true
+		}
+		switch {
+		case candidate >= 0:
+			matched[candidate] = true
+			report.Matched++
+		case duplicate:
+			report.Duplicated = append(report.Duplicated, entry)
+		default:
+			report.Missing = append(report.Missing, entry)
+		}
+	}
+
+	for i, op := range ledger {
+		if !matched[i] {
+			report.Unrecorded = append(report.Unrecorded, op)
+		}
+	}
+	return report
+}
+
+// differingFields returns the json names of the fields of op that differ
+// from a statement entry. The time only differs if the entry has one more
+// than tolerance away.
+func differingFields(entry, op Operation, tolerance time.Duration) []string {
+	var fields []string
+	if entry.Type != op.Type {
+		fields = append(fields, "type")
+	}
+	if entry.From != op.From {
+		fields = append(fields, "from")
+	}
+	if entry.To != op.To {
+		fields = append(fields, "to")
+	}
+	if entry.Amount != op.Amount {
+		fields = append(fields, "amount")
+	}
+	if !entry.Time.IsZero() && (entry.Time.Sub(op.Time) > tolerance || op.Time.Sub(entry.Time) > tolerance) {
+		fields = append(fields, "time")
+	}
+	return fields
+}
+
+// ReadStatement reads the entries of a statement. JSON statements are
+// arrays of operations as Operations encodes them. CSV statements start
+// with a header naming their columns, any of id, type, from, to, amount and
+// time, the time in RFC 3339.
+func ReadStatement(r io.Reader, format ImportFormat) ([]Operation, error) {
+	switch format {
+	case ImportJSON:
+		var entries []Operation
+		decoder := json.NewDecoder(r)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&entries); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidStatement, err)
+		}
+		return entries, nil
+	case ImportCSV:
+		return readCSVStatement(r)
+	}
+	return nil, fmt.Errorf("%w: unknown format %q", ErrInvalidStatement, format)
+}
+
+func readCSVStatement(r io.Reader) ([]Operation, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: no header: %v", ErrInvalidStatement, err)
+	}
+	for _, column := range header {
+		switch strings.ToLower(column) {
+		case "id", "type", "from", "to", "amount", "time":
+		default:
+			return nil, fmt.Errorf("%w: unknown column %q", ErrInvalidStatement, column)
+		}
+	}
+
+	var entries []Operation
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidStatement, err)
+		}
+
+		var entry Operation
+		for i, value := range record {
+			switch strings.ToLower(header[i]) {
+			case "id":
+				entry.ID = value
+			case "type":
+				entry.Type = OperationType(value)
+			case "from":
+				entry.From = value
+			case "to":
+				entry.To = value
+			case "amount":
+				entry.Amount, err = strconv.Atoi(value)
+			case "time":
+				if value != "" {
+					entry.Time, err = time.Parse(time.RFC3339Nano, value)
+				}
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w: row %d: invalid %s: %v", ErrInvalidStatement, row, header[i], err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+}
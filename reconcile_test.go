@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newReconcileStateMachine applies three operations a minute apart,
+// txn-1 to txn-3, starting at start.
+func newReconcileStateMachine(start time.Time) *StateMachine {
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 500}}
+	clock := NewFakeClock(start)
+	sm.UseClock(clock)
+
+	_ = sm.Deposit("acc1", 100)
+	clock.Advance(time.Minute)
+	_ = sm.Transfer("acc1", "acc2", 50)
+	clock.Advance(time.Minute)
+	_ = sm.Deposit("acc1", 100)
+
+	// Readable IDs keep the statements below short.
+	for i := range sm.journal {
+		sm.journal[i].ID = fmt.Sprintf("txn-%d", i+1)
+	}
+	return sm
+}
+
+// operationIds returns the IDs of ops, or the type of those without one.
+func operationIds(ops []Operation) []string {
+	ids := make([]string, len(ops))
+	for i, op := range ops {
+		ids[i] = op.ID
+		if ids[i] == "" {
+			ids[i] = string(op.Type)
+		}
+	}
+	return ids
+}
+
+func TestReconcile(t *testing.T) {
+	quiet(t)
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	sm := newReconcileStateMachine(start)
+
+	deposit := Operation{Type: OpDeposit, To: "acc1", Amount: 100}
+	transfer := Operation{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 50}
+
+	tests := []struct {
+		name               string
+		statement          []Operation
+		opts               ReconcileOptions
+		expectedMatched    int
+		expectedMissing    []string
+		expectedUnrecorded []string
+		expectedDuplicated []string
+		expectedMismatched []string // fields of each mismatch
+	}{
+		{
+			name: "Reconciled by id",
+			statement: []Operation{
+				{ID: "txn-1", Type: OpDeposit, To: "acc1", Amount: 100, Time: start},
+				{ID: "txn-2", Type: OpTransfer, From: "acc1", To: "acc2", Amount: 50},
+				{ID: "txn-3", Type: OpDeposit, To: "acc1", Amount: 100},
+			},
+			expectedMatched: 3,
+		},
+		{
+			name:            "Reconciled without ids",
+			statement:       []Operation{deposit, transfer, deposit},
+			expectedMatched: 3,
+		},
+		{
+			name:               "Missing and unrecorded",
+			statement:          []Operation{transfer, {ID: "txn-9", Type: OpDeposit, To: "acc1", Amount: 1}, {Type: OpWithdraw, From: "acc2", Amount: 5}},
+			expectedMatched:    1,
+			expectedMissing:    []string{"txn-9", "withdraw"},
+			expectedUnrecorded: []string{"txn-1", "txn-3"},
+		},
+		{
+			name:               "Duplicated",
+			statement:          []Operation{{ID: "txn-2", Type: OpTransfer, From: "acc1", To: "acc2", Amount: 50}, {ID: "txn-2"}, transfer, deposit, deposit},
+			expectedMatched:    3,
+			expectedDuplicated: []string{"txn-2", "transfer"},
+		},
+		{
+			name:               "Mismatched",
+			statement:          []Operation{{ID: "txn-1", Type: OpDeposit, To: "acc2", Amount: 90}, {ID: "txn-2", Type: OpTransfer, From: "acc1", To: "acc2", Amount: 50, Time: start}, deposit},
+			expectedMatched:    1,
+			expectedMismatched: []string{"to,amount", "time"},
+		},
+		{
+			name:               "Times within tolerance",
+			statement:          []Operation{{Type: OpDeposit, To: "acc1", Amount: 100, Time: start.Add(2*time.Minute + time.Second)}, {Type: OpDeposit, To: "acc1", Amount: 100, Time: start.Add(time.Hour)}},
+			opts:               ReconcileOptions{Tolerance: 5 * time.Second},
+			expectedMatched:    1,
+			expectedMissing:    []string{"deposit"},
+			expectedUnrecorded: []string{"txn-1", "txn-2"},
+		},
+		{
+			name:            "Window",
+			statement:       []Operation{transfer},
+			opts:            ReconcileOptions{Since: start.Add(time.Second), Until: start.Add(2 * time.Minute)},
+			expectedMatched: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := sm.Reconcile(tt.statement, tt.opts)
+
+			var mismatched []string
+			for _, m := range report.Mismatched {
+				mismatched = append(mismatched, strings.Join(m.Fields, ","))
+			}
+			if report.Matched != tt.expectedMatched ||
+				!slices.Equal(operationIds(report.Missing), tt.expectedMissing) ||
+				!slices.Equal(operationIds(report.Unrecorded), tt.expectedUnrecorded) ||
+				!slices.Equal(operationIds(report.Duplicated), tt.expectedDuplicated) ||
+				!slices.Equal(mismatched, tt.expectedMismatched) {
+				t.Errorf("Reconcile = %d matched, missing %v, unrecorded %v, duplicated %v, mismatched %v; want %d, %v, %v, %v, %v",
+					report.Matched, operationIds(report.Missing), operationIds(report.Unrecorded), operationIds(report.Duplicated), mismatched,
+					tt.expectedMatched, tt.expectedMissing, tt.expectedUnrecorded, tt.expectedDuplicated, tt.expectedMismatched)
+			}
+
+			reconciled := len(tt.expectedMissing)+len(tt.expectedUnrecorded)+len(tt.expectedDuplicated)+len(tt.expectedMismatched) == 0
+			if report.Reconciled() != reconciled {
+				t.Errorf("Reconciled = %v; want %v", report.Reconciled(), reconciled)
+			}
+		})
+	}
+}
+
+func TestReadStatement(t *testing.T) {
+	tests := []struct {
+		name        string
+		input       string
+		format      ImportFormat
+		expected    []Operation
+		expectedErr error
+	}{
+		{
+			name:     "CSV",
+			input:    "type,from,to,amount,time\ntransfer,acc1,acc2,50,2024-01-01T12:00:00Z\ndeposit,,acc1,7,\n",
+			format:   ImportCSV,
+			expected: []Operation{{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 50, Time: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}, {Type: OpDeposit, To: "acc1", Amount: 7}},
+		},
+		{
+			name:     "JSON",
+			input:    `[{"id": "txn-1", "type": "withdraw", "from": "acc1", "amount": 5}]`,
+			format:   ImportJSON,
+			expected: []Operation{{ID: "txn-1", Type: OpWithdraw, From: "acc1", Amount: 5}},
+		},
+		{name: "Unknown column", input: "id,memo\n", format: ImportCSV, expectedErr: ErrInvalidStatement},
+		{name: "Invalid amount", input: "id,amount\ntxn-1,lots\n", format: ImportCSV, expectedErr: ErrInvalidStatement},
+		{name: "Wrong field count", input: "id,amount\ntxn-1\n", format: ImportCSV, expectedErr: ErrInvalidStatement},
+		{name: "Unknown field", input: `[{"note": "x"}]`, format: ImportJSON, expectedErr: ErrInvalidStatement},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statement, err := ReadStatement(strings.NewReader(tt.input), tt.format)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("ReadStatement = %v; want %v", err, tt.expectedErr)
+			}
+			if !reflect.DeepEqual(statement, tt.expected) {
+				t.Errorf("ReadStatement = %+v; want %+v", statement, tt.expected)
+			}
+		})
+	}
+}
+
+func TestServerReconcile(t *testing.T) {
+	quiet(t)
+
+	sm := newReconcileStateMachine(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	srv := NewServer(sm, "")
+
+	tests := []struct {
+		name           string
+		path           string
+		contentType    string
+		body           string
+		expectedStatus int
+		expected       string
+	}{
+		{
+			name:           "CSV",
+			path:           "/reconciliations?until=2024-01-01T12:01:30Z",
+			contentType:    "text/csv; charset=utf-8",
+			body:           "id,type,to,amount\ntxn-1,deposit,acc1,100\n",
+			expectedStatus: http.StatusOK,
+			expected:       `"unrecorded":[{"id":"txn-2"`,
+		},
+		{
+			name:           "JSON",
+			path:           "/reconciliations?tolerance=1s",
+			body:           `[{"type": "deposit", "to": "acc1", "amount": 100}]`,
+			expectedStatus: http.StatusOK,
+			expected:       `{"matched":1,"missing":[],"unrecorded":[{"id":"txn-2"`,
+		},
+		{name: "Invalid statement", path: "/reconciliations", body: `{}`, expectedStatus: http.StatusBadRequest},
+		{name: "Invalid time", path: "/reconciliations?since=yesterday", body: `[]`, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, req)
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("POST %s = %d; want %d (%s)", tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.expected) {
+				t.Errorf("Response = %s; want it to contain %s", rec.Body, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrReadOnly is returned for operations on a replica, which only
+	// applies the operations of its leader.
+	ErrReadOnly = errors.New("read-only replica")
+	// ErrReplicaStale is returned by a replica that has not heard from its
+	// leader for longer than its maximum staleness.
+	ErrReplicaStale = errors.New("replica is stale")
+)
+
+// replicationHeartbeat is how often the leader reports it is alive on an
+// idle replication stream.
+const replicationHeartbeat = time.Second
+
+// defaultReplicaRetry is how long a replica waits before reconnecting to
+// its leader by default.
+const defaultReplicaRetry = time.Second
+
+// Replica keeps a read-only copy of a leader's accounts and operation log,
+// following the leader's /replication stream: the state when it connects,
+// then every operation the leader applies. Replicas serve balance and
+// history reads, offloading the leader; operations on them fail with
+// ErrReadOnly.
+//
+// A replica is as stale as the time since it last heard from its leader,
+// which sends a heartbeat every second on an idle stream. Once that exceeds
+// the maximum staleness, Check fails, taking a server using the replica
+// out of rotation and failing its reads, until the replica reconnects.
+// Tenants, tags, aliases and approvals are not replicated.
+type Replica struct {
+	Leader        string       // base URL of the leader, e.g. http://leader:8080
+	APIKey        string       // sent as X-API-Key when set
+	Client        *http.Client // http.DefaultClient if nil
+	RetryInterval time.Duration
+
+	sm           *StateMachine
+	maxStaleness time.Duration
+
+	mu          sync.Mutex
+	synced      bool      // the leader's state was received
+	lastContact time.Time // last message from the leader
+}
+
+// NewReplica returns a replica of the leader at the given base URL, stale
+// after maxStaleness without news from it. It follows the leader once Run
+// is called.
+func NewReplica(leader string, maxStaleness time.Duration) *Replica {
+	return &Replica{
+		Leader:        strings.TrimSuffix(leader, "/"),
+		RetryInterval: defaultReplicaRetry,
+		sm:            &StateMachine{accounts: map[string]int{}, readOnly: true},
+		maxStaleness:  maxStaleness,
+	}
+}
+
+// StateMachine returns the replica's copy of the leader's state.
+func (r *Replica) StateMachine() *StateMachine {
+	return r.sm
+}
+
+// Run follows the leader until ctx is done, reconnecting after
+// RetryInterval whenever the stream fails or ends. Each connection starts
+// from the leader's current state, so a replica that fell behind catches up
+// on reconnecting.
+func (r *Replica) Run(ctx context.Context) {
+	for {
+		err := r.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Println("Replication Error:", err)
+
+		select {
+		case <-time.After(r.RetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check fails with ErrReplicaStale until the replica has the leader's state,
+// and whenever it last heard from the leader more than its maximum
+// staleness ago. It can be used as a ReadinessCheck.
+func (r *Replica) Check(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.synced {
+		return fmt.Errorf("%w: not synced with %s", ErrReplicaStale, r.Leader)
+	}
+	if staleness := r.sm.now().Sub(r.lastContact); staleness > r.maxStaleness {
+		return fmt.Errorf("%w: last heard from %s %s ago", ErrReplicaStale, r.Leader, staleness)
+	}
+	return nil
+}
+
+// follow reads one replication stream until it ends.
+func (r *Replica) follow(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.Leader+"/replication", nil)
+	if err != nil {
+		return err
+	}
+	if r.APIKey != "" {
+		req.Header.Set("X-API-Key", r.APIKey)
+	}
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader %s answered %s", r.Leader, resp.Status)
+	}
+
+	// Until the state arrives, the replica's copy may be arbitrarily old.
+	r.mu.Lock()
+	r.synced = false
+	r.mu.Unlock()
+
+	reader := bufio.NewReader(resp.Body)
+	var name, data string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("leader %s ended the stream", r.Leader)
+			}
+			return err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if name != "" {
+				if err := r.receive(name, data); err != nil {
+					return err
+				}
+			}
+			name, data = "", ""
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// receive applies a message of the replication stream.
+func (r *Replica) receive(name, data string) error {
+	var event Event
+	if err := json.Unmarshal([]byte(data), &event); err != nil {
+		return fmt.Errorf("invalid %s event: %w", name, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch name {
+	case "state":
+		r.sm.resetTo(event)
+		r.synced = true
+	case "operation":
+		if !r.synced {
+			return fmt.Errorf("operation %s before the leader's state", event.Operation.ID)
+		}
+		r.sm.applyReplicated(event)
+		if err := r.sm.wal.Sync(r.sm.wal.Written()); err != nil {
+			return err
+		}
+	case "heartbeat":
+	default:
+		return fmt.Errorf("unknown event %q", name)
+	}
+	r.lastContact = r.sm.now()
+	return nil
+}
+
+// resetTo replaces the state with the leader's, forgetting history.
+func (sm *StateMachine) resetTo(state Event) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.accounts = maps.Clone(state.Balances)
+	if sm.accounts == nil {
+		sm.accounts = map[string]int{}
+	}
+	sm.balanceIndex.invalidate()
+	sm.version = state.Version
+	sm.storeState()
+	sm.history = stateHistory{}
+	sm.journal = nil
+	sm.opIndex.rebuild(nil, 0)
+	sm.endEpoch()
+}
+
+// applyReplicated applies an operation of the leader by taking the balances
+// it left from its event, rather than applying it again: the leader's
+// history also holds states of failed operations, which are not replicated,
+// so a rollback replayed here could undo something else.
+func (sm *StateMachine) applyReplicated(event Event) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	op := event.Operation
+	switch op.Type {
+	case OpRollback, OpRollbackTo:
+		// The event of a rollback holds every balance and bucket.
+		sm.history.forget(event.Version)
+		sm.keepImages()
+		sm.accounts = maps.Clone(event.Balances)
+		maps.Copy(sm.accounts, event.Buckets)
+		sm.forgetOperationsAfter(event.Version)
+	case OpArchive, OpUnarchive, OpSetStatus:
+		// The event leaves out the balances of archived accounts and the
+		// statuses, so the operation is applied again, to the same state as
+		// on the leader.
+		if err := sm.apply(op); err != nil {
+			fmt.Println("Replication Error:", err)
+		}
+		sm.journalOperation(op)
+	default:
+		sm.history.save(sm.version, sm.now(), sm.accounts, append(op.accounts(), slices.Collect(maps.Keys(event.Buckets))...)...)
+		sm.history.trim(sm.maxHistory)
+		maps.Copy(sm.accounts, event.Balances)
+		maps.Copy(sm.accounts, event.Buckets)
+		if op.Type == OpOpen {
+			sm.setStatus(op.To, op.Status)
+		}
+		sm.journalOperation(op)
+	}
+	sm.version = event.Version
+	if op.MessageID != "" {
+		sm.inbox.add(op)
+	}
+	// Replicas, and state machines replaying a log, have no write-ahead log
+	// to fail, see ReplayWAL.
+	_ = sm.publish(op)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startReplica follows the leader served by srv until the test ends.
+func startReplica(t *testing.T, srv *Server, clock Clock, maxStaleness time.Duration) (*Replica, context.CancelFunc) {
+	t.Helper()
+	ts := httptest.NewServer(srv.Handler())
+	t.Cleanup(func() {
+		_ = srv.Close(context.Background())
+		ts.Close()
+	})
+
+	replica := NewReplica(ts.URL, maxStaleness)
+	replica.RetryInterval = 10 * time.Millisecond
+	replica.StateMachine().UseClock(clock)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go replica.Run(ctx)
+	return replica, cancel
+}
+
+// waitReplicated waits until the replica is synced at version.
+func waitReplicated(t *testing.T, replica *Replica, version int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if replica.Check(context.Background()) == nil && replica.StateMachine().Version() == version {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Replica at version %d; want %d", replica.StateMachine().Version(), version)
+}
+
+func TestReplica(t *testing.T) {
+	quiet(t)
+
+	srv, leader := newTestServer(map[string]int{"acc1": 1000, "acc2": 500})
+	_ = leader.Deposit("acc1", 1) // before the replica connects
+	clock := NewFakeClock(time.Now())
+	replica, stop := startReplica(t, srv, clock, time.Minute)
+	waitReplicated(t, replica, 1)
+
+	_ = leader.Deposit("acc1", 100)
+	_ = leader.Withdraw("acc2", 10000) // fails, but is saved to the leader's history
+	_ = leader.Rollback()              // undoes the failed withdraw, not the deposit
+	_ = leader.Tx(func(tx *Tx) error {
+		_ = tx.Open("acc3", 30)
+		return tx.Deposit("acc2", 20)
+	})
+	_ = leader.Transfer("acc1", "acc2", 50)
+	waitReplicated(t, replica, leader.Version())
+
+	sm := replica.StateMachine()
+	if balances := sm.Balances(); !maps.Equal(balances, leader.Balances()) {
+		t.Errorf("Replica balances = %v; want %v", balances, leader.Balances())
+	}
+	if ids := operationIds(sm.Operations()); !slices.Equal(ids, operationIds(leader.Operations())[1:]) {
+		t.Errorf("Replica operations = %v; want those since it connected, %v", ids, operationIds(leader.Operations()))
+	}
+
+	if err := sm.Deposit("acc1", 1); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Deposit() on a replica error = %v; want ErrReadOnly", err)
+	}
+	if err := sm.Tx(func(tx *Tx) error { return nil }); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Tx() on a replica error = %v; want ErrReadOnly", err)
+	}
+
+	// Rolling the leader back is replicated like any operation.
+	_ = leader.Rollback()
+	waitReplicated(t, replica, leader.Version())
+	if balances := sm.Balances(); !maps.Equal(balances, leader.Balances()) {
+		t.Errorf("Replica balances after rollback = %v; want %v", balances, leader.Balances())
+	}
+
+	// Without news from the leader, the replica goes stale.
+	stop()
+	clock.Advance(2 * time.Minute)
+	if err := replica.Check(context.Background()); !errors.Is(err, ErrReplicaStale) {
+		t.Errorf("Check() after losing the leader = %v; want ErrReplicaStale", err)
+	}
+}
+
+func TestReplicaBuckets(t *testing.T) {
+	quiet(t)
+
+	srv, leader := newTestServer(map[string]int{"acc1": 1000, "acc2": 500})
+	_ = leader.Move("acc1", "", "reserved", 300) // before the replica connects
+	replica, _ := startReplica(t, srv, NewFakeClock(time.Now()), time.Minute)
+	waitReplicated(t, replica, 1)
+
+	_ = leader.Move("acc2", "", "bonus", 200)
+	_ = leader.Transfer("acc2", "acc1", 100)
+	_ = leader.Move("acc1", "reserved", "", 100)
+	_ = leader.Rollback()
+	waitReplicated(t, replica, leader.Version())
+
+	sm := replica.StateMachine()
+	for _, id := range []string{"acc1", "acc2"} {
+		got, err := sm.Buckets(id)
+		want, _ := leader.Buckets(id)
+		if err != nil || !maps.Equal(got, want) {
+			t.Errorf("Replica buckets of %s = %v, %v; want %v", id, got, err, want)
+		}
+	}
+}
+
+func TestReplicaServer(t *testing.T) {
+	quiet(t)
+
+	leaderSrv, _ := newTestServer(map[string]int{"acc1": 1000})
+	ts := httptest.NewServer(leaderSrv.Handler())
+	defer ts.Close()
+	defer leaderSrv.Close(context.Background())
+
+	replica := NewReplica(ts.URL, time.Minute)
+	srv := NewServer(replica.StateMachine(), "")
+	srv.UseReplica(replica)
+
+	tests := []struct {
+		name           string
+		synced         bool
+		method, path   string
+		body           string
+		expectedStatus int
+	}{
+		{"Not ready before syncing", false, http.MethodGet, "/readyz", "", http.StatusServiceUnavailable},
+		{"Reads fail before syncing", false, http.MethodGet, "/accounts/acc1", "", http.StatusServiceUnavailable},
+		{"Ready once synced", true, http.MethodGet, "/readyz", "", http.StatusOK},
+		{"Reads", true, http.MethodGet, "/accounts/acc1", "", http.StatusOK},
+		{"Writes", true, http.MethodPost, "/accounts/acc1/deposit", `{"amount": 1}`, http.StatusMethodNotAllowed},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, tt := range tests {
+		if tt.synced && replica.Check(ctx) != nil {
+			go replica.Run(ctx)
+			waitReplicated(t, replica, 0)
+		}
+
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			w := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(w, req)
+			if w.Code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d (%s)", tt.method, tt.path, w.Code, tt.expectedStatus, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy says how an action failing with a transient error, e.g. a
+// storage write or a webhook call, is attempted again: up to MaxAttempts
+// times, waiting Backoff after the first failure and twice as long after
+// each next one, up to MaxBackoff. Jitter randomizes that fraction of each
+// wait, so clients failing together do not retry together.
+type RetryPolicy struct {
+	MaxAttempts int           // including the first, 1 if 0
+	Backoff     time.Duration // before the second attempt
+	MaxBackoff  time.Duration // 0 means unbounded
+	Jitter      float64       // from 0 to 1
+
+	// Retryable classifies errors, IsRetryable if nil.
+	Retryable func(err error) bool
+}
+
+// Do calls fn until it succeeds, fails with an error that is not retryable
+// or has been attempted MaxAttempts times, and returns its last error. It
+// stops once ctx is done, returning ctx's error wrapping the last one if it
+// was waiting to attempt again.
+func (p RetryPolicy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(ctx)
+		if err == nil || ctx.Err() != nil || !p.retryable(err) || attempt >= p.MaxAttempts {
+			return err
+		}
+
+		timer := time.NewTimer(p.Delay(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: after %d attempts: %w", ctx.Err(), attempt, err)
+		}
+	}
+}
+
+// Delay returns how long to wait after the attempt-th consecutive failure,
+// counting from 1, before attempting again.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	d := p.Backoff << min(max(attempt-1, 0), 30)
+	if d < p.Backoff {
+		d = math.MaxInt64 // overflowed
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d -= time.Duration(float64(d) * min(p.Jitter, 1) * rand.Float64())
+	}
+	return d
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// permanentError marks an error not worth retrying.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func (e *permanentError) Retryable() bool {
+	return false
+}
+
+// Permanent marks err as not retryable, e.g. a request the server rejected
+// as invalid, which would be rejected again.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// IsRetryable is the default classification of RetryPolicy. Errors with a
+// Retryable method tell, e.g. RateLimitError or those marked Permanent, and
+// cancellations and missing files are final; any other error, e.g. a network
+// one or a timeout, is assumed transient.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+	var r interface{ Retryable() bool }
+	if errors.As(err, &r) {
+		return r.Retryable()
+	}
+	return true
+}
+
+// retryable is the classification of errors of operations, which are final,
+// e.g. an insufficient balance, unless they tell otherwise, e.g. a rate
+// limit.
+func retryable(err error) bool {
+	var r interface{ Retryable() bool }
+	return errors.As(err, &r) && r.Retryable()
+}
+
+// statusError marks err, reporting an HTTP response of status, Permanent
+// if the status is a client error retrying would repeat, i.e. a 4xx other
+// than 408 Request Timeout and 429 Too Many Requests.
+func statusError(status int, err error) error {
+	if status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
+
+// RetryStore is an ObjectStore retrying the requests to Store that fail
+// with Policy.
+type RetryStore struct {
+	Store  ObjectStore
+	Policy RetryPolicy
+}
+
+func (s RetryStore) Put(ctx context.Context, key string, data []byte) error {
+	return s.Policy.Do(ctx, func(ctx context.Context) error {
+		return s.Store.Put(ctx, key, data)
+	})
+}
+
+func (s RetryStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	var r io.ReadCloser
+	err := s.Policy.Do(ctx, func(ctx context.Context) (err error) {
+		r, err = s.Store.Get(ctx, key)
+		return err
+	})
+	return r, err
+}
+
+func (s RetryStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := s.Policy.Do(ctx, func(ctx context.Context) (err error) {
+		keys, err = s.Store.List(ctx, prefix)
+		return err
+	})
+	return keys, err
+}
+
+func (s RetryStore) Delete(ctx context.Context, key string) error {
+	return s.Policy.Do(ctx, func(ctx context.Context) error {
+		return s.Store.Delete(ctx, key)
+	})
+}
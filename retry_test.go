@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDo(t *testing.T) {
+	errUnreachable := errors.New("bucket unreachable")
+	tests := []struct {
+		name             string
+		policy           RetryPolicy
+		errs             []error // of the attempts, nil once they run out
+		expectedAttempts int
+		expectedErr      error
+	}{
+		{"Succeeds", RetryPolicy{MaxAttempts: 3}, nil, 1, nil},
+		{"Succeeds on retry", RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}, []error{errUnreachable, errUnreachable}, 3, nil},
+		{"Attempts exhausted", RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}, []error{errUnreachable, errUnreachable, errUnreachable, errUnreachable}, 3, errUnreachable},
+		{"Zero policy attempts once", RetryPolicy{}, []error{errUnreachable}, 1, errUnreachable},
+		{"Permanent", RetryPolicy{MaxAttempts: 3}, []error{Permanent(errUnreachable)}, 1, errUnreachable},
+		{"Classified permanent", RetryPolicy{MaxAttempts: 3, Retryable: retryable}, []error{errUnreachable}, 1, errUnreachable},
+		{"Rate limited", RetryPolicy{MaxAttempts: 3, Retryable: retryable}, []error{&RateLimitError{Scope: "global"}}, 2, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			err := tt.policy.Do(context.Background(), func(ctx context.Context) error {
+				attempts++
+				if attempts > len(tt.errs) {
+					return nil
+				}
+				return tt.errs[attempts-1]
+			})
+			if !errors.Is(err, tt.expectedErr) || (tt.expectedErr == nil) != (err == nil) {
+				t.Errorf("Do() error = %v; want %v", err, tt.expectedErr)
+			}
+			if attempts != tt.expectedAttempts {
+				t.Errorf("Do() attempted %d times; want %d", attempts, tt.expectedAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDoCancelled(t *testing.T) {
+	errUnreachable := errors.New("bucket unreachable")
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := RetryPolicy{MaxAttempts: 10, Backoff: time.Hour}
+
+	attempts := 0
+	err := policy.Do(ctx, func(ctx context.Context) error {
+		attempts++
+		cancel()
+		return errUnreachable
+	})
+	if !errors.Is(err, errUnreachable) || attempts != 1 {
+		t.Errorf("Do() = %v after %d attempts; want the error of the only attempt", err, attempts)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	err = policy.Do(ctx, func(ctx context.Context) error { return errUnreachable })
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, errUnreachable) {
+		t.Errorf("Do() cancelled while waiting = %v; want the cancellation and the last error", err)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for attempt, want := range map[int]time.Duration{
+		1:  100 * time.Millisecond,
+		2:  200 * time.Millisecond,
+		4:  800 * time.Millisecond,
+		5:  time.Second,
+		80: time.Second,
+	} {
+		if d := policy.Delay(attempt); d != want {
+			t.Errorf("Delay(%d) = %s; want %s", attempt, d, want)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for range 100 {
+		if d := policy.Delay(2); d < 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Fatalf("Delay(2) with jitter = %s; want from 100ms to 200ms", d)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{errors.New("connection reset"), true},
+		{&RateLimitError{Scope: "global"}, true},
+		{fmt.Errorf("archive: %w", Permanent(errors.New("forbidden"))), false},
+		{statusError(http.StatusForbidden, errors.New("forbidden")), false},
+		{statusError(http.StatusTooManyRequests, errors.New("slow down")), true},
+		{statusError(http.StatusBadGateway, errors.New("bad gateway")), true},
+		{fmt.Errorf("open: %w", fs.ErrNotExist), false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, true},
+	}
+
+	for _, tt := range tests {
+		if got := IsRetryable(tt.err); got != tt.expected {
+			t.Errorf("IsRetryable(%v) = %t; want %t", tt.err, got, tt.expected)
+		}
+	}
+}
+
+// flakyStore is an ObjectStore whose writes fail until failures run out.
+type flakyStore struct {
+	memStore
+	failures int
+}
+
+func (f *flakyStore) Put(ctx context.Context, key string, data []byte) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("bucket unreachable")
+	}
+	return f.memStore.Put(ctx, key, data)
+}
+
+func TestRetryStore(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	flaky := &flakyStore{failures: 2}
+	store := RetryStore{Store: flaky, Policy: RetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond}}
+
+	key, err := sm.Archive(context.Background(), store, ArchiveOptions{})
+	if err != nil {
+		t.Fatalf("Archive() error = %v", err)
+	}
+	if _, err := store.Get(context.Background(), key); err != nil {
+		t.Errorf("Get(%s) error = %v", key, err)
+	}
+
+	flaky.failures = 3
+	if _, err := sm.Archive(context.Background(), store, ArchiveOptions{}); err == nil || flaky.failures != 0 {
+		t.Errorf("Archive() = %v with %d failures left; want an error after 3 attempts", err, flaky.failures)
+	}
+}
+
+func TestWebhookPublisherRetry(t *testing.T) {
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusNoContent}
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[min(requests, len(statuses)-1)])
+		requests++
+	}))
+	defer ts.Close()
+
+	pub := &WebhookPublisher{URL: ts.URL, Retry: RetryPolicy{MaxAttempts: 5, Backoff: time.Millisecond}}
+	entries := []OutboxEntry{{Seq: 1, Event: Event{Operation: Operation{ID: "txn-1", Type: OpDeposit}}}}
+	if err := pub.Publish(context.Background(), entries); err != nil || requests != 3 {
+		t.Errorf("Publish() = %v after %d requests; want nil after 3", err, requests)
+	}
+
+	statuses, requests = []int{http.StatusBadRequest}, 0
+	if err := pub.Publish(context.Background(), entries); err == nil || requests != 1 {
+		t.Errorf("Publish() rejected = %v after %d requests; want an error after 1", err, requests)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+var (
+	ErrOperationNotFound = errors.New("operation not found")
+	ErrAlreadyReversed   = errors.New("operation already reversed")
+	ErrIrreversible      = errors.New("operation cannot be reversed")
+)
+
+// newOperationID returns a new ULID for an operation applied at t, so
+// operation IDs are unique and sort in the order operations were applied.
+func (sm *StateMachine) newOperationID(t time.Time) string {
+	return sm.ids.next(t)
+}
+
+// journalOperation records an applied operation. sm.mu must be held.
+func (sm *StateMachine) journalOperation(op Operation) {
+	sm.journal = append(sm.journal, op)
+	sm.opIndex.add(sm.opIndex.start+len(sm.journal)-1, op)
+
+	if sm.maxHistory > 0 && len(sm.journal) > sm.maxHistory {
+		n := len(sm.journal) - sm.maxHistory
+		sm.journal = sm.journal[n:] // forget the oldest operations
+		sm.opIndex.forget(sm.journal, n)
+	}
+}
+
+// forgetOperationsAfter drops the operations a rollback undid. sm.mu must be
+// held.
+func (sm *StateMachine) forgetOperationsAfter(version int) {
+	i := len(sm.journal)
+	for i > 0 && sm.journal[i-1].Version > version {
+		i--
+	}
+	sm.journal = sm.journal[:i]
+	sm.opIndex.rebuild(sm.journal, sm.opIndex.start)
+}
+
+// journaledOperations returns the journaled operations that produced
+// version. sm.mu must be held.
+func (sm *StateMachine) journaledOperations(version int) []Operation {
+	i, _ := slices.BinarySearchFunc(sm.journal, version, func(op Operation, version int) int {
+		return cmp.Compare(op.Version, version)
+	})
+	j := i
+	for j < len(sm.journal) && sm.journal[j].Version == version {
+		j++
+	}
+	return slices.Clone(sm.journal[i:j])
+}
+
+// Operations returns the applied operations still in history, oldest first.
+// Operations undone by a rollback are not included.
+func (sm *StateMachine) Operations() []Operation {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	return append([]Operation(nil), sm.journal...)
+}
+
+// OperationsWithMetadata returns the applied operations still in history
+// whose metadata holds every key and value of metadata, oldest first.
+func (sm *StateMachine) OperationsWithMetadata(metadata map[string]string) []Operation {
+	return sm.SearchOperations(OperationFilter{Metadata: metadata})
+}
+
+// hasMetadata reports whether op's metadata holds every key and value of
+// metadata.
+func (op Operation) hasMetadata(metadata map[string]string) bool {
+	for key, value := range metadata {
+		if v, ok := op.Metadata[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Operation returns the applied operation with the given id.
+func (sm *StateMachine) Operation(id string) (Operation, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for _, op := range sm.journal {
+		if op.ID == id {
+			return op, nil
+		}
+	}
+	return Operation{}, fmt.Errorf("%w (%s)", ErrOperationNotFound, id)
+}
+
+// Reverse undoes a single past deposit, withdrawal or transfer by posting a
+// compensating operation, leaving the rest of the history intact. Unlike
+// Rollback it can reverse any operation still in history, not just the last
+// one, and it fails with ErrInsufficientBalance if the balances no longer
+// allow it.
+func (sm *StateMachine) Reverse(id string) (Operation, error) {
+	return sm.ReverseContext(context.Background(), id)
+}
+
+// ReverseContext is like Reverse but gives up without applying anything if
+// ctx is done before the reversal starts.
+func (sm *StateMachine) ReverseContext(ctx context.Context, id string) (Operation, error) {
+	original, err := sm.Operation(id)
+	if err != nil {
+		return Operation{}, err
+	}
+
+	compensation, err := compensate(original)
+	if err != nil {
+		return Operation{}, err
+	}
+
+	return sm.execute(ctx, compensation)
+}
+
+// checkReversible reports why the operation with the given id can no longer
+// be reversed, if it cannot. sm.mu must be held.
+func (sm *StateMachine) checkReversible(id string) error {
+	found := false
+	for _, op := range sm.journal {
+		switch {
+		case op.ID == id:
+			found = true
+		case op.Reverses == id:
+			return fmt.Errorf("%w (%s) by %s", ErrAlreadyReversed, id, op.ID)
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w (%s)", ErrOperationNotFound, id)
+	}
+	return nil
+}
+
+// compensate returns the operation undoing op.
+func compensate(op Operation) (Operation, error) {
+	if op.Reverses != "" {
+		return Operation{}, fmt.Errorf("%w: %s reverses %s", ErrIrreversible, op.ID, op.Reverses)
+	}
+
+	reversal := Operation{Amount: op.Amount, Reverses: op.ID, FromBucket: op.ToBucket, ToBucket: op.FromBucket}
+	switch op.Type {
+	case OpDeposit:
+		reversal.Type, reversal.From = OpWithdraw, op.To
+	case OpWithdraw:
+		reversal.Type, reversal.To = OpDeposit, op.From
+	case OpTransfer:
+		reversal.Type, reversal.From, reversal.To = OpTransfer, op.To, op.From
+	case OpMove:
+		reversal.Type, reversal.From = OpMove, op.From
+	default:
+		return Operation{}, fmt.Errorf("%w: %s (%s)", ErrIrreversible, op.Type, op.ID)
+	}
+	return reversal, nil
+}
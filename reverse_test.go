@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStateMachineReverse(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000, "acc2": 500},
+	}
+
+	if err := sm.Deposit("acc1", 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Transfer("acc1", "acc2", 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Withdraw("acc2", 100); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := sm.Operations()
+	if len(ops) != 3 {
+		t.Fatalf("Operations = %+v; want 3", ops)
+	}
+	deposit, transfer, withdraw := ops[0], ops[1], ops[2]
+
+	tests := []struct {
+		name             string
+		id               string
+		expectedErr      error
+		expectedAccounts map[string]int
+	}{
+		{name: "Transfer", id: transfer.ID, expectedAccounts: map[string]int{"acc1": 1200, "acc2": 400}},
+		{name: "Transfer again", id: transfer.ID, expectedErr: ErrAlreadyReversed, expectedAccounts: map[string]int{"acc1": 1200, "acc2": 400}},
+		{name: "Deposit", id: deposit.ID, expectedAccounts: map[string]int{"acc1": 1000, "acc2": 400}},
+		{name: "Withdraw", id: withdraw.ID, expectedAccounts: map[string]int{"acc1": 1000, "acc2": 500}},
+		{name: "Unknown", id: "txn-nope", expectedErr: ErrOperationNotFound, expectedAccounts: map[string]int{"acc1": 1000, "acc2": 500}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reversal, err := sm.Reverse(tt.id)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Reverse(%s) = %v; want %v", tt.id, err, tt.expectedErr)
+			}
+			if err == nil && reversal.Reverses != tt.id {
+				t.Errorf("Reversal reverses %q; want %q", reversal.Reverses, tt.id)
+			}
+			for acc, expectedBalance := range tt.expectedAccounts {
+				if sm.accounts[acc] != expectedBalance {
+					t.Errorf("Account %s balance = %d; want %d", acc, sm.accounts[acc], expectedBalance)
+				}
+			}
+		})
+	}
+
+	reversals := sm.Operations()[3:]
+	if _, err := sm.Reverse(reversals[0].ID); !errors.Is(err, ErrIrreversible) {
+		t.Errorf("Reversing a reversal = %v; want %v", err, ErrIrreversible)
+	}
+}
+
+func TestStateMachineReverseInsufficientBalance(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 100},
+	}
+
+	if err := sm.Deposit("acc1", 500); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Withdraw("acc1", 550); err != nil {
+		t.Fatal(err)
+	}
+
+	deposit := sm.Operations()[0]
+	if _, err := sm.Reverse(deposit.ID); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Reverse = %v; want %v", err, ErrInsufficientBalance)
+	}
+	if sm.accounts["acc1"] != 50 {
+		t.Errorf("Balance after failed reversal = %d; want 50", sm.accounts["acc1"])
+	}
+}
+
+func TestStateMachineReverseRolledBack(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 100},
+	}
+
+	if err := sm.Deposit("acc1", 500); err != nil {
+		t.Fatal(err)
+	}
+	deposit := sm.Operations()[0]
+	if err := sm.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sm.Reverse(deposit.ID); !errors.Is(err, ErrOperationNotFound) {
+		t.Errorf("Reverse of rolled back operation = %v; want %v", err, ErrOperationNotFound)
+	}
+}
+
+func TestServerReverse(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 1000, "acc2": 500})
+
+	if err := sm.Transfer("acc1", "acc2", 200); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/operations", nil))
+	var ops []Operation
+	if err := json.NewDecoder(rec.Body).Decode(&ops); err != nil || len(ops) != 1 {
+		t.Fatalf("GET /operations = %v, %v; want one operation", ops, err)
+	}
+
+	tests := []struct {
+		name           string
+		id             string
+		expectedStatus int
+	}{
+		{name: "Reverse", id: ops[0].ID, expectedStatus: http.StatusOK},
+		{name: "Reverse again", id: ops[0].ID, expectedStatus: http.StatusConflict},
+		{name: "Unknown", id: "txn-nope", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest("POST", "/operations/"+tt.id+"/reverse", nil))
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("Reverse %s = %d; want %d (%s)", tt.id, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+
+	if sm.accounts["acc1"] != 1000 || sm.accounts["acc2"] != 500 {
+		t.Errorf("Accounts after reversal = %v; want original balances", sm.accounts)
+	}
+}
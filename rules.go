@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrBlockedByRule is wrapped by the veto of an operation matching a blocking
+// rule.
+var ErrBlockedByRule = errors.New("blocked by rule")
+
+type RuleAction string
+
+const (
+	RuleBlock    RuleAction = "block"    // veto the operation
+	RuleFlag     RuleAction = "flag"     // apply it, but queue it for review
+	RuleAnnotate RuleAction = "annotate" // apply it and only record the finding
+)
+
+// Condition decides whether a rule matches an operation. activity holds the
+// operations recently applied, for velocity or counterparty checks.
+type Condition func(op Operation, activity *RuleActivity) bool
+
+type Rule struct {
+	Name      string
+	Condition Condition
+	Action    RuleAction
+}
+
+// Finding records a rule matching an operation.
+type Finding struct {
+	Rule   string
+	Action RuleAction
+	Op     Operation
+	At     time.Time
+}
+
+// AmountAbove matches operations moving more than threshold.
+func AmountAbove(threshold int) Condition {
+	return func(op Operation, activity *RuleActivity) bool {
+		return op.Amount > threshold
+	}
+}
+
+// VelocityAbove matches operations debiting an account that has already been
+// debited max times within window.
+func VelocityAbove(max int, window time.Duration) Condition {
+	return func(op Operation, activity *RuleActivity) bool {
+		return op.From != "" && activity.Debits(op.From, activity.now().Add(-window)) >= max
+	}
+}
+
+// NewCounterparty matches transfers to an account the sender has never sent
+// funds to before.
+func NewCounterparty() Condition {
+	return func(op Operation, activity *RuleActivity) bool {
+		return op.Type == OpTransfer && !activity.HasPaid(op.From, op.To)
+	}
+}
+
+// RuleActivity is the recent activity rules are evaluated against.
+type RuleActivity struct {
+	now            func() time.Time
+	retention      time.Duration
+	debits         map[string][]time.Time     // account => times it was debited
+	counterparties map[string]map[string]bool // sender => receivers
+}
+
+// Debits returns how many times an account was debited since a point in time.
+func (a *RuleActivity) Debits(accountId string, since time.Time) int {
+	n := 0
+	for _, at := range a.debits[accountId] {
+		if !at.Before(since) {
+			n++
+		}
+	}
+	return n
+}
+
+// HasPaid reports whether from has transferred funds to to before.
+func (a *RuleActivity) HasPaid(from, to string) bool {
+	return a.counterparties[from][to]
+}
+
+func (a *RuleActivity) record(op Operation) {
+	now := a.now()
+	if op.From != "" {
+		debits := append(a.debits[op.From], now)
+		for len(debits) > 0 && now.Sub(debits[0]) > a.retention {
+			debits = debits[1:]
+		}
+		a.debits[op.From] = debits
+	}
+	if op.Type == OpTransfer {
+		if a.counterparties[op.From] == nil {
+			a.counterparties[op.From] = map[string]bool{}
+		}
+		a.counterparties[op.From][op.To] = true
+	}
+}
+
+// RuleEngine evaluates rules before operations are applied. Register it with
+// StateMachine.RegisterHooks(engine.Hooks()).
+type RuleEngine struct {
+	mu       sync.Mutex
+	rules    []Rule
+	activity *RuleActivity
+	findings []Finding
+	review   []Finding
+
+	// OnFinding, if set, is called for every finding, e.g. to write it to an
+	// audit log.
+	OnFinding func(Finding)
+}
+
+// NewRuleEngine creates an engine keeping activity for retention, which
+// should cover the longest velocity window of its rules.
+func NewRuleEngine(retention time.Duration, rules ...Rule) *RuleEngine {
+	return &RuleEngine{
+		rules: rules,
+		activity: &RuleActivity{
+			now:            time.Now,
+			retention:      retention,
+			debits:         map[string][]time.Time{},
+			counterparties: map[string]map[string]bool{},
+		},
+	}
+}
+
+func (e *RuleEngine) AddRule(rule Rule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = append(e.rules, rule)
+}
+
+func (e *RuleEngine) Hooks() Hooks {
+	return Hooks{
+		BeforeOperation: e.evaluate,
+		AfterOperation: func(ctx context.Context, op Operation) {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.activity.record(op)
+		},
+	}
+}
+
+// evaluate applies every matching rule, vetoing the operation on the first
+// blocking one.
+func (e *RuleEngine) evaluate(ctx context.Context, op Operation) error {
+	e.mu.Lock()
+	var matched []Finding
+	for _, rule := range e.rules {
+		if !rule.Condition(op, e.activity) {
+			continue
+		}
+
+		finding := Finding{Rule: rule.Name, Action: rule.Action, Op: op, At: e.activity.now()}
+		matched = append(matched, finding)
+		e.findings = append(e.findings, finding)
+		if rule.Action == RuleFlag {
+			e.review = append(e.review, finding)
+		}
+		if rule.Action == RuleBlock {
+			break
+		}
+	}
+	onFinding := e.OnFinding
+	e.mu.Unlock()
+
+	for _, finding := range matched {
+		if onFinding != nil {
+			onFinding(finding)
+		}
+		if finding.Action == RuleBlock {
+			return fmt.Errorf("%w %s", ErrBlockedByRule, finding.Rule)
+		}
+	}
+	return nil
+}
+
+// Findings returns every rule match so far, oldest first.
+func (e *RuleEngine) Findings() []Finding {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Finding(nil), e.findings...)
+}
+
+// ReviewQueue returns the flagged operations not yet reviewed.
+func (e *RuleEngine) ReviewQueue() []Finding {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Finding(nil), e.review...)
+}
+
+// ClearReview removes the flagged operations returned by ReviewQueue.
+func (e *RuleEngine) ClearReview() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.review = nil
+}
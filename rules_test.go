@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRuleEngine(t *testing.T) {
+	now := time.Unix(0, 0)
+	engine := NewRuleEngine(time.Hour,
+		Rule{Name: "large-amount", Condition: AmountAbove(5000), Action: RuleBlock},
+		Rule{Name: "new-payee", Condition: NewCounterparty(), Action: RuleFlag},
+		Rule{Name: "velocity", Condition: VelocityAbove(2, time.Minute), Action: RuleAnnotate},
+	)
+	engine.activity.now = func() time.Time { return now }
+
+	var notified []string
+	engine.OnFinding = func(f Finding) { notified = append(notified, f.Rule) }
+
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 10000, "acc2": 500},
+	}
+	sm.RegisterHooks(engine.Hooks())
+
+	err := sm.Withdraw("acc1", 6000)
+	if !errors.Is(err, ErrBlockedByRule) || !errors.Is(err, ErrVetoed) {
+		t.Fatalf("Large withdraw = %v; want %v", err, ErrBlockedByRule)
+	}
+
+	// The first transfer to acc2 is flagged, the second is not.
+	for range 2 {
+		if err := sm.Transfer("acc1", "acc2", 100); err != nil {
+			t.Fatalf("Transfer failed: %v", err)
+		}
+	}
+
+	// acc1 was debited twice within the minute, so a third debit is annotated.
+	if err := sm.Withdraw("acc1", 100); err != nil {
+		t.Fatalf("Withdraw failed: %v", err)
+	}
+
+	// Once the window has passed the velocity rule no longer matches.
+	now = now.Add(2 * time.Minute)
+	if err := sm.Withdraw("acc1", 100); err != nil {
+		t.Fatalf("Withdraw failed: %v", err)
+	}
+
+	expectedRules := []string{"large-amount", "new-payee", "velocity"}
+	if len(notified) != len(expectedRules) {
+		t.Fatalf("Findings = %v; want %v", notified, expectedRules)
+	}
+	for i, rule := range expectedRules {
+		if notified[i] != rule {
+			t.Errorf("Finding[%d] = %s; want %s", i, notified[i], rule)
+		}
+	}
+
+	review := engine.ReviewQueue()
+	if len(review) != 1 || review[0].Rule != "new-payee" || review[0].Op.To != "acc2" {
+		t.Errorf("ReviewQueue = %+v; want the first transfer to acc2", review)
+	}
+	engine.ClearReview()
+	if n := len(engine.ReviewQueue()); n != 0 {
+		t.Errorf("ReviewQueue after ClearReview has %d entries; want 0", n)
+	}
+
+	if sm.accounts["acc1"] != 9600 {
+		t.Errorf("Account acc1 balance = %d; want 9600", sm.accounts["acc1"])
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math/rand/v2"
+)
+
+// Scheduler runs concurrent tasks in an interleaving chosen by a seed rather
+// than by the Go scheduler, so tests of concurrent operations are
+// reproducible: the same seed always runs the steps in the same order. Every
+// task runs on its own goroutine, but only one step runs at a time.
+type Scheduler struct {
+	rng   *rand.Rand
+	tasks [][]func() error
+}
+
+// ScheduledStep records a step the scheduler ran.
+type ScheduledStep struct {
+	Task int // index of the task, in the order tasks were added
+	Step int // index of the step within the task
+	Err  error
+}
+
+func NewScheduler(seed uint64) *Scheduler {
+	return &Scheduler{rng: rand.New(rand.NewPCG(seed, seed))}
+}
+
+// Go adds a task running steps in order. Steps of other tasks may run
+// between them.
+func (s *Scheduler) Go(steps ...func() error) {
+	s.tasks = append(s.tasks, steps)
+}
+
+// Run runs every task to completion and returns the steps in the order they
+// ran. The tasks are cleared, so the scheduler can be reused.
+func (s *Scheduler) Run() []ScheduledStep {
+	type turn struct {
+		step int
+		done chan error
+	}
+
+	turns := make([]chan turn, len(s.tasks))
+	for i, steps := range s.tasks {
+		turns[i] = make(chan turn)
+		go func(steps []func() error, turns <-chan turn) {
+			for t := range turns {
+				t.done <- steps[t.step]()
+			}
+		}(steps, turns[i])
+	}
+
+	var trace []ScheduledStep
+	next := make([]int, len(s.tasks)) // next step of every task
+	runnable := make([]int, 0, len(s.tasks))
+	for i, steps := range s.tasks {
+		if len(steps) > 0 {
+			runnable = append(runnable, i)
+		} else {
+			close(turns[i])
+		}
+	}
+
+	done := make(chan error)
+	for len(runnable) > 0 {
+		r := s.rng.IntN(len(runnable))
+		task := runnable[r]
+
+		turns[task] <- turn{step: next[task], done: done}
+		trace = append(trace, ScheduledStep{Task: task, Step: next[task], Err: <-done})
+
+		next[task]++
+		if next[task] == len(s.tasks[task]) {
+			close(turns[task])
+			runnable = append(runnable[:r], runnable[r+1:]...)
+		}
+	}
+
+	s.tasks = nil
+	return trace
+}
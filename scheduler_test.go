@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"slices"
+	"testing"
+)
+
+// scheduledStress runs workers depositing into and withdrawing from random
+// accounts, interleaved by a scheduler seeded with seed.
+func scheduledStress(seed uint64) (map[string]int, []ScheduledStep) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 100, "acc2": 50, "acc3": 30},
+	}
+	accountIds := []string{"acc1", "acc2", "acc3"}
+
+	s := NewScheduler(seed)
+	for i := range 20 {
+		accountId := accountIds[i%len(accountIds)]
+		s.Go(
+			func() error { return sm.Withdraw(accountId, 40) },
+			func() error { return sm.Deposit(accountId, 10) },
+			func() error { return sm.Transfer(accountId, accountIds[(i+1)%len(accountIds)], 25) },
+		)
+	}
+	trace := s.Run()
+	return sm.accounts, trace
+}
+
+func sameStep(a, b ScheduledStep) bool {
+	return a.Task == b.Task && a.Step == b.Step && (a.Err == nil) == (b.Err == nil)
+}
+
+func TestSchedulerReproducible(t *testing.T) {
+	accounts, trace := scheduledStress(42)
+	if len(trace) != 60 {
+		t.Fatalf("Ran %d steps; want 60", len(trace))
+	}
+
+	for range 5 {
+		again, againTrace := scheduledStress(42)
+		if !maps.Equal(accounts, again) {
+			t.Errorf("Accounts = %v; want %v from the same seed", again, accounts)
+		}
+		if !slices.EqualFunc(trace, againTrace, sameStep) {
+			t.Errorf("Trace differs for the same seed")
+		}
+	}
+
+	if _, otherTrace := scheduledStress(7); slices.EqualFunc(trace, otherTrace, sameStep) {
+		t.Errorf("Seeds 42 and 7 ran the same interleaving")
+	}
+}
+
+func TestSchedulerStepOrder(t *testing.T) {
+	s := NewScheduler(1)
+	var ran []string
+	errStep := errors.New("step failed")
+
+	s.Go(
+		func() error { ran = append(ran, "a0"); return nil },
+		func() error { ran = append(ran, "a1"); return errStep },
+	)
+	s.Go()
+	s.Go(func() error { ran = append(ran, "b0"); return nil })
+
+	trace := s.Run()
+	if len(trace) != 3 {
+		t.Fatalf("Trace = %+v; want 3 steps", trace)
+	}
+	if a0, a1 := slices.Index(ran, "a0"), slices.Index(ran, "a1"); a0 > a1 {
+		t.Errorf("Ran %v; want the steps of a task in order", ran)
+	}
+	for _, step := range trace {
+		if (step.Task == 0 && step.Step == 1) != errors.Is(step.Err, errStep) {
+			t.Errorf("Step %+v; want only task 0 step 1 to fail", step)
+		}
+	}
+	if len(s.Run()) != 0 {
+		t.Errorf("Second Run ran steps; want tasks cleared")
+	}
+}
@@ -0,0 +1,948 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidScript  = errors.New("invalid script")
+	ErrScriptNotFound = errors.New("script not found")
+	ErrScriptRejected = errors.New("rejected by script")
+	ErrScriptFailed   = errors.New("script failed")
+)
+
+// Limits of scripts, which keep them cheap to run on every operation.
+const (
+	maxScriptLength = 4096
+	maxScriptDepth  = 64 // of nested expressions
+)
+
+// scriptMetadataKey is set in the metadata of the operations derived by a
+// script to its name.
+const scriptMetadataKey = "script"
+
+// Script is custom logic operators define without recompiling vaultflow,
+// e.g. to validate operations or to derive operations from them. A script
+// reads
+//
+//	when <condition> then <action>; <action>...
+//
+// where the condition is an expression over the operation, and each action
+// one of
+//
+//	reject(message)               veto the operation with the message
+//	deposit(to, amount)           derive a deposit
+//	withdraw(from, amount)        derive a withdrawal
+//	transfer(from, to, amount)    derive a transfer
+//
+// A script that rejects has no other action. Derived operations are applied
+// once the operation that triggered them has been, not atomically with it;
+// those of an amount below 1 are skipped. They carry the name of the script
+// in their "script" metadata and do not trigger scripts in turn, though
+// scripts may still reject them. Sweeping 10% of every deposit into
+// acc1 to savings reads
+//
+//	when op.type == "deposit" && op.to == "acc1"
+//	then transfer(op.to, "savings", op.amount / 10)
+//
+// Expressions are made of integers, "strings" or 'strings', true and false,
+// the operators + - * / % == != < <= > >= && || ! and in, e.g.
+// op.to in ["acc1", "acc2"], parentheses, the fields of the operation op.id,
+// op.type, op.from, op.to, op.amount, op.memo, op.category, op.from_bucket,
+// op.to_bucket, op.hour, op.weekday and op.metadata["key"], and the
+// functions balance(account), min, max, abs, len, has_prefix, has_suffix and
+// contains. They are type checked when the script is compiled, and have no
+// loops or side effects; a script that fails as it runs, e.g. dividing by
+// zero, rejects the operation.
+type Script struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+
+	when    scriptExpr
+	actions []scriptAction
+}
+
+// scriptKind is the type of an expression.
+type scriptKind string
+
+const (
+	kindInt    scriptKind = "int"
+	kindString scriptKind = "string"
+	kindBool   scriptKind = "bool"
+	kindMap    scriptKind = "map"
+	kindList   scriptKind = "list"
+)
+
+// scriptEnv is what expressions are evaluated against.
+type scriptEnv struct {
+	op      Operation
+	now     time.Time // of operations not yet given a time
+	balance func(id string) (int, error)
+}
+
+// scriptExpr is a compiled expression, whose eval returns a value of its
+// kind: an int, string, bool, map[string]string or []any.
+type scriptExpr struct {
+	kind scriptKind
+	eval func(env *scriptEnv) (any, error)
+}
+
+type scriptAction struct {
+	name string
+	args []scriptExpr
+}
+
+// scriptActions are the parameter kinds of each action.
+var scriptActions = map[string][]scriptKind{
+	"reject":   {kindString},
+	"deposit":  {kindString, kindInt},
+	"withdraw": {kindString, kindInt},
+	"transfer": {kindString, kindString, kindInt},
+}
+
+// CompileScript parses and type checks the script source, see Script.
+func CompileScript(name, source string) (*Script, error) {
+	if name == "" {
+		return nil, fmt.Errorf("%w: no name", ErrInvalidScript)
+	}
+	if len(source) > maxScriptLength {
+		return nil, fmt.Errorf("%w: %s: longer than %d bytes", ErrInvalidScript, name, maxScriptLength)
+	}
+
+	p := &scriptParser{src: source}
+	s, err := p.script()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalidScript, name, err)
+	}
+	s.Name, s.Source = name, source
+	return s, nil
+}
+
+// rejects reports whether the script validates operations rather than
+// deriving them.
+func (s *Script) rejects() bool {
+	return s.actions[0].name == "reject"
+}
+
+// match evaluates the condition of the script.
+func (s *Script) match(env *scriptEnv) (bool, error) {
+	return s.when.holds(env)
+}
+
+// holds evaluates a bool expression.
+func (e scriptExpr) holds(env *scriptEnv) (bool, error) {
+	v, err := e.eval(env)
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+// compileCondition compiles a bool expression in the language of scripts,
+// e.g. for policies.
+func compileCondition(source string) (scriptExpr, error) {
+	if len(source) > maxScriptLength {
+		return scriptExpr{}, fmt.Errorf("longer than %d bytes", maxScriptLength)
+	}
+	p := &scriptParser{src: source}
+	e, err := p.expr()
+	if err != nil {
+		return e, err
+	}
+	if p.skip(); p.pos < len(p.src) {
+		return e, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	if e.kind != kindBool {
+		return e, p.errorf("condition is %s, not bool", e.kind)
+	}
+	return e, nil
+}
+
+// rejection returns the message the script vetoes the operation of env
+// with, or "" if it does not.
+func (s *Script) rejection(env *scriptEnv) (string, error) {
+	if matched, err := s.match(env); err != nil || !matched {
+		return "", err
+	}
+	v, err := s.actions[0].args[0].eval(env)
+	if err != nil {
+		return "", err
+	}
+	return cmp.Or(v.(string), "rejected"), nil
+}
+
+// derive returns the operations the script derives from the operation of
+// env.
+func (s *Script) derive(env *scriptEnv) ([]Operation, error) {
+	if matched, err := s.match(env); err != nil || !matched {
+		return nil, err
+	}
+
+	var derived []Operation
+	for _, action := range s.actions {
+		args := make([]any, len(action.args))
+		for i, arg := range action.args {
+			v, err := arg.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+
+		op := Operation{Type: OperationType(action.name)}
+		switch op.Type {
+		case OpDeposit:
+			op.To, op.Amount = args[0].(string), args[1].(int)
+		case OpWithdraw:
+			op.From, op.Amount = args[0].(string), args[1].(int)
+		case OpTransfer:
+			op.From, op.To, op.Amount = args[0].(string), args[1].(string), args[2].(int)
+		}
+		if op.Amount < 1 {
+			continue
+		}
+		op.CorrelationID = env.op.CorrelationID
+		op.Metadata = map[string]string{scriptMetadataKey: s.Name}
+		derived = append(derived, op)
+	}
+	return derived, nil
+}
+
+// scripts are the scripts set on a state machine, see SetScript.
+type scripts struct {
+	mu     sync.RWMutex
+	byName map[string]*Script
+	hooked bool // the hooks running them are registered
+}
+
+// sorted returns the scripts in the order they run, by name.
+func (sc *scripts) sorted() []*Script {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	return slices.SortedFunc(maps.Values(sc.byName), func(a, b *Script) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+// SetScript compiles source and runs it for every later operation, see
+// Script, replacing the script of the same name if there is one. Scripts
+// run in the order of their names.
+func (sm *StateMachine) SetScript(name, source string) (*Script, error) {
+	s, err := CompileScript(name, source)
+	if err != nil {
+		return nil, err
+	}
+
+	sm.scripts.mu.Lock()
+	defer sm.scripts.mu.Unlock()
+
+	if sm.scripts.byName == nil {
+		sm.scripts.byName = map[string]*Script{}
+	}
+	sm.scripts.byName[name] = s
+	if !sm.scripts.hooked {
+		sm.RegisterHooks(sm.scriptHooks())
+		sm.scripts.hooked = true
+	}
+	return s, nil
+}
+
+// Scripts returns the scripts set, by name.
+func (sm *StateMachine) Scripts() []Script {
+	var list []Script
+	for _, s := range sm.scripts.sorted() {
+		list = append(list, *s)
+	}
+	return list
+}
+
+// RemoveScript stops running the script of the given name.
+func (sm *StateMachine) RemoveScript(name string) error {
+	sm.scripts.mu.Lock()
+	defer sm.scripts.mu.Unlock()
+
+	if _, ok := sm.scripts.byName[name]; !ok {
+		return fmt.Errorf("%w (%s)", ErrScriptNotFound, name)
+	}
+	delete(sm.scripts.byName, name)
+	return nil
+}
+
+// scriptEnv returns the environment scripts evaluate op in.
+func (sm *StateMachine) scriptEnv(op Operation) *scriptEnv {
+	return &scriptEnv{op: op, now: sm.now(), balance: sm.Balance}
+}
+
+// scriptHooks run the scripts set: those rejecting before operations and
+// those deriving operations after them. Failures to apply derived
+// operations are only logged, as the operation is applied by then.
+func (sm *StateMachine) scriptHooks() Hooks {
+	return Hooks{
+		BeforeOperation: func(ctx context.Context, op Operation) error {
+			env := sm.scriptEnv(op)
+			for _, s := range sm.scripts.sorted() {
+				if !s.rejects() {
+					continue
+				}
+				msg, err := s.rejection(env)
+				if err != nil {
+					return fmt.Errorf("%w: %s: %w", ErrScriptFailed, s.Name, err)
+				}
+				if msg != "" {
+					return fmt.Errorf("%w %s: %s", ErrScriptRejected, s.Name, msg)
+				}
+			}
+			return nil
+		},
+		AfterOperation: func(ctx context.Context, op Operation) {
+			if op.Metadata[scriptMetadataKey] != "" {
+				return
+			}
+			env := sm.scriptEnv(op)
+			for _, s := range sm.scripts.sorted() {
+				if s.rejects() {
+					continue
+				}
+				derived, err := s.derive(env)
+				if err != nil {
+					fmt.Printf("Script Error: %s: %v\n", s.Name, err)
+					continue
+				}
+				for _, d := range derived {
+					if _, err := sm.ApplyContext(ctx, d); err != nil {
+						fmt.Printf("Script Error: %s: %s of %d: %v\n", s.Name, d.Type, d.Amount, err)
+					}
+				}
+			}
+		},
+	}
+}
+
+// scriptParser compiles scripts, reading the source as it goes.
+type scriptParser struct {
+	src   string
+	pos   int
+	depth int
+}
+
+func (p *scriptParser) script() (*Script, error) {
+	if p.name() != "when" {
+		return nil, p.errorf("expected when")
+	}
+	when, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if when.kind != kindBool {
+		return nil, p.errorf("condition is %s, not bool", when.kind)
+	}
+	if p.name() != "then" {
+		return nil, p.errorf("expected then")
+	}
+
+	s := &Script{when: when}
+	for {
+		action, err := p.action()
+		if err != nil {
+			return nil, err
+		}
+		s.actions = append(s.actions, action)
+		if !p.accept(";") {
+			break
+		}
+	}
+	if p.skip(); p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	for _, action := range s.actions {
+		if action.name == "reject" && len(s.actions) > 1 {
+			return nil, p.errorf("reject must be the only action")
+		}
+	}
+	return s, nil
+}
+
+func (p *scriptParser) action() (scriptAction, error) {
+	name := p.name()
+	params, ok := scriptActions[name]
+	if !ok {
+		return scriptAction{}, p.errorf("unknown action %q", name)
+	}
+	args, err := p.args(name, params)
+	return scriptAction{name: name, args: args}, err
+}
+
+// args parses the parenthesized arguments of a call, which must be of the
+// given kinds.
+func (p *scriptParser) args(name string, params []scriptKind) ([]scriptExpr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var args []scriptExpr
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) != len(params) {
+		return nil, p.errorf("%s takes %d arguments, got %d", name, len(params), len(args))
+	}
+	for i, arg := range args {
+		if arg.kind != params[i] {
+			return nil, p.errorf("argument %d of %s is %s, not %s", i+1, name, arg.kind, params[i])
+		}
+	}
+	return args, nil
+}
+
+func (p *scriptParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%s at offset %d", fmt.Sprintf(format, args...), p.pos)
+}
+
+// skip skips whitespace and comments.
+func (p *scriptParser) skip() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *scriptParser) peek(punct string) bool {
+	p.skip()
+	return strings.HasPrefix(p.src[p.pos:], punct)
+}
+
+func (p *scriptParser) accept(punct string) bool {
+	if p.peek(punct) {
+		p.pos += len(punct)
+		return true
+	}
+	return false
+}
+
+func (p *scriptParser) expect(punct string) error {
+	if !p.accept(punct) {
+		return p.errorf("expected %q", punct)
+	}
+	return nil
+}
+
+// name returns the next name, or "" if there is none.
+func (p *scriptParser) name() string {
+	p.skip()
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || p.pos > start && '0' <= c && c <= '9' {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.src[start:p.pos]
+}
+
+// acceptName consumes the next name if it is keyword.
+func (p *scriptParser) acceptName(keyword string) bool {
+	start := p.pos
+	if p.name() == keyword {
+		return true
+	}
+	p.pos = start
+	return false
+}
+
+// expr parses an expression, operators binding from loosest to tightest:
+// ||, &&, comparisons and in, + and -, then * / and %.
+func (p *scriptParser) expr() (scriptExpr, error) {
+	if p.depth++; p.depth > maxScriptDepth {
+		return scriptExpr{}, p.errorf("expressions nested deeper than %d", maxScriptDepth)
+	}
+	defer func() { p.depth-- }()
+	return p.or()
+}
+
+func (p *scriptParser) or() (scriptExpr, error) {
+	left, err := p.and()
+	for err == nil && p.accept("||") {
+		var right scriptExpr
+		if right, err = p.and(); err == nil {
+			left, err = p.logical("||", left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *scriptParser) and() (scriptExpr, error) {
+	left, err := p.comparison()
+	for err == nil && p.accept("&&") {
+		var right scriptExpr
+		if right, err = p.comparison(); err == nil {
+			left, err = p.logical("&&", left, right)
+		}
+	}
+	return left, err
+}
+
+// logical combines two bool expressions, evaluating right only if left
+// does not decide the result.
+func (p *scriptParser) logical(op string, left, right scriptExpr) (scriptExpr, error) {
+	if left.kind != kindBool || right.kind != kindBool {
+		return scriptExpr{}, p.errorf("%s of %s and %s", op, left.kind, right.kind)
+	}
+	short := op == "||" // the value of left deciding the result
+	return scriptExpr{kind: kindBool, eval: func(env *scriptEnv) (any, error) {
+		l, err := left.eval(env)
+		if err != nil || l.(bool) == short {
+			return l, err
+		}
+		return right.eval(env)
+	}}, nil
+}
+
+func (p *scriptParser) comparison() (scriptExpr, error) {
+	left, err := p.additive()
+	if err != nil {
+		return left, err
+	}
+	if p.acceptName("in") {
+		right, err := p.list()
+		if err != nil {
+			return right, err
+		}
+		return p.in(left, right)
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if !p.accept(op) {
+			continue
+		}
+		right, err := p.additive()
+		if err != nil {
+			return right, err
+		}
+		return p.compare(op, left, right)
+	}
+	return left, nil
+}
+
+func (p *scriptParser) compare(op string, left, right scriptExpr) (scriptExpr, error) {
+	ordered := left.kind == kindInt || left.kind == kindString
+	if left.kind != right.kind || left.kind == kindMap || left.kind == kindList || !ordered && op != "==" && op != "!=" {
+		return scriptExpr{}, p.errorf("%s of %s and %s", op, left.kind, right.kind)
+	}
+	return scriptExpr{kind: kindBool, eval: func(env *scriptEnv) (any, error) {
+		l, err := left.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		}
+		var c int
+		if left.kind == kindInt {
+			c = cmp.Compare(l.(int), r.(int))
+		} else {
+			c = strings.Compare(l.(string), r.(string))
+		}
+		switch op {
+		case "<":
+			return c < 0, nil
+		case "<=":
+			return c <= 0, nil
+		case ">":
+			return c > 0, nil
+		}
+		return c >= 0, nil
+	}}, nil
+}
+
+// list parses a list of values of the same kind, [a, b, ...].
+func (p *scriptParser) list() (scriptExpr, error) {
+	if err := p.expect("["); err != nil {
+		return scriptExpr{}, err
+	}
+	var items []scriptExpr
+	for !p.accept("]") {
+		if len(items) > 0 {
+			if err := p.expect(","); err != nil {
+				return scriptExpr{}, err
+			}
+		}
+		item, err := p.expr()
+		if err != nil {
+			return item, err
+		}
+		if len(items) > 0 && item.kind != items[0].kind {
+			return scriptExpr{}, p.errorf("list of %s and %s", items[0].kind, item.kind)
+		}
+		items = append(items, item)
+	}
+	return scriptExpr{kind: kindList, eval: func(env *scriptEnv) (any, error) {
+		values := make([]any, len(items))
+		for i, item := range items {
+			v, err := item.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return values, nil
+	}}, nil
+}
+
+func (p *scriptParser) in(left, right scriptExpr) (scriptExpr, error) {
+	if left.kind != kindInt && left.kind != kindString {
+		return scriptExpr{}, p.errorf("in of %s", left.kind)
+	}
+	return scriptExpr{kind: kindBool, eval: func(env *scriptEnv) (any, error) {
+		l, err := left.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		return slices.Contains(r.([]any), l), nil
+	}}, nil
+}
+
+func (p *scriptParser) additive() (scriptExpr, error) {
+	left, err := p.multiplicative()
+	for err == nil {
+		op := ""
+		if p.accept("+") {
+			op = "+"
+		} else if p.accept("-") {
+			op = "-"
+		} else {
+			break
+		}
+		var right scriptExpr
+		if right, err = p.multiplicative(); err == nil {
+			left, err = p.arithmetic(op, left, right)
+		}
+	}
+	return left, err
+}
+
+func (p *scriptParser) multiplicative() (scriptExpr, error) {
+	left, err := p.unary()
+	for err == nil {
+		op := ""
+		if p.accept("*") {
+			op = "*"
+		} else if p.accept("/") {
+			op = "/"
+		} else if p.accept("%") {
+			op = "%"
+		} else {
+			break
+		}
+		var right scriptExpr
+		if right, err = p.unary(); err == nil {
+			left, err = p.arithmetic(op, left, right)
+		}
+	}
+	return left, err
+}
+
+// arithmetic combines two ints, or concatenates two strings with +.
+func (p *scriptParser) arithmetic(op string, left, right scriptExpr) (scriptExpr, error) {
+	concat := op == "+" && left.kind == kindString && right.kind == kindString
+	if !concat && (left.kind != kindInt || right.kind != kindInt) {
+		return scriptExpr{}, p.errorf("%s of %s and %s", op, left.kind, right.kind)
+	}
+	return scriptExpr{kind: left.kind, eval: func(env *scriptEnv) (any, error) {
+		l, err := left.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if concat {
+			return l.(string) + r.(string), nil
+		}
+		a, b := l.(int), r.(int)
+		switch op {
+		case "+":
+			return a + b, nil
+		case "-":
+			return a - b, nil
+		case "*":
+			return a * b, nil
+		}
+		if b == 0 {
+			return nil, errors.New("division by zero")
+		}
+		if op == "/" {
+			return a / b, nil
+		}
+		return a % b, nil
+	}}, nil
+}
+
+func (p *scriptParser) unary() (scriptExpr, error) {
+	if p.peek("!") && !p.peek("!=") {
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return operand, err
+		}
+		if operand.kind != kindBool {
+			return scriptExpr{}, p.errorf("! of %s", operand.kind)
+		}
+		return scriptExpr{kind: kindBool, eval: func(env *scriptEnv) (any, error) {
+			v, err := operand.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			return !v.(bool), nil
+		}}, nil
+	}
+	if p.accept("-") {
+		operand, err := p.unary()
+		if err != nil {
+			return operand, err
+		}
+		if operand.kind != kindInt {
+			return scriptExpr{}, p.errorf("- of %s", operand.kind)
+		}
+		return scriptExpr{kind: kindInt, eval: func(env *scriptEnv) (any, error) {
+			v, err := operand.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			return -v.(int), nil
+		}}, nil
+	}
+	return p.postfix()
+}
+
+// postfix parses a primary expression and any index of it, e.g.
+// op.metadata["key"], which is "" for keys not set.
+func (p *scriptParser) postfix() (scriptExpr, error) {
+	e, err := p.primary()
+	for err == nil && p.accept("[") {
+		var key scriptExpr
+		if key, err = p.expr(); err != nil {
+			break
+		}
+		if err = p.expect("]"); err != nil {
+			break
+		}
+		if e.kind != kindMap || key.kind != kindString {
+			return scriptExpr{}, p.errorf("index of %s by %s", e.kind, key.kind)
+		}
+		m := e
+		e = scriptExpr{kind: kindString, eval: func(env *scriptEnv) (any, error) {
+			v, err := m.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			k, err := key.eval(env)
+			if err != nil {
+				return nil, err
+			}
+			return v.(map[string]string)[k.(string)], nil
+		}}
+	}
+	return e, err
+}
+
+func (p *scriptParser) primary() (scriptExpr, error) {
+	p.skip()
+	if p.pos == len(p.src) {
+		return scriptExpr{}, p.errorf("unexpected end")
+	}
+	switch c := p.src[p.pos]; {
+	case c == '(':
+		p.pos++
+		e, err := p.expr()
+		if err == nil {
+			err = p.expect(")")
+		}
+		return e, err
+	case c == '"' || c == '\'':
+		s, err := p.quoted()
+		return constant(kindString, s), err
+	case '0' <= c && c <= '9':
+		start := p.pos
+		for p.pos < len(p.src) && '0' <= p.src[p.pos] && p.src[p.pos] <= '9' {
+			p.pos++
+		}
+		n, err := strconv.Atoi(p.src[start:p.pos])
+		if err != nil {
+			return scriptExpr{}, p.errorf("invalid number %s", p.src[start:p.pos])
+		}
+		return constant(kindInt, n), nil
+	}
+
+	switch name := p.name(); name {
+	case "":
+		return scriptExpr{}, p.errorf("expected an expression")
+	case "true", "false":
+		return constant(kindBool, name == "true"), nil
+	case "op":
+		if err := p.expect("."); err != nil {
+			return scriptExpr{}, err
+		}
+		field := p.name()
+		e, ok := scriptFields[field]
+		if !ok {
+			return e, p.errorf("unknown field op.%s", field)
+		}
+		return e, nil
+	default:
+		fn, ok := scriptFunctions[name]
+		if !ok {
+			return scriptExpr{}, p.errorf("unknown name %q", name)
+		}
+		args, err := p.args(name, fn.params)
+		if err != nil {
+			return scriptExpr{}, err
+		}
+		return scriptExpr{kind: fn.kind, eval: func(env *scriptEnv) (any, error) {
+			values := make([]any, len(args))
+			for i, arg := range args {
+				v, err := arg.eval(env)
+				if err != nil {
+					return nil, err
+				}
+				values[i] = v
+			}
+			return fn.call(env, values)
+		}}, nil
+	}
+}
+
+// string parses a string in double quotes, with the escapes of Go, or in
+// single quotes, without escapes.
+func (p *scriptParser) quoted() (string, error) {
+	quote := p.src[p.pos]
+	end := p.pos + 1
+	for end < len(p.src) && p.src[end] != quote {
+		if quote == '"' && p.src[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(p.src) {
+		return "", p.errorf("unterminated string")
+	}
+	lit := p.src[p.pos : end+1]
+	p.pos = end + 1
+	if quote == '\'' {
+		return lit[1 : len(lit)-1], nil
+	}
+	s, err := strconv.Unquote(lit)
+	if err != nil {
+		return "", p.errorf("invalid string %s", lit)
+	}
+	return s, nil
+}
+
+func constant(kind scriptKind, v any) scriptExpr {
+	return scriptExpr{kind: kind, eval: func(*scriptEnv) (any, error) { return v, nil }}
+}
+
+// opField returns the expression of a field of the operation.
+func opField(kind scriptKind, get func(env *scriptEnv) any) scriptExpr {
+	return scriptExpr{kind: kind, eval: func(env *scriptEnv) (any, error) { return get(env), nil }}
+}
+
+// opTime returns when the operation was applied, or is being.
+func (env *scriptEnv) opTime() time.Time {
+	if env.op.Time.IsZero() {
+		return env.now
+	}
+	return env.op.Time
+}
+
+var scriptFields = map[string]scriptExpr{
+	"id":          opField(kindString, func(env *scriptEnv) any { return env.op.ID }),
+	"type":        opField(kindString, func(env *scriptEnv) any { return string(env.op.Type) }),
+	"from":        opField(kindString, func(env *scriptEnv) any { return env.op.From }),
+	"to":          opField(kindString, func(env *scriptEnv) any { return env.op.To }),
+	"amount":      opField(kindInt, func(env *scriptEnv) any { return env.op.Amount }),
+	"memo":        opField(kindString, func(env *scriptEnv) any { return env.op.Memo }),
+	"category":    opField(kindString, func(env *scriptEnv) any { return env.op.Category }),
+	"from_bucket": opField(kindString, func(env *scriptEnv) any { return env.op.FromBucket }),
+	"to_bucket":   opField(kindString, func(env *scriptEnv) any { return env.op.ToBucket }),
+	"hour":        opField(kindInt, func(env *scriptEnv) any { return env.opTime().Hour() }),
+	"weekday": opField(kindString, func(env *scriptEnv) any {
+		return strings.ToLower(env.opTime().Weekday().String())
+	}),
+	"metadata": opField(kindMap, func(env *scriptEnv) any {
+		if env.op.Metadata == nil {
+			return map[string]string{}
+		}
+		return env.op.Metadata
+	}),
+}
+
+type scriptFunction struct {
+	params []scriptKind
+	kind   scriptKind
+	call   func(env *scriptEnv, args []any) (any, error)
+}
+
+var scriptFunctions = map[string]scriptFunction{
+	"balance": {[]scriptKind{kindString}, kindInt, func(env *scriptEnv, args []any) (any, error) {
+		return env.balance(args[0].(string))
+	}},
+	"min": {[]scriptKind{kindInt, kindInt}, kindInt, func(env *scriptEnv, args []any) (any, error) {
+		return min(args[0].(int), args[1].(int)), nil
+	}},
+	"max": {[]scriptKind{kindInt, kindInt}, kindInt, func(env *scriptEnv, args []any) (any, error) {
+		return max(args[0].(int), args[1].(int)), nil
+	}},
+	"abs": {[]scriptKind{kindInt}, kindInt, func(env *scriptEnv, args []any) (any, error) {
+		return max(args[0].(int), -args[0].(int)), nil
+	}},
+	"len": {[]scriptKind{kindString}, kindInt, func(env *scriptEnv, args []any) (any, error) {
+		return len(args[0].(string)), nil
+	}},
+	"has_prefix": {[]scriptKind{kindString, kindString}, kindBool, func(env *scriptEnv, args []any) (any, error) {
+		return strings.HasPrefix(args[0].(string), args[1].(string)), nil
+	}},
+	"has_suffix": {[]scriptKind{kindString, kindString}, kindBool, func(env *scriptEnv, args []any) (any, error) {
+		return strings.HasSuffix(args[0].(string), args[1].(string)), nil
+	}},
+	"contains": {[]scriptKind{kindString, kindString}, kindBool, func(env *scriptEnv, args []any) (any, error) {
+		return strings.Contains(args[0].(string), args[1].(string)), nil
+	}},
+}
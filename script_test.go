@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileScript(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		valid  bool
+	}{
+		{"Reject", `when op.amount > 500 then reject("too large")`, true},
+		{"Derive", "when op.type == 'deposit' # every deposit\nthen transfer(op.to, 'savings', op.amount / 10); deposit('fees', 1)", true},
+		{"No when", `op.amount > 500 then reject("too large")`, false},
+		{"No then", `when op.amount > 500 reject("too large")`, false},
+		{"Condition not bool", `when op.amount then reject("x")`, false},
+		{"Unknown field", `when op.balance > 0 then reject("x")`, false},
+		{"Unknown function", `when exec("rm") then reject("x")`, false},
+		{"Unknown action", `when true then freeze(op.from)`, false},
+		{"Mismatched types", `when op.amount == "500" then reject("x")`, false},
+		{"Wrong argument count", `when true then deposit("acc1")`, false},
+		{"Wrong argument type", `when true then deposit(op.amount, op.to)`, false},
+		{"Reject and derive", `when true then deposit("acc1", 1); reject("x")`, false},
+		{"Mixed list", `when op.to in ["acc1", 2] then reject("x")`, false},
+		{"Trailing input", `when true then reject("x") else`, false},
+		{"Unterminated string", `when op.to == "acc1 then reject("x")`, false},
+		{"Too deep", "when " + strings.Repeat("(", maxScriptDepth+1) + "true" + strings.Repeat(")", maxScriptDepth+1) + ` then reject("x")`, false},
+		{"Too long", `when true then reject("` + strings.Repeat("x", maxScriptLength) + `")`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := CompileScript("s", tt.source)
+			if tt.valid && err != nil {
+				t.Errorf("CompileScript() = %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidScript) {
+				t.Errorf("CompileScript() error = %v; want %v", err, ErrInvalidScript)
+			}
+		})
+	}
+}
+
+func TestScriptConditions(t *testing.T) {
+	op := Operation{
+		Type: OpTransfer, From: "acc1", To: "acc2", Amount: 250, Category: "rent",
+		Time:     time.Date(2026, 3, 7, 22, 15, 0, 0, time.UTC), // a Saturday
+		Metadata: map[string]string{"invoice": "42"},
+	}
+	balances := map[string]int{"acc1": 1000}
+	env := &scriptEnv{op: op, balance: func(id string) (int, error) {
+		balance, ok := balances[id]
+		if !ok {
+			return 0, ErrInvalidAccount
+		}
+		return balance, nil
+	}}
+
+	tests := []struct {
+		condition string
+		want      bool
+	}{
+		{`op.type == "transfer" && op.amount >= 250`, true},
+		{`op.amount > 250 || op.category == 'rent'`, true},
+		{`!(op.from == "acc1")`, false},
+		{`1 + 2 * 3 == 7 && (1 + 2) * 3 == 9 && 7 % 4 == 3 && -op.amount == 0 - 250`, true},
+		{`op.amount * 10 / 100 == 25`, true},
+		{`"acc" + "1" == op.from && "b" > "a"`, true},
+		{`op.to in ["acc2", "acc3"] && !(op.amount in [1, 2])`, true},
+		{`op.metadata["invoice"] == "42" && op.metadata["missing"] == ""`, true},
+		{`op.hour >= 22 && op.weekday == "saturday"`, true},
+		{`balance(op.from) - op.amount < 800`, true},
+		{`min(op.amount, 100) == 100 && max(op.amount, 100) == 250 && abs(-3) == 3`, true},
+		{`len(op.from) == 4 && has_prefix(op.from, "acc") && has_suffix(op.to, "2") && contains(op.category, "en")`, true},
+		{`false && 1 / 0 == 0`, false}, // short-circuits
+		{`true || balance("unknown") > 0`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			s, err := CompileScript("s", "when "+tt.condition+` then reject("x")`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := s.match(env); err != nil || got != tt.want {
+				t.Errorf("match() = %t, %v; want %t", got, err, tt.want)
+			}
+		})
+	}
+
+	for _, condition := range []string{`op.amount / (op.amount - 250) > 0`, `balance("unknown") > 0`} {
+		s, err := CompileScript("s", "when "+condition+` then reject("x")`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.match(env); err == nil {
+			t.Errorf("match(%s) succeeded; want an error", condition)
+		}
+	}
+}
+
+func TestSetScript(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "savings": 0}}
+	if _, err := sm.SetScript("sweep", `when op.type == "deposit" && op.to == "acc1" then transfer(op.to, "savings", op.amount / 10)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.SetScript("cap", `when op.type == "withdraw" && op.amount > 500 then reject("withdrawals above 500 need approval")`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.SetScript("bad", "when true then"); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("SetScript() of an invalid script error = %v; want %v", err, ErrInvalidScript)
+	}
+	if scripts := sm.Scripts(); len(scripts) != 2 || scripts[0].Name != "cap" || scripts[1].Name != "sweep" {
+		t.Errorf("Scripts() = %+v; want cap and sweep", scripts)
+	}
+
+	// 10% of deposits into acc1 is swept, not of the sweep itself.
+	if err := sm.Deposit("acc1", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Deposit("acc1", 5); err != nil {
+		t.Fatal(err)
+	}
+	if balances := sm.Balances(); balances["acc1"] != 1095 || balances["savings"] != 10 {
+		t.Errorf("Balances() = %v; want 10 swept to savings", balances)
+	}
+	journal := sm.journal
+	if derived := journal[1]; derived.Type != OpTransfer || derived.Metadata[scriptMetadataKey] != "sweep" {
+		t.Errorf("Derived operation = %+v; want a transfer of the sweep script", derived)
+	}
+
+	err := sm.Withdraw("acc1", 600)
+	if !errors.Is(err, ErrVetoed) || !errors.Is(err, ErrScriptRejected) || !strings.Contains(err.Error(), "need approval") {
+		t.Errorf("Withdraw(600) error = %v; want the cap script's rejection", err)
+	}
+	if err := sm.Withdraw("acc1", 100); err != nil {
+		t.Errorf("Withdraw(100) = %v", err)
+	}
+
+	// Scripts failing as they run reject the operation.
+	if _, err := sm.SetScript("cap", `when op.amount / 0 > 1 then reject("x")`); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Deposit("savings", 1); !errors.Is(err, ErrScriptFailed) {
+		t.Errorf("Deposit() error = %v; want %v", err, ErrScriptFailed)
+	}
+
+	if err := sm.RemoveScript("cap"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.RemoveScript("cap"); !errors.Is(err, ErrScriptNotFound) {
+		t.Errorf("RemoveScript() twice error = %v; want %v", err, ErrScriptNotFound)
+	}
+	if err := sm.Deposit("savings", 1); err != nil {
+		t.Errorf("Deposit() once the script is removed = %v", err)
+	}
+}
+
+func TestServerScripts(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPut, "/scripts/cap", `{"source": "when op.amount > 500 then reject('too large')"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("PUT /scripts/cap = %d; want 200 (%s)", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodPut, "/scripts/bad", `{"source": "when op.amount then reject('x')"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("PUT of an invalid script = %d; want 400", rec.Code)
+	}
+
+	rec = do(http.MethodGet, "/scripts", "")
+	var scripts []Script
+	if err := json.Unmarshal(rec.Body.Bytes(), &scripts); err != nil {
+		t.Fatal(err)
+	}
+	if len(scripts) != 1 || scripts[0].Name != "cap" || !strings.Contains(scripts[0].Source, "too large") {
+		t.Errorf("GET /scripts = %+v; want the cap script", scripts)
+	}
+	if err := sm.Withdraw("acc1", 600); !errors.Is(err, ErrScriptRejected) {
+		t.Errorf("Withdraw() error = %v; want %v", err, ErrScriptRejected)
+	}
+
+	if rec := do(http.MethodDelete, "/scripts/cap", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d; want 204 (%s)", rec.Code, rec.Body)
+	}
+	if rec := do(http.MethodDelete, "/scripts/cap", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Second DELETE = %d; want 404", rec.Code)
+	}
+}
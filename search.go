@@ -0,0 +1,218 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// OperationFilter selects the operations SearchOperations returns. Zero
+// fields select every operation.
+type OperationFilter struct {
+	Account string        // operations from or to the account
+	Type    OperationType // operations of the type
+
+	MinAmount *int // nil means no lower bound
+	MaxAmount *int // nil means no upper bound
+
+	Since time.Time // operations applied at or after, zero means no bound
+	Until time.Time // operations applied before, zero means no bound
+
+	Metadata map[string]string // operations with every key and value
+	Memo     string            // operations whose memo contains the text, in any case
+
+	Limit int // most operations returned, 0 means no limit
+}
+
+// matches reports whether op is selected by f.
+func (f OperationFilter) matches(op Operation) bool {
+	switch {
+	case f.Account != "" && op.From != f.Account && op.To != f.Account:
+		return false
+	case f.Type != "" && op.Type != f.Type:
+		return false
+	case f.MinAmount != nil && op.Amount < *f.MinAmount || f.MaxAmount != nil && op.Amount > *f.MaxAmount:
+		return false
+	case !f.Since.IsZero() && op.Time.Before(f.Since) || !f.Until.IsZero() && !op.Time.Before(f.Until):
+		return false
+	case f.Memo != "" && !strings.Contains(strings.ToLower(op.Memo), strings.ToLower(f.Memo)):
+		return false
+	}
+	return op.hasMetadata(f.Metadata)
+}
+
+// SearchOperations returns the applied operations still in history selected
+// by filter, oldest first. The account, amount range, time range and
+// metadata keys of the filter are looked up in indexes, so a search reads
+// only the operations of its most selective criterion rather than all of
+// history.
+func (sm *StateMachine) SearchOperations(filter OperationFilter) []Operation {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	var ops []Operation
+	for _, i := range sm.opIndex.candidates(filter, len(sm.journal)) {
+		if op := sm.journal[i]; filter.matches(op) {
+			ops = append(ops, op)
+			if len(ops) == filter.Limit {
+				break
+			}
+		}
+	}
+	return ops
+}
+
+// operationIndex indexes the journal for SearchOperations. Entries hold the
+// sequence number of an operation, its position in the journal plus the
+// number of operations forgotten before it, so they stay valid as the oldest
+// operations are forgotten. Entries of forgotten operations are skipped and
+// dropped when the index is rebuilt.
+type operationIndex struct {
+	start int // sequence number of journal[0]
+	stale int // entries of forgotten operations
+
+	byAccount  map[string][]int // sequence numbers, ascending
+	byMetadata map[string][]int // by metadata key, sequence numbers, ascending
+	byAmount   []amountEntry    // ordered by amount
+	byTime     []timeEntry      // ordered by time
+}
+
+type amountEntry struct {
+	amount int
+	seq    int
+}
+
+type timeEntry struct {
+	time time.Time
+	seq  int
+}
+
+// add indexes op, the operation with sequence number seq.
+func (x *operationIndex) add(seq int, op Operation) {
+	if x.byAccount == nil {
+		x.byAccount = map[string][]int{}
+		x.byMetadata = map[string][]int{}
+	}
+	for _, id := range op.accounts() {
+		x.byAccount[id] = append(x.byAccount[id], seq)
+	}
+	for key := range op.Metadata {
+		x.byMetadata[key] = append(x.byMetadata[key], seq)
+	}
+
+	// Operations mostly arrive in time order, so these inserts are mostly
+	// appends.
+	i, _ := slices.BinarySearchFunc(x.byAmount, op.Amount, func(e amountEntry, amount int) int {
+		if e.amount <= amount {
+			return -1
+		}
+		return 1
+	})
+	x.byAmount = slices.Insert(x.byAmount, i, amountEntry{op.Amount, seq})
+	i, _ = slices.BinarySearchFunc(x.byTime, op.Time, func(e timeEntry, t time.Time) int {
+		if !e.time.After(t) {
+			return -1
+		}
+		return 1
+	})
+	x.byTime = slices.Insert(x.byTime, i, timeEntry{op.Time, seq})
+}
+
+// rebuild indexes journal afresh, journal[0] having sequence number start.
+func (x *operationIndex) rebuild(journal []Operation, start int) {
+	*x = operationIndex{start: start}
+	for i, op := range journal {
+		x.add(start+i, op)
+	}
+}
+
+// forget records that the oldest n operations of journal were forgotten,
+// rebuilding the index once it holds more forgotten operations than
+// remembered ones.
+func (x *operationIndex) forget(journal []Operation, n int) {
+	x.start += n
+	x.stale += n
+	if x.stale > len(journal) {
+		x.rebuild(journal, x.start)
+	}
+}
+
+// candidates returns the journal positions, ascending, of the operations
+// that may match f: those of the most selective indexed criterion of f, or
+// the whole journal of n operations if f has none.
+func (x *operationIndex) candidates(f OperationFilter, n int) []int {
+	var best []int // sequence numbers
+	indexed := false
+	consider := func(seqs []int) {
+		if !indexed || len(seqs) < len(best) {
+			best, indexed = seqs, true
+		}
+	}
+
+	if f.Account != "" {
+		consider(x.byAccount[f.Account])
+	}
+	for key := range f.Metadata {
+		consider(x.byMetadata[key])
+	}
+	if f.MinAmount != nil || f.MaxAmount != nil {
+		lo, hi := 0, len(x.byAmount)
+		if f.MinAmount != nil {
+			lo, _ = slices.BinarySearchFunc(x.byAmount, *f.MinAmount, func(e amountEntry, amount int) int {
+				return cmp.Compare(e.amount, amount)
+			})
+		}
+		if f.MaxAmount != nil {
+			hi, _ = slices.BinarySearchFunc(x.byAmount, *f.MaxAmount, func(e amountEntry, amount int) int {
+				if e.amount <= amount {
+					return -1
+				}
+				return 1
+			})
+		}
+		if hi-lo < len(best) || !indexed {
+			seqs := make([]int, 0, max(hi-lo, 0))
+			for _, e := range x.byAmount[lo:max(hi, lo)] {
+				seqs = append(seqs, e.seq)
+			}
+			slices.Sort(seqs)
+			consider(seqs)
+		}
+	}
+	if !f.Since.IsZero() || !f.Until.IsZero() {
+		lo, hi := 0, len(x.byTime)
+		if !f.Since.IsZero() {
+			lo, _ = slices.BinarySearchFunc(x.byTime, f.Since, func(e timeEntry, t time.Time) int {
+				return e.time.Compare(t)
+			})
+		}
+		if !f.Until.IsZero() {
+			hi, _ = slices.BinarySearchFunc(x.byTime, f.Until, func(e timeEntry, t time.Time) int {
+				return e.time.Compare(t)
+			})
+		}
+		if hi-lo < len(best) || !indexed {
+			seqs := make([]int, 0, max(hi-lo, 0))
+			for _, e := range x.byTime[lo:max(hi, lo)] {
+				seqs = append(seqs, e.seq)
+			}
+			slices.Sort(seqs)
+			consider(seqs)
+		}
+	}
+
+	var positions []int
+	if !indexed {
+		for i := range n {
+			positions = append(positions, i)
+		}
+		return positions
+	}
+	for _, seq := range best {
+		if i := seq - x.start; i >= 0 && i < n {
+			positions = append(positions, i)
+		}
+	}
+	return positions
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSearchOperations(t *testing.T) {
+	quiet(t)
+
+	start := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100_000, "acc2": 100_000, "acc3": 100_000}}
+	sm.UseClock(clock)
+	for _, op := range []Operation{
+		{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 15_000},                                        // day 0
+		{Type: OpTransfer, From: "acc2", To: "acc1", Amount: 20_000},                                        // day 1
+		{Type: OpDeposit, To: "acc1", Amount: 50_000, Metadata: map[string]string{"invoice": "42"}},         // day 2
+		{Type: OpTransfer, From: "acc1", To: "acc3", Amount: 500, Memo: "Lunch"},                            // day 3
+		{Type: OpTransfer, From: "acc1", To: "acc3", Amount: 12_000, Metadata: map[string]string{"k": "v"}}, // day 4
+		{Type: OpWithdraw, From: "acc3", Amount: 10_000},                                                    // day 5
+	} {
+		if _, err := sm.Apply(op); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(24 * time.Hour)
+	}
+
+	amount := func(v int) *int { return &v }
+	tests := []struct {
+		name            string
+		filter          OperationFilter
+		expectedAmounts []int
+	}{
+		{"All", OperationFilter{}, []int{15_000, 20_000, 50_000, 500, 12_000, 10_000}},
+		{"Account", OperationFilter{Account: "acc3"}, []int{500, 12_000, 10_000}},
+		{"Transfers over 10k of acc1", OperationFilter{Account: "acc1", Type: OpTransfer, MinAmount: amount(10_001)}, []int{15_000, 20_000, 12_000}},
+		{"Amount range", OperationFilter{MinAmount: amount(10_000), MaxAmount: amount(15_000)}, []int{15_000, 12_000, 10_000}},
+		{"Max amount", OperationFilter{MaxAmount: amount(500)}, []int{500}},
+		{"Empty amount range", OperationFilter{MinAmount: amount(20), MaxAmount: amount(10)}, nil},
+		{"Since", OperationFilter{Since: start.Add(4 * 24 * time.Hour)}, []int{12_000, 10_000}},
+		{"Until", OperationFilter{Until: start.Add(24 * time.Hour)}, []int{15_000}},
+		{"Time range", OperationFilter{Since: start.Add(24 * time.Hour), Until: start.Add(3 * 24 * time.Hour)}, []int{20_000, 50_000}},
+		{"Metadata key", OperationFilter{Metadata: map[string]string{"invoice": "42"}}, []int{50_000}},
+		{"Metadata value", OperationFilter{Metadata: map[string]string{"invoice": "43"}}, nil},
+		{"Memo", OperationFilter{Memo: "lunch"}, []int{500}},
+		{"Limit", OperationFilter{Account: "acc1", Limit: 2}, []int{15_000, 20_000}},
+		{"Unknown account", OperationFilter{Account: "acc9", MinAmount: amount(0)}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var amounts []int
+			for _, op := range sm.SearchOperations(tt.filter) {
+				amounts = append(amounts, op.Amount)
+			}
+			if !slices.Equal(amounts, tt.expectedAmounts) {
+				t.Errorf("SearchOperations(%+v) amounts = %v; want %v", tt.filter, amounts, tt.expectedAmounts)
+			}
+		})
+	}
+}
+
+// TestSearchOperationsIndex checks searches through the indexes find what a
+// scan of history finds as operations are forgotten and rolled back.
+func TestSearchOperationsIndex(t *testing.T) {
+	quiet(t)
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	sm := &StateMachine{accounts: map[string]int{"acc1": 0, "acc2": 0, "acc3": 0}, maxHistory: 20}
+	sm.UseClock(clock)
+	rng := rand.New(rand.NewPCG(1, 2))
+	accounts := []string{"acc1", "acc2", "acc3"}
+
+	amount := func(v int) *int { return &v }
+	filters := []OperationFilter{
+		{Account: "acc2"},
+		{MinAmount: amount(30), MaxAmount: amount(60)},
+		{Since: start.Add(100 * time.Minute), Until: start.Add(140 * time.Minute)},
+		{Metadata: map[string]string{"batch": "1"}},
+		{Account: "acc1", MinAmount: amount(50), Since: start.Add(110 * time.Minute)},
+	}
+
+	for i := range 200 {
+		if i%25 == 24 {
+			_ = sm.Rollback()
+		} else {
+			op := Operation{Type: OpDeposit, To: accounts[rng.IntN(3)], Amount: 1 + rng.IntN(100)}
+			if rng.IntN(2) == 0 {
+				op.Metadata = map[string]string{"batch": string(rune('0' + rng.IntN(3)))}
+			}
+			if _, err := sm.Apply(op); err != nil {
+				t.Fatal(err)
+			}
+		}
+		clock.Advance(time.Minute)
+
+		for _, filter := range filters {
+			var scanned []Operation
+			for _, op := range sm.Operations() {
+				if filter.matches(op) {
+					scanned = append(scanned, op)
+				}
+			}
+			if searched := sm.SearchOperations(filter); !slices.EqualFunc(searched, scanned, func(a, b Operation) bool { return a.ID == b.ID }) {
+				t.Fatalf("After %d operations SearchOperations(%+v) = %d operations; want %d", i+1, filter, len(searched), len(scanned))
+			}
+		}
+	}
+}
+
+func TestServerSearchOperations(t *testing.T) {
+	quiet(t)
+
+	srv, _ := newTestServer(map[string]int{"acc1": 100_000, "acc2": 0})
+	for _, body := range []string{
+		`{"from": "acc1", "to": "acc2", "amount": 15000}`,
+		`{"from": "acc1", "to": "acc2", "amount": 500}`,
+		`{"from": "acc2", "to": "acc1", "amount": 11000}`,
+	} {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/transfers", strings.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST /transfers = %d; want 200 (%s)", rec.Code, rec.Body)
+		}
+	}
+
+	tests := []struct {
+		name            string
+		query           string
+		expectedStatus  int
+		expectedAmounts []int
+	}{
+		{"Over 10k of acc1", "?account=acc1&type=transfer&min_amount=10001", http.StatusOK, []int{15000, 11000}},
+		{"Amount range", "?min_amount=400&max_amount=11000", http.StatusOK, []int{500, 11000}},
+		{"Since", "?since=2000-01-01T00:00:00Z&limit=1", http.StatusOK, []int{15000}},
+		{"Until", "?until=2000-01-01T00:00:00Z", http.StatusOK, nil},
+		{"Bad amount", "?min_amount=lots", http.StatusBadRequest, nil},
+		{"Bad time", "?since=yesterday", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/operations"+tt.query, nil))
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("GET = %d; want %d (%s)", rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+
+			var ops []Operation
+			if err := json.Unmarshal(rec.Body.Bytes(), &ops); err != nil {
+				t.Fatal(err)
+			}
+			var amounts []int
+			for _, op := range ops {
+				amounts = append(amounts, op.Amount)
+			}
+			if !slices.Equal(amounts, tt.expectedAmounts) {
+				t.Errorf("GET /operations%s amounts = %v; want %v", tt.query, amounts, tt.expectedAmounts)
+			}
+		})
+	}
+}
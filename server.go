@@ -0,0 +1,2776 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadinessCheck reports why a dependency is not ready to serve traffic, or
+// nil when it is.
+type ReadinessCheck func(ctx context.Context) error
+
+// Server exposes a StateMachine over HTTP.
+type Server struct {
+	sm   *StateMachine
+	http *http.Server
+
+	auth      *Authenticator // nil leaves the API unauthenticated
+	opTimeout time.Duration  // 0 means operations only end with the request
+	replica   *Replica       // nil unless sm is a replica, see UseReplica
+	pressure  *backpressure  // nil unless enabled, see UseBackpressure
+	dispatch  *Dispatcher    // requeues dead letters, see UseDispatcher
+	breakers  []*CircuitBreaker
+
+	correlationIDs ulids // generates correlation IDs of requests without one
+
+	mu       sync.Mutex
+	draining bool
+	checks   map[string]ReadinessCheck
+	closing  chan struct{} // closed by Close to end event streams
+}
+
+func NewServer(sm *StateMachine, addr string) *Server {
+	s := &Server{
+		sm:      sm,
+		checks:  map[string]ReadinessCheck{},
+		closing: make(chan struct{}),
+	}
+	sm.State() // published before serving, so reads never wait for the state lock
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	mux.HandleFunc("GET /"+APIVersion+"/openapi.json", handleOpenAPI)
+	for _, rt := range s.routes() {
+		for _, pattern := range rt.patterns() {
+			mux.HandleFunc(pattern, s.api(rt.handler))
+		}
+	}
+
+	s.http = &http.Server{Addr: addr, Handler: mux}
+	return s
+}
+
+// routes lists every API route. Account routes are served for the root
+// namespace and, under /tenants/{tenant}, for each tenant's namespace; all
+// of them under /v1 and, for clients predating it, without a version. The
+// summaries, parameters and body types document them in the OpenAPI
+// document, see openAPIDocument.
+func (s *Server) routes() []route {
+	return []route{
+		{method: "POST", path: "/tenants", handler: s.handleCreateTenant, rootOnly: true, summary: "Create a tenant, root admins only",
+			request: createTenantRequest{}, response: map[string]string{}, status: http.StatusCreated},
+		{method: "GET", path: "/tenants/{tenant}/quota", handler: s.handleQuota, rootOnly: true, summary: "Limits of a tenant and their usage, root admins only",
+			response: quotaResponse{}},
+		{method: "PUT", path: "/tenants/{tenant}/quota", handler: s.handleSetQuota, rootOnly: true, summary: "Set the limits of a tenant, root admins only",
+			request: Quota{}, response: quotaResponse{}},
+		{method: "GET", path: "/replication", handler: s.handleReplication, rootOnly: true, summary: "Stream the state and operations to a replica, admins only",
+			responseType: "text/event-stream"},
+		{method: "GET", path: "/backup", handler: s.handleBackup, rootOnly: true, summary: "Consistent backup of the state and its history, admins only",
+			response: backupFile{}},
+		{method: "GET", path: "/verify", handler: s.handleVerify, rootOnly: true, summary: "Replay the journal against the recorded states, admins only",
+			response: VerificationReport{}},
+		{method: "GET", path: "/flags", handler: s.handleFlags, rootOnly: true, summary: "Every feature flag, admins only",
+			response: []FlagState{}},
+		{method: "PUT", path: "/flags/{flag}", handler: s.handleSetFlag, rootOnly: true, summary: "Turn a feature flag on or off, admins only",
+			request: setFlagRequest{}, response: FlagState{}},
+		{method: "GET", path: "/breakers", handler: s.handleBreakers, rootOnly: true, summary: "Circuit breakers of external dependencies, admins only",
+			response: []BreakerStatus{}},
+		{method: "GET", path: "/wal", handler: s.handleWAL, rootOnly: true, summary: "Segments of the write-ahead log and latency of its flushes, admins only",
+			response: WALStatus{}},
+
+		{method: "GET", path: "/accounts", handler: s.handleListAccounts, summary: "Page of accounts",
+			query: []string{"cursor", "limit", "tag", "order", "min_balance", "max_balance"}, response: AccountPage{}},
+		{method: "GET", path: "/accounts/{id}", handler: s.handleBalance, summary: "Balance of an account, now or at a past version or time",
+			query: []string{"version", "at"}, response: balanceResponse{}},
+		{method: "GET", path: "/balances/top", handler: s.handleTopBalances, summary: "Accounts with the highest balances",
+			query: []string{"n"}, response: []AccountBalance{}},
+		{method: "GET", path: "/balances/total", handler: s.handleTotalBalance, summary: "Sum of every balance",
+			response: map[string]int{}},
+		{method: "GET", path: "/balances/distribution", handler: s.handleBalanceDistribution, summary: "Number of accounts between ascending bounds",
+			query: []string{"bound"}, response: []BalanceRange{}},
+		{method: "PUT", path: "/accounts/{id}/tags", handler: s.handleSetTags, summary: "Replace the tags of an account, admins only",
+			request: tagsRequest{}, response: map[string]any{}},
+		{method: "GET", path: "/accounts/{id}/status", handler: s.handleAccountStatus, summary: "Lifecycle status of an account",
+			response: statusResponse{}},
+		{method: "PUT", path: "/accounts/{id}/status", handler: s.handleSetAccountStatus, summary: "Change the status of an account",
+			request: statusRequest{}, response: statusResponse{}},
+		{method: "GET", path: "/accounts/{id}/aliases", handler: s.handleAliases, summary: "External identifiers of an account",
+			response: map[string]any{}},
+		{method: "PUT", path: "/accounts/{id}/aliases/{alias}", handler: s.handleSetAlias, summary: "Map an external identifier to an account",
+			response: map[string]any{}},
+		{method: "DELETE", path: "/accounts/{id}/aliases/{alias}", handler: s.handleRemoveAlias, summary: "Remove an alias",
+			response: map[string]any{}},
+		{method: "GET", path: "/accounts/{id}/signers", handler: s.handleSigners, summary: "Signer set of an account",
+			response: signersResponse{}},
+		{method: "PUT", path: "/accounts/{id}/signers", handler: s.handleSetSigners, summary: "Replace the signer set of an account, admins only",
+			request: SignerSet{}, response: signersResponse{}},
+		{method: "POST", path: "/accounts/{id}/deposit", handler: s.handleDeposit, summary: "Deposit to an account",
+			query: []string{"dry_run"}, request: amountRequest{}, response: balanceResponse{}},
+		{method: "POST", path: "/accounts/{id}/withdraw", handler: s.handleWithdraw, summary: "Withdraw from an account",
+			query: []string{"dry_run"}, request: amountRequest{}, response: balanceResponse{}},
+		{method: "GET", path: "/accounts/{id}/buckets", handler: s.handleBuckets, summary: "Balance of each bucket of an account",
+			response: bucketsResponse{}},
+		{method: "GET", path: "/accounts/{id}/forecast", handler: s.handleForecast, summary: "Projected daily balances of an account over the next ?days, 30 by default",
+			query: []string{"days"}, response: Forecast{}},
+		{method: "GET", path: "/accounts/{id}/statement", handler: s.handleStatement, summary: "Statement of an account from ?since until ?until, as OFX or camt.053 XML with ?format",
+			query: []string{"since", "until", "format", "currency", "scale"}, response: Statement{}},
+		{method: "POST", path: "/accounts/{id}/moves", handler: s.handleMove, summary: "Move an amount between buckets of an account",
+			request: moveRequest{}, response: bucketsResponse{}},
+		{method: "GET", path: "/accounts/{id}/stats", handler: s.handleAccountStats, summary: "Count and total amount of the operations of an account, by type, and its spending and earning by category",
+			response: accountStatsResponse{}},
+		{method: "GET", path: "/accounts/{id}/tombstones", handler: s.handleTombstones, summary: "Operations of an account pruned from history",
+			response: []Tombstone{}},
+		{method: "POST", path: "/accounts/{id}/archive", handler: s.handleArchive, summary: "Archive an account",
+			response: map[string]string{}},
+		{method: "POST", path: "/accounts/{id}/unarchive", handler: s.handleArchive, summary: "Restore an archived account",
+			response: map[string]string{}},
+		{method: "GET", path: "/archived-accounts", handler: s.handleArchivedAccounts, summary: "Archived accounts with their balances",
+			response: []ArchivedAccount{}},
+		{method: "POST", path: "/transfers", handler: s.handleTransfer, summary: "Transfer between accounts",
+			query: []string{"dry_run"}, request: transferRequest{}, response: map[string]string{}},
+		{method: "POST", path: "/rollback", handler: s.handleRollback, summary: "Roll back the latest state change, if still at if_version when given",
+			query: []string{"if_version"}, response: map[string]string{}},
+		{method: "GET", path: "/operations", handler: s.handleOperations, summary: "Applied operations still in history",
+			query: []string{"account", "type", "min_amount", "max_amount", "since", "until", "metadata", "memo", "limit"}, response: []Operation{}},
+		{method: "POST", path: "/operations/bulk", handler: s.handleBulk, summary: "Apply a stream of operations, one JSON object per line",
+			request: Operation{}, requestType: "application/x-ndjson", response: BulkResult{}, responseType: "application/x-ndjson"},
+		{method: "POST", path: "/operations/{operation}/reverse", handler: s.handleReverse, summary: "Post an operation compensating another, admins only",
+			response: Operation{}},
+		{method: "GET", path: "/events", handler: s.handleEvents, summary: "Server-sent events of later operations",
+			query: []string{"account"}, responseType: "text/event-stream"},
+		{method: "GET", path: "/stats", handler: s.handleStats, summary: "Count and total amount of the operations applied, and spending and earning by category",
+			response: Stats{}},
+		{method: "GET", path: "/hot-accounts", handler: s.handleHotAccounts, summary: "Accounts with the most operations or lock contention, admins only",
+			response: []HotAccount{}},
+		{method: "POST", path: "/locks", handler: s.handleLockAccounts, summary: "Lock accounts for the lock owner of the request",
+			request: lockRequest{}, response: []AccountLock{}},
+		{method: "DELETE", path: "/locks", handler: s.handleReleaseLocks, summary: "Release every lock of the lock owner of the request",
+			response: releaseLocksResponse{}},
+		{method: "GET", path: "/locks", handler: s.handleLocks, summary: "Locks held on accounts, admins only",
+			response: []AccountLock{}},
+		{method: "GET", path: "/memory", handler: s.handleMemory, summary: "Estimated memory held by accounts, history, indexes and queues, admins only",
+			response: MemStats{}},
+		{method: "GET", path: "/settings", handler: s.handleSettings, summary: "Current runtime settings, admins only",
+			response: settingsResponse{}},
+		{method: "PATCH", path: "/settings", handler: s.handleUpdateSettings, summary: "Change runtime settings, admins only",
+			request: settingsRequest{}, response: SettingsChange{}},
+		{method: "GET", path: "/settings/history", handler: s.handleSettingsHistory, summary: "Every change of the settings since start, admins only",
+			response: []SettingsChange{}},
+		{method: "POST", path: "/reconciliations", handler: s.handleReconcile, summary: "Reconcile an external statement, as JSON operations or CSV",
+			query: []string{"since", "until", "tolerance"}, request: []Operation{}, response: ReconciliationReport{}},
+		{method: "POST", path: "/graphql", handler: s.handleGraphQL, summary: "GraphQL query or mutation",
+			request: graphQLRequest{}, response: graphQLResponse{}},
+		{method: "GET", path: "/approvals", handler: s.handleApprovals, summary: "Transfers parked for approval",
+			response: []approvalResponse{}},
+		{method: "GET", path: "/approvals/{approval}", handler: s.handleApproval, summary: "A transfer parked for approval",
+			response: approvalResponse{}},
+		{method: "POST", path: "/approvals/{approval}/approve", handler: s.handleApprove, summary: "Approve a parked transfer, admins only",
+			response: approvalResponse{}},
+		{method: "POST", path: "/approvals/{approval}/reject", handler: s.handleReject, summary: "Reject a parked transfer, admins only",
+			request: rejectRequest{}, response: approvalResponse{}},
+		{method: "GET", path: "/debits", handler: s.handleDebits, summary: "Debits parked for signatures",
+			response: []debitResponse{}},
+		{method: "GET", path: "/debits/{debit}", handler: s.handleDebit, summary: "A debit parked for signatures",
+			response: debitResponse{}},
+		{method: "POST", path: "/debits/{debit}/sign", handler: s.handleSignDebit, summary: "Sign a debit as one of the account's signers",
+			response: debitResponse{}},
+		{method: "POST", path: "/debits/{debit}/reject", handler: s.handleRejectDebit, summary: "Reject a debit",
+			request: rejectRequest{}, response: debitResponse{}},
+		{method: "GET", path: "/escrows", handler: s.handleEscrows, summary: "Every escrow",
+			response: []escrowResponse{}},
+		{method: "POST", path: "/escrows", handler: s.handleCreateEscrow, summary: "Hold an amount in escrow",
+			request: escrowRequest{}, response: escrowResponse{}, status: http.StatusCreated},
+		{method: "GET", path: "/escrows/{escrow}", handler: s.handleEscrow, summary: "An escrow",
+			response: escrowResponse{}},
+		{method: "POST", path: "/escrows/{escrow}/release", handler: s.handleSettleEscrow, summary: "Pay an escrow to its recipient",
+			response: escrowResponse{}},
+		{method: "POST", path: "/escrows/{escrow}/refund", handler: s.handleSettleEscrow, summary: "Pay an escrow back, admins only",
+			response: escrowResponse{}},
+		{method: "GET", path: "/standing-orders", handler: s.handleStandingOrders, summary: "Every standing order",
+			response: []StandingOrder{}},
+		{method: "POST", path: "/standing-orders", handler: s.handleCreateStandingOrder, summary: "Create a standing order",
+			request: standingOrderRequest{}, response: StandingOrder{}, status: http.StatusCreated},
+		{method: "GET", path: "/standing-orders/{order}", handler: s.handleStandingOrder, summary: "A standing order",
+			response: StandingOrder{}},
+		{method: "DELETE", path: "/standing-orders/{order}", handler: s.handleCancelStandingOrder, summary: "Cancel a standing order",
+			response: StandingOrder{}},
+		{method: "POST", path: "/settlements", handler: s.handleSettle, summary: "Settle a batch of obligations with net transfers",
+			query: []string{"dry_run"}, request: settlementRequest{}, response: Settlement{}},
+		{method: "GET", path: "/outbox", handler: s.handleOutbox, summary: "Events of the outbox after a Seq, or a consumer's offset, as Debezium change events with ?format=debezium, admins only",
+			query: []string{"after", "consumer", "limit", "format"}, response: []OutboxEntry{}},
+		{method: "GET", path: "/outbox/offsets", handler: s.handleOffsets, summary: "Offset of each consumer of the outbox, admins only",
+			response: map[string]uint64{}},
+		{method: "PUT", path: "/outbox/offsets/{consumer}", handler: s.handleCommitOffset, summary: "Commit the offset of a consumer of the outbox, admins only",
+			request: offsetRequest{}, response: map[string]uint64{}},
+		{method: "DELETE", path: "/outbox/offsets/{consumer}", handler: s.handleRemoveConsumer, summary: "Remove a consumer of the outbox, admins only",
+			response: map[string]uint64{}},
+		{method: "GET", path: "/dead-letters", handler: s.handleDeadLetters, summary: "Submitted operations that could not be applied, admins only",
+			response: []DeadLetter{}},
+		{method: "GET", path: "/dead-letters/{letter}", handler: s.handleDeadLetter, summary: "A dead letter, admins only",
+			response: DeadLetter{}},
+		{method: "POST", path: "/dead-letters/{letter}/requeue", handler: s.handleRequeueDeadLetter, summary: "Submit the operation of a dead letter again, admins only",
+			response: requeueResponse{}, status: http.StatusAccepted},
+		{method: "DELETE", path: "/dead-letters/{letter}", handler: s.handleDiscardDeadLetter, summary: "Discard a dead letter, admins only",
+			response: DeadLetter{}},
+		{method: "GET", path: "/compensations", handler: s.handleCompensations, summary: "Compensation log of failed composite operations, admins only",
+			query: []string{"status"}, response: []Compensation{}},
+		{method: "GET", path: "/compensations/{compensation}", handler: s.handleCompensation, summary: "An entry of the compensation log, admins only",
+			response: Compensation{}},
+		{method: "POST", path: "/compensations/{compensation}/retry", handler: s.handleRetryCompensation, summary: "Attempt a compensation again, admins only",
+			response: Compensation{}},
+		{method: "POST", path: "/compensations/{compensation}/resolve", handler: s.handleResolveCompensation, summary: "Record a compensation settled by other means, admins only",
+			request: resolveCompensationRequest{}, response: Compensation{}},
+		{method: "GET", path: "/alerts", handler: s.handleAlerts, summary: "Registered alerts",
+			response: []Alert{}},
+		{method: "POST", path: "/alerts", handler: s.handleAddAlert, summary: "Register an alert, admins only",
+			request: alertRequest{}, response: Alert{}, status: http.StatusCreated},
+		{method: "DELETE", path: "/alerts/{alert}", handler: s.handleRemoveAlert, summary: "Remove an alert, admins only",
+			status: http.StatusNoContent},
+		{method: "GET", path: "/scripts", handler: s.handleScripts, summary: "Scripts run for every operation, admins only",
+			response: []Script{}},
+		{method: "PUT", path: "/scripts/{script}", handler: s.handleSetScript, summary: "Set a script validating or deriving operations, admins only",
+			request: scriptRequest{}, response: Script{}},
+		{method: "DELETE", path: "/scripts/{script}", handler: s.handleRemoveScript, summary: "Remove a script, admins only",
+			status: http.StatusNoContent},
+		{method: "GET", path: "/policies", handler: s.handlePolicies, summary: "Policies constraining operations, admins only",
+			response: []Policy{}},
+		{method: "PUT", path: "/policies", handler: s.handleSetPolicies, summary: "Replace the policies, as JSON or application/yaml, admins only",
+			request: []Policy{}, response: []Policy{}},
+		{method: "POST", path: "/policies/simulate", handler: s.handleSimulatePolicies, summary: "Decide operations under policies without applying them, admins only",
+			request: simulatePoliciesRequest{}, response: []PolicyDecision{}},
+	}
+}
+
+// UseAuth requires every API request to be authenticated by auth and
+// authorized for the accounts it touches. It must be called before serving.
+func (s *Server) UseAuth(auth *Authenticator) {
+	s.auth = auth
+}
+
+// UseOperationTimeout bounds how long an operation may wait to be applied.
+// Operations that time out are never partially applied and are answered with
+// 504 Gateway Timeout. It must be called before serving.
+func (s *Server) UseOperationTimeout(timeout time.Duration) {
+	s.opTimeout = timeout
+}
+
+// operationContext derives the context operations of r are applied under.
+func (s *Server) operationContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.opTimeout > 0 {
+		return context.WithTimeout(r.Context(), s.opTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// UseBackpressure sheds operations with 429 Too Many Requests and a
+// Retry-After while maxDepth of them are already in flight, or while
+// those in flight recently took longer than maxLatency on average to be
+// applied. Reads are never shed. Zero disables a limit. It must be called
+// before serving.
+func (s *Server) UseBackpressure(maxDepth int, maxLatency time.Duration) {
+	if maxDepth > 0 || maxLatency > 0 {
+		s.pressure = &backpressure{maxDepth: maxDepth, maxLatency: maxLatency}
+	}
+}
+
+// UseDispatcher requeues dead letters on d. Without one they can only be
+// inspected and discarded. It must be called before serving.
+func (s *Server) UseDispatcher(d *Dispatcher) {
+	s.dispatch = d
+}
+
+// UseBreakers reports the circuit breakers of the server's external
+// dependencies, e.g. its archive, on /breakers. It must be called before
+// serving.
+func (s *Server) UseBreakers(breakers ...*CircuitBreaker) {
+	s.breakers = append(s.breakers, breakers...)
+}
+
+// UseReplica serves the state machine of a replica, refusing every request
+// while it is stale and reporting not ready until it catches up. It must be
+// called before serving.
+func (s *Server) UseReplica(replica *Replica) {
+	s.replica = replica
+	s.AddReadinessCheck("replication", replica.Check)
+}
+
+// AddReadinessCheck registers a named check consulted by /readyz, e.g. for a
+// storage backend or replication link.
+func (s *Server) AddReadinessCheck(name string, check ReadinessCheck) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks[name] = check
+}
+
+func (s *Server) Handler() http.Handler {
+	return s.http.Handler
+}
+
+// UseTLS serves HTTPS with cfg, see NewTLSConfig. It must be called before
+// serving.
+func (s *Server) UseTLS(cfg *tls.Config) {
+	s.http.TLSConfig = cfg
+}
+
+// ListenAndServe serves until Close is called, at which point it returns nil.
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.http.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l until Close is called, at which point it
+// returns nil.
+func (s *Server) Serve(l net.Listener) error {
+	var err error
+	if s.http.TLSConfig != nil {
+		err = s.http.ServeTLS(l, "", "")
+	} else {
+		err = s.http.Serve(l)
+	}
+
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Close marks the server as not ready, stops accepting connections and waits
+// for active requests to complete or ctx to be done.
+func (s *Server) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.draining {
+		s.draining = true
+		close(s.closing)
+	}
+	s.mu.Unlock()
+
+	return s.http.Shutdown(ctx)
+}
+
+// ClientIDHeader identifies the API client for per-client rate limiting when
+// the request is not authenticated. The remote address is used when it is
+// absent.
+const ClientIDHeader = "X-Client-ID"
+
+// apiHandler serves a request against the state machine of the namespace it
+// addresses.
+type apiHandler func(w http.ResponseWriter, r *http.Request, sm *StateMachine)
+
+// api wraps an API handler with correlation IDs, backpressure,
+// authentication, per-client rate limiting and tenant resolution. On a replica, reads requesting a
+// consistency it cannot serve are routed to the leader.
+func (s *Server) api(next apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenantId := r.PathValue("tenant")
+
+		correlationId := r.Header.Get(CorrelationIDHeader)
+		if correlationId == "" {
+			correlationId = s.correlationIDs.next(time.Now())
+		}
+		if len(correlationId) > maxCorrelationIDLength {
+			writeError(w, fmt.Errorf("%w: %s longer than %d characters", errBadRequest, CorrelationIDHeader, maxCorrelationIDLength))
+			return
+		}
+		w.Header().Set(CorrelationIDHeader, correlationId)
+		r = r.WithContext(WithCorrelationID(r.Context(), correlationId))
+
+		if s.pressure != nil && r.Method != http.MethodGet {
+			if err := s.pressure.admit(); err != nil {
+				writeError(w, err)
+				return
+			}
+			start := time.Now()
+			defer func() { s.pressure.finish(time.Since(start)) }()
+		}
+
+		if s.auth != nil {
+			p, err := s.auth.Authenticate(r)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if !p.CanAccessTenant(tenantId) {
+				writeError(w, fmt.Errorf("%w: %s may not access tenant %q", ErrForbidden, p.Subject, tenantId))
+				return
+			}
+			r = r.WithContext(withPrincipal(r.Context(), p))
+		}
+		r = r.WithContext(WithActor(r.Context(), clientID(r)))
+
+		consistency, err := ParseConsistency(r.Header.Get(ConsistencyHeader))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if s.replica != nil {
+			if r.Method == http.MethodGet && consistency.Level != "" {
+				if !s.replica.Serves(consistency) {
+					s.replica.forward(w, r)
+					return
+				}
+			} else if err := s.replica.Check(r.Context()); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+
+		if err := s.sm.limiter.AllowClient(clientID(r)); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		sm := s.sm
+		if tenantId != "" {
+			tenant, err := s.sm.Tenant(tenantId)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			sm = tenant
+		}
+		if id := r.PathValue("id"); id != "" {
+			r.SetPathValue("id", sm.ResolveAccount(id))
+		}
+		if r.Method == http.MethodGet {
+			w.Header().Set(ServedVersionHeader, strconv.Itoa(sm.State().Version()))
+		}
+		w.Header().Set(EpochHeader, sm.Epoch())
+		if epoch := r.Header.Get(EpochHeader); epoch != "" {
+			r = r.WithContext(WithEpoch(r.Context(), epoch))
+		}
+		if owner := r.Header.Get(LockOwnerHeader); owner != "" {
+			r = r.WithContext(WithLockOwner(r.Context(), owner))
+		}
+		next(w, r, sm)
+	}
+}
+
+// authorize checks that the caller may perform action on each account. It
+// always succeeds when authentication is disabled.
+func (s *Server) authorize(r *http.Request, action Action, accountIds ...string) error {
+	if s.auth == nil {
+		return nil
+	}
+
+	p, ok := PrincipalFrom(r.Context())
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if len(accountIds) == 0 {
+		accountIds = []string{""}
+	}
+	for _, id := range accountIds {
+		if !p.Can(action, id) {
+			if id == "" {
+				return fmt.Errorf("%w: %s may not %s", ErrForbidden, p.Subject, action)
+			}
+			return fmt.Errorf("%w: %s may not %s account %s", ErrForbidden, p.Subject, action, id)
+		}
+	}
+	return nil
+}
+
+// authorizeRoot checks that the caller may manage the root namespace, and
+// so every tenant: tenant admins may not change their own limits. It always
+// succeeds when authentication is disabled.
+func (s *Server) authorizeRoot(r *http.Request) error {
+	if err := s.authorize(r, ActionManage); err != nil {
+		return err
+	}
+	if p, ok := PrincipalFrom(r.Context()); ok && p.Tenant != "" {
+		return fmt.Errorf("%w: %s is an admin of tenant %s only", ErrForbidden, p.Subject, p.Tenant)
+	}
+	return nil
+}
+
+func clientID(r *http.Request) string {
+	if p, ok := PrincipalFrom(r.Context()); ok {
+		return p.Subject
+	}
+	if id := r.Header.Get(ClientIDHeader); id != "" {
+		return id
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	draining := s.draining
+	checks := make(map[string]ReadinessCheck, len(s.checks))
+	for name, check := range s.checks {
+		checks[name] = check
+	}
+	s.mu.Unlock()
+
+	failures := map[string]string{}
+	if draining {
+		failures["server"] = "draining"
+	}
+	if s.sm.Closed() {
+		failures["state_machine"] = ErrClosed.Error()
+	}
+	for name, check := range checks {
+		if err := check(r.Context()); err != nil {
+			failures[name] = err.Error()
+		}
+	}
+
+	if len(failures) > 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "not ready", "failures": failures})
+		return
+	}
+
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ready", "checks": names})
+}
+
+type amountRequest struct {
+	Amount   int               `json:"amount"`
+	Bucket   string            `json:"bucket"`
+	Memo     string            `json:"memo"`
+	Metadata map[string]string `json:"metadata"`
+	Category string            `json:"category"`
+}
+
+type transferRequest struct {
+	From       string            `json:"from"`
+	To         string            `json:"to"`
+	Amount     int               `json:"amount"`
+	FromBucket string            `json:"from_bucket"`
+	ToBucket   string            `json:"to_bucket"`
+	Memo       string            `json:"memo"`
+	Metadata   map[string]string `json:"metadata"`
+	Category   string            `json:"category"`
+}
+
+type balanceResponse struct {
+	ID          string `json:"id"`
+	Balance     int    `json:"balance"`
+	DryRun      bool   `json:"dry_run,omitempty"`      // balance the operation would leave
+	OperationID string `json:"operation_id,omitempty"` // of the operation that left the balance
+}
+
+// isDryRun reports whether a request asks for its operation to be simulated
+// with ?dry_run=true instead of applied.
+func isDryRun(r *http.Request) bool {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	return dryRun
+}
+
+func (s *Server) handleBalance(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionRead, id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// ?version=N or ?at=<RFC 3339 time> read a past balance.
+	query := r.URL.Query()
+	if !query.Has("version") && !query.Has("at") {
+		writeBalance(w, sm, id)
+		return
+	}
+
+	var balance int
+	if query.Has("version") {
+		version, err := strconv.Atoi(query.Get("version"))
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: invalid version: %v", errBadRequest, err))
+			return
+		}
+		balance, err = sm.BalanceAt(id, version)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	} else {
+		at, err := time.Parse(time.RFC3339Nano, query.Get("at"))
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: invalid time: %v", errBadRequest, err))
+			return
+		}
+		balance, err = sm.BalanceAtTime(id, at)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, balanceResponse{ID: id, Balance: balance})
+}
+
+// handleListAccounts serves a page of accounts, filtered and ordered by the
+// limit, cursor, min_balance, max_balance, tag (repeatable) and order query
+// parameters, see ListOptions.
+func (s *Server) handleListAccounts(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	opts := ListOptions{
+		Cursor: query.Get("cursor"),
+		Tags:   query["tag"],
+		Order:  AccountOrder(query.Get("order")),
+	}
+	var err error
+	if opts.Limit, err = queryInt(query, "limit"); err == nil {
+		opts.MinBalance, err = queryBound(query, "min_balance")
+	}
+	if err == nil {
+		opts.MaxBalance, err = queryBound(query, "max_balance")
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	page, err := sm.ListAccounts(opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// handleTopBalances serves the n (default 10, at most 1000) accounts with
+// the highest balances.
+func (s *Server) handleTopBalances(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+	n, err := queryInt(r.URL.Query(), "n")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if n <= 0 {
+		n = 10
+	}
+	writeJSON(w, http.StatusOK, sm.TopAccountsByBalance(min(n, maxPageSize)))
+}
+
+func (s *Server) handleTotalBalance(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"total": sm.TotalBalance()})
+}
+
+// handleBalanceDistribution counts the accounts between the ascending
+// bound query parameters (repeatable).
+func (s *Server) handleBalanceDistribution(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+	var bounds []int
+	for _, v := range r.URL.Query()["bound"] {
+		bound, err := strconv.Atoi(v)
+		if err != nil {
+			writeError(w, fmt.Errorf("%w: invalid bound: %v", errBadRequest, err))
+			return
+		}
+		bounds = append(bounds, bound)
+	}
+	ranges, err := sm.BalanceDistribution(bounds)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, ranges)
+}
+
+// queryInt parses an optional integer query parameter, 0 if it is absent.
+func queryInt(query url.Values, name string) (int, error) {
+	bound, err := queryBound(query, name)
+	if bound == nil {
+		return 0, err
+	}
+	return *bound, nil
+}
+
+// queryTime parses an optional RFC 3339 time query parameter, the zero time
+// if it is absent.
+func queryTime(query url.Values, name string) (time.Time, error) {
+	if !query.Has(name) {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, query.Get(name))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: invalid %s: %v", errBadRequest, name, err)
+	}
+	return t, nil
+}
+
+// queryBound parses an optional integer query parameter, nil if it is
+// absent.
+func queryBound(query url.Values, name string) (*int, error) {
+	if !query.Has(name) {
+		return nil, nil
+	}
+	v, err := strconv.Atoi(query.Get(name))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid %s: %v", errBadRequest, name, err)
+	}
+	return &v, nil
+}
+
+type tagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+func (s *Server) handleSetTags(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	var req tagsRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionManage, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := sm.SetAccountTags(id, req.Tags...); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "tags": sm.AccountTags(id)})
+}
+
+type statusRequest struct {
+	Status AccountStatus `json:"status"`
+	Reason string        `json:"reason"`
+}
+
+type statusResponse struct {
+	ID          string        `json:"id"`
+	Status      AccountStatus `json:"status"`
+	OperationID string        `json:"operation_id,omitempty"`
+}
+
+func (s *Server) handleAccountStatus(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionRead, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	status, err := sm.AccountStatus(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{ID: id, Status: status})
+}
+
+// handleSetAccountStatus changes the status of an account, e.g. activates
+// it once its holder's identity is verified.
+func (s *Server) handleSetAccountStatus(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	var req statusRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionManage, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+
+	op, err := sm.ApplyContext(ctx, Operation{Type: OpSetStatus, To: id, Status: req.Status, Memo: req.Reason})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, statusResponse{ID: id, Status: op.Status, OperationID: op.ID})
+}
+
+func (s *Server) handleAliases(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionRead, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := sm.Balance(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeAliases(w, sm, id)
+}
+
+func (s *Server) handleSetAlias(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionManage, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := sm.SetAlias(r.PathValue("alias"), id); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeAliases(w, sm, id)
+}
+
+func (s *Server) handleRemoveAlias(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionManage, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := sm.RemoveAlias(r.PathValue("alias"), id); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeAliases(w, sm, id)
+}
+
+func writeAliases(w http.ResponseWriter, sm *StateMachine, id string) {
+	aliases := sm.Aliases(id)
+	if aliases == nil {
+		aliases = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"id": id, "aliases": aliases})
+}
+
+func (s *Server) handleSigners(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionRead, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := sm.Balance(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	set, _ := sm.Signers(id)
+	writeJSON(w, http.StatusOK, newSignersResponse(id, set))
+}
+
+func (s *Server) handleSetSigners(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	var req SignerSet
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionManage, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := sm.RequireSignatures(id, req); err != nil {
+		writeError(w, err)
+		return
+	}
+	set, _ := sm.Signers(id)
+	writeJSON(w, http.StatusOK, newSignersResponse(id, set))
+}
+
+type signersResponse struct {
+	ID       string   `json:"id"`
+	Signers  []string `json:"signers"`
+	Required int      `json:"required"`
+}
+
+func newSignersResponse(id string, set SignerSet) signersResponse {
+	if set.Signers == nil {
+		set.Signers = []string{}
+	}
+	return signersResponse{ID: id, Signers: set.Signers, Required: set.Required}
+}
+
+func writeBalance(w http.ResponseWriter, sm *StateMachine, id string) {
+	balance, err := sm.Balance(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, balanceResponse{ID: id, Balance: balance})
+}
+
+func (s *Server) handleDeposit(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	s.handleAmount(w, r, sm, ActionDeposit, func(id string, req amountRequest) Operation {
+		return Operation{Type: OpDeposit, To: id, Amount: req.Amount, ToBucket: req.Bucket}
+	})
+}
+
+func (s *Server) handleWithdraw(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	s.handleAmount(w, r, sm, ActionWithdraw, func(id string, req amountRequest) Operation {
+		return Operation{Type: OpWithdraw, From: id, Amount: req.Amount, FromBucket: req.Bucket}
+	})
+}
+
+type moveRequest struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Amount int    `json:"amount"`
+	Memo   string `json:"memo"`
+}
+
+// handleMove moves an amount between two buckets of an account and answers
+// with the account's buckets.
+func (s *Server) handleMove(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	var req moveRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkAmount(req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionWithdraw, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+
+	op, err := sm.ApplyContext(ctx, Operation{Type: OpMove, From: id, FromBucket: req.From, ToBucket: req.To, Amount: req.Amount, Memo: req.Memo})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	buckets, err := sm.Buckets(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bucketsResponse{ID: id, Buckets: buckets, OperationID: op.ID})
+}
+
+type bucketsResponse struct {
+	ID          string         `json:"id"`
+	Buckets     map[string]int `json:"buckets"`
+	OperationID string         `json:"operation_id,omitempty"`
+}
+
+func (s *Server) handleBuckets(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionRead, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	buckets, err := sm.Buckets(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bucketsResponse{ID: id, Buckets: buckets})
+}
+
+func (s *Server) handleForecast(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionRead, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	days, err := queryInt(r.URL.Query(), "days")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if days == 0 {
+		days = defaultForecastDays
+	}
+	forecast, err := sm.Forecast(id, time.Duration(days)*24*time.Hour)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, forecast)
+}
+
+// handleStatement answers the statement of an account as JSON, or with
+// ?format=ofx or ?format=camt053 as a document of that format, see
+// Statement.
+func (s *Server) handleStatement(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionRead, id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	opts := StatementOptions{Currency: query.Get("currency")}
+	var err error
+	if opts.Since, err = queryTime(query, "since"); err == nil {
+		if opts.Until, err = queryTime(query, "until"); err == nil {
+			opts.Scale, err = queryInt(query, "scale")
+		}
+	}
+	var format StatementFormat
+	if err == nil && query.Has("format") {
+		format, err = ParseStatementFormat(query.Get("format"))
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	statement, err := sm.Statement(id, opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	switch format {
+	case "":
+		writeJSON(w, http.StatusOK, statement)
+		return
+	case StatementOFX:
+		w.Header().Set("Content-Type", "application/x-ofx")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".ofx"))
+	default:
+		w.Header().Set("Content-Type", "application/xml")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", id+".camt053.xml"))
+	}
+	_ = statement.Write(w, format)
+}
+
+type accountStatsResponse struct {
+	ID         string                           `json:"id"`
+	ByType     map[OperationType]OperationStats `json:"by_type"`
+	ByCategory map[string]CategoryStats         `json:"by_category"`
+}
+
+func (s *Server) handleAccountStats(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionRead, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := sm.Balance(id); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, accountStatsResponse{ID: id, ByType: sm.AccountStats(id), ByCategory: sm.AccountCategoryStats(id)})
+}
+
+func (s *Server) handleTombstones(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionRead, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	tombstones := sm.Tombstones(id)
+	if tombstones == nil {
+		tombstones = []Tombstone{}
+	}
+	writeJSON(w, http.StatusOK, tombstones)
+}
+
+// handleArchive archives or restores an account, depending on the path.
+func (s *Server) handleArchive(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	id := r.PathValue("id")
+	if err := s.authorize(r, ActionManage, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+
+	req := Operation{Type: OpArchive, From: id}
+	if strings.HasSuffix(r.URL.Path, "/unarchive") {
+		req = Operation{Type: OpUnarchive, To: id}
+	}
+	op, err := sm.ApplyContext(ctx, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "operation_id": op.ID})
+}
+
+func (s *Server) handleArchivedAccounts(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.ArchivedAccounts())
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.Stats())
+}
+
+// handleHotAccounts lists the hot accounts, see DetectHotAccounts.
+func (s *Server) handleHotAccounts(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.HotAccounts())
+}
+
+type lockRequest struct {
+	Accounts []string `json:"accounts"`
+}
+
+// handleLockAccounts locks accounts for the owner named by LockOwnerHeader
+// until it releases them, or the lock timeout passes, and answers with its
+// locks.
+func (s *Server) handleLockAccounts(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	var req lockRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	owner := LockOwnerFrom(r.Context())
+	if owner == "" || len(req.Accounts) == 0 {
+		writeError(w, fmt.Errorf("%w: %s and accounts are required", errBadRequest, LockOwnerHeader))
+		return
+	}
+	for i, id := range req.Accounts {
+		req.Accounts[i] = sm.ResolveAccount(id)
+	}
+	if err := s.authorize(r, ActionWithdraw, req.Accounts...); err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+
+	if _, err := sm.LockAccounts(ctx, req.Accounts...); err != nil {
+		writeError(w, err)
+		return
+	}
+	locks := []AccountLock{}
+	for _, lock := range sm.Locks() {
+		if lock.Owner == owner {
+			locks = append(locks, lock)
+		}
+	}
+	writeJSON(w, http.StatusOK, locks)
+}
+
+type releaseLocksResponse struct {
+	Released int `json:"released"`
+}
+
+func (s *Server) handleReleaseLocks(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	owner := LockOwnerFrom(r.Context())
+	if owner == "" {
+		writeError(w, fmt.Errorf("%w: %s is required", errBadRequest, LockOwnerHeader))
+		return
+	}
+	var accounts []string
+	for _, lock := range sm.Locks() {
+		if lock.Owner == owner {
+			accounts = append(accounts, lock.Account)
+		}
+	}
+	if err := s.authorize(r, ActionWithdraw, accounts...); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, releaseLocksResponse{Released: sm.ReleaseLocks(owner)})
+}
+
+func (s *Server) handleLocks(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.Locks())
+}
+
+// handleMemory estimates the memory the state machine holds, see MemStats.
+func (s *Server) handleMemory(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.MemStats())
+}
+
+func (s *Server) handleAmount(w http.ResponseWriter, r *http.Request, sm *StateMachine, action Action, newOperation func(accountId string, req amountRequest) Operation) {
+	var req amountRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkAmount(req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := s.authorize(r, action, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+
+	op := newOperation(id, req)
+	op.Memo, op.Metadata, op.Category = req.Memo, req.Metadata, req.Category
+	var err error
+	if op.MessageID, err = idempotencyKey(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	if isDryRun(r) {
+		balances, err := sm.SimulateContext(ctx, func(scratch *StateMachine) error {
+			_, err := scratch.ApplyContext(ctx, op)
+			return err
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, balanceResponse{ID: id, Balance: balances[id], DryRun: true})
+		return
+	}
+
+	applied, err := sm.ApplyContext(ctx, op)
+	if first, ok := replayed(w, sm, op, err); ok {
+		applied, err = first, nil
+	}
+	if err != nil {
+		writePendingOrError(w, err)
+		return
+	}
+	balance, err := sm.Balance(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, balanceResponse{ID: id, Balance: balance, OperationID: applied.ID})
+}
+
+func (s *Server) handleTransfer(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	var req transferRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkAmount(req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
+	req.From, req.To = sm.ResolveAccount(req.From), sm.ResolveAccount(req.To)
+
+	if err := s.authorize(r, ActionWithdraw, req.From); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.authorize(r, ActionDeposit, req.To); err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+
+	op := Operation{
+		Type:       OpTransfer,
+		From:       req.From,
+		To:         req.To,
+		Amount:     req.Amount,
+		FromBucket: req.FromBucket,
+		ToBucket:   req.ToBucket,
+		Memo:       req.Memo,
+		Metadata:   req.Metadata,
+		Category:   req.Category,
+	}
+	var err error
+	if op.MessageID, err = idempotencyKey(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	if isDryRun(r) {
+		balances, err := sm.SimulateContext(ctx, func(scratch *StateMachine) error {
+			_, err := scratch.ApplyContext(ctx, op)
+			return err
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"dry_run":  true,
+			"balances": map[string]int{req.From: balances[req.From], req.To: balances[req.To]},
+		})
+		return
+	}
+
+	applied, err := sm.ApplyContext(ctx, op)
+	if first, ok := replayed(w, sm, op, err); ok {
+		applied, err = first, nil
+	}
+	if err != nil {
+		writePendingOrError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok", "operation_id": applied.ID})
+}
+
+// writePendingOrError answers an operation parked for an approval or for
+// signatures with 202 Accepted and the ID to follow it by, and any other
+// error as writeError does.
+func writePendingOrError(w http.ResponseWriter, err error) {
+	var approvalErr *ApprovalRequiredError
+	if errors.As(err, &approvalErr) {
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": string(ApprovalPending), "approval_id": approvalErr.ID})
+		return
+	}
+	var signaturesErr *SignaturesRequiredError
+	if errors.As(err, &signaturesErr) {
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": string(DebitPending), "debit_id": signaturesErr.ID})
+		return
+	}
+	writeError(w, err)
+}
+
+// handleRollback rolls back the latest change or, with if_version, only the
+// change that produced that version, see RollbackIfVersion.
+func (s *Server) handleRollback(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRollback); err != nil {
+		writeError(w, err)
+		return
+	}
+	version, err := queryInt(r.URL.Query(), "if_version")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+	if err := sm.RollbackIfVersion(ctx, version); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set(EpochHeader, sm.Epoch())
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleOperations lists the operations in history selected by the query,
+// see OperationFilter: account, type, min_amount and max_amount, since and
+// until as RFC 3339 times, metadata as key:value, which may be repeated,
+// memo and limit.
+func (s *Server) handleOperations(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := OperationFilter{
+		Account: query.Get("account"),
+		Type:    OperationType(query.Get("type")),
+		Memo:    query.Get("memo"),
+	}
+	var err error
+	if filter.MinAmount, err = queryBound(query, "min_amount"); err == nil {
+		filter.MaxAmount, err = queryBound(query, "max_amount")
+	}
+	if err == nil {
+		filter.Since, err = queryTime(query, "since")
+	}
+	if err == nil {
+		filter.Until, err = queryTime(query, "until")
+	}
+	if err == nil {
+		filter.Limit, err = queryInt(query, "limit")
+	}
+	for _, pair := range query["metadata"] {
+		key, value, ok := strings.Cut(pair, ":")
+		if !ok {
+			err = fmt.Errorf("%w: metadata filter %q, want key:value", errBadRequest, pair)
+			break
+		}
+		if filter.Metadata == nil {
+			filter.Metadata = map[string]string{}
+		}
+		filter.Metadata[key] = value
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	operations := sm.SearchOperations(filter)
+	if operations == nil {
+		operations = []Operation{}
+	}
+	writeJSON(w, http.StatusOK, operations)
+}
+
+// handleReconcile reconciles the statement in the request body, as JSON or,
+// with a text/csv Content-Type, CSV, see ReadStatement. The since and until
+// query parameters bound the ledger and tolerance sets how far apart times
+// of entries without an ID may be, see ReconcileOptions.
+func (s *Server) handleReconcile(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var opts ReconcileOptions
+	query := r.URL.Query()
+	var err error
+	if opts.Since, err = queryTime(query, "since"); err == nil {
+		opts.Until, err = queryTime(query, "until")
+	}
+	if err == nil && query.Has("tolerance") {
+		if opts.Tolerance, err = time.ParseDuration(query.Get("tolerance")); err != nil {
+			err = fmt.Errorf("%w: invalid tolerance: %v", errBadRequest, err)
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	format := ImportJSON
+	if mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(mediaType) == "text/csv" {
+		format = ImportCSV
+	}
+	statement, err := ReadStatement(r.Body, format)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.Reconcile(statement, opts))
+}
+
+// handleReverse needs the same permission as a rollback, as both undo
+// operations other clients may have performed.
+func (s *Server) handleReverse(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRollback); err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+
+	op, err := sm.ReverseContext(ctx, r.PathValue("operation"))
+	if err != nil {
+		writePendingOrError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, op)
+}
+
+// handleEvents streams operation events as server-sent events, for the
+// accounts given with ?account=<id>, which may be repeated, or for every
+// account. The stream ends when the client disconnects, the server closes,
+// or the client falls too far behind, see StateMachine.Subscribe.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	accountIds := r.URL.Query()["account"]
+	if err := s.authorize(r, ActionRead, accountIds...); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	events := sm.Subscribe(ctx, accountIds...)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	_ = rc.Flush()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: operation\ndata: %s\n\n", event.Operation.ID, data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-s.closing:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleBackup answers with a backup of the state machine, see Backup.
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="vaultflow-backup.json"`)
+	if err := sm.Backup(w); err != nil {
+		fmt.Println("Backup Error:", err)
+	}
+}
+
+// handleVerify answers with the report of verifying the state machine, see
+// Verify.
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	report, err := sm.Verify()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) handleFlags(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.Flags())
+}
+
+// handleBreakers lists the circuit breakers, e.g. to see which dependency
+// is failing fast.
+func (s *Server) handleBreakers(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	breakers := make([]BreakerStatus, len(s.breakers))
+	for i, b := range s.breakers {
+		breakers[i] = b.Status()
+	}
+	writeJSON(w, http.StatusOK, breakers)
+}
+
+// handleWAL describes the write-ahead log, e.g. to watch the latency of its
+// flushes under the sync policy in use.
+func (s *Server) handleWAL(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	if sm.wal == nil {
+		writeError(w, ErrWALDisabled)
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.wal.Status())
+}
+
+type setFlagRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleSetFlag turns a feature flag on or off, see SetFlag.
+func (s *Server) handleSetFlag(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req setFlagRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	flag := Flag(r.PathValue("flag"))
+	if err := sm.SetFlag(r.Context(), flag, req.Enabled); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, FlagState{FlagInfo: knownFlags[flag], Name: flag, Enabled: sm.Enabled(flag)})
+}
+
+// settingsResponse is the current settings and their version, the number of
+// changes since start.
+type settingsResponse struct {
+	Version  int      `json:"version"`
+	Settings Settings `json:"settings"`
+}
+
+// settingsRequest changes the settings it names, keeping the others.
+// ApprovalTTL is a Go duration, e.g. "24h".
+type settingsRequest struct {
+	MaxHistory        *int       `json:"max_history"`
+	ApprovalThreshold *int       `json:"approval_threshold"`
+	ApprovalTTL       *string    `json:"approval_ttl"`
+	GlobalLimit       *RateLimit `json:"global_limit"`
+	AccountLimit      *RateLimit `json:"account_limit"`
+	ClientLimit       *RateLimit `json:"client_limit"`
+	Reason            string     `json:"reason"`
+}
+
+func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, settingsResponse{Version: len(sm.SettingsHistory()), Settings: sm.Settings()})
+}
+
+// handleUpdateSettings applies a settingsRequest, see UpdateSettings, and
+// answers with the change.
+func (s *Server) handleUpdateSettings(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req settingsRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	var ttl time.Duration
+	if req.ApprovalTTL != nil {
+		var err error
+		if ttl, err = time.ParseDuration(*req.ApprovalTTL); err != nil {
+			writeError(w, fmt.Errorf("%w: invalid approval_ttl: %v", errBadRequest, err))
+			return
+		}
+	}
+
+	change, err := sm.UpdateSettings(r.Context(), func(settings *Settings) {
+		if req.MaxHistory != nil {
+			settings.MaxHistory = *req.MaxHistory
+		}
+		if req.ApprovalThreshold != nil {
+			settings.ApprovalThreshold = *req.ApprovalThreshold
+		}
+		if req.ApprovalTTL != nil {
+			settings.ApprovalTTL = ttl
+		}
+		for _, limit := range []struct{ from, to *RateLimit }{
+			{req.GlobalLimit, &settings.GlobalLimit},
+			{req.AccountLimit, &settings.AccountLimit},
+			{req.ClientLimit, &settings.ClientLimit},
+		} {
+			if limit.from != nil {
+				*limit.to = *limit.from
+			}
+		}
+	}, req.Reason)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, change)
+}
+
+func (s *Server) handleSettingsHistory(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	changes := sm.SettingsHistory()
+	if changes == nil {
+		changes = []SettingsChange{}
+	}
+	writeJSON(w, http.StatusOK, changes)
+}
+
+// handleReplication streams the state and then every operation to a
+// replica as server-sent events: a "state" event with the version and every
+// balance, an "operation" event per applied operation, and a "heartbeat"
+// event with the current version every second. Replicas that fall behind
+// are disconnected and resync on reconnecting.
+func (s *Server) handleReplication(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	state, events := sm.SubscribeWithState(ctx)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+
+	send := func(name string, event Event) bool {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	if !send("state", state) {
+		return
+	}
+
+	heartbeat := time.NewTicker(replicationHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok || !send("operation", event) {
+				return
+			}
+		case <-heartbeat.C:
+			if !send("heartbeat", Event{Version: sm.Version()}) {
+				return
+			}
+		case <-s.closing:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type approvalResponse struct {
+	ID          string         `json:"id"`
+	From        string         `json:"from"`
+	To          string         `json:"to"`
+	Amount      int            `json:"amount"`
+	Status      ApprovalStatus `json:"status"`
+	RequestedBy string         `json:"requested_by"`
+	RequestedAt time.Time      `json:"requested_at"`
+	ExpiresAt   time.Time      `json:"expires_at"`
+	DecidedBy   string         `json:"decided_by,omitempty"`
+	Reason      string         `json:"reason,omitempty"`
+}
+
+func newApprovalResponse(p PendingTransfer) approvalResponse {
+	return approvalResponse{
+		ID:          p.ID,
+		From:        p.From,
+		To:          p.To,
+		Amount:      p.Amount,
+		Status:      p.Status,
+		RequestedBy: p.RequestedBy,
+		RequestedAt: p.RequestedAt,
+		ExpiresAt:   p.ExpiresAt,
+		DecidedBy:   p.DecidedBy,
+		Reason:      p.Reason,
+	}
+}
+
+func (s *Server) handleApprovals(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	approvals := []approvalResponse{}
+	for _, p := range sm.Approvals() {
+		approvals = append(approvals, newApprovalResponse(p))
+	}
+	writeJSON(w, http.StatusOK, approvals)
+}
+
+func (s *Server) handleApproval(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	p, err := sm.Approval(r.PathValue("approval"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newApprovalResponse(p))
+}
+
+func (s *Server) handleApprove(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionApprove); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+	p, err := sm.Approve(ctx, r.PathValue("approval"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newApprovalResponse(p))
+}
+
+type rejectRequest struct {
+	Reason string `json:"reason"`
+}
+
+func (s *Server) handleReject(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionApprove); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req rejectRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	p, err := sm.Reject(r.Context(), r.PathValue("approval"), req.Reason)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newApprovalResponse(p))
+}
+
+type debitResponse struct {
+	ID          string      `json:"id"`
+	Operation   Operation   `json:"operation"`
+	Status      DebitStatus `json:"status"`
+	RequestedBy string      `json:"requested_by"`
+	RequestedAt time.Time   `json:"requested_at"`
+	Required    int         `json:"required"`
+	Signatures  []string    `json:"signatures"`
+	DecidedBy   string      `json:"decided_by,omitempty"`
+	Reason      string      `json:"reason,omitempty"`
+}
+
+func newDebitResponse(d PendingDebit) debitResponse {
+	if d.Signatures == nil {
+		d.Signatures = []string{}
+	}
+	return debitResponse{
+		ID:          d.ID,
+		Operation:   d.Operation,
+		Status:      d.Status,
+		RequestedBy: d.RequestedBy,
+		RequestedAt: d.RequestedAt,
+		Required:    d.Signers.Required,
+		Signatures:  d.Signatures,
+		DecidedBy:   d.DecidedBy,
+		Reason:      d.Reason,
+	}
+}
+
+func (s *Server) handleDebits(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	debits := []debitResponse{}
+	for _, d := range sm.PendingDebits() {
+		debits = append(debits, newDebitResponse(d))
+	}
+	writeJSON(w, http.StatusOK, debits)
+}
+
+func (s *Server) handleDebit(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	d, err := sm.PendingDebit(r.PathValue("debit"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newDebitResponse(d))
+}
+
+// handleSignDebit signs a debit as the client, which must be one of the
+// signers of the account, and applies it with the last signature needed.
+func (s *Server) handleSignDebit(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+	d, err := sm.SignDebit(ctx, r.PathValue("debit"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newDebitResponse(d))
+}
+
+func (s *Server) handleRejectDebit(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req rejectRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	d, err := sm.RejectDebit(r.Context(), r.PathValue("debit"), req.Reason)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newDebitResponse(d))
+}
+
+type escrowRequest struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Amount    int       `json:"amount"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type escrowResponse struct {
+	ID        string       `json:"id"`
+	From      string       `json:"from"`
+	To        string       `json:"to"`
+	Amount    int          `json:"amount"`
+	Account   string       `json:"account"`
+	Status    EscrowStatus `json:"status"`
+	CreatedAt time.Time    `json:"created_at"`
+	ExpiresAt *time.Time   `json:"expires_at,omitempty"`
+	SettledAt *time.Time   `json:"settled_at,omitempty"`
+}
+
+func newEscrowResponse(e Escrow) escrowResponse {
+	resp := escrowResponse{
+		ID:        e.ID,
+		From:      e.From,
+		To:        e.To,
+		Amount:    e.Amount,
+		Account:   e.Account(),
+		Status:    e.Status,
+		CreatedAt: e.CreatedAt,
+	}
+	if !e.ExpiresAt.IsZero() {
+		resp.ExpiresAt = &e.ExpiresAt
+	}
+	if !e.SettledAt.IsZero() {
+		resp.SettledAt = &e.SettledAt
+	}
+	return resp
+}
+
+func (s *Server) handleEscrows(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	escrows := []escrowResponse{}
+	for _, e := range sm.Escrows() {
+		escrows = append(escrows, newEscrowResponse(e))
+	}
+	writeJSON(w, http.StatusOK, escrows)
+}
+
+func (s *Server) handleEscrow(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	e, err := sm.Escrow(r.PathValue("escrow"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newEscrowResponse(e))
+}
+
+// handleCreateEscrow holds funds from an account in escrow, needing the
+// same permissions as a transfer.
+func (s *Server) handleCreateEscrow(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	var req escrowRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkAmount(req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.authorize(r, ActionWithdraw, req.From); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.authorize(r, ActionDeposit, req.To); err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+
+	e, err := sm.CreateEscrow(ctx, req.From, req.To, req.Amount, req.ExpiresAt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newEscrowResponse(e))
+}
+
+// handleSettleEscrow releases an escrow, which its payer must be allowed
+// to withdraw from, or refunds it, which takes an admin.
+func (s *Server) handleSettleEscrow(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	e, err := sm.Escrow(r.PathValue("escrow"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	settle := sm.ReleaseEscrow
+	err = s.authorize(r, ActionWithdraw, e.From)
+	if strings.HasSuffix(r.URL.Path, "/refund") {
+		settle = sm.RefundEscrow
+		err = s.authorize(r, ActionManage)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+
+	if e, err = settle(ctx, e.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newEscrowResponse(e))
+}
+
+// standingOrderRequest sets up a standing order. Every and RetryWindow are
+// durations such as "24h"; Start defaults to now.
+type standingOrderRequest struct {
+	From        string    `json:"from"`
+	To          string    `json:"to"`
+	Amount      int       `json:"amount"`
+	Every       string    `json:"every"`
+	RetryWindow string    `json:"retry_window"`
+	Start       time.Time `json:"start"`
+}
+
+func (s *Server) handleStandingOrders(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.StandingOrders())
+}
+
+func (s *Server) handleStandingOrder(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	o, err := sm.StandingOrder(r.PathValue("order"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, o)
+}
+
+// handleCreateStandingOrder sets up a standing order, needing the same
+// permissions as a transfer.
+func (s *Server) handleCreateStandingOrder(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	var req standingOrderRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := checkAmount(req.Amount); err != nil {
+		writeError(w, err)
+		return
+	}
+	every, err := time.ParseDuration(req.Every)
+	if err != nil {
+		writeError(w, fmt.Errorf("%w: invalid every: %v", errBadRequest, err))
+		return
+	}
+	var retryWindow time.Duration
+	if req.RetryWindow != "" {
+		if retryWindow, err = time.ParseDuration(req.RetryWindow); err != nil {
+			writeError(w, fmt.Errorf("%w: invalid retry_window: %v", errBadRequest, err))
+			return
+		}
+	}
+	if err := s.authorize(r, ActionWithdraw, req.From); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.authorize(r, ActionDeposit, req.To); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	o, err := sm.CreateStandingOrder(req.From, req.To, req.Amount, every, req.Start, retryWindow)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, o)
+}
+
+// handleCancelStandingOrder cancels a standing order, which its payer must
+// be allowed to withdraw from.
+func (s *Server) handleCancelStandingOrder(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	o, err := sm.StandingOrder(r.PathValue("order"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.authorize(r, ActionWithdraw, o.From); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if o, err = sm.CancelStandingOrder(o.ID); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, o)
+}
+
+type settlementRequest struct {
+	Obligations []Obligation `json:"obligations"`
+}
+
+// handleSettle settles a batch of obligations with net transfers, needing
+// the permissions of a transfer for each obligation: every net payer owes,
+// and every net receiver is owed, in at least one of them.
+func (s *Server) handleSettle(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	var req settlementRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, o := range req.Obligations {
+		if err := checkAmount(o.Amount); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := s.authorize(r, ActionWithdraw, o.From); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := s.authorize(r, ActionDeposit, o.To); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+
+	if isDryRun(r) {
+		transfers, err := Net(req.Obligations)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		balances, err := sm.SimulateContext(ctx, func(scratch *StateMachine) error {
+			for _, op := range transfers {
+				if _, err := scratch.ApplyContext(ctx, op); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		touched := map[string]int{}
+		for _, op := range transfers {
+			touched[op.From], touched[op.To] = balances[op.From], balances[op.To]
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"dry_run":   true,
+			"transfers": append([]Operation{}, transfers...),
+			"balances":  touched,
+		})
+		return
+	}
+
+	settlement, err := sm.Settle(ctx, req.Obligations)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, settlement)
+}
+
+func (s *Server) handleDeadLetters(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	letters := sm.DeadLetters()
+	if letters == nil {
+		letters = []DeadLetter{}
+	}
+	writeJSON(w, http.StatusOK, letters)
+}
+
+func (s *Server) handleDeadLetter(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	dl, err := sm.DeadLetter(r.PathValue("letter"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, dl)
+}
+
+type requeueResponse struct {
+	ID     string       `json:"id"`     // of the dead letter requeued
+	Future string       `json:"future"` // of the operation submitted
+	Status FutureStatus `json:"status"`
+}
+
+// handleRequeueDeadLetter submits the operation of a dead letter again and
+// answers right away; if it fails again, a new dead letter is queued.
+func (s *Server) handleRequeueDeadLetter(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	if s.dispatch == nil {
+		writeError(w, fmt.Errorf("%w: no dispatcher to requeue on", ErrDispatcherClosed))
+		return
+	}
+	id := r.PathValue("letter")
+	future, err := sm.RequeueDeadLetter(r.Context(), s.dispatch, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, requeueResponse{ID: id, Future: future.ID(), Status: future.Status()})
+}
+
+func (s *Server) handleDiscardDeadLetter(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	dl, err := sm.DiscardDeadLetter(r.PathValue("letter"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, dl)
+}
+
+// handleOutbox answers the outbox entries after the Seq ?after, or else
+// after the offset of ?consumer, see Events, or with ?format=debezium their
+// change events, see ChangeEvents.
+func (s *Server) handleOutbox(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	query := r.URL.Query()
+	limit, err := queryInt(query, "limit")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	after := sm.Offsets()[query.Get("consumer")]
+	if query.Has("after") {
+		if after, err = strconv.ParseUint(query.Get("after"), 10, 64); err != nil {
+			writeError(w, fmt.Errorf("%w: after must be a Seq", errBadRequest))
+			return
+		}
+	}
+	format := query.Get("format")
+	if format != "" && format != "debezium" {
+		writeError(w, fmt.Errorf("%w: unknown format %q", errBadRequest, format))
+		return
+	}
+	entries, err := sm.Events(after, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if format == "debezium" {
+		events := []ChangeEvent{}
+		for _, entry := range entries {
+			events = append(events, ChangeEvents(entry, changeSourceName)...)
+		}
+		writeJSON(w, http.StatusOK, events)
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+type offsetRequest struct {
+	Seq uint64 `json:"seq"`
+}
+
+func (s *Server) handleOffsets(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	offsets := sm.Offsets()
+	if offsets == nil {
+		offsets = map[string]uint64{}
+	}
+	writeJSON(w, http.StatusOK, offsets)
+}
+
+// handleCommitOffset commits the offset of a consumer and answers with the
+// offset of each.
+func (s *Server) handleCommitOffset(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	var req offsetRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := sm.CommitOffset(r.PathValue("consumer"), req.Seq); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sm.Offsets())
+}
+
+func (s *Server) handleRemoveConsumer(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+	sm.RemoveConsumer(r.PathValue("consumer"))
+	s.handleOffsets(w, r, sm)
+}
+
+// handleCompensations lists the compensation log, only the entries with the
+// given status if any, e.g. ?status=unresolved for those waiting for an
+// admin.
+func (s *Server) handleCompensations(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	status := CompensationStatus(r.URL.Query().Get("status"))
+	compensations := []Compensation{}
+	for _, c := range sm.Compensations() {
+		if status == "" || c.Status == status {
+			compensations = append(compensations, c)
+		}
+	}
+	writeJSON(w, http.StatusOK, compensations)
+}
+
+func (s *Server) handleCompensation(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	c, err := sm.Compensation(r.PathValue("compensation"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (s *Server) handleRetryCompensation(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ctx, cancel := s.operationContext(r)
+	defer cancel()
+	c, err := sm.RetryCompensation(ctx, r.PathValue("compensation"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+type resolveCompensationRequest struct {
+	Note string `json:"note"`
+}
+
+func (s *Server) handleResolveCompensation(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req resolveCompensationRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	c, err := sm.ResolveCompensation(r.Context(), r.PathValue("compensation"), req.Note)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (s *Server) handleAlerts(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionRead); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	alerts := sm.Alerts()
+	if alerts == nil {
+		alerts = []Alert{}
+	}
+	writeJSON(w, http.StatusOK, alerts)
+}
+
+type alertRequest struct {
+	Kind      AlertKind `json:"kind"`
+	Account   string    `json:"account"`
+	Threshold int       `json:"threshold"`
+}
+
+func (s *Server) handleAddAlert(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req alertRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	alert, err := sm.AddAlert(Alert{Kind: req.Kind, Account: req.Account, Threshold: req.Threshold})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, alert)
+}
+
+func (s *Server) handleRemoveAlert(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := sm.RemoveAlert(r.PathValue("alert")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleScripts(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	scripts := sm.Scripts()
+	if scripts == nil {
+		scripts = []Script{}
+	}
+	writeJSON(w, http.StatusOK, scripts)
+}
+
+type scriptRequest struct {
+	Source string `json:"source"`
+}
+
+func (s *Server) handleSetScript(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req scriptRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	script, err := sm.SetScript(r.PathValue("script"), req.Source)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, script)
+}
+
+func (s *Server) handleRemoveScript(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := sm.RemoveScript(r.PathValue("script")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handlePolicies(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	policies := sm.Policies()
+	if policies == nil {
+		policies = []Policy{}
+	}
+	writeJSON(w, http.StatusOK, policies)
+}
+
+// handleSetPolicies replaces the policies with those of the body, in YAML
+// if its media type says so, or else in JSON.
+func (s *Server) handleSetPolicies(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	format := PolicyJSON
+	if mediaType, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.Contains(mediaType, "yaml") {
+		format = PolicyYAML
+	}
+	policies, err := ReadPolicies(r.Body, format)
+	if err == nil {
+		err = sm.SetPolicies(policies)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	s.handlePolicies(w, r, sm)
+}
+
+type simulatePoliciesRequest struct {
+	Policies   []Policy    `json:"policies"` // the policies set if null
+	Operations []Operation `json:"operations"`
+}
+
+func (s *Server) handleSimulatePolicies(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req simulatePoliciesRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	decisions, err := sm.SimulatePolicies(r.Context(), req.Policies, req.Operations)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if decisions == nil {
+		decisions = []PolicyDecision{}
+	}
+	writeJSON(w, http.StatusOK, decisions)
+}
+
+type createTenantRequest struct {
+	ID       string         `json:"id"`
+	Accounts map[string]int `json:"accounts"`
+}
+
+func (s *Server) handleCreateTenant(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorize(r, ActionManage); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req createTenantRequest
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, err := sm.CreateTenant(req.ID, req.Accounts, nil); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"id": req.ID})
+}
+
+// quotaResponse is the quota of a tenant and its usage.
+type quotaResponse struct {
+	Quota Quota      `json:"quota"`
+	Usage QuotaUsage `json:"usage"`
+}
+
+// handleQuota answers the quota of a tenant and its usage.
+func (s *Server) handleQuota(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorizeRoot(r); err != nil {
+		writeError(w, err)
+		return
+	}
+	quota, usage := sm.Quota()
+	writeJSON(w, http.StatusOK, quotaResponse{Quota: quota, Usage: usage})
+}
+
+// handleSetQuota replaces the quota of a tenant, see SetQuota.
+func (s *Server) handleSetQuota(w http.ResponseWriter, r *http.Request, sm *StateMachine) {
+	if err := s.authorizeRoot(r); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var req Quota
+	if err := decodeRequest(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := sm.SetQuota(req); err != nil {
+		writeError(w, err)
+		return
+	}
+	quota, usage := sm.Quota()
+	writeJSON(w, http.StatusOK, quotaResponse{Quota: quota, Usage: usage})
+}
+
+// errBadRequest marks errors caused by a malformed request body.
+var errBadRequest = errors.New("bad request")
+
+func decodeRequest(r *http.Request, v any) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+	return nil
+}
+
+func checkAmount(amount int) error {
+	if amount <= 0 {
+		return fmt.Errorf("%w: amount must be positive", errBadRequest)
+	}
+	return nil
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var rateErr *RateLimitError
+	var overloadErr *OverloadError
+	var epochErr *StaleEpochError
+	switch {
+	case errors.As(err, &rateErr):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rateErr.RetryAfter.Seconds()))))
+	case errors.As(err, &overloadErr):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(overloadErr.RetryAfter.Seconds()))))
+	case errors.As(err, &epochErr):
+		w.Header().Set(EpochHeader, epochErr.Current)
+	}
+	writeJSON(w, errorStatus(err), map[string]string{"error": err.Error()})
+}
+
+// errorStatus returns the HTTP status answering err.
+func errorStatus(err error) int {
+	status := http.StatusInternalServerError
+
+	switch {
+	case errors.Is(err, ErrRateLimited), errors.Is(err, ErrOverloaded):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, ErrUnauthenticated):
+		status = http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrSelfApproval), errors.Is(err, ErrEscrowAccount),
+		errors.Is(err, ErrNotSigner), errors.Is(err, ErrStatusForbids), errors.Is(err, ErrQuotaExceeded),
+		errors.Is(err, ErrPolicyViolation):
+		status = http.StatusForbidden
+	case errors.Is(err, errBadRequest), errors.Is(err, ErrInvalidOperation), errors.Is(err, ErrInvalidCursor),
+		errors.Is(err, ErrInvalidStatement), errors.Is(err, ErrInvalidAlert), errors.Is(err, ErrInvalidSigners),
+		errors.Is(err, ErrInvalidBucket), errors.Is(err, ErrInvalidStandingOrder), errors.Is(err, ErrInvalidObligation),
+		errors.Is(err, ErrInvalidBounds), errors.Is(err, ErrInvalidAlias), errors.Is(err, ErrInvalidStatus),
+		errors.Is(err, ErrInvalidConsistency), errors.Is(err, ErrInvalidSettings), errors.Is(err, ErrInvalidQuota),
+		errors.Is(err, ErrInvalidExportFormat), errors.Is(err, ErrInvalidScript), errors.Is(err, ErrInvalidPolicy):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrInvalidAccount), errors.Is(err, ErrInvalidTenant), errors.Is(err, ErrUnknownApproval), errors.Is(err, ErrOperationNotFound),
+		errors.Is(err, ErrUnknownVersion), errors.Is(err, ErrAlertNotFound), errors.Is(err, ErrScriptNotFound),
+		errors.Is(err, ErrUnknownEscrow), errors.Is(err, ErrUnknownDebit), errors.Is(err, ErrUnknownStandingOrder),
+		errors.Is(err, ErrUnknownAlias), errors.Is(err, ErrUnknownFlag), errors.Is(err, ErrUnknownCompensation),
+		errors.Is(err, ErrUnknownDeadLetter), errors.Is(err, ErrWALDisabled), errors.Is(err, ErrOutboxDisabled):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrInsufficientBalance), errors.Is(err, ErrNothingToRollback), errors.Is(err, ErrApprovalDecided),
+		errors.Is(err, ErrAlreadyReversed), errors.Is(err, ErrIrreversible), errors.Is(err, ErrAccountExists),
+		errors.Is(err, ErrDuplicateMessage), errors.Is(err, ErrEscrowSettled), errors.Is(err, ErrSignaturesRequired),
+		errors.Is(err, ErrDebitDecided), errors.Is(err, ErrAlreadySigned), errors.Is(err, ErrApprovalRequired),
+		errors.Is(err, ErrAccountArchived), errors.Is(err, ErrNotArchived), errors.Is(err, ErrAliasTaken),
+		errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrCompensationSettled), errors.Is(err, ErrVersionConflict),
+		errors.Is(err, ErrDeadlock), errors.Is(err, ErrTenantsNotDurable):
+		status = http.StatusConflict
+	case errors.Is(err, ErrStaleEpoch):
+		status = http.StatusPreconditionFailed
+	case errors.Is(err, ErrEventsPruned):
+		status = http.StatusGone
+	case errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusGatewayTimeout
+	case errors.Is(err, ErrReadOnly):
+		status = http.StatusMethodNotAllowed
+	case errors.Is(err, ErrClosed), errors.Is(err, ErrReplicaStale), errors.Is(err, ErrDispatcherClosed), errors.Is(err, ErrQueueFull),
+		errors.Is(err, ErrWALFailed), errors.Is(err, ErrMemoryLimit):
+		status = http.StatusServiceUnavailable
+	}
+	return status
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer(accounts map[string]int) (*Server, *StateMachine) {
+	sm := &StateMachine{
+		accounts: accounts,
+	}
+	return NewServer(sm, ""), sm
+}
+
+func TestServerOperations(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 1000, "acc2": 500})
+
+	tests := []struct {
+		name           string
+		method, path   string
+		body           string
+		expectedStatus int
+	}{
+		{name: "Deposit", method: "POST", path: "/accounts/acc1/deposit", body: `{"amount": 200}`, expectedStatus: http.StatusOK},
+		{name: "Withdraw", method: "POST", path: "/accounts/acc2/withdraw", body: `{"amount": 100}`, expectedStatus: http.StatusOK},
+		{name: "Transfer", method: "POST", path: "/transfers", body: `{"from": "acc1", "to": "acc2", "amount": 150}`, expectedStatus: http.StatusOK},
+		{name: "Insufficient balance", method: "POST", path: "/accounts/acc2/withdraw", body: `{"amount": 5000}`, expectedStatus: http.StatusConflict},
+		{name: "Invalid account", method: "POST", path: "/accounts/nope/deposit", body: `{"amount": 1}`, expectedStatus: http.StatusNotFound},
+		{name: "Negative amount", method: "POST", path: "/accounts/acc1/deposit", body: `{"amount": -1}`, expectedStatus: http.StatusBadRequest},
+		{name: "Malformed body", method: "POST", path: "/transfers", body: `{"from":`, expectedStatus: http.StatusBadRequest},
+		{name: "Balance", method: "GET", path: "/accounts/acc1", expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+
+	expectedAccounts := map[string]int{"acc1": 1050, "acc2": 550}
+	for acc, expectedBalance := range expectedAccounts {
+		if sm.accounts[acc] != expectedBalance {
+			t.Errorf("Account %s balance = %d; want %d", acc, sm.accounts[acc], expectedBalance)
+		}
+	}
+}
+
+func TestServerReadiness(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+
+	get := func(path string) int {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz = %d; want %d", code, http.StatusOK)
+	}
+
+	storageErr := errors.New("storage unreachable")
+	srv.AddReadinessCheck("storage", func(ctx context.Context) error { return storageErr })
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz with failing check = %d; want %d", code, http.StatusServiceUnavailable)
+	}
+
+	storageErr = nil
+	if err := sm.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz after Close = %d; want %d", code, http.StatusServiceUnavailable)
+	}
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz after Close = %d; want %d", code, http.StatusOK)
+	}
+}
+
+func TestServerOperationTimeout(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+	srv.UseOperationTimeout(10 * time.Millisecond)
+
+	sm.mu.Lock()
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest("POST", "/accounts/acc1/withdraw", strings.NewReader(`{"amount": 100}`)))
+	sm.mu.Unlock()
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("Withdraw while locked = %d; want %d", rec.Code, http.StatusGatewayTimeout)
+	}
+	if balance, _ := sm.Balance("acc1"); balance != 1000 {
+		t.Errorf("Account acc1 balance = %d; want 1000", balance)
+	}
+}
+
+func TestServerRollbackIfVersion(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+	_ = sm.Deposit("acc1", 100) // version 1
+	_ = sm.Deposit("acc1", 10)  // version 2
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+	}{
+		{"Stale version", "/rollback?if_version=1", http.StatusConflict},
+		{"Invalid version", "/rollback?if_version=latest", http.StatusBadRequest},
+		{"Current version", "/rollback?if_version=2", http.StatusOK},
+		{"Rolled back already", "/rollback?if_version=2", http.StatusConflict},
+		{"Unconditional", "/rollback", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, tt.path, nil))
+			if rec.Code != tt.expectedStatus {
+				t.Errorf("POST %s = %d; want %d (%s)", tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+	if balance, _ := sm.Balance("acc1"); balance != 1000 {
+		t.Errorf("Balance() = %d; want 1000, both deposits rolled back", balance)
+	}
+}
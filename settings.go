@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrInvalidSettings is returned by Reconfigure for settings that cannot be
+// applied.
+var ErrInvalidSettings = errors.New("invalid settings")
+
+// Settings are the limits that can be changed while running, see
+// Reconfigure.
+type Settings struct {
+	MaxHistory        int           `json:"max_history"`        // 0 keeps every state
+	ApprovalThreshold int           `json:"approval_threshold"` // 0 if approvals are disabled
+	ApprovalTTL       time.Duration `json:"approval_ttl"`
+	GlobalLimit       RateLimit     `json:"global_limit"`
+	AccountLimit      RateLimit     `json:"account_limit"`
+	ClientLimit       RateLimit     `json:"client_limit"`
+}
+
+// SettingsChange records a change of the settings, for audit.
+type SettingsChange struct {
+	Version  int       `json:"version"` // 1 for the first change since start
+	Settings Settings  `json:"settings"`
+	Previous Settings  `json:"previous"`
+	Actor    string    `json:"actor,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// settings serializes changes of the settings and keeps their history.
+type settings struct {
+	mu      sync.Mutex
+	changes []SettingsChange
+}
+
+// Settings returns the current settings.
+func (sm *StateMachine) Settings() Settings {
+	sm.mu.Lock()
+	s := Settings{MaxHistory: sm.maxHistory}
+	sm.mu.Unlock()
+
+	if a := sm.approvals.Load(); a != nil {
+		a.mu.Lock()
+		s.ApprovalThreshold, s.ApprovalTTL = int(a.threshold.Load()), a.ttl
+		a.mu.Unlock()
+	}
+	if sm.limiter != nil {
+		s.GlobalLimit, s.AccountLimit, s.ClientLimit = sm.limiter.Limits()
+	}
+	return s
+}
+
+// SettingsHistory returns every change of the settings since start, oldest
+// first. The version of the current settings is the number of changes.
+func (sm *StateMachine) SettingsHistory() []SettingsChange {
+	sm.settings.mu.Lock()
+	defer sm.settings.mu.Unlock()
+	return slices.Clone(sm.settings.changes)
+}
+
+// Reconfigure replaces the settings without restarting, recording the
+// change with the actor in ctx and reason. Lowering MaxHistory trims history
+// right away; changing the approval threshold applies to transfers
+// requested from then on, pending ones keeping theirs.
+//
+// Approvals can be enabled but not disabled, as transfers pending approval
+// would be stranded: raise the threshold instead. Rate limits can only be
+// changed if sm has a rate limiter.
+func (sm *StateMachine) Reconfigure(ctx context.Context, s Settings, reason string) (SettingsChange, error) {
+	return sm.UpdateSettings(ctx, func(current *Settings) { *current = s }, reason)
+}
+
+// UpdateSettings changes the current settings with update, then applies
+// them as Reconfigure does. No other change is made in between, so updates
+// of different settings never undo each other.
+func (sm *StateMachine) UpdateSettings(ctx context.Context, update func(s *Settings), reason string) (SettingsChange, error) {
+	sm.settings.mu.Lock()
+	defer sm.settings.mu.Unlock()
+
+	previous := sm.Settings()
+	s := previous
+	update(&s)
+	if err := s.validate(); err != nil {
+		return SettingsChange{}, err
+	}
+	a := sm.approvals.Load()
+	if a != nil && s.ApprovalThreshold == 0 {
+		return SettingsChange{}, fmt.Errorf("%w: approvals cannot be disabled while running", ErrInvalidSettings)
+	}
+	if sm.limiter == nil && (s.GlobalLimit != RateLimit{} || s.AccountLimit != RateLimit{} || s.ClientLimit != RateLimit{}) {
+		return SettingsChange{}, fmt.Errorf("%w: rate limiting is not enabled", ErrInvalidSettings)
+	}
+
+	sm.mu.Lock()
+	sm.maxHistory = s.MaxHistory
+	sm.history.trim(sm.maxHistory)
+	sm.mu.Unlock()
+
+	switch {
+	case a != nil:
+		a.mu.Lock()
+		a.threshold.Store(int64(s.ApprovalThreshold))
+		a.ttl = s.ApprovalTTL
+		a.mu.Unlock()
+	case s.ApprovalThreshold > 0:
+		sm.RequireApproval(s.ApprovalThreshold, s.ApprovalTTL)
+	}
+	if sm.limiter != nil {
+		sm.limiter.SetLimits(s.GlobalLimit, s.AccountLimit, s.ClientLimit)
+	}
+
+	change := SettingsChange{
+		Version:  len(sm.settings.changes) + 1,
+		Settings: s,
+		Previous: previous,
+		Actor:    ActorFrom(ctx),
+		Reason:   reason,
+		Time:     sm.now(),
+	}
+	sm.settings.changes = append(sm.settings.changes, change)
+
+	fmt.Printf("\n\nSettings changed to version %d by %q: %+v\n", change.Version, change.Actor, s)
+
+	return change, nil
+}
+
+func (s Settings) validate() error {
+	if s.MaxHistory < 0 {
+		return fmt.Errorf("%w: negative max_history (%d)", ErrInvalidSettings, s.MaxHistory)
+	}
+	if s.ApprovalThreshold < 0 || (s.ApprovalThreshold > 0 && s.ApprovalTTL <= 0) {
+		return fmt.Errorf("%w: approval_threshold (%d) must not be negative, with a positive approval_ttl (%s)", ErrInvalidSettings, s.ApprovalThreshold, s.ApprovalTTL)
+	}
+	for name, limit := range map[string]RateLimit{"global": s.GlobalLimit, "account": s.AccountLimit, "client": s.ClientLimit} {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return fmt.Errorf("%w: negative %s_limit (%+v)", ErrInvalidSettings, name, limit)
+		}
+	}
+	return nil
+}
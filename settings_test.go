@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconfigure(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 10000, "acc2": 0},
+		limiter:  NewRateLimiter(RateLimit{}, RateLimit{}, RateLimit{}),
+	}
+	for range 5 {
+		if err := sm.Deposit("acc1", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := WithActor(context.Background(), "alice")
+
+	tests := []struct {
+		name        string
+		settings    Settings
+		expectedErr error
+	}{
+		{"Negative max history", Settings{MaxHistory: -1}, ErrInvalidSettings},
+		{"Approvals without a TTL", Settings{ApprovalThreshold: 100}, ErrInvalidSettings},
+		{"Negative rate", Settings{GlobalLimit: RateLimit{Rate: -1}}, ErrInvalidSettings},
+		{"Enable approvals", Settings{MaxHistory: 2, ApprovalThreshold: 100, ApprovalTTL: time.Hour}, nil},
+		{"Disable approvals", Settings{MaxHistory: 2}, ErrInvalidSettings},
+		{"Raise threshold and limit accounts", Settings{MaxHistory: 2, ApprovalThreshold: 500, ApprovalTTL: time.Hour, AccountLimit: RateLimit{Rate: 1, Burst: 1}}, nil},
+	}
+
+	version := 0
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := sm.Settings()
+			change, err := sm.Reconfigure(alice, tt.settings, tt.name)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Reconfigure() error = %v; want %v", err, tt.expectedErr)
+			}
+			if err != nil {
+				if sm.Settings() != previous {
+					t.Errorf("Settings() after a failed Reconfigure() = %+v; want %+v", sm.Settings(), previous)
+				}
+				return
+			}
+			version++
+			if change.Version != version || change.Previous != previous || change.Actor != "alice" || change.Reason != tt.name {
+				t.Errorf("Reconfigure() = %+v; want version %d by alice, from %+v", change, version, previous)
+			}
+			if sm.Settings() != tt.settings {
+				t.Errorf("Settings() = %+v; want %+v", sm.Settings(), tt.settings)
+			}
+		})
+	}
+
+	if depth := sm.HistoryDepth(); depth != 2 {
+		t.Errorf("HistoryDepth() = %d; want 2, trimmed to the new max_history", depth)
+	}
+	if err := sm.TransferContext(alice, "acc1", "acc2", 600); !errors.Is(err, ErrApprovalRequired) {
+		t.Errorf("Transfer above the new threshold error = %v; want ErrApprovalRequired", err)
+	}
+	if err := sm.Transfer("acc1", "acc2", 400); err != nil {
+		t.Errorf("Transfer under the new threshold error = %v", err)
+	}
+	if err := sm.Deposit("acc1", 1); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Deposit over the new account limit error = %v; want ErrRateLimited", err)
+	}
+	if history := sm.SettingsHistory(); len(history) != 2 {
+		t.Errorf("SettingsHistory() = %+v; want 2 changes", history)
+	}
+
+	unlimited := &StateMachine{accounts: map[string]int{}}
+	if _, err := unlimited.Reconfigure(alice, Settings{ClientLimit: RateLimit{Rate: 1}}, ""); !errors.Is(err, ErrInvalidSettings) {
+		t.Errorf("Reconfigure() of rate limits without a limiter error = %v; want ErrInvalidSettings", err)
+	}
+}
+
+func TestServerSettings(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 100})
+	sm.limiter = NewRateLimiter(RateLimit{}, RateLimit{}, RateLimit{})
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expected       Settings
+	}{
+		{"Max history", `{"max_history": 10, "reason": "memory"}`, http.StatusOK, Settings{MaxHistory: 10}},
+		{"Approvals and limits", `{"approval_threshold": 500, "approval_ttl": "1h", "client_limit": {"rate": 5, "burst": 10}}`, http.StatusOK,
+			Settings{MaxHistory: 10, ApprovalThreshold: 500, ApprovalTTL: time.Hour, ClientLimit: RateLimit{Rate: 5, Burst: 10}}},
+		{"Invalid TTL", `{"approval_ttl": "soon"}`, http.StatusBadRequest, Settings{}},
+		{"Invalid setting", `{"max_history": -1}`, http.StatusBadRequest, Settings{}},
+		{"Unknown setting", `{"fees": 1}`, http.StatusBadRequest, Settings{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/settings", strings.NewReader(tt.body)))
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("PATCH /settings = %d; want %d (%s)", rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var change SettingsChange
+			if err := json.Unmarshal(rec.Body.Bytes(), &change); err != nil {
+				t.Fatal(err)
+			}
+			if change.Settings != tt.expected {
+				t.Errorf("PATCH /settings = %+v; want %+v", change.Settings, tt.expected)
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/settings", nil))
+	var current settingsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &current); err != nil || current.Version != 2 || current.Settings != sm.Settings() {
+		t.Errorf("GET /settings = %s; want version 2 and %+v", rec.Body, sm.Settings())
+	}
+
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/settings/history", nil))
+	var history []SettingsChange
+	if err := json.Unmarshal(rec.Body.Bytes(), &history); err != nil || len(history) != 2 || history[0].Reason != "memory" {
+		t.Errorf("GET /settings/history = %s; want both changes", rec.Body)
+	}
+}
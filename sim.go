@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"maps"
+	"math/rand/v2"
+	"os"
+	"slices"
+	"time"
+)
+
+// ErrInvariant is returned by RunSimulation when a scenario breaks an
+// invariant of the state machine.
+var ErrInvariant = errors.New("invariant violated")
+
+// simAccounts are the accounts simulated operations pick from. The last one
+// does not exist.
+var simAccounts = []string{"acc1", "acc2", "acc3", "acc4", "nope"}
+
+// simDiskFaults are the failures of the simulated disk checkpoints are
+// written to.
+var simDiskFaults = Faults{ErrorRate: 0.1, PartialWriteRate: 0.1}
+
+// SimulationReport is the outcome of a simulated scenario, see RunSimulation.
+type SimulationReport struct {
+	Seed        uint64 `json:"seed"`
+	Steps       int    `json:"steps"`
+	Operations  int    `json:"operations"`  // applied
+	Rejected    int    `json:"rejected"`    // e.g. for an insufficient balance
+	Rollbacks   int    `json:"rollbacks"`   // applied
+	Checkpoints int    `json:"checkpoints"` // backups written whole
+	Torn        int    `json:"torn"`        // backups the disk failed to write
+	Crashes     int    `json:"crashes"`     // of the leader, restarted from its last checkpoint
+	Partitions  int    `json:"partitions"`  // between the leader and its replica
+	Resyncs     int    `json:"resyncs"`     // of the replica from the leader's state
+	Version     int    `json:"version"`     // of the leader at the end
+	Digest      string `json:"digest"`      // of everything that happened, the same for the same seed
+}
+
+// simulation is a leader and its replica run step by step, with the time,
+// the random bits of IDs, the disk and the network between them all
+// controlled by one seed.
+type simulation struct {
+	rng     *rand.Rand
+	entropy *rand.ChaCha8 // random bits of the IDs
+	clock   *FakeClock
+	disk    *FaultInjector
+
+	leader        *StateMachine
+	states        []map[string]int // expected balances at every version of the leader
+	total         int              // expected sum of the leader's balances
+	durable       []byte           // the last checkpoint written whole
+	durableStates []map[string]int // states when it was written
+
+	replica     *StateMachine
+	events      <-chan Event // from the leader, nil while disconnected
+	unsubscribe context.CancelFunc
+	partitioned bool
+
+	trace  hash.Hash
+	report SimulationReport
+}
+
+// RunSimulation runs a scenario of the given number of steps, each an
+// operation, a rollback, events reaching the replica, a checkpoint of the
+// leader to a disk failing at random, a crash of the leader or a network
+// partition between the leader and its replica, and checks the invariants
+// after every step:
+//
+//   - balances never go negative,
+//   - money is only created by deposits and destroyed by withdrawals,
+//   - rollbacks restore exactly the earlier states,
+//   - a leader restarted from its last checkpoint has the state it had when
+//     the checkpoint was taken, and its journal replays to it,
+//   - a torn checkpoint is never restored,
+//   - a replica that caught up with the leader has the leader's state.
+//
+// The scenario follows from the seed alone: no wall clock or real I/O is
+// involved and nothing runs alongside the steps, so running a seed again
+// reproduces it step by step, with the same digest. The first invariant broken is returned, wrapping
+// ErrInvariant.
+func RunSimulation(seed uint64, steps int) (SimulationReport, error) {
+	var key [32]byte
+	binary.LittleEndian.PutUint64(key[:], seed)
+	s := &simulation{
+		rng:     rand.New(rand.NewPCG(seed, 0)),
+		entropy: rand.NewChaCha8(key),
+		clock:   NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)),
+		disk:    NewFaultInjector(seed, simDiskFaults),
+		trace:   sha256.New(),
+		report:  SimulationReport{Seed: seed, Steps: steps},
+	}
+	defer s.disconnect()
+
+	initial := map[string]int{}
+	for _, id := range simAccounts[:len(simAccounts)-1] {
+		initial[id] = s.rng.IntN(1000)
+	}
+	s.leader = s.newMachine(initial)
+	s.states = []map[string]int{maps.Clone(initial)}
+	s.total = sum(initial)
+	s.replica = s.newMachine(nil)
+	s.replica.readOnly = true
+
+	// The initial state is on disk before the leader starts.
+	var buf bytes.Buffer
+	if err := s.leader.Backup(&buf); err != nil {
+		return s.report, err
+	}
+	s.durable, s.durableStates = buf.Bytes(), slices.Clone(s.states)
+
+	for step := range steps {
+		s.clock.Advance(time.Duration(s.rng.IntN(2000)) * time.Millisecond)
+
+		var event string
+		var err error
+		switch n := s.rng.IntN(100); {
+		case n < 50:
+			event, err = s.operate()
+		case n < 56:
+			event, err = s.rollback()
+		case n < 76:
+			event, err = s.deliver()
+		case n < 86:
+			event, err = s.checkpoint()
+		case n < 90:
+			event, err = s.crash()
+		default:
+			event = s.partition()
+		}
+		fmt.Fprintf(s.trace, "%d %s -> %d\n", step, event, s.leader.Version())
+		if err == nil {
+			err = s.check()
+		}
+		if err != nil {
+			return s.report, fmt.Errorf("%w: seed %d, step %d (%s): %w", ErrInvariant, seed, step, event, err)
+		}
+	}
+
+	if err := verified(s.leader); err != nil {
+		return s.report, fmt.Errorf("%w: seed %d, at the end: %w", ErrInvariant, seed, err)
+	}
+	s.report.Version = s.leader.Version()
+	s.report.Digest = hex.EncodeToString(s.trace.Sum(nil))
+	return s.report, nil
+}
+
+// newMachine returns a state machine with the given balances on the
+// simulation's clock and entropy.
+func (s *simulation) newMachine(accounts map[string]int) *StateMachine {
+	sm := &StateMachine{accounts: maps.Clone(accounts)}
+	if sm.accounts == nil {
+		sm.accounts = map[string]int{}
+	}
+	sm.UseClock(s.clock)
+	sm.UseRandom(s.entropy)
+	return sm
+}
+
+// account picks an account, possibly one that does not exist.
+func (s *simulation) account() string {
+	return simAccounts[s.rng.IntN(len(simAccounts))]
+}
+
+// operate applies a random deposit, withdrawal or transfer to the leader.
+func (s *simulation) operate() (string, error) {
+	op := Operation{Amount: 1 + s.rng.IntN(300)}
+	switch s.rng.IntN(3) {
+	case 0:
+		op.Type, op.To = OpDeposit, s.account()
+	case 1:
+		op.Type, op.From = OpWithdraw, s.account()
+	default:
+		op.Type, op.From, op.To = OpTransfer, s.account(), s.account()
+	}
+
+	applied, err := s.leader.ApplyContext(context.Background(), op)
+	event := fmt.Sprintf("%s %s>%s %d: %s", op.Type, op.From, op.To, op.Amount, applied.ID)
+	if err != nil {
+		s.report.Rejected++
+		event += " " + err.Error()
+	} else {
+		s.report.Operations++
+		switch op.Type {
+		case OpDeposit:
+			s.total += op.Amount
+		case OpWithdraw:
+			s.total -= op.Amount
+		}
+	}
+
+	// Rejected operations may leave a state in history too.
+	if version := s.leader.Version(); version == len(s.states) {
+		s.states = append(s.states, s.leader.Balances())
+	} else if err == nil || version != len(s.states)-1 {
+		return event, fmt.Errorf("version %d after the operation; want %d", version, len(s.states))
+	}
+	return event, nil
+}
+
+// rollback rolls the leader back one version or to a random one.
+func (s *simulation) rollback() (string, error) {
+	if s.rng.IntN(2) == 0 {
+		err := s.leader.Rollback()
+		if len(s.states) == 1 {
+			if !errors.Is(err, ErrNothingToRollback) {
+				return "rollback", fmt.Errorf("rollback of an empty history = %v; want %w", err, ErrNothingToRollback)
+			}
+			return "rollback", nil
+		}
+		if err != nil {
+			return "rollback", fmt.Errorf("rollback failed: %w", err)
+		}
+		s.states = s.states[:len(s.states)-1]
+	} else {
+		version := s.rng.IntN(len(s.states))
+		if err := s.leader.RollbackTo(version); err != nil {
+			return fmt.Sprintf("rollback to %d", version), fmt.Errorf("rollback failed: %w", err)
+		}
+		s.states = s.states[:version+1]
+	}
+	s.report.Rollbacks++
+	s.total = sum(s.states[len(s.states)-1])
+	return "rollback", nil
+}
+
+// deliver connects the replica to the leader, unless they are partitioned,
+// and passes it some of the events in flight, as they would be sent over
+// the network.
+func (s *simulation) deliver() (string, error) {
+	if s.partitioned {
+		return "deliver: partitioned", nil
+	}
+	if s.events == nil {
+		var ctx context.Context
+		ctx, s.unsubscribe = context.WithCancel(context.Background())
+		var state Event
+		state, s.events = s.leader.SubscribeWithState(ctx)
+		if err := roundTrip(&state); err != nil {
+			return "resync", err
+		}
+		s.replica.resetTo(state)
+		s.report.Resyncs++
+		return fmt.Sprintf("resync at %d", state.Version), nil
+	}
+
+	n := s.rng.IntN(len(s.events) + 1)
+	for range n {
+		event := <-s.events
+		if err := roundTrip(&event); err != nil {
+			return "deliver", err
+		}
+		s.replica.applyReplicated(event)
+	}
+	if len(s.events) == 0 {
+		// Events are only sent as the leader applies operations, so an
+		// empty channel is either waiting for more or closed.
+		select {
+		case <-s.events:
+			// The replica fell too far behind and was dropped.
+			s.disconnect()
+			return fmt.Sprintf("deliver %d, dropped", n), nil
+		default:
+		}
+	}
+	return fmt.Sprintf("deliver %d", n), nil
+}
+
+// roundTrip encodes and decodes event as the replication stream does.
+func roundTrip(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	*event = Event{}
+	return json.Unmarshal(data, event)
+}
+
+// checkpoint writes a backup of the leader to the simulated disk. Like a
+// file written aside and renamed, it replaces the last checkpoint only once
+// written whole.
+func (s *simulation) checkpoint() (string, error) {
+	var buf bytes.Buffer
+	if err := s.leader.Backup(s.disk.Writer(&buf)); err != nil {
+		s.report.Torn++
+		if err := s.newMachine(nil).Restore(bytes.NewReader(buf.Bytes()), LatestVersion); err == nil {
+			return "checkpoint: torn", fmt.Errorf("torn checkpoint of %d bytes restored", buf.Len())
+		}
+		return "checkpoint: torn", nil
+	}
+	s.durable, s.durableStates = buf.Bytes(), slices.Clone(s.states)
+	s.report.Checkpoints++
+	return fmt.Sprintf("checkpoint at %d", s.leader.Version()), nil
+}
+
+// crash restarts the leader from its last checkpoint, losing what happened
+// since, and breaks its connection to the replica.
+func (s *simulation) crash() (string, error) {
+	s.disconnect()
+	s.report.Crashes++
+
+	restarted := s.newMachine(nil)
+	if err := restarted.Restore(bytes.NewReader(s.durable), LatestVersion); err != nil {
+		return "crash", fmt.Errorf("restart failed: %w", err)
+	}
+	s.leader = restarted
+	s.states = slices.Clone(s.durableStates)
+	s.total = sum(s.states[len(s.states)-1])
+	version := restarted.Version()
+	return fmt.Sprintf("crash, restarted at %d", version), verified(restarted)
+}
+
+// partition cuts the network between the leader and its replica, or heals
+// it. Events in flight are lost and the replica resyncs once healed.
+func (s *simulation) partition() string {
+	s.partitioned = !s.partitioned
+	if !s.partitioned {
+		return "heal"
+	}
+	s.disconnect()
+	s.report.Partitions++
+	return "partition"
+}
+
+func (s *simulation) disconnect() {
+	if s.unsubscribe != nil {
+		s.unsubscribe()
+	}
+	s.events, s.unsubscribe = nil, nil
+}
+
+// check checks the invariants of the current state.
+func (s *simulation) check() error {
+	balances := s.leader.Balances()
+	for id, balance := range balances {
+		if balance < 0 {
+			return fmt.Errorf("account %s balance = %d; want non-negative", id, balance)
+		}
+	}
+	if got := sum(balances); got != s.total {
+		return fmt.Errorf("total balance = %d; want %d", got, s.total)
+	}
+	version := s.leader.Version()
+	if version != len(s.states)-1 {
+		return fmt.Errorf("version = %d; want %d", version, len(s.states)-1)
+	}
+	if expected := s.states[version]; !maps.Equal(balances, expected) {
+		return fmt.Errorf("balances = %v; want %v", balances, expected)
+	}
+
+	// Publishing happens as operations are applied, so with no event in
+	// flight the replica has caught up. Its version may lag behind: the
+	// states rejected operations leave in the leader's history are not
+	// replicated.
+	if s.events != nil && len(s.events) == 0 {
+		if replicated := s.replica.Balances(); !maps.Equal(replicated, balances) {
+			return fmt.Errorf("caught up replica balances = %v; want %v", replicated, balances)
+		}
+	}
+	return nil
+}
+
+// verified replays the journal of sm, failing on any divergence.
+func verified(sm *StateMachine) error {
+	report, err := sm.Verify()
+	if err != nil {
+		return err
+	}
+	if !report.Verified() {
+		return fmt.Errorf("journal diverges: %+v", report.Divergences)
+	}
+	return nil
+}
+
+// sum returns the sum of the balances.
+func sum(accounts map[string]int) int {
+	total := 0
+	for _, balance := range accounts {
+		total += balance
+	}
+	return total
+}
+
+// runSim implements "vaultflow sim": it runs simulated scenarios of
+// operations, crashes and partitions from consecutive seeds, stopping at the
+// first broken invariant, which the seed printed reproduces.
+func runSim(args []string) error {
+	flags := flag.NewFlagSet("sim", flag.ExitOnError)
+	seed := flags.Uint64("seed", uint64(time.Now().UnixNano()), "seed of the first scenario")
+	runs := flags.Int("runs", 1000, "number of scenarios, of consecutive seeds")
+	steps := flags.Int("steps", 200, "steps of each scenario")
+	asJSON := flags.Bool("json", false, "print the report of every scenario as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: vaultflow sim [-seed n] [-runs n] [-steps n]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	var total SimulationReport
+	start := time.Now()
+	enc := json.NewEncoder(os.Stdout)
+	for i := range uint64(max(*runs, 0)) {
+		restore := discardStdout()
+		report, err := RunSimulation(*seed+i, *steps)
+		restore()
+		if err != nil {
+			return fmt.Errorf("%w\nreproduce with: vaultflow sim -seed %d -runs 1 -steps %d", err, *seed+i, *steps)
+		}
+		if *asJSON {
+			if err := enc.Encode(report); err != nil {
+				return err
+			}
+		}
+		total.Steps += report.Steps
+		total.Operations += report.Operations
+		total.Crashes += report.Crashes
+		total.Partitions += report.Partitions
+		total.Torn += report.Torn
+	}
+
+	if !*asJSON {
+		elapsed := time.Since(start)
+		fmt.Printf("%d scenarios from seed %d passed in %s (%.0f/s): %d steps, %d operations, %d crashes, %d partitions, %d torn checkpoints\n",
+			*runs, *seed, elapsed.Round(time.Millisecond), float64(*runs)/elapsed.Seconds(),
+			total.Steps, total.Operations, total.Crashes, total.Partitions, total.Torn)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestRunSimulation(t *testing.T) {
+	quiet(t)
+
+	var total SimulationReport
+	for seed := range uint64(100) {
+		report, err := RunSimulation(seed, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total.Operations += report.Operations
+		total.Rollbacks += report.Rollbacks
+		total.Torn += report.Torn
+		total.Crashes += report.Crashes
+		total.Partitions += report.Partitions
+		total.Resyncs += report.Resyncs
+	}
+
+	// Every kind of step happens across the seeds.
+	if total.Operations == 0 || total.Rollbacks == 0 || total.Torn == 0 || total.Crashes == 0 || total.Partitions == 0 || total.Resyncs == 0 {
+		t.Errorf("Scenarios = %+v; want operations, rollbacks, torn checkpoints, crashes, partitions and resyncs", total)
+	}
+}
+
+func TestRunSimulationReproducible(t *testing.T) {
+	quiet(t)
+
+	first, err := RunSimulation(42, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := RunSimulation(42, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != again || first.Digest == "" {
+		t.Errorf("RunSimulation(42) = %+v, then %+v; want the same scenario", first, again)
+	}
+
+	other, err := RunSimulation(43, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Digest == first.Digest {
+		t.Errorf("seeds 42 and 43 ran the same scenario, digest %s", first.Digest)
+	}
+}
+
+func TestSimulationCheck(t *testing.T) {
+	quiet(t)
+
+	s := &simulation{}
+	s.leader = &StateMachine{accounts: map[string]int{"acc1": 100}}
+	s.states = []map[string]int{{"acc1": 100}}
+	s.total = 100
+	if err := s.check(); err != nil {
+		t.Fatalf("check() of the expected state = %v", err)
+	}
+
+	// Money appearing from nowhere.
+	s.leader.accounts["acc1"] = 150
+	s.leader.storeState()
+	if err := s.check(); err == nil {
+		t.Error("check() of a changed total = nil; want an error")
+	}
+}
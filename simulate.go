@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"maps"
+)
+
+// Simulate applies op to a scratch copy of the current balances and returns
+// the balances it would produce, without touching the state or history of sm.
+// Validation errors are returned exactly as the real operation would, e.g.
+//
+//	balances, err := sm.Simulate(func(s *StateMachine) error {
+//		return s.Transfer("acc1", "acc2", 100)
+//	})
+func (sm *StateMachine) Simulate(op func(scratch *StateMachine) error) (map[string]int, error) {
+	return sm.SimulateContext(context.Background(), op)
+}
+
+// SimulateContext is like Simulate but gives up if ctx is done before the
+// current balances could be read.
+func (sm *StateMachine) SimulateContext(ctx context.Context, op func(scratch *StateMachine) error) (map[string]int, error) {
+	if err := sm.lifecycle.begin(); err != nil {
+		return nil, err
+	}
+	defer sm.lifecycle.end()
+
+	if err := sm.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	scratch := &StateMachine{
+		accounts: maps.Clone(sm.accounts),
+		statuses: maps.Clone(sm.statuses),
+	}
+	sm.mu.Unlock()
+
+	if err := op(scratch); err != nil {
+		return nil, err
+	}
+	return scratch.accounts, nil
+}
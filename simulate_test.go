@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStateMachineSimulate(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000, "acc2": 500},
+	}
+
+	balances, err := sm.Simulate(func(s *StateMachine) error { return s.Transfer("acc1", "acc2", 300) })
+	if err != nil {
+		t.Fatalf("Simulate failed: %v", err)
+	}
+	if balances["acc1"] != 700 || balances["acc2"] != 800 {
+		t.Errorf("Simulated balances = %v; want map[acc1:700 acc2:800]", balances)
+	}
+
+	_, err = sm.Simulate(func(s *StateMachine) error { return s.Withdraw("acc2", 501) })
+	if !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Simulate overdraw = %v; want %v", err, ErrInsufficientBalance)
+	}
+
+	if sm.accounts["acc1"] != 1000 || sm.accounts["acc2"] != 500 {
+		t.Errorf("Balances after Simulate = %v; want them unchanged", sm.accounts)
+	}
+	if sm.history.len() != 0 {
+		t.Errorf("History length after Simulate = %d; want 0", sm.history.len())
+	}
+}
+
+func TestServerDryRun(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 1000, "acc2": 500})
+
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest("POST", "/transfers?dry_run=true", strings.NewReader(`{"from": "acc1", "to": "acc2", "amount": 250}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Dry-run transfer = %d; want %d (%s)", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var resp struct {
+		DryRun   bool           `json:"dry_run"`
+		Balances map[string]int `json:"balances"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !resp.DryRun || resp.Balances["acc1"] != 750 || resp.Balances["acc2"] != 750 {
+		t.Errorf("Dry-run response = %+v; want balances acc1:750 acc2:750", resp)
+	}
+
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest("POST", "/accounts/acc2/withdraw?dry_run=1", strings.NewReader(`{"amount": 600}`)))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("Dry-run overdraw = %d; want %d", rec.Code, http.StatusConflict)
+	}
+
+	if sm.accounts["acc1"] != 1000 || sm.accounts["acc2"] != 500 {
+		t.Errorf("Balances after dry runs = %v; want them unchanged", sm.accounts)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrInvalidSnappy is returned for data snappyDecode cannot decode.
+var ErrInvalidSnappy = errors.New("invalid snappy block")
+
+// snappyMaxOffset is the furthest back snappyEncode copies from, so every
+// copy fits the 2-byte offset form.
+const snappyMaxOffset = 1<<16 - 1
+
+// snappyEncode compresses src in the Snappy block format: the uncompressed
+// length as a uvarint, then literals and copies of earlier bytes. Matches
+// are found with a hash table of 4-byte sequences, which trades ratio for
+// speed as Snappy intends.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+	if len(src) < 4 {
+		return snappyLiteral(dst, src)
+	}
+
+	const tableBits = 14
+	var table [1 << tableBits]int32 // position+1 of the last sequence with each hash
+	hash := func(i int) uint32 {
+		return binary.LittleEndian.Uint32(src[i:]) * 0x1e35a7bd >> (32 - tableBits)
+	}
+
+	literal := 0 // start of the bytes not emitted yet
+	for i := 0; i+4 <= len(src); {
+		h := hash(i)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if candidate < 0 || i-candidate > snappyMaxOffset ||
+			binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = snappyLiteral(dst, src[literal:i])
+		dst = snappyCopy(dst, i-candidate, length)
+		i += length
+		literal = i
+	}
+	return snappyLiteral(dst, src[literal:])
+}
+
+// snappyLiteral appends a literal of lit, if any.
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	switch n := uint64(len(lit) - 1); {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n <= math.MaxUint8:
+		dst = append(dst, 60<<2, byte(n))
+	case n <= math.MaxUint16:
+		dst = binary.LittleEndian.AppendUint16(append(dst, 61<<2), uint16(n))
+	default:
+		dst = binary.LittleEndian.AppendUint32(append(dst, 63<<2), uint32(n))
+	}
+	return append(dst, lit...)
+}
+
+// snappyCopy appends copies of length bytes from offset back, in the 2-byte
+// offset form, which copies at most 64 bytes at a time.
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := min(length, 64)
+		dst = binary.LittleEndian.AppendUint16(append(dst, byte(n-1)<<2|2), uint16(offset))
+		length -= n
+	}
+	return dst
+}
+
+// snappyDecode decompresses a Snappy block, refusing ones that would
+// decompress to more than maxLen bytes.
+func snappyDecode(src []byte, maxLen int) ([]byte, error) {
+	n, header := binary.Uvarint(src)
+	if header <= 0 || n > uint64(maxLen) {
+		return nil, fmt.Errorf("%w: bad or too large length", ErrInvalidSnappy)
+	}
+	src = src[header:]
+	dst := make([]byte, 0, n)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag>>2) + 1
+			src = src[1:]
+			if extra := length - 60; extra > 0 {
+				if len(src) < extra {
+					return nil, fmt.Errorf("%w: truncated literal length", ErrInvalidSnappy)
+				}
+				var l uint64
+				for i := extra - 1; i >= 0; i-- {
+					l = l<<8 | uint64(src[i])
+				}
+				length = int(min(l, math.MaxInt32)) + 1
+				src = src[extra:]
+			}
+			if length > len(src) || uint64(len(dst)+length) > n {
+				return nil, fmt.Errorf("%w: literal of %d bytes overflows", ErrInvalidSnappy, length)
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, fmt.Errorf("%w: truncated copy", ErrInvalidSnappy)
+			}
+			length, offset = int(tag>>2&7)+4, int(tag>>5)<<8|int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, fmt.Errorf("%w: truncated copy", ErrInvalidSnappy)
+			}
+			length, offset = int(tag>>2)+1, int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, fmt.Errorf("%w: truncated copy", ErrInvalidSnappy)
+			}
+			length, offset = int(tag>>2)+1, int(min(binary.LittleEndian.Uint32(src[1:]), math.MaxInt32))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > n {
+			return nil, fmt.Errorf("%w: copy of %d bytes from %d back at %d", ErrInvalidSnappy, length, offset, len(dst))
+		}
+		// Byte by byte, as a copy may overlap the bytes it produces.
+		for range length {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, fmt.Errorf("%w: %d bytes decoded, %d expected", ErrInvalidSnappy, len(dst), n)
+	}
+	return dst, nil
+}
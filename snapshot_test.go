@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStateMachineSnapshot(t *testing.T) {
+	keys, _ := NewKeyring("k1", bytes.Repeat([]byte{7}, 32))
+
+	tests := []struct {
+		name string
+		enc  *Encryptor
+	}{
+		{name: "Plaintext", enc: nil},
+		{name: "Encrypted", enc: NewEncryptor(keys)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{
+				accounts: map[string]int{"acc1": 1000, "acc2": 500},
+			}
+
+			var buf bytes.Buffer
+			if err := sm.WriteSnapshot(&buf, tt.enc); err != nil {
+				t.Fatalf("WriteSnapshot failed: %v", err)
+			}
+			if IsSealed(buf.Bytes()) != (tt.enc != nil) {
+				t.Errorf("IsSealed = %v; want %v", IsSealed(buf.Bytes()), tt.enc != nil)
+			}
+
+			restored := &StateMachine{}
+			if err := restored.ReadSnapshot(bytes.NewReader(buf.Bytes()), tt.enc); err != nil {
+				t.Fatalf("ReadSnapshot failed: %v", err)
+			}
+
+			for acc, expectedBalance := range sm.accounts {
+				if restored.accounts[acc] != expectedBalance {
+					t.Errorf("Account %s balance = %d; want %d", acc, restored.accounts[acc], expectedBalance)
+				}
+			}
+		})
+	}
+}
+
+func TestStateMachineSnapshotRequiresKey(t *testing.T) {
+	keys, _ := NewKeyring("k1", bytes.Repeat([]byte{7}, 32))
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1}}
+
+	var buf bytes.Buffer
+	if err := sm.WriteSnapshot(&buf, NewEncryptor(keys)); err != nil {
+		t.Fatalf("WriteSnapshot failed: %v", err)
+	}
+	if err := sm.ReadSnapshot(&buf, nil); err == nil {
+		t.Errorf("ReadSnapshot of encrypted snapshot without encryptor succeeded")
+	}
+}
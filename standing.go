@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidStandingOrder = errors.New("invalid standing order")
+	ErrUnknownStandingOrder = errors.New("unknown standing order")
+)
+
+// standingOrderInterval is how often the server pays the standing orders
+// that are due.
+const standingOrderInterval = time.Second
+
+// Bounds of the delay before a payment that failed for lack of funds is
+// tried again. It doubles with every attempt.
+const (
+	standingOrderBackoff    = time.Minute
+	maxStandingOrderBackoff = time.Hour
+)
+
+// maxStandingOrderRuns is how many outcomes a standing order keeps.
+const maxStandingOrderRuns = 20
+
+type StandingOrderStatus string
+
+const (
+	StandingOrderPaid     StandingOrderStatus = "paid"
+	StandingOrderRetrying StandingOrderStatus = "retrying" // no funds yet, tried again at RetryAt
+	StandingOrderFailed   StandingOrderStatus = "failed"   // given up until the next payment
+)
+
+// StandingOrder transfers Amount from From to To every Every, starting at
+// Next. A payment failing for lack of funds is tried again with a growing
+// backoff for up to RetryWindow after it was due; then, or right away if it
+// fails for another reason, it is marked failed and the order waits for the
+// next payment.
+type StandingOrder struct {
+	ID          string        `json:"id"`
+	From        string        `json:"from"`
+	To          string        `json:"to"`
+	Amount      int           `json:"amount"`
+	Every       time.Duration `json:"every"`
+	RetryWindow time.Duration `json:"retry_window"`
+	CreatedAt   time.Time     `json:"created_at"`
+	Cancelled   bool          `json:"cancelled"`
+
+	Next     time.Time `json:"next"`     // when the next payment is due
+	Attempts int       `json:"attempts"` // failed attempts of the next payment
+	RetryAt  time.Time `json:"retry_at"` // zero unless the next payment is being retried
+
+	Runs []StandingOrderRun `json:"runs"` // newest last, at most maxStandingOrderRuns
+}
+
+// StandingOrderRun is the outcome of an attempt to make a payment of a
+// standing order, handed to the OnStandingOrder hooks.
+type StandingOrderRun struct {
+	OrderID     string              `json:"order_id"`
+	Due         time.Time           `json:"due"`
+	Attempt     int                 `json:"attempt"` // 1 for the first attempt of the payment
+	Time        time.Time           `json:"time"`
+	Status      StandingOrderStatus `json:"status"`
+	OperationID string              `json:"operation_id,omitempty"` // of the transfer, once paid
+	RetryAt     time.Time           `json:"retry_at"`               // zero unless retrying
+	Error       string              `json:"error,omitempty"`
+}
+
+// due reports whether a payment of the order should be attempted at now.
+func (o *StandingOrder) due(now time.Time) bool {
+	if o.Cancelled {
+		return false
+	}
+	if !o.RetryAt.IsZero() {
+		return !now.Before(o.RetryAt)
+	}
+	return !now.Before(o.Next)
+}
+
+func (o *StandingOrder) clone() StandingOrder {
+	c := *o
+	c.Runs = slices.Clone(o.Runs)
+	return c
+}
+
+// standingOrders holds every standing order, in the order they were
+// created. Its lock is never held while taking the state lock; run
+// serialises the payments.
+type standingOrders struct {
+	mu    sync.Mutex
+	run   sync.Mutex
+	byID  map[string]*StandingOrder
+	order []string
+}
+
+func (so *standingOrders) add(o StandingOrder) {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	if so.byID == nil {
+		so.byID = map[string]*StandingOrder{}
+	}
+	so.byID[o.ID] = &o
+	so.order = append(so.order, o.ID)
+}
+
+// list returns every standing order, oldest first.
+func (so *standingOrders) list() []StandingOrder {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	list := make([]StandingOrder, 0, len(so.order))
+	for _, id := range so.order {
+		list = append(list, so.byID[id].clone())
+	}
+	return list
+}
+
+// restore replaces the standing orders with list.
+func (so *standingOrders) restore(list []StandingOrder) {
+	so.mu.Lock()
+	so.byID, so.order = nil, nil
+	so.mu.Unlock()
+	for _, o := range list {
+		so.add(o)
+	}
+}
+
+// CreateStandingOrder sets up a recurring transfer, first due at start, or
+// right away if start is zero. As payments are made unattended they cannot
+// wait for an approval or signatures, so orders above the approval
+// threshold or from an account with signers are refused.
+func (sm *StateMachine) CreateStandingOrder(from, to string, amount int, every time.Duration, start time.Time, retryWindow time.Duration) (StandingOrder, error) {
+	if from == "" || to == "" || from == to || amount <= 0 {
+		return StandingOrder{}, fmt.Errorf("%w: a standing order needs a payer, another payee and a positive amount", ErrInvalidStandingOrder)
+	}
+	if every <= 0 || retryWindow < 0 || retryWindow >= every {
+		return StandingOrder{}, fmt.Errorf("%w: every (%s) must be positive and longer than the retry window (%s)", ErrInvalidStandingOrder, every, retryWindow)
+	}
+	op := Operation{Type: OpTransfer, From: from, To: to, Amount: amount}
+	if err := op.Validate(); err != nil {
+		return StandingOrder{}, err
+	}
+	if err := checkEscrowAccounts(context.Background(), op); err != nil {
+		return StandingOrder{}, err
+	}
+	if a := sm.approvals.Load(); a != nil && a.above(amount) {
+		return StandingOrder{}, fmt.Errorf("%w: payments above %d cannot wait for approval", ErrInvalidStandingOrder, a.threshold.Load())
+	}
+	if err := sm.checkSignatures(context.Background(), op); err != nil {
+		return StandingOrder{}, err
+	}
+	for _, id := range op.accounts() {
+		if _, err := sm.Balance(id); err != nil {
+			return StandingOrder{}, err
+		}
+	}
+
+	now := sm.now()
+	if start.IsZero() {
+		start = now
+	}
+	o := StandingOrder{
+		ID:          sm.ids.next(now),
+		From:        from,
+		To:          to,
+		Amount:      amount,
+		Every:       every,
+		RetryWindow: retryWindow,
+		CreatedAt:   now,
+		Next:        start,
+	}
+	sm.standingOrders.add(o)
+
+	fmt.Printf("\n\nStanding order %s: %d from account %s to account %s every %s\n", o.ID, amount, from, to, every)
+	return o.clone(), nil
+}
+
+// StandingOrder returns the standing order with the given ID.
+func (sm *StateMachine) StandingOrder(id string) (StandingOrder, error) {
+	sm.standingOrders.mu.Lock()
+	defer sm.standingOrders.mu.Unlock()
+
+	o, ok := sm.standingOrders.byID[id]
+	if !ok {
+		return StandingOrder{}, fmt.Errorf("%w (%s)", ErrUnknownStandingOrder, id)
+	}
+	return o.clone(), nil
+}
+
+// StandingOrders returns every standing order, oldest first.
+func (sm *StateMachine) StandingOrders() []StandingOrder {
+	return sm.standingOrders.list()
+}
+
+// CancelStandingOrder stops a standing order: no payment is attempted after
+// it returns, though one in progress may still complete. Cancelled orders
+// are kept with their outcomes.
+func (sm *StateMachine) CancelStandingOrder(id string) (StandingOrder, error) {
+	sm.standingOrders.mu.Lock()
+	defer sm.standingOrders.mu.Unlock()
+
+	o, ok := sm.standingOrders.byID[id]
+	if !ok {
+		return StandingOrder{}, fmt.Errorf("%w (%s)", ErrUnknownStandingOrder, id)
+	}
+	o.Cancelled, o.RetryAt = true, time.Time{}
+	return o.clone(), nil
+}
+
+// PayStandingOrders attempts the payments of the standing orders that are
+// due, including those missed while the server was down, and returns their
+// outcomes. Each outcome is also handed to the OnStandingOrder hooks.
+func (sm *StateMachine) PayStandingOrders(ctx context.Context) []StandingOrderRun {
+	sm.standingOrders.run.Lock()
+	defer sm.standingOrders.run.Unlock()
+
+	var runs []StandingOrderRun
+	for _, o := range sm.standingOrders.list() {
+		for o.due(sm.now()) {
+			run, ok := sm.payStandingOrder(ctx, o)
+			if !ok {
+				return runs
+			}
+			runs = append(runs, run)
+
+			var err error
+			if o, err = sm.StandingOrder(o.ID); err != nil {
+				break
+			}
+		}
+	}
+	return runs
+}
+
+// payStandingOrder attempts the next payment of o and records its outcome.
+// It records nothing and returns false if the attempt was cut short by ctx
+// or by the state machine closing.
+func (sm *StateMachine) payStandingOrder(ctx context.Context, o StandingOrder) (StandingOrderRun, bool) {
+	run := StandingOrderRun{OrderID: o.ID, Due: o.Next, Attempt: o.Attempts + 1}
+
+	// The payment runs as a transaction so it fails rather than being
+	// parked for an approval or signatures.
+	var paid *Tx
+	err := sm.TxContext(ctx, func(tx *Tx) error {
+		paid = tx
+		return tx.Apply(Operation{
+			Type:     OpTransfer,
+			From:     o.From,
+			To:       o.To,
+			Amount:   o.Amount,
+			Memo:     "standing order " + o.ID,
+			Metadata: map[string]string{"standing_order": o.ID},
+		})
+	})
+	if err != nil && (ctx.Err() != nil || errors.Is(err, ErrClosed)) {
+		return run, false
+	}
+	now := sm.now()
+	run.Time = now
+
+	sm.standingOrders.mu.Lock()
+	current, ok := sm.standingOrders.byID[o.ID]
+	if !ok { // restored meanwhile
+		sm.standingOrders.mu.Unlock()
+		return run, false
+	}
+	switch {
+	case err == nil:
+		run.Status, run.OperationID = StandingOrderPaid, paid.ops[0].ID
+	case errors.Is(err, ErrInsufficientBalance) && now.Before(o.Next.Add(o.RetryWindow)):
+		backoff := min(standingOrderBackoff<<min(o.Attempts, 16), maxStandingOrderBackoff)
+		run.Status, run.RetryAt, run.Error = StandingOrderRetrying, now.Add(backoff), err.Error()
+		if deadline := o.Next.Add(o.RetryWindow); run.RetryAt.After(deadline) {
+			run.RetryAt = deadline
+		}
+	default:
+		run.Status, run.Error = StandingOrderFailed, err.Error()
+	}
+	if run.Status == StandingOrderRetrying {
+		current.Attempts, current.RetryAt = run.Attempt, run.RetryAt
+	} else {
+		current.Next, current.Attempts, current.RetryAt = o.Next.Add(o.Every), 0, time.Time{}
+	}
+	if current.Cancelled {
+		current.RetryAt = time.Time{}
+	}
+	current.Runs = append(current.Runs, run)
+	if len(current.Runs) > maxStandingOrderRuns {
+		current.Runs = slices.Delete(current.Runs, 0, len(current.Runs)-maxStandingOrderRuns)
+	}
+	sm.standingOrders.mu.Unlock()
+
+	fmt.Printf("\n\nStanding order %s payment due at %s %s\n", o.ID, run.Due.Format(time.RFC3339), run.Status)
+	sm.runStandingOrderHooks(ctx, run)
+	return run, true
+}
+
+// RunStandingOrders calls PayStandingOrders every interval until ctx is
+// done.
+func (sm *StateMachine) RunStandingOrders(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sm.PayStandingOrders(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStandingOrder(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	start := clock.Now()
+	sm := &StateMachine{accounts: map[string]int{"payer": 50, "payee": 0}}
+	sm.UseClock(clock)
+	var notified []StandingOrderRun
+	sm.RegisterHooks(Hooks{OnStandingOrder: func(ctx context.Context, run StandingOrderRun) {
+		notified = append(notified, run)
+	}})
+
+	o, err := sm.CreateStandingOrder("payer", "payee", 100, 24*time.Hour, time.Time{}, 3*time.Hour)
+	if err != nil {
+		t.Fatalf("CreateStandingOrder() error = %v", err)
+	}
+
+	tests := []struct {
+		name            string
+		advance         time.Duration
+		deposit         int
+		expectedRuns    []StandingOrderStatus
+		expectedPayee   int
+		expectedNext    time.Time
+		expectedRetryAt time.Time
+	}{
+		{"Insufficient funds", 0, 0, []StandingOrderStatus{StandingOrderRetrying}, 0, start, start.Add(time.Minute)},
+		{"Not yet retried", 30 * time.Second, 0, nil, 0, start, start.Add(time.Minute)},
+		{"Backoff doubles", 30 * time.Second, 0, []StandingOrderStatus{StandingOrderRetrying}, 0, start, start.Add(3 * time.Minute)},
+		{"Paid on retry", 2 * time.Minute, 100, []StandingOrderStatus{StandingOrderPaid}, 100, start.Add(24 * time.Hour), time.Time{}},
+		{"Missed payments", 48 * time.Hour, 200, []StandingOrderStatus{StandingOrderPaid, StandingOrderPaid}, 300, start.Add(72 * time.Hour), time.Time{}},
+		{"Retried until the window ends", 24 * time.Hour, 0, []StandingOrderStatus{StandingOrderRetrying}, 300, start.Add(72 * time.Hour), start.Add(72*time.Hour + 4*time.Minute)},
+		{"Given up", 3 * time.Hour, 0, []StandingOrderStatus{StandingOrderFailed}, 300, start.Add(96 * time.Hour), time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock.Advance(tt.advance)
+			if tt.deposit > 0 {
+				if err := sm.Deposit("payer", tt.deposit); err != nil {
+					t.Fatal(err)
+				}
+			}
+			notified = nil
+
+			runs := sm.PayStandingOrders(context.Background())
+			if len(runs) != len(tt.expectedRuns) || len(notified) != len(runs) {
+				t.Fatalf("PayStandingOrders() = %+v, notified %d; want %v", runs, len(notified), tt.expectedRuns)
+			}
+			for i, run := range runs {
+				if run.Status != tt.expectedRuns[i] || (run.Status == StandingOrderPaid) != (run.OperationID != "") {
+					t.Errorf("Run %d = %+v; want %s", i, run, tt.expectedRuns[i])
+				}
+			}
+			if balance, _ := sm.Balance("payee"); balance != tt.expectedPayee {
+				t.Errorf("Payee balance = %d; want %d", balance, tt.expectedPayee)
+			}
+			got, _ := sm.StandingOrder(o.ID)
+			if !got.Next.Equal(tt.expectedNext) || !got.RetryAt.Equal(tt.expectedRetryAt) {
+				t.Errorf("Next, RetryAt = %s, %s; want %s, %s", got.Next, got.RetryAt, tt.expectedNext, tt.expectedRetryAt)
+			}
+		})
+	}
+
+	if ops := sm.OperationsWithMetadata(map[string]string{"standing_order": o.ID}); len(ops) != 3 {
+		t.Errorf("Standing order operations = %+v; want the 3 payments", ops)
+	}
+}
+
+func TestCancelStandingOrder(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"payer": 1000, "payee": 0}}
+	sm.UseClock(clock)
+	o, _ := sm.CreateStandingOrder("payer", "payee", 100, time.Hour, clock.Now().Add(time.Hour), 0)
+
+	if _, err := sm.CancelStandingOrder(o.ID); err != nil {
+		t.Fatalf("CancelStandingOrder() error = %v", err)
+	}
+	clock.Advance(2 * time.Hour)
+	if runs := sm.PayStandingOrders(context.Background()); len(runs) != 0 {
+		t.Errorf("PayStandingOrders() = %+v; want nothing paid", runs)
+	}
+	if _, err := sm.CancelStandingOrder("nope"); !errors.Is(err, ErrUnknownStandingOrder) {
+		t.Errorf("CancelStandingOrder() of an unknown order error = %v; want ErrUnknownStandingOrder", err)
+	}
+}
+
+func TestCreateStandingOrderInvalid(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name        string
+		from, to    string
+		amount      int
+		every       time.Duration
+		retryWindow time.Duration
+		expectedErr error
+	}{
+		{"Zero amount", "payer", "payee", 0, time.Hour, 0, ErrInvalidStandingOrder},
+		{"Same account", "payer", "payer", 10, time.Hour, 0, ErrInvalidStandingOrder},
+		{"No interval", "payer", "payee", 10, 0, 0, ErrInvalidStandingOrder},
+		{"Retry window as long as the interval", "payer", "payee", 10, time.Hour, time.Hour, ErrInvalidStandingOrder},
+		{"Unknown payee", "payer", "nobody", 10, time.Hour, 0, ErrInvalidAccount},
+		{"From an escrow", "escrow:x", "payee", 10, time.Hour, 0, ErrEscrowAccount},
+		{"Above the approval threshold", "payer", "payee", 600, time.Hour, 0, ErrInvalidStandingOrder},
+		{"From an account with signers", "joint", "payee", 10, time.Hour, 0, ErrSignaturesRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"payer": 1000, "payee": 0, "joint": 1000}}
+			sm.RequireApproval(500, time.Hour)
+			if err := sm.RequireSignatures("joint", SignerSet{Signers: []string{"alice", "bob"}, Required: 2}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sm.CreateStandingOrder(tt.from, tt.to, tt.amount, tt.every, time.Time{}, tt.retryWindow); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("CreateStandingOrder() error = %v; want %v", err, tt.expectedErr)
+			}
+			if orders := sm.StandingOrders(); len(orders) != 0 {
+				t.Errorf("StandingOrders() = %+v; want none", orders)
+			}
+		})
+	}
+}
+
+func TestStandingOrderSnapshot(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"payer": 1000, "payee": 0}}
+	sm.UseClock(clock)
+	o, _ := sm.CreateStandingOrder("payer", "payee", 100, time.Hour, time.Time{}, 0)
+	sm.PayStandingOrders(context.Background())
+	var buf bytes.Buffer
+	if err := sm.WriteSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := &StateMachine{}
+	restored.UseClock(clock)
+	if err := restored.ReadSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := restored.StandingOrder(o.ID)
+	if err != nil {
+		t.Fatalf("StandingOrder() after restoring error = %v", err)
+	}
+	if len(got.Runs) != 1 || !got.Next.Equal(o.Next.Add(time.Hour)) {
+		t.Fatalf("Restored standing order = %+v; want one payment made", got)
+	}
+	clock.Advance(time.Hour)
+	if runs := restored.PayStandingOrders(context.Background()); len(runs) != 1 || runs[0].Status != StandingOrderPaid {
+		t.Errorf("PayStandingOrders() after restoring = %+v; want the next payment", runs)
+	}
+}
+
+func TestServerStandingOrders(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"payer": 1000, "payee": 0})
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+
+	rec := do(http.MethodPost, "/standing-orders", `{"from": "payer", "to": "payee", "amount": 100, "every": "24h", "retry_window": "1h"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST /standing-orders = %d; want 201 (%s)", rec.Code, rec.Body)
+	}
+	var created StandingOrder
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Every != 24*time.Hour || created.RetryWindow != time.Hour {
+		t.Errorf("POST /standing-orders = %+v; want a daily order", created)
+	}
+	sm.PayStandingOrders(context.Background())
+
+	tests := []struct {
+		name           string
+		method, path   string
+		body           string
+		expectedStatus int
+	}{
+		{"Bad interval", http.MethodPost, "/standing-orders", `{"from": "payer", "to": "payee", "amount": 100, "every": "daily"}`, http.StatusBadRequest},
+		{"Retry window too long", http.MethodPost, "/standing-orders", `{"from": "payer", "to": "payee", "amount": 100, "every": "1h", "retry_window": "2h"}`, http.StatusBadRequest},
+		{"Unknown account", http.MethodPost, "/standing-orders", `{"from": "payer", "to": "nobody", "amount": 100, "every": "1h"}`, http.StatusNotFound},
+		{"List", http.MethodGet, "/standing-orders", "", http.StatusOK},
+		{"Get", http.MethodGet, "/standing-orders/" + created.ID, "", http.StatusOK},
+		{"Unknown", http.MethodGet, "/standing-orders/nope", "", http.StatusNotFound},
+		{"Cancel", http.MethodDelete, "/standing-orders/" + created.ID, "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := do(tt.method, tt.path, tt.body); rec.Code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+		})
+	}
+
+	if balance, _ := sm.Balance("payee"); balance != 100 {
+		t.Errorf("Payee balance = %d; want 100", balance)
+	}
+	if o, _ := sm.StandingOrder(created.ID); !o.Cancelled || len(o.Runs) != 1 {
+		t.Errorf("Standing order = %+v; want cancelled after one payment", o)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// stateShards is the number of shards of a State. A commit copies the
+// shards of the accounts it changed, about 1/stateShards of the accounts
+// each.
+const stateShards = 64
+
+// State is an immutable copy of the balances, published by every operation
+// that changes them, so reads never wait for the state lock: a reader
+// loads the current State and keeps reading it while writers publish newer
+// ones. Reads of a single State are consistent with each other.
+type State struct {
+	shards   [stateShards]map[string]int // balances of accounts, not buckets
+	archived map[string]bool             // shared between states until it changes
+	version  int
+
+	hashOnce sync.Once
+	hash     string
+}
+
+func shardOf(accountId string) int {
+	h := fnv.New32a()
+	h.Write([]byte(accountId))
+	return int(h.Sum32() % stateShards)
+}
+
+// newState returns a State of accounts.
+func newState(accounts map[string]int, archived map[string]ArchivedAccount) *State {
+	s := &State{archived: map[string]bool{}}
+	for i := range s.shards {
+		s.shards[i] = map[string]int{}
+	}
+	for id, balance := range accounts {
+		if !isBucketKey(id) {
+			s.shards[shardOf(id)][id] = balance
+		}
+	}
+	for id := range archived {
+		s.archived[id] = true
+	}
+	return s
+}
+
+// with returns a copy of s with the balances of the accounts ids as they
+// are in accounts, sharing the shards none of them is in.
+func (s *State) with(accounts map[string]int, archived map[string]ArchivedAccount, ids ...string) *State {
+	next := &State{shards: s.shards, archived: s.archived, version: s.version}
+	copied, archivedCopied := map[int]bool{}, false
+	for _, id := range ids {
+		if isBucketKey(id) {
+			continue
+		}
+		i := shardOf(id)
+		if !copied[i] {
+			next.shards[i] = maps.Clone(s.shards[i])
+			copied[i] = true
+		}
+		if balance, ok := accounts[id]; ok {
+			next.shards[i][id] = balance
+		} else {
+			delete(next.shards[i], id)
+		}
+		if _, ok := archived[id]; ok != s.archived[id] {
+			if !archivedCopied {
+				next.archived = maps.Clone(s.archived)
+				archivedCopied = true
+			}
+			if ok {
+				next.archived[id] = true
+			} else {
+				delete(next.archived, id)
+			}
+		}
+	}
+	return next
+}
+
+// Version returns the version of the state, see StateMachine.Version.
+func (s *State) Version() int {
+	return s.version
+}
+
+// Balance returns the balance of an account.
+func (s *State) Balance(accountId string) (int, error) {
+	if s.archived[accountId] {
+		return 0, fmt.Errorf("%w (%s)", ErrAccountArchived, accountId)
+	}
+	balance, ok := s.shards[shardOf(accountId)][accountId]
+	if !ok {
+		return 0, fmt.Errorf("%w (%s)", ErrInvalidAccount, accountId)
+	}
+	return balance, nil
+}
+
+// Balances returns a copy of every balance.
+func (s *State) Balances() map[string]int {
+	n := 0
+	for _, shard := range s.shards {
+		n += len(shard)
+	}
+	balances := make(map[string]int, n)
+	for _, shard := range s.shards {
+		maps.Copy(balances, shard)
+	}
+	return balances
+}
+
+// Hash returns a SHA-256 of every account and its balance, hex encoded, the
+// same for equal balances whatever history led to them. It is computed on
+// first use.
+func (s *State) Hash() string {
+	s.hashOnce.Do(func() {
+		balances := s.Balances()
+		h := sha256.New()
+		for _, id := range slices.Sorted(maps.Keys(balances)) {
+			h.Write([]byte(id))
+			h.Write([]byte{'='})
+			h.Write(strconv.AppendInt(nil, int64(balances[id]), 10))
+			h.Write([]byte{'\n'})
+		}
+		s.hash = hex.EncodeToString(h.Sum(nil))
+	})
+	return s.hash
+}
+
+// State returns the current state. It only waits for the state lock if no
+// operation has published a state yet.
+func (sm *StateMachine) State() *State {
+	if s := sm.state.Load(); s != nil {
+		return s
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if s := sm.state.Load(); s != nil {
+		return s
+	}
+	return sm.storeState()
+}
+
+// lockedBalance is Balance with FlagStateReads off.
+func (sm *StateMachine) lockedBalance(accountId string) (int, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	balance, ok := sm.accounts[accountId]
+	if _, archived := sm.archived[accountId]; archived {
+		return 0, fmt.Errorf("%w (%s)", ErrAccountArchived, accountId)
+	}
+	if !ok || isBucketKey(accountId) {
+		return 0, fmt.Errorf("%w (%s)", ErrInvalidAccount, accountId)
+	}
+	return balance, nil
+}
+
+// lockedBalances is Balances with FlagStateReads off.
+func (sm *StateMachine) lockedBalances() map[string]int {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	balances := maps.Clone(sm.accounts)
+	maps.DeleteFunc(balances, func(id string, _ int) bool { return isBucketKey(id) })
+	return balances
+}
+
+// StateHash returns the Hash of the current state, so replicas or backups
+// can be compared with the leader without comparing every balance.
+func (sm *StateMachine) StateHash() string {
+	return sm.State().Hash()
+}
+
+// storeState publishes a State of the current balances and returns it.
+// sm.mu must be held.
+func (sm *StateMachine) storeState() *State {
+	s := newState(sm.accounts, sm.archived)
+	s.version = sm.version
+	sm.state.Store(s)
+	return s
+}
+
+// updateState publishes a State with the new balances of the accounts ids,
+// or of every account if no State was published yet. sm.mu must be held.
+func (sm *StateMachine) updateState(ids ...string) {
+	if s := sm.state.Load(); s != nil {
+		next := s.with(sm.accounts, sm.archived, ids...)
+		next.version = sm.version
+		sm.state.Store(next)
+	} else {
+		sm.storeState()
+	}
+}
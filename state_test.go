@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"reflect"
+	"testing"
+)
+
+// TestStateFollowsOperations checks that the published state holds the
+// balances left by every kind of change.
+func TestStateFollowsOperations(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 50}}
+	before := sm.State()
+
+	tests := []struct {
+		name string
+		fn   func() error
+	}{
+		{"Deposit", func() error { return sm.Deposit("acc1", 25) }},
+		{"Transfer", func() error { return sm.Transfer("acc1", "acc2", 75) }},
+		{"Open", func() error { return sm.OpenAccount("acc3", 10) }},
+		{"Tx", func() error {
+			return sm.Tx(func(tx *Tx) error {
+				if err := tx.Withdraw("acc2", 5); err != nil {
+					return err
+				}
+				return tx.Deposit("acc3", 5)
+			})
+		}},
+		{"Rollback", func() error { return sm.Rollback() }},
+		{"RollbackTo", func() error { return sm.RollbackTo(1) }},
+		{"Archive", func() error {
+			if err := sm.OpenAccount("acc4", 0); err != nil {
+				return err
+			}
+			return sm.ArchiveAccount("acc4")
+		}},
+		{"Unarchive", func() error { return sm.UnarchiveAccount("acc4") }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fn(); err != nil {
+				t.Fatal(err)
+			}
+			sm.mu.Lock()
+			expected := maps.Clone(sm.accounts)
+			maps.DeleteFunc(expected, func(id string, _ int) bool { return isBucketKey(id) })
+			sm.mu.Unlock()
+
+			if balances := sm.State().Balances(); !reflect.DeepEqual(balances, expected) {
+				t.Errorf("State().Balances() = %v; want %v", balances, expected)
+			}
+		})
+	}
+
+	if balance, _ := before.Balance("acc1"); balance != 100 {
+		t.Errorf("Balance() of an earlier state = %d; want 100, as it was then", balance)
+	}
+}
+
+func TestStateArchived(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 0}}
+	sm.State()
+	if err := sm.ArchiveAccount("acc1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sm.Balance("acc1"); !errors.Is(err, ErrAccountArchived) {
+		t.Errorf("Balance() of an archived account error = %v; want ErrAccountArchived", err)
+	}
+	if _, err := sm.Balance("acc2"); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("Balance() of an unknown account error = %v; want ErrInvalidAccount", err)
+	}
+}
+
+// TestStateReadsDoNotWait reads balances while the state lock is held, which
+// would deadlock if reads took it.
+func TestStateReadsDoNotWait(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	if err := sm.Deposit("acc1", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if balance, err := sm.Balance("acc1"); err != nil || balance != 110 {
+		t.Errorf("Balance() = %d, %v; want 110", balance, err)
+	}
+	if balances := sm.Balances(); balances["acc1"] != 110 {
+		t.Errorf("Balances() = %v; want acc1 at 110", balances)
+	}
+}
+
+func TestStateHash(t *testing.T) {
+	quiet(t)
+
+	sm1 := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 50}}
+	sm2 := &StateMachine{accounts: map[string]int{"acc1": 50, "acc2": 100}}
+	if sm1.StateHash() == sm2.StateHash() {
+		t.Fatal("StateHash() of different balances is equal")
+	}
+
+	// Different histories leading to the same balances.
+	if err := sm1.Transfer("acc1", "acc2", 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm2.Deposit("acc2", 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm2.Withdraw("acc2", 50); err != nil {
+		t.Fatal(err)
+	}
+	if sm1.StateHash() != sm2.StateHash() {
+		t.Errorf("StateHash() = %s, %s; want equal hashes of equal balances", sm1.StateHash(), sm2.StateHash())
+	}
+}
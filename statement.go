@@ -0,0 +1,397 @@
+package main
+
+import (
+	"cmp"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatementFormat is the banking interchange format statements are written
+// in, see Statement.Write.
+type StatementFormat string
+
+const (
+	StatementOFX     StatementFormat = "ofx"     // OFX 2.2 bank statement
+	StatementCAMT053 StatementFormat = "camt053" // ISO 20022 camt.053.001.02
+)
+
+// noCurrency is the ISO 4217 code of transactions without a currency.
+const noCurrency = "XXX"
+
+// ParseStatementFormat parses the name of a statement format.
+func ParseStatementFormat(name string) (StatementFormat, error) {
+	switch f := StatementFormat(name); f {
+	case StatementOFX, StatementCAMT053:
+		return f, nil
+	}
+	return "", fmt.Errorf("%w: %q, want ofx or camt053", ErrInvalidExportFormat, name)
+}
+
+// StatementOptions select the period of a statement and how its amounts
+// are written.
+type StatementOptions struct {
+	Since time.Time // zero means since the start of history
+	Until time.Time // exclusive, zero means up to now
+
+	// Currency is the ISO 4217 code amounts are in, XXX if empty, and
+	// Scale the number of their decimals vaultflow's integer amounts hold,
+	// e.g. 2 when they count cents.
+	Currency string
+	Scale    int
+}
+
+// Statement is the activity of an account over a period, with its opening
+// and closing balances.
+type Statement struct {
+	Account  string           `json:"account"`
+	Since    time.Time        `json:"since"`
+	Until    time.Time        `json:"until"`
+	Created  time.Time        `json:"created"`
+	Opening  int              `json:"opening"`
+	Closing  int              `json:"closing"`
+	Entries  []StatementEntry `json:"entries"`
+	Currency string           `json:"currency"`
+	Scale    int              `json:"scale"`
+}
+
+// StatementEntry is an operation that changed the balance of the account of
+// a statement by Amount, negative for debits, leaving Balance.
+type StatementEntry struct {
+	Operation Operation `json:"operation"`
+	Amount    int       `json:"amount"`
+	Balance   int       `json:"balance"`
+}
+
+// Statement returns the statement of an account over a period, for
+// accounting software to ingest once written with Write. Entries are the
+// operations that moved funds in or out of the available balance of the
+// account: openings, deposits, withdrawals, transfers and moves between
+// its buckets. The opening balance is the balance at Since, which must
+// still be in history; the closing balance is the opening balance plus the
+// entries, so a rollback in the period of an operation applied before it is
+// not reflected.
+func (sm *StateMachine) Statement(accountId string, opts StatementOptions) (Statement, error) {
+	if _, err := sm.Balance(accountId); err != nil {
+		return Statement{}, err
+	}
+	now := sm.now().UTC()
+	s := Statement{
+		Account:  accountId,
+		Since:    opts.Since,
+		Until:    cmp.Or(opts.Until, now),
+		Created:  now,
+		Currency: cmp.Or(opts.Currency, noCurrency),
+		Scale:    opts.Scale,
+	}
+	if !s.Since.IsZero() && !s.Since.Before(s.Until) || s.Scale < 0 {
+		return Statement{}, fmt.Errorf("%w: statement from %s until %s with scale %d", ErrInvalidOperation, s.Since, s.Until, s.Scale)
+	}
+
+	if !s.Since.IsZero() {
+		opening, err := sm.BalanceAtTime(accountId, s.Since)
+		switch {
+		case errors.Is(err, ErrInvalidAccount):
+			// Opened in the period.
+		case err != nil:
+			return Statement{}, err
+		}
+		s.Opening = opening
+	}
+
+	s.Closing = s.Opening
+	s.Entries = []StatementEntry{}
+	for _, op := range sm.SearchOperations(OperationFilter{Account: accountId, Since: opts.Since, Until: opts.Until}) {
+		if amount := statementAmount(op, accountId); amount != 0 {
+			s.Closing += amount
+			s.Entries = append(s.Entries, StatementEntry{Operation: op, Amount: amount, Balance: s.Closing})
+		}
+	}
+	return s, nil
+}
+
+// statementAmount returns how much op changed the available balance of an
+// account.
+func statementAmount(op Operation, accountId string) int {
+	from, to := op.From, op.To
+	switch op.Type {
+	case OpOpen, OpDeposit, OpWithdraw, OpTransfer:
+	case OpMove:
+		to = op.From
+	default:
+		return 0
+	}
+
+	amount := 0
+	if from == accountId && bucketName(op.FromBucket) == BucketAvailable {
+		amount -= op.Amount
+	}
+	if to == accountId && bucketName(op.ToBucket) == BucketAvailable {
+		amount += op.Amount
+	}
+	return amount
+}
+
+// Write writes the statement in format.
+func (s Statement) Write(w io.Writer, format StatementFormat) error {
+	var doc any
+	header := xml.Header
+	switch format {
+	case StatementOFX:
+		doc = s.ofx()
+		header += `<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n"
+	case StatementCAMT053:
+		doc = s.camt053()
+	default:
+		_, err := ParseStatementFormat(string(format))
+		return err
+	}
+
+	if _, err := io.WriteString(w, header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// decimal formats an amount with the decimals of the statement, unsigned if
+// abs.
+func (s Statement) decimal(amount int, abs bool) string {
+	sign := ""
+	if amount < 0 {
+		amount = -amount
+		if !abs {
+			sign = "-"
+		}
+	}
+	digits := strconv.Itoa(amount)
+	if s.Scale == 0 {
+		return sign + digits
+	}
+	if len(digits) <= s.Scale {
+		digits = strings.Repeat("0", s.Scale-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-s.Scale] + "." + digits[len(digits)-s.Scale:]
+}
+
+// start returns when the statement starts: Since, or if it has none, when
+// its first entry was applied.
+func (s Statement) start() time.Time {
+	switch {
+	case !s.Since.IsZero():
+		return s.Since
+	case len(s.Entries) > 0:
+		return s.Entries[0].Operation.Time
+	}
+	return s.Until
+}
+
+// counterparty returns the other account of a transfer of the statement's
+// account, if any.
+func (s Statement) counterparty(op Operation) string {
+	switch {
+	case op.Type != OpTransfer:
+		return ""
+	case op.From == s.Account:
+		return op.To
+	}
+	return op.From
+}
+
+type ofxStatus struct {
+	Code     int    `xml:"CODE"`
+	Severity string `xml:"SEVERITY"`
+}
+
+type ofxTransaction struct {
+	Type   string `xml:"TRNTYPE"`
+	Posted string `xml:"DTPOSTED"`
+	Amount string `xml:"TRNAMT"`
+	FITID  string `xml:"FITID"`
+	Name   string `xml:"NAME,omitempty"`
+	Memo   string `xml:"MEMO,omitempty"`
+}
+
+type ofxDocument struct {
+	XMLName xml.Name `xml:"OFX"`
+	Signon  struct {
+		Status   ofxStatus `xml:"SONRS>STATUS"`
+		Server   string    `xml:"SONRS>DTSERVER"`
+		Language string    `xml:"SONRS>LANGUAGE"`
+	} `xml:"SIGNONMSGSRSV1"`
+	Response struct {
+		TrnUID   string    `xml:"TRNUID"`
+		Status   ofxStatus `xml:"STATUS"`
+		Currency string    `xml:"STMTRS>CURDEF"`
+		Account  struct {
+			BankID string `xml:"BANKID"`
+			ID     string `xml:"ACCTID"`
+			Type   string `xml:"ACCTTYPE"`
+		} `xml:"STMTRS>BANKACCTFROM"`
+		Start        string           `xml:"STMTRS>BANKTRANLIST>DTSTART"`
+		End          string           `xml:"STMTRS>BANKTRANLIST>DTEND"`
+		Transactions []ofxTransaction `xml:"STMTRS>BANKTRANLIST>STMTTRN"`
+		Balance      string           `xml:"STMTRS>LEDGERBAL>BALAMT"`
+		AsOf         string           `xml:"STMTRS>LEDGERBAL>DTASOF"`
+	} `xml:"BANKMSGSRSV1>STMTTRNRS"`
+}
+
+// ofxTime formats t as an OFX date and time.
+func ofxTime(t time.Time) string {
+	return t.UTC().Format("20060102150405.000") + "[0:GMT]"
+}
+
+func (s Statement) ofx() ofxDocument {
+	var doc ofxDocument
+	doc.Signon.Status = ofxStatus{Severity: "INFO"}
+	doc.Signon.Server = ofxTime(s.Created)
+	doc.Signon.Language = "ENG"
+
+	r := &doc.Response
+	r.TrnUID = "0"
+	r.Status = ofxStatus{Severity: "INFO"}
+	r.Currency = s.Currency
+	r.Account.BankID = changeSourceName
+	r.Account.ID = s.Account
+	r.Account.Type = "CHECKING"
+	r.Start = ofxTime(s.start())
+	r.End = ofxTime(s.Until)
+	for _, e := range s.Entries {
+		t := ofxTransaction{
+			Posted: ofxTime(e.Operation.Time),
+			Amount: s.decimal(e.Amount, false),
+			FITID:  e.Operation.ID,
+			Name:   s.counterparty(e.Operation),
+			Memo:   e.Operation.Memo,
+		}
+		switch {
+		case e.Operation.Type == OpTransfer:
+			t.Type = "XFER"
+		case e.Operation.Type == OpDeposit:
+			t.Type = "DEP"
+		case e.Amount > 0:
+			t.Type = "CREDIT"
+		default:
+			t.Type = "DEBIT"
+		}
+		r.Transactions = append(r.Transactions, t)
+	}
+	r.Balance = s.decimal(s.Closing, false)
+	r.AsOf = ofxTime(s.Until)
+	return doc
+}
+
+type camtAmount struct {
+	Currency string `xml:"Ccy,attr"`
+	Value    string `xml:",chardata"`
+}
+
+type camtBalance struct {
+	Type      string     `xml:"Tp>CdOrPrtry>Cd"`
+	Amount    camtAmount `xml:"Amt"`
+	Indicator string     `xml:"CdtDbtInd"`
+	Date      string     `xml:"Dt>DtTm"`
+}
+
+type camtParty struct {
+	Name string `xml:"Nm"`
+}
+
+type camtEntry struct {
+	Reference   string     `xml:"NtryRef"`
+	Amount      camtAmount `xml:"Amt"`
+	Indicator   string     `xml:"CdtDbtInd"`
+	Status      string     `xml:"Sts"`
+	Booked      string     `xml:"BookgDt>DtTm"`
+	Value       string     `xml:"ValDt>DtTm"`
+	ServicerRef string     `xml:"AcctSvcrRef"`
+	Code        string     `xml:"BkTxCd>Prtry>Cd"`
+	Details     struct {
+		EndToEndID string     `xml:"Refs>EndToEndId"`
+		Debtor     *camtParty `xml:"RltdPties>Dbtr,omitempty"`
+		Creditor   *camtParty `xml:"RltdPties>Cdtr,omitempty"`
+		Remittance string     `xml:"RmtInf>Ustrd,omitempty"`
+	} `xml:"NtryDtls>TxDtls"`
+}
+
+type camtDocument struct {
+	XMLName   xml.Name `xml:"urn:iso:std:iso:20022:tech:xsd:camt.053.001.02 Document"`
+	MessageID string   `xml:"BkToCstmrStmt>GrpHdr>MsgId"`
+	Created   string   `xml:"BkToCstmrStmt>GrpHdr>CreDtTm"`
+	Statement struct {
+		ID       string        `xml:"Id"`
+		Created  string        `xml:"CreDtTm"`
+		From     string        `xml:"FrToDt>FrDtTm"`
+		To       string        `xml:"FrToDt>ToDtTm"`
+		Account  string        `xml:"Acct>Id>Othr>Id"`
+		Currency string        `xml:"Acct>Ccy"`
+		Balances []camtBalance `xml:"Bal"`
+		Entries  []camtEntry   `xml:"Ntry"`
+	} `xml:"BkToCstmrStmt>Stmt"`
+}
+
+// camtTime formats t as an ISO 20022 date and time.
+func camtTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// camtIndicator returns whether amount is a credit or a debit.
+func camtIndicator(amount int) string {
+	if amount < 0 {
+		return "DBIT"
+	}
+	return "CRDT"
+}
+
+func (s Statement) camt053() camtDocument {
+	var doc camtDocument
+	id := fmt.Sprintf("%s-%s", s.Account, s.Created.Format("20060102150405"))
+	doc.MessageID = id
+	doc.Created = camtTime(s.Created)
+
+	st := &doc.Statement
+	st.ID = id
+	st.Created = camtTime(s.Created)
+	st.From = camtTime(s.start())
+	st.To = camtTime(s.Until)
+	st.Account = s.Account
+	st.Currency = s.Currency
+	st.Balances = []camtBalance{
+		{Type: "OPBD", Amount: camtAmount{s.Currency, s.decimal(s.Opening, true)}, Indicator: camtIndicator(s.Opening), Date: st.From},
+		{Type: "CLBD", Amount: camtAmount{s.Currency, s.decimal(s.Closing, true)}, Indicator: camtIndicator(s.Closing), Date: st.To},
+	}
+
+	for _, e := range s.Entries {
+		op := e.Operation
+		entry := camtEntry{
+			Reference:   op.ID,
+			Amount:      camtAmount{s.Currency, s.decimal(e.Amount, true)},
+			Indicator:   camtIndicator(e.Amount),
+			Status:      "BOOK",
+			Booked:      camtTime(op.Time),
+			Value:       camtTime(op.Time),
+			ServicerRef: op.ID,
+			Code:        string(op.Type),
+		}
+		entry.Details.EndToEndID = cmp.Or(op.CorrelationID, "NOTPROVIDED")
+		if other := s.counterparty(op); other != "" {
+			if e.Amount < 0 {
+				entry.Details.Creditor = &camtParty{other}
+			} else {
+				entry.Details.Debtor = &camtParty{other}
+			}
+		}
+		entry.Details.Remittance = op.Memo
+		st.Entries = append(st.Entries, entry)
+	}
+	return doc
+}
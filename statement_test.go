@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatement(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100, "acc2": 0}}
+	sm.UseClock(clock)
+	_ = sm.Deposit("acc1", 50)
+	clock.Advance(time.Hour)
+	since := clock.Now()
+	clock.Advance(time.Hour)
+	_ = sm.Transfer("acc1", "acc2", 30)
+	_ = sm.Move("acc1", BucketAvailable, "savings", 20)
+	_ = sm.SetAccountStatus("acc1", StatusRestricted, "review")
+	_ = sm.OpenAccount("acc3", 5)
+	clock.Advance(time.Hour)
+	until := clock.Now()
+	_ = sm.Withdraw("acc2", 10)
+
+	tests := []struct {
+		name    string
+		account string
+		opts    StatementOptions
+		opening int
+		amounts []int
+		closing int
+	}{
+		{"Everything", "acc1", StatementOptions{}, 0, []int{50, -30, -20}, 0},
+		{"Period", "acc1", StatementOptions{Since: since, Until: until}, 150, []int{-30, -20}, 100},
+		{"Credits", "acc2", StatementOptions{Since: since}, 0, []int{30, -10}, 20},
+		{"Opened in the period", "acc3", StatementOptions{Since: since}, 0, []int{5}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := sm.Statement(tt.account, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var amounts []int
+			for _, e := range s.Entries {
+				amounts = append(amounts, e.Amount)
+			}
+			if s.Opening != tt.opening || s.Closing != tt.closing || !slices.Equal(amounts, tt.amounts) {
+				t.Errorf("Statement() = %d, %v, %d; want %d, %v, %d", s.Opening, amounts, s.Closing, tt.opening, tt.amounts, tt.closing)
+			}
+			if n := len(s.Entries); n > 0 && s.Entries[n-1].Balance != s.Closing {
+				t.Errorf("Last entry leaves %d; want the closing balance %d", s.Entries[n-1].Balance, s.Closing)
+			}
+		})
+	}
+
+	if _, err := sm.Statement("nope", StatementOptions{}); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("Statement() of an unknown account error = %v; want %v", err, ErrInvalidAccount)
+	}
+	if _, err := sm.Statement("acc1", StatementOptions{Since: until, Until: since}); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Statement() ending before it starts error = %v; want %v", err, ErrInvalidOperation)
+	}
+}
+
+func TestStatementDecimal(t *testing.T) {
+	tests := []struct {
+		amount int
+		scale  int
+		abs    bool
+		want   string
+	}{
+		{1234, 0, false, "1234"},
+		{1234, 2, false, "12.34"},
+		{-5, 2, false, "-0.05"},
+		{-5, 2, true, "0.05"},
+		{100, 3, false, "0.100"},
+		{0, 2, false, "0.00"},
+	}
+	for _, tt := range tests {
+		if got := (Statement{Scale: tt.scale}).decimal(tt.amount, tt.abs); got != tt.want {
+			t.Errorf("decimal(%d) with scale %d = %q; want %q", tt.amount, tt.scale, got, tt.want)
+		}
+	}
+}
+
+func TestStatementWrite(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+	sm.UseClock(clock)
+	_, _ = sm.Apply(Operation{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 250, Memo: "invoice 42"})
+	_ = sm.Deposit("acc1", 5)
+	s, err := sm.Statement("acc1", StatementOptions{Since: clock.Now().Add(-time.Hour), Currency: "EUR", Scale: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.Write(&buf, StatementOFX); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `<?OFX OFXHEADER="200" VERSION="220"`) {
+		t.Errorf("OFX statement has no OFX header:\n%s", buf.String())
+	}
+	var ofx ofxDocument
+	if err := xml.Unmarshal(buf.Bytes(), &ofx); err != nil {
+		t.Fatal(err)
+	}
+	r := ofx.Response
+	if r.Currency != "EUR" || r.Account.ID != "acc1" || r.Balance != "7.55" || len(r.Transactions) != 2 {
+		t.Fatalf("OFX statement = %+v; want 2 transactions of acc1 leaving EUR 7.55", r)
+	}
+	want := ofxTransaction{Type: "XFER", Posted: "20260101100000.000[0:GMT]", Amount: "-2.50", FITID: s.Entries[0].Operation.ID, Name: "acc2", Memo: "invoice 42"}
+	if r.Transactions[0] != want {
+		t.Errorf("OFX transaction = %+v; want %+v", r.Transactions[0], want)
+	}
+	if r.Transactions[1].Type != "DEP" || r.Transactions[1].Amount != "0.05" {
+		t.Errorf("OFX transaction = %+v; want a deposit of 0.05", r.Transactions[1])
+	}
+
+	buf.Reset()
+	if err := s.Write(&buf, StatementCAMT053); err != nil {
+		t.Fatal(err)
+	}
+	var camt camtDocument
+	if err := xml.Unmarshal(buf.Bytes(), &camt); err != nil {
+		t.Fatal(err)
+	}
+	st := camt.Statement
+	if camt.XMLName.Space != "urn:iso:std:iso:20022:tech:xsd:camt.053.001.02" || st.Account != "acc1" || len(st.Balances) != 2 || len(st.Entries) != 2 {
+		t.Fatalf("camt.053 statement = %+v", camt)
+	}
+	if opening, closing := st.Balances[0], st.Balances[1]; opening.Type != "OPBD" || opening.Amount.Value != "10.00" || closing.Type != "CLBD" || closing.Amount.Value != "7.55" {
+		t.Errorf("camt.053 balances = %+v; want 10.00 opening and 7.55 closing", st.Balances)
+	}
+	entry := st.Entries[0]
+	if entry.Amount != (camtAmount{"EUR", "2.50"}) || entry.Indicator != "DBIT" || entry.Code != string(OpTransfer) ||
+		entry.Details.Creditor == nil || entry.Details.Creditor.Name != "acc2" || entry.Details.Remittance != "invoice 42" {
+		t.Errorf("camt.053 entry = %+v; want a 2.50 debit paid to acc2", entry)
+	}
+	if credit := st.Entries[1]; credit.Indicator != "CRDT" || credit.Details.Debtor != nil {
+		t.Errorf("camt.053 entry = %+v; want a credit from no account", credit)
+	}
+
+	if err := s.Write(&buf, "qif"); !errors.Is(err, ErrInvalidExportFormat) {
+		t.Errorf("Write() error = %v; want %v", err, ErrInvalidExportFormat)
+	}
+}
+
+func TestServerStatement(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 100, "acc2": 0})
+	_ = sm.Transfer("acc1", "acc2", 30)
+	handler := srv.Handler()
+
+	tests := []struct {
+		query       string
+		code        int
+		contentType string
+	}{
+		{"", http.StatusOK, "application/json"},
+		{"?format=ofx&currency=USD&scale=2", http.StatusOK, "application/x-ofx"},
+		{"?format=camt053", http.StatusOK, "application/xml"},
+		{"?format=qif", http.StatusBadRequest, "application/json"},
+		{"?since=yesterday", http.StatusBadRequest, "application/json"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/accounts/acc2/statement"+tt.query, nil))
+		if rec.Code != tt.code || rec.Header().Get("Content-Type") != tt.contentType {
+			t.Errorf("GET statement%s = %d %s; want %d %s (%s)", tt.query, rec.Code, rec.Header().Get("Content-Type"), tt.code, tt.contentType, rec.Body)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/accounts/acc2/statement", nil))
+	var s Statement
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Entries) != 1 || s.Entries[0].Amount != 30 || s.Closing != 30 {
+		t.Errorf("GET statement = %+v; want the transfer in", s)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"maps"
+	"time"
+)
+
+// statsPeriod is the width of the time buckets of Stats.
+const statsPeriod = time.Hour
+
+// maxStatsPeriods is how many time buckets Stats keeps, a week's worth.
+const maxStatsPeriods = 7 * 24
+
+// OperationStats counts operations and sums their amounts.
+type OperationStats struct {
+	Count int `json:"count"`
+	Sum   int `json:"sum"`
+}
+
+// PeriodStats holds the statistics of the operations applied in the period
+// of statsPeriod starting at Start.
+type PeriodStats struct {
+	Start  time.Time                        `json:"start"`
+	ByType map[OperationType]OperationStats `json:"by_type"`
+}
+
+// CategoryStats holds the spending and earning of a category: the funds
+// operations of the category took out of accounts, by withdrawal or
+// transfer, and put into them, by deposit or transfer. Across accounts, a
+// transfer counts both as spending of its payer and earning of its payee.
+type CategoryStats struct {
+	Spending OperationStats `json:"spending"`
+	Earning  OperationStats `json:"earning"`
+}
+
+// Stats holds the count and total amount of the operations applied since
+// the state machine was created, by type, by account and type, and by type
+// for each hour of the last week with operations, oldest first, and the
+// spending and earning of the operations with a category, by category.
+// Operations undone by a rollback stay counted; the rollback is counted
+// too. A transaction counts as each of its operations.
+type Stats struct {
+	ByType     map[OperationType]OperationStats            `json:"by_type"`
+	ByAccount  map[string]map[OperationType]OperationStats `json:"by_account"`
+	ByPeriod   []PeriodStats                               `json:"by_period"`
+	ByCategory map[string]CategoryStats                    `json:"by_category"`
+}
+
+// stats are kept up to date as operations are applied, guarded by sm.mu.
+type stats struct {
+	byType            map[OperationType]OperationStats
+	byAccount         map[string]map[OperationType]OperationStats
+	byPeriod          []PeriodStats
+	byCategory        map[string]CategoryStats
+	byAccountCategory map[string]map[string]CategoryStats
+}
+
+func addStats(byType map[OperationType]OperationStats, op Operation) {
+	s := byType[op.Type]
+	s.Count++
+	s.Sum += op.Amount
+	byType[op.Type] = s
+}
+
+// add counts an applied operation.
+func (s *stats) add(op Operation) {
+	if s.byType == nil {
+		s.byType = map[OperationType]OperationStats{}
+		s.byAccount = map[string]map[OperationType]OperationStats{}
+		s.byCategory = map[string]CategoryStats{}
+		s.byAccountCategory = map[string]map[string]CategoryStats{}
+	}
+	s.addCategory(op)
+	addStats(s.byType, op)
+	for _, id := range op.accounts() {
+		if s.byAccount[id] == nil {
+			s.byAccount[id] = map[OperationType]OperationStats{}
+		}
+		addStats(s.byAccount[id], op)
+	}
+
+	start := op.Time.UTC().Truncate(statsPeriod)
+	if n := len(s.byPeriod); n == 0 || s.byPeriod[n-1].Start.Before(start) {
+		s.byPeriod = append(s.byPeriod, PeriodStats{Start: start, ByType: map[OperationType]OperationStats{}})
+		if len(s.byPeriod) > maxStatsPeriods {
+			s.byPeriod = s.byPeriod[len(s.byPeriod)-maxStatsPeriods:]
+		}
+	}
+	// Operations applied out of time order, e.g. replicated from a leader
+	// whose clock went back, count in the latest period.
+	addStats(s.byPeriod[len(s.byPeriod)-1].ByType, op)
+}
+
+// addCategory counts the spending and earning of an operation with a
+// category.
+func (s *stats) addCategory(op Operation) {
+	if op.Category == "" || (op.Type != OpDeposit && op.Type != OpWithdraw && op.Type != OpTransfer) {
+		return
+	}
+	add := func(id string, spent bool) {
+		if s.byAccountCategory[id] == nil {
+			s.byAccountCategory[id] = map[string]CategoryStats{}
+		}
+		for _, byCategory := range []map[string]CategoryStats{s.byCategory, s.byAccountCategory[id]} {
+			c := byCategory[op.Category]
+			side := &c.Earning
+			if spent {
+				side = &c.Spending
+			}
+			side.Count++
+			side.Sum += op.Amount
+			byCategory[op.Category] = c
+		}
+	}
+	if op.From != "" {
+		add(op.From, true)
+	}
+	if op.To != "" {
+		add(op.To, false)
+	}
+}
+
+// Stats returns the statistics of the operations applied so far. They are
+// kept up to date as operations are applied, so this does not read history.
+func (sm *StateMachine) Stats() Stats {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	stats := Stats{
+		ByType:     maps.Clone(sm.stats.byType),
+		ByAccount:  make(map[string]map[OperationType]OperationStats, len(sm.stats.byAccount)),
+		ByPeriod:   make([]PeriodStats, 0, len(sm.stats.byPeriod)),
+		ByCategory: maps.Clone(sm.stats.byCategory),
+	}
+	if stats.ByType == nil {
+		stats.ByType = map[OperationType]OperationStats{}
+		stats.ByCategory = map[string]CategoryStats{}
+	}
+	for id, byType := range sm.stats.byAccount {
+		stats.ByAccount[id] = maps.Clone(byType)
+	}
+	for _, period := range sm.stats.byPeriod {
+		stats.ByPeriod = append(stats.ByPeriod, PeriodStats{Start: period.Start, ByType: maps.Clone(period.ByType)})
+	}
+	return stats
+}
+
+// AccountStats returns the statistics of the operations applied so far to
+// an account, by type.
+func (sm *StateMachine) AccountStats(accountId string) map[OperationType]OperationStats {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	stats := maps.Clone(sm.stats.byAccount[accountId])
+	if stats == nil {
+		stats = map[OperationType]OperationStats{}
+	}
+	return stats
+}
+
+// AccountCategoryStats returns the spending and earning of an account by
+// category, for budgeting.
+func (sm *StateMachine) AccountCategoryStats(accountId string) map[string]CategoryStats {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	stats := maps.Clone(sm.stats.byAccountCategory[accountId])
+	if stats == nil {
+		stats = map[string]CategoryStats{}
+	}
+	return stats
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 10, 30, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+	sm.UseClock(clock)
+
+	_ = sm.Deposit("acc1", 100)
+	_ = sm.Transfer("acc1", "acc2", 300)
+	_ = sm.Withdraw("acc2", 500) // fails, not counted
+	clock.Advance(time.Hour)
+	_ = sm.Withdraw("acc2", 50)
+	_ = sm.Tx(func(tx *Tx) error {
+		if err := tx.Deposit("acc1", 10); err != nil {
+			return err
+		}
+		return tx.Deposit("acc2", 20)
+	})
+	_ = sm.Rollback()
+
+	stats := sm.Stats()
+
+	expectedByType := map[OperationType]OperationStats{
+		OpDeposit:  {Count: 3, Sum: 130},
+		OpTransfer: {Count: 1, Sum: 300},
+		OpWithdraw: {Count: 1, Sum: 50},
+		OpRollback: {Count: 1},
+	}
+	if !maps.Equal(stats.ByType, expectedByType) {
+		t.Errorf("ByType = %v; want %v", stats.ByType, expectedByType)
+	}
+
+	expectedByAccount := map[string]map[OperationType]OperationStats{
+		"acc1": {OpDeposit: {Count: 2, Sum: 110}, OpTransfer: {Count: 1, Sum: 300}},
+		"acc2": {OpDeposit: {Count: 1, Sum: 20}, OpTransfer: {Count: 1, Sum: 300}, OpWithdraw: {Count: 1, Sum: 50}},
+	}
+	for id, expected := range expectedByAccount {
+		if !maps.Equal(stats.ByAccount[id], expected) {
+			t.Errorf("ByAccount[%s] = %v; want %v", id, stats.ByAccount[id], expected)
+		}
+		if byType := sm.AccountStats(id); !maps.Equal(byType, expected) {
+			t.Errorf("AccountStats(%s) = %v; want %v", id, byType, expected)
+		}
+	}
+
+	if len(stats.ByPeriod) != 2 {
+		t.Fatalf("ByPeriod = %+v; want 2 hours", stats.ByPeriod)
+	}
+	first, second := stats.ByPeriod[0], stats.ByPeriod[1]
+	if !first.Start.Equal(time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)) || first.ByType[OpDeposit].Count != 1 || first.ByType[OpTransfer].Count != 1 {
+		t.Errorf("First period = %+v; want a deposit and a transfer from 10:00", first)
+	}
+	if !second.Start.Equal(time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC)) || second.ByType[OpDeposit].Count != 2 || second.ByType[OpRollback].Count != 1 {
+		t.Errorf("Second period = %+v; want the transaction and the rollback from 11:00", second)
+	}
+
+	// The returned stats are a copy.
+	stats.ByType[OpDeposit] = OperationStats{}
+	if sm.Stats().ByType[OpDeposit].Count != 3 {
+		t.Errorf("Stats() shares its maps with the state machine")
+	}
+}
+
+func TestStatsPeriods(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	sm := &StateMachine{accounts: map[string]int{"acc1": 0}}
+	sm.UseClock(clock)
+	for range maxStatsPeriods + 5 {
+		_ = sm.Deposit("acc1", 1)
+		clock.Advance(statsPeriod)
+	}
+
+	stats := sm.Stats()
+	if len(stats.ByPeriod) != maxStatsPeriods {
+		t.Fatalf("ByPeriod has %d periods; want %d", len(stats.ByPeriod), maxStatsPeriods)
+	}
+	if start := clock.Now().Add(-maxStatsPeriods * statsPeriod); !stats.ByPeriod[0].Start.Equal(start) {
+		t.Errorf("Oldest period starts at %s; want %s", stats.ByPeriod[0].Start, start)
+	}
+	if stats.ByType[OpDeposit].Count != maxStatsPeriods+5 {
+		t.Errorf("ByType = %v; want every deposit counted", stats.ByType)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 1000, "acc2": 0})
+	_ = sm.Transfer("acc1", "acc2", 100)
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expected       OperationStats
+	}{
+		{"All", "/stats", http.StatusOK, OperationStats{Count: 1, Sum: 100}},
+		{"Account", "/accounts/acc2/stats", http.StatusOK, OperationStats{Count: 1, Sum: 100}},
+		{"Unknown account", "/accounts/nope/stats", http.StatusNotFound, OperationStats{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("GET %s = %d; want %d (%s)", tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if rec.Code != http.StatusOK {
+				return
+			}
+			var resp struct {
+				ByType map[OperationType]OperationStats `json:"by_type"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.ByType[OpTransfer] != tt.expected {
+				t.Errorf("Transfers = %+v; want %+v", resp.ByType[OpTransfer], tt.expected)
+			}
+		})
+	}
+}
+
+func TestCategoryStats(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+	sm.RegisterHooks(Hooks{Classify: func(ctx context.Context, op Operation) string {
+		if op.Type == OpDeposit {
+			return "salary"
+		}
+		return ""
+	}})
+	sm.RegisterHooks(Hooks{Classify: func(ctx context.Context, op Operation) string { return "other" }})
+
+	_, _ = sm.Apply(Operation{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 100, Category: "rent"})
+	_, _ = sm.Apply(Operation{Type: OpWithdraw, From: "acc2", Amount: 30, Category: "groceries"})
+	_ = sm.Deposit("acc1", 500)
+	_ = sm.Withdraw("acc1", 5)
+	_ = sm.Tx(func(tx *Tx) error { return tx.Deposit("acc2", 20) })
+	_ = sm.Move("acc1", BucketAvailable, "savings", 50) // not spending
+	if _, err := sm.Apply(Operation{Type: OpDeposit, To: "acc1", Amount: 1, Category: strings.Repeat("x", maxMetadataLength+1)}); !errors.Is(err, ErrInvalidOperation) {
+		t.Errorf("Apply() with a long category error = %v; want %v", err, ErrInvalidOperation)
+	}
+
+	expected := map[string]CategoryStats{
+		"rent":      {Spending: OperationStats{Count: 1, Sum: 100}, Earning: OperationStats{Count: 1, Sum: 100}},
+		"groceries": {Spending: OperationStats{Count: 1, Sum: 30}},
+		"salary":    {Earning: OperationStats{Count: 2, Sum: 520}},
+		"other":     {Spending: OperationStats{Count: 1, Sum: 5}},
+	}
+	if byCategory := sm.Stats().ByCategory; !maps.Equal(byCategory, expected) {
+		t.Errorf("ByCategory = %+v; want %+v", byCategory, expected)
+	}
+
+	expectedByAccount := map[string]map[string]CategoryStats{
+		"acc1": {
+			"rent":   {Spending: OperationStats{Count: 1, Sum: 100}},
+			"salary": {Earning: OperationStats{Count: 1, Sum: 500}},
+			"other":  {Spending: OperationStats{Count: 1, Sum: 5}},
+		},
+		"acc2": {
+			"rent":      {Earning: OperationStats{Count: 1, Sum: 100}},
+			"groceries": {Spending: OperationStats{Count: 1, Sum: 30}},
+			"salary":    {Earning: OperationStats{Count: 1, Sum: 20}},
+		},
+		"nope": {},
+	}
+	for id, expected := range expectedByAccount {
+		if byCategory := sm.AccountCategoryStats(id); !maps.Equal(byCategory, expected) {
+			t.Errorf("AccountCategoryStats(%s) = %+v; want %+v", id, byCategory, expected)
+		}
+	}
+
+	srv := NewServer(sm, "")
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/accounts/acc2/withdraw", strings.NewReader(`{"amount":10,"category":"groceries"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST withdraw = %d (%s)", rec.Code, rec.Body)
+	}
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/accounts/acc2/stats", nil))
+	var resp accountStatsResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if groceries := resp.ByCategory["groceries"].Spending; groceries != (OperationStats{Count: 2, Sum: 40}) {
+		t.Errorf("GET stats spending on groceries = %+v; want 2 for 40", groceries)
+	}
+}
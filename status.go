@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+var (
+	ErrInvalidStatus     = errors.New("invalid account status")
+	ErrInvalidTransition = errors.New("invalid account status transition")
+	// ErrStatusForbids is returned for operations the status of one of
+	// their accounts does not allow, see statusPermissions.
+	ErrStatusForbids = errors.New("operation not allowed in account status")
+)
+
+// AccountStatus is where an account is in its lifecycle, e.g. pending until
+// its holder's identity is verified.
+type AccountStatus string
+
+const (
+	StatusPending    AccountStatus = "pending"
+	StatusActive     AccountStatus = "active"
+	StatusRestricted AccountStatus = "restricted"
+	StatusClosed     AccountStatus = "closed"
+)
+
+// statusPermissions is what operations each status allows on an account:
+// credits are deposits and transfers to it, debits are withdrawals,
+// transfers from it and moves between its buckets.
+var statusPermissions = map[AccountStatus]struct{ credit, debit bool }{
+	StatusPending:    {credit: true},
+	StatusActive:     {credit: true, debit: true},
+	StatusRestricted: {},
+	StatusClosed:     {},
+}
+
+// statusTransitions is the statuses each status can change to. Closing is
+// final.
+var statusTransitions = map[AccountStatus][]AccountStatus{
+	StatusPending:    {StatusActive, StatusRestricted, StatusClosed},
+	StatusActive:     {StatusRestricted, StatusClosed},
+	StatusRestricted: {StatusActive, StatusClosed},
+	StatusClosed:     nil,
+}
+
+func (s AccountStatus) valid() bool {
+	_, ok := statusPermissions[s]
+	return ok
+}
+
+// AccountStatus returns the status of an account. Accounts are active
+// unless opened with another status or changed with SetAccountStatus.
+func (sm *StateMachine) AccountStatus(accountId string) (AccountStatus, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.accounts[accountId]; !ok {
+		return "", fmt.Errorf("%w (%s)", ErrInvalidAccount, accountId)
+	}
+	return sm.status(accountId), nil
+}
+
+// status returns the status of an account. sm.mu must be held.
+func (sm *StateMachine) status(accountId string) AccountStatus {
+	if status, ok := sm.statuses[accountId]; ok {
+		return status
+	}
+	return StatusActive
+}
+
+// setStatus sets the status of an account. sm.mu must be held.
+func (sm *StateMachine) setStatus(accountId string, status AccountStatus) {
+	previous, ok := sm.statuses[accountId]
+	sm.onRevert(func() error {
+		if ok {
+			sm.statuses[accountId] = previous
+		} else {
+			delete(sm.statuses, accountId)
+		}
+		return nil
+	})
+	if status == "" || status == StatusActive {
+		delete(sm.statuses, accountId)
+		return
+	}
+	if sm.statuses == nil {
+		sm.statuses = map[string]AccountStatus{}
+	}
+	sm.statuses[accountId] = status
+}
+
+// SetAccountStatus changes the status of an account, with a reason kept as
+// the memo of the operation. The change is journaled like any other
+// operation, so the history of an account shows when and why its status
+// changed; like archivals, rollbacks cannot undo it. Only the transitions
+// in statusTransitions are allowed, and accounts can only be closed once
+// empty.
+func (sm *StateMachine) SetAccountStatus(accountId string, status AccountStatus, reason string) error {
+	return sm.SetAccountStatusContext(context.Background(), accountId, status, reason)
+}
+
+// SetAccountStatusContext is like SetAccountStatus but gives up without
+// changing anything if ctx is done before the operation starts.
+func (sm *StateMachine) SetAccountStatusContext(ctx context.Context, accountId string, status AccountStatus, reason string) error {
+	_, err := sm.ApplyContext(ctx, Operation{Type: OpSetStatus, To: accountId, Status: status, Memo: reason})
+	return err
+}
+
+func (sm *StateMachine) applySetStatus(op Operation) error {
+	accountId := op.To
+	fmt.Printf("\n\nSetting status of account %s to %s\n", accountId, op.Status)
+
+	balance, ok := sm.accounts[accountId]
+	if !ok {
+		return fmt.Errorf("%w (%s)", ErrInvalidAccount, accountId)
+	}
+	current := sm.status(accountId)
+	if !slices.Contains(statusTransitions[current], op.Status) {
+		return fmt.Errorf("%w: %s cannot become %s", ErrInvalidTransition, current, op.Status)
+	}
+	if op.Status == StatusClosed && balance != 0 {
+		return fmt.Errorf("%w: %s still holds %d", ErrInvalidTransition, accountId, balance)
+	}
+
+	sm.saveState(accountId)
+	sm.setStatus(accountId, op.Status)
+	return nil
+}
+
+// checkStatus fails with ErrStatusForbids if the status of an account of op
+// does not allow it. sm.mu must be held.
+func (sm *StateMachine) checkStatus(op Operation) error {
+	var credited, debited string
+	switch op.Type {
+	case OpDeposit:
+		credited = op.To
+	case OpWithdraw, OpMove:
+		debited = op.From
+	case OpTransfer:
+		credited, debited = op.To, op.From
+	}
+	if debited != "" {
+		if status := sm.status(debited); !statusPermissions[status].debit {
+			return fmt.Errorf("%w: %s is %s and cannot be debited", ErrStatusForbids, debited, status)
+		}
+	}
+	if credited != "" {
+		if status := sm.status(credited); !statusPermissions[status].credit {
+			return fmt.Errorf("%w: %s is %s and cannot be credited", ErrStatusForbids, credited, status)
+		}
+	}
+	return nil
+}
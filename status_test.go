@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAccountStatus(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 100}}
+	if _, err := sm.Apply(Operation{Type: OpOpen, To: "new", Status: StatusPending}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		apply    func() error
+		expected error
+	}{
+		{"Deposit to pending", func() error { return sm.Deposit("new", 50) }, nil},
+		{"Withdraw from pending", func() error { return sm.Withdraw("new", 10) }, ErrStatusForbids},
+		{"Transfer from pending", func() error { return sm.Transfer("new", "acc1", 10) }, ErrStatusForbids},
+		{"Move in pending", func() error { return sm.Move("new", "", "reserved", 10) }, ErrStatusForbids},
+		{"Transaction from pending", func() error {
+			return sm.Tx(func(tx *Tx) error { return tx.Withdraw("new", 10) })
+		}, ErrStatusForbids},
+		{"Activate", func() error { return sm.SetAccountStatus("new", StatusActive, "identity verified") }, nil},
+		{"Withdraw from active", func() error { return sm.Withdraw("new", 10) }, nil},
+		{"Activate again", func() error { return sm.SetAccountStatus("new", StatusActive, "") }, ErrInvalidTransition},
+		{"Back to pending", func() error { return sm.SetAccountStatus("new", StatusPending, "") }, ErrInvalidTransition},
+		{"Restrict", func() error { return sm.SetAccountStatus("new", StatusRestricted, "suspected fraud") }, nil},
+		{"Deposit to restricted", func() error { return sm.Deposit("new", 10) }, ErrStatusForbids},
+		{"Transfer to restricted", func() error { return sm.Transfer("acc1", "new", 10) }, ErrStatusForbids},
+		{"Close with a balance", func() error { return sm.SetAccountStatus("new", StatusClosed, "") }, ErrInvalidTransition},
+		{"Reactivate", func() error { return sm.SetAccountStatus("new", StatusActive, "cleared") }, nil},
+		{"Empty", func() error { return sm.Transfer("new", "acc1", 40) }, nil},
+		{"Close", func() error { return sm.SetAccountStatus("new", StatusClosed, "customer request") }, nil},
+		{"Deposit to closed", func() error { return sm.Deposit("new", 10) }, ErrStatusForbids},
+		{"Reopen", func() error { return sm.SetAccountStatus("new", StatusActive, "") }, ErrInvalidTransition},
+		{"Unknown status", func() error { return sm.SetAccountStatus("acc1", "frozen", "") }, ErrInvalidStatus},
+		{"Open closed", func() error {
+			_, err := sm.Apply(Operation{Type: OpOpen, To: "acc2", Status: StatusClosed})
+			return err
+		}, ErrInvalidStatus},
+		{"Unknown account", func() error { return sm.SetAccountStatus("acc3", StatusRestricted, "") }, ErrInvalidAccount},
+		{"Rollback across a status change", func() error { return sm.Rollback() }, ErrIrreversible},
+		{"Status change in a transaction", func() error {
+			return sm.Tx(func(tx *Tx) error {
+				return tx.Apply(Operation{Type: OpSetStatus, To: "acc1", Status: StatusRestricted})
+			})
+		}, ErrInvalidOperation},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.apply(); !errors.Is(err, tt.expected) {
+				t.Errorf("Error = %v; want %v", err, tt.expected)
+			}
+		})
+	}
+
+	if status, _ := sm.AccountStatus("new"); status != StatusClosed {
+		t.Errorf("AccountStatus() = %s; want %s", status, StatusClosed)
+	}
+	var changes []string
+	for _, op := range sm.Operations() {
+		if op.Type == OpSetStatus {
+			changes = append(changes, string(op.Status)+": "+op.Memo)
+		}
+	}
+	expected := []string{"active: identity verified", "restricted: suspected fraud", "active: cleared", "closed: customer request"}
+	if strings.Join(changes, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("Journaled status changes = %v; want %v", changes, expected)
+	}
+
+	var buf bytes.Buffer
+	if err := sm.WriteSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	restored := &StateMachine{}
+	if err := restored.ReadSnapshot(&buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := restored.AccountStatus("new"); status != StatusClosed {
+		t.Errorf("AccountStatus() after ReadSnapshot = %s; want %s", status, StatusClosed)
+	}
+}
+
+func TestServerAccountStatus(t *testing.T) {
+	quiet(t)
+
+	srv, _ := newTestServer(map[string]int{"acc1": 100})
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Status", http.MethodGet, "/accounts/acc1/status", "", http.StatusOK, `"status":"active"`},
+		{"Restrict", http.MethodPut, "/accounts/acc1/status", `{"status":"restricted","reason":"review"}`, http.StatusOK, `"status":"restricted"`},
+		{"Withdraw", http.MethodPost, "/accounts/acc1/withdraw", `{"amount":10}`, http.StatusForbidden, ""},
+		{"Invalid transition", http.MethodPut, "/accounts/acc1/status", `{"status":"pending"}`, http.StatusConflict, ""},
+		{"Unknown status", http.MethodPut, "/accounts/acc1/status", `{"status":"frozen"}`, http.StatusBadRequest, ""},
+		{"Unknown account", http.MethodGet, "/accounts/acc2/status", "", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if rec.Code != tt.expectedStatus {
+				t.Fatalf("%s %s = %d; want %d (%s)", tt.method, tt.path, rec.Code, tt.expectedStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.expectedBody) {
+				t.Errorf("%s %s = %s; want %s", tt.method, tt.path, rec.Body, tt.expectedBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+)
+
+// streamBuffer is how many events a subscriber may fall behind by before it
+// is dropped.
+const streamBuffer = 64
+
+// Event reports an applied operation and the balances it left.
+type Event struct {
+	Operation Operation      `json:"operation"`
+	Version   int            `json:"version"`          // version after the operation
+	Balances  map[string]int `json:"balances"`         // of the subscribed accounts the operation may have changed
+	Alerts    []Alert        `json:"alerts,omitempty"` // triggered by the operation, see AddAlert
+
+	// Buckets holds the balances of the buckets of those accounts, keyed
+	// like in sm.accounts, e.g. "acc1#reserved", so that replicas and the
+	// write-ahead log replay keep them: every bucket for a rollback, those
+	// the operation may have changed otherwise.
+	Buckets map[string]int `json:"buckets,omitempty"`
+
+	// Before holds the balances the accounts had before the operation, for
+	// ChangeEvents. It is kept in the outbox only, and in memory only, so
+	// the persisted formats are unchanged.
+	Before map[string]int `json:"-"`
+}
+
+// subscriber receives the events of the accounts it subscribed to, or of
+// every account if accountIds is empty.
+type subscriber struct {
+	accountIds []string
+	events     chan Event
+}
+
+// watches reports whether the subscriber wants to hear about accountId.
+func (s *subscriber) watches(accountId string) bool {
+	return len(s.accountIds) == 0 || slices.Contains(s.accountIds, accountId)
+}
+
+type streams struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+// Subscribe streams the events of later operations touching any of the
+// given accounts, or every account if none are given, until ctx is done.
+// Rollbacks are reported to every subscriber, as they may change any
+// balance.
+//
+// Events are sent in the order operations are applied. A subscriber that
+// falls more than a few dozen events behind is dropped and its channel
+// closed, so a slow reader never holds up operations; it should resubscribe
+// and read the balances afresh.
+func (sm *StateMachine) Subscribe(ctx context.Context, accountIds ...string) <-chan Event {
+	sub := &subscriber{accountIds: accountIds, events: make(chan Event, streamBuffer)}
+
+	sm.streams.mu.Lock()
+	if sm.streams.subscribers == nil {
+		sm.streams.subscribers = map[*subscriber]struct{}{}
+	}
+	sm.streams.subscribers[sub] = struct{}{}
+	sm.streams.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		sm.streams.unsubscribe(sub)
+	}()
+	return sub.events
+}
+
+// SubscribeWithState is like Subscribe for every account, but also returns
+// the state the first event follows: an Event without an operation holding
+// the current version and every balance.
+func (sm *StateMachine) SubscribeWithState(ctx context.Context) (Event, <-chan Event) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	// Events are published with sm.mu held, so none is missed in between.
+	state := Event{Version: sm.version, Balances: maps.Clone(sm.accounts)}
+	return state, sm.Subscribe(ctx)
+}
+
+func (s *streams) unsubscribe(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subscribers[sub]; ok {
+		delete(s.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// publish records the event of an applied operation, with the alerts it
+// triggered, in the write-ahead log, if any, then counts the operation in
+// the stats and the balance index, records its event in the outbox, if
+// enabled, and sends it to its subscribers. It fails, publishing nothing
+// else, if the log cannot record the event. sm.mu must be held, so events
+// are published in the order operations are applied.
+func (sm *StateMachine) publish(op Operation) error {
+	// Rollbacks may change any account.
+	rollback := op.Type == OpRollback || op.Type == OpRollbackTo
+	changed := op.accounts()
+	if rollback {
+		for id := range sm.accounts {
+			if !isBucketKey(id) {
+				changed = append(changed, id)
+			}
+		}
+	}
+
+	alerts := sm.alerts.triggered(op, sm.accounts, changed)
+	var event Event
+	if sm.outbox.enabled || sm.wal != nil {
+		event = Event{Operation: op, Version: sm.version, Balances: sm.balancesOf(changed, nil), Alerts: alerts, Buckets: sm.bucketsOf(op, nil)}
+	}
+	if sm.wal != nil {
+		if err := sm.wal.Append(event); err != nil {
+			return err
+		}
+	}
+
+	sm.stats.add(op)
+	sm.quota.count(op)
+	sm.markActive(op)
+	if rollback {
+		sm.balanceIndex.invalidate()
+		sm.storeState()
+	} else {
+		sm.balanceIndex.update(sm.accounts, changed...)
+		sm.updateState(changed...)
+	}
+	if sm.outbox.enabled {
+		event.Before = sm.imagesBefore(op, changed)
+		sm.outbox.add(event)
+	}
+
+	sm.streams.mu.Lock()
+	defer sm.streams.mu.Unlock()
+
+	for sub := range sm.streams.subscribers {
+		if !rollback && !slices.ContainsFunc(changed, sub.watches) {
+			continue
+		}
+
+		select {
+		case sub.events <- Event{Operation: op, Version: sm.version, Balances: sm.balancesOf(changed, sub.watches), Alerts: alerts, Buckets: sm.bucketsOf(op, sub.watches)}:
+		default:
+			delete(sm.streams.subscribers, sub)
+			close(sub.events)
+		}
+	}
+	return nil
+}
+
+// balancesOf returns the balances of the given accounts that exist and, if
+// watches is not nil, are watched. sm.mu must be held.
+func (sm *StateMachine) balancesOf(ids []string, watches func(string) bool) map[string]int {
+	balances := map[string]int{}
+	for _, id := range ids {
+		if balance, ok := sm.accounts[id]; ok && (watches == nil || watches(id)) {
+			balances[id] = balance
+		}
+	}
+	return balances
+}
+
+// bucketsOf returns the balances of the buckets op may have changed, of
+// every bucket for a rollback, whose accounts, if watches is not nil, are
+// watched, or nil if there are none. sm.mu must be held.
+func (sm *StateMachine) bucketsOf(op Operation, watches func(string) bool) map[string]int {
+	var buckets map[string]int
+	add := func(key string) {
+		if balance, ok := sm.accounts[key]; ok && (watches == nil || watches(accountOfKey(key))) {
+			if buckets == nil {
+				buckets = map[string]int{}
+			}
+			buckets[key] = balance
+		}
+	}
+
+	if op.Type == OpRollback || op.Type == OpRollbackTo {
+		for key := range sm.accounts {
+			if isBucketKey(key) {
+				add(key)
+			}
+		}
+		return buckets
+	}
+	for _, id := range op.accounts() {
+		for _, key := range bucketKeys(id, op.FromBucket, op.ToBucket)[1:] {
+			add(key)
+		}
+	}
+	return buckets
+}
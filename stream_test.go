@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000, "acc2": 500, "acc3": 0},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	all := sm.Subscribe(ctx)
+	acc3 := sm.Subscribe(ctx, "acc3")
+
+	_ = sm.Deposit("acc1", 100)
+	_ = sm.Withdraw("acc1", 5000) // fails, so is not reported
+	_ = sm.Transfer("acc2", "acc3", 200)
+	_ = sm.Rollback()
+
+	tests := []struct {
+		name     string
+		events   <-chan Event
+		expected []Event
+	}{
+		{
+			name:   "Every account",
+			events: all,
+			expected: []Event{
+				{Operation: Operation{Type: OpDeposit, To: "acc1", Amount: 100}, Version: 1, Balances: map[string]int{"acc1": 1100}},
+				{Operation: Operation{Type: OpTransfer, From: "acc2", To: "acc3", Amount: 200}, Version: 3, Balances: map[string]int{"acc2": 300, "acc3": 200}},
+				{Operation: Operation{Type: OpRollback}, Version: 2, Balances: map[string]int{"acc1": 1100, "acc2": 500, "acc3": 0}},
+			},
+		},
+		{
+			name:   "One account",
+			events: acc3,
+			expected: []Event{
+				{Operation: Operation{Type: OpTransfer, From: "acc2", To: "acc3", Amount: 200}, Version: 3, Balances: map[string]int{"acc3": 200}},
+				{Operation: Operation{Type: OpRollback}, Version: 2, Balances: map[string]int{"acc3": 0}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, expected := range tt.expected {
+				event := <-tt.events
+				if event.Operation.ID == "" {
+					t.Errorf("Event of %s has no operation id", event.Operation.Type)
+				}
+				event.Operation.ID, event.Operation.Version, event.Operation.Time = "", 0, expected.Operation.Time
+				if !reflect.DeepEqual(event.Operation, expected.Operation) || event.Version != expected.Version || !maps.Equal(event.Balances, expected.Balances) {
+					t.Errorf("Event = %+v; want %+v", event, expected)
+				}
+			}
+			if len(tt.events) != 0 {
+				t.Errorf("%d more events; want none", len(tt.events))
+			}
+		})
+	}
+
+	cancel()
+	for range all {
+	}
+	for range acc3 {
+	}
+}
+
+func TestSubscribeSlowReader(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{accounts: map[string]int{"acc1": 0}}
+	events := sm.Subscribe(context.Background(), "acc1")
+
+	for range streamBuffer + 1 {
+		if err := sm.Deposit("acc1", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := 0
+	for range events {
+		received++
+	}
+	if received != streamBuffer {
+		t.Errorf("Received %d events before being dropped; want %d", received, streamBuffer)
+	}
+	if err := sm.Deposit("acc1", 1); err != nil {
+		t.Errorf("Deposit after dropping the subscriber = %v; want nil", err)
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 1000, "acc2": 500})
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/events?account=acc2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q; want text/event-stream", ct)
+	}
+
+	_ = sm.Deposit("acc1", 1) // not subscribed to
+	_ = sm.Transfer("acc1", "acc2", 100)
+
+	lines := bufio.NewScanner(resp.Body)
+	var fields []string
+	for lines.Scan() && lines.Text() != "" {
+		fields = append(fields, lines.Text())
+	}
+	if len(fields) != 3 || !strings.HasPrefix(fields[0], "id: ") || fields[1] != "event: operation" {
+		t.Fatalf("Event = %q; want id, event and data fields", fields)
+	}
+
+	var event Event
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(fields[2], "data: ")), &event); err != nil {
+		t.Fatal(err)
+	}
+	if fields[0] != "id: "+event.Operation.ID {
+		t.Errorf("Event id = %q; want the operation id %s", fields[0], event.Operation.ID)
+	}
+	if event.Operation.Type != OpTransfer || !maps.Equal(event.Balances, map[string]int{"acc2": 600}) {
+		t.Errorf("Event = %+v; want the transfer and the balance of acc2", event)
+	}
+
+	if err := srv.Close(context.Background()); err != nil {
+		t.Errorf("Close with an open stream = %v; want nil", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Sweep moves everything above Target from one account to another, e.g.
+// the day's takings from an operational account to the treasury, every day
+// at At, the time since midnight UTC.
+type Sweep struct {
+	Name   string
+	From   string
+	To     string
+	Target int // balance left in From
+	At     time.Duration
+}
+
+// RunSweep performs a sweep now and returns the amount moved, 0 if From
+// holds no more than the target. The transfer is journaled like any other,
+// with the memo "sweep <name>" and the sweep's name as its "sweep" metadata,
+// so sweeps can be audited with SearchOperations. A configured sweep counts
+// as approved, so it is not parked however much it moves.
+func (sm *StateMachine) RunSweep(ctx context.Context, sweep Sweep) (int, error) {
+	swept := 0
+	ctx = context.WithValue(ctx, approvedKey{}, "sweep "+sweep.Name)
+	err := sm.TxContext(ctx, func(tx *Tx) error {
+		balance, err := tx.Balance(sweep.From)
+		if err != nil || balance <= sweep.Target {
+			return err
+		}
+		swept = balance - sweep.Target
+		return tx.Apply(Operation{
+			Type:     OpTransfer,
+			From:     sweep.From,
+			To:       sweep.To,
+			Amount:   swept,
+			Memo:     "sweep " + sweep.Name,
+			Metadata: map[string]string{"sweep": sweep.Name},
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("sweep %s: %w", sweep.Name, err)
+	}
+	return swept, nil
+}
+
+// nextSweep returns the first time at or after now that a sweep at the
+// given time of day runs.
+func nextSweep(now time.Time, at time.Duration) time.Time {
+	next := now.UTC().Truncate(24 * time.Hour).Add(at)
+	if next.Before(now) {
+		next = next.Add(24 * time.Hour)
+	}
+	return next
+}
+
+// RunSweeps performs each sweep every day at its time until ctx is done.
+// Failed sweeps are logged and tried again the next day.
+func (sm *StateMachine) RunSweeps(ctx context.Context, sweeps ...Sweep) {
+	after := sm.now()
+	for {
+		var next time.Time
+		for _, sweep := range sweeps {
+			if t := nextSweep(after, sweep.At); next.IsZero() || t.Before(next) {
+				next = t
+			}
+		}
+		if next.IsZero() {
+			return // no sweeps
+		}
+
+		timer := time.NewTimer(next.Sub(sm.now()))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+
+		for _, sweep := range sweeps {
+			if !nextSweep(after, sweep.At).Equal(next) {
+				continue
+			}
+			if amount, err := sm.RunSweep(ctx, sweep); err != nil {
+				fmt.Println("Sweep Error:", err)
+			} else if amount > 0 {
+				fmt.Printf("\n\nSwept %d from account %s to account %s\n", amount, sweep.From, sweep.To)
+			}
+		}
+		after = next.Add(time.Nanosecond)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestRunSweep(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name             string
+		balance          int
+		approvals        bool
+		expectedSwept    int
+		expectedBalances map[string]int
+		expectedErr      error
+	}{
+		{"Above target", 2500, false, 1500, map[string]int{"ops": 1000, "treasury": 1500}, nil},
+		{"At target", 1000, false, 0, map[string]int{"ops": 1000, "treasury": 0}, nil},
+		{"Below target", 400, false, 0, map[string]int{"ops": 400, "treasury": 0}, nil},
+		{"Above the approval threshold", 100_000, true, 99_000, map[string]int{"ops": 1000, "treasury": 99_000}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{accounts: map[string]int{"ops": tt.balance, "treasury": 0}}
+			if tt.approvals {
+				sm.RequireApproval(500, time.Hour)
+			}
+			sweep := Sweep{Name: "nightly", From: "ops", To: "treasury", Target: 1000}
+
+			swept, err := sm.RunSweep(context.Background(), sweep)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("RunSweep() error = %v; want %v", err, tt.expectedErr)
+			}
+			if swept != tt.expectedSwept {
+				t.Errorf("RunSweep() = %d; want %d", swept, tt.expectedSwept)
+			}
+			if balances := sm.Balances(); !maps.Equal(balances, tt.expectedBalances) {
+				t.Errorf("Balances() = %v; want %v", balances, tt.expectedBalances)
+			}
+
+			audited := sm.SearchOperations(OperationFilter{Metadata: map[string]string{"sweep": "nightly"}})
+			if swept == 0 && len(audited) != 0 || swept > 0 && (len(audited) != 1 || audited[0].Amount != swept || audited[0].Memo != "sweep nightly") {
+				t.Errorf("Sweep operations = %+v; want one moving %d", audited, swept)
+			}
+		})
+	}
+
+	sm := &StateMachine{accounts: map[string]int{"ops": 10}}
+	if _, err := sm.RunSweep(context.Background(), Sweep{Name: "s", From: "ops", To: "gone"}); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("RunSweep() to a missing account error = %v; want ErrInvalidAccount", err)
+	}
+}
+
+func TestNextSweep(t *testing.T) {
+	day := time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		at       time.Duration
+		expected time.Time
+	}{
+		{"Later today", day.Add(9 * time.Hour), 17 * time.Hour, day.Add(17 * time.Hour)},
+		{"Now", day.Add(17 * time.Hour), 17 * time.Hour, day.Add(17 * time.Hour)},
+		{"Tomorrow", day.Add(17*time.Hour + time.Second), 17 * time.Hour, day.Add(41 * time.Hour)},
+		{"Midnight", day.Add(23 * time.Hour), 0, day.Add(24 * time.Hour)},
+		{"Other time zone", day.Add(20 * time.Hour).In(time.FixedZone("UTC+5", 5*3600)), 18 * time.Hour, day.Add(42 * time.Hour)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if next := nextSweep(tt.now, tt.at); !next.Equal(tt.expected) {
+				t.Errorf("nextSweep(%s, %s) = %s; want %s", tt.now, tt.at, next, tt.expected)
+			}
+		})
+	}
+}
+
+func TestRunSweeps(t *testing.T) {
+	quiet(t)
+
+	// A sweep due now runs straight away.
+	now := time.Now().UTC()
+	sm := &StateMachine{accounts: map[string]int{"ops": 500, "treasury": 0}}
+	sm.UseClock(NewFakeClock(now))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sm.RunSweeps(ctx, Sweep{Name: "s", From: "ops", To: "treasury", Target: 100, At: now.Sub(now.Truncate(24 * time.Hour))})
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for sm.Balances()["treasury"] != 400 {
+		select {
+		case <-deadline:
+			t.Fatalf("Balances() = %v; want 400 swept to treasury", sm.Balances())
+		case <-time.After(time.Millisecond):
+		}
+	}
+	cancel()
+	<-done
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+)
+
+var (
+	ErrInvalidTenant     = errors.New("invalid tenant")
+	ErrTenantsNotDurable = errors.New("tenants are not durable")
+)
+
+// CreateTenant registers an isolated account namespace. The tenant gets its
+// own accounts, history and rate limiter; operations on it never see the
+// accounts of the root state machine or of other tenants.
+//
+// Tenants live in memory only: they are not written to the write-ahead log,
+// snapshots or backups, nor archived or replicated. So that their accounts
+// are not silently lost on a restart, creating one fails with
+// ErrTenantsNotDurable once a write-ahead log is used.
+func (sm *StateMachine) CreateTenant(tenantId string, accounts map[string]int, limiter *RateLimiter) (*StateMachine, error) {
+	if tenantId == "" {
+		return nil, fmt.Errorf("%w: empty tenant id", ErrInvalidTenant)
+	}
+	if sm.readOnly {
+		return nil, ErrReadOnly
+	}
+	if sm.wal != nil {
+		return nil, fmt.Errorf("%w: tenant %s cannot be created with a write-ahead log", ErrTenantsNotDurable, tenantId)
+	}
+	if err := sm.lifecycle.begin(); err != nil {
+		return nil, err
+	}
+	defer sm.lifecycle.end()
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, ok := sm.tenants[tenantId]; ok {
+		return nil, fmt.Errorf("%w: tenant %s already exists", ErrInvalidTenant, tenantId)
+	}
+	for id := range accounts {
+		if err := validateAccountId(id); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidTenant, err)
+		}
+	}
+
+	tenant := &StateMachine{
+		accounts:   maps.Clone(accounts),
+		maxHistory: sm.maxHistory,
+		limiter:    limiter,
+		clock:      sm.clock,
+	}
+	if tenant.accounts == nil {
+		tenant.accounts = map[string]int{}
+	}
+
+	if sm.tenants == nil {
+		sm.tenants = map[string]*StateMachine{}
+	}
+	sm.tenants[tenantId] = tenant
+
+	fmt.Printf("\n\nCreated tenant %s with accounts %v\n", tenantId, tenant.accounts)
+
+	return tenant, nil
+}
+
+// Tenant returns the state machine scoped to a tenant's namespace.
+func (sm *StateMachine) Tenant(tenantId string) (*StateMachine, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	tenant, ok := sm.tenants[tenantId]
+	if !ok {
+		return nil, fmt.Errorf("%w (%s)", ErrInvalidTenant, tenantId)
+	}
+	return tenant, nil
+}
+
+// closeTenants drains every tenant once the root state machine is closed.
+func (sm *StateMachine) closeTenants(ctx context.Context) error {
+	sm.mu.Lock()
+	tenants := make([]*StateMachine, 0, len(sm.tenants))
+	for _, tenant := range sm.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sm.mu.Unlock()
+
+	for _, tenant := range tenants {
+		if err := tenant.Close(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
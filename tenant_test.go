@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStateMachineTenants(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000},
+	}
+
+	acme, err := sm.CreateTenant("acme", map[string]int{"acc1": 100}, nil)
+	if err != nil {
+		t.Fatalf("CreateTenant failed: %v", err)
+	}
+	globex, err := sm.CreateTenant("globex", map[string]int{"acc2": 50}, nil)
+	if err != nil {
+		t.Fatalf("CreateTenant failed: %v", err)
+	}
+	if _, err := sm.CreateTenant("acme", nil, nil); !errors.Is(err, ErrInvalidTenant) {
+		t.Errorf("CreateTenant duplicate = %v; want %v", err, ErrInvalidTenant)
+	}
+	if _, err := sm.CreateTenant("initech", map[string]int{"acc1#reserved": 5}, nil); !errors.Is(err, ErrInvalidTenant) {
+		t.Errorf("CreateTenant with a bucket key = %v; want %v", err, ErrInvalidTenant)
+	}
+
+	if err := acme.Deposit("acc1", 50); err != nil {
+		t.Fatalf("Tenant deposit failed: %v", err)
+	}
+	if err := globex.Deposit("acc1", 50); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("Deposit to another tenant's account = %v; want %v", err, ErrInvalidAccount)
+	}
+	if err := sm.Rollback(); !errors.Is(err, ErrNothingToRollback) {
+		t.Errorf("Root rollback after tenant operation = %v; want %v", err, ErrNothingToRollback)
+	}
+
+	if sm.accounts["acc1"] != 1000 {
+		t.Errorf("Root acc1 balance = %d; want 1000", sm.accounts["acc1"])
+	}
+	if acme.accounts["acc1"] != 150 {
+		t.Errorf("Tenant acme acc1 balance = %d; want 150", acme.accounts["acc1"])
+	}
+
+	if err := sm.Close(context.Background()); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := acme.Deposit("acc1", 1); !errors.Is(err, ErrClosed) {
+		t.Errorf("Tenant deposit after Close = %v; want %v", err, ErrClosed)
+	}
+}
+
+func TestTenantsRefusedWithWAL(t *testing.T) {
+	sm, w := walMachine(t, t.TempDir(), WALOptions{})
+	defer w.Close()
+
+	if _, err := sm.CreateTenant("acme", map[string]int{"acc1": 100}, nil); !errors.Is(err, ErrTenantsNotDurable) {
+		t.Errorf("CreateTenant with a write-ahead log = %v; want %v", err, ErrTenantsNotDurable)
+	}
+	if _, err := sm.Tenant("acme"); !errors.Is(err, ErrInvalidTenant) {
+		t.Errorf("Tenant() = %v; want %v", err, ErrInvalidTenant)
+	}
+}
+
+func TestServerTenantIsolation(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+
+	auth := NewAuthenticator(nil)
+	_ = auth.AddAPIKey("root-admin", Principal{Subject: "root", Role: RoleAdmin})
+	_ = auth.AddAPIKey("acme-admin", Principal{Subject: "acme-admin", Role: RoleAdmin, Tenant: "acme"})
+	srv.UseAuth(auth)
+
+	do := func(apiKey, method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(APIKeyHeader, apiKey)
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	tests := []struct {
+		name           string
+		apiKey         string
+		method, path   string
+		body           string
+		expectedStatus int
+	}{
+		{name: "Tenant admin creates tenant", apiKey: "acme-admin", method: "POST", path: "/tenants", body: `{"id": "globex"}`, expectedStatus: http.StatusForbidden},
+		{name: "Root admin creates tenant", apiKey: "root-admin", method: "POST", path: "/tenants", body: `{"id": "acme", "accounts": {"acc1": 10}}`, expectedStatus: http.StatusCreated},
+		{name: "Tenant deposit", apiKey: "acme-admin", method: "POST", path: "/tenants/acme/accounts/acc1/deposit", body: `{"amount": 5}`, expectedStatus: http.StatusOK},
+		{name: "Tenant reads root", apiKey: "acme-admin", method: "GET", path: "/accounts/acc1", expectedStatus: http.StatusForbidden},
+		{name: "Tenant reads other tenant", apiKey: "acme-admin", method: "GET", path: "/tenants/globex/accounts/acc1", expectedStatus: http.StatusForbidden},
+		{name: "Root reads tenant", apiKey: "root-admin", method: "GET", path: "/tenants/acme/accounts/acc1", expectedStatus: http.StatusOK},
+		{name: "Unknown tenant", apiKey: "root-admin", method: "GET", path: "/tenants/nope/accounts/acc1", expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := do(tt.apiKey, tt.method, tt.path, tt.body); code != tt.expectedStatus {
+				t.Errorf("%s %s = %d; want %d", tt.method, tt.path, code, tt.expectedStatus)
+			}
+		})
+	}
+
+	acme, err := sm.Tenant("acme")
+	if err != nil {
+		t.Fatalf("Tenant failed: %v", err)
+	}
+	if acme.accounts["acc1"] != 15 || sm.accounts["acc1"] != 1000 {
+		t.Errorf("Balances acme/acc1 = %d, root/acc1 = %d; want 15 and 1000", acme.accounts["acc1"], sm.accounts["acc1"])
+	}
+}
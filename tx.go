@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+var ErrUnknownSavepoint = errors.New("unknown savepoint")
+
+// Tx is a batch of operations applied all together or not at all, see
+// StateMachine.Tx. Operations see the balances left by the ones before them,
+// and savepoints let a batch undo part of its work and retry it without
+// aborting. A Tx is not safe for concurrent use and must not be used after
+// the function it was passed to returns.
+type Tx struct {
+	ctx        context.Context
+	sm         *StateMachine
+	scratch    *StateMachine // balances as the operations so far leave them
+	hooks      []Hooks
+	ops        []Operation
+	savepoints []savepoint
+}
+
+type savepoint struct {
+	name     string
+	accounts map[string]int
+	statuses map[string]AccountStatus
+	ops      int // number of operations performed before the savepoint
+}
+
+// Tx runs fn with a new transaction and, if fn returns nil, applies the
+// operations it performed as a single step: a concurrent reader sees either
+// none or all of them, and one Rollback undoes them all. If fn returns an
+// error nothing is applied, e.g.
+//
+//	err := sm.Tx(func(tx *Tx) error {
+//		if err := tx.Withdraw("acc1", 100); err != nil {
+//			return err
+//		}
+//		return tx.Deposit("acc2", 100)
+//	})
+func (sm *StateMachine) Tx(fn func(tx *Tx) error) error {
+	return sm.TxContext(context.Background(), fn)
+}
+
+// TxContext is like Tx but gives up without applying anything if ctx is done
+// before the transaction is applied.
+//
+// The operations are validated against the balances when they are performed
+// and again when the transaction is applied, so the transaction fails if a
+// concurrent operation has since made one of them impossible.
+func (sm *StateMachine) TxContext(ctx context.Context, fn func(tx *Tx) error) error {
+	if err := sm.lifecycle.begin(); err != nil {
+		return err
+	}
+	defer sm.lifecycle.end()
+
+	if sm.readOnly {
+		return ErrReadOnly
+	}
+	tx, err := sm.newTx(ctx)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return sm.commit(ctx, tx.hooks, tx.ops, nil)
+}
+
+// newTx returns a new transaction starting from the current balances.
+func (sm *StateMachine) newTx(ctx context.Context) (*Tx, error) {
+	if err := sm.lockContext(ctx); err != nil {
+		return nil, err
+	}
+	defer sm.mu.Unlock()
+
+	return &Tx{
+		ctx: ctx,
+		sm:  sm,
+		scratch: &StateMachine{
+			accounts: maps.Clone(sm.accounts),
+			statuses: maps.Clone(sm.statuses),
+		},
+		hooks: sm.registeredHooks(),
+	}, nil
+}
+
+// commit applies ops as a single state change. With a coordinator, the
+// operations are written to the host transaction and it is committed once
+// they are validated, before they are applied: they are applied only if it
+// commits, and it is rolled back otherwise.
+func (sm *StateMachine) commit(ctx context.Context, hooks []Hooks, ops []Operation, coord TxCoordinator) error {
+	if len(ops) == 0 {
+		if coord != nil {
+			return coord.Commit()
+		}
+		return nil
+	}
+	if err := sm.wal.Err(); err != nil {
+		if coord != nil {
+			_ = coord.Rollback()
+		}
+		return err
+	}
+	now := sm.now()
+	var accounts []string
+	for i := range ops {
+		ops[i].ID, ops[i].Time = sm.newOperationID(now), now
+		accounts = append(accounts, ops[i].accounts()...)
+	}
+	accounts = slices.Compact(slices.Sorted(slices.Values(accounts)))
+
+	release, err := sm.hot.queue(ctx, now, sm.locks.notHeldBy(LockOwnerFrom(ctx), slices.Clone(accounts)))
+	if err == nil {
+		defer release()
+		waitedSince := time.Now()
+		err = sm.lockFor(ctx, accounts, false)
+		if err == nil {
+			sm.hot.record(now, accounts, time.Since(waitedSince))
+		}
+	}
+	if err == nil {
+		var written uint64
+		err = sm.checkEpoch(EpochFrom(ctx))
+		if err == nil {
+			err = sm.checkMemory(ops[0])
+		}
+		scratch := &StateMachine{
+			accounts: maps.Clone(sm.accounts),
+			statuses: maps.Clone(sm.statuses),
+			quota:    sm.quota,
+		}
+		for i := 0; err == nil && i < len(ops); i++ {
+			if err = scratch.apply(ops[i]); err == nil {
+				scratch.quota.count(ops[i])
+				scratch.balanceIndex.update(scratch.accounts, ops[i].accounts()...)
+			}
+		}
+		if err == nil && coord != nil {
+			err = sm.commitHost(ctx, coord, ops)
+		} else if coord != nil {
+			_ = coord.Rollback()
+		}
+
+		if err == nil {
+			sm.saveState()
+			statuses := sm.statuses
+			sm.accounts = scratch.accounts
+			sm.statuses = scratch.statuses
+			sm.onRevert(func() error {
+				sm.statuses = statuses
+				return nil
+			})
+			for i := 0; err == nil && i < len(ops); i++ {
+				ops[i], err = sm.record(ops[i])
+			}
+			if err == nil {
+				written = sm.wal.Written()
+				sm.logged(written)
+
+				fmt.Println("After transaction:", sm.accounts)
+			} else {
+				err = errors.Join(err, sm.revertUnlogged())
+			}
+		}
+		sm.mu.Unlock()
+		if err == nil {
+			if err = sm.wal.Sync(written); err != nil {
+				sm.mu.Lock()
+				err = errors.Join(err, sm.revertUnlogged())
+				sm.mu.Unlock()
+			}
+		}
+	} else if coord != nil {
+		_ = coord.Rollback()
+	}
+
+	for _, op := range ops {
+		sm.runAfterHooks(ctx, hooks, op, err)
+	}
+	return err
+}
+
+// run performs op within the transaction. Admission checks and before hooks
+// run now; after hooks only run once the transaction has been applied.
+func (tx *Tx) run(op Operation) error {
+	op = correlate(tx.ctx, op)
+	err := tx.ctx.Err()
+	if err == nil {
+		err = op.Validate()
+	}
+	if err == nil {
+		err = checkEscrowAccounts(tx.ctx, op)
+	}
+	if err == nil {
+		err = tx.sm.checkSignatures(tx.ctx, op)
+	}
+	if err == nil {
+		err = tx.sm.limiter.AllowOperation(op.accounts()...)
+	}
+	if err == nil {
+		op = tx.sm.classify(tx.ctx, tx.hooks, op)
+		err = tx.sm.runBeforeHooks(tx.ctx, tx.hooks, op)
+	}
+	if err == nil {
+		err = tx.scratch.apply(op)
+	}
+
+	if err != nil {
+		tx.sm.runAfterHooks(tx.ctx, tx.hooks, op, err)
+		return err
+	}
+	tx.ops = append(tx.ops, op)
+	return nil
+}
+
+func (tx *Tx) Deposit(accountId string, amount int) error {
+	return tx.run(Operation{Type: OpDeposit, To: accountId, Amount: amount})
+}
+
+func (tx *Tx) Withdraw(accountId string, amount int) error {
+	return tx.run(Operation{Type: OpWithdraw, From: accountId, Amount: amount})
+}
+
+// Open opens an account with an initial balance.
+func (tx *Tx) Open(accountId string, balance int) error {
+	return tx.run(Operation{Type: OpOpen, To: accountId, Amount: balance})
+}
+
+// Transfer fails with ErrApprovalRequired if amount is above the approval
+// threshold, as a transaction cannot wait for an approval.
+func (tx *Tx) Transfer(fromAccountId, toAccountId string, amount int) error {
+	return tx.Apply(Operation{Type: OpTransfer, From: fromAccountId, To: toAccountId, Amount: amount})
+}
+
+// Apply performs op, e.g. one with a memo or metadata, like
+// StateMachine.Apply. Rollbacks, archivals, restores and status changes
+// cannot be part of a transaction, and transfers fail like with Transfer.
+func (tx *Tx) Apply(op Operation) error {
+	switch op.Type {
+	case OpRollback, OpRollbackTo, OpArchive, OpUnarchive, OpSetStatus:
+		return fmt.Errorf("%w: %s cannot be part of a transaction", ErrInvalidOperation, op.Type)
+	}
+	a := tx.sm.approvals.Load()
+	if op.Type == OpTransfer && a != nil && a.above(op.Amount) && tx.ctx.Value(approvedKey{}) == nil {
+		return fmt.Errorf("%w: transfers above %d cannot be part of a transaction", ErrApprovalRequired, a.threshold.Load())
+	}
+	op.ID, op.Time = "", time.Time{}
+	op.Metadata = maps.Clone(op.Metadata)
+	return tx.run(op)
+}
+
+// Balance returns the balance of an account as the operations performed so
+// far leave it.
+func (tx *Tx) Balance(accountId string) (int, error) {
+	return tx.scratch.Balance(accountId)
+}
+
+// Savepoint marks the current point of the transaction under name, so the
+// operations performed after it can be undone with RollbackToSavepoint. A
+// savepoint with the name of an existing one hides it until it is rolled
+// back past.
+func (tx *Tx) Savepoint(name string) {
+	tx.savepoints = append(tx.savepoints, savepoint{
+		name:     name,
+		accounts: maps.Clone(tx.scratch.accounts),
+		statuses: maps.Clone(tx.scratch.statuses),
+		ops:      len(tx.ops),
+	})
+}
+
+// RollbackToSavepoint undoes the operations performed since the savepoint
+// with the given name and forgets the savepoints created after it. The
+// savepoint itself is kept, so it can be rolled back to again.
+func (tx *Tx) RollbackToSavepoint(name string) error {
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		sp := tx.savepoints[i]
+		if sp.name != name {
+			continue
+		}
+
+		tx.scratch.accounts = maps.Clone(sp.accounts)
+		tx.scratch.statuses = maps.Clone(sp.statuses)
+		tx.ops = tx.ops[:sp.ops]
+		tx.savepoints = tx.savepoints[:i+1]
+
+		fmt.Printf("\n\nRolled back to savepoint %s: %v\n", name, tx.scratch.accounts)
+
+		return nil
+	}
+	return fmt.Errorf("%w (%s)", ErrUnknownSavepoint, name)
+}
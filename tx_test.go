@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStateMachineTx(t *testing.T) {
+	tests := []struct {
+		name             string
+		fn               func(tx *Tx) error
+		expectedErr      error
+		expectedAccounts map[string]int
+		expectedOps      int
+	}{
+		{
+			name: "Commit",
+			fn: func(tx *Tx) error {
+				if err := tx.Withdraw("acc1", 100); err != nil {
+					return err
+				}
+				return tx.Transfer("acc1", "acc2", 200)
+			},
+			expectedAccounts: map[string]int{"acc1": 700, "acc2": 700},
+			expectedOps:      2,
+		},
+		{
+			name: "Abort",
+			fn: func(tx *Tx) error {
+				if err := tx.Deposit("acc1", 100); err != nil {
+					return err
+				}
+				return tx.Withdraw("acc2", 5000)
+			},
+			expectedErr:      ErrInsufficientBalance,
+			expectedAccounts: map[string]int{"acc1": 1000, "acc2": 500},
+		},
+		{
+			name: "Rollback to savepoint",
+			fn: func(tx *Tx) error {
+				if err := tx.Deposit("acc1", 100); err != nil {
+					return err
+				}
+				tx.Savepoint("batch")
+				if err := tx.Withdraw("acc2", 400); err != nil {
+					return err
+				}
+				if err := tx.Withdraw("acc2", 400); err == nil {
+					return errors.New("overdraft allowed")
+				}
+				if err := tx.RollbackToSavepoint("batch"); err != nil {
+					return err
+				}
+				return tx.Withdraw("acc2", 300)
+			},
+			expectedAccounts: map[string]int{"acc1": 1100, "acc2": 200},
+			expectedOps:      2,
+		},
+		{
+			name: "Nested savepoints",
+			fn: func(tx *Tx) error {
+				tx.Savepoint("outer")
+				if err := tx.Deposit("acc1", 100); err != nil {
+					return err
+				}
+				tx.Savepoint("inner")
+				if err := tx.Deposit("acc1", 100); err != nil {
+					return err
+				}
+				if err := tx.RollbackToSavepoint("outer"); err != nil {
+					return err
+				}
+				if err := tx.RollbackToSavepoint("inner"); !errors.Is(err, ErrUnknownSavepoint) {
+					return errors.New("savepoint after rolled back one kept")
+				}
+				if balance, err := tx.Balance("acc1"); err != nil || balance != 1000 {
+					return errors.New("balance not restored")
+				}
+				return tx.Deposit("acc2", 1)
+			},
+			expectedAccounts: map[string]int{"acc1": 1000, "acc2": 501},
+			expectedOps:      1,
+		},
+		{
+			name: "Rollback an open to savepoint",
+			fn: func(tx *Tx) error {
+				tx.Savepoint("open")
+				if err := tx.Apply(Operation{Type: OpOpen, To: "acc3", Amount: 10, Status: StatusPending}); err != nil {
+					return err
+				}
+				if err := tx.RollbackToSavepoint("open"); err != nil {
+					return err
+				}
+				if _, ok := tx.scratch.statuses["acc3"]; ok {
+					return errors.New("status of the rolled back account kept")
+				}
+				return tx.Open("acc3", 20)
+			},
+			expectedAccounts: map[string]int{"acc1": 1000, "acc2": 500, "acc3": 20},
+			expectedOps:      1,
+		},
+		{
+			name: "Unknown savepoint",
+			fn: func(tx *Tx) error {
+				return tx.RollbackToSavepoint("nope")
+			},
+			expectedErr:      ErrUnknownSavepoint,
+			expectedAccounts: map[string]int{"acc1": 1000, "acc2": 500},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sm := &StateMachine{
+				accounts: map[string]int{"acc1": 1000, "acc2": 500},
+			}
+
+			if err := sm.Tx(tt.fn); !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("Tx = %v; want %v", err, tt.expectedErr)
+			}
+			for acc, expectedBalance := range tt.expectedAccounts {
+				if sm.accounts[acc] != expectedBalance {
+					t.Errorf("Account %s balance = %d; want %d", acc, sm.accounts[acc], expectedBalance)
+				}
+			}
+			if ops := sm.Operations(); len(ops) != tt.expectedOps {
+				t.Errorf("Operations = %+v; want %d", ops, tt.expectedOps)
+			}
+		})
+	}
+}
+
+func TestStateMachineTxRollback(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000, "acc2": 500},
+	}
+
+	if err := sm.Tx(func(tx *Tx) error {
+		if err := tx.Deposit("acc1", 100); err != nil {
+			return err
+		}
+		return tx.Transfer("acc1", "acc2", 300)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sm.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if sm.accounts["acc1"] != 1000 || sm.accounts["acc2"] != 500 {
+		t.Errorf("Accounts after rollback = %v; want the state before the transaction", sm.accounts)
+	}
+	if ops := sm.Operations(); len(ops) != 0 {
+		t.Errorf("Operations after rollback = %+v; want none", ops)
+	}
+}
+
+func TestStateMachineTxConflict(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 1000},
+	}
+
+	err := sm.Tx(func(tx *Tx) error {
+		if err := tx.Withdraw("acc1", 800); err != nil {
+			return err
+		}
+		// A concurrent withdrawal leaves too little for the transaction.
+		return sm.Withdraw("acc1", 500)
+	})
+	if !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Conflicting Tx = %v; want %v", err, ErrInsufficientBalance)
+	}
+	if sm.accounts["acc1"] != 500 {
+		t.Errorf("Balance = %d; want 500", sm.accounts["acc1"])
+	}
+}
+
+func TestStateMachineTxApprovalRequired(t *testing.T) {
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 10000, "acc2": 0},
+	}
+	sm.RequireApproval(1000, time.Hour)
+
+	err := sm.TxContext(context.Background(), func(tx *Tx) error {
+		return tx.Transfer("acc1", "acc2", 5000)
+	})
+	if !errors.Is(err, ErrApprovalRequired) {
+		t.Errorf("Tx with large transfer = %v; want %v", err, ErrApprovalRequired)
+	}
+	if sm.accounts["acc2"] != 0 {
+		t.Errorf("Balance = %d; want 0", sm.accounts["acc2"])
+	}
+}
+
+func TestStateMachineTxApply(t *testing.T) {
+	quiet(t)
+
+	sm := &StateMachine{
+		accounts: map[string]int{"acc1": 100, "acc2": 0},
+	}
+	err := sm.Tx(func(tx *Tx) error {
+		if err := tx.Apply(Operation{Type: OpRollback}); !errors.Is(err, ErrInvalidOperation) {
+			t.Errorf("Apply(rollback) = %v; want %v", err, ErrInvalidOperation)
+		}
+		return tx.Apply(Operation{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 40, Memo: "rent", Metadata: map[string]string{"invoice": "7"}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops := sm.Operations()
+	if len(ops) != 1 || ops[0].Memo != "rent" || ops[0].Metadata["invoice"] != "7" || sm.accounts["acc2"] != 40 {
+		t.Errorf("Operations() = %+v, balances %v; want the transfer with its memo and metadata", ops, sm.accounts)
+	}
+}
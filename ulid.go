@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"sync"
+	"time"
+)
+
+// crockford is the alphabet of Crockford's base32, used to encode ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulids generates ULIDs: 26 character IDs made of a 48-bit millisecond
+// timestamp and 80 random bits, which sort by the time they were made.
+// Within a millisecond the random bits are incremented rather than drawn
+// again, and a clock going backwards does not move the timestamp back, so
+// IDs from one generator sort in the order they were made. The zero value
+// is ready to use.
+type ulids struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+	source  io.Reader // of the random bits, crypto/rand if nil
+}
+
+// UseRandom makes sm draw the random bits of the IDs it generates from r
+// rather than crypto/rand, e.g. a seeded source so runs can be reproduced. It
+// must be called before operations start.
+func (sm *StateMachine) UseRandom(r io.Reader) {
+	sm.ids.source = r
+}
+
+// next returns a new ULID made at t.
+func (g *ulids) next(t time.Time) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms := uint64(max(t.UnixMilli(), 0))
+	if ms > g.lastMs {
+		g.lastMs = ms
+		if g.source != nil {
+			_, _ = io.ReadFull(g.source, g.entropy[:])
+		} else {
+			_, _ = rand.Read(g.entropy[:])
+		}
+	} else {
+		// Same or earlier millisecond: keep the timestamp and increment.
+		for i := len(g.entropy) - 1; i >= 0; i-- {
+			g.entropy[i]++
+			if g.entropy[i] != 0 {
+				break
+			}
+		}
+	}
+
+	var id [16]byte
+	for i := range 6 {
+		id[i] = byte(g.lastMs >> (40 - 8*i))
+	}
+	copy(id[6:], g.entropy[:])
+	return encodeULID(id)
+}
+
+// encodeULID encodes 128 bits as 26 base32 characters, most significant
+// first, the first character holding only 3 bits.
+func encodeULID(id [16]byte) string {
+	var s [26]byte
+	var acc uint32
+	bits := 2 // 130 bits are encoded, so start with 2 leading zero bits
+	n := 0
+	for _, b := range id {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			s[n] = crockford[acc>>bits&31]
+			n++
+		}
+	}
+	return string(s[:])
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestULIDs(t *testing.T) {
+	var g ulids
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		t    time.Time
+	}{
+		{"First", start},
+		{"Same millisecond", start.Add(time.Microsecond)},
+		{"Later", start.Add(time.Second)},
+		{"Clock went back", start},
+		{"Much later", start.Add(24 * time.Hour)},
+	}
+
+	var ids []string
+	for _, tt := range tests {
+		id := g.next(tt.t)
+		if len(id) != 26 || strings.Trim(id, crockford) != "" {
+			t.Errorf("%s: ID %q; want 26 base32 characters", tt.name, id)
+		}
+		ids = append(ids, id)
+	}
+	if !slices.IsSorted(ids) {
+		t.Errorf("IDs %v; want them sorted in the order they were made", ids)
+	}
+	if len(slices.Compact(slices.Clone(ids))) != len(ids) {
+		t.Errorf("IDs %v; want them unique", ids)
+	}
+
+	// The first 10 characters encode the millisecond timestamp.
+	if prefix := encodeULID([16]byte{0, 0, 0, 0, 0, 1})[:10]; prefix != "0000000001" {
+		t.Errorf("Timestamp 1 encodes as %s; want 0000000001", prefix)
+	}
+	if ids[0][:10] == ids[4][:10] {
+		t.Errorf("IDs %s and %s a day apart share a timestamp", ids[0], ids[4])
+	}
+}
+
+func TestULIDsRandom(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := ulids{source: rand.NewChaCha8([32]byte{1})}
+	b := ulids{source: rand.NewChaCha8([32]byte{1})}
+	for i := range 3 {
+		at := start.Add(time.Duration(i) * time.Second)
+		if idA, idB := a.next(at), b.next(at); idA != idB {
+			t.Fatalf("IDs from the same seed differ: %s and %s", idA, idB)
+		}
+	}
+}
+
+func TestServerOperationIDs(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 1000, "acc2": 500})
+
+	var ids []string
+	for _, req := range []struct{ path, body string }{
+		{"/accounts/acc1/deposit", `{"amount": 100}`},
+		{"/accounts/acc1/withdraw", `{"amount": 50}`},
+		{"/transfers", `{"from": "acc1", "to": "acc2", "amount": 25}`},
+	} {
+		rec := httptest.NewRecorder()
+		srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, req.path, strings.NewReader(req.body)))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST %s = %d; want 200 (%s)", req.path, rec.Code, rec.Body)
+		}
+
+		var resp struct {
+			OperationID string `json:"operation_id"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, resp.OperationID)
+	}
+
+	var recorded []string
+	for _, op := range sm.Operations() {
+		recorded = append(recorded, op.ID)
+	}
+	if !slices.Equal(ids, recorded) {
+		t.Errorf("Returned operation IDs %v; want those in history, %v", ids, recorded)
+	}
+	if !slices.IsSorted(ids) {
+		t.Errorf("Operation IDs %v; want them sorted", ids)
+	}
+}
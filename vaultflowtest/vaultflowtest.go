@@ -0,0 +1,272 @@
+// Package vaultflowtest provides test doubles, assertion helpers and state
+// builders for code using vaultflow state machines.
+//
+// The helpers are written against small interfaces rather than vaultflow's
+// types, so they accept both the real state machine and the Mock.
+package vaultflowtest
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+var (
+	ErrInvalidAccount      = errors.New("invalid account")
+	ErrInsufficientBalance = errors.New("insufficient balance")
+	ErrNothingToRollback   = errors.New("nothing to rollback")
+)
+
+// StateTransitions is the method set of vaultflow's StateTransitions.
+type StateTransitions interface {
+	Deposit(accountId string, amount int) error
+	Withdraw(accountId string, amount int) error
+	Transfer(fromAccountId, toAccountId string, amount int) error
+	Rollback() error
+}
+
+// Balancer reads balances, as the state machine and Mock do.
+type Balancer interface {
+	Balance(accountId string) (int, error)
+}
+
+// HistoryDepther reports how many states can be rolled back, as the state
+// machine and Mock do.
+type HistoryDepther interface {
+	HistoryDepth() int
+}
+
+// Call records a call made to a Mock.
+type Call struct {
+	Method string
+	Args   []any
+	Err    error
+}
+
+// Mock is an in-memory StateTransitions that behaves like the state machine
+// unless scripted otherwise with FailNext or On. It is safe for concurrent
+// use.
+type Mock struct {
+	mu       sync.Mutex
+	accounts map[string]int
+	history  []map[string]int
+	calls    []Call
+	failures map[string][]error
+	handlers map[string]func(args ...any) error
+}
+
+// NewMock returns a mock holding accounts, e.g. built with Accounts.
+func NewMock(accounts map[string]int) *Mock {
+	m := &Mock{
+		accounts: maps.Clone(accounts),
+		failures: map[string][]error{},
+		handlers: map[string]func(args ...any) error{},
+	}
+	if m.accounts == nil {
+		m.accounts = map[string]int{}
+	}
+	return m
+}
+
+// FailNext makes the next call of method, e.g. "Withdraw", fail with err
+// without changing any balance. Calling it again queues further failures.
+func (m *Mock) FailNext(method string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failures[method] = append(m.failures[method], err)
+}
+
+// On replaces the behavior of method with fn, which receives the call's
+// arguments. Balances are left alone; fn may return nil to report success.
+func (m *Mock) On(method string, fn func(args ...any) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[method] = fn
+}
+
+// Calls returns the calls made so far, in order.
+func (m *Mock) Calls() []Call {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Call(nil), m.calls...)
+}
+
+// call runs a method, unless scripted otherwise, and records it.
+func (m *Mock) call(method string, apply func() error, args ...any) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var err error
+	if failures := m.failures[method]; len(failures) > 0 {
+		err, m.failures[method] = failures[0], failures[1:]
+	} else if handler := m.handlers[method]; handler != nil {
+		err = handler(args...)
+	} else {
+		err = apply()
+	}
+
+	m.calls = append(m.calls, Call{Method: method, Args: args, Err: err})
+	return err
+}
+
+func (m *Mock) Deposit(accountId string, amount int) error {
+	return m.call("Deposit", func() error {
+		m.save()
+		if _, ok := m.accounts[accountId]; !ok {
+			return fmt.Errorf("%w (%s) to deposit to", ErrInvalidAccount, accountId)
+		}
+		m.accounts[accountId] += amount
+		return nil
+	}, accountId, amount)
+}
+
+func (m *Mock) Withdraw(accountId string, amount int) error {
+	return m.call("Withdraw", func() error {
+		m.save()
+		balance, ok := m.accounts[accountId]
+		if !ok {
+			return fmt.Errorf("%w (%s) to withdraw from", ErrInvalidAccount, accountId)
+		}
+		if balance < amount {
+			return fmt.Errorf("%w (%d)", ErrInsufficientBalance, balance)
+		}
+		m.accounts[accountId] -= amount
+		return nil
+	}, accountId, amount)
+}
+
+func (m *Mock) Transfer(fromAccountId, toAccountId string, amount int) error {
+	return m.call("Transfer", func() error {
+		m.save()
+		balance, ok := m.accounts[fromAccountId]
+		if !ok {
+			return fmt.Errorf("%w (%s) to transfer from", ErrInvalidAccount, fromAccountId)
+		}
+		if _, ok := m.accounts[toAccountId]; !ok {
+			return fmt.Errorf("%w (%s) to transfer to", ErrInvalidAccount, toAccountId)
+		}
+		if balance < amount {
+			return fmt.Errorf("%w (%d) to transfer (%d) from", ErrInsufficientBalance, balance, amount)
+		}
+		m.accounts[fromAccountId] -= amount
+		m.accounts[toAccountId] += amount
+		return nil
+	}, fromAccountId, toAccountId, amount)
+}
+
+func (m *Mock) Rollback() error {
+	return m.call("Rollback", func() error {
+		if len(m.history) == 0 {
+			return ErrNothingToRollback
+		}
+		m.accounts = m.history[len(m.history)-1]
+		m.history = m.history[:len(m.history)-1]
+		return nil
+	})
+}
+
+// save records the current state for rollback. Like the state machine, the
+// mock saves the state before every operation, even one that then fails.
+func (m *Mock) save() {
+	m.history = append(m.history, maps.Clone(m.accounts))
+}
+
+func (m *Mock) Balance(accountId string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	balance, ok := m.accounts[accountId]
+	if !ok {
+		return 0, fmt.Errorf("%w (%s)", ErrInvalidAccount, accountId)
+	}
+	return balance, nil
+}
+
+func (m *Mock) HistoryDepth() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.history)
+}
+
+// ExpectBalance fails the test unless accountId has the expected balance.
+func ExpectBalance(t testing.TB, b Balancer, accountId string, expected int) {
+	t.Helper()
+
+	balance, err := b.Balance(accountId)
+	if err != nil {
+		t.Errorf("Balance(%s) failed: %v", accountId, err)
+		return
+	}
+	if balance != expected {
+		t.Errorf("Account %s balance = %d; want %d", accountId, balance, expected)
+	}
+}
+
+// ExpectBalances calls ExpectBalance for every account in expected.
+func ExpectBalances(t testing.TB, b Balancer, expected map[string]int) {
+	t.Helper()
+
+	ids := make([]string, 0, len(expected))
+	for id := range expected {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		ExpectBalance(t, b, id, expected[id])
+	}
+}
+
+// ExpectHistoryDepth fails the test unless h can roll back exactly expected
+// states.
+func ExpectHistoryDepth(t testing.TB, h HistoryDepther, expected int) {
+	t.Helper()
+
+	if depth := h.HistoryDepth(); depth != expected {
+		t.Errorf("History depth = %d; want %d", depth, expected)
+	}
+}
+
+// AccountsBuilder builds the initial balances of a test.
+type AccountsBuilder struct {
+	accounts map[string]int
+}
+
+// Accounts starts a set of balances, e.g.
+//
+//	accounts := vaultflowtest.Accounts().With("acc1", 1000).With("acc2", 500).Build()
+func Accounts() *AccountsBuilder {
+	return &AccountsBuilder{accounts: map[string]int{}}
+}
+
+func (b *AccountsBuilder) With(accountId string, balance int) *AccountsBuilder {
+	b.accounts[accountId] = balance
+	return b
+}
+
+// Numbered adds n accounts named prefix1 to prefixN, each holding balance.
+func (b *AccountsBuilder) Numbered(prefix string, n, balance int) *AccountsBuilder {
+	for i := 1; i <= n; i++ {
+		b.accounts[prefix+strconv.Itoa(i)] = balance
+	}
+	return b
+}
+
+// Seeded adds n accounts named prefix1 to prefixN with balances below max
+// chosen by seed, so the same seed always builds the same state.
+func (b *AccountsBuilder) Seeded(seed uint64, prefix string, n, max int) *AccountsBuilder {
+	rng := rand.New(rand.NewPCG(seed, seed))
+	for i := 1; i <= n; i++ {
+		b.accounts[prefix+strconv.Itoa(i)] = rng.IntN(max)
+	}
+	return b
+}
+
+// Build returns a copy of the balances, so a builder can seed several tests.
+func (b *AccountsBuilder) Build() map[string]int {
+	return maps.Clone(b.accounts)
+}
@@ -0,0 +1,149 @@
+package vaultflowtest
+
+import (
+	"errors"
+	"maps"
+	"testing"
+)
+
+func TestMock(t *testing.T) {
+	m := NewMock(Accounts().With("acc1", 1000).With("acc2", 500).Build())
+
+	if err := m.Deposit("acc1", 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Transfer("acc1", "acc2", 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Withdraw("acc2", 5000); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Overdraft = %v; want %v", err, ErrInsufficientBalance)
+	}
+	if err := m.Deposit("nope", 1); !errors.Is(err, ErrInvalidAccount) {
+		t.Errorf("Deposit to unknown account = %v; want %v", err, ErrInvalidAccount)
+	}
+
+	ExpectBalances(t, m, map[string]int{"acc1": 900, "acc2": 800})
+	ExpectHistoryDepth(t, m, 4)
+
+	for range 4 {
+		if err := m.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ExpectBalances(t, m, map[string]int{"acc1": 1000, "acc2": 500})
+	if err := m.Rollback(); !errors.Is(err, ErrNothingToRollback) {
+		t.Errorf("Rollback of empty history = %v; want %v", err, ErrNothingToRollback)
+	}
+}
+
+func TestExpectAfterRollback(t *testing.T) {
+	m := NewMock(Accounts().With("acc1", 1000).With("acc2", 500).Build())
+
+	if err := m.Deposit("acc1", 200); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Withdraw("acc2", 100); err != nil {
+		t.Fatal(err)
+	}
+	ExpectBalances(t, m, map[string]int{"acc1": 1200, "acc2": 400})
+	ExpectHistoryDepth(t, m, 2)
+
+	for range 2 {
+		if err := m.Rollback(); err != nil {
+			t.Fatalf("Rollback failed: %v", err)
+		}
+	}
+	ExpectBalances(t, m, map[string]int{"acc1": 1000, "acc2": 500})
+	ExpectHistoryDepth(t, m, 0)
+}
+
+func TestMockScripted(t *testing.T) {
+	m := NewMock(Accounts().With("acc1", 100).Build())
+	errDown := errors.New("storage down")
+
+	m.FailNext("Withdraw", errDown)
+	if err := m.Withdraw("acc1", 10); !errors.Is(err, errDown) {
+		t.Errorf("Scripted Withdraw = %v; want %v", err, errDown)
+	}
+	if err := m.Withdraw("acc1", 10); err != nil {
+		t.Errorf("Withdraw after the scripted failure = %v; want nil", err)
+	}
+
+	var deposited []any
+	m.On("Deposit", func(args ...any) error {
+		deposited = args
+		return nil
+	})
+	if err := m.Deposit("acc1", 50); err != nil {
+		t.Fatal(err)
+	}
+	if len(deposited) != 2 || deposited[0] != "acc1" || deposited[1] != 50 {
+		t.Errorf("Deposit handler got %v; want [acc1 50]", deposited)
+	}
+	ExpectBalance(t, m, "acc1", 90)
+
+	calls := m.Calls()
+	if len(calls) != 3 || calls[0].Method != "Withdraw" || !errors.Is(calls[0].Err, errDown) || calls[2].Method != "Deposit" {
+		t.Errorf("Calls = %+v; want the failed and successful withdrawals and the deposit", calls)
+	}
+}
+
+func TestAccountsBuilder(t *testing.T) {
+	b := Accounts().With("main", 7).Numbered("acc", 3, 100)
+	expected := map[string]int{"main": 7, "acc1": 100, "acc2": 100, "acc3": 100}
+	if accounts := b.Build(); !maps.Equal(accounts, expected) {
+		t.Errorf("Build = %v; want %v", accounts, expected)
+	}
+
+	first := Accounts().Seeded(9, "acc", 5, 1000).Build()
+	second := Accounts().Seeded(9, "acc", 5, 1000).Build()
+	if len(first) != 5 || !maps.Equal(first, second) {
+		t.Errorf("Seeded builds %v and %v; want the same 5 accounts", first, second)
+	}
+	for id, balance := range first {
+		if balance < 0 || balance >= 1000 {
+			t.Errorf("Account %s balance = %d; want in [0, 1000)", id, balance)
+		}
+	}
+
+	built := b.Build()
+	built["main"] = 0
+	if b.Build()["main"] != 7 {
+		t.Errorf("Changing a built state changed the builder")
+	}
+}
+
+func TestExpectFailures(t *testing.T) {
+	m := NewMock(Accounts().With("acc1", 1).Build())
+
+	tests := []struct {
+		name   string
+		expect func(t testing.TB)
+	}{
+		{name: "Wrong balance", expect: func(t testing.TB) { ExpectBalance(t, m, "acc1", 2) }},
+		{name: "Unknown account", expect: func(t testing.TB) { ExpectBalance(t, m, "nope", 0) }},
+		{name: "Wrong depth", expect: func(t testing.TB) { ExpectHistoryDepth(t, m, 1) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recordingTB{TB: t}
+			tt.expect(rec)
+			if !rec.failed {
+				t.Errorf("%s did not fail the test", tt.name)
+			}
+		})
+	}
+}
+
+// recordingTB records failures instead of failing the test.
+type recordingTB struct {
+	testing.TB
+	failed bool
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.failed = true
+}
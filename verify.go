@@ -0,0 +1,380 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/Olusamimaths/vaultflow/config"
+)
+
+// Sources of the states the journal is replayed against, see Verify.
+const (
+	SourceJournal  = "journal"  // an operation that could not be replayed
+	SourceHistory  = "history"  // the rollback history
+	SourceSnapshot = "snapshot" // the current balances
+	SourceLive     = "live"     // the state published to readers
+)
+
+// BalanceMismatch is an account whose replayed balance differs from the one
+// recorded. A nil balance is an account that does not exist.
+type BalanceMismatch struct {
+	Account  string `json:"account"`
+	Replayed *int   `json:"replayed"`
+	Recorded *int   `json:"recorded"`
+}
+
+// Divergence is a range of versions over which a recorded state stopped
+// matching the replayed journal: they agreed at From and no longer at To, so
+// one of the operations producing the versions after From up to To is at
+// fault, or the record itself.
+type Divergence struct {
+	Source     string            `json:"source"`
+	From       int               `json:"from"`
+	To         int               `json:"to"`
+	Operation  string            `json:"operation,omitempty"` // ID of the operation that could not be replayed
+	Error      string            `json:"error,omitempty"`
+	Mismatches []BalanceMismatch `json:"mismatches,omitempty"`
+}
+
+// VerificationReport is the outcome of replaying the journal, see Verify.
+type VerificationReport struct {
+	From        int          `json:"from"`       // oldest version in history, replayed from
+	To          int          `json:"to"`         // version of the current state
+	Operations  int          `json:"operations"` // replayed
+	Skipped     int          `json:"skipped"`    // states left by pruned operations, not replayed
+	Divergences []Divergence `json:"divergences"`
+}
+
+// Verified reports whether every record agreed with the replayed journal.
+func (r *VerificationReport) Verified() bool {
+	return len(r.Divergences) == 0
+}
+
+// Verify checks that the records of the state agree: it replays the journal
+// from the oldest state in history, recomputing the balances, and compares
+// them with every state in history, with the current balances and with the
+// state published to readers. After a divergence the replay carries on from
+// the recorded state, so each one is reported with the range of versions it
+// arose in. The state is copied under the lock, and replayed without it.
+func (sm *StateMachine) Verify() (VerificationReport, error) {
+	sm.mu.Lock()
+	data, err := json.Marshal(sm.backup())
+	live := sm.state.Load()
+	if live == nil {
+		live = sm.storeState()
+	}
+	sm.mu.Unlock()
+	if err != nil {
+		return VerificationReport{}, err
+	}
+
+	var backup backupFile
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return VerificationReport{}, err
+	}
+	return backup.verify(live), nil
+}
+
+// VerifyBackup is Verify for a backup written by Backup, which has no live
+// state.
+func VerifyBackup(r io.Reader) (VerificationReport, error) {
+	backup, err := readBackup(r)
+	if err != nil {
+		return VerificationReport{}, err
+	}
+	return backup.verify(nil), nil
+}
+
+func (b *backupFile) verify(live *State) VerificationReport {
+	report := VerificationReport{From: b.Version, To: b.Version, Divergences: []Divergence{}}
+	entries := b.history().entries
+	if len(entries) > 0 {
+		report.From = entries[0].version
+	}
+
+	replay := b.replayer(report.From)
+	agreed := newAgreement(report.From)
+	next := 0 // the next operation to replay
+	for next < len(b.Operations) && b.Operations[next].Version <= report.From {
+		next++
+	}
+
+	for i := 1; i <= len(entries); i++ {
+		source, version := SourceSnapshot, b.Version
+		recorded, absent, full := b.Snapshot.Accounts, []string(nil), true
+		if i < len(entries) {
+			source, version = SourceHistory, entries[i].version
+			recorded, absent, full = entries[i].balances, entries[i].absent, entries[i].full
+		}
+		previous := entries[i-1]
+
+		// Pruned operations cannot be replayed: the replay skips to the
+		// state they left.
+		if (next == len(b.Operations) || b.Operations[next].Version > previous.version+1) && b.pruned(previous) {
+			for next < len(b.Operations) && b.Operations[next].Version <= version {
+				next++
+			}
+			replay.accounts = b.stateAt(version)
+			agreed = newAgreement(version)
+			report.Skipped++
+			continue
+		}
+
+		failed := false
+		for ; next < len(b.Operations) && b.Operations[next].Version <= version; next++ {
+			op := b.Operations[next]
+			if failed {
+				continue
+			}
+			if err := replay.apply(op); err != nil {
+				report.Divergences = append(report.Divergences, Divergence{Source: SourceJournal, From: agreed.since(op.accounts()...), To: op.Version, Operation: op.ID, Error: err.Error()})
+				failed = true
+				continue
+			}
+			replay.journalOperation(op)
+			report.Operations++
+		}
+		if failed {
+			replay.accounts = b.stateAt(version)
+			agreed = newAgreement(version)
+			continue
+		}
+
+		if mismatches := diffBalances(replay.accounts, recorded, absent, full); len(mismatches) > 0 {
+			ids := make([]string, len(mismatches))
+			for j, mismatch := range mismatches {
+				ids[j] = mismatch.Account
+			}
+			report.Divergences = append(report.Divergences, Divergence{Source: source, From: agreed.since(ids...), To: version, Mismatches: mismatches})
+			for _, mismatch := range mismatches {
+				if mismatch.Recorded != nil {
+					replay.accounts[mismatch.Account] = *mismatch.Recorded
+				} else {
+					delete(replay.accounts, mismatch.Account)
+				}
+			}
+		}
+		agreed.at(version, recorded, absent, full)
+	}
+
+	if live != nil {
+		if live.Version() != b.Version {
+			report.Divergences = append(report.Divergences, Divergence{Source: SourceLive, From: agreed.base, To: live.Version(),
+				Error: fmt.Sprintf("published at version %d, the state is at %d", live.Version(), b.Version)})
+		} else if mismatches := diffBalances(live.Balances(), accountBalances(b.Snapshot.Accounts), nil, true); len(mismatches) > 0 {
+			report.Divergences = append(report.Divergences, Divergence{Source: SourceLive, From: b.Version, To: b.Version, Mismatches: mismatches})
+		}
+	}
+	return report
+}
+
+// agreement tracks the last version each account was checked at: a history
+// delta only records the accounts an operation touched.
+type agreement struct {
+	base    int // when every account was last checked
+	checked map[string]int
+}
+
+func newAgreement(version int) *agreement {
+	return &agreement{base: version, checked: map[string]int{}}
+}
+
+// at records the accounts checked at version: the recorded and absent ones,
+// or every one if the record is full.
+func (a *agreement) at(version int, recorded map[string]int, absent []string, full bool) {
+	if full {
+		*a = *newAgreement(version)
+		return
+	}
+	for id := range recorded {
+		a.checked[id] = version
+	}
+	for _, id := range absent {
+		a.checked[id] = version
+	}
+}
+
+// since returns the earliest version the accounts were last checked at.
+func (a *agreement) since(ids ...string) int {
+	version := -1
+	for _, id := range ids {
+		checked, ok := a.checked[id]
+		if !ok {
+			checked = a.base
+		}
+		if version < 0 || checked < version {
+			version = checked
+		}
+	}
+	if version < 0 {
+		return a.base
+	}
+	return version
+}
+
+// stateAt returns the balances at version as the history and current
+// balances of the backup record them.
+func (b *backupFile) stateAt(version int) map[string]int {
+	current := maps.Clone(b.Snapshot.Accounts)
+	if current == nil {
+		current = map[string]int{}
+	}
+	if version == b.Version {
+		return current
+	}
+	history := b.history()
+	accounts, err := history.restore(current, version)
+	if err != nil {
+		return current // not reached: version is in history
+	}
+	return accounts
+}
+
+// replayer returns a scratch state machine at version to replay operations
+// on, as transactions do. It knows the operations before version, which
+// later ones may reverse, the statuses, and the accounts archived that are
+// not open at version.
+func (b *backupFile) replayer(version int) *StateMachine {
+	replay := &StateMachine{
+		accounts: b.stateAt(version),
+		statuses: maps.Clone(b.Snapshot.Statuses),
+	}
+	for _, op := range b.Operations {
+		if op.Version <= version {
+			replay.journalOperation(op)
+		}
+	}
+	for _, archived := range b.Snapshot.Archived {
+		if _, open := replay.accounts[archived.ID]; !open {
+			if replay.archived == nil {
+				replay.archived = map[string]ArchivedAccount{}
+			}
+			replay.archived[archived.ID] = archived
+		}
+	}
+	return replay
+}
+
+// pruned reports whether the operation that moved the state on from entry
+// was pruned: a tombstone covers its time and one of its accounts.
+func (b *backupFile) pruned(entry historyEntry) bool {
+	for _, tombstone := range b.Tombstones {
+		if !entry.saved.Before(tombstone.Before) {
+			continue
+		}
+		for _, id := range tombstone.Accounts {
+			if _, ok := entry.balances[id]; ok || slices.Contains(entry.absent, id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// accountBalances returns the balances of accounts without those of their
+// buckets, as the published state holds them.
+func accountBalances(accounts map[string]int) map[string]int {
+	balances := maps.Clone(accounts)
+	maps.DeleteFunc(balances, func(id string, _ int) bool { return isBucketKey(id) })
+	return balances
+}
+
+// diffBalances returns the accounts whose replayed balances differ from
+// those recorded, sorted. Only the recorded and absent accounts are
+// compared, unless the record is full.
+func diffBalances(replayed, recorded map[string]int, absent []string, full bool) []BalanceMismatch {
+	ids := slices.Collect(maps.Keys(recorded))
+	ids = append(ids, absent...)
+	if full {
+		for id := range replayed {
+			if _, ok := recorded[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	var mismatches []BalanceMismatch
+	for _, id := range ids {
+		got, inReplay := replayed[id]
+		want, inRecord := recorded[id]
+		if inReplay == inRecord && got == want {
+			continue
+		}
+		mismatch := BalanceMismatch{Account: id}
+		if inReplay {
+			mismatch.Replayed = &got
+		}
+		if inRecord {
+			mismatch.Recorded = &want
+		}
+		mismatches = append(mismatches, mismatch)
+	}
+	slices.SortFunc(mismatches, func(a, b BalanceMismatch) int { return cmp.Compare(a.Account, b.Account) })
+	return mismatches
+}
+
+// runVerify implements "vaultflow verify": it verifies a backup file, or a
+// running instance, and fails if anything diverged.
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	addr := flags.String("addr", "", "base URL of an instance to verify, instead of a backup file")
+	apiKey := flags.String("api-key", os.Getenv(config.EnvPrefix+"API_KEY"), "admin API key, sent as X-API-Key")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: vaultflow verify [-addr url] [-api-key key] [file]")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if (*addr == "") == (flags.NArg() == 0) || flags.NArg() > 1 {
+		flags.Usage()
+		return fmt.Errorf("want a backup file or an instance to verify")
+	}
+
+	var report VerificationReport
+	if *addr != "" {
+		req, err := http.NewRequest(http.MethodGet, *addr+"/verify", nil)
+		if err != nil {
+			return err
+		}
+		if *apiKey != "" {
+			req.Header.Set("X-API-Key", *apiKey)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s answered %s", *addr, resp.Status)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			return fmt.Errorf("decode report: %w", err)
+		}
+	} else {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		report, err = VerifyBackup(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	if !report.Verified() {
+		return fmt.Errorf("%d divergences between versions %d and %d", len(report.Divergences), report.From, report.To)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// verifiedMachine returns a state machine whose history covers each kind of
+// state change: operations, failed ones, a transaction and a rollback.
+func verifiedMachine(t *testing.T) *StateMachine {
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 500}}
+	_ = sm.Deposit("acc1", 100)                          // version 1
+	_ = sm.OpenAccount("acc3", 30)                       // version 2
+	_ = sm.Withdraw("acc2", 10000)                       // version 3, failed
+	_ = sm.Transfer("acc1", "acc3", 200)                 // version 4
+	_ = sm.Deposit("acc2", 1)                            // version 5
+	_ = sm.Rollback()                                    // back to version 4
+	_ = sm.Move("acc1", BucketAvailable, "reserved", 50) // version 5
+	err := sm.Tx(func(tx *Tx) error {                    // version 6
+		if err := tx.Withdraw("acc3", 30); err != nil {
+			return err
+		}
+		return tx.Deposit("acc2", 30)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sm.Version() != 6 {
+		t.Fatalf("Version() = %d; want 6", sm.Version())
+	}
+	return sm
+}
+
+// backupOf returns a decoded backup of sm.
+func backupOf(t *testing.T, sm *StateMachine) backupFile {
+	var buf bytes.Buffer
+	if err := sm.Backup(&buf); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := readBackup(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backup
+}
+
+func TestVerify(t *testing.T) {
+	quiet(t)
+
+	sm := verifiedMachine(t)
+	report, err := sm.Verify()
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if !report.Verified() || report.From != 0 || report.To != 6 || report.Operations != 6 {
+		t.Errorf("Verify() = %+v; want 6 operations from 0 to 6 verified", report)
+	}
+
+	// A rejected operation saves a state, whose version readers see too.
+	_ = sm.Withdraw("acc2", 10000)
+	if report, _ := sm.Verify(); !report.Verified() || report.To != 7 || sm.State().Version() != 7 {
+		t.Errorf("Verify() after a rejected operation = %+v; want verified up to 7", report)
+	}
+
+	// A published state that differs from the balances.
+	sm.state.Store(newState(map[string]int{"acc1": 1}, nil))
+	report, _ = sm.Verify()
+	if len(report.Divergences) != 1 || report.Divergences[0].Source != SourceLive {
+		t.Errorf("Verify() of a diverging published state = %+v; want a live divergence", report.Divergences)
+	}
+}
+
+func TestVerifyDivergences(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		name     string
+		tamper   func(b *backupFile)
+		expected []Divergence
+	}{
+		{"Consistent", func(b *backupFile) {}, nil},
+		// The replay carries on from the altered record, which the next
+		// record of the account then disagrees with.
+		{"Altered history", func(b *backupFile) { b.History[2].Balances["acc3"] = 31 }, []Divergence{
+			{Source: SourceHistory, From: 1, To: 2, Mismatches: []BalanceMismatch{{Account: "acc3", Replayed: ptr(30), Recorded: ptr(31)}}},
+			{Source: SourceHistory, From: 2, To: 3, Mismatches: []BalanceMismatch{{Account: "acc3", Replayed: ptr(31), Recorded: ptr(30)}}},
+		}},
+		{"Altered balance", func(b *backupFile) { b.Snapshot.Accounts["acc2"] = 0 }, []Divergence{
+			{Source: SourceSnapshot, From: 5, To: 6, Mismatches: []BalanceMismatch{{Account: "acc2", Replayed: ptr(530), Recorded: ptr(0)}}},
+		}},
+		{"Altered operation", func(b *backupFile) { b.Operations[0].Amount = 99 }, []Divergence{
+			{Source: SourceHistory, From: 0, To: 3, Mismatches: []BalanceMismatch{{Account: "acc1", Replayed: ptr(1099), Recorded: ptr(1100)}}},
+		}},
+		{"Operation that cannot be replayed", func(b *backupFile) { b.Operations[2].Amount = 5000 }, []Divergence{
+			{Source: SourceJournal, From: 3, To: 4},
+		}},
+	}
+
+	sm := verifiedMachine(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backup := backupOf(t, sm)
+			tt.tamper(&backup)
+			report := backup.verify(nil)
+
+			if len(report.Divergences) != len(tt.expected) {
+				t.Fatalf("verify() = %+v; want %d divergences", report.Divergences, len(tt.expected))
+			}
+			for i, d := range report.Divergences {
+				want := tt.expected[i]
+				if d.Source != want.Source || d.From != want.From || d.To != want.To {
+					t.Errorf("divergence %d = %s from %d to %d; want %s from %d to %d", i, d.Source, d.From, d.To, want.Source, want.From, want.To)
+				}
+				if want.Mismatches != nil && mustJSON(d.Mismatches) != mustJSON(want.Mismatches) {
+					t.Errorf("divergence %d mismatches = %s; want %s", i, mustJSON(d.Mismatches), mustJSON(want.Mismatches))
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyCommand(t *testing.T) {
+	quiet(t)
+
+	srv, sm := newTestServer(map[string]int{"acc1": 1000})
+	_ = sm.Deposit("acc1", 1)
+	ts := httptest.NewServer(srv.Handler())
+	defer ts.Close()
+
+	if err := runVerify([]string{"-addr", ts.URL}); err != nil {
+		t.Errorf("runVerify(-addr) error = %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.json")
+	backup := backupOf(t, sm)
+	backup.Snapshot.Accounts["acc1"] = 0
+	data, _ := json.Marshal(backup)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := runVerify([]string{path}); err == nil {
+		t.Errorf("runVerify() of a diverging backup succeeded; want an error")
+	}
+}
+
+func ptr(n int) *int {
+	return &n
+}
+
+func mustJSON(v any) string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,892 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrWALCorrupt is matched by a WALCorruptError.
+	ErrWALCorrupt = errors.New("write-ahead log is corrupt")
+	// ErrWALFailed is returned for operations once the write-ahead log
+	// failed to record one, as they would not be durable.
+	ErrWALFailed = errors.New("write-ahead log failed")
+	// ErrWALDisabled is returned for the status of a write-ahead log when
+	// none is used.
+	ErrWALDisabled = errors.New("write-ahead log disabled")
+	// ErrInvalidSyncPolicy is returned for an unknown SyncPolicy.
+	ErrInvalidSyncPolicy = errors.New("invalid sync policy")
+)
+
+// WALCorruptError locates a record of the write-ahead log that does not
+// match its checksum, or a segment that does not match its footer.
+type WALCorruptError struct {
+	Segment string
+	Offset  int64
+	Reason  string
+}
+
+func (e *WALCorruptError) Error() string {
+	return fmt.Sprintf("%s: %s at byte %d: %s", ErrWALCorrupt, e.Segment, e.Offset, e.Reason)
+}
+
+func (e *WALCorruptError) Is(target error) bool {
+	return target == ErrWALCorrupt
+}
+
+// The layout of a segment: walMagic, then records of a length, the CRC32C
+// of the payload and the payload, an event encoded as JSON. A sealed
+// segment ends with a footer: walFooterMarker where a length would be, the
+// number of records, the versions of the first and last ones, the CRC32C of
+// every record and that of the footer itself.
+var walMagic = []byte("VFWAL\x00\x00\x01")
+
+const (
+	walFooterMarker = 0xffffffff
+	walHeaderSize   = 8  // length and checksum of a record
+	walFooterSize   = 36 // marker, count, first, last, records CRC, footer CRC
+	walMaxRecord    = 64 << 20
+	walSegmentExt   = ".wal"
+
+	defaultSegmentSize  = 64 << 20
+	defaultSyncInterval = 10 * time.Millisecond
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// SyncPolicy is when a write-ahead log flushes its records to disk, which
+// trades the durability of acknowledged operations for throughput.
+type SyncPolicy string
+
+const (
+	// SyncAlways flushes every record before its operation is
+	// acknowledged, so a crash loses none. Operations waiting at the same
+	// time share a flush, see WAL.Sync.
+	SyncAlways SyncPolicy = "always"
+	// SyncBatch flushes the records written within SyncInterval together,
+	// so a crash of the machine loses at most the operations acknowledged
+	// in the last interval.
+	SyncBatch SyncPolicy = "batch"
+	// SyncAsync leaves flushing to the operating system, so a crash of the
+	// process loses nothing but one of the machine loses what it had not
+	// flushed yet.
+	SyncAsync SyncPolicy = "async"
+)
+
+// ParseSyncPolicy parses the name of a sync policy, SyncAlways if empty.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch p := SyncPolicy(name); p {
+	case "":
+		return SyncAlways, nil
+	case SyncAlways, SyncBatch, SyncAsync:
+		return p, nil
+	}
+	return "", fmt.Errorf("%w: %q, want always, batch or async", ErrInvalidSyncPolicy, name)
+}
+
+// WALOptions configure when a write-ahead log rotates to a new segment:
+// once the current one holds SegmentSize bytes, 64 MiB if 0, or is older
+// than SegmentAge, if set, by Clock, WallClock if nil. Records are flushed
+// to disk as Sync says, SyncAlways if empty, every SyncInterval, 10ms if 0,
+// with SyncBatch. With SyncAlways, a flush waits GroupWindow, if set, for
+// more operations to share it. Records are sealed with Encryptor, if set,
+// so balances and memos are not on disk in plaintext; plaintext records
+// written before it was set still read.
+type WALOptions struct {
+	SegmentSize  int64
+	SegmentAge   time.Duration
+	Clock        Clock
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+	GroupWindow  time.Duration
+	Encryptor    *Encryptor
+}
+
+// walAAD binds sealed records to the write-ahead log, so a sealed record
+// cannot pass for a sealed snapshot or the other way around.
+var walAAD = []byte("vaultflow-wal")
+
+// WALFlushStats measure the flushes of a write-ahead log to disk: their
+// number and latency, and the number of records each made durable.
+type WALFlushStats struct {
+	Flushes     int           `json:"flushes"`
+	Records     int           `json:"records"`
+	MaxBatch    int           `json:"max_batch"`
+	LastLatency time.Duration `json:"last_latency"`
+	MeanLatency time.Duration `json:"mean_latency"`
+	MaxLatency  time.Duration `json:"max_latency"`
+}
+
+// WALStatus describes a write-ahead log, see WAL.Status.
+type WALStatus struct {
+	Sync     SyncPolicy    `json:"sync"`
+	Segments []WALSegment  `json:"segments"`
+	Flush    WALFlushStats `json:"flush"`
+}
+
+// WALSegment describes a segment of a write-ahead log.
+type WALSegment struct {
+	Name         string `json:"name"`
+	Records      int    `json:"records"`
+	FirstVersion int    `json:"first_version"` // of the first record, 0 if none
+	LastVersion  int    `json:"last_version"`
+	Sealed       bool   `json:"sealed"` // no longer written, see ArchiveSegments
+}
+
+// WAL is a write-ahead log of the events of applied operations, split in
+// segments rotated by size and age. See UseWAL.
+type WAL struct {
+	dir  string
+	opts WALOptions
+
+	mu       sync.Mutex
+	segments []WALSegment // oldest first, the last one being written
+	file     *os.File
+	size     int64
+	crc      uint32    // of the records of the current segment
+	created  time.Time // of the current segment
+	err      error     // of the first failed append, see Err
+	pending  int       // records written but not flushed yet
+	written  uint64    // records appended since opened, see Written
+	synced   uint64    // of those, the ones flushed
+	failed   uint64    // the first one lost to a failure, if any
+	flushing bool      // by the leader of a group, see Sync
+	flushed  *sync.Cond
+	stats    WALFlushStats
+	latency  time.Duration // of every flush, for the mean
+	stop     chan struct{} // stops the flushes of SyncBatch
+	done     chan struct{}
+}
+
+// OpenWAL opens the write-ahead log in dir, creating it if needed. Every
+// segment is checked: a record not matching its checksum fails with a
+// WALCorruptError, unless it is the torn tail of the last segment, left by
+// a crash during a write, which is truncated. Appends go to a new segment.
+func OpenWAL(dir string, opts WALOptions) (*WAL, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.Clock == nil {
+		opts.Clock = WallClock
+	}
+	if opts.Sync == "" {
+		opts.Sync = SyncAlways
+	}
+	if _, err := ParseSyncPolicy(string(opts.Sync)); err != nil {
+		return nil, err
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = defaultSyncInterval
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	w := &WAL{dir: dir, opts: opts}
+	w.flushed = sync.NewCond(&w.mu)
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+walSegmentExt))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(names)
+	for i, path := range names {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		segment, tornAt, err := scanSegment(filepath.Base(path), data, i == len(names)-1, opts.Encryptor, nil)
+		if err != nil {
+			return nil, err
+		}
+		if tornAt >= 0 && tornAt < int64(len(walMagic)) {
+			fmt.Printf("WAL: removing %s, torn while created\n", segment.Name)
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if tornAt >= 0 {
+			fmt.Printf("WAL: truncating the torn tail of %s at byte %d\n", segment.Name, tornAt)
+			if err := os.Truncate(path, tornAt); err != nil {
+				return nil, err
+			}
+		}
+		w.segments = append(w.segments, segment)
+	}
+
+	if n := len(w.segments); n > 0 && !w.segments[n-1].Sealed {
+		// Seal the segment a crash left open, so segments are only ever
+		// appended to by the process that created them.
+		if err := w.sealFile(&w.segments[n-1]); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.rotate(); err != nil {
+		return nil, err
+	}
+	if opts.Sync == SyncBatch {
+		w.stop, w.done = make(chan struct{}), make(chan struct{})
+		go w.flushEvery(opts.SyncInterval)
+	}
+	return w, nil
+}
+
+// scanSegment reads the segment name holding data, opening sealed records
+// with enc, calling fn, if not nil, with each event. It returns where the
+// torn tail of the last segment starts, -1 if it has none.
+func scanSegment(name string, data []byte, last bool, enc *Encryptor, fn func(Event) error) (WALSegment, int64, error) {
+	segment := WALSegment{Name: name}
+	corrupt := func(offset int, reason string, args ...any) error {
+		return &WALCorruptError{Segment: segment.Name, Offset: int64(offset), Reason: fmt.Sprintf(reason, args...)}
+	}
+	if !bytes.HasPrefix(data, walMagic) {
+		if last && len(data) < len(walMagic) && bytes.HasPrefix(walMagic, data) {
+			return segment, 0, nil // torn while created
+		}
+		return segment, -1, corrupt(0, "not a segment")
+	}
+
+	var crc uint32
+	offset := len(walMagic)
+	for offset < len(data) {
+		rest := data[offset:]
+		if len(rest) >= 4 && binary.BigEndian.Uint32(rest) == walFooterMarker {
+			if len(rest) != walFooterSize {
+				return segment, -1, corrupt(offset, "footer of %d bytes", len(rest))
+			}
+			if binary.BigEndian.Uint32(rest[32:]) != crc32.Checksum(rest[:32], castagnoli) {
+				return segment, -1, corrupt(offset, "footer checksum mismatch")
+			}
+			count := int(binary.BigEndian.Uint64(rest[4:]))
+			first, lastVersion := int(binary.BigEndian.Uint64(rest[12:])), int(binary.BigEndian.Uint64(rest[20:]))
+			if count != segment.Records || first != segment.FirstVersion || lastVersion != segment.LastVersion ||
+				binary.BigEndian.Uint32(rest[28:]) != crc {
+				return segment, -1, corrupt(offset, "footer of %d records, versions %d to %d, does not match them", count, first, lastVersion)
+			}
+			segment.Sealed = true
+			return segment, -1, nil
+		}
+
+		torn := func(reason string, args ...any) (WALSegment, int64, error) {
+			// Only the last record of the last segment may be incomplete.
+			if last {
+				return segment, int64(offset), nil
+			}
+			return segment, -1, corrupt(offset, reason, args...)
+		}
+		if len(rest) < walHeaderSize {
+			return torn("truncated record header")
+		}
+		length := binary.BigEndian.Uint32(rest)
+		if length > walMaxRecord {
+			return segment, -1, corrupt(offset, "record of %d bytes", length)
+		}
+		end := walHeaderSize + int(length)
+		if len(rest) < end {
+			return torn("record of %d bytes truncated", length)
+		}
+		payload := rest[walHeaderSize:end]
+		if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(rest[4:]) {
+			if last && len(rest) == end {
+				return torn("record checksum mismatch")
+			}
+			return segment, -1, corrupt(offset, "record checksum mismatch")
+		}
+
+		if IsSealed(payload) {
+			if enc == nil {
+				return segment, -1, fmt.Errorf("%s: record at byte %d is encrypted but no encryptor was given", segment.Name, offset)
+			}
+			var err error
+			if payload, err = enc.Open(payload, walAAD); err != nil {
+				return segment, -1, fmt.Errorf("%s: record at byte %d: %w", segment.Name, offset, err)
+			}
+		}
+		var event Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return segment, -1, corrupt(offset, "record does not decode: %v", err)
+		}
+		if fn != nil {
+			if err := fn(event); err != nil {
+				return segment, -1, err
+			}
+		}
+		if segment.Records == 0 {
+			segment.FirstVersion = event.Version
+		}
+		segment.Records++
+		segment.LastVersion = event.Version
+		crc = crc32.Update(crc, castagnoli, rest[:end])
+		offset += end
+	}
+	return segment, -1, nil
+}
+
+// Append records the event of an applied operation, rotating to a new
+// segment first if the current one is full or old enough. Once an append
+// failed every later one fails too, see Err. The record is not flushed to
+// disk yet: with SyncAlways, Sync waits until it is.
+func (w *WAL) Append(event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	if w.opts.Encryptor != nil {
+		if payload, err = w.opts.Encryptor.Seal(payload, walAAD); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.written++ // counted even if it fails, for Sync to report it
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.size >= w.opts.SegmentSize || w.opts.SegmentAge > 0 && w.opts.Clock.Now().Sub(w.created) >= w.opts.SegmentAge {
+		if err := w.sealCurrent(); err != nil {
+			return w.fail(err)
+		}
+		if err := w.rotate(); err != nil {
+			return w.fail(err)
+		}
+	}
+
+	record := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.Checksum(payload, castagnoli))
+	record = append(record, payload...)
+	if _, err := w.file.Write(record); err != nil {
+		return w.fail(err)
+	}
+
+	w.size += int64(len(record))
+	w.crc = crc32.Update(w.crc, castagnoli, record)
+	w.pending++
+	current := &w.segments[len(w.segments)-1]
+	if current.Records == 0 {
+		current.FirstVersion = event.Version
+	}
+	current.Records++
+	current.LastVersion = event.Version
+	return nil
+}
+
+// Written returns how many records were appended so far, to wait for them
+// with Sync. It is nil safe.
+func (w *WAL) Written() uint64 {
+	if w == nil {
+		return 0
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.written
+}
+
+// Sync waits until the first written records are flushed to disk, with
+// SyncAlways, and returns at once otherwise. Callers waiting at the same
+// time share a flush, which is group commit: the first one becomes the
+// leader of a group, waits GroupWindow for more records, then flushes
+// every record written so far for all of them. The log is not locked
+// during the flush, so records keep being appended for the next group. It
+// must be called without holding the state lock, or no other operation
+// could join the group, and is nil safe. It fails, wrapping ErrWALFailed,
+// if the records could not be appended or flushed.
+func (w *WAL) Sync(written uint64) error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.opts.Sync == SyncAlways && w.synced < written && w.err == nil {
+		if w.flushing {
+			w.flushed.Wait()
+		} else {
+			_ = w.flushGroup() // see w.err
+		}
+	}
+	if w.failed > 0 && written >= w.failed || w.opts.Sync == SyncAlways && w.synced < written {
+		return w.err
+	}
+	return nil
+}
+
+// flushGroup flushes the records written, as the leader of a group. w.mu
+// must be held; it is released while waiting for the group and flushing.
+// A failed flush is sticky, see Err.
+func (w *WAL) flushGroup() error {
+	w.flushing = true
+	defer func() {
+		w.flushing = false
+		w.flushed.Broadcast()
+	}()
+
+	if w.opts.GroupWindow > 0 {
+		w.mu.Unlock()
+		time.Sleep(w.opts.GroupWindow)
+		w.mu.Lock()
+	}
+	// The segment is not sealed while flushing, so the file stays open.
+	file, written, batch := w.file, w.written, w.pending
+	if batch == 0 {
+		w.synced = written
+		return nil
+	}
+	w.mu.Unlock()
+	start := time.Now()
+	err := file.Sync()
+	latency := time.Since(start)
+	w.mu.Lock()
+	if err != nil {
+		return w.fail(err)
+	}
+	w.recordFlush(written, batch, latency)
+	return nil
+}
+
+// flush makes the records written so far durable, holding w.mu.
+func (w *WAL) flush() error {
+	if w.pending == 0 || w.file == nil {
+		return nil
+	}
+	start := time.Now()
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.recordFlush(w.written, w.pending, time.Since(start))
+	return nil
+}
+
+// recordFlush records that a flush of batch records, the last ones up to
+// written, took latency. w.mu must be held.
+func (w *WAL) recordFlush(written uint64, batch int, latency time.Duration) {
+	w.synced = max(w.synced, written)
+	w.flushed.Broadcast()
+	w.pending -= batch
+	w.latency += latency
+	w.stats.Flushes++
+	w.stats.Records += batch
+	w.stats.MaxBatch = max(w.stats.MaxBatch, batch)
+	w.stats.LastLatency = latency
+	w.stats.MeanLatency = w.latency / time.Duration(w.stats.Flushes)
+	w.stats.MaxLatency = max(w.stats.MaxLatency, latency)
+}
+
+// flushEvery flushes the records written in each interval, for SyncBatch,
+// until Close.
+func (w *WAL) flushEvery(interval time.Duration) {
+	defer close(w.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+		w.mu.Lock()
+		if w.err == nil {
+			if err := w.flush(); err != nil {
+				fmt.Println("WAL Error:", w.fail(err))
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// fail makes err sticky, unless another failure came first, and the
+// records not flushed yet lost. w.mu must be held.
+func (w *WAL) fail(err error) error {
+	if w.err == nil {
+		w.err = fmt.Errorf("%w: %v", ErrWALFailed, err)
+		w.failed = w.synced + 1
+	}
+	return w.err
+}
+
+// durableRecords returns how many of the records appended since opened
+// were flushed.
+func (w *WAL) durableRecords() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.synced
+}
+
+// keptRecords returns how many of the records appended since opened the log
+// keeps: all of them, unless a failure lost those not flushed before.
+func (w *WAL) keptRecords() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed > 0 {
+		return w.failed - 1
+	}
+	return w.written
+}
+
+// Err returns the error of the first failed append, wrapping ErrWALFailed,
+// or nil. It is nil safe.
+func (w *WAL) Err() error {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// rotate starts a new segment, named after the one before so names sort
+// in order. w.mu must be held.
+func (w *WAL) rotate() error {
+	next := 1
+	if n := len(w.segments); n > 0 {
+		last, err := strconv.Atoi(strings.TrimSuffix(w.segments[n-1].Name, walSegmentExt))
+		if err != nil {
+			return fmt.Errorf("segment %s is not named by number: %w", w.segments[n-1].Name, err)
+		}
+		next = last + 1
+	}
+	name := fmt.Sprintf("%016d%s", next, walSegmentExt)
+	f, err := os.OpenFile(filepath.Join(w.dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(walMagic); err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.size, w.crc, w.created = f, int64(len(walMagic)), 0, w.opts.Clock.Now()
+	w.segments = append(w.segments, WALSegment{Name: name})
+	return nil
+}
+
+// sealCurrent writes the footer of the current segment and closes it. w.mu
+// must be held.
+func (w *WAL) sealCurrent() error {
+	for w.flushing {
+		w.flushed.Wait()
+	}
+	if w.file == nil {
+		return nil
+	}
+	segment := &w.segments[len(w.segments)-1]
+	_, err := w.file.Write(walFooter(*segment, w.crc))
+	if err == nil && w.opts.Sync != SyncAsync {
+		// The footer is flushed with the records not flushed yet, if any.
+		if w.pending > 0 {
+			err = w.flush()
+		} else {
+			err = w.file.Sync()
+		}
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	if err == nil {
+		segment.Sealed = true
+	}
+	return err
+}
+
+// sealFile seals a segment left open by a crash.
+func (w *WAL) sealFile(segment *WALSegment) error {
+	path := filepath.Join(w.dir, segment.Name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(walFooter(*segment, crc32.Checksum(data[len(walMagic):], castagnoli)))
+	if err == nil && w.opts.Sync != SyncAsync {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		segment.Sealed = true
+	}
+	return err
+}
+
+func walFooter(segment WALSegment, crc uint32) []byte {
+	footer := make([]byte, 0, walFooterSize)
+	footer = binary.BigEndian.AppendUint32(footer, walFooterMarker)
+	footer = binary.BigEndian.AppendUint64(footer, uint64(segment.Records))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(segment.FirstVersion))
+	footer = binary.BigEndian.AppendUint64(footer, uint64(segment.LastVersion))
+	footer = binary.BigEndian.AppendUint32(footer, crc)
+	return binary.BigEndian.AppendUint32(footer, crc32.Checksum(footer, castagnoli))
+}
+
+// Status describes the log: its sync policy, its segments and its
+// flushes so far.
+func (w *WAL) Status() WALStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return WALStatus{Sync: w.opts.Sync, Segments: slices.Clone(w.segments), Flush: w.stats}
+}
+
+// Segments describes the segments of the log, oldest first.
+func (w *WAL) Segments() []WALSegment {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return slices.Clone(w.segments)
+}
+
+// Close seals the current segment, or removes it if empty. The log cannot
+// be appended to after.
+func (w *WAL) Close() error {
+	if w.stop != nil {
+		select {
+		case <-w.stop:
+		default:
+			close(w.stop)
+		}
+		<-w.done
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = fmt.Errorf("%w: closed", ErrWALFailed)
+	}
+	if n := len(w.segments); w.file != nil && w.segments[n-1].Records == 0 {
+		err := w.file.Close()
+		w.file = nil
+		if removeErr := os.Remove(filepath.Join(w.dir, w.segments[n-1].Name)); err == nil {
+			err = removeErr
+		}
+		w.segments = w.segments[:n-1]
+		return err
+	}
+	return w.sealCurrent()
+}
+
+// Replay calls fn with the events of the log after version, oldest first,
+// checking every record against its checksum. As a rollback takes the
+// version back, events are replayed from the last one leaving the state at
+// version, or from the first one past it if none did.
+func (w *WAL) Replay(after int, fn func(Event) error) error {
+	segments := w.Segments()
+	scan := func(fn func(Event) error) error {
+		for _, segment := range segments {
+			if segment.Records == 0 {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(w.dir, segment.Name))
+			if err != nil {
+				return err
+			}
+			// The segment being written ends without a footer.
+			if _, _, err := scanSegment(segment.Name, data, !segment.Sealed, w.opts.Encryptor, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	from := -1 // the index of the first event to replay, -1 for those past after
+	i := 0
+	err := scan(func(event Event) error {
+		i++
+		if event.Version == after {
+			from = i
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	i = 0
+	return scan(func(event Event) error {
+		i++
+		if from < 0 && event.Version <= after || from >= 0 && i <= from {
+			return nil
+		}
+		return fn(event)
+	})
+}
+
+// ArchiveSegments uploads the sealed segments not archived yet to store
+// under prefix, compressed with c, and returns their keys. Segments are
+// immutable once sealed, so each is uploaded once.
+func (w *WAL) ArchiveSegments(ctx context.Context, store ObjectStore, prefix string, c Compression) ([]string, error) {
+	archived, err := store.List(ctx, prefix+"wal/")
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, segment := range w.Segments() {
+		key := prefix + "wal/" + segment.Name
+		if !segment.Sealed || slices.Contains(archived, key) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(w.dir, segment.Name))
+		if err != nil {
+			return keys, err
+		}
+		if data, err = Compress(c, data); err != nil {
+			return keys, err
+		}
+		if err := store.Put(ctx, key, data); err != nil {
+			return keys, fmt.Errorf("archive %s: %w", key, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// RemoveSegments deletes the sealed segments holding only events up to
+// version, e.g. once a snapshot at that version is persisted, and returns
+// their names.
+func (w *WAL) RemoveSegments(version int) ([]string, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var removed []string
+	for len(w.segments) > 1 && w.segments[0].Sealed && w.segments[0].LastVersion <= version {
+		if err := os.Remove(filepath.Join(w.dir, w.segments[0].Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		removed = append(removed, w.segments[0].Name)
+		w.segments = w.segments[1:]
+	}
+	return removed, nil
+}
+
+// UseWAL records the event of every later operation in w, before the
+// operation is acknowledged. Once w fails to record one, it is undone, with
+// the operations w lost, see revertUnlogged, and it and later operations
+// fail with ErrWALFailed, as they would not be durable. Replay w with
+// ReplayWAL first. It must be called before operations start.
+func (sm *StateMachine) UseWAL(w *WAL) {
+	sm.wal = w
+}
+
+// unlogged is how to undo a change to the state, as long as the write-ahead
+// log may not keep it, see revertUnlogged.
+type unlogged struct {
+	record uint64 // in the log, of the last operation of the change, 0 until logged
+	undo   func() error
+}
+
+// onRevert registers how to undo a change to the state, if a write-ahead
+// log is used. sm.mu must be held.
+func (sm *StateMachine) onRevert(undo func() error) {
+	if sm.wal != nil {
+		sm.unlogged = append(sm.unlogged, unlogged{undo: undo})
+	}
+}
+
+// onRevertRollback registers how to undo a rollback about to be applied,
+// which history cannot do as the rollback forgets the states undone. sm.mu
+// must be held.
+func (sm *StateMachine) onRevertRollback() {
+	if sm.wal == nil {
+		return
+	}
+	accounts, history, journal, version := maps.Clone(sm.accounts), sm.history, slices.Clone(sm.journal), sm.version
+	history.entries = slices.Clone(history.entries)
+	sm.onRevert(func() error {
+		sm.accounts, sm.history, sm.journal, sm.version = accounts, history, journal, version
+		sm.opIndex.rebuild(sm.journal, sm.opIndex.start)
+		return nil
+	})
+}
+
+// logged records that the changes registered so far were recorded by the
+// first written records of the write-ahead log, and forgets those flushed,
+// which the log keeps. sm.mu must be held.
+func (sm *StateMachine) logged(written uint64) {
+	if sm.wal == nil {
+		return
+	}
+	for i := len(sm.unlogged) - 1; i >= 0 && sm.unlogged[i].record == 0; i-- {
+		sm.unlogged[i].record = written
+	}
+	durable := sm.wal.durableRecords()
+	i := 0
+	for i < len(sm.unlogged) && sm.unlogged[i].record <= durable {
+		i++
+	}
+	sm.unlogged = sm.unlogged[i:]
+}
+
+// revertUnlogged undoes, newest first, the changes to the state the
+// write-ahead log failed to record or lost with a failure, so the state is
+// the one replaying the log restores rather than one no replay would. sm.mu
+// must be held.
+func (sm *StateMachine) revertUnlogged() error {
+	kept := sm.wal.keptRecords()
+	var err error
+	for n := len(sm.unlogged); n > 0 && err == nil; n-- {
+		change := sm.unlogged[n-1]
+		if change.record != 0 && change.record <= kept {
+			break
+		}
+		sm.unlogged = sm.unlogged[:n-1]
+		err = change.undo()
+	}
+	sm.balanceIndex.invalidate()
+	sm.storeState()
+	sm.alerts.restore(sm.alerts.defined, sm.accounts)
+	sm.endEpoch()
+	return err
+}
+
+// ReplayWAL brings the state machine up to date with the events w recorded
+// after its version, e.g. after restoring the latest snapshot or backup, as
+// a replica applies those of its leader, and returns how many it replayed.
+// It must be called before UseWAL.
+func (sm *StateMachine) ReplayWAL(w *WAL) (int, error) {
+	replayed := 0
+	err := w.Replay(sm.Version(), func(event Event) error {
+		sm.applyReplicated(event)
+		replayed++
+		return nil
+	})
+	return replayed, err
+}
+
+// ReadWALSegment returns the events of a segment, as archived by
+// ArchiveSegments, checking its checksums and footer. Sealed records are
+// opened with enc, see WALOptions.Encryptor.
+func ReadWALSegment(r io.Reader, enc *Encryptor) ([]Event, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = Decompress(data); err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	segment, _, err := scanSegment("archived segment", data, false, enc, func(event Event) error {
+		events = append(events, event)
+		return nil
+	})
+	if err == nil && !segment.Sealed {
+		err = &WALCorruptError{Segment: segment.Name, Offset: int64(len(data)), Reason: "no footer"}
+	}
+	return events, err
+}
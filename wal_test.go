@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// walMachine returns a state machine recording its operations in a new
+// write-ahead log in dir.
+func walMachine(t *testing.T, dir string, opts WALOptions) (*StateMachine, *WAL) {
+	t.Helper()
+	w, err := OpenWAL(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+	sm.UseWAL(w)
+	return sm, w
+}
+
+// replayWAL returns a state machine with the initial state of walMachine,
+// brought up to date with the log in dir.
+func replayWAL(t *testing.T, dir string) (*StateMachine, int, error) {
+	t.Helper()
+	w, err := OpenWAL(dir, WALOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	t.Cleanup(func() { w.Close() })
+	sm := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+	n, err := sm.ReplayWAL(w)
+	return sm, n, err
+}
+
+func TestWALReplay(t *testing.T) {
+	quiet(t)
+
+	dir := t.TempDir()
+	sm, w := walMachine(t, dir, WALOptions{SegmentSize: 1024})
+	for i := range 20 {
+		if err := sm.Transfer("acc1", "acc2", i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sm.OpenAccount("acc3", 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Transfer("acc3", "acc1", 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.ArchiveAccount("acc3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := w.Segments()
+	if len(segments) < 2 {
+		t.Fatalf("%d segments of at most 1 KiB; want the log rotated", len(segments))
+	}
+	for i, segment := range segments {
+		if !segment.Sealed || i > 0 && segment.FirstVersion != segments[i-1].LastVersion+1 {
+			t.Errorf("segment %+v after %+v; want sealed and following on", segment, segments[max(i-1, 0)])
+		}
+	}
+
+	restored, n, err := replayWAL(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 24 || restored.Version() != sm.Version() {
+		t.Errorf("replayed %d operations to version %d; want 24 to %d", n, restored.Version(), sm.Version())
+	}
+	if got, want := restored.Balances(), sm.Balances(); !maps.Equal(got, want) {
+		t.Errorf("Balances() = %v; want %v", got, want)
+	}
+
+	// Operations are replayed after the version of a restored state, the
+	// last time the state was at it: version 21 was left by the opening of
+	// acc3, then by the rollback.
+	for version, want := range map[int]int{20: 4, 21: 1, 22: 0} {
+		n := 0
+		if err := w.Replay(version, func(Event) error { n++; return nil }); err != nil || n != want {
+			t.Errorf("Replay(%d) = %d operations, %v; want %d", version, n, err, want)
+		}
+	}
+}
+
+func TestWALReplayBuckets(t *testing.T) {
+	quiet(t)
+
+	dir := t.TempDir()
+	sm, w := walMachine(t, dir, WALOptions{})
+	if err := sm.Move("acc1", "", "reserved", 800); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Move("acc1", "reserved", "bonus", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Transfer("acc1", "acc2", 150); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, _, err := replayWAL(t, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{BucketAvailable: 50, "reserved": 800}
+	if buckets, err := restored.Buckets("acc1"); err != nil || !maps.Equal(buckets, want) {
+		t.Errorf("Buckets() = %v, %v; want %v", buckets, err, want)
+	}
+
+	// Rolling back the replayed state restores the buckets as well.
+	if err := restored.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]int{BucketAvailable: 200, "reserved": 800}
+	if buckets, err := restored.Buckets("acc1"); err != nil || !maps.Equal(buckets, want) {
+		t.Errorf("Buckets() after rollback = %v, %v; want %v", buckets, err, want)
+	}
+	if err := restored.Withdraw("acc1", 500); !errors.Is(err, ErrInsufficientBalance) {
+		t.Errorf("Withdraw() of reserved money = %v; want %v", err, ErrInsufficientBalance)
+	}
+}
+
+func TestWALRotation(t *testing.T) {
+	quiet(t)
+
+	clock := NewFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	sm, w := walMachine(t, t.TempDir(), WALOptions{SegmentAge: time.Hour, Clock: clock})
+	defer w.Close()
+
+	_ = sm.Deposit("acc1", 1)
+	clock.Advance(59 * time.Minute)
+	_ = sm.Deposit("acc1", 1)
+	if n := len(w.Segments()); n != 1 {
+		t.Errorf("%d segments within the hour; want 1", n)
+	}
+	clock.Advance(time.Minute)
+	_ = sm.Deposit("acc1", 1)
+
+	segments := w.Segments()
+	if len(segments) != 2 || !segments[0].Sealed || segments[0].Records != 2 || segments[1].Records != 1 {
+		t.Errorf("Segments() = %+v; want 2 records in a sealed segment, then 1", segments)
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	quiet(t)
+
+	// crashed returns the directory of a log of 10 operations in 2
+	// segments, the last one left open.
+	crashed := func(t *testing.T) (string, []WALSegment) {
+		dir := t.TempDir()
+		sm, w := walMachine(t, dir, WALOptions{SegmentSize: 512})
+		for range 10 {
+			_ = sm.Transfer("acc1", "acc2", 10)
+		}
+		w.file.Close()
+		segments := w.Segments()
+		if len(segments) < 2 {
+			t.Fatalf("%d segments; want at least 2", len(segments))
+		}
+		return dir, segments
+	}
+	appendTo := func(t *testing.T, path string, data []byte) {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Open segment", func(t *testing.T) {
+		dir, _ := crashed(t)
+		if _, n, err := replayWAL(t, dir); err != nil || n != 10 {
+			t.Errorf("replayed %d operations, %v; want 10", n, err)
+		}
+	})
+
+	t.Run("Torn tail", func(t *testing.T) {
+		dir, segments := crashed(t)
+		last := filepath.Join(dir, segments[len(segments)-1].Name)
+		appendTo(t, last, []byte{0, 0, 0, 40, 1, 2, 3, 4, '{'}) // a record cut short
+
+		sm, n, err := replayWAL(t, dir)
+		if err != nil || n != 10 || sm.accounts["acc2"] != 100 {
+			t.Errorf("replayed %d operations to %v, %v; want the 10 before the torn record", n, sm, err)
+		}
+	})
+
+	t.Run("Torn while created", func(t *testing.T) {
+		dir, segments := crashed(t)
+		appendTo(t, filepath.Join(dir, "0000000000000099.wal"), walMagic[:3])
+		if _, n, err := replayWAL(t, dir); err != nil || n != 10 {
+			t.Errorf("replayed %d operations, %v; want 10", n, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "0000000000000099.wal")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("segment torn while created left after %v", segments)
+		}
+	})
+
+	corrupt := map[string]func(data []byte) []byte{
+		"Record": func(data []byte) []byte {
+			data[len(walMagic)+walHeaderSize+2] ^= 0x20
+			return data
+		},
+		"Footer": func(data []byte) []byte {
+			data[len(data)-walFooterSize+5] ^= 1
+			return data
+		},
+		"Truncated": func(data []byte) []byte {
+			return data[:len(data)-walFooterSize-3]
+		},
+	}
+	for name, corrupt := range corrupt {
+		t.Run("Corrupt "+name, func(t *testing.T) {
+			dir, segments := crashed(t)
+			first := filepath.Join(dir, segments[0].Name)
+			data, _ := os.ReadFile(first)
+			if err := os.WriteFile(first, corrupt(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := OpenWAL(dir, WALOptions{})
+			var corruptErr *WALCorruptError
+			if !errors.Is(err, ErrWALCorrupt) || !errors.As(err, &corruptErr) || corruptErr.Segment != segments[0].Name {
+				t.Errorf("OpenWAL() error = %v; want %s corrupt", err, segments[0].Name)
+			}
+		})
+	}
+}
+
+func TestWALFailure(t *testing.T) {
+	quiet(t)
+
+	sm, w := walMachine(t, t.TempDir(), WALOptions{})
+	_ = sm.Deposit("acc1", 10)
+	version := sm.Version()
+	w.file.Close() // appends fail from now on
+
+	for name, run := range map[string]func() error{
+		"Operation":   func() error { return sm.Deposit("acc1", 10) },
+		"Transaction": func() error { return sm.Tx(func(tx *Tx) error { return tx.Deposit("acc1", 10) }) },
+		"Rollback":    sm.Rollback,
+		"Message": func() error {
+			_, err := sm.Apply(Operation{Type: OpDeposit, To: "acc1", Amount: 10, MessageID: "m1"})
+			return err
+		},
+		"Status": func() error { return sm.SetAccountStatus("acc1", StatusRestricted, "") },
+	} {
+		if err := run(); !errors.Is(err, ErrWALFailed) {
+			t.Errorf("%s error = %v; want %v", name, err, ErrWALFailed)
+		}
+	}
+	if err := w.Err(); !errors.Is(err, ErrWALFailed) {
+		t.Fatalf("Err() = %v; want %v", err, ErrWALFailed)
+	}
+	if got := sm.accounts["acc1"]; got != 1010 {
+		t.Errorf("acc1 = %d; want 1010, none of the operations that failed to be recorded applied", got)
+	}
+	if got, _ := sm.Balance("acc1"); got != 1010 {
+		t.Errorf("Balance(acc1) = %d; want 1010", got)
+	}
+	if got := sm.Version(); got != version {
+		t.Errorf("Version() = %d; want %d", got, version)
+	}
+	if got, _ := sm.AccountStatus("acc1"); got != StatusActive {
+		t.Errorf("AccountStatus(acc1) = %s; want %s", got, StatusActive)
+	}
+	if _, ok := sm.ProcessedMessage("m1"); ok {
+		t.Error("message m1 is processed; want it forgotten with its operation")
+	}
+	if ops := sm.Operations(); len(ops) != 1 {
+		t.Errorf("Operations() = %+v; want the deposit recorded only", ops)
+	}
+}
+
+func TestWALArchive(t *testing.T) {
+	quiet(t)
+
+	sm, w := walMachine(t, t.TempDir(), WALOptions{SegmentSize: 512})
+	defer w.Close()
+	for range 10 {
+		_ = sm.Transfer("acc1", "acc2", 10)
+	}
+
+	store := &memStore{}
+	keys, err := w.ArchiveSegments(context.Background(), store, "vf/", CompressionSnappy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments := w.Segments()
+	if len(keys) != len(segments)-1 {
+		t.Fatalf("archived %v; want every segment but the one being written of %+v", keys, segments)
+	}
+	var versions []int
+	for _, key := range keys {
+		events, err := ReadWALSegment(bytes.NewReader(store.objects[key]), nil)
+		if err != nil {
+			t.Fatalf("ReadWALSegment(%s) error = %v", key, err)
+		}
+		for _, event := range events {
+			versions = append(versions, event.Version)
+		}
+	}
+	for i, v := range versions {
+		if v != i+1 {
+			t.Fatalf("archived versions %v; want 1 onwards", versions)
+		}
+	}
+	if keys, err := w.ArchiveSegments(context.Background(), store, "vf/", CompressionSnappy); err != nil || len(keys) != 0 {
+		t.Errorf("ArchiveSegments() again = %v, %v; want nothing archived", keys, err)
+	}
+
+	removed, err := w.RemoveSegments(segments[0].LastVersion)
+	if err != nil || len(removed) != 1 || removed[0] != segments[0].Name {
+		t.Errorf("RemoveSegments(%d) = %v, %v; want %s", segments[0].LastVersion, removed, err, segments[0].Name)
+	}
+	if _, err := ReadWALSegment(bytes.NewReader(walMagic), nil); !errors.Is(err, ErrWALCorrupt) {
+		t.Errorf("ReadWALSegment() of a segment without footer = %v; want %v", err, ErrWALCorrupt)
+	}
+}
+
+func TestWALEncryption(t *testing.T) {
+	quiet(t)
+
+	keys, err := NewKeyring("k1", bytes.Repeat([]byte{3}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := NewEncryptor(keys)
+	dir := t.TempDir()
+
+	// Records written before the log was encrypted still read.
+	sm, w := walMachine(t, dir, WALOptions{})
+	if err := sm.Deposit("acc1", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w, err = OpenWAL(dir, WALOptions{Encryptor: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.UseWAL(w)
+	if _, err := sm.Apply(Operation{Type: OpTransfer, From: "acc1", To: "acc2", Amount: 100, Memo: "confidential rent"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := w.Segments()
+	data, err := os.ReadFile(filepath.Join(dir, segments[len(segments)-1].Name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("confidential")) || bytes.Contains(data, []byte("acc2")) {
+		t.Errorf("encrypted segment holds plaintext: %q", data)
+	}
+	if events, err := ReadWALSegment(bytes.NewReader(data), enc); err != nil || len(events) != 1 || events[0].Operation.Memo != "confidential rent" {
+		t.Errorf("ReadWALSegment() = %+v, %v; want the transfer", events, err)
+	}
+	if _, err := ReadWALSegment(bytes.NewReader(data), nil); err == nil {
+		t.Errorf("ReadWALSegment() without the encryptor succeeded")
+	}
+
+	w, err = OpenWAL(dir, WALOptions{Encryptor: enc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	restored := &StateMachine{accounts: map[string]int{"acc1": 1000, "acc2": 0}}
+	if n, err := restored.ReplayWAL(w); err != nil || n != 2 {
+		t.Fatalf("ReplayWAL() = %d, %v; want 2 operations", n, err)
+	}
+	if got, want := restored.Balances(), sm.Balances(); !maps.Equal(got, want) {
+		t.Errorf("Balances() = %v; want %v", got, want)
+	}
+	if _, err := OpenWAL(dir, WALOptions{}); err == nil {
+		t.Errorf("OpenWAL() of an encrypted log without the encryptor succeeded")
+	}
+}
+
+func TestWALSync(t *testing.T) {
+	quiet(t)
+
+	tests := []struct {
+		sync        SyncPolicy
+		wantFlushes int
+		wantBatch   int
+	}{
+		{SyncAlways, 10, 1}, // each record as written
+		{SyncBatch, 1, 10},  // every record at once, when sealed
+		{SyncAsync, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.sync), func(t *testing.T) {
+			sm, w := walMachine(t, t.TempDir(), WALOptions{Sync: tt.sync, SyncInterval: time.Hour})
+			for range 10 {
+				_ = sm.Deposit("acc1", 1)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+			status := w.Status()
+			if status.Sync != tt.sync || status.Flush.Flushes != tt.wantFlushes || status.Flush.MaxBatch != tt.wantBatch {
+				t.Errorf("Status() = %+v; want %d flushes of at most %d records", status, tt.wantFlushes, tt.wantBatch)
+			}
+		})
+	}
+
+	t.Run("Batch interval", func(t *testing.T) {
+		sm, w := walMachine(t, t.TempDir(), WALOptions{Sync: SyncBatch, SyncInterval: time.Millisecond})
+		defer w.Close()
+		_ = sm.Deposit("acc1", 1)
+		for deadline := time.Now().Add(5 * time.Second); w.Status().Flush.Records == 0; time.Sleep(time.Millisecond) {
+			if time.Now().After(deadline) {
+				t.Fatal("record not flushed within the interval")
+			}
+		}
+	})
+
+	if _, err := OpenWAL(t.TempDir(), WALOptions{Sync: "never"}); !errors.Is(err, ErrInvalidSyncPolicy) {
+		t.Errorf("OpenWAL(never) error = %v; want %v", err, ErrInvalidSyncPolicy)
+	}
+}
+
+func TestServerWAL(t *testing.T) {
+	srv, sm := newTestServer(map[string]int{"acc1": 100})
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/wal", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("GET /wal without a log = %d; want %d", rec.Code, http.StatusNotFound)
+	}
+
+	w, err := OpenWAL(t.TempDir(), WALOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	sm.UseWAL(w)
+	_ = sm.Deposit("acc1", 1)
+
+	rec = httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/wal", nil))
+	var status WALStatus
+	if err := json.NewDecoder(rec.Body).Decode(&status); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("GET /wal = %d, %v", rec.Code, err)
+	}
+	if status.Sync != SyncAlways || len(status.Segments) != 1 || status.Flush.Records != 1 {
+		t.Errorf("GET /wal = %+v; want 1 record flushed", status)
+	}
+}
+
+func TestWALGroupCommit(t *testing.T) {
+	quiet(t)
+
+	sm, w := walMachine(t, t.TempDir(), WALOptions{GroupWindow: 5 * time.Millisecond})
+	defer w.Close()
+
+	const operations = 50
+	var wg sync.WaitGroup
+	for range operations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sm.Deposit("acc1", 1); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every operation was flushed before being acknowledged, sharing flushes.
+	flush := w.Status().Flush
+	if flush.Records != operations || flush.Flushes >= operations || flush.MaxBatch < 2 {
+		t.Errorf("%d records in %d flushes of at most %d; want %d in fewer, shared flushes", flush.Records, flush.Flushes, flush.MaxBatch, operations)
+	}
+
+	w.mu.Lock()
+	w.file.Close() // the next flush fails
+	w.mu.Unlock()
+	if err := sm.Deposit("acc1", 1); !errors.Is(err, ErrWALFailed) {
+		t.Errorf("Deposit() error = %v; want %v once the flush failed", err, ErrWALFailed)
+	}
+}